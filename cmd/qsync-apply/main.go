@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/holiman/qvm-sync/packer"
+)
+
+func init() {
+	packer.SetupLogging()
+}
+
+// defaultReceiver is the preloader, as installed by install.sh
+const defaultReceiver = "/usr/local/bin/qsync-preloader"
+
+// qsync-apply applies a batch written by qsync-send -batch-out, e.g. after
+// carrying it over on removable media:
+//
+//	qsync-send -batch-out /media/usb/photos.qsync /home/user/photos
+//	qsync-apply -source usb /media/usb/photos.qsync
+//
+// By default, the batch is applied by the preloader, which runs a jailed
+// receiver in the jail of the given source, /home/user/QubesSync/usb.
+//
+// For incremental batches, the destination is described first, and the
+// description is given to qsync-send with -batch-against:
+//
+//	qsync-apply -describe -dest /home/user/QubesSync/usb > /media/usb/dest.json
+//
+// With -import, a tar or zip archive is applied instead of a batch: the
+// destination is synced to the archive, and files which aren't in it are
+// deleted, as with any sync.
+//
+//	qsync-apply -import -source usb /media/usb/photos.tar
+func main() {
+	dest := flag.String("dest", ".", "`directory` to apply the batch to, with -unsafe-in-process or a -receiver which doesn't jail itself")
+	describe := flag.Bool("describe", false, "write a description of the destination to stdout, instead of applying a batch")
+	receiver := flag.String("receiver", defaultReceiver, "`command` (space-separated) to apply the batch with")
+	source := flag.String("source", "batch", "`name` of the source, which selects the jail of the preloader")
+	inProcess := flag.Bool("unsafe-in-process", false, "apply the batch in this process, without a jail")
+	trustedKey := flag.String("trusted-key", "", "base64 public `key` which the batch must be signed with, with -unsafe-in-process")
+	audit := flag.Bool("audit", false, "keep an audit log of all changes in .qsync/audit.log, with -unsafe-in-process")
+	archive := flag.String("archive", "", "write the tree of the batch to the archive `file` (tar, or zip if named .zip), instead of applying it")
+	importArchive := flag.Bool("import", false, "apply a tar or zip archive (zip if named .zip) instead of a batch")
+	name := flag.String("name", "", "`directory` to place the content of the archive in, with -import (default: the only top-level directory of the archive)")
+	verbosity := flag.Uint("v", 3, "`verbosity`: 0=None, 1=Error, 2=Warn, 3=Info, 4=Debug, 5=Trace")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n %s [options] batchfile\n %s -import [-name dir] [options] archive\n %s -describe [-dest dir]\nOptions:\n", os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *describe {
+		if err := packer.DescribeDestination(os.Stdout, *dest); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.NArg() < 1 {
+		fmt.Fprintf(flag.CommandLine.Output(), "Error: batch file not supplied\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	var (
+		err   error
+		apply func(ropts *packer.ReceiverOptions) error
+		send  func(out io.Writer, in io.Reader) error
+	)
+	if *importArchive {
+		if *archive != "" || *trustedKey != "" {
+			log.Fatal("Options -archive and -trusted-key can't be used with -import")
+		}
+		a, err := packer.OpenArchive(flag.Arg(0), *name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer a.Close()
+		opts := packer.NewOptions(packer.WithVerbosity(int(*verbosity)), packer.WithCompression(packer.CompressionOff))
+		apply = func(ropts *packer.ReceiverOptions) error {
+			return packer.ApplyArchive(a, *name, ropts, opts)
+		}
+		send = func(out io.Writer, in io.Reader) error {
+			s, err := packer.NewArchiveSender(out, in, a, opts)
+			if err != nil {
+				return err
+			}
+			return s.Sync(*name)
+		}
+	} else {
+		batch, err := os.Open(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer batch.Close()
+		apply = func(ropts *packer.ReceiverOptions) error {
+			return packer.ApplyBatch(batch, ropts, int(*verbosity))
+		}
+		send = func(out io.Writer, in io.Reader) error {
+			return packer.ReplayBatch(batch, out, in, int(*verbosity))
+		}
+	}
+	if *archive != "" {
+		// Nothing but the archive is written, no jail is needed
+		err = applyToArchive(apply, *archive)
+	} else if *inProcess {
+		err = applyHere(apply, *dest, *audit, *trustedKey)
+	} else {
+		if *audit || *trustedKey != "" {
+			log.Fatal("Options -audit and -trusted-key require -unsafe-in-process, configure the receiver instead")
+		}
+		err = applyWith(send, strings.Fields(*receiver), *dest, *source)
+	}
+	if err != nil {
+		log.Fatalf("Error applying %v: %v", flag.Arg(0), err)
+	}
+	log.Print("All done")
+}
+
+// applyHere applies the batch or archive with a receiver in this process.
+func applyHere(apply func(*packer.ReceiverOptions) error, dest string, audit bool, trustedKey string) error {
+	if err := os.Chdir(dest); err != nil {
+		return err
+	}
+	ropts := &packer.ReceiverOptions{
+		AuditLog:        audit,
+		AuditLogMaxSize: packer.DefaultAuditLogSize,
+	}
+	if trustedKey != "" {
+		key, err := packer.ParsePublicKey(trustedKey)
+		if err != nil {
+			return err
+		}
+		ropts.TrustedKey = key
+	}
+	return apply(ropts)
+}
+
+// applyToArchive writes the tree of the batch to an archive. As it's written
+// from scratch, the batch should not be incremental.
+func applyToArchive(apply func(*packer.ReceiverOptions) error, name string) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	ropts := &packer.ReceiverOptions{
+		Archive:       f,
+		ArchiveFormat: packer.ArchiveFormat(name),
+	}
+	err = apply(ropts)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+// applyWith applies the batch or archive, sent by send, with the given
+// receiver command, run in dest. The source is passed as the calling qube, as
+// qrexec would.
+func applyWith(send func(out io.Writer, in io.Reader) error, command []string, dest, source string) error {
+	if len(command) == 0 {
+		return fmt.Errorf("no receiver given")
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = dest
+	cmd.Env = append(os.Environ(), "QREXEC_REMOTE_DOMAIN="+source)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	in, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	err = send(out, in)
+	out.Close()
+	if wErr := cmd.Wait(); wErr != nil && err == nil {
+		err = fmt.Errorf("receiver failed: %v", wErr)
+	}
+	return err
+}
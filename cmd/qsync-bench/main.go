@@ -0,0 +1,202 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/holiman/qvm-sync/internal/treegen"
+	"github.com/holiman/qvm-sync/packer"
+)
+
+func init() {
+	packer.SetupLogging()
+}
+
+var (
+	compressions = map[string]int{"off": packer.CompressionOff, "snappy": packer.CompressionSnappy}
+	crcUsages    = map[string]int{"off": packer.FileCrcOff, "data": packer.FileCrcAtimeNsec, "metadata": packer.FileCrcAtimeNsecMetadata}
+)
+
+// qsync-bench measures syncs end-to-end, with the sender and receiver in
+// this process, connected by pipes. It generates a synthetic tree in two
+// versions, and for each combination of the compression and crc settings,
+// syncs the first version to an empty destination (initial), and then the
+// second (incremental):
+//
+//	qsync-bench -files 2000 -sizes 4k:70,64k:25,4M:5 -change 0.1 -compression off,snappy
+//
+// It reports the files and bytes sent, the time, the throughput (of file
+// content) and the cpu time used, by both sides.
+func main() {
+	files := flag.Int("files", 1000, "number of `files` in the tree")
+	dirs := flag.Int("dirs", 20, "number of `directories` the files are spread over")
+	depth := flag.Int("depth", 1, "`levels` the directories are nested in")
+	symlinks := flag.Float64("symlinks", 0, "`fraction` of the files which are symlinks instead")
+	sizes := flag.String("sizes", "4k:70,64k:25,1M:5", "file size `distribution`, as size:weight,...; files are 50-150% of the size")
+	contentKind := flag.String("content", "mixed", "file `content`: random (incompressible), text or mixed")
+	change := flag.Float64("change", 0.1, "`fraction` of the files changed between the syncs")
+	compression := flag.String("compression", "off,snappy", "compression `settings` to measure (off, snappy)")
+	crc := flag.String("crc", "off,data,metadata", "crc `settings` to measure (off, data, metadata)")
+	streams := flag.Int("streams", 1, "number of `streams` the file content is sent over")
+	compressors := flag.Int("compressors", 1, "number of `cores` the sender compresses on")
+	workers := flag.Int("workers", 1, "number of `files` the sender reads and hashes at once")
+	overlap := flag.Bool("overlap", false, "let the receiver request files while it still compares the metadata")
+	pack := flag.Bool("pack", false, "pack small files into frames")
+	mmap := flag.Bool("mmap", false, "map large files into memory to hash them, on both sides")
+	ioUring := flag.Bool("io-uring", false, "read and write large files through io_uring, on both sides")
+	seed := flag.Int64("seed", 1, "random `seed` for the tree")
+	workDir := flag.String("dir", "", "`directory` to generate the trees in (default: a temporary directory, removed afterwards)")
+	flag.Parse()
+
+	classes, err := treegen.ParseSizes(*sizes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	comps, err := settings(*compression, compressions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	crcs, err := settings(*crc, crcUsages)
+	if err != nil {
+		log.Fatal(err)
+	}
+	root := *workDir
+	if root == "" {
+		if root, err = ioutil.TempDir("", "qsync-bench"); err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+	}
+	spec := &treegen.Spec{
+		Seed:     *seed,
+		Files:    *files,
+		Dirs:     *dirs,
+		Depth:    *depth,
+		Sizes:    classes,
+		Content:  *contentKind,
+		Symlinks: *symlinks,
+		Change:   *change,
+	}
+	start := time.Now()
+	size, err := treegen.Generate(filepath.Join(root, "src"), spec)
+	if err != nil {
+		log.Fatalf("Generating the tree failed: %v", err)
+	}
+	log.Printf("Generated %d files, %v, in %v", *files, mb(uint64(size)), time.Since(start).Round(time.Millisecond))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "compression\tcrc\tsync\tfiles\tcontent\tsent\ttime\tMB/s\tcpu\t")
+	for _, comp := range comps {
+		for _, c := range crcs {
+			dest := filepath.Join(root, "dest-"+comp+"-"+c)
+			if err := os.Mkdir(dest, 0755); err != nil {
+				log.Fatal(err)
+			}
+			opts := packer.NewOptions(packer.WithVerbosity(0), packer.WithCompression(compressions[comp]), packer.WithCrcUsage(crcUsages[c]))
+			opts.Streams = *streams
+			opts.Workers = *workers
+			opts.Compressors = *compressors
+			opts.Overlap = *overlap
+			opts.Pack = *pack
+			opts.Mmap = *mmap
+			opts.IOUring = *ioUring
+			for _, phase := range []string{"base", "changed"} {
+				res, err := measure(filepath.Join(root, "src", phase, "tree"), dest, opts)
+				if err != nil {
+					log.Fatalf("Sync with compression %v, crc %v failed: %v", comp, c, err)
+				}
+				name := map[string]string{"base": "initial", "changed": "incremental"}[phase]
+				fmt.Fprintf(w, "%v\t%v\t%v\t%d\t%v\t%v\t%v\t%.1f\t%v\t\n", comp, c, name, res.files,
+					mb(res.bytes), mb(uint64(res.sent)), res.wall.Round(time.Millisecond),
+					float64(res.bytes)/1e6/res.wall.Seconds(), res.cpu.Round(time.Millisecond))
+			}
+			os.RemoveAll(dest)
+		}
+	}
+	w.Flush()
+}
+
+// settings parses a comma-separated list of setting names.
+func settings(list string, known map[string]int) ([]string, error) {
+	names := strings.Split(list, ",")
+	for _, name := range names {
+		if _, ok := known[name]; !ok {
+			return nil, fmt.Errorf("unknown setting %q", name)
+		}
+	}
+	return names, nil
+}
+
+// result is the outcome of a measured sync.
+type result struct {
+	files int
+	bytes uint64 // file content sent
+	sent  int    // bytes sent by the sender, after compression
+	wall  time.Duration
+	cpu   time.Duration // user and system, of both sides
+}
+
+// measure syncs the directory to dest, with a receiver in this process.
+func measure(dir, dest string, opts *packer.Options) (*result, error) {
+	res := new(result)
+	opts.Progress = func(path string, size uint64) {
+		res.files++
+		res.bytes += size
+	}
+	toReceiver, senderOut := io.Pipe()
+	senderIn, fromReceiver := io.Pipe()
+	errc := make(chan error, 1)
+	cpu, start := cpuTime(), time.Now()
+	go func() {
+		ropts := packer.NewReceiverOptions(packer.WithRoot(dest))
+		ropts.Mmap, ropts.IOUring = opts.Mmap, opts.IOUring
+		r, err := packer.NewReceiver(toReceiver, fromReceiver, ropts)
+		if err == nil {
+			err = r.Sync()
+		}
+		if err != nil {
+			toReceiver.CloseWithError(err)
+		}
+		fromReceiver.Close()
+		errc <- err
+	}()
+	s, err := packer.NewSender(senderOut, senderIn, opts)
+	if err == nil {
+		err = s.Sync(dir)
+		_, res.sent = s.Stats()
+	}
+	if err != nil {
+		senderOut.CloseWithError(err)
+	}
+	if rErr := <-errc; rErr != nil {
+		return nil, rErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.wall, res.cpu = time.Since(start), cpuTime()-cpu
+	return res, nil
+}
+
+// cpuTime returns the cpu time used by this process so far.
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// mb formats a size in MB.
+func mb(size uint64) string {
+	return fmt.Sprintf("%.1f MB", float64(size)/1e6)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/holiman/qvm-sync/dbus"
+	"github.com/holiman/qvm-sync/packer"
+	"github.com/holiman/qvm-sync/transport"
+)
+
+const (
+	// progressPrefix and statsPrefix start the lines written by qsync-send
+	// -progress
+	progressPrefix = "qsync-progress"
+	statsPrefix    = "qsync-stats"
+	// maxRuns is how many runs the api keeps, see status.runs
+	maxRuns = 100
+)
+
+// status is the state of the daemon, as served by the control api.
+type status struct {
+	configFile string
+	profiles   map[string]*packer.Profile
+
+	syncMu   sync.Mutex // held during each sync, so they run one at a time
+	mu       sync.Mutex // protects the fields below
+	current  *progress  // the sync in progress, if any
+	runs     []*runEntry
+	manifest *manifest // of the last successful sync
+}
+
+// progress is the progress of the sync in progress.
+type progress struct {
+	Dir    string    `json:"dir"`
+	Target string    `json:"target"`
+	Start  time.Time `json:"start"`
+	Items  int       `json:"items"`
+	Bytes  uint64    `json:"bytes"`
+	Path   string    `json:"path,omitempty"` // the last item sent
+
+	items           []manifestItem
+	raw, compressed uint64 // bytes sent, as reported at the end
+}
+
+// manifest lists the items sent in a sync.
+type manifest struct {
+	Dir    string         `json:"dir"`
+	Target string         `json:"target"`
+	End    time.Time      `json:"end"`
+	Items  []manifestItem `json:"items"`
+}
+
+type manifestItem struct {
+	Path string `json:"path"`
+	Size uint64 `json:"size"`
+}
+
+// profileInfo is a profile, as listed by the api.
+type profileInfo struct {
+	Name        string    `json:"name"`
+	Path        string    `json:"path"`
+	Destination []string  `json:"destination"`
+	Last        *runEntry `json:"last,omitempty"` // the last run of the profile
+}
+
+// newStatus loads the profiles of the configuration file, or of that of the
+// user. Without a configuration, there are no profiles.
+func newStatus(configFile string) (*status, error) {
+	st := &status{configFile: configFile, profiles: make(map[string]*packer.Profile)}
+	if configFile == "" {
+		path, err := packer.UserConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return st, nil
+		}
+		st.configFile = path
+	}
+	cfg, err := packer.LoadConfig(st.configFile)
+	if err != nil {
+		return nil, err
+	}
+	st.profiles = cfg.Profiles
+	return st, nil
+}
+
+// begin marks the start of a sync.
+func (st *status) begin(p *progress) {
+	st.mu.Lock()
+	st.current = p
+	st.mu.Unlock()
+}
+
+// end marks the end of the sync in progress.
+func (st *status) end(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if p := st.current; p != nil && err == nil {
+		st.manifest = &manifest{Dir: p.Dir, Target: p.Target, End: time.Now(), Items: p.items}
+	}
+	st.current = nil
+}
+
+// addRun records a run, keeping the last maxRuns.
+func (st *status) addRun(entry *runEntry) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.runs = append(st.runs, entry)
+	if len(st.runs) > maxRuns {
+		st.runs = st.runs[len(st.runs)-maxRuns:]
+	}
+}
+
+// progressWriter passes on what qsync-send writes on stderr, except for the
+// progress lines, which update the progress.
+type progressWriter struct {
+	mu     sync.Locker // held while updating the progress
+	p      *progress
+	events *dbus.Events // if set, the progress is reported there too
+	line   []byte
+}
+
+func (w *progressWriter) Write(data []byte) (int, error) {
+	w.line = append(w.line, data...)
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		w.handle(string(w.line[:i+1]))
+		w.line = w.line[i+1:]
+	}
+}
+
+// handle handles one line: "qsync-progress size "path"", "qsync-stats raw
+// compressed", or anything else.
+func (w *progressWriter) handle(line string) {
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 3)
+	if len(fields) != 3 || (fields[0] != progressPrefix && fields[0] != statsPrefix) {
+		os.Stderr.WriteString(line)
+		return
+	}
+	size, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if fields[0] == statsPrefix {
+		w.p.raw = size
+		w.p.compressed, _ = strconv.ParseUint(fields[2], 10, 64)
+		return
+	}
+	path, err := strconv.Unquote(fields[2])
+	if err != nil {
+		return
+	}
+	w.p.Items++
+	w.p.Bytes += size
+	w.p.Path = path
+	w.p.items = append(w.p.items, manifestItem{Path: path, Size: size})
+	if w.events != nil {
+		w.events.Progress(w.p.Dir, w.p.Items, w.p.Bytes, path)
+	}
+}
+
+// runCommand runs a sync, and reports its progress to the api, the metrics
+// and the session bus, if any, and notifies the user as configured.
+func runCommand(cfg *config, cmd *exec.Cmd, dir, target string) error {
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if !cfg.observed() {
+		return cmd.Run()
+	}
+	p := &progress{Dir: dir, Target: target, Start: time.Now()}
+	w := &progressWriter{mu: new(sync.Mutex), p: p, events: cfg.events}
+	if st := cfg.status; st != nil {
+		st.syncMu.Lock()
+		defer st.syncMu.Unlock()
+		st.begin(p)
+		w.mu = &st.mu
+	}
+	if cfg.events != nil {
+		cfg.events.Started(dir, target)
+	}
+	cmd.Stderr = w
+	err := cmd.Run()
+	if len(w.line) > 0 {
+		w.handle(string(w.line) + "\n")
+	}
+	if cfg.status != nil {
+		cfg.status.end(err)
+	}
+	if cfg.metrics != nil {
+		cfg.metrics.addSync(p, time.Since(p.Start), err)
+	}
+	if cfg.events != nil {
+		cfg.events.Completed(dir, target, err, p.Items, p.Bytes)
+	}
+	summary := &packer.SyncSummary{Dir: dir, Target: target, Files: p.Items, Bytes: p.Bytes, Err: err}
+	if nErr := packer.Notify(cfg.notify, summary); nErr != nil {
+		log.Print(nErr)
+	}
+	return err
+}
+
+// runProfile syncs the profile, via qsync-send, which sends to the
+// destinations of the profile. The run is recorded in the journal.
+func runProfile(cfg *config, p *packer.Profile, journal string) {
+	entry := &runEntry{Dir: p.Path, Target: strings.Join(p.Destination, ","), Profile: p.Name, Start: time.Now()}
+	args := append([]string{"-config", cfg.status.configFile, "-profile", p.Name, "-progress"}, cfg.sendArgs...)
+	err := runCommand(cfg, exec.Command(cfg.sendBinary, args...), entry.Dir, entry.Target)
+	if err != nil {
+		entry.Error = err.Error()
+		log.Printf("Sync of profile %v failed: %v", p.Name, err)
+	} else {
+		log.Printf("Synced profile %v in %v", p.Name, time.Since(entry.Start).Round(time.Millisecond))
+	}
+	entry.End = time.Now()
+	appendRun(journal, entry)
+	cfg.status.addRun(entry)
+}
+
+// serveAPI serves the control api on the unix socket at path, until it
+// fails. The api is json over http:
+//
+//	GET  /profiles              the profiles, with their last run
+//	POST /profiles/<name>/sync  start a sync of the profile
+//	GET  /progress              the sync in progress, or null
+//	GET  /journal               the last runs, oldest first
+//	GET  /manifest              the items sent in the last successful sync
+//	GET  /metrics               the metrics, if exported (see serveMetrics)
+//
+// The socket is only accessible to the user.
+func serveAPI(cfg *config, path, journal string) (io.Closer, error) {
+	l, err := transport.ListenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	handler := apiHandler(cfg, journal)
+	go func() {
+		if err := http.Serve(l, handler); err != nil && !isClosed(err) {
+			log.Printf("Control api failed: %v", err)
+		}
+	}()
+	log.Printf("Serving control api on %v", path)
+	return l, nil
+}
+
+// apiHandler returns the handler of the control api, see serveAPI.
+func apiHandler(cfg *config, journal string) http.Handler {
+	st := cfg.status
+	mux := http.NewServeMux()
+	mux.HandleFunc("/profiles", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		infos := make([]*profileInfo, 0, len(st.profiles))
+		st.mu.Lock()
+		for _, p := range st.profiles {
+			info := &profileInfo{Name: p.Name, Path: p.Path, Destination: p.Destination}
+			for _, run := range st.runs {
+				if run.Profile == p.Name {
+					info.Last = run
+				}
+			}
+			infos = append(infos, info)
+		}
+		st.mu.Unlock()
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+		writeJSON(w, infos)
+	})
+	mux.HandleFunc("/profiles/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/profiles/")
+		if !strings.HasSuffix(name, "/sync") {
+			http.NotFound(w, r)
+			return
+		}
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		p, ok := st.profiles[strings.TrimSuffix(name, "/sync")]
+		if !ok {
+			http.Error(w, "unknown profile", http.StatusNotFound)
+			return
+		}
+		if p.Path == "" || len(p.Destination) == 0 {
+			http.Error(w, "profile has no path or destination", http.StatusBadRequest)
+			return
+		}
+		// The sync waits for the one in progress, if any
+		go runProfile(cfg, p, journal)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/progress", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		writeJSON(w, st.current)
+	})
+	mux.HandleFunc("/journal", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		writeJSON(w, append([]*runEntry{}, st.runs...))
+	})
+	mux.HandleFunc("/manifest", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		writeJSON(w, st.manifest)
+	})
+	if cfg.metrics != nil {
+		mux.Handle("/metrics", cfg.metrics)
+	}
+	return mux
+}
+
+// allowMethod responds with an error, unless the request uses the method.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Control api response failed: %v", err)
+	}
+}
+
+// isClosed reports whether err is due to the listener being closed.
+func isClosed(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/holiman/qvm-sync/dbus"
+	"github.com/holiman/qvm-sync/packer"
+	"golang.org/x/sys/unix"
+)
+
+// fakeSend stands in for qsync-send -progress: it reports two items and the
+// bytes sent, and fails for the profile "broken".
+const fakeSend = `#!/bin/sh
+case "$4" in
+broken)
+	echo "qsync-send: no route to vault" >&2
+	exit 3
+	;;
+esac
+echo 'qsync-progress 5 "a.txt"' >&2
+echo 'qsync-progress 7 "b/c.txt"' >&2
+echo 'qsync-stats 120 60' >&2
+`
+
+// newTestConfig returns a configuration with the profiles docs, broken and
+// empty (which has no destination), syncing with fakeSend.
+func newTestConfig(t *testing.T) *config {
+	t.Helper()
+	dir := t.TempDir()
+	send := filepath.Join(dir, "qsync-send")
+	if err := ioutil.WriteFile(send, []byte(fakeSend), 0755); err != nil {
+		t.Fatal(err)
+	}
+	st := &status{
+		configFile: filepath.Join(dir, "config.toml"),
+		profiles: map[string]*packer.Profile{
+			"docs":   {Name: "docs", Path: "/home/user/docs", Destination: []string{"vault"}},
+			"broken": {Name: "broken", Path: "/home/user/broken", Destination: []string{"vault"}},
+			"empty":  {Name: "empty", Path: "/home/user/empty"},
+		},
+	}
+	return &config{sendBinary: send, status: st}
+}
+
+// getJSON gets the path from the server, and decodes the response into v.
+func getJSON(t *testing.T, srv *httptest.Server, path string, v interface{}) {
+	t.Helper()
+	resp, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %v: status %v", path, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("GET %v: content type %q", path, ct)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %v: %v", path, err)
+	}
+}
+
+// syncProfile starts a sync of the profile through the api, and waits for
+// its run to be recorded.
+func syncProfile(t *testing.T, srv *httptest.Server, name string) *runEntry {
+	t.Helper()
+	resp, err := http.Post(srv.URL+"/profiles/"+name+"/sync", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("sync of %v: status %v", name, resp.Status)
+	}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var runs []*runEntry
+		getJSON(t, srv, "/journal", &runs)
+		for _, run := range runs {
+			if run.Profile == name {
+				return run
+			}
+		}
+	}
+	t.Fatalf("sync of %v not recorded", name)
+	return nil
+}
+
+func TestAPI(t *testing.T) {
+	cfg := newTestConfig(t)
+	journal := filepath.Join(t.TempDir(), "journal")
+	srv := httptest.NewServer(apiHandler(cfg, journal))
+	defer srv.Close()
+
+	var cur *progress
+	getJSON(t, srv, "/progress", &cur)
+	if cur != nil {
+		t.Fatalf("progress before any sync: %+v", cur)
+	}
+	var man *manifest
+	getJSON(t, srv, "/manifest", &man)
+	if man != nil {
+		t.Fatalf("manifest before any sync: %+v", man)
+	}
+	var runs []*runEntry
+	getJSON(t, srv, "/journal", &runs)
+	if runs == nil || len(runs) != 0 {
+		t.Fatalf("journal before any sync: %v, want []", runs)
+	}
+
+	run := syncProfile(t, srv, "docs")
+	if run.Error != "" || run.Dir != "/home/user/docs" || run.Target != "vault" {
+		t.Fatalf("run of docs: %+v", run)
+	}
+	getJSON(t, srv, "/manifest", &man)
+	want := []manifestItem{{"a.txt", 5}, {"b/c.txt", 7}}
+	if man == nil || man.Dir != "/home/user/docs" || len(man.Items) != len(want) {
+		t.Fatalf("manifest: %+v, want items %v", man, want)
+	}
+	for i, item := range man.Items {
+		if item != want[i] {
+			t.Errorf("manifest item %d: %v, want %v", i, item, want[i])
+		}
+	}
+	getJSON(t, srv, "/progress", &cur)
+	if cur != nil {
+		t.Fatalf("progress after the sync: %+v", cur)
+	}
+
+	// A failed sync is recorded, but keeps the manifest of the last
+	// successful one
+	run = syncProfile(t, srv, "broken")
+	if !strings.Contains(run.Error, "exit status 3") {
+		t.Fatalf("run of broken: error %q, want exit status 3", run.Error)
+	}
+	getJSON(t, srv, "/manifest", &man)
+	if man == nil || man.Dir != "/home/user/docs" {
+		t.Fatalf("manifest after a failed sync: %+v", man)
+	}
+
+	var infos []*profileInfo
+	getJSON(t, srv, "/profiles", &infos)
+	if len(infos) != 3 {
+		t.Fatalf("profiles: %d, want 3", len(infos))
+	}
+	for i, name := range []string{"broken", "docs", "empty"} {
+		if infos[i].Name != name {
+			t.Errorf("profile %d: %v, want %v", i, infos[i].Name, name)
+		}
+	}
+	if last := infos[0].Last; last == nil || last.Error == "" {
+		t.Errorf("last run of broken: %+v, want a failure", last)
+	}
+	if last := infos[1].Last; last == nil || last.Error != "" {
+		t.Errorf("last run of docs: %+v, want a success", last)
+	}
+	if infos[2].Last != nil {
+		t.Errorf("last run of empty: %+v, want none", infos[2].Last)
+	}
+
+	// The runs are appended to the journal as well
+	data, err := ioutil.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 {
+		t.Fatalf("journal file: %d lines, want 2:\n%s", len(lines), data)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	cfg := newTestConfig(t)
+	srv := httptest.NewServer(apiHandler(cfg, ""))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		method, path string
+		status       int
+		allow        string // the Allow header, if any
+	}{
+		{"POST", "/profiles", http.StatusMethodNotAllowed, "GET"},
+		{"GET", "/profiles/docs/sync", http.StatusMethodNotAllowed, "POST"},
+		{"POST", "/profiles/docs", http.StatusNotFound, ""},
+		{"POST", "/profiles/docs/start", http.StatusNotFound, ""},
+		{"POST", "/profiles/nosuch/sync", http.StatusNotFound, ""},
+		{"POST", "/profiles/empty/sync", http.StatusBadRequest, ""},
+		{"DELETE", "/progress", http.StatusMethodNotAllowed, "GET"},
+		{"PUT", "/journal", http.StatusMethodNotAllowed, "GET"},
+		{"POST", "/manifest", http.StatusMethodNotAllowed, "GET"},
+		{"GET", "/nosuch", http.StatusNotFound, ""},
+		// Metrics aren't exported
+		{"GET", "/metrics", http.StatusNotFound, ""},
+	} {
+		req, err := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%v %v: status %v, want %d", tt.method, tt.path, resp.Status, tt.status)
+		}
+		if allow := resp.Header.Get("Allow"); allow != tt.allow {
+			t.Errorf("%v %v: Allow %q, want %q", tt.method, tt.path, allow, tt.allow)
+		}
+	}
+	// None of them started a sync
+	cfg.status.mu.Lock()
+	defer cfg.status.mu.Unlock()
+	if len(cfg.status.runs) != 0 {
+		t.Fatalf("runs: %v, want none", cfg.status.runs)
+	}
+}
+
+func TestServeAPI(t *testing.T) {
+	cfg := newTestConfig(t)
+	path := filepath.Join(t.TempDir(), "api.sock")
+	l, err := serveAPI(cfg, path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket permissions %v, want 0600", perm)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket not removed: %v", err)
+	}
+}
+
+// metricValue returns the value of the sample of the metric, with the
+// labels, from the exposition.
+func metricValue(t *testing.T, exposition, sample string) string {
+	t.Helper()
+	re := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(sample) + ` (\S+)$`)
+	m := re.FindStringSubmatch(exposition)
+	if m == nil {
+		t.Fatalf("no sample %v in:\n%s", sample, exposition)
+	}
+	return m[1]
+}
+
+func TestMetrics(t *testing.T) {
+	cfg := newTestConfig(t)
+	file := filepath.Join(t.TempDir(), "qsync.prom")
+	cfg.metrics = newMetrics(file)
+	srv := httptest.NewServer(apiHandler(cfg, ""))
+	defer srv.Close()
+
+	start := time.Now()
+	docs, broken := cfg.status.profiles["docs"], cfg.status.profiles["broken"]
+	runProfile(cfg, docs, "")
+	runProfile(cfg, docs, "")
+	runProfile(cfg, broken, "")
+	cfg.metrics.addSkipped(docs.Path)
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("content type %q", ct)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exposition := string(body)
+
+	for _, tt := range []struct {
+		sample, value string
+	}{
+		{`qsync_syncs_total{dir="/home/user/docs"}`, "2"},
+		{`qsync_syncs_total{dir="/home/user/broken"}`, "1"},
+		{`qsync_sync_errors_total{dir="/home/user/docs"}`, "0"},
+		{`qsync_sync_errors_total{dir="/home/user/broken"}`, "1"},
+		{`qsync_syncs_skipped_total{dir="/home/user/docs"}`, "1"},
+		{`qsync_syncs_skipped_total{dir="/home/user/broken"}`, "0"},
+		{`qsync_files_transferred_total{dir="/home/user/docs"}`, "4"},
+		{`qsync_bytes_transferred_total{dir="/home/user/docs"}`, "24"},
+		{`qsync_sent_bytes_total{dir="/home/user/docs"}`, "240"},
+		{`qsync_sent_compressed_bytes_total{dir="/home/user/docs"}`, "120"},
+		{`qsync_compression_ratio{dir="/home/user/docs"}`, "2"},
+		{`qsync_compression_ratio{dir="/home/user/broken"}`, "1"},
+		{`qsync_last_success_timestamp_seconds{dir="/home/user/broken"}`, "0"},
+		{`qsync_sync_duration_seconds_bucket{dir="/home/user/docs",le="3600"}`, "2"},
+		{`qsync_sync_duration_seconds_bucket{dir="/home/user/docs",le="+Inf"}`, "2"},
+		{`qsync_sync_duration_seconds_count{dir="/home/user/docs"}`, "2"},
+		{`qsync_sync_duration_seconds_count{dir="/home/user/broken"}`, "1"},
+	} {
+		if value := metricValue(t, exposition, tt.sample); value != tt.value {
+			t.Errorf("%v: %v, want %v", tt.sample, value, tt.value)
+		}
+	}
+	for _, sample := range []string{
+		`qsync_last_sync_timestamp_seconds{dir="/home/user/broken"}`,
+		`qsync_last_success_timestamp_seconds{dir="/home/user/docs"}`,
+	} {
+		var ts float64
+		if _, err := fmt.Sscan(metricValue(t, exposition, sample), &ts); err != nil {
+			t.Fatal(err)
+		}
+		if ts < float64(start.Unix()) || ts > float64(time.Now().Unix()+1) {
+			t.Errorf("%v: %v, want around %v", sample, ts, start.Unix())
+		}
+	}
+	// Each family is announced once, before its samples, and the broken
+	// directory sorts before docs
+	if n := strings.Count(exposition, "# TYPE qsync_syncs_total counter\n"); n != 1 {
+		t.Errorf("TYPE of qsync_syncs_total announced %d times", n)
+	}
+	if !strings.Contains(exposition, "# TYPE qsync_sync_duration_seconds histogram\n") {
+		t.Errorf("no TYPE for the duration histogram")
+	}
+	if i, j := strings.Index(exposition, `dir="/home/user/broken"`), strings.Index(exposition, `dir="/home/user/docs"`); i > j {
+		t.Errorf("directories not sorted")
+	}
+	// The textfile has the same metrics
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != exposition {
+		t.Errorf("textfile differs from the served metrics:\n%s", data)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0644 {
+		t.Errorf("textfile permissions %v, want 0644", perm)
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	m := newMetrics("")
+	m.addSync(&progress{Dir: "/home/user/a \"b\"\\c\nd"}, 90*time.Second, nil)
+	var buf bytes.Buffer
+	m.write(&buf)
+	exposition := buf.String()
+	label := `dir="/home/user/a \"b\"\\c\nd"`
+	if value := metricValue(t, exposition, "qsync_syncs_total{"+label+"}"); value != "1" {
+		t.Errorf("syncs: %v, want 1", value)
+	}
+	// 90s falls in the buckets from 300s up
+	for le, want := range map[string]string{"1": "0", "60": "0", "300": "1", "+Inf": "1"} {
+		sample := "qsync_sync_duration_seconds_bucket{" + label + `,le="` + le + `"}`
+		if value := metricValue(t, exposition, sample); value != want {
+			t.Errorf("%v: %v, want %v", sample, value, want)
+		}
+	}
+	if value := metricValue(t, exposition, "qsync_sync_duration_seconds_sum{"+label+"}"); value != "90" {
+		t.Errorf("duration sum: %v, want 90", value)
+	}
+}
+
+// recordingBus records the members of the signals emitted on it.
+type recordingBus struct {
+	mu      sync.Mutex
+	members []string
+	args    [][]interface{}
+}
+
+func (b *recordingBus) Emit(path dbus.ObjectPath, iface, member string, args ...interface{}) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.members = append(b.members, member)
+	b.args = append(b.args, args)
+	return nil
+}
+
+func (b *recordingBus) Call(dest string, path dbus.ObjectPath, iface, member string, timeout time.Duration, args ...interface{}) ([]interface{}, error) {
+	return nil, &dbus.Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown"}
+}
+
+func TestEvents(t *testing.T) {
+	cfg := newTestConfig(t)
+	bus := new(recordingBus)
+	cfg.events = dbus.NewEvents(bus)
+	runProfile(cfg, cfg.status.profiles["docs"], "")
+	runProfile(cfg, cfg.status.profiles["broken"], "")
+
+	// The second progress line is within dbus.ProgressInterval of the first
+	want := []string{"Started", "Progress", "Completed", "Started", "Completed"}
+	if !reflect.DeepEqual(bus.members, want) {
+		t.Fatalf("signals %v, want %v", bus.members, want)
+	}
+	if args := bus.args[1]; !reflect.DeepEqual(args, []interface{}{"/home/user/docs", uint32(1), uint64(5), "a.txt"}) {
+		t.Errorf("progress: %v", args)
+	}
+	if args := bus.args[2]; !reflect.DeepEqual(args, []interface{}{"/home/user/docs", "vault", true, "", uint32(2), uint64(12)}) {
+		t.Errorf("completion of docs: %v", args)
+	}
+	if args := bus.args[4]; args[2] != false || args[3] != "exit status 3" {
+		t.Errorf("completion of broken: %v", args)
+	}
+}
+
+// inotifyEvent encodes an event as the kernel does, the name padded to the
+// size of the struct.
+func inotifyEvent(wd int32, mask uint32, name string) []byte {
+	n := 0
+	if name != "" {
+		n = (len(name) + unix.SizeofInotifyEvent) / unix.SizeofInotifyEvent * unix.SizeofInotifyEvent
+	}
+	ev := unix.InotifyEvent{Wd: wd, Mask: mask, Len: uint32(n)}
+	data := append([]byte{}, (*[unix.SizeofInotifyEvent]byte)(unsafe.Pointer(&ev))[:]...)
+	return append(data, append([]byte(name), make([]byte, n-len(name))...)...)
+}
+
+func TestWatcher(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a/b", packer.StateDir + "/c"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := newWatcher(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	watched := func() []string {
+		var dirs []string
+		for _, dir := range w.dirs {
+			rel, _ := filepath.Rel(root, dir)
+			dirs = append(dirs, rel)
+		}
+		sort.Strings(dirs)
+		return dirs
+	}
+	// The state directory isn't watched
+	if got, want := watched(), []string{".", "a", "a/b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("watched %v, want %v", got, want)
+	}
+	wdOf := func(rel string) int32 {
+		for wd, dir := range w.dirs {
+			if dir == filepath.Join(root, rel) {
+				return wd
+			}
+		}
+		t.Fatalf("%v not watched", rel)
+		return 0
+	}
+
+	// A directory created, or moved in, is watched with what's below it
+	for _, dir := range []string{"a/new/sub", "moved/sub"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var events []byte
+	events = append(events, inotifyEvent(wdOf("a"), unix.IN_CREATE|unix.IN_ISDIR, "new")...)
+	events = append(events, inotifyEvent(wdOf("a/b"), unix.IN_MODIFY, "file")...)
+	events = append(events, inotifyEvent(wdOf("."), unix.IN_MOVED_TO|unix.IN_ISDIR, "moved")...)
+	// Files created aren't
+	events = append(events, inotifyEvent(wdOf("."), unix.IN_CREATE, "file")...)
+	// Nor are events of unknown watches
+	events = append(events, inotifyEvent(9999, unix.IN_CREATE|unix.IN_ISDIR, "gone")...)
+	events = append(events, inotifyEvent(-1, unix.IN_Q_OVERFLOW, "")...)
+	w.handle(events)
+	if got, want := watched(), []string{".", "a", "a/b", "a/new", "a/new/sub", "moved", "moved/sub"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("watched %v, want %v", got, want)
+	}
+	// A watch removed, e.g. with its directory, is dropped
+	w.handle(inotifyEvent(wdOf("a/b"), unix.IN_IGNORED, ""))
+	if got, want := watched(), []string{".", "a", "a/new", "a/new/sub", "moved", "moved/sub"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("watched %v, want %v", got, want)
+	}
+	// Cut short, the rest is dropped
+	w.handle(inotifyEvent(wdOf("."), unix.IN_CREATE|unix.IN_ISDIR, "moved")[:unix.SizeofInotifyEvent+2])
+}
+
+func TestWatcherRun(t *testing.T) {
+	root := t.TempDir()
+	w, err := newWatcher(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go w.run()
+	if err := ioutil.WriteFile(filepath.Join(root, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.changes:
+	case <-time.After(10 * time.Second):
+		t.Fatal("change not signalled")
+	}
+	// Closing the watcher wakes up run, blocked reading
+	w.Close()
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case _, ok := <-w.changes:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("run not ended by Close")
+		}
+	}
+}
+
+func TestReadSchedule(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "schedule")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`# The jobs
+/home/user/docs  vault            every 15m  jitter 1m
+
+/home/user/code  backup+projects  at 03:30   args -i -exclude *.o
+`)
+	jobs, err := readSchedule(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*job{
+		{dir: "/home/user/docs", target: "vault", every: 15 * time.Minute, jitter: time.Minute},
+		{dir: "/home/user/code", target: "backup+projects", daily: true, at: 3*time.Hour + 30*time.Minute, args: []string{"-i", "-exclude", "*.o"}},
+	}
+	if !reflect.DeepEqual(jobs, want) {
+		t.Errorf("jobs %+v, want %+v", jobs, want)
+	}
+	for _, tt := range []struct {
+		content string
+		errMsg  string
+	}{
+		{"", "no jobs in " + path},
+		{"# nothing\n", "no jobs in " + path},
+		{"/docs vault every\n", path + ":1: expected: directory target every|at <when> [jitter <duration>] [args ...]"},
+		{"\n/docs vault every 30s\n", path + `:2: invalid interval "30s", must be at least 1m`},
+		{"/docs vault at 25:00\n", path + `:1: invalid time of day "25:00", expected hh:mm`},
+		{"/docs vault every 1h jitter -1m\n", path + `:1: invalid jitter "-1m"`},
+		{"/docs vault every 1h jitter\n", path + `:1: missing value for "jitter"`},
+		{"/docs vault hourly 1h\n", path + `:1: unknown keyword "hourly"`},
+		{"/docs vault every 1h at 03:00\n", path + ":1: exactly one of every and at must be given"},
+		{"/docs vault jitter 1m args -i\n", path + ":1: exactly one of every and at must be given"},
+	} {
+		write(tt.content)
+		if _, err := readSchedule(path); err == nil || err.Error() != tt.errMsg {
+			t.Errorf("%q: error %v, want %q", tt.content, err, tt.errMsg)
+		}
+	}
+}
+
+func TestScheduleLoop(t *testing.T) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	client := filepath.Join(dir, "qrexec-client-vm")
+	if err := ioutil.WriteFile(client, []byte("#!/bin/sh\necho \"$@\" >> "+calls+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "src")
+	os.Mkdir(src, 0755)
+	cfg := &config{qrexecClient: client, sendBinary: "qsync-send", sendArgs: []string{"-n"}}
+	journal := filepath.Join(dir, "journal")
+	jobs := []*job{
+		{dir: src, target: "vault+docs", every: time.Hour, args: []string{"-i"}},
+		// Not due
+		{dir: dir, target: "backup", daily: true, at: time.Duration(time.Now().Add(-time.Hour).Hour()) * time.Hour},
+	}
+	sigs := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- scheduleLoop(cfg, jobs, journal, sigs) }()
+
+	// The job running every so often runs at startup
+	var runs []runEntry
+	for deadline := time.Now().Add(10 * time.Second); len(runs) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("job not run at startup")
+		}
+		data, _ := ioutil.ReadFile(journal)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var entry runEntry
+			if json.Unmarshal([]byte(line), &entry) == nil {
+				runs = append(runs, entry)
+			}
+		}
+	}
+	sigs <- os.Interrupt
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("loop not ended by the signal")
+	}
+	if len(runs) != 1 || runs[0].Dir != src || runs[0].Target != "vault+docs" || runs[0].Error != "" || runs[0].Skipped {
+		t.Fatalf("runs %+v", runs)
+	}
+	if data, _ := ioutil.ReadFile(calls); string(data) != "vault qubes.Filesync+docs qsync-send -n -i "+src+"\n" {
+		t.Errorf("qrexec-client-vm called with %q", data)
+	}
+	if next := jobs[0].next; next.Before(runs[0].End.Add(time.Hour)) {
+		t.Errorf("next run at %v, an hour after %v", next, runs[0].End)
+	}
+
+	// Unchanged since, it's skipped
+	runJob(cfg, jobs[0], journal)
+	data, _ := ioutil.ReadFile(journal)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var entry runEntry
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[1]), &entry) != nil || !entry.Skipped {
+		t.Errorf("journal %q, want the second run skipped", data)
+	}
+}
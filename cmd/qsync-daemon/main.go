@@ -0,0 +1,230 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/holiman/qvm-sync/dbus"
+	"github.com/holiman/qvm-sync/packer"
+)
+
+func init() {
+	packer.SetupLogging()
+}
+
+const (
+	defaultQrexecClient = "/usr/lib/qubes/qrexec-client-vm"
+	defaultSendBinary   = "/usr/local/bin/qsync-send"
+	syncService         = "qubes.Filesync"
+)
+
+// config holds the settings of the daemon.
+type config struct {
+	target       string
+	qrexecClient string
+	sendBinary   string
+	sendArgs     []string
+	debounce     time.Duration
+	watch        bool
+	status       *status      // if the control api is served
+	metrics      *metrics     // if metrics are exported
+	events       *dbus.Events // if syncs are reported on the session bus
+	notify       int          // when to show desktop notifications
+}
+
+// observed reports whether the progress of syncs is needed, see runCommand.
+func (cfg *config) observed() bool {
+	return cfg.status != nil || cfg.metrics != nil || cfg.events != nil || cfg.notify != packer.NotifyOff
+}
+
+// qsync-daemon keeps a directory synced to another qube. With -watch, it
+// watches the directory for changes, and after things have been quiet for a
+// while (-debounce), it runs a sync. Since only changed files are
+// transferred, each sync is incremental.
+//
+// With -schedule, it instead syncs the directories listed in the schedule
+// periodically, see readSchedule.
+//
+// With -api, it serves a control api on a unix socket, see serveAPI, through
+// which the profiles of the configuration can be synced as well. Without a
+// directory or schedule, it only serves the api.
+func main() {
+	target := flag.String("target", "@default", "`qube` to sync to (qube+target for a profile)")
+	qrexecClient := flag.String("qrexec-client", defaultQrexecClient, "`path` to qrexec-client-vm")
+	sendBinary := flag.String("send", defaultSendBinary, "`path` to qsync-send")
+	sendArgs := flag.String("send-args", "", "extra `arguments` for qsync-send, separated by spaces")
+	debounce := flag.Duration("debounce", 2*time.Second, "how long to wait for changes to settle, before syncing")
+	watch := flag.Bool("watch", false, "watch the directory, and sync on changes")
+	schedule := flag.String("schedule", "", "`file` with the directories to sync periodically, instead of a single directory")
+	journal := flag.String("journal", "", "`file` to record each scheduled run in, as json-lines")
+	api := flag.String("api", "", "serve the control api on the unix socket at `path`")
+	metricsAddr := flag.String("metrics", "", "serve prometheus metrics on /metrics at `address` (e.g. 127.0.0.1:9101)")
+	metricsFile := flag.String("metrics-file", "", "write prometheus metrics to `file` after each sync, for the textfile collector of the node exporter")
+	notify := flag.String("notify", "off", "show a desktop notification when a sync completes: off, errors or always")
+	useDbus := flag.Bool("dbus", false, "report syncs with signals on the session bus, for desktop applets")
+	configFile := flag.String("config", "", "configuration `file` with the profiles for the control api (default ~/.config/qvm-sync/config.toml)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n %s [options] -watch /directory/to/sync\n %s [options] -schedule file\n %s [options] -api socket\nOptions:\n", os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cfg := &config{
+		target:       *target,
+		qrexecClient: *qrexecClient,
+		sendBinary:   *sendBinary,
+		sendArgs:     strings.Fields(*sendArgs),
+		debounce:     *debounce,
+		watch:        *watch,
+	}
+	notifyWhen, err := packer.ParseNotify(*notify)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.notify = notifyWhen
+	if *useDbus {
+		conn, err := dbus.SessionBus()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+		cfg.events = dbus.NewEvents(conn)
+	}
+	if *metricsAddr != "" || *metricsFile != "" {
+		cfg.metrics = newMetrics(*metricsFile)
+		if *metricsAddr != "" {
+			l, err := serveMetrics(cfg.metrics, *metricsAddr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer l.Close()
+		}
+	}
+	if *api != "" {
+		st, err := newStatus(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.status = st
+		l, err := serveAPI(cfg, *api, *journal)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer l.Close()
+	}
+	if *schedule != "" {
+		if *watch || flag.NArg() > 0 {
+			log.Fatal("Option -schedule can't be combined with -watch, or a directory")
+		}
+		jobs, err := readSchedule(*schedule)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		if err := scheduleLoop(cfg, jobs, *journal, sigs); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.NArg() < 1 && *api != "" {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		log.Printf("Got %v, exiting", <-sigs)
+		return
+	}
+	if flag.NArg() < 1 {
+		fmt.Fprintf(flag.CommandLine.Output(), "Error: path not supplied\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	dir, err := filepath.Abs(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !cfg.watch {
+		if err := runSync(cfg, dir); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := watchLoop(cfg, dir); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runSync performs one sync of the directory, via qrexec. A target of
+// qube+name syncs to the profile name, via qubes.Filesync+name.
+func runSync(cfg *config, dir string) error {
+	qube, service := cfg.target, syncService
+	if i := strings.Index(qube, "+"); i > 0 {
+		qube, service = qube[:i], service+qube[i:]
+	}
+	args := []string{qube, service, cfg.sendBinary}
+	if cfg.observed() {
+		args = append(args, "-progress")
+	}
+	args = append(args, cfg.sendArgs...)
+	args = append(args, dir)
+	start := time.Now()
+	if err := runCommand(cfg, exec.Command(cfg.qrexecClient, args...), dir, cfg.target); err != nil {
+		return fmt.Errorf("sync of %v failed: %v", dir, err)
+	}
+	log.Printf("Synced %v to %v in %v", dir, cfg.target, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// watchLoop syncs the directory once, and then again each time changes have
+// settled. Changes made during a sync trigger another one afterwards.
+func watchLoop(cfg *config, dir string) error {
+	w, err := newWatcher(dir)
+	if err != nil {
+		return fmt.Errorf("failed watching %v: %v", dir, err)
+	}
+	defer w.Close()
+	go w.run()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	// Start out with a sync, to catch changes made while we weren't running
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case _, ok := <-w.changes:
+			if !ok {
+				return fmt.Errorf("watch of %v ended", dir)
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(cfg.debounce)
+		case <-timer.C:
+			entry := &runEntry{Dir: dir, Target: cfg.target, Start: time.Now()}
+			if err := runSync(cfg, dir); err != nil {
+				// The other qube may be unavailable, the next change
+				// triggers another attempt
+				entry.Error = err.Error()
+				log.Print(err)
+			}
+			if cfg.status != nil {
+				entry.End = time.Now()
+				cfg.status.addRun(entry)
+			}
+		case sig := <-sigs:
+			log.Printf("Got %v, exiting", sig)
+			return nil
+		}
+	}
+}
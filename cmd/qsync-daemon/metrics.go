@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds of the buckets of the sync duration
+// histogram, in seconds.
+var durationBuckets = []float64{1, 5, 15, 60, 300, 900, 3600}
+
+// labelEscaper escapes label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metrics collects metrics of the syncs, per directory, for prometheus.
+type metrics struct {
+	file string // textfile to write after each sync, if any
+
+	mu   sync.Mutex
+	dirs map[string]*dirMetrics
+}
+
+// dirMetrics are the metrics of the syncs of one directory.
+type dirMetrics struct {
+	syncs, errors, skipped uint64
+	files, bytes           uint64 // transferred
+	raw, compressed        uint64 // sent, before and after compression
+	buckets                []uint64
+	durations              float64 // sum, in seconds
+	lastSync, lastSuccess  time.Time
+}
+
+func newMetrics(file string) *metrics {
+	return &metrics{file: file, dirs: make(map[string]*dirMetrics)}
+}
+
+func (m *metrics) dir(dir string) *dirMetrics {
+	d, ok := m.dirs[dir]
+	if !ok {
+		d = &dirMetrics{buckets: make([]uint64, len(durationBuckets))}
+		m.dirs[dir] = d
+	}
+	return d
+}
+
+// addSync records a sync, as reported by qsync-send -progress.
+func (m *metrics) addSync(p *progress, duration time.Duration, err error) {
+	m.mu.Lock()
+	d := m.dir(p.Dir)
+	d.syncs++
+	d.lastSync = time.Now()
+	if err != nil {
+		d.errors++
+	} else {
+		d.lastSuccess = d.lastSync
+	}
+	d.files += uint64(p.Items)
+	d.bytes += p.Bytes
+	d.raw += p.raw
+	d.compressed += p.compressed
+	d.durations += duration.Seconds()
+	for i, le := range durationBuckets {
+		if duration.Seconds() <= le {
+			d.buckets[i]++
+		}
+	}
+	m.mu.Unlock()
+	m.writeFile()
+}
+
+// addSkipped records a scheduled run which was skipped, as the directory
+// was unchanged.
+func (m *metrics) addSkipped(dir string) {
+	m.mu.Lock()
+	m.dir(dir).skipped++
+	m.mu.Unlock()
+	m.writeFile()
+}
+
+// write writes the metrics in the prometheus text format.
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dirs := make([]string, 0, len(m.dirs))
+	for dir := range m.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	family := func(name, kind, help string, value func(d *dirMetrics) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, dir := range dirs {
+			fmt.Fprintf(w, "%s{dir=\"%s\"} %v\n", name, labelEscaper.Replace(dir), value(m.dirs[dir]))
+		}
+	}
+	family("qsync_syncs_total", "counter", "Syncs run.",
+		func(d *dirMetrics) float64 { return float64(d.syncs) })
+	family("qsync_sync_errors_total", "counter", "Syncs which failed.",
+		func(d *dirMetrics) float64 { return float64(d.errors) })
+	family("qsync_syncs_skipped_total", "counter", "Scheduled syncs skipped, as the directory was unchanged.",
+		func(d *dirMetrics) float64 { return float64(d.skipped) })
+	family("qsync_files_transferred_total", "counter", "Files and symlinks transferred.",
+		func(d *dirMetrics) float64 { return float64(d.files) })
+	family("qsync_bytes_transferred_total", "counter", "Size of the files transferred.",
+		func(d *dirMetrics) float64 { return float64(d.bytes) })
+	family("qsync_sent_bytes_total", "counter", "Bytes sent, before compression.",
+		func(d *dirMetrics) float64 { return float64(d.raw) })
+	family("qsync_sent_compressed_bytes_total", "counter", "Bytes sent, after compression.",
+		func(d *dirMetrics) float64 { return float64(d.compressed) })
+	family("qsync_compression_ratio", "gauge", "Bytes sent before compression, per byte after, over all syncs.",
+		func(d *dirMetrics) float64 {
+			if d.compressed == 0 {
+				return 1
+			}
+			return float64(d.raw) / float64(d.compressed)
+		})
+	family("qsync_last_sync_timestamp_seconds", "gauge", "When the last sync ended.",
+		func(d *dirMetrics) float64 { return unixSeconds(d.lastSync) })
+	family("qsync_last_success_timestamp_seconds", "gauge", "When the last successful sync ended.",
+		func(d *dirMetrics) float64 { return unixSeconds(d.lastSuccess) })
+
+	name := "qsync_sync_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Duration of the syncs.\n# TYPE %s histogram\n", name, name)
+	for _, dir := range dirs {
+		d, label := m.dirs[dir], labelEscaper.Replace(dir)
+		for i, le := range durationBuckets {
+			fmt.Fprintf(w, "%s_bucket{dir=\"%s\",le=\"%v\"} %d\n", name, label, le, d.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{dir=\"%s\",le=\"+Inf\"} %d\n", name, label, d.syncs)
+		fmt.Fprintf(w, "%s_sum{dir=\"%s\"} %v\n", name, label, d.durations)
+		fmt.Fprintf(w, "%s_count{dir=\"%s\"} %d\n", name, label, d.syncs)
+	}
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+// writeFile writes the metrics to the textfile, if any, for the textfile
+// collector of the node exporter. It's replaced as a whole, so that it's
+// never read half-written.
+func (m *metrics) writeFile() {
+	if m.file == "" {
+		return
+	}
+	var buf bytes.Buffer
+	m.write(&buf)
+	tmp, err := ioutil.TempFile(filepath.Dir(m.file), ".qsync-metrics-")
+	if err == nil {
+		_, err = tmp.Write(buf.Bytes())
+		if cErr := tmp.Close(); err == nil {
+			err = cErr
+		}
+		if err == nil {
+			err = os.Chmod(tmp.Name(), 0644)
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), m.file)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to write metrics: %v", err)
+	}
+}
+
+// ServeHTTP serves the metrics.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+// serveMetrics serves the metrics on /metrics at the (tcp) address, until
+// it fails.
+func serveMetrics(m *metrics, addr string) (io.Closer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go func() {
+		if err := http.Serve(l, mux); err != nil && !isClosed(err) {
+			log.Printf("Metrics endpoint failed: %v", err)
+		}
+	}()
+	log.Printf("Serving metrics on http://%v/metrics", l.Addr())
+	return l, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/holiman/qvm-sync/packer"
+)
+
+// job is one entry of the schedule: a directory, synced to a target on a
+// schedule.
+type job struct {
+	dir    string
+	target string        // qube, or qube+target
+	every  time.Duration // sync this often, or
+	daily  bool          // daily,
+	at     time.Duration // at this time of day
+	jitter time.Duration // random delay added to each run
+	args   []string      // extra arguments for qsync-send
+
+	next time.Time // when to run next
+	last []byte    // fingerprint of the directory at the last successful sync
+}
+
+func (j *job) String() string {
+	return fmt.Sprintf("%v to %v", j.dir, j.target)
+}
+
+// readSchedule reads the schedule, one job per line:
+//
+//	/home/user/docs  vault            every 15m  jitter 1m
+//	/home/user/code  backup+projects  at 03:00   args -i
+//
+// A job runs either every so often, or daily at the given time. Everything
+// after "args" is passed on to qsync-send.
+func readSchedule(path string) ([]*job, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var (
+		jobs    []*job
+		scanner = bufio.NewScanner(f)
+		lineNo  = 0
+	)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		j, err := parseJob(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", path, lineNo, err)
+		}
+		jobs = append(jobs, j)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no jobs in %v", path)
+	}
+	return jobs, nil
+}
+
+func parseJob(fields []string) (*job, error) {
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("expected: directory target every|at <when> [jitter <duration>] [args ...]")
+	}
+	dir, err := filepath.Abs(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	j := &job{dir: dir, target: fields[1]}
+	for rest := fields[2:]; len(rest) > 0; rest = rest[2:] {
+		if rest[0] == "args" {
+			j.args = rest[1:]
+			break
+		}
+		if len(rest) < 2 {
+			return nil, fmt.Errorf("missing value for %q", rest[0])
+		}
+		switch rest[0] {
+		case "every":
+			if j.every, err = time.ParseDuration(rest[1]); err != nil || j.every < time.Minute {
+				return nil, fmt.Errorf("invalid interval %q, must be at least 1m", rest[1])
+			}
+		case "at":
+			t, err := time.Parse("15:04", rest[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid time of day %q, expected hh:mm", rest[1])
+			}
+			j.daily, j.at = true, time.Duration(t.Hour())*time.Hour+time.Duration(t.Minute())*time.Minute
+		case "jitter":
+			if j.jitter, err = time.ParseDuration(rest[1]); err != nil || j.jitter < 0 {
+				return nil, fmt.Errorf("invalid jitter %q", rest[1])
+			}
+		default:
+			return nil, fmt.Errorf("unknown keyword %q", rest[0])
+		}
+	}
+	if (j.every != 0) == j.daily {
+		return nil, fmt.Errorf("exactly one of every and at must be given")
+	}
+	return j, nil
+}
+
+// schedule sets when the job runs next, after now.
+func (j *job) schedule(now time.Time) {
+	if j.daily {
+		y, m, d := now.Date()
+		j.next = time.Date(y, m, d, 0, 0, 0, 0, now.Location()).Add(j.at)
+		if !j.next.After(now) {
+			j.next = j.next.AddDate(0, 0, 1)
+		}
+	} else {
+		j.next = now.Add(j.every)
+	}
+	if j.jitter > 0 {
+		j.next = j.next.Add(time.Duration(rand.Int63n(int64(j.jitter))))
+	}
+}
+
+// fingerprint returns a digest of the metadata of everything in the
+// directory. If it hasn't changed since the last sync, neither has the
+// directory (short of changes which preserve size and mtime).
+func fingerprint(dir string) ([]byte, error) {
+	h := sha256.New()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == packer.StateDir {
+			return filepath.SkipDir
+		}
+		h.Write([]byte(path))
+		binary.Write(h, binary.LittleEndian, []int64{int64(info.Mode()), info.Size(), info.ModTime().UnixNano()})
+		return nil
+	})
+	return h.Sum(nil), err
+}
+
+// runEntry is one line in the journal of the scheduler, describing a run.
+type runEntry struct {
+	Dir     string    `json:"dir"`
+	Target  string    `json:"target"`
+	Profile string    `json:"profile,omitempty"` // if synced via the control api
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Skipped bool      `json:"skipped,omitempty"` // unchanged since the last sync
+	Error   string    `json:"error,omitempty"`
+}
+
+// appendRun appends the entry as a json-line to the journal, if any.
+func appendRun(path string, entry *runEntry) {
+	if path == "" {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err == nil {
+			_, err = f.Write(append(data, '\n'))
+			if cErr := f.Close(); err == nil {
+				err = cErr
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to update journal: %v", err)
+	}
+}
+
+// runJob syncs the directory of the job, unless it's unchanged since the
+// last successful sync.
+func runJob(cfg *config, j *job, journal string) {
+	entry := &runEntry{Dir: j.dir, Target: j.target, Start: time.Now()}
+	defer func() {
+		entry.End = time.Now()
+		appendRun(journal, entry)
+		if cfg.status != nil {
+			cfg.status.addRun(entry)
+		}
+	}()
+	fp, err := fingerprint(j.dir)
+	if err != nil {
+		entry.Error = err.Error()
+		log.Printf("Sync of %v skipped: %v", j, err)
+		return
+	}
+	if j.last != nil && string(fp) == string(j.last) {
+		entry.Skipped = true
+		log.Printf("Sync of %v skipped, unchanged", j)
+		if cfg.metrics != nil {
+			cfg.metrics.addSkipped(j.dir)
+		}
+		return
+	}
+	jobCfg := *cfg
+	jobCfg.target = j.target
+	jobCfg.sendArgs = append(append([]string{}, cfg.sendArgs...), j.args...)
+	if err := runSync(&jobCfg, j.dir); err != nil {
+		entry.Error = err.Error()
+		log.Print(err)
+		return
+	}
+	j.last = fp
+}
+
+// scheduleLoop runs the jobs on their schedules, one at a time, until a
+// signal arrives on sigs. Jobs running every so often also run at startup, to
+// catch up with changes made while we weren't running.
+func scheduleLoop(cfg *config, jobs []*job, journal string, sigs <-chan os.Signal) error {
+	now := time.Now()
+	for _, j := range jobs {
+		if j.daily {
+			j.schedule(now)
+		} else {
+			j.next = now
+		}
+		log.Printf("Scheduled sync of %v, first at %v", j, j.next.Format(time.RFC3339))
+	}
+	for {
+		first := jobs[0]
+		for _, j := range jobs[1:] {
+			if j.next.Before(first.next) {
+				first = j
+			}
+		}
+		timer := time.NewTimer(time.Until(first.next))
+		select {
+		case <-timer.C:
+			runJob(cfg, first, journal)
+			first.schedule(time.Now())
+		case sig := <-sigs:
+			timer.Stop()
+			log.Printf("Got %v, exiting", sig)
+			return nil
+		}
+	}
+}
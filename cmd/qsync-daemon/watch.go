@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"github.com/holiman/qvm-sync/packer"
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_ATTRIB | syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR
+
+// watcher watches a directory tree for changes, via inotify.
+type watcher struct {
+	// The inotify fd, non-blocking, so that reads go through the runtime
+	// poller, and closing it wakes up run.
+	f       *os.File
+	conn    syscall.RawConn
+	dirs    map[int32]string // watch descriptor -> directory
+	changes chan struct{}
+}
+
+func newWatcher(root string) (*watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		dirs:    make(map[int32]string),
+		changes: make(chan struct{}, 1),
+	}
+	if w.conn, err = w.f.SyscallConn(); err == nil {
+		err = w.addTree(root)
+	}
+	if err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// addTree adds watches for the directory and everything below it. Inotify
+// is not recursive, so each directory needs a watch of its own.
+func (w *watcher) addTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Vanished in the meantime
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == packer.StateDir {
+			return filepath.SkipDir
+		}
+		var wd int
+		if cErr := w.conn.Control(func(fd uintptr) {
+			wd, err = unix.InotifyAddWatch(int(fd), path, watchMask)
+		}); cErr != nil {
+			return cErr
+		}
+		if err != nil {
+			return err
+		}
+		w.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+// run reads events, and signals on changes, until the inotify fd is closed.
+func (w *watcher) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil || n <= 0 {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Printf("Watch ended: %v", err)
+			}
+			close(w.changes)
+			return
+		}
+		w.handle(buf[:n])
+		// Several changes are collapsed into one signal
+		select {
+		case w.changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// handle parses the events, adding watches for new directories. They're in
+// the byte order of the host, and aligned for the struct, as the kernel
+// writes them.
+func (w *watcher) handle(data []byte) {
+	for len(data) >= unix.SizeofInotifyEvent {
+		ev := (*unix.InotifyEvent)(unsafe.Pointer(&data[0]))
+		end := unix.SizeofInotifyEvent + int(ev.Len)
+		if end > len(data) {
+			return
+		}
+		name := bytes.TrimRight(data[unix.SizeofInotifyEvent:end], "\x00")
+		data = data[end:]
+		switch {
+		case ev.Mask&syscall.IN_Q_OVERFLOW != 0:
+			log.Print("Watch queue overflow, changes may have been missed")
+		case ev.Mask&syscall.IN_IGNORED != 0:
+			delete(w.dirs, ev.Wd)
+		case ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+			if dir, ok := w.dirs[ev.Wd]; ok {
+				if err := w.addTree(filepath.Join(dir, string(name))); err != nil {
+					log.Printf("Failed watching %v: %v", name, err)
+				}
+			}
+		}
+	}
+}
+
+// Close stops the watch, and with it run, which closes the changes.
+func (w *watcher) Close() error {
+	return w.f.Close()
+}
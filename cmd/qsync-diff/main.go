@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/holiman/qvm-sync/packer"
+)
+
+func init() {
+	packer.SetupLogging()
+}
+
+// record is one line of output, describing what a sync from the local side
+// (the source) would change on the remote side (the destination).
+type record struct {
+	Change  string `json:"change"` // added, modified or deleted
+	Path    string `json:"path"`
+	Type    string `json:"type"` // file, dir or symlink
+	SrcSize string `json:"src_size,omitempty"`
+	DstSize string `json:"dst_size,omitempty"`
+	SrcCrc  string `json:"src_crc,omitempty"`
+	DstCrc  string `json:"dst_crc,omitempty"`
+	Detail  string `json:"detail"`
+}
+
+var csvHeader = []string{"change", "path", "type", "src_size", "dst_size", "src_crc", "dst_crc", "detail"}
+
+func (r *record) csv() []string {
+	return []string{r.Change, r.Path, r.Type, r.SrcSize, r.DstSize, r.SrcCrc, r.DstCrc, r.Detail}
+}
+
+func newRecord(d *packer.Difference) *record {
+	r := &record{
+		Change: d.Change(),
+		Path:   d.Path,
+		Detail: d.Reason(),
+	}
+	describe := func(e *packer.ManifestEntry) (size, crc string) {
+		if e == nil {
+			return "", ""
+		}
+		switch mode := os.FileMode(e.Mode); {
+		case mode.IsDir():
+			r.Type = "dir"
+			return "", ""
+		case mode&os.ModeSymlink != 0:
+			r.Type = "symlink"
+		default:
+			r.Type = "file"
+		}
+		return strconv.FormatUint(e.Size, 10), fmt.Sprintf("%08x", e.Crc)
+	}
+	// The type of the destination, unless it's only at the source
+	r.SrcSize, r.SrcCrc = describe(d.Local)
+	r.DstSize, r.DstCrc = describe(d.Remote)
+	return r
+}
+
+// qsync-diff is started by qrexec-client-vm, connected to the
+// qubes.FilesyncVerify service in the remote qube (see qsync-verify):
+//
+//	local: qsync-diff [-remote dir] [-format csv] /local/dir  <->  remote: qsync-verify -serve -root /home/user/QubesSync/<caller>
+//
+// It writes one record per difference, describing what a sync would change.
+// It exits with 1 if there are differences.
+func main() {
+	remote := flag.String("remote", "", "remote `directory` to compare with (default: the name of the local directory)")
+	format := flag.String("format", "ndjson", "output `format`: ndjson or csv")
+	output := flag.String("o", "", "`file` to write the records to (default: standard error, since standard output is connected to the other side)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n %s [options] /directory/to/compare\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		fmt.Fprintf(flag.CommandLine.Output(), "Error: path not supplied\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *format != "ndjson" && *format != "csv" {
+		log.Fatalf("Unknown format %q", *format)
+	}
+	out := os.Stderr
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		out = f
+	}
+	local := filepath.Clean(flag.Arg(0))
+	dir := *remote
+	if dir == "" {
+		// Where qvm-sync puts it, within the jail of the calling qube
+		dir = filepath.Base(local)
+	}
+	diffs, err := packer.Verify(os.Stdin, os.Stdout, local, dir)
+	if err != nil {
+		log.Fatalf("Error during comparison: %v", err)
+	}
+	if err := writeRecords(out, *format, diffs); err != nil {
+		log.Fatal(err)
+	}
+	if out != os.Stderr {
+		if err := out.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+}
+
+func writeRecords(out io.Writer, format string, diffs []*packer.Difference) error {
+	if format == "csv" {
+		w := csv.NewWriter(out)
+		w.Write(csvHeader)
+		for _, d := range diffs {
+			w.Write(newRecord(d).csv())
+		}
+		w.Flush()
+		return w.Error()
+	}
+	enc := json.NewEncoder(out)
+	for _, d := range diffs {
+		if err := enc.Encode(newRecord(d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
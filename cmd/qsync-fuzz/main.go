@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/holiman/qvm-sync/packer"
+)
+
+func init() {
+	packer.SetupLogging()
+}
+
+// qsync-fuzz feeds mutated protocol streams to a receiver, to find inputs
+// which crash or hang it. The receiver parses what another qube sends, so it
+// must survive anything.
+//
+// The corpus is a directory of recorded streams, which are batches written
+// against an empty destination (qsync-send -batch-out). One can be recorded
+// from a directory with:
+//
+//	qsync-fuzz -corpus corpus -record /some/dir
+//
+// Each mutated stream is given to a receiver in a child process, with its
+// own destination, a limited heap and file size, and a timeout.
+// Inputs which crash or hang it are saved in the crashers directory, along
+// with the output of the receiver, and can be run again with -run.
+//
+// OBS: The receiver runs without the jail of the preloader, as the user
+// running qsync-fuzz. Use an account, or a qube, with nothing to lose.
+func main() {
+	corpusDir := flag.String("corpus", "corpus", "`directory` of recorded streams to mutate")
+	record := flag.String("record", "", "record the sync of `dir` into the corpus, and exit")
+	crashers := flag.String("crashers", "crashers", "`directory` where inputs which crash or hang the receiver are saved")
+	runFile := flag.String("run", "", "run the receiver on the input in `file`, and print the outcome")
+	timeout := flag.Duration("timeout", 10*time.Second, "time the receiver has for an input, before it's considered hung")
+	memory := flag.Int64("memory", 1024, "heap of the receiver, in `MB`")
+	fsize := flag.Int64("fsize", 64, "maximum size of a file written by the receiver, in `MB`")
+	quota := flag.Uint64("quota", 256, "maximum total size of the destination, in `MB`")
+	duration := flag.Duration("duration", 0, "stop after this long (0 = until interrupted)")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "random `seed` for the mutations")
+	flag.Parse()
+
+	if len(os.Args) > 5 && os.Args[1] == childArg {
+		child(os.Args[2], os.Args[3], os.Args[4], os.Args[5])
+		return
+	}
+	b := &budget{timeout: *timeout, memory: *memory << 20, fsize: *fsize << 20, quota: *quota << 20}
+	if *record != "" {
+		path, err := recordStream(*corpusDir, *record)
+		if err != nil {
+			log.Fatalf("Recording failed: %v", err)
+		}
+		log.Printf("Recorded %v", path)
+		return
+	}
+	if *runFile != "" {
+		input, err := ioutil.ReadFile(*runFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		outcome, stderr, err := run(input, b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stderr.Write(stderr)
+		fmt.Println(outcomeNames[outcome])
+		return
+	}
+	corpus, err := loadCorpus(*corpusDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(*crashers, 0755); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Fuzzing with %d inputs, seed %d", len(corpus), *seed)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	fuzz(corpus, *crashers, b, *duration, rand.New(rand.NewSource(*seed)), stop)
+}
+
+// fuzz runs mutated inputs until the duration has passed, or it's stopped.
+func fuzz(corpus [][]byte, crashers string, b *budget, duration time.Duration, rnd *rand.Rand, stop chan os.Signal) {
+	var (
+		counts  = make([]int, len(outcomeNames))
+		seen    = make(map[string]bool) // signatures of crashes saved
+		start   = time.Now()
+		lastLog = start
+		execs   int
+	)
+	report := func() {
+		elapsed := time.Since(start)
+		log.Printf("execs: %d (%.0f/s), accepted: %d, rejected: %d, crashes: %d, hangs: %d, elapsed: %v",
+			execs, float64(execs)/elapsed.Seconds(), counts[accepted], counts[rejected],
+			counts[crashed], counts[hung], elapsed.Round(time.Second))
+	}
+	defer report()
+	for duration == 0 || time.Since(start) < duration {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		input := mutate(corpus[rnd.Intn(len(corpus))], corpus, rnd)
+		outcome, stderr, err := run(input, b)
+		if err != nil {
+			log.Fatalf("Running the receiver failed: %v", err)
+		}
+		execs++
+		counts[outcome]++
+		if outcome == crashed || outcome == hung {
+			sig := outcomeNames[outcome]
+			if outcome == crashed {
+				sig = signature(stderr)
+			}
+			if !seen[sig] {
+				seen[sig] = true
+				path, err := save(crashers, outcomeNames[outcome], input, stderr)
+				if err != nil {
+					log.Fatalf("Saving the input failed: %v", err)
+				}
+				log.Printf("Found %v: %v, saved as %v", outcomeNames[outcome], sig, path)
+			}
+		}
+		if time.Since(lastLog) > 10*time.Second {
+			report()
+			lastLog = time.Now()
+		}
+	}
+}
+
+// save writes an input and the output of the receiver into dir.
+func save(dir, kind string, input, stderr []byte) (string, error) {
+	path := filepath.Join(dir, fmt.Sprintf("%v-%x.qsync", kind, sha256.Sum256(input)))
+	if err := ioutil.WriteFile(path, input, 0644); err != nil {
+		return "", err
+	}
+	return path, ioutil.WriteFile(path+".txt", stderr, 0644)
+}
+
+// loadCorpus reads the inputs in dir.
+func loadCorpus(dir string) ([][]byte, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var corpus [][]byte
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		corpus = append(corpus, data)
+	}
+	if len(corpus) == 0 {
+		return nil, fmt.Errorf("no inputs in %v, see -record", dir)
+	}
+	return corpus, nil
+}
+
+// recordStream records the sync of dir to an empty destination, into the
+// corpus. The stream is not compressed, so that the mutations hit the
+// protocol rather than the snappy framing.
+func recordStream(corpus, dir string) (string, error) {
+	if err := os.MkdirAll(corpus, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(corpus, filepath.Base(filepath.Clean(dir))+".qsync")
+	out, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	opts := packer.NewOptions(packer.WithVerbosity(0), packer.WithCompression(packer.CompressionOff),
+		packer.WithCrcUsage(packer.FileCrcAtimeNsecMetadata))
+	sender, err := packer.NewBatchSender(out, opts, nil)
+	if err == nil {
+		err = sender.Sync(dir)
+	}
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return path, err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+)
+
+// interesting are values which tend to hit edge cases, when written over
+// the lengths, modes and counts in the stream.
+var interesting = []uint32{0, 1, 0x7f, 0x80, 0xff, 0x100, 0xfff, 0x1000, 0xffff, 0x10000,
+	0x7fffffff, 0x80000000, 0xfffffffe, 0xffffffff}
+
+// mutate returns a mutated copy of input, applying a few random mutations.
+// Other inputs of the corpus may be spliced in.
+func mutate(input []byte, corpus [][]byte, rnd *rand.Rand) []byte {
+	data := append([]byte(nil), input...)
+	for n := 1 + rnd.Intn(4); n > 0; n-- {
+		if len(data) == 0 {
+			data = append(data, byte(rnd.Intn(256)))
+			continue
+		}
+		pos := rnd.Intn(len(data))
+		switch rnd.Intn(8) {
+		case 0: // flip a bit
+			data[pos] ^= 1 << uint(rnd.Intn(8))
+		case 1: // set a byte
+			data[pos] = byte(rnd.Intn(256))
+		case 2: // write an interesting 32-bit value, as the headers are made of them
+			if pos+4 <= len(data) {
+				binary.LittleEndian.PutUint32(data[pos:], interesting[rnd.Intn(len(interesting))])
+			}
+		case 3: // add to a 32-bit value
+			if pos+4 <= len(data) {
+				v := binary.LittleEndian.Uint32(data[pos:])
+				binary.LittleEndian.PutUint32(data[pos:], v+uint32(rnd.Intn(33)-16))
+			}
+		case 4: // remove a range
+			end := pos + 1 + rnd.Intn(min(len(data)-pos, 64))
+			data = append(data[:pos], data[end:]...)
+		case 5: // duplicate a range
+			end := pos + 1 + rnd.Intn(min(len(data)-pos, 64))
+			data = append(data[:end], append(append([]byte(nil), data[pos:end]...), data[end:]...)...)
+		case 6: // truncate
+			data = data[:pos]
+		case 7: // splice in the tail of another input
+			other := corpus[rnd.Intn(len(corpus))]
+			if len(other) > 0 {
+				data = append(data[:pos], other[rnd.Intn(len(other)):]...)
+			}
+		}
+	}
+	return data
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/holiman/qvm-sync/packer"
+)
+
+// childArg is the (hidden) first argument used when qsync-fuzz executes
+// itself to run a receiver on an input.
+const childArg = "__fuzz-child"
+
+// budget is what the receiver may use for an input.
+type budget struct {
+	timeout time.Duration
+	memory  int64  // data segment (the heap), in bytes
+	fsize   int64  // max size of a file written, in bytes
+	quota   uint64 // max total size of the destination, in bytes
+}
+
+// Outcomes of running an input.
+const (
+	accepted = iota // the receiver completed the sync
+	rejected        // the receiver failed with an error, as it should on bad input
+	crashed
+	hung
+)
+
+var outcomeNames = []string{"accepted", "rejected", "crash", "hang"}
+
+// run executes a receiver on the input, in a child process with the budget
+// applied, and a destination of its own. It returns the outcome, and what
+// the child wrote to stderr.
+func run(input []byte, b *budget) (int, []byte, error) {
+	dest, err := ioutil.TempDir("", "qsync-fuzz")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer os.RemoveAll(dest)
+	self, err := os.Executable()
+	if err != nil {
+		return 0, nil, err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(self, childArg, dest, strconv.FormatInt(b.memory, 10),
+		strconv.FormatInt(b.fsize, 10), strconv.FormatUint(b.quota, 10))
+	cmd.Stdin, cmd.Stderr = bytes.NewReader(input), &stderr
+	if err := cmd.Start(); err != nil {
+		return 0, nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(b.timeout):
+		cmd.Process.Kill()
+		<-done
+		// The destination may have been left unwritable, see removeAll
+		removeAll(dest)
+		return hung, stderr.Bytes(), nil
+	}
+	removeAll(dest)
+	if err == nil {
+		return accepted, stderr.Bytes(), nil
+	}
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 1 {
+		return rejected, stderr.Bytes(), nil
+	}
+	// Panics exit with 2, and resource limits show up as signals
+	return crashed, stderr.Bytes(), nil
+}
+
+// removeAll removes the directory, also when the receiver has left read-only
+// directories in it.
+func removeAll(dir string) {
+	if os.RemoveAll(dir) == nil {
+		return
+	}
+	exec.Command("chmod", "-R", "u+rwx", dir).Run()
+	os.RemoveAll(dir)
+}
+
+// child runs a receiver on stdin, into dest, with the given limits. It exits
+// with 1 if the receiver fails, which is the expected outcome for most
+// inputs; anything else than 0 or 1 is a crash.
+func child(dest, memory, fsize, quota string) {
+	// The logging of the receiver only slows us down. Panics are still
+	// written to stderr by the runtime.
+	log.SetOutput(ioutil.Discard)
+	limits := map[int]string{syscall.RLIMIT_DATA: memory, syscall.RLIMIT_FSIZE: fsize, syscall.RLIMIT_CORE: "0"}
+	for resource, value := range limits {
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid limit %q\n", value)
+			os.Exit(3)
+		}
+		if v == 0 && resource != syscall.RLIMIT_CORE {
+			continue
+		}
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: v, Max: v}); err != nil {
+			fmt.Fprintf(os.Stderr, "failed setting rlimit: %v\n", err)
+			os.Exit(3)
+		}
+	}
+	q, _ := strconv.ParseUint(quota, 10, 64)
+	r, err := packer.NewReceiver(os.Stdin, ioutil.Discard, packer.NewReceiverOptions(packer.WithRoot(dest), packer.WithQuota(q)))
+	if err == nil {
+		err = r.Sync()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// signature identifies a crash by its panic message and the innermost frame
+// within qvm-sync, so that the same crash is only saved once.
+func signature(stderr []byte) string {
+	var msg, frame string
+	for _, line := range strings.Split(string(stderr), "\n") {
+		switch {
+		case msg == "" && (strings.HasPrefix(line, "panic: ") || strings.HasPrefix(line, "fatal error: ")):
+			msg = line
+		case msg != "" && frame == "" && strings.Contains(line, "qvm-sync/"):
+			// Without the arguments, which differ between runs
+			frame = strings.TrimSpace(line)
+			if i := strings.LastIndex(frame, "("); i > 0 {
+				frame = frame[:i]
+			}
+		}
+	}
+	if msg == "" {
+		return "no panic message"
+	}
+	return msg + " at " + frame
+}
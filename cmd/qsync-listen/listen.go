@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/holiman/qvm-sync/packer"
+	"github.com/holiman/qvm-sync/transport"
+)
+
+// peerRe matches the client names which are accepted as directory names.
+var peerRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// conn is a connection from a client, tls or vsock.
+type conn interface {
+	io.ReadWriteCloser
+	SetDeadline(t time.Time) error
+}
+
+// acceptFunc waits for the next connection, and returns it along with the
+// name of the client.
+type acceptFunc func() (conn, string, error)
+
+// idleConn drops the connection if a read or write doesn't complete within
+// the timeout.
+type idleConn struct {
+	conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.SetDeadline(time.Now().Add(c.timeout))
+	return c.conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.SetDeadline(time.Now().Add(c.timeout))
+	return c.conn.Write(p)
+}
+
+// listenTLS returns an acceptFunc for tls connections on addr. Clients are
+// named after the common name of their certificate.
+func listenTLS(addr string, cfg *tls.Config) (acceptFunc, error) {
+	l, err := transport.ListenTLS(addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Listening on %v", l.Addr())
+	return func() (conn, string, error) {
+		conn, peer, err := transport.AcceptTLS(l)
+		if err != nil {
+			return nil, "", err
+		}
+		log.Printf("Connection from %v (%v)", peer, conn.RemoteAddr())
+		return conn, peer, nil
+	}, nil
+}
+
+// listenVsock returns an acceptFunc for vsock connections on port. Clients
+// are named after their CID, e.g. cid-3.
+func listenVsock(port uint32) (acceptFunc, error) {
+	l, err := transport.ListenVsock(port)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Listening on vsock port %d", l.Port())
+	return func() (conn, string, error) {
+		conn, cid, err := l.Accept()
+		if err != nil {
+			return nil, "", err
+		}
+		log.Printf("Connection from vsock cid %d", cid)
+		return conn, fmt.Sprintf("cid-%d", cid), nil
+	}, nil
+}
+
+// listenUnix returns an acceptFunc for connections on the unix socket, which
+// may also be passed by socket activation. Clients are named after their
+// uid, e.g. uid-1000.
+func listenUnix(l *net.UnixListener) acceptFunc {
+	log.Printf("Listening on %v", l.Addr())
+	return func() (conn, string, error) {
+		conn, uid, err := transport.AcceptUnix(l)
+		if err != nil {
+			return nil, "", err
+		}
+		log.Printf("Connection from uid %d", uid)
+		return conn, fmt.Sprintf("uid-%d", uid), nil
+	}
+}
+
+// listen accepts connections, one at a time, and receives a sync from each.
+// Like the jails of the preloader, each client gets a directory of its own,
+// named after the client. Clients which stay silent for longer than the
+// timeout are dropped.
+func listen(accept acceptFunc, timeout time.Duration, ropts *packer.ReceiverOptions) error {
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	var (
+		mu      sync.Mutex
+		current *packer.Receiver
+	)
+	// On SIGINT/SIGTERM, clean up after the sync in progress, if any
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Got %v, exiting", sig)
+		mu.Lock()
+		if current != nil {
+			current.Cleanup()
+		}
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
+	for {
+		c, peer, err := accept()
+		if err != nil {
+			return err
+		}
+		conn := &idleConn{conn: c, timeout: timeout}
+		r, err := receiveFrom(conn, peer, root, ropts)
+		if err == nil {
+			mu.Lock()
+			current = r
+			mu.Unlock()
+			err = r.Sync()
+			mu.Lock()
+			current = nil
+			mu.Unlock()
+		}
+		conn.Close()
+		if err != nil {
+			log.Printf("Sync from %v failed: %v", peer, err)
+			continue
+		}
+		log.Printf("Sync from %v done", peer)
+	}
+}
+
+// receiveFrom creates the receiver for a client, within its directory.
+func receiveFrom(conn io.ReadWriter, peer, root string, ropts *packer.ReceiverOptions) (*packer.Receiver, error) {
+	if !peerRe.MatchString(peer) {
+		return nil, fmt.Errorf("invalid client name %q", peer)
+	}
+	dir := root + "/" + peer
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return nil, err
+	}
+	opts := *ropts
+	opts.Peer = peer
+	if ropts.Store != nil {
+		// The store is shared, each client has manifests of its own
+		opts.StoreSource = peer
+	}
+	return packer.NewReceiver(conn, conn, &opts)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/holiman/qvm-sync/packer"
+	"github.com/holiman/qvm-sync/transport"
+)
+
+func init() {
+	packer.SetupLogging()
+}
+
+// qsync-listen receives syncs over the network (tls) or vsock, for when
+// sender and receiver are not connected via qrexec:
+//
+//	qsync-listen -listen 0.0.0.0:7777 -tls-cert server.crt -tls-key server.key -tls-ca ca.crt
+//	qsync-listen -listen-vsock 5000
+//	qsync-listen -listen-unix /run/user/1000/qsync.sock
+//
+// Without any of these, it serves the unix socket passed by systemd socket
+// activation. Syncs are received one after the other, by the same process.
+//
+// It's kept apart from qsync-receive, which runs in the jail of the
+// preloader, and must remain statically linked (without net).
+func main() {
+	quota := flag.Uint64("quota", 0, "maximum total `bytes` in the directory of a client (0 = no quota)")
+	listenAddr := flag.String("listen", "", "listen for syncs on `address` (host:port), with tls")
+	tlsCert := flag.String("tls-cert", "", "certificate `file`, with -listen")
+	tlsKey := flag.String("tls-key", "", "private key `file` of the certificate, with -listen")
+	tlsCA := flag.String("tls-ca", "", "`file` with the ca which client certificates must be signed by, with -listen")
+	vsockPort := flag.Uint("listen-vsock", 0, "listen for syncs on vsock `port`")
+	unixPath := flag.String("listen-unix", "", "listen for syncs on the unix socket at `path`")
+	idleTimeout := flag.Duration("idle-timeout", defaultIdleTimeout, "`duration` after which a client which doesn't send or receive anything is dropped")
+	trustedKey := flag.String("trusted-key", "", "base64 public `key` which transfers must be signed with")
+	store := flag.String("store", "", "receive into the content-addressed store in `dir`, shared by all clients")
+	receiverFlags := packer.AddReceiverFlags(flag.CommandLine)
+	flag.Parse()
+
+	ropts, err := receiverFlags.ReceiverOptions(&packer.ReceiverOptions{MaxRootSize: *quota})
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "Error: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *trustedKey != "" {
+		key, err := packer.ParsePublicKey(*trustedKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ropts.TrustedKey = key
+	}
+	if *store != "" {
+		s, err := packer.OpenStore(*store)
+		if err != nil {
+			log.Fatalf("Error opening store: %v", err)
+		}
+		ropts.Store = s
+	}
+	var listeners int
+	for _, set := range []bool{*listenAddr != "", *vsockPort != 0, *unixPath != ""} {
+		if set {
+			listeners++
+		}
+	}
+	if listeners > 1 {
+		log.Fatal("Only one of -listen, -listen-vsock and -listen-unix can be used")
+	}
+	if *idleTimeout <= 0 {
+		log.Fatal("The idle timeout must be positive")
+	}
+	var accept acceptFunc
+	switch {
+	case *listenAddr != "":
+		cfg, cfgErr := transport.TLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if cfgErr != nil {
+			log.Fatal(cfgErr)
+		}
+		accept, err = listenTLS(*listenAddr, cfg)
+	case *vsockPort != 0:
+		accept, err = listenVsock(uint32(*vsockPort))
+	case *unixPath != "":
+		var l *net.UnixListener
+		if l, err = transport.ListenUnix(*unixPath); err == nil {
+			accept = listenUnix(l)
+		}
+	default:
+		l, aErr := transport.ActivatedListener()
+		if aErr != nil {
+			log.Fatal(aErr)
+		}
+		if l == nil {
+			log.Fatal("One of -listen, -listen-vsock and -listen-unix must be used, or socket activation")
+		}
+		accept = listenUnix(l)
+	}
+	if err == nil {
+		err = listen(accept, *idleTimeout, ropts)
+	}
+	log.Fatal(err)
+}
+
+// defaultIdleTimeout is how long a client may stay silent, before it's
+// dropped. Syncs are received one at a time, so a silent client would
+// otherwise block everyone else.
+const defaultIdleTimeout = 2 * time.Minute
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/holiman/qvm-sync/packer"
+)
+
+func init() {
+	packer.SetupLogging()
+}
+
+// qsync-log shows the journal of the syncs received into a directory, or
+// what they did to a file:
+//
+//	qsync-log -root /home/user/QubesIncoming/work [-profile docs] [-peer work] [-n 10]
+//	qsync-log -root /home/user/QubesIncoming/work -file docs/report.txt
+func main() {
+	root := flag.String("root", ".", "`directory` the syncs are received into")
+	profile := flag.String("profile", "", "only show syncs of the `profile`")
+	peer := flag.String("peer", "", "only show syncs from the `peer`")
+	last := flag.Int("n", 0, "only show the last `count` syncs (0 = all)")
+	file := flag.String("file", "", "show the history of the `path` (relative to the root), from the audit log")
+	asJSON := flag.Bool("json", false, "print the journal entries as json lines")
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *file != "" {
+		events, err := packer.FileHistory(*root, *file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(events) == 0 {
+			log.Fatalf("No history of %v (is the audit log enabled?)", *file)
+		}
+		for _, ev := range events {
+			from := "unknown sync"
+			if s := ev.Sync; s != nil {
+				from = describe(s)
+			}
+			fmt.Printf("%v %-6v %v (%d bytes), %v\n", ev.Time.Local().Format(time.RFC3339), ev.Action, ev.Path, ev.Size, from)
+		}
+		return
+	}
+	entries, err := packer.ReadJournal(*root)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var shown []*packer.JournalEntry
+	for _, e := range entries {
+		if (*profile == "" || e.Profile == *profile) && (*peer == "" || e.Peer == *peer) {
+			shown = append(shown, e)
+		}
+	}
+	if *last > 0 && len(shown) > *last {
+		shown = shown[len(shown)-*last:]
+	}
+	for _, e := range shown {
+		if *asJSON {
+			data, _ := json.Marshal(e)
+			fmt.Println(string(data))
+			continue
+		}
+		result := "ok"
+		if e.Error != "" {
+			result = "failed: " + e.Error
+		}
+		files := fmt.Sprintf("%d files (%d bytes)", e.Files, e.Bytes)
+		if e.Gone > 0 {
+			files += fmt.Sprintf(", %d gone", e.Gone)
+		}
+		if e.Failed > 0 {
+			files += fmt.Sprintf(", %d failed", e.Failed)
+		}
+		if e.Duplicates > 0 {
+			files += fmt.Sprintf(", %d duplicates", e.Duplicates)
+		}
+		deleted := fmt.Sprintf("%d deleted", e.Deleted)
+		if e.DeleteFailed > 0 {
+			deleted += fmt.Sprintf(" (%d failed)", e.DeleteFailed)
+		}
+		fmt.Printf("%v %v: %v, %v, %d conflicts, %v\n",
+			e.Start.Local().Format(time.RFC3339), describe(e), files, deleted, e.Conflicts, result)
+	}
+}
+
+// describe names the sync: the directory, where it came from and the profile.
+func describe(e *packer.JournalEntry) string {
+	s := e.Dir
+	if s == "" {
+		s = "?"
+	}
+	if e.Peer != "" {
+		s += " from " + e.Peer
+	}
+	if e.Profile != "" {
+		s += " (profile " + e.Profile + ")"
+	}
+	return s
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"os"
+)
+
+// auditLogger sends records about each sync to the system log (journald
+// picks these up via /dev/log), in addition to stderr. Since the records are
+// emitted by the privileged preloader, the jailed receiver cannot tamper with
+// them.
+type auditLogger struct {
+	w *syslog.Writer
+}
+
+func newAuditLogger() *auditLogger {
+	w, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_NOTICE, "qsync-preloader")
+	if err != nil {
+		log.Printf("System log not available: %v", err)
+	}
+	return &auditLogger{w}
+}
+
+func (a *auditLogger) logf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Print(msg)
+	if a.w != nil {
+		a.w.Notice(msg)
+	}
+}
+
+func (a *auditLogger) Close() {
+	if a.w != nil {
+		a.w.Close()
+	}
+}
+
+// fileHash returns the hex-encoded sha256 of the file at path.
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
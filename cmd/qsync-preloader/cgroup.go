@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the (unified, v2) cgroup hierarchy is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupLimits are the resource limits applied to the receiver.
+type cgroupLimits struct {
+	memoryMax string // value for memory.max, e.g. "512M"
+	cpuMax    int    // percentage of one cpu, 0 means no limit
+	ioMax     string // lines for io.max, e.g. "8:0 wbps=10485760"
+}
+
+func (l *cgroupLimits) empty() bool {
+	return l.memoryMax == "" && l.cpuMax == 0 && l.ioMax == ""
+}
+
+// cgroup is a transient cgroup, created for a single sync.
+type cgroup struct {
+	path string
+}
+
+// newCgroup creates the cgroup qsync/<name> and applies the limits to it.
+func newCgroup(name string, limits *cgroupLimits) (*cgroup, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("cgroup v2 not available: %v", err)
+	}
+	parent := filepath.Join(cgroupRoot, "qsync")
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+	// Processes can only be placed in leaf nodes, so the controllers must be
+	// enabled in both the root and our parent
+	var controllers []string
+	if limits.memoryMax != "" {
+		controllers = append(controllers, "+memory")
+	}
+	if limits.cpuMax != 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	if limits.ioMax != "" {
+		controllers = append(controllers, "+io")
+	}
+	for _, dir := range []string{cgroupRoot, parent} {
+		if err := writeCgroupFile(dir, "cgroup.subtree_control", strings.Join(controllers, " ")); err != nil {
+			return nil, err
+		}
+	}
+	cg := &cgroup{path: filepath.Join(parent, name)}
+	if err := os.Mkdir(cg.path, 0755); err != nil {
+		return nil, err
+	}
+	if err := cg.apply(limits); err != nil {
+		cg.remove()
+		return nil, err
+	}
+	return cg, nil
+}
+
+func (cg *cgroup) apply(limits *cgroupLimits) error {
+	if limits.memoryMax != "" {
+		if err := writeCgroupFile(cg.path, "memory.max", limits.memoryMax); err != nil {
+			return err
+		}
+		// Don't let it escape the memory limit by swapping
+		if err := writeCgroupFile(cg.path, "memory.swap.max", "0"); err != nil {
+			return err
+		}
+	}
+	if limits.cpuMax != 0 {
+		const period = 100000
+		quota := strconv.Itoa(limits.cpuMax * period / 100)
+		if err := writeCgroupFile(cg.path, "cpu.max", fmt.Sprintf("%v %d", quota, period)); err != nil {
+			return err
+		}
+	}
+	if limits.ioMax != "" {
+		// io.max takes one device per write
+		for _, line := range strings.Split(limits.ioMax, ",") {
+			if err := writeCgroupFile(cg.path, "io.max", strings.TrimSpace(line)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// spawnInto makes the command start its process within the cgroup, so it is
+// never outside of the limits. The returned file must be closed once the
+// command has started.
+func (cg *cgroup) spawnInto(cmd *exec.Cmd) (*os.File, error) {
+	dir, err := os.Open(cg.path)
+	if err != nil {
+		return nil, err
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	return dir, nil
+}
+
+// remove deletes the cgroup. This only succeeds once all processes in it
+// have exited.
+func (cg *cgroup) remove() error {
+	return os.Remove(cg.path)
+}
+
+func writeCgroupFile(dir, file, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed writing %q to %v: %v", value, file, err)
+	}
+	return nil
+}
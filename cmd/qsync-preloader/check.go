@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// checkResult is the outcome of one of the self-test checks.
+type checkResult struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// diagnosis is the report of the self-test, written as json to stdout.
+type diagnosis struct {
+	OK     bool          `json:"ok"`
+	Checks []checkResult `json:"checks"`
+}
+
+func (d *diagnosis) add(name string, err error, detail string) bool {
+	res := checkResult{Name: name, OK: err == nil, Detail: detail}
+	if err != nil {
+		res.Detail = err.Error()
+	}
+	d.Checks = append(d.Checks, res)
+	return err == nil
+}
+
+func (d *diagnosis) write(out io.Writer) error {
+	d.OK = true
+	for _, c := range d.Checks {
+		d.OK = d.OK && c.OK
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// selfCheck verifies that a sync could be executed with the given config,
+// without actually executing one: it runs the receiver in a scratch jail,
+// asking only for its usage. Nothing is left behind, except the jail root.
+func selfCheck(cfg *config, cfgErr error, trustedBinary string) *diagnosis {
+	d := new(diagnosis)
+	if !d.add("config", cfgErr, "") {
+		return d
+	}
+	if uid := syscall.Geteuid(); uid != 0 {
+		d.add("root", fmt.Errorf("need root credentials, got %v", uid), "")
+		return d
+	}
+	d.add("root", nil, "")
+	usr, err := user.Lookup(cfg.user)
+	if _, ok := err.(user.UnknownUserError); ok && cfg.createUser {
+		d.add("user", nil, fmt.Sprintf("'%s' does not exist, will be created", cfg.user))
+		return d
+	}
+	if !d.add("user", err, cfg.user) {
+		return d
+	}
+	uid, _ := strconv.Atoi(usr.Uid)
+	gid, _ := strconv.Atoi(usr.Gid)
+	if uid == 0 {
+		d.add("user", fmt.Errorf("same user alias forbidden"), "")
+		return d
+	}
+	binOk := d.add("binary", checkBinary(trustedBinary), trustedBinary)
+	destRoot, err := setupJailRoot(usr.HomeDir, cfg.syncDir, uid, gid)
+	if !d.add("jail-root", err, destRoot) {
+		return d
+	}
+	if cfg.systemd != "" && cfg.systemd != systemdScope && cfg.systemd != systemdService {
+		d.add("systemd", fmt.Errorf("invalid systemd mode %q", cfg.systemd), "")
+	}
+	if !cfg.limits.empty() && cfg.systemd == "" {
+		_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+		d.add("cgroup", err, cgroupRoot)
+	}
+	if !binOk {
+		return d
+	}
+	// A scratch jail, to try out the namespaces and mounts in
+	jail, err := setupDir(filepath.Join(destRoot, fmt.Sprintf(".qsync-check-%d", os.Getpid())), uid, gid)
+	if !d.add("jail", err, jail) {
+		return d
+	}
+	defer os.Remove(jail)
+	trustedBinary, _ = filepath.Abs(trustedBinary)
+	var stderr bytes.Buffer
+	cmd := jailCommand(jail, trustedBinary, uid, gid, &cfg.rlimits, []string{"-help"})
+	cmd.Env = jailEnv(nil)
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	// With -help, the receiver prints its usage and exits with 0 or 2,
+	// depending on the go version it was built with
+	if eErr, ok := err.(*exec.ExitError); ok && eErr.ExitCode() == 2 {
+		err = nil
+	}
+	if err == nil && !strings.Contains(stderr.String(), "Usage") {
+		err = fmt.Errorf("unexpected output")
+	}
+	if err != nil {
+		err = fmt.Errorf("%v: %v", err, strings.TrimSpace(stderr.String()))
+	}
+	d.add("exec", err, "")
+	return d
+}
+
+// checkBinary checks that the receiver binary is a regular, executable file,
+// not writable by others, and statically linked, since nothing but the
+// binary itself is available within the jail.
+func checkBinary(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file: %v", info.Mode())
+	}
+	if info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("not executable: %v", info.Mode())
+	}
+	if info.Mode().Perm()&022 != 0 {
+		return fmt.Errorf("writable by others: %v", info.Mode())
+	}
+	f, err := elf.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return fmt.Errorf("dynamically linked")
+		}
+	}
+	return nil
+}
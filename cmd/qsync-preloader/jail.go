@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// jailInitArg is the (hidden) first argument used when the preloader
+// re-executes itself inside the new namespaces.
+const jailInitArg = "__jail-init"
+
+const (
+	prSetNoNewPrivs = 38 // PR_SET_NO_NEW_PRIVS, missing from package syscall
+
+	secbitNoroot              = 1 << 0
+	secbitNorootLocked        = 1 << 1
+	secbitNoSetuidFixup       = 1 << 2
+	secbitNoSetuidFixupLocked = 1 << 3
+)
+
+// jailCommand returns a command which re-executes the preloader in new user,
+// mount and pid namespaces, where jailInit sets up the jail and executes the
+// binary (given as an absolute path), with the given rlimits.
+//
+// Within the user namespace, only uid/gid 0 exist, and they map to the
+// given uid/gid on the outside. So even if the jailed process were to break
+// out of the mount namespace, it would only have the privileges of 'user'.
+func jailCommand(jail, binary string, uid, gid int, limits *rlimits, args []string) *exec.Cmd {
+	return &exec.Cmd{
+		Path: "/proc/self/exe",
+		Args: append([]string{"qsync-preloader", jailInitArg, jail, binary, limits.String()}, args...),
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID,
+			UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}},
+			GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}},
+			// Needed so the credential below can clear the supplementary
+			// groups inherited from the caller
+			GidMappingsEnableSetgroups: true,
+			Credential:                 &syscall.Credential{Uid: 0, Gid: 0},
+			// A process group of its own, so it can be killed as a whole
+			Setpgid: true,
+		},
+	}
+}
+
+// inJailNamespace checks that we are pid 1 of a pid namespace, within a user
+// namespace. This is what jailCommand sets up, and it's important to verify,
+// since the preloader is suid: we must never do the mount dance in the
+// initial namespaces.
+func inJailNamespace() bool {
+	if os.Getpid() != 1 {
+		return false
+	}
+	data, err := ioutil.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(data))
+	// The initial user namespace has the identity mapping '0 0 4294967295'
+	return len(fields) == 3 && fields[2] == "1"
+}
+
+// envAllowlist are the variables passed on from our own environment to the
+// receiver. Everything else is cleared.
+var envAllowlist = []string{"QREXEC_REMOTE_DOMAIN", "QREXEC_SERVICE_ARGUMENT", "LANG", "LC_ALL", "TZ"}
+
+// envPrefix is the prefix of the variables used to configure the receiver,
+// which are also passed on.
+const envPrefix = "QSYNC_"
+
+// jailEnv returns the environment for the receiver: the allowed variables
+// from our own environment, overridden by the given settings.
+func jailEnv(settings map[string]string) []string {
+	vars := make(map[string]string)
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if strings.HasPrefix(parts[0], envPrefix) {
+			vars[parts[0]] = parts[1]
+		}
+	}
+	for _, k := range envAllowlist {
+		if v, ok := os.LookupEnv(k); ok {
+			vars[k] = v
+		}
+	}
+	for k, v := range settings {
+		vars[k] = v
+	}
+	env := make([]string, 0, len(vars))
+	for k, v := range vars {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// The layout of the root filesystem within the jail
+const (
+	jailBinary  = "qsync-receive" // the receiver binary, mounted read-only
+	jailSyncDir = "sync"          // the jail directory, where the receiver runs
+)
+
+// jailInit runs inside the namespaces created by jailCommand. It builds a
+// new, read-only, root filesystem containing only the binary and the jail,
+// which is mounted nosuid, nodev and noexec. It then pivots into it, drops
+// all capabilities, applies the rlimits and executes the binary within the
+// jail directory.
+//
+// The binary is bind-mounted from its trusted location, so there is never a
+// copy of it which the jailed process (or any other process running as
+// 'user') could tamper with.
+func jailInit(jail, binary, rlimitSpec string, args []string) error {
+	if !inJailNamespace() {
+		return fmt.Errorf("not in jail namespace")
+	}
+	limits, err := parseRlimits(rlimitSpec)
+	if err != nil {
+		return err
+	}
+	// Don't let any mount changes propagate back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed making mounts private: %v", err)
+	}
+	// The new root is mounted on top of the jail, so keep a handle to the
+	// jail itself, to mount it within the new root
+	jailFd, err := syscall.Open(jail, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed opening jail: %v", err)
+	}
+	defer syscall.Close(jailFd)
+	if err := syscall.Mount("tmpfs", jail, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755,size=64k"); err != nil {
+		return fmt.Errorf("failed mounting root: %v", err)
+	}
+	var (
+		syncPath = filepath.Join(jail, jailSyncDir)
+		binPath  = filepath.Join(jail, jailBinary)
+	)
+	if err := os.Mkdir(syncPath, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(binPath, nil, 0755); err != nil {
+		return err
+	}
+	// Not recursive: that would bring along the new root, which is now
+	// mounted beneath the jail
+	jailSrc := fmt.Sprintf("/proc/self/fd/%d", jailFd)
+	if err := syscall.Mount(jailSrc, syncPath, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed bind mounting jail: %v", err)
+	}
+	if err := remount(syncPath, syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC); err != nil {
+		return fmt.Errorf("failed remounting jail: %v", err)
+	}
+	// The binary is the only executable thing, and read-only
+	if err := syscall.Mount(binary, binPath, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed mounting binary: %v", err)
+	}
+	if err := remount(binPath, syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV); err != nil {
+		return fmt.Errorf("failed remounting binary: %v", err)
+	}
+	if err := remount(jail, syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV); err != nil {
+		return fmt.Errorf("failed remounting root: %v", err)
+	}
+	if err := os.Chdir(jail); err != nil {
+		return err
+	}
+	// Stack the new root on top of the old root, and detach the old root
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root failed: %v", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed detaching old root: %v", err)
+	}
+	if err := os.Chdir("/" + jailSyncDir); err != nil {
+		return err
+	}
+	if err := dropCapabilities(); err != nil {
+		return err
+	}
+	// As late as possible, since nproc also limits the threads we can start
+	if err := limits.apply(); err != nil {
+		return err
+	}
+	return syscall.Exec("/"+jailBinary, append([]string{jailBinary}, args...), os.Environ())
+}
+
+// remount changes the flags of the bind mount at path.
+func remount(path string, flags uintptr) error {
+	return syscall.Mount("", path, "", syscall.MS_BIND|syscall.MS_REMOUNT|flags, "")
+}
+
+// dropCapabilities makes sure that the binary we exec does not get any
+// capabilities (not even within the user namespace), and can never gain any.
+// The caller must have locked the OS thread, since this affects only the
+// current thread.
+func dropCapabilities() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("failed setting no_new_privs: %v", errno)
+	}
+	// Drop everything from the bounding set, until the kernel says that
+	// there are no more capabilities
+	for c := uintptr(0); ; c++ {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, c, 0)
+		if errno == syscall.EINVAL {
+			break
+		}
+		if errno != 0 {
+			return fmt.Errorf("failed dropping capability %d: %v", c, errno)
+		}
+	}
+	// Don't grant capabilities to uid 0 on exec
+	bits := secbitNoroot | secbitNorootLocked | secbitNoSetuidFixup | secbitNoSetuidFixupLocked
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_SECUREBITS, uintptr(bits), 0); errno != 0 {
+		return fmt.Errorf("failed setting securebits: %v", errno)
+	}
+	return nil
+}
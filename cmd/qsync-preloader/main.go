@@ -1,21 +1,33 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"flag"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
-	"math/rand"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
+
+	"github.com/holiman/qvm-sync/packer"
 )
 
 const (
-	destUser = "user"
-	destRoot = "/home/user/QubesSync"
+	// defaultUser is the account which owns the synced data, by default
+	defaultUser = "user"
+	// defaultSyncDir is the directory, within the home of the account, where
+	// the jails are placed
+	defaultSyncDir = "QubesSync"
 )
 
 var logger *log.Logger
@@ -28,18 +40,216 @@ func init() {
 	log.SetOutput(os.Stderr)
 }
 
+// config holds the preloader settings. Since the preloader runs suid, these
+// are taken from the root-owned config file and profiles, and only from the
+// command line if the caller is root, see checkCaller.
+type config struct {
+	// snapshotCmd is invoked (as root, outside the jail) before the receiver
+	// is started. The id it reports is forwarded to the receiver.
+	snapshotCmd []string
+	// limits are applied to the receiver via a transient cgroup
+	limits cgroupLimits
+	// rlimits are applied to the receiver by the jail init
+	rlimits rlimits
+	// quota is the maximum size of the jail, in bytes. 0 means no quota.
+	quota uint64
+	// user is the account which the receiver runs as, and which owns the
+	// synced data
+	user string
+	// createUser makes the preloader create the account if it does not exist
+	createUser bool
+	// syncDir is where the jails are placed, relative to the home of the
+	// account
+	syncDir string
+	// profile is the name of the profile in use, if any
+	profile string
+	// receiveArgs are extra arguments for the receiver
+	receiveArgs []string
+	// trustedKey is the file with the public key which transfers must be
+	// signed with, or a directory with one such file per qube
+	// (<qube>.pub). Empty means that signatures are not required.
+	trustedKey string
+	// timeout is the maximum duration of a sync. 0 means no timeout.
+	timeout time.Duration
+	// staleAge is the age after which leftovers from earlier syncs are
+	// removed from the jail. 0 means no cleanup.
+	staleAge time.Duration
+	// systemd, if set, is the kind of transient unit (scope or service) the
+	// receiver is launched in, via systemd-run
+	systemd string
+	// systemdProps are extra properties for the transient unit
+	systemdProps []string
+}
+
+const (
+	// binaryPrefix is the prefix of the receiver binary, as copied into the
+	// jail by earlier versions
+	binaryPrefix = "qsync-receive-temp-"
+	// stagingPrefix is the prefix of the tempfiles the receiver unpacks into
+	stagingPrefix = "qvm-"
+)
+
+// safePath is the PATH used for the commands run as root.
+const safePath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// killGracePeriod is how long the receiver gets to abort the sync, after
+// the timeout, before it is killed.
+const killGracePeriod = 10 * time.Second
+
 func main() {
-	if len(os.Args) < 2 {
+	if len(os.Args) > 4 && os.Args[1] == jailInitArg {
+		// We're the child, inside the namespaces. All of the jail setup
+		// must happen on the same OS thread as the final exec.
+		runtime.LockOSThread()
+		if err := jailInit(os.Args[2], os.Args[3], os.Args[4], os.Args[5:]); err != nil {
+			log.Fatalf("Jail setup failed: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 6 && os.Args[1] == jailSpawnArg {
+		// We're executed by systemd-run, within the transient unit
+		code, err := jailSpawn(os.Args[2], os.Args[3], os.Args[4], os.Args[5], os.Args[6], os.Args[7:])
+		if err != nil {
+			log.Fatalf("Jail spawn failed: %v", err)
+		}
+		os.Exit(code)
+	}
+	snapshotCmd := flag.String("snapshot-cmd", "", "`command` to invoke (space-separated) to snapshot the jail before syncing")
+	memoryMax := flag.String("memory-max", "", "memory `limit` for the receiver (e.g. 512M)")
+	cpuMax := flag.Int("cpu-max", 0, "cpu limit for the receiver, in `percent` of one cpu")
+	ioMax := flag.String("io-max", "", "comma-separated io `limits` for the receiver (e.g. \"8:0 wbps=10485760\")")
+	fsizeMax := flag.Int64("rlimit-fsize", -1, "max `bytes` of a single file written by the receiver (-1 = unchanged)")
+	nofileMax := flag.Int64("rlimit-nofile", -1, "max `number` of files open in the receiver (-1 = unchanged)")
+	nprocMax := flag.Int64("rlimit-nproc", -1, "max `number` of processes of the account (-1 = unchanged)")
+	coreMax := flag.Int64("rlimit-core", 0, "max `bytes` of a receiver core dump (-1 = unchanged)")
+	uname := flag.String("user", defaultUser, "`account` which owns the synced data")
+	createUser := flag.Bool("create-user", false, "create the account (as a system account) if it does not exist")
+	timeout := flag.Duration("timeout", 0, "maximum `duration` of a sync, after which the receiver is killed (0 = no timeout)")
+	staleAge := flag.Duration("stale-age", 24*time.Hour, "`age` after which leftover binaries and tempfiles in the jail are removed (0 = never)")
+	systemd := flag.String("systemd", "", "run the receiver in a transient systemd unit, `kind` 'scope' or 'service'")
+	var systemdProps stringList
+	flag.Var(&systemdProps, "systemd-property", "extra `property` for the systemd unit (can be repeated)")
+	quota := flag.Uint64("quota", 0, "maximum total `bytes` in the jail of a qube (0 = no quota)")
+	syncDir := flag.String("sync-dir", defaultSyncDir, "`directory` for the jails, relative to the home of the account")
+	receiveArgs := flag.String("receive-args", "", "extra `arguments` (space-separated) for the receiver")
+	check := flag.Bool("check", false, "check the setup, without executing a sync, and report the outcome as json")
+	profileDir := flag.String("profiles", defaultProfileDir, "`directory` with the profiles, selected by the service argument")
+	trustedKey := flag.String("trusted-key", "", "`file` with the public key which transfers must be signed with, or a directory with <qube>.pub files")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n %s [options] <path-to-executable>\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := checkCaller(flag.CommandLine, syscall.Getuid()); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if flag.NArg() < 1 {
 		log.Print("Error, no executable specified!")
-		log.Fatalf("usage:\n %v <path-to-executable>", os.Args[0])
+		flag.Usage()
+		os.Exit(1)
+	}
+	sourceBinary := flag.Arg(0)
+	// The config file, and then the profile, if requested, override the
+	// options we were started with
+	cfgErr := applyConfig(defaultConfigFile)
+	var profile string
+	if cfgErr == nil {
+		profile, cfgErr = applyProfile(*profileDir)
+	}
+	if cfgErr != nil && !*check {
+		log.Fatalf("Error: %v\n", cfgErr)
+	}
+	cfg := &config{
+		snapshotCmd: strings.Fields(*snapshotCmd),
+		limits: cgroupLimits{
+			memoryMax: *memoryMax,
+			cpuMax:    *cpuMax,
+			ioMax:     *ioMax,
+		},
+		rlimits: rlimits{
+			fsize:  *fsizeMax,
+			nofile: *nofileMax,
+			nproc:  *nprocMax,
+			core:   *coreMax,
+		},
+		quota:        *quota,
+		user:         *uname,
+		createUser:   *createUser,
+		timeout:      *timeout,
+		staleAge:     *staleAge,
+		systemd:      *systemd,
+		systemdProps: systemdProps,
+		syncDir:      *syncDir,
+		profile:      profile,
+		receiveArgs:  strings.Fields(*receiveArgs),
+		trustedKey:   *trustedKey,
+	}
+	if *check {
+		d := selfCheck(cfg, cfgErr, sourceBinary)
+		d.write(os.Stdout)
+		if !d.OK {
+			os.Exit(1)
+		}
+		return
 	}
-	sourceBinary := os.Args[1]
 	log.Printf("Preloader started. Source binary: %v", sourceBinary)
-	if err := execJailed(destUser, destRoot, sourceBinary); err != nil {
+	if err := execJailed(cfg, sourceBinary); err != nil {
 		log.Fatalf("Error: %v\n", err)
 	}
 }
 
+// userRe matches the account names we're willing to create
+var userRe = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,30}$`)
+
+// domainRe matches valid qube names
+var domainRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]{0,30}$`)
+
+// remoteDomain returns the name of the calling qube, as provided by qrexec.
+// The name is used as a directory name, so it is validated strictly.
+func remoteDomain() (string, error) {
+	domain := os.Getenv("QREXEC_REMOTE_DOMAIN")
+	if domain == "" {
+		return "", fmt.Errorf("QREXEC_REMOTE_DOMAIN not set")
+	}
+	if !domainRe.MatchString(domain) {
+		return "", fmt.Errorf("invalid remote domain %q", domain)
+	}
+	return domain, nil
+}
+
+// removeStale removes receiver binaries and tempfiles, left in the jail by
+// earlier syncs which crashed, if they have not been touched for the given
+// duration. Syncs which are still running keep their files fresh, unless
+// they've been stuck for longer than that.
+func removeStale(jail string, age time.Duration) {
+	entries, err := ioutil.ReadDir(jail)
+	if err != nil {
+		log.Printf("Failed reading jail dir: %v", err)
+		return
+	}
+	for _, info := range entries {
+		name := info.Name()
+		if !strings.HasPrefix(name, binaryPrefix) && !strings.HasPrefix(name, stagingPrefix) {
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		// The binary is hard linked, so its mtime is that of the original,
+		// but linking it (and chmod) updates the ctime
+		stat := info.Sys().(*syscall.Stat_t)
+		changed := time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec))
+		if time.Since(changed) < age {
+			continue
+		}
+		if err := os.Remove(filepath.Join(jail, name)); err != nil {
+			log.Printf("Failed removing stale file %v: %v", name, err)
+		} else {
+			log.Printf("Removed stale file %v", name)
+		}
+	}
+}
+
 // setupDir creates the given directory as 0700, sets the uid/gid ownership,
 // and chdirs into it
 func setupDir(dir string, uid, gid int) (string, error) {
@@ -47,8 +257,15 @@ func setupDir(dir string, uid, gid int) (string, error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return "", err
 	}
+	// The parent is owned by 'user', who could have placed a symlink here,
+	// to have us hand over its target
+	if info, err := os.Lstat(dir); err != nil {
+		return "", err
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("%v is not a directory", dir)
+	}
 	// Make 'user' own then
-	if err := os.Chown(dir, uid, gid); err != nil {
+	if err := os.Lchown(dir, uid, gid); err != nil {
 		return "", fmt.Errorf("failed re-owning %v by %v", dir, uid)
 	}
 	// Change into it
@@ -58,28 +275,60 @@ func setupDir(dir string, uid, gid int) (string, error) {
 	return dir, nil
 }
 
-func copyFile(src, dest string) error {
-	from, err := os.Open(src)
+// setupJailRoot creates the directory for the jails, syncDir within home, see
+// setupDir. It must stay within home, also when following symlinks, since it
+// is handed over to the account.
+func setupJailRoot(home, syncDir string, uid, gid int) (string, error) {
+	rel := filepath.Clean(syncDir)
+	if filepath.IsAbs(rel) || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("invalid sync dir %q, must be within the home of the account", syncDir)
+	}
+	dir := filepath.Join(home, rel)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	realHome, err := filepath.EvalSymlinks(home)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if real, err := filepath.EvalSymlinks(dir); err != nil {
+		return "", err
+	} else if real != filepath.Join(realHome, rel) {
+		return "", fmt.Errorf("sync dir %v leads outside of %v", dir, home)
+	}
+	return setupDir(dir, uid, gid)
+}
+
+// lookupUser finds the account by name, optionally creating it. The name
+// comes from a trusted source, see checkCaller.
+func lookupUser(name string, create bool) (*user.User, error) {
+	usr, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok && create {
+		if !userRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid user name %q", name)
+		}
+		log.Printf("Creating account '%s'", name)
+		cmd := exec.Command("useradd", "--system", "--create-home",
+			"--shell", "/sbin/nologin", name)
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("failed creating user '%s': %v", name, err)
+		}
+		usr, err = user.Lookup(name)
 	}
-	defer from.Close()
-	to, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to lookup '%s' %v", name, err)
 	}
-	defer to.Close()
-	_, err = io.Copy(to, from)
-	return err
+	return usr, nil
 }
 
-// switchUser comes mostly from
-// https://github.com/golang/go/issues/1435#issuecomment-479057768
-// by @larytet
-func execJailed(uname, jail, trustedBinary string) error {
+// execJailed sets up the jail for the calling qube, places the binary in it,
+// and executes it with the jail as root filesystem, as the configured user.
+func execJailed(cfg *config, trustedBinary string) (err error) {
 	var (
-		err error
 		usr *user.User
+		// settings are passed to the receiver via its environment
+		settings = make(map[string]string)
 	)
 	// Are we root? If we are running a suid binary, we need to check the
 	// EUID (effective UID), not the UID (original UID)
@@ -87,9 +336,20 @@ func execJailed(uname, jail, trustedBinary string) error {
 		return fmt.Errorf("need root credentials, got %v", uid)
 	}
 	log.Printf("Root ok")
+	// Become root for real, so the commands we run (useradd, systemd-run)
+	// are not executed on behalf of the caller
+	if err := syscall.Setgid(0); err != nil {
+		return fmt.Errorf("setgid failed: %v", err)
+	}
+	if err := syscall.Setuid(0); err != nil {
+		return fmt.Errorf("setuid failed: %v", err)
+	}
+	// The commands we run as root (useradd, the snapshot command) must not be
+	// looked up in a PATH chosen by the caller
+	os.Setenv("PATH", safePath)
 	// Does 'user' exist?
-	if usr, err = user.Lookup(uname); err != nil {
-		return fmt.Errorf("failed to lookup '%s' %v", uname, err)
+	if usr, err = lookupUser(cfg.user, cfg.createUser); err != nil {
+		return err
 	}
 	gid, _ := strconv.Atoi(usr.Gid)
 	uid, _ := strconv.Atoi(usr.Uid)
@@ -98,7 +358,11 @@ func execJailed(uname, jail, trustedBinary string) error {
 		// Let's forbid root aliasing
 		return fmt.Errorf("same user alias forbidden")
 	}
-	// Does the source binary exist?
+	// Does the source binary exist? It is mounted into the jail by path, so
+	// resolve it before we change directory
+	if trustedBinary, err = filepath.Abs(trustedBinary); err != nil {
+		return err
+	}
 	if finfo, err := os.Stat(trustedBinary); err != nil {
 		return fmt.Errorf("stat %v failed: %v", trustedBinary, err)
 	} else {
@@ -107,79 +371,165 @@ func execJailed(uname, jail, trustedBinary string) error {
 		}
 	}
 	// Create base root (/home/user/QubesSync/)if not existing already
-	if _, err = setupDir(destRoot, uid, gid); err != nil {
+	destRoot, err := setupJailRoot(usr.HomeDir, cfg.syncDir, uid, gid)
+	if err != nil {
 		return err
 	}
-	// Create vm-root (/home/user/QubesSync/all/) if not existing already
-	jail, err = setupDir(filepath.Join(destRoot, "all"), uid, gid)
+	// Create vm-root (/home/user/QubesSync/<domain>/) if not existing already,
+	// so that content from different source qubes is kept apart
+	domain, err := remoteDomain()
+	if err != nil {
+		return err
+	}
+	audit := newAuditLogger()
+	defer audit.Close()
+	audit.logf("sync request domain=%v profile=%q binary=%v", domain, cfg.profile, trustedBinary)
+	defer func() {
+		if err != nil {
+			audit.logf("sync failed domain=%v error=%q", domain, err)
+		}
+	}()
+	jail, err := setupDir(filepath.Join(destRoot, domain), uid, gid)
 	if err != nil {
 		return fmt.Errorf("setup dir failed: %v", err)
 	}
-	log.Print("Jail dir ok")
-	// All looking good so far, now let's copy the source binary into the
-	// future jail
-	var (
-		newName = fmt.Sprintf("qsync-receive-temp-%d", uint64(rand.Int63()))
-		newPath = fmt.Sprintf("%v/%v", jail, newName)
-	)
-	if err := os.Link(trustedBinary, newPath); err != nil {
-		log.Print("Hard linking failed (cross-device?), trying copy instead")
-		// Hard linking fails across fs boundaries, such as
-		// /usr/lib/qubes to /home/user/
-		// We can do a manual copy instead
-		if err = copyFile(trustedBinary, newPath); err != nil {
-			return fmt.Errorf("file copying failed: %v", err)
+	log.Printf("Jail dir %v ok", jail)
+	if cfg.staleAge > 0 {
+		removeStale(jail, cfg.staleAge)
+	}
+	if cfg.quota > 0 {
+		usage, err := packer.DiskUsage(jail)
+		if err != nil {
+			return fmt.Errorf("failed calculating disk usage: %v", err)
+		}
+		if usage >= cfg.quota {
+			return fmt.Errorf("quota exceeded: %d bytes used, quota is %d", usage, cfg.quota)
 		}
+		log.Printf("Quota ok: %d of %d bytes used", usage, cfg.quota)
+		// The receiver enforces it during the sync
+		settings["QSYNC_QUOTA"] = strconv.FormatUint(cfg.quota, 10)
 	}
-	log.Printf("Copy to %v ok", newPath)
-	defer func() {
-		if err := os.Remove(newPath); err != nil {
-			if os.IsNotExist(err) {
-				log.Printf("Clean up: file already removed")
-			} else {
-				log.Printf("failed cleaning up %v: %v", newPath, err)
-			}
-		} else {
-			log.Printf("Call done, cleaned up %v ok", newPath)
+	if len(cfg.snapshotCmd) > 0 {
+		id, err := packer.TakeSnapshot(cfg.snapshotCmd, jail)
+		if err != nil {
+			return err
 		}
-	}()
-	// Set perms so user it can't overwrite itself
-	if err := os.Chmod(newPath, 0755); err != nil {
-		return fmt.Errorf("chmod op failed: %v", err)
+		log.Printf("Snapshot ok: %v", id)
+		settings["QSYNC_SNAPSHOT_ID"] = id
 	}
-	log.Print("Permissions ok")
-	if err := os.Chdir(destRoot); err != nil {
-		return fmt.Errorf("failed chdir: %v", err)
+	if cfg.trustedKey != "" {
+		key, err := readTrustedKey(cfg.trustedKey, domain)
+		if err != nil {
+			return err
+		}
+		// The receiver can't read the file from within the jail
+		settings["QSYNC_TRUSTED_KEY"] = key
+	}
+	// The binary is mounted read-only into the jail, see jailInit
+	hash, err := fileHash(trustedBinary)
+	if err != nil {
+		return err
 	}
-	// I'm actually unsure if this mount/unmount dance actually
-	// accomplishes anything ...
-	if err := syscall.Mount(".", ".", "", syscall.MS_BIND|syscall.MS_NODEV|syscall.MS_NOEXEC|syscall.MS_NOSUID, ""); err != nil {
-		return fmt.Errorf("failed mounting '.': %v", err)
+	log.Print("Executing call")
+	settings["QSYNC_DOMAIN"] = domain
+	if cfg.profile != "" {
+		settings["QSYNC_PROFILE"] = cfg.profile
 	}
-	log.Print("Remount ok. Executing call")
-	defer func() {
-		if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
-			fmt.Fprintf(os.Stderr, "cannot unmount sync directory: %v", err)
+	env := jailEnv(settings)
+	// The jail is set up in new namespaces, see jailInit
+	var (
+		cmd  *exec.Cmd
+		unit = fmt.Sprintf("qsync-%v-%d", domain, os.Getpid())
+		kill = func(sig syscall.Signal) { syscall.Kill(-cmd.Process.Pid, sig) }
+	)
+	if cfg.systemd != "" {
+		if cmd, err = systemdCommand(cfg, unit, jail, trustedBinary, uid, gid, env, cfg.receiveArgs); err != nil {
+			return err
 		}
-	}()
-	// Prepare root jail
-	cmd := &exec.Cmd{
-		Path: fmt.Sprintf("./%v", newName),
-		Args: []string{newName},
-		Dir:  "/",
-		SysProcAttr: &syscall.SysProcAttr{
-			Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
-			Chroot:     jail,
-		},
+		kill = func(sig syscall.Signal) { systemctlKill(unit, sig) }
+	} else {
+		cmd = jailCommand(jail, trustedBinary, uid, gid, &cfg.rlimits, cfg.receiveArgs)
 	}
 	cmd.Stdout, cmd.Stderr, cmd.Stdin = os.Stdout, os.Stderr, os.Stdin
-	if err := cmd.Run(); err != nil {
+	cmd.Env = env
+	var cg *cgroup
+	if !cfg.limits.empty() && cfg.systemd == "" {
+		if cg, err = newCgroup(fmt.Sprintf("%v-%d", domain, os.Getpid()), &cfg.limits); err != nil {
+			return fmt.Errorf("cgroup setup failed: %v", err)
+		}
+		defer cg.remove()
+		dir, err := cg.spawnInto(cmd)
+		if err != nil {
+			return fmt.Errorf("cgroup setup failed: %v", err)
+		}
+		defer dir.Close()
+	}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run %s as user '%s': %v", trustedBinary, usr.Username, err)
+	}
+	audit.logf("sync start domain=%v pid=%d sha256=%v", domain, cmd.Process.Pid, hash)
+	if cfg.systemd != "" {
+		log.Printf("Running in systemd %v %v", cfg.systemd, unit)
+	}
+	if cg != nil {
+		log.Printf("Resource limits applied")
+	}
+	var timedOut int32
+	if cfg.timeout > 0 {
+		timer := time.AfterFunc(cfg.timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			killReceiver(kill)
+		})
+		defer timer.Stop()
+	}
+	err = cmd.Wait()
+	stop := fmt.Sprintf("sync stop domain=%v pid=%d status=%q duration=%v",
+		domain, cmd.Process.Pid, cmd.ProcessState, time.Since(start))
+	// With systemd, the process we waited for is systemd-run, not the
+	// receiver, so its usage says nothing about the sync
+	if rusage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok && cfg.systemd == "" {
+		stop += fmt.Sprintf(" bytes-written=%d", rusage.Oublock*512)
+	}
+	audit.logf("%v", stop)
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("timeout: sync not done after %v", cfg.timeout)
+	}
+	if err != nil {
 		// Or exec failed or the child failed
 		if eErr, ok := err.(*exec.ExitError); ok {
 			return fmt.Errorf("exit error: %v", eErr.ProcessState.String())
 		}
-		return fmt.Errorf("failed to run %s as user '%s': %v", newPath, usr.Username, err)
+		return fmt.Errorf("failed to run %s as user '%s': %v", trustedBinary, usr.Username, err)
 	}
 	log.Print("Execution complete")
 	return nil
 }
+
+// killReceiver asks the receiver to abort the sync, and kills it (along with
+// everything it started) if it's still around after killGracePeriod.
+func killReceiver(kill func(syscall.Signal)) {
+	log.Printf("Timeout, aborting receiver")
+	kill(syscall.SIGTERM)
+	time.AfterFunc(killGracePeriod, func() {
+		log.Printf("Receiver did not abort, killing it")
+		kill(syscall.SIGKILL)
+	})
+}
+
+// readTrustedKey reads the public key which transfers from the domain must be
+// signed with. If path is a directory, the key is in <domain>.pub within it.
+func readTrustedKey(path, domain string) (string, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, domain+".pub")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("no trusted key: %v", err)
+	}
+	key := strings.TrimSpace(string(data))
+	if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != ed25519.PublicKeySize {
+		return "", fmt.Errorf("invalid trusted key in %v", path)
+	}
+	return key, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckCaller(t *testing.T) {
+	for _, tt := range []struct {
+		args   []string
+		uid    int
+		errMsg string
+	}{
+		{args: nil, uid: 1000},
+		{args: []string{"-check"}, uid: 1000},
+		{args: []string{"-sync-dir", "/etc"}, uid: 1000, errMsg: "option -sync-dir is only accepted from root, or from " + defaultConfigFile},
+		{args: []string{"-check", "-quota", "1"}, uid: 1000, errMsg: "option -quota is only accepted from root, or from " + defaultConfigFile},
+		// Given as its default, it's still given
+		{args: []string{"-quota", "0"}, uid: 1000, errMsg: "option -quota is only accepted from root, or from " + defaultConfigFile},
+		{args: []string{"-sync-dir", "/etc", "-quota", "1"}, uid: 0},
+		{args: []string{"-check"}, uid: 0},
+	} {
+		fs := flag.NewFlagSet("qsync-preloader", flag.ContinueOnError)
+		fs.Bool("check", false, "")
+		fs.String("sync-dir", "", "")
+		fs.Uint64("quota", 0, "")
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		err := checkCaller(fs, tt.uid)
+		if tt.errMsg == "" && err != nil {
+			t.Errorf("uid %d, %v: %v", tt.uid, tt.args, err)
+		}
+		if tt.errMsg != "" && (err == nil || err.Error() != tt.errMsg) {
+			t.Errorf("uid %d, %v: error %v, want %q", tt.uid, tt.args, err, tt.errMsg)
+		}
+	}
+}
+
+func TestReadOptions(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to own the config")
+	}
+	dir, _ := ioutil.TempDir("", "preloader-options")
+	defer os.RemoveAll(dir)
+	config := "# The preloader's options\n\n-sync-dir Projects\n  -quota 10000000000  \n-receive-args -audit -max-depth 32\n-check\n"
+	for _, tt := range []struct {
+		content string
+		mode    os.FileMode
+		uid     int
+		want    []string
+		errMsg  string
+	}{
+		{content: config, mode: 0644, want: []string{"-sync-dir=Projects", "-quota=10000000000", "-receive-args=-audit -max-depth 32", "-check"}},
+		{content: config, mode: 0600, want: []string{"-sync-dir=Projects", "-quota=10000000000", "-receive-args=-audit -max-depth 32", "-check"}},
+		{content: "", mode: 0644, want: nil},
+		{content: "sync-dir Projects\n", mode: 0644, errMsg: `invalid line in %v: "sync-dir Projects"`},
+		{content: config, mode: 0664, errMsg: "%v must be owned and only writable by root"},
+		{content: config, mode: 0646, errMsg: "%v must be owned and only writable by root"},
+		{content: config, mode: 0644, uid: 1000, errMsg: "%v must be owned and only writable by root"},
+	} {
+		path := filepath.Join(dir, "qsync-preloader.conf")
+		os.Remove(path)
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chmod(path, tt.mode)
+		if err := os.Chown(path, tt.uid, 0); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readOptions(path)
+		if tt.errMsg != "" {
+			if want := fmt.Sprintf(tt.errMsg, path); err == nil || err.Error() != want {
+				t.Errorf("%q, mode %v, uid %d: error %v, want %q", tt.content, tt.mode, tt.uid, err, want)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, %v, want %q", tt.content, got, err, tt.want)
+		}
+	}
+	if _, err := readOptions(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("missing config: %v", err)
+	}
+}
+
+func TestRequestedProfile(t *testing.T) {
+	for _, tt := range []struct {
+		arg   string
+		want  string
+		valid bool
+	}{
+		{"", "", true},
+		{"work", "work", true},
+		{"Work_2-backup", "Work_2-backup", true},
+		{"abcdefghijklmnopqrstuvwxyz01234", "abcdefghijklmnopqrstuvwxyz01234", true},
+		{"abcdefghijklmnopqrstuvwxyz012345", "", false},
+		{"../work", "", false},
+		{"work/..", "", false},
+		{".hidden", "", false},
+		{"work profile", "", false},
+		{"work\n", "", false},
+		{"wörk", "", false},
+	} {
+		t.Setenv("QREXEC_SERVICE_ARGUMENT", tt.arg)
+		got, err := requestedProfile()
+		if tt.valid && (err != nil || got != tt.want) {
+			t.Errorf("%q: got %q, %v, want %q", tt.arg, got, err, tt.want)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%q: accepted as %q", tt.arg, got)
+		}
+	}
+}
+
+func TestJailEnv(t *testing.T) {
+	// Start from an environment with only the variables set below
+	for _, kv := range os.Environ() {
+		k := strings.SplitN(kv, "=", 2)[0]
+		t.Setenv(k, "")
+		os.Unsetenv(k)
+	}
+	for k, v := range map[string]string{
+		"QREXEC_REMOTE_DOMAIN": "work",
+		"LANG":                 "C.UTF-8",
+		"QSYNC_VERBOSITY":      "3",
+		"QSYNC_PROFILE":        "from-env",
+		"HOME":                 "/root",
+		"LD_PRELOAD":           "/tmp/evil.so",
+		"PATH":                 "/tmp/evil",
+		"QREXEC_AGENT_PID":     "1234",
+	} {
+		t.Setenv(k, v)
+	}
+	for _, tt := range []struct {
+		settings map[string]string
+		want     []string
+	}{
+		{nil, []string{"LANG=C.UTF-8", "QREXEC_REMOTE_DOMAIN=work", "QSYNC_PROFILE=from-env", "QSYNC_VERBOSITY=3"}},
+		// The settings override the environment
+		{map[string]string{"QSYNC_PROFILE": "work", "QSYNC_QUOTA": "100"},
+			[]string{"LANG=C.UTF-8", "QREXEC_REMOTE_DOMAIN=work", "QSYNC_PROFILE=work", "QSYNC_QUOTA=100", "QSYNC_VERBOSITY=3"}},
+	} {
+		if got := jailEnv(tt.settings); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("settings %v: env %q, want %q", tt.settings, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// defaultProfileDir is where the sync profiles are kept
+const defaultProfileDir = "/etc/qubes/qsync-profiles"
+
+// defaultConfigFile holds the options of the preloader, in the same format
+// as a profile
+const defaultConfigFile = "/etc/qubes/qsync-preloader.conf"
+
+// profileRe matches valid profile names
+var profileRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,31}$`)
+
+// requestedProfile returns the name of the profile the caller asked for, as
+// the service argument (qubes.Filesync+<profile>), or "" if none.
+func requestedProfile() (string, error) {
+	name := os.Getenv("QREXEC_SERVICE_ARGUMENT")
+	if name == "" {
+		return "", nil
+	}
+	if !profileRe.MatchString(name) {
+		return "", fmt.Errorf("invalid profile %q", name)
+	}
+	return name, nil
+}
+
+// loadProfile reads the named profile from dir, and returns it as command
+// line arguments, to be parsed on top of the ones we were started with.
+func loadProfile(dir, name string) ([]string, error) {
+	args, err := readOptions(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+	return args, err
+}
+
+// readOptions reads a file with options, and returns them as command line
+// arguments. It contains one option per line, e.g.
+//
+//	-sync-dir Projects
+//	-quota 10000000000
+//	-receive-args -audit -max-depth 32
+//
+// Since it decides how we, as root, set up the jail, it must be owned by root
+// and not writable by anyone else.
+func readOptions(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid != 0 || info.Mode().Perm()&022 != 0 {
+		return nil, fmt.Errorf("%v must be owned and only writable by root", path)
+	}
+	var args []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "-") {
+			return nil, fmt.Errorf("invalid line in %v: %q", path, line)
+		}
+		// Everything after the option name is the value, spaces and all
+		if parts := strings.SplitN(line, " ", 2); len(parts) == 2 {
+			line = parts[0] + "=" + strings.TrimSpace(parts[1])
+		}
+		args = append(args, line)
+	}
+	return args, scanner.Err()
+}
+
+// applyProfile loads the requested profile, if any, and parses its options on
+// top of the command line. It returns the name of the profile.
+func applyProfile(dir string) (string, error) {
+	profile, err := requestedProfile()
+	if err != nil || profile == "" {
+		return "", err
+	}
+	args, err := loadProfile(dir, profile)
+	if err != nil {
+		return "", err
+	}
+	if err := flag.CommandLine.Parse(args); err != nil || flag.NArg() > 0 {
+		return "", fmt.Errorf("invalid profile %v: %v", profile, args)
+	}
+	log.Printf("Using profile %v", profile)
+	return profile, nil
+}
+
+// applyConfig parses the options in the config file, if it exists. Since we
+// run suid, the command line is chosen by whoever runs us, so unless that is
+// root, this (and the profiles) is where the options come from.
+func applyConfig(path string) error {
+	args, err := readOptions(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := flag.CommandLine.Parse(args); err != nil || flag.NArg() > 0 {
+		return fmt.Errorf("invalid config %v: %v", path, args)
+	}
+	return nil
+}
+
+// unprivilegedFlags are the only options accepted on the command line when
+// the caller (the real uid) is not root.
+var unprivilegedFlags = map[string]bool{"check": true}
+
+// checkCaller returns an error if the command line, parsed into fs, holds
+// options which the caller (with the real uid) may not give.
+func checkCaller(fs *flag.FlagSet, uid int) error {
+	if uid == 0 {
+		return nil
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if !unprivilegedFlags[f.Name] && err == nil {
+			err = fmt.Errorf("option -%v is only accepted from root, or from %v", f.Name, defaultConfigFile)
+		}
+	})
+	return err
+}
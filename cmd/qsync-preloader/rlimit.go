@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const rlimitNproc = 6 // RLIMIT_NPROC, missing from package syscall
+
+// rlimits are the kernel resource limits applied to the receiver. A negative
+// value means the limit is left as is.
+type rlimits struct {
+	fsize  int64 // max size of a file written, in bytes
+	nofile int64 // max number of open files
+	nproc  int64 // max number of processes (and threads) of the account
+	core   int64 // max size of core dumps, in bytes
+}
+
+// rlimitNames maps the names used in the serialized form to the resources
+var rlimitNames = map[string]int{
+	"fsize":  syscall.RLIMIT_FSIZE,
+	"nofile": syscall.RLIMIT_NOFILE,
+	"nproc":  rlimitNproc,
+	"core":   syscall.RLIMIT_CORE,
+}
+
+func (l *rlimits) values() map[string]int64 {
+	return map[string]int64{
+		"fsize":  l.fsize,
+		"nofile": l.nofile,
+		"nproc":  l.nproc,
+		"core":   l.core,
+	}
+}
+
+// String serializes the limits, for passing them to the jail init.
+func (l *rlimits) String() string {
+	return fmt.Sprintf("fsize=%d,nofile=%d,nproc=%d,core=%d", l.fsize, l.nofile, l.nproc, l.core)
+}
+
+func parseRlimits(s string) (*rlimits, error) {
+	l := &rlimits{-1, -1, -1, -1}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rlimit %q", kv)
+		}
+		v, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rlimit %q: %v", kv, err)
+		}
+		switch parts[0] {
+		case "fsize":
+			l.fsize = v
+		case "nofile":
+			l.nofile = v
+		case "nproc":
+			l.nproc = v
+		case "core":
+			l.core = v
+		default:
+			return nil, fmt.Errorf("unknown rlimit %q", parts[0])
+		}
+	}
+	return l, nil
+}
+
+// apply sets the limits on the current process, from where they are
+// inherited across exec. Both the soft and hard limit are set, so they
+// cannot be raised again.
+func (l *rlimits) apply() error {
+	for name, v := range l.values() {
+		if v < 0 {
+			continue
+		}
+		lim := &syscall.Rlimit{Cur: uint64(v), Max: uint64(v)}
+		if err := syscall.Setrlimit(rlimitNames[name], lim); err != nil {
+			return fmt.Errorf("failed setting rlimit %v to %d: %v", name, v, err)
+		}
+	}
+	return nil
+}
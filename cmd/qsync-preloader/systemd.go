@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// jailSpawnArg is the (hidden) first argument used when systemd-run executes
+// the preloader, within the transient unit.
+const jailSpawnArg = "__jail-spawn"
+
+const (
+	systemdScope   = "scope"   // resource control only, attached to our stdio
+	systemdService = "service" // resource control and sandboxing
+)
+
+// stringList is a flag which can be given multiple times.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// systemdCommand returns a command which runs the preloader in a transient
+// systemd unit, where jailSpawn sets up the namespaces as usual. The
+// resource limits are applied by systemd, instead of via our own cgroup.
+func systemdCommand(cfg *config, unit, jail, binary string, uid, gid int, env, args []string) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	props := []string{
+		fmt.Sprintf("Description=qsync receiver for %v", jail),
+	}
+	if cfg.limits.memoryMax != "" {
+		props = append(props, "MemoryMax="+cfg.limits.memoryMax, "MemorySwapMax=0")
+	}
+	if cfg.limits.cpuMax != 0 {
+		props = append(props, fmt.Sprintf("CPUQuota=%d%%", cfg.limits.cpuMax))
+	}
+	if cfg.limits.ioMax != "" {
+		return nil, fmt.Errorf("-io-max is not supported with systemd, use -systemd-property")
+	}
+	cmdArgs := []string{"--quiet", "--unit=" + unit}
+	switch cfg.systemd {
+	case systemdScope:
+		cmdArgs = append(cmdArgs, "--scope")
+	case systemdService:
+		// Sandboxing directives only exist for services. The jail is the
+		// only place the receiver needs to write to.
+		props = append(props,
+			"ProtectSystem=strict",
+			"ProtectHome=read-only",
+			"ReadWritePaths="+jail,
+			"PrivateTmp=yes",
+			"PrivateNetwork=yes",
+		)
+		cmdArgs = append(cmdArgs, "--pipe", "--wait", "--collect")
+	default:
+		return nil, fmt.Errorf("invalid systemd mode %q", cfg.systemd)
+	}
+	props = append(props, cfg.systemdProps...)
+	for _, p := range props {
+		cmdArgs = append(cmdArgs, "--property="+p)
+	}
+	// A service doesn't inherit our environment
+	for _, kv := range env {
+		cmdArgs = append(cmdArgs, "--setenv="+kv)
+	}
+	cmdArgs = append(cmdArgs, "--", self, jailSpawnArg, jail, binary,
+		strconv.Itoa(uid), strconv.Itoa(gid), cfg.rlimits.String())
+	return exec.Command("systemd-run", append(cmdArgs, args...)...), nil
+}
+
+// jailSpawn runs inside the transient unit, and executes the binary in the
+// jail, see jailCommand.
+func jailSpawn(jail, binary, uidStr, gidStr, rlimitSpec string, args []string) (int, error) {
+	// The preloader is suid, so anyone can invoke it with these arguments.
+	// Only systemd (real root) may.
+	if syscall.Getuid() != 0 {
+		return 1, fmt.Errorf("need real root credentials")
+	}
+	uid, err := strconv.Atoi(uidStr)
+	if err != nil {
+		return 1, err
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 1, err
+	}
+	if uid == 0 || gid == 0 {
+		return 1, fmt.Errorf("same user alias forbidden")
+	}
+	limits, err := parseRlimits(rlimitSpec)
+	if err != nil {
+		return 1, err
+	}
+	cmd := jailCommand(jail, binary, uid, gid, limits, args)
+	cmd.Stdout, cmd.Stderr, cmd.Stdin = os.Stdout, os.Stderr, os.Stdin
+	// Don't pass on whatever systemd added
+	cmd.Env = jailEnv(nil)
+	if err := cmd.Run(); err != nil {
+		if eErr, ok := err.(*exec.ExitError); ok {
+			return eErr.ExitCode(), nil
+		}
+		return 1, err
+	}
+	return 0, nil
+}
+
+// systemctlKill sends the signal to all processes in the unit.
+func systemctlKill(unit string, sig syscall.Signal) {
+	exec.Command("systemctl", "kill", "--signal="+strconv.Itoa(int(sig)), unit).Run()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/holiman/qvm-sync/packer"
+)
+
+func init() {
+	packer.SetupLogging()
+}
+
+// qsync-pull has two sides. The local side is started by qrexec-client-vm,
+// connected to the qubes.Filepull service in the remote qube, where the
+// serving side runs (with -serve):
+//
+//	local: qsync-pull [-dest dir] remote/dir  <->  remote: qsync-pull -serve -root /home/user/QubesShare
+//
+// The local side requests the directory, and then acts as receiver. The
+// serving side acts as sender.
+func main() {
+	serve := flag.Bool("serve", false, "serve directories to the calling qube (used by the qubes.Filepull service)")
+	root := flag.String("root", "", "`directory` which is served, with -serve")
+	dest := flag.String("dest", ".", "local `directory` to sync into")
+	disableCompression := flag.Bool("n", false, "`nocompress` disables compression, with -serve")
+	verbosity := flag.Uint("v", 3, "`verbosity`: 0=None, 1=Error, 2=Warn, 3=Info, 4=Debug, 5=Trace")
+	ignoreSymlinks := flag.Bool("i", false, "`ignore-symlinks` - if set, symlinks are ignored, with -serve")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n %s [options] directory/to/pull\n %s -serve -root /directory/to/serve\nOptions:\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *serve {
+		if *root == "" {
+			fmt.Fprintf(flag.CommandLine.Output(), "Error: root not supplied\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		opts := packer.DefaultOptions
+		if *disableCompression {
+			opts.Compression = packer.CompressionOff
+		}
+		opts.IgnoreSymlinks = *ignoreSymlinks
+		opts.Verbosity = int(*verbosity)
+		if err := servePull(*root, opts); err != nil {
+			log.Fatal(err)
+		}
+		log.Print("All done")
+		return
+	}
+	if flag.NArg() < 1 {
+		fmt.Fprintf(flag.CommandLine.Output(), "Error: path not supplied\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err := pull(flag.Arg(0), *dest); err != nil {
+		log.Fatalf("Error during pull: %v", err)
+	}
+}
+
+// servePull reads the requested directory, and sends it.
+func servePull(root string, opts *packer.Options) error {
+	path, err := packer.ReadPullRequest(os.Stdin)
+	if err != nil {
+		return err
+	}
+	log.Printf("Pull requested: %v", path)
+	realPath, err := packer.ResolveServed(root, path)
+	if err != nil {
+		return err
+	}
+	sender, err := packer.NewSender(os.Stdout, os.Stdin, opts)
+	if err != nil {
+		return err
+	}
+	return sender.Sync(realPath)
+}
+
+// pull requests the directory, and receives it into dest.
+func pull(path, dest string) error {
+	if err := packer.RequestPull(os.Stdout, path); err != nil {
+		return err
+	}
+	if err := os.Chdir(dest); err != nil {
+		return err
+	}
+	r, err := packer.NewReceiver(os.Stdin, os.Stdout, nil)
+	if err != nil {
+		return err
+	}
+	return r.Sync()
+}
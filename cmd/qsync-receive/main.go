@@ -1,9 +1,18 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/holiman/qvm-sync/internal/profiling"
 	"github.com/holiman/qvm-sync/packer"
 )
 
@@ -13,12 +22,185 @@ func init() {
 
 const useSnappy = true
 
+// abortGracePeriod is how long we wait for the receiver to wind down after
+// a signal, before giving up and exiting anyway.
+const abortGracePeriod = 5 * time.Second
+
 func main() {
-	r, err := packer.NewReceiver(os.Stdin, os.Stdout)
+	snapshotId := flag.String("snapshot-id", os.Getenv("QSYNC_SNAPSHOT_ID"), "`id` of a snapshot already taken by the caller, recorded in the journal")
+	quota := flag.Uint64("quota", envUint64("QSYNC_QUOTA"), "maximum total `bytes` in the sync root (0 = no quota)")
+	version := flag.Bool("version", false, "print the protocol version, and exit")
+	trustedKey := flag.String("trusted-key", os.Getenv("QSYNC_TRUSTED_KEY"), "base64 public `key` which the transfer must be signed with")
+	configFile := flag.String("config", packer.SystemConfigFile, "configuration `file`")
+	profileName := flag.String("profile", os.Getenv("QSYNC_PROFILE"), "use the limits of the `profile` in the configuration; options given here override them")
+	linkDest := flag.String("link-dest", "", "hardlink files which are unchanged in `dir` (a previous copy of the destination), instead of receiving them")
+	snapshots := flag.String("snapshots", "", "receive into a new snapshot within `dir`, hardlinked from the previous one")
+	store := flag.String("store", "", "receive into the content-addressed store in `dir`, see qsync-store")
+	archive := flag.String("archive", "", "write the received tree to the archive `file` (tar, or zip if named .zip), instead of into the destination")
+	storeSource := flag.String("store-source", os.Getenv("QSYNC_DOMAIN"), "`name` of the source, which the manifest is recorded under in the store")
+	peer := flag.String("peer", os.Getenv("QSYNC_DOMAIN"), "`name` of the sender, recorded in the journal")
+	receiverFlags := packer.AddReceiverFlags(flag.CommandLine)
+	profiles := profiling.AddFlags()
+	flag.Parse()
+
+	if *version {
+		// Read by remote senders, see transport.CommandConn.Handshake
+		fmt.Printf("%v%d\n", packer.VersionPrefix, packer.Version)
+		return
+	}
+	ropts, err := receiverFlags.ReceiverOptions(&packer.ReceiverOptions{
+		SnapshotID:  *snapshotId,
+		MaxRootSize: *quota,
+		LinkDest:    *linkDest,
+		Profile:     *profileName,
+		Peer:        *peer,
+	})
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "Error: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *profileName != "" {
+		if ropts, err = applyProfile(ropts, *configFile, *profileName); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *trustedKey != "" {
+		key, err := packer.ParsePublicKey(*trustedKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ropts.TrustedKey = key
+	}
+	if *snapshots != "" {
+		root, prev, err := packer.NewLinkSnapshot(*snapshots, time.Now())
+		if err != nil {
+			log.Fatalf("Error creating snapshot: %v", err)
+		}
+		ropts.Root = root
+		if ropts.LinkDest == "" {
+			ropts.LinkDest = prev
+		}
+	}
+	if *store != "" {
+		s, err := packer.OpenStore(*store)
+		if err != nil {
+			log.Fatalf("Error opening store: %v", err)
+		}
+		ropts.Store, ropts.StoreSource = s, *storeSource
+	}
+	if *archive != "" {
+		f, err := os.OpenFile(*archive, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+		if err != nil {
+			log.Fatalf("Error creating archive: %v", err)
+		}
+		defer f.Close()
+		ropts.Archive, ropts.ArchiveFormat = f, packer.ArchiveFormat(*archive)
+	}
+	// Within the jail of the preloader, only the synced directory can be
+	// written to. The profiles go into its state directory, which isn't
+	// synced over, unless given as absolute paths.
+	stopProfiles, err := profiles.Start(filepath.Join(ropts.Root, packer.StateDir))
+	if err != nil {
+		log.Fatalf("Error starting profiles: %v", err)
+	}
+	r, err := packer.NewReceiver(os.Stdin, os.Stdout, ropts)
 	if err != nil {
 		log.Fatalf("Error during init: %v", err)
 	}
-	if err := r.Sync(); err != nil {
+	// On SIGINT/SIGTERM, ask the receiver to wind down. If it's stuck
+	// waiting for the sender, clean up and exit after a grace period.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	// The exit code for the signal is passed on before aborting, so it's
+	// there once the sync returns ErrAborted
+	abortCode := make(chan int, 1)
+	go func() {
+		sig := <-sigs
+		log.Printf("Got %v, aborting", sig)
+		exitCode := 128 + int(sig.(syscall.Signal))
+		abortCode <- exitCode
+		r.Abort()
+		time.Sleep(abortGracePeriod)
+		log.Print("Receiver did not abort in time, exiting")
+		r.Cleanup()
+		os.Exit(exitCode)
+	}()
+	err = r.Sync()
+	stopProfiles()
+	var partial *packer.PartialError
+	if errors.As(err, &partial) {
+		for _, f := range partial.Failures {
+			log.Printf("Failed: %v", f)
+		}
+		log.Printf("Sync completed, but %d items failed", len(partial.Failures))
+		err = nil
+	}
+	if err != nil {
+		if *archive != "" {
+			// It's incomplete
+			os.Remove(*archive)
+		}
+		if err == packer.ErrAborted {
+			log.Printf("Sync aborted")
+			os.Exit(<-abortCode)
+		}
+		if err == packer.ErrSenderAborted {
+			log.Printf("Sync aborted by the sender")
+			os.Exit(packer.ExitAborted)
+		}
 		log.Fatalf("Error during sync : %v", err)
 	}
+	if *snapshots != "" {
+		if err := packer.CompleteLinkSnapshot(ropts.Root); err != nil {
+			log.Fatalf("Error completing snapshot: %v", err)
+		}
+	}
+	if partial != nil {
+		os.Exit(packer.ExitPartial)
+	}
+}
+
+// envUint64 returns the value of the environment variable, or 0 if not set.
+// The preloader passes its settings this way.
+func envUint64(name string) uint64 {
+	v, err := strconv.ParseUint(os.Getenv(name), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// applyProfile applies the limits of the profile to the options, except for
+// those given on the command line. Within the jail of the preloader, the
+// configuration can't be read, and the profile (QSYNC_PROFILE) is only
+// applied if it's asked for explicitly.
+func applyProfile(ropts *packer.ReceiverOptions, path, name string) (*packer.ReceiverOptions, error) {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	cfg, err := packer.LoadConfig(path)
+	if os.IsNotExist(err) && !given["profile"] {
+		return ropts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p, err := cfg.Profile(name)
+	if err != nil {
+		return nil, err
+	}
+	res := p.ReceiverOptions(ropts)
+	if given["max-depth"] {
+		res.MaxDepth = ropts.MaxDepth
+	}
+	if given["max-dir-entries"] {
+		res.MaxDirEntries = ropts.MaxDirEntries
+	}
+	if given["quota"] {
+		res.MaxRootSize = ropts.MaxRootSize
+	}
+	if given["audit"] {
+		res.AuditLog = ropts.AuditLog
+	}
+	return res, nil
 }
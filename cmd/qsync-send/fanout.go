@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/holiman/qvm-sync/packer"
+	"github.com/holiman/qvm-sync/transport"
+)
+
+// qrexecClient invokes a service in another qube, connected to our stdin and
+// stdout, or to the given program.
+const qrexecClient = "/usr/lib/qubes/qrexec-client-vm"
+
+// qubeRe matches a qube name, optionally with the target (the service
+// argument, see qvm-sync -target).
+var qubeRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]{0,30}(\+[a-zA-Z0-9_-]{1,31})?$`)
+
+// stringList collects the values of a repeatable option, e.g. -to.
+type stringList []string
+
+func (d *stringList) String() string {
+	return strings.Join(*d, ",")
+}
+
+func (d *stringList) Set(v string) error {
+	*d = append(*d, v)
+	return nil
+}
+
+// dial connects to a destination, given as a qube (qube+target), or as
+// unix:path, vsock:cid:port or tls:host:port. The tls files are the
+// certificate, key and ca, as for -connect.
+func dial(dest string, tlsFiles [3]string) (io.ReadWriteCloser, error) {
+	kind, addr := "", dest
+	if i := strings.Index(dest, ":"); i > 0 {
+		kind, addr = dest[:i], dest[i+1:]
+	}
+	switch kind {
+	case "unix":
+		return transport.DialUnix(addr)
+	case "vsock":
+		cid, port, err := transport.ParseVsockAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		return transport.DialVsock(cid, port)
+	case "tls":
+		cfg, err := transport.TLSConfig(tlsFiles[0], tlsFiles[1], tlsFiles[2])
+		if err != nil {
+			return nil, err
+		}
+		return transport.DialTLS(addr, cfg)
+	case "":
+		if !qubeRe.MatchString(dest) {
+			return nil, fmt.Errorf("invalid destination %q", dest)
+		}
+		service := "qubes.Filesync"
+		if i := strings.Index(dest, "+"); i > 0 {
+			dest, service = dest[:i], service+dest[i:]
+		}
+		return transport.StartCommand([]string{qrexecClient, dest, service})
+	}
+	return nil, fmt.Errorf("unknown kind of destination %q", kind)
+}
+
+// sendFanout syncs the directory to all destinations at once.
+// If throttle is set, it wraps the connections.
+func sendFanout(dests []string, tlsFiles [3]string, syncDir string, opts *packer.Options, throttle func(io.Writer) io.Writer) error {
+	var fanout []packer.Destination
+	for _, d := range dests {
+		conn, err := dial(d, tlsFiles)
+		if err != nil {
+			return fmt.Errorf("destination %v: %v", d, err)
+		}
+		defer func(d string) {
+			if err := conn.Close(); err != nil {
+				log.Printf("Closing connection to %v failed: %v", d, err)
+			}
+		}(d)
+		var out io.Writer = conn
+		if throttle != nil {
+			out = throttle(conn)
+		}
+		fanout = append(fanout, packer.Destination{Name: d, Out: out, In: conn})
+	}
+	sender, err := packer.NewFanoutSender(fanout, opts)
+	if err != nil {
+		return err
+	}
+	return sender.Sync(syncDir)
+}
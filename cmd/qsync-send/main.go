@@ -1,52 +1,374 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/holiman/qvm-sync/internal/profiling"
 	"github.com/holiman/qvm-sync/packer"
+	"github.com/holiman/qvm-sync/transport"
 )
 
 func init() {
 	packer.SetupLogging()
 }
 
-func main() {
+// progressPrefix starts the lines written with -progress, which e.g.
+// qsync-daemon reads. After a sync (unless fanned out), a line starting with
+// statsPrefix gives the bytes sent, before and after compression.
+const (
+	progressPrefix = "qsync-progress"
+	statsPrefix    = "qsync-stats"
+)
 
-	disableCompression := flag.Bool("n", false, "`nocompress` disables compression")
-	verbosity := flag.Uint("v", 3, "`verbosity`: 0=None, 1=Error, 2=Warn, 3=Info, 4=Debug, 5=Trace")
-	ignoreSymlinks := flag.Bool("i", false, "`ignore-symlinks` - if set, symlinks are ignored")
-	flag.Parse()
+// abortGracePeriod is how long we wait for the sender to wind down after a
+// signal, before giving up and exiting anyway.
+const abortGracePeriod = 5 * time.Second
 
-	opts := packer.DefaultOptions
-	if *disableCompression {
-		opts.Compression = packer.CompressionOff
-	}
-	if *ignoreSymlinks {
-		opts.IgnoreSymlinks = true
-	}
-	opts.Verbosity = int(*verbosity)
+func main() {
 
+	genKey := flag.String("gen-key", "", "generate a signing key into `file` (and the public key into file.pub), and exit")
+	connect := flag.String("connect", "", "connect to a receiver at `address` (host:port), with tls, instead of using stdin/stdout")
+	tlsCert := flag.String("tls-cert", "", "certificate `file`, with -connect")
+	tlsKey := flag.String("tls-key", "", "private key `file` of the certificate, with -connect")
+	tlsCA := flag.String("tls-ca", "", "`file` with the ca which the receiver certificate must be signed by, with -connect")
+	vsock := flag.String("vsock", "", "connect to a receiver at vsock `address` (cid:port, where cid may be \"host\"), instead of using stdin/stdout")
+	unixPath := flag.String("unix", "", "connect to a receiver at the unix socket `path`, instead of using stdin/stdout")
+	remote := flag.String("remote", "", "sync to `host:dir` via a remote shell, instead of using stdin/stdout")
+	rsh := flag.String("e", "ssh", "remote shell `command` (space-separated), with -remote")
+	remoteBin := flag.String("remote-bin", "", "`path` to qsync-receive on the remote host, with -remote (default: searched for)")
+	remoteArgs := flag.String("remote-args", "", "extra `arguments` (space-separated) for the remote qsync-receive, with -remote")
+	var fanout stringList
+	flag.Var(&fanout, "to", "send to this `destination` as well, reading each file once for all (repeatable): a qube (qube+target for a profile), unix:path, vsock:cid:port or tls:host:port")
+	configFile := flag.String("config", "", "configuration `file` (default ~/.config/qvm-sync/config.toml)")
+	profileName := flag.String("profile", "", "use the settings of the `profile` in the configuration; options given here override them")
+	batchOut := flag.String("batch-out", "", "write the sync to a batch `file`, to be applied later with qsync-apply")
+	batchAgainst := flag.String("batch-against", "", "only include what differs from the destination described in `file` (see qsync-apply -describe), with -batch-out")
+	progress := flag.Bool("progress", false, "report each item sent on stderr, as a line \""+progressPrefix+" size \"path\"\"")
+	notify := flag.String("notify", "off", "show a desktop notification when the sync completes: off, errors or always")
+	trickle := flag.Bool("trickle", false, "run in the background: at the lowest cpu and io priority, limited by -bwlimit and -idle")
+	bwlimit := flag.Uint64("bwlimit", 0, "send at most this many `bytes` per second (0 = no limit)")
+	idle := flag.Duration("idle", 0, "with -trickle, pause while the user has been idle for less than this `duration` (0 = don't pause)")
+	idleCommand := flag.String("idle-command", "xprintidle", "`command` which prints how long the user has been idle, in milliseconds, with -idle")
+	senderFlags := packer.AddSenderFlags(flag.CommandLine)
+	profiles := profiling.AddFlags()
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n %s [options] /directory/to/sync\nOptions:\n", os.Args[0])
 		flag.PrintDefaults()
 	}
+	flag.Parse()
 
-	if flag.NArg() < 1 {
+	if *genKey != "" {
+		if err := packer.GenerateKey(*genKey, *genKey+".pub"); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Key written to %v, public key to %v.pub", *genKey, *genKey)
+		os.Exit(0)
+	}
+	base := packer.DefaultOptions
+	var profile *packer.Profile
+	if *profileName != "" {
+		p, err := loadProfile(*configFile, *profileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		profile, base = p, p.Options(base)
+	}
+	opts, err := senderFlags.Options(base)
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "Error: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *progress {
+		opts.Progress = func(path string, size uint64) {
+			fmt.Fprintf(os.Stderr, "%s %d %s\n", progressPrefix, size, strconv.Quote(path))
+		}
+	}
+	notifyWhen, err := packer.ParseNotify(*notify)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// addProgress adds fn to what's called for each item sent
+	addProgress := func(fn func(path string, size uint64)) {
+		prev := opts.Progress
+		opts.Progress = func(path string, size uint64) {
+			if prev != nil {
+				prev(path, size)
+			}
+			fn(path, size)
+		}
+	}
+	summary := new(packer.SyncSummary)
+	if notifyWhen != packer.NotifyOff {
+		addProgress(func(path string, size uint64) {
+			summary.Files++
+			summary.Bytes += size
+		})
+	}
+	qubes := newQubesProgress()
+	if qubes != nil {
+		addProgress(func(path string, size uint64) { qubes.add(size) })
+	}
+	// notifyDone reports the end of the sync, to the progress dialog and as
+	// a notification, if any
+	notifyDone := func(err error) {
+		if qubes != nil && err == nil {
+			qubes.done()
+		}
+		summary.Err = err
+		if err := packer.Notify(notifyWhen, summary); err != nil {
+			log.Print(err)
+		}
+	}
+	if *idle > 0 && !*trickle {
+		log.Fatal("Option -idle needs -trickle")
+	}
+	// throttle, if set, wraps the connections to the receivers
+	var throttle func(io.Writer) io.Writer
+	if *trickle {
+		if err := lowerPriority(); err != nil {
+			log.Fatalf("Failed lowering the priority: %v", err)
+		}
+	}
+	if *trickle || *bwlimit > 0 {
+		if throttle, err = trickler(*bwlimit, *idle, *idleCommand); err != nil {
+			log.Fatal(err)
+		}
+	}
+	syncDir := flag.Arg(0)
+	if syncDir == "" && profile != nil {
+		syncDir = profile.Path
+	}
+	if syncDir == "" {
 		fmt.Fprintf(flag.CommandLine.Output(), "Error: path not supplied\n")
 		flag.Usage()
 		os.Exit(1)
 	}
-	syncDir := flag.Arg(0)
-	sender, err := packer.NewSender(os.Stdout, os.Stdin, opts)
+	summary.Dir = syncDir
+	stopProfiles, err := profiles.Start("")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *batchOut != "" {
+		err := writeBatch(*batchOut, *batchAgainst, syncDir, opts)
+		stopProfiles()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Batch written to %v", *batchOut)
+		os.Exit(0)
+	}
+	if exclusive(*connect, *vsock, *unixPath, *remote) > 1 {
+		log.Fatal("Only one of -connect, -vsock, -unix and -remote can be used")
+	}
+	if len(fanout) == 0 && profile != nil && exclusive(*connect, *vsock, *unixPath, *remote) == 0 {
+		fanout = profile.Destination
+	}
+	if len(fanout) > 0 {
+		if exclusive(*connect, *vsock, *unixPath, *remote) > 0 {
+			log.Fatal("Option -to can't be combined with -connect, -vsock, -unix or -remote")
+		}
+		tlsFiles := [3]string{*tlsCert, *tlsKey, *tlsCA}
+		summary.Target = strings.Join(fanout, ", ")
+		err := sendFanout(fanout, tlsFiles, syncDir, opts, throttle)
+		stopProfiles()
+		notifyDone(err)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Print("All done")
+		os.Exit(0)
+	}
+	var (
+		out  io.Writer = os.Stdout
+		in   io.Reader = os.Stdin
+		conn io.Closer
+	)
+	if *connect != "" {
+		cfg, err := transport.TLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c, err := transport.DialTLS(*connect, cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		out, in, conn = c, c, c
+	}
+	if *vsock != "" {
+		cid, port, err := transport.ParseVsockAddr(*vsock)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c, err := transport.DialVsock(cid, port)
+		if err != nil {
+			log.Fatal(err)
+		}
+		out, in, conn = c, c, c
+	}
+	if *unixPath != "" {
+		c, err := transport.DialUnix(*unixPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		out, in, conn = c, c, c
+	}
+	if *remote != "" {
+		c, err := startRemote(*rsh, *remote, *remoteBin, strings.Fields(*remoteArgs))
+		if err != nil {
+			log.Fatal(err)
+		}
+		out, in, conn = c, c, c
+	}
+	if throttle != nil {
+		out = throttle(out)
+	}
+	sender, err := packer.NewSender(out, in, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err := sender.Sync(syncDir); err != nil {
+	// On SIGINT/SIGTERM, ask the sender to wind down (and the receiver, with
+	// -abortable). If it's stuck waiting for the receiver, exit after a
+	// grace period.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	// The exit code for the signal is passed on before aborting, so it's
+	// there once the sync returns ErrAborted
+	abortCode := make(chan int, 1)
+	go func() {
+		sig := <-sigs
+		log.Printf("Got %v, aborting", sig)
+		exitCode := 128 + int(sig.(syscall.Signal))
+		abortCode <- exitCode
+		sender.Abort()
+		time.Sleep(abortGracePeriod)
+		log.Print("Sender did not abort in time, exiting")
+		os.Exit(exitCode)
+	}()
+	err = sender.Sync(syncDir)
+	stopProfiles()
+	notifyDone(err)
+	if err == packer.ErrAborted {
+		log.Printf("Sync aborted")
+		os.Exit(<-abortCode)
+	}
+	if errors.Is(err, packer.ErrAborted) {
+		log.Printf("Sync aborted by the receiver: %v", err)
+		os.Exit(packer.ExitAborted)
+	}
+	var partial *packer.PartialError
+	if errors.As(err, &partial) {
+		for _, f := range partial.Failures {
+			log.Printf("Failed: %v", f)
+		}
+		log.Printf("Sync completed, but %d items failed", len(partial.Failures))
+		os.Exit(packer.ExitPartial)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
+	if gone := sender.Gone(); len(gone) > 0 {
+		log.Printf("Skipped %d files, which were gone", len(gone))
+	}
+	if changed := sender.Changed(); len(changed) > 0 {
+		log.Printf("%d files changed while they were sent, and will be sent again by the next sync", len(changed))
+	}
+	if *progress {
+		raw, compressed := sender.Stats()
+		fmt.Fprintf(os.Stderr, "%s %d %d\n", statsPrefix, raw, compressed)
+	}
+	if conn != nil {
+		if err := conn.Close(); err != nil {
+			log.Fatalf("Closing connection failed: %v", err)
+		}
+	}
 	log.Print("All done")
 	os.Exit(0)
 }
+
+// exclusive returns how many of the given (mutually exclusive) flags are set.
+func exclusive(flags ...string) int {
+	n := 0
+	for _, f := range flags {
+		if f != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// startRemote starts the receiver at dest (host:dir) via the remote shell,
+// and checks that it speaks our protocol.
+func startRemote(rsh, dest, bin string, args []string) (*transport.CommandConn, error) {
+	i := strings.Index(dest, ":")
+	if i <= 0 || strings.HasPrefix(dest, "-") {
+		return nil, fmt.Errorf("invalid remote %q, expected host:dir", dest)
+	}
+	host, dir := dest[:i], dest[i+1:]
+	if dir == "" {
+		dir = "."
+	}
+	conn, err := transport.StartCommand(transport.SSHCommand(rsh, host, dir, bin, args))
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Handshake(packer.Version); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// writeBatch writes the sync of syncDir to a batch file.
+func writeBatch(path, description, syncDir string, opts *packer.Options) error {
+	var desc io.Reader
+	if description != "" {
+		f, err := os.Open(description)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		desc = f
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	sender, err := packer.NewBatchSender(out, opts, desc)
+	if err == nil {
+		err = sender.Sync(syncDir)
+	}
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// loadProfile loads the named profile from the configuration file, or from
+// that of the user.
+func loadProfile(path, name string) (*packer.Profile, error) {
+	if path == "" {
+		var err error
+		if path, err = packer.UserConfigFile(); err != nil {
+			return nil, err
+		}
+	}
+	cfg, err := packer.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Profile(name)
+}
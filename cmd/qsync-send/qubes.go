@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// qubesProgressDelta is how many bytes are sent between reports, as with
+// qfile-agent.
+const qubesProgressDelta = 15 * 1000 * 1000
+
+// qubesProgress reports the progress the way qfile-agent does, for the
+// progress dialogs of Qubes (e.g. of qvm-copy). It's configured by the
+// environment:
+//
+//   - PROGRESS_TYPE=console: "sent x/y KB" on stderr, where y is
+//     FILECOPY_TOTAL_SIZE (in KB)
+//   - PROGRESS_TYPE=gui: the bytes sent so far, a line at a time, on the fd
+//     in SAVED_FD_1 (our original stdout, saved by qrexec-client-vm)
+//
+// A file counts as sent once all of it is, and only file content counts, so
+// for a sync where most files are unchanged, the total is never reached.
+type qubesProgress struct {
+	console  bool
+	totalKB  string   // with console
+	out      *os.File // with gui
+	sent     uint64
+	reported uint64
+}
+
+// newQubesProgress returns the progress reporter asked for by the
+// environment, if any.
+func newQubesProgress() *qubesProgress {
+	switch os.Getenv("PROGRESS_TYPE") {
+	case "console":
+		total := os.Getenv("FILECOPY_TOTAL_SIZE")
+		if total == "" {
+			return nil
+		}
+		q := &qubesProgress{console: true, totalKB: total}
+		q.report(false)
+		return q
+	case "gui":
+		fd, err := strconv.Atoi(os.Getenv("SAVED_FD_1"))
+		if err != nil || fd < 0 {
+			return nil
+		}
+		q := &qubesProgress{out: os.NewFile(uintptr(fd), "progress")}
+		q.report(false)
+		return q
+	}
+	return nil
+}
+
+func (q *qubesProgress) add(size uint64) {
+	q.sent += size
+	if q.sent > q.reported+qubesProgressDelta {
+		q.report(false)
+	}
+}
+
+// done reports the end of the sync.
+func (q *qubesProgress) done() {
+	q.report(true)
+}
+
+func (q *qubesProgress) report(done bool) {
+	q.reported = q.sent
+	if q.console {
+		fmt.Fprintf(os.Stderr, "sent %d/%s KB\r", q.sent/1024, q.totalKB)
+		if done {
+			fmt.Fprint(os.Stderr, "\n")
+		}
+		return
+	}
+	_, err := fmt.Fprintf(q.out, "%d\n", q.sent)
+	if errors.Is(err, syscall.EPIPE) {
+		// The dialog was cancelled, exit like qfile-agent
+		os.Exit(32)
+	}
+}
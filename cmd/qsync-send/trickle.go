@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/holiman/qvm-sync/packer"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// lowerPriority makes the process run at the lowest cpu priority (nice 19),
+// and in the idle io class, like nice -n 19 ionice -c 3 would. On Linux, both
+// are per thread, so it's done for each thread of the process; threads
+// started later inherit it.
+func lowerPriority() error {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, 19); err != nil {
+			return err
+		}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid),
+			ioprioClassIdle<<ioprioClassShift)
+		if errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
+
+// trickler returns what wraps the connections to the receivers, so that at
+// most bwlimit bytes per second are sent over each, and, with idle, nothing
+// while the user is active.
+func trickler(bwlimit uint64, idle time.Duration, idleCommand string) (func(io.Writer) io.Writer, error) {
+	var idleTime func() (time.Duration, error)
+	if idle > 0 {
+		command := strings.Fields(idleCommand)
+		if len(command) == 0 {
+			return nil, fmt.Errorf("no idle command")
+		}
+		idleTime = packer.IdleCommand(command...)
+		// Later failures don't pause the sync, but it should work to begin
+		// with
+		if _, err := idleTime(); err != nil {
+			return nil, fmt.Errorf("idle detection failed: %v", err)
+		}
+	}
+	return func(out io.Writer) io.Writer {
+		tw := packer.NewTrickleWriter(out, bwlimit)
+		tw.Idle, tw.IdleTime = idle, idleTime
+		tw.Paused = func(paused bool) {
+			if paused {
+				log.Print("User is active, pausing")
+			} else {
+				log.Print("User is idle, resuming")
+			}
+		}
+		return tw
+	}, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/holiman/qvm-sync/packer"
+)
+
+func init() {
+	packer.SetupLogging()
+}
+
+// qsync-store works with the content-addressed store, which qsync-receive
+// receives into with -store:
+//
+//	qsync-store -store /home/user/QubesStore list [source]
+//	qsync-store -store /home/user/QubesStore materialize <manifest> /directory/to/create
+func main() {
+	dir := flag.String("store", "", "`directory` of the store")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n %s -store dir list [source]\n %s -store dir materialize <manifest> /directory/to/create\nOptions:\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *dir == "" || flag.NArg() < 1 {
+		fmt.Fprintf(flag.CommandLine.Output(), "Error: store or command not supplied\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if _, err := os.Stat(*dir); err != nil {
+		log.Fatal(err)
+	}
+	store, err := packer.OpenStore(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch args := flag.Args(); {
+	case args[0] == "list" && len(args) <= 2:
+		names, err := store.Manifests(flag.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	case args[0] == "materialize" && len(args) == 3:
+		if err := store.Materialize(args[1], args[2]); err != nil {
+			log.Fatalf("Error during materialize: %v", err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
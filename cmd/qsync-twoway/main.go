@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/holiman/qvm-sync/dbus"
+	"github.com/holiman/qvm-sync/packer"
+)
+
+func init() {
+	packer.SetupLogging()
+}
+
+// qsync-twoway has two sides, like qsync-pull. The local side is started by
+// qrexec-client-vm, connected to the qubes.FilesyncTwoway service in the
+// remote qube, where the serving side runs (with -serve):
+//
+//	local: qsync-twoway -peer work [-dest dir] remote/dir  <->  remote: qsync-twoway -serve -root /home/user/QubesShare/<caller>
+//
+// The local side decides what goes where, and stores the common ancestor.
+func main() {
+	serve := flag.Bool("serve", false, "serve directories to the calling qube (used by the qubes.FilesyncTwoway service)")
+	root := flag.String("root", "", "`directory` which is served, with -serve")
+	dest := flag.String("dest", ".", "local `directory` to sync")
+	peer := flag.String("peer", "", "`name` of the other qube, which the sync state is kept for")
+	conflict := flag.String("conflict", "rename", "conflict `policy`: newest, rename or interactive")
+	useDbus := flag.Bool("dbus", false, "report the sync on the session bus, and with -conflict interactive, ask the desktop applet about conflicts")
+	verbosity := flag.Uint("v", 3, "`verbosity`: 0=None, 1=Error, 2=Warn, 3=Info, 4=Debug, 5=Trace")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n %s [options] -peer <qube> directory/to/sync\n %s -serve -root /directory/to/serve\nOptions:\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *serve {
+		if *root == "" {
+			fmt.Fprintf(flag.CommandLine.Output(), "Error: root not supplied\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := packer.ServeTwoWay(os.Stdin, os.Stdout, servedDir(*root)); err != nil {
+			log.Fatal(err)
+		}
+		log.Print("All done")
+		return
+	}
+	if flag.NArg() < 1 || *peer == "" {
+		fmt.Fprintf(flag.CommandLine.Output(), "Error: path or peer not supplied\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	opts := &packer.TwoWayOptions{
+		Peer:      *peer,
+		Verbosity: int(*verbosity),
+	}
+	switch *conflict {
+	case "newest":
+		opts.Policy = packer.ConflictNewest
+	case "rename":
+		opts.Policy = packer.ConflictRename
+	case "interactive":
+		opts.Policy = packer.ConflictInteractive
+		opts.Resolve = askUser
+	default:
+		log.Fatalf("Unknown conflict policy %q", *conflict)
+	}
+	var events *dbus.Events
+	if *useDbus {
+		conn, err := dbus.SessionBus()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+		events = dbus.NewEvents(conn)
+		if opts.Resolve != nil {
+			opts.Resolve = askApplet(events, *dest)
+		}
+		events.Started(*dest, *peer)
+	}
+	err := packer.TwoWaySync(os.Stdin, os.Stdout, *dest, flag.Arg(0), opts)
+	if events != nil {
+		events.Completed(*dest, *peer, err, 0, 0)
+	}
+	if err != nil {
+		log.Fatalf("Error during two-way sync: %v", err)
+	}
+}
+
+// servedDir returns a function which resolves a requested directory within
+// the served root.
+func servedDir(root string) func(string) (string, error) {
+	return func(dir string) (string, error) {
+		log.Printf("Two-way sync requested: %v", dir)
+		return packer.ResolveServed(root, dir)
+	}
+}
+
+// describe describes one side of a conflict, to the user.
+func describe(e *packer.ManifestEntry) string {
+	if e == nil {
+		return "deleted"
+	}
+	return fmt.Sprintf("%d bytes, modified %v", e.Size, time.Unix(0, e.Mtime).Format(time.RFC3339))
+}
+
+// resolutionNames are the names of the resolutions, as on the session bus.
+var resolutionNames = []string{packer.KeepLocal: "local", packer.KeepRemote: "remote", packer.KeepBoth: "both"}
+
+// askApplet returns a function which resolves a conflict by asking the
+// desktop applet, via the session bus, and reports the resolution there.
+// Without an applet, the user is asked on the terminal instead.
+func askApplet(events *dbus.Events, dir string) func(*packer.Conflict) (packer.Resolution, error) {
+	return func(c *packer.Conflict) (packer.Resolution, error) {
+		answer, err := events.Resolve(c.Path, describe(c.Local), describe(c.Remote))
+		if e, ok := err.(*dbus.Error); ok && (e.Name == "org.freedesktop.DBus.Error.ServiceUnknown" || e.Name == "org.freedesktop.DBus.Error.NameHasNoOwner") {
+			log.Printf("No applet to ask about conflict in %v, asking on the terminal", c.Path)
+			res, err := askUser(c)
+			if err == nil {
+				events.Conflict(dir, c.Path, resolutionNames[res])
+			}
+			return res, err
+		}
+		if err != nil {
+			return 0, fmt.Errorf("can't ask about conflict in %v: %v", c.Path, err)
+		}
+		for res, name := range resolutionNames {
+			if name == answer {
+				events.Conflict(dir, c.Path, answer)
+				return packer.Resolution(res), nil
+			}
+		}
+		return 0, fmt.Errorf("invalid resolution %q of conflict in %v", answer, c.Path)
+	}
+}
+
+// askUser resolves a conflict by asking on the terminal, since stdin and
+// stdout are connected to the other side.
+func askUser(c *packer.Conflict) (packer.Resolution, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return 0, fmt.Errorf("can't ask about conflict in %v: %v", c.Path, err)
+	}
+	defer tty.Close()
+	fmt.Fprintf(tty, "Conflict: %v\n  local:  %v\n  remote: %v\n", c.Path, describe(c.Local), describe(c.Remote))
+	in := bufio.NewReader(tty)
+	for {
+		fmt.Fprintf(tty, "Keep [l]ocal, [r]emote or [b]oth? ")
+		answer, err := in.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		switch strings.TrimSpace(answer) {
+		case "l":
+			return packer.KeepLocal, nil
+		case "r":
+			return packer.KeepRemote, nil
+		case "b":
+			return packer.KeepBoth, nil
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/holiman/qvm-sync/packer"
+)
+
+func init() {
+	packer.SetupLogging()
+}
+
+// qsync-verify has two sides, like qsync-pull. The local side is started by
+// qrexec-client-vm, connected to the qubes.FilesyncVerify service in the
+// remote qube, where the serving side runs (with -serve):
+//
+//	local: qsync-verify [-remote dir] /local/dir  <->  remote: qsync-verify -serve -root /home/user/QubesSync/<caller>
+//
+// The local side compares the manifests of both trees, and lists whatever
+// differs. It exits with 1 if the trees differ.
+func main() {
+	serve := flag.Bool("serve", false, "serve directories to the calling qube (used by the qubes.FilesyncVerify service)")
+	root := flag.String("root", "", "`directory` which is served, with -serve")
+	remote := flag.String("remote", "", "remote `directory` to compare with (default: the name of the local directory)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n %s [options] /directory/to/verify\n %s -serve -root /directory/to/serve\nOptions:\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *serve {
+		if *root == "" {
+			fmt.Fprintf(flag.CommandLine.Output(), "Error: root not supplied\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := packer.ServeVerify(os.Stdin, os.Stdout, servedDir(*root)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.NArg() < 1 {
+		fmt.Fprintf(flag.CommandLine.Output(), "Error: path not supplied\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	local := filepath.Clean(flag.Arg(0))
+	dir := *remote
+	if dir == "" {
+		// Where qvm-sync puts it, within the jail of the calling qube
+		dir = filepath.Base(local)
+	}
+	diffs, err := packer.Verify(os.Stdin, os.Stdout, local, dir)
+	if err != nil {
+		log.Fatalf("Error during verification: %v", err)
+	}
+	// Stdout is connected to the other side
+	for _, d := range diffs {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", d.Path, d.Reason())
+	}
+	if len(diffs) > 0 {
+		log.Printf("%v and %v differ: %d differences", local, dir, len(diffs))
+		os.Exit(1)
+	}
+	log.Printf("%v and %v are identical", local, dir)
+}
+
+// servedDir returns a function which resolves a requested directory within
+// the served root.
+func servedDir(root string) func(string) (string, error) {
+	return func(dir string) (string, error) {
+		log.Printf("Verification requested: %v", dir)
+		return packer.ResolveServed(root, dir)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// commands are those which qsync runs, as qsync-<command>.
+var commands = []struct{ name, what string }{
+	{"send", "send a directory to a receiver"},
+	{"receive", "receive a directory from a sender, on stdin/stdout"},
+	{"listen", "receive syncs over tcp/tls, vsock or a unix socket"},
+	{"pull", "pull a directory from another qube"},
+	{"twoway", "sync a directory both ways"},
+	{"verify", "compare a directory with its copy, without changing it"},
+	{"diff", "show what a sync would change"},
+	{"apply", "apply a batch written by send -batch-out"},
+	{"store", "work with the content-addressed store"},
+	{"daemon", "keep a directory synced to another qube"},
+	{"log", "show the journal of the syncs received"},
+}
+
+// qsync runs the command given as its first argument, e.g.
+//
+//	qsync send -summary /home/user/photos
+//
+// runs qsync-send, found next to qsync or in the PATH, with the rest of the
+// arguments. The commands can also be run directly.
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "-help" {
+		usage()
+		if len(os.Args) < 2 {
+			os.Exit(2)
+		}
+		return
+	}
+	name := os.Args[1]
+	bin, err := lookup("qsync-" + name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+	args := append([]string{"qsync-" + name}, os.Args[2:]...)
+	if err := syscall.Exec(bin, args, os.Environ()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error running %v: %v\n", bin, err)
+		os.Exit(1)
+	}
+}
+
+// lookup returns the path of the named binary, next to qsync, or in the PATH.
+func lookup(name string) (string, error) {
+	if self, err := os.Executable(); err == nil {
+		path := filepath.Join(filepath.Dir(self), name)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return exec.LookPath(name)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n %s <command> [options] [arguments]\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.what)
+	}
+	fmt.Fprintf(os.Stderr, "Use \"%s <command> -h\" for the options of a command.\n", filepath.Base(os.Args[0]))
+}
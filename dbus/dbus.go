@@ -0,0 +1,554 @@
+// Package dbus is a minimal client of the D-Bus message bus: enough to emit
+// signals, and to call methods with simple arguments, on the session bus.
+// Arguments may be strings, object paths (ObjectPath), booleans, bytes and
+// 32- or 64-bit integers.
+package dbus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ObjectPath is a D-Bus object path, e.g. /org/qubes/Qsync1.
+type ObjectPath string
+
+// Error is an error returned by a method call.
+type Error struct {
+	Name    string // e.g. org.freedesktop.DBus.Error.ServiceUnknown
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Name
+	}
+	return fmt.Sprintf("%v: %v", e.Name, e.Message)
+}
+
+const (
+	typeMethodCall   = 1
+	typeMethodReturn = 2
+	typeError        = 3
+	typeSignal       = 4
+
+	flagNoReplyExpected = 0x1
+
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSender      = 7
+	fieldSignature   = 8
+
+	// maxMessageSize is the limit of the specification
+	maxMessageSize = 128 << 20
+)
+
+// Conn is a connection to a message bus. It is safe for concurrent use.
+type Conn struct {
+	mu     sync.Mutex
+	conn   *net.UnixConn
+	in     *bufio.Reader
+	serial uint32
+	name   string // unique name, assigned by the bus
+}
+
+// SessionBus connects to the session bus of the user, as given by
+// DBUS_SESSION_BUS_ADDRESS, or at $XDG_RUNTIME_DIR/bus.
+func SessionBus() (*Conn, error) {
+	addr := os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+	if addr == "" {
+		dir := os.Getenv("XDG_RUNTIME_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("no session bus: neither DBUS_SESSION_BUS_ADDRESS nor XDG_RUNTIME_DIR is set")
+		}
+		addr = "unix:path=" + dir + "/bus"
+	}
+	return Dial(addr)
+}
+
+// Dial connects to the bus at the address, which must be a unix socket
+// (unix:path=... or unix:abstract=...). Of several addresses, the first
+// which works is used.
+func Dial(address string) (*Conn, error) {
+	var errs []string
+	for _, addr := range strings.Split(address, ";") {
+		path, err := parseAddress(addr)
+		if err == nil {
+			var c *Conn
+			if c, err = dialUnix(path); err == nil {
+				return c, nil
+			}
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("can't connect to bus: %v", strings.Join(errs, "; "))
+}
+
+// parseAddress returns the socket path of a unix address, with a leading @
+// for abstract sockets.
+func parseAddress(addr string) (string, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return "", fmt.Errorf("unsupported address %q", addr)
+	}
+	for _, kv := range strings.Split(strings.TrimPrefix(addr, "unix:"), ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		value, err := unescapeAddress(kv[i+1:])
+		if err != nil {
+			return "", err
+		}
+		switch kv[:i] {
+		case "path":
+			return value, nil
+		case "abstract":
+			return "@" + value, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported address %q", addr)
+}
+
+// unescapeAddress undoes the %-escaping of address values.
+func unescapeAddress(value string) (string, error) {
+	var out []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' {
+			out = append(out, value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return "", fmt.Errorf("invalid escape in %q", value)
+		}
+		b, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", value)
+		}
+		out = append(out, b[0])
+		i += 2
+	}
+	return string(out), nil
+}
+
+func dialUnix(path string) (*Conn, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: conn, in: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	err = c.auth()
+	if err == nil {
+		var reply []interface{}
+		reply, err = c.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", nil)
+		if err == nil && len(reply) == 1 {
+			c.name, _ = reply[0].(string)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// auth authenticates as the user running us (the EXTERNAL mechanism).
+func (c *Conn) auth() error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := c.conn.Write([]byte("\x00AUTH EXTERNAL " + uid + "\r\n")); err != nil {
+		return err
+	}
+	line, err := c.in.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("authentication failed: %q", strings.TrimSpace(line))
+	}
+	_, err = c.conn.Write([]byte("BEGIN\r\n"))
+	return err
+}
+
+// Name returns the unique name of the connection.
+func (c *Conn) Name() string {
+	return c.name
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Emit emits a signal.
+func (c *Conn) Emit(path ObjectPath, iface, member string, args ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.send(typeSignal, flagNoReplyExpected, "", path, iface, member, args)
+	return err
+}
+
+// Call calls a method, and waits for the reply (at most timeout). An error
+// reply is returned as *Error. Other use of the connection waits for the
+// reply.
+func (c *Conn) Call(dest string, path ObjectPath, iface, member string, timeout time.Duration, args ...interface{}) ([]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	return c.call(dest, path, iface, member, args)
+}
+
+// call sends a method call, and reads messages until the reply. Other
+// messages (e.g. signals the bus sends us) are dropped.
+func (c *Conn) call(dest string, path ObjectPath, iface, member string, args []interface{}) ([]interface{}, error) {
+	serial, err := c.send(typeMethodCall, 0, dest, path, iface, member, args)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if msg.replySerial != serial || (msg.typ != typeMethodReturn && msg.typ != typeError) {
+			continue
+		}
+		if msg.typ == typeError {
+			e := &Error{Name: msg.errorName}
+			if len(msg.body) > 0 {
+				e.Message, _ = msg.body[0].(string)
+			}
+			return nil, e
+		}
+		return msg.body, nil
+	}
+}
+
+// send writes a message, and returns its serial.
+func (c *Conn) send(typ, flags byte, dest string, path ObjectPath, iface, member string, args []interface{}) (uint32, error) {
+	sig, err := signature(args)
+	if err != nil {
+		return 0, err
+	}
+	// The body is aligned as if it started at a multiple of 8, as it will
+	body := new(encoder)
+	for _, arg := range args {
+		body.value(arg)
+	}
+	c.serial++
+	var fields []interface{}
+	field := func(code byte, v interface{}) {
+		fields = append(fields, code, v)
+	}
+	field(fieldPath, path)
+	if iface != "" {
+		field(fieldInterface, iface)
+	}
+	field(fieldMember, member)
+	if dest != "" {
+		field(fieldDestination, dest)
+	}
+	if sig != "" {
+		field(fieldSignature, signatureValue(sig))
+	}
+	msg := new(encoder)
+	msg.buf.Write([]byte{'l', typ, flags, 1})
+	msg.uint32(uint32(body.buf.Len()))
+	msg.uint32(c.serial)
+	// The header fields, an array of struct(byte, variant)
+	msg.uint32(0)
+	lenAt := msg.buf.Len()
+	msg.align(8)
+	start := msg.buf.Len()
+	for i := 0; i < len(fields); i += 2 {
+		msg.align(8)
+		msg.buf.WriteByte(fields[i].(byte))
+		msg.variant(fields[i+1])
+	}
+	binary.LittleEndian.PutUint32(msg.buf.Bytes()[lenAt-4:], uint32(msg.buf.Len()-start))
+	msg.align(8)
+	msg.buf.Write(body.buf.Bytes())
+	if _, err := c.conn.Write(msg.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return c.serial, nil
+}
+
+// signatureValue is a value of type signature.
+type signatureValue string
+
+// signature returns the signature of the arguments.
+func signature(args []interface{}) (string, error) {
+	var sig strings.Builder
+	for _, arg := range args {
+		code, err := typeCode(arg)
+		if err != nil {
+			return "", err
+		}
+		sig.WriteByte(code)
+	}
+	return sig.String(), nil
+}
+
+func typeCode(v interface{}) (byte, error) {
+	switch v.(type) {
+	case byte:
+		return 'y', nil
+	case bool:
+		return 'b', nil
+	case int32:
+		return 'i', nil
+	case uint32:
+		return 'u', nil
+	case int64:
+		return 'x', nil
+	case uint64:
+		return 't', nil
+	case string:
+		return 's', nil
+	case ObjectPath:
+		return 'o', nil
+	case signatureValue:
+		return 'g', nil
+	}
+	return 0, fmt.Errorf("unsupported type %T", v)
+}
+
+// encoder marshals values, in little endian.
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) align(n int) {
+	for e.buf.Len()%n != 0 {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.align(4)
+	binary.Write(&e.buf, binary.LittleEndian, v)
+}
+
+func (e *encoder) value(v interface{}) {
+	switch v := v.(type) {
+	case byte:
+		e.buf.WriteByte(v)
+	case bool:
+		b := uint32(0)
+		if v {
+			b = 1
+		}
+		e.uint32(b)
+	case int32:
+		e.uint32(uint32(v))
+	case uint32:
+		e.uint32(v)
+	case int64:
+		e.align(8)
+		binary.Write(&e.buf, binary.LittleEndian, v)
+	case uint64:
+		e.align(8)
+		binary.Write(&e.buf, binary.LittleEndian, v)
+	case string:
+		e.uint32(uint32(len(v)))
+		e.buf.WriteString(v)
+		e.buf.WriteByte(0)
+	case ObjectPath:
+		e.value(string(v))
+	case signatureValue:
+		e.buf.WriteByte(byte(len(v)))
+		e.buf.WriteString(string(v))
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *encoder) variant(v interface{}) {
+	code, _ := typeCode(v)
+	e.value(signatureValue(string(code)))
+	e.value(v)
+}
+
+// message is a received message, as far as we need it.
+type message struct {
+	typ         byte
+	replySerial uint32
+	errorName   string
+	body        []interface{} // nil if of a type we don't decode
+}
+
+// read reads a message.
+func (c *Conn) read() (*message, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(c.in, head); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if head[0] == 'B' {
+		order = binary.BigEndian
+	}
+	bodyLen, fieldsLen := order.Uint32(head[4:]), order.Uint32(head[12:])
+	headerLen := (16 + fieldsLen + 7) &^ 7
+	if uint64(headerLen)+uint64(bodyLen) > maxMessageSize {
+		return nil, fmt.Errorf("message too large")
+	}
+	data := make([]byte, headerLen+bodyLen)
+	copy(data, head)
+	if _, err := io.ReadFull(c.in, data[16:]); err != nil {
+		return nil, err
+	}
+	msg := &message{typ: head[1]}
+	d := &decoder{data: data[:16+fieldsLen], pos: 16, order: order}
+	var sig string
+	for d.pos < len(d.data) {
+		d.align(8)
+		code, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.variant()
+		if err != nil {
+			return nil, err
+		}
+		switch code {
+		case fieldReplySerial:
+			msg.replySerial, _ = v.(uint32)
+		case fieldErrorName:
+			msg.errorName, _ = v.(string)
+		case fieldSignature:
+			s, _ := v.(signatureValue)
+			sig = string(s)
+		}
+	}
+	d = &decoder{data: data, pos: int(headerLen), order: order}
+	for i := 0; i < len(sig); i++ {
+		v, err := d.value(sig[i])
+		if err != nil {
+			// Of a type we don't decode, e.g. a container
+			msg.body = nil
+			break
+		}
+		msg.body = append(msg.body, v)
+	}
+	return msg, nil
+}
+
+// decoder unmarshals values. Positions are relative to the message start,
+// which alignment is relative to.
+type decoder struct {
+	data  []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+var errShort = fmt.Errorf("message too short")
+
+func (d *decoder) align(n int) {
+	d.pos = (d.pos + n - 1) / n * n
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if d.pos+n > len(d.data) {
+		return nil, errShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) byte() (byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	d.align(4)
+	b, err := d.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint32(b), nil
+}
+
+func (d *decoder) uint64() (uint64, error) {
+	d.align(8)
+	b, err := d.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint64(b), nil
+}
+
+func (d *decoder) string(length int) (string, error) {
+	b, err := d.next(length + 1)
+	if err != nil {
+		return "", err
+	}
+	return string(b[:length]), nil
+}
+
+func (d *decoder) value(code byte) (interface{}, error) {
+	switch code {
+	case 'y':
+		return d.byte()
+	case 'b':
+		v, err := d.uint32()
+		return v != 0, err
+	case 'i':
+		v, err := d.uint32()
+		return int32(v), err
+	case 'u':
+		return d.uint32()
+	case 'x':
+		v, err := d.uint64()
+		return int64(v), err
+	case 't':
+		return d.uint64()
+	case 's', 'o':
+		n, err := d.uint32()
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.string(int(n))
+		if code == 'o' {
+			return ObjectPath(s), err
+		}
+		return s, err
+	case 'g':
+		n, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.string(int(n))
+		return signatureValue(s), err
+	}
+	return nil, fmt.Errorf("unsupported type %q", code)
+}
+
+func (d *decoder) variant() (interface{}, error) {
+	sig, err := d.value('g')
+	if err != nil {
+		return nil, err
+	}
+	if s := sig.(signatureValue); len(s) == 1 {
+		return d.value(s[0])
+	}
+	return nil, fmt.Errorf("unsupported variant %q", sig)
+}
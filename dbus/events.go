@@ -0,0 +1,112 @@
+package dbus
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// The interface of qvm-sync on the session bus. Syncs are reported with
+// signals on EventsPath:
+//
+//	Started(s dir, s target)
+//	Progress(s dir, u items, t bytes, s path)   at most every ProgressInterval
+//	Completed(s dir, s target, b ok, s error, u items, t bytes)
+//	Conflict(s dir, s path, s resolution)
+//
+// Conflicts are resolved by calling Resolve(s path, s local, s remote) on
+// the applet owning PromptName, which returns "local", "remote" or "both".
+const (
+	EventsPath      ObjectPath = "/org/qubes/Qsync1"
+	EventsInterface            = "org.qubes.Qsync1"
+
+	PromptName      = "org.qubes.Qsync1.Prompt"
+	PromptPath      = ObjectPath("/org/qubes/Qsync1/Prompt")
+	PromptInterface = "org.qubes.Qsync1.Prompt"
+
+	ProgressInterval = 500 * time.Millisecond
+)
+
+// PromptTimeout is how long the applet has to resolve a conflict.
+var PromptTimeout = 10 * time.Minute
+
+// Bus is what Events needs of a bus connection, as implemented by Conn.
+type Bus interface {
+	Emit(path ObjectPath, iface, member string, args ...interface{}) error
+	Call(dest string, path ObjectPath, iface, member string, timeout time.Duration, args ...interface{}) ([]interface{}, error)
+}
+
+// Events emits the events of syncs on the bus. Failures to emit are logged,
+// but don't affect the sync.
+type Events struct {
+	bus Bus
+
+	mu           sync.Mutex
+	lastProgress time.Time
+	failed       bool // logged already
+}
+
+// NewEvents returns an Events, emitting on the bus.
+func NewEvents(bus Bus) *Events {
+	return &Events{bus: bus}
+}
+
+func (e *Events) emit(member string, args ...interface{}) {
+	if err := e.bus.Emit(EventsPath, EventsInterface, member, args...); err != nil {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if !e.failed {
+			log.Printf("Failed to emit %v on the session bus: %v", member, err)
+			e.failed = true
+		}
+	}
+}
+
+// Started reports the start of a sync of dir, to target.
+func (e *Events) Started(dir, target string) {
+	e.emit("Started", dir, target)
+}
+
+// Progress reports the items and bytes sent so far, and the last item. Calls
+// within ProgressInterval of the last reported one are dropped.
+func (e *Events) Progress(dir string, items int, bytes uint64, path string) {
+	e.mu.Lock()
+	now := time.Now()
+	if now.Sub(e.lastProgress) < ProgressInterval {
+		e.mu.Unlock()
+		return
+	}
+	e.lastProgress = now
+	e.mu.Unlock()
+	e.emit("Progress", dir, uint32(items), bytes, path)
+}
+
+// Completed reports the end of a sync, which failed if err is set.
+func (e *Events) Completed(dir, target string, err error, items int, bytes uint64) {
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	e.emit("Completed", dir, target, err == nil, msg, uint32(items), bytes)
+}
+
+// Conflict reports how a conflict was resolved.
+func (e *Events) Conflict(dir, path, resolution string) {
+	e.emit("Conflict", dir, path, resolution)
+}
+
+// Resolve asks the applet to resolve a conflict in path, between the local
+// and remote versions (as described to the user). It returns "local",
+// "remote" or "both".
+func (e *Events) Resolve(path, local, remote string) (string, error) {
+	reply, err := e.bus.Call(PromptName, PromptPath, PromptInterface, "Resolve", PromptTimeout, path, local, remote)
+	if err != nil {
+		return "", err
+	}
+	if len(reply) == 1 {
+		if s, ok := reply[0].(string); ok && (s == "local" || s == "remote" || s == "both") {
+			return s, nil
+		}
+	}
+	return "", &Error{Name: "org.qubes.Qsync1.Error.InvalidReply", Message: "expected \"local\", \"remote\" or \"both\""}
+}
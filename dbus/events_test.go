@@ -0,0 +1,148 @@
+package dbus
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var _ Bus = (*Conn)(nil)
+
+// signal is a signal emitted on the fakeBus.
+type signal struct {
+	member string
+	args   []interface{}
+}
+
+// fakeBus records the signals emitted on it, and answers method calls with
+// reply and err.
+type fakeBus struct {
+	mu      sync.Mutex
+	signals []signal
+	emitErr error
+
+	calls []signal // the method calls, by member
+	dest  string   // of the last call
+	reply []interface{}
+	err   error
+}
+
+func (b *fakeBus) Emit(path ObjectPath, iface, member string, args ...interface{}) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if path != EventsPath || iface != EventsInterface {
+		return errors.New("signal on the wrong path or interface")
+	}
+	if b.emitErr != nil {
+		return b.emitErr
+	}
+	b.signals = append(b.signals, signal{member, args})
+	return nil
+}
+
+func (b *fakeBus) Call(dest string, path ObjectPath, iface, member string, timeout time.Duration, args ...interface{}) ([]interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if path != PromptPath || iface != PromptInterface || timeout != PromptTimeout {
+		return nil, errors.New("call on the wrong path or interface, or with the wrong timeout")
+	}
+	b.dest = dest
+	b.calls = append(b.calls, signal{member, args})
+	return b.reply, b.err
+}
+
+func TestEvents(t *testing.T) {
+	bus := new(fakeBus)
+	e := NewEvents(bus)
+	e.Started("/home/user/docs", "vault")
+	e.Progress("/home/user/docs", 1, 5, "a.txt")
+	// Within ProgressInterval of the last one, so dropped
+	e.Progress("/home/user/docs", 2, 12, "b/c.txt")
+	e.Conflict("/home/user/docs", "d.txt", "both")
+	e.Completed("/home/user/docs", "vault", nil, 2, 12)
+	e.Completed("/home/user/docs", "vault", errors.New("no route to vault"), 0, 0)
+
+	want := []signal{
+		{"Started", []interface{}{"/home/user/docs", "vault"}},
+		{"Progress", []interface{}{"/home/user/docs", uint32(1), uint64(5), "a.txt"}},
+		{"Conflict", []interface{}{"/home/user/docs", "d.txt", "both"}},
+		{"Completed", []interface{}{"/home/user/docs", "vault", true, "", uint32(2), uint64(12)}},
+		{"Completed", []interface{}{"/home/user/docs", "vault", false, "no route to vault", uint32(0), uint64(0)}},
+	}
+	if !reflect.DeepEqual(bus.signals, want) {
+		t.Fatalf("signals:\n%v\nwant:\n%v", bus.signals, want)
+	}
+	// The signatures are those documented
+	for i, sig := range []string{"ss", "suts", "sss", "ssbsut", "ssbsut"} {
+		if got, err := signature(bus.signals[i].args); err != nil || got != sig {
+			t.Errorf("signature of %v: %q (%v), want %q", bus.signals[i].member, got, err, sig)
+		}
+	}
+
+	// After the interval, progress is reported again
+	e.mu.Lock()
+	e.lastProgress = time.Now().Add(-ProgressInterval)
+	e.mu.Unlock()
+	e.Progress("/home/user/docs", 3, 20, "e.txt")
+	if n := len(bus.signals); n != len(want)+1 || bus.signals[n-1].member != "Progress" {
+		t.Fatalf("progress after the interval not reported: %v", bus.signals[len(want):])
+	}
+}
+
+func TestEventsEmitFailure(t *testing.T) {
+	bus := &fakeBus{emitErr: errors.New("broken pipe")}
+	e := NewEvents(bus)
+	e.Started("/home/user/docs", "vault")
+	if !e.failed {
+		t.Fatal("failure to emit not recorded")
+	}
+	// Later failures aren't logged again, and the events go on
+	e.Completed("/home/user/docs", "vault", nil, 0, 0)
+	bus.emitErr = nil
+	e.Started("/home/user/docs", "vault")
+	if len(bus.signals) != 1 {
+		t.Fatalf("signals: %v, want Started", bus.signals)
+	}
+}
+
+func TestEventsResolve(t *testing.T) {
+	for _, tt := range []struct {
+		reply  []interface{}
+		err    error
+		answer string
+		errMsg string
+	}{
+		{reply: []interface{}{"local"}, answer: "local"},
+		{reply: []interface{}{"remote"}, answer: "remote"},
+		{reply: []interface{}{"both"}, answer: "both"},
+		{reply: []interface{}{"neither"}, errMsg: `org.qubes.Qsync1.Error.InvalidReply: expected "local", "remote" or "both"`},
+		{reply: []interface{}{uint32(1)}, errMsg: `org.qubes.Qsync1.Error.InvalidReply: expected "local", "remote" or "both"`},
+		{reply: []interface{}{"local", "remote"}, errMsg: `org.qubes.Qsync1.Error.InvalidReply: expected "local", "remote" or "both"`},
+		{reply: nil, errMsg: `org.qubes.Qsync1.Error.InvalidReply: expected "local", "remote" or "both"`},
+		{err: &Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown"}, errMsg: "org.freedesktop.DBus.Error.ServiceUnknown"},
+	} {
+		bus := &fakeBus{reply: tt.reply, err: tt.err}
+		answer, err := NewEvents(bus).Resolve("d.txt", "local version", "remote version")
+		if bus.dest != PromptName {
+			t.Errorf("call to %q, want %q", bus.dest, PromptName)
+		}
+		wantCall := []signal{{"Resolve", []interface{}{"d.txt", "local version", "remote version"}}}
+		if !reflect.DeepEqual(bus.calls, wantCall) {
+			t.Errorf("calls: %v, want %v", bus.calls, wantCall)
+		}
+		if tt.errMsg != "" {
+			if err == nil || err.Error() != tt.errMsg {
+				t.Errorf("reply %v, error %v: got %q, %v, want error %q", tt.reply, tt.err, answer, err, tt.errMsg)
+			}
+			if _, ok := err.(*Error); !ok {
+				t.Errorf("error %v is a %T, want *Error", err, err)
+			}
+			continue
+		}
+		if err != nil || answer != tt.answer {
+			t.Errorf("reply %v: got %q, %v, want %q", tt.reply, answer, err, tt.answer)
+		}
+	}
+}
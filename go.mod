@@ -1,5 +1,10 @@
 module github.com/holiman/qvm-sync
 
-go 1.13
+go 1.20
 
-require github.com/golang/snappy v0.0.1
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/golang/snappy v0.0.1
+	golang.org/x/sys v0.15.0
+	golang.org/x/text v0.3.8
+)
@@ -15,6 +15,21 @@ RPCDIR=/etc/qubes-rpc
 echo "Installing sender script into $SYNCDIR..."  && \
     sudo cp ./scripts/qvm-sync $SYNCDIR/qvm-sync &&\
     sudo chmod 755 $SYNCDIR/qvm-sync
+echo "Installing sender script for the file manager into $SYNCDIR..."  && \
+    sudo cp ./scripts/qvm-sync-gui $SYNCDIR/qvm-sync-gui &&\
+    sudo chmod 755 $SYNCDIR/qvm-sync-gui
+echo "Installing pull script into $SYNCDIR..."  && \
+    sudo cp ./scripts/qvm-pull $SYNCDIR/qvm-pull &&\
+    sudo chmod 755 $SYNCDIR/qvm-pull
+echo "Installing two-way sync script into $SYNCDIR..."  && \
+    sudo cp ./scripts/qvm-sync-twoway $SYNCDIR/qvm-sync-twoway &&\
+    sudo chmod 755 $SYNCDIR/qvm-sync-twoway
+echo "Installing verify script into $SYNCDIR..."  && \
+    sudo cp ./scripts/qvm-verify $SYNCDIR/qvm-verify &&\
+    sudo chmod 755 $SYNCDIR/qvm-verify
+echo "Installing diff script into $SYNCDIR..."  && \
+    sudo cp ./scripts/qvm-diff $SYNCDIR/qvm-diff &&\
+    sudo chmod 755 $SYNCDIR/qvm-diff
 
 #
 # Install the service that can be invoked via qubes rpc calls
@@ -22,24 +37,60 @@ echo "Installing sender script into $SYNCDIR..."  && \
 echo "Installing receiver into $RPCDIR..."  && \
   sudo cp ./scripts/qubes.Filesync $RPCDIR/qubes.Filesync &&\
   sudo chmod 755 $RPCDIR/qubes.Filesync
+echo "Installing pull service into $RPCDIR..."  && \
+  sudo cp ./scripts/qubes.Filepull $RPCDIR/qubes.Filepull &&\
+  sudo chmod 755 $RPCDIR/qubes.Filepull
+echo "Installing two-way sync service into $RPCDIR..."  && \
+  sudo cp ./scripts/qubes.FilesyncTwoway $RPCDIR/qubes.FilesyncTwoway &&\
+  sudo chmod 755 $RPCDIR/qubes.FilesyncTwoway
+echo "Installing verify service into $RPCDIR..."  && \
+  sudo cp ./scripts/qubes.FilesyncVerify $RPCDIR/qubes.FilesyncVerify &&\
+  sudo chmod 755 $RPCDIR/qubes.FilesyncVerify
 
 #
 # Build the binaries, if we have go installed
 #
 go version && \
   echo "Building binaries..."
+  go build ./cmd/qsync && \
   go build ./cmd/qsync-send && \
-  go build ./cmd/qsync-receive && \
+  CGO_ENABLED=0 go build ./cmd/qsync-receive && \
+  go build ./cmd/qsync-listen && \
+  go build ./cmd/qsync-pull && \
+  go build ./cmd/qsync-twoway && \
+  go build ./cmd/qsync-daemon && \
+  go build ./cmd/qsync-verify && \
+  go build ./cmd/qsync-diff && \
+  go build ./cmd/qsync-apply && \
+  go build ./cmd/qsync-store && \
   go build ./cmd/qsync-preloader
 
 #
 # Install the binaries into /usr/lib/qubes
 #
 echo "Installing binaries into $BINDIR..."
+sudo cp qsync $BINDIR/ && \
+    sudo chmod 0755 $BINDIR/qsync
 sudo cp qsync-send $BINDIR/ && \
     sudo chmod 0755 $BINDIR/qsync-send
 sudo cp qsync-receive $BINDIR/ && \
     sudo chmod 0755 $BINDIR/qsync-receive
+sudo cp qsync-listen $BINDIR/ && \
+    sudo chmod 0755 $BINDIR/qsync-listen
+sudo cp qsync-pull $BINDIR/ && \
+    sudo chmod 0755 $BINDIR/qsync-pull
+sudo cp qsync-twoway $BINDIR/ && \
+    sudo chmod 0755 $BINDIR/qsync-twoway
+sudo cp qsync-daemon $BINDIR/ && \
+    sudo chmod 0755 $BINDIR/qsync-daemon
+sudo cp qsync-verify $BINDIR/ && \
+    sudo chmod 0755 $BINDIR/qsync-verify
+sudo cp qsync-diff $BINDIR/ && \
+    sudo chmod 0755 $BINDIR/qsync-diff
+sudo cp qsync-apply $BINDIR/ && \
+    sudo chmod 0755 $BINDIR/qsync-apply
+sudo cp qsync-store $BINDIR/ && \
+    sudo chmod 0755 $BINDIR/qsync-store
 
 #
 # The preloader requires suid flag to be set
@@ -0,0 +1,109 @@
+// Package profiling adds the flags for capturing cpu and memory profiles, and
+// execution traces, of a sync to the commands.
+package profiling
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// Flags are the profiling flags of a command.
+type Flags struct {
+	cpu, mem, trace *string
+}
+
+// AddFlags adds -cpuprofile, -memprofile and -trace to the command line flags.
+// They're to be parsed before Start is called.
+func AddFlags() *Flags {
+	return &Flags{
+		cpu:   flag.String("cpuprofile", "", "write a cpu profile of the sync to `file`"),
+		mem:   flag.String("memprofile", "", "write a memory profile to `file`, when the sync ends"),
+		trace: flag.String("trace", "", "write an execution trace of the sync to `file`"),
+	}
+}
+
+// Start starts the profiles asked for. Relative file names are placed in dir,
+// which is created if needed, unless it's empty. The returned function stops
+// them, and writes the memory profile; it's to be called when the sync ends,
+// whether it failed or not.
+func (f *Flags) Start(dir string) (stop func(), err error) {
+	var (
+		cpuFile, traceFile *os.File
+		memPath            = resolve(*f.mem, dir)
+	)
+	stop = func() {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			cpuFile.Close()
+			cpuFile = nil
+		}
+		if traceFile != nil {
+			trace.Stop()
+			traceFile.Close()
+			traceFile = nil
+		}
+		if memPath != "" {
+			if err := writeHeapProfile(memPath); err != nil {
+				log.Printf("Failed writing memory profile: %v", err)
+			}
+			memPath = ""
+		}
+	}
+	if dir != "" && *f.cpu+*f.mem+*f.trace != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	if *f.cpu != "" {
+		if cpuFile, err = os.Create(resolve(*f.cpu, dir)); err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			cpuFile.Close()
+			return nil, fmt.Errorf("failed starting cpu profile: %v", err)
+		}
+	}
+	if *f.trace != "" {
+		if traceFile, err = os.Create(resolve(*f.trace, dir)); err == nil {
+			if err = trace.Start(traceFile); err != nil {
+				traceFile.Close()
+				traceFile = nil
+				err = fmt.Errorf("failed starting trace: %v", err)
+			}
+		}
+		if err != nil {
+			memPath = ""
+			stop()
+			return nil, err
+		}
+	}
+	return stop, nil
+}
+
+// resolve returns where the file given by name goes.
+func resolve(name, dir string) string {
+	if name == "" || dir == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+func writeHeapProfile(path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	// Up to date statistics, of what's still in use
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
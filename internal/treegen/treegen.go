@@ -0,0 +1,257 @@
+// Package treegen generates synthetic trees, reproducibly from a seed, for
+// the benchmarks and tests.
+package treegen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// SizeClass is a class of the file size distribution: files of about Size
+// bytes, with the given weight.
+type SizeClass struct {
+	Size   int64
+	Weight int
+}
+
+// ParseSizes parses a size distribution, e.g. "4k:70,64k:25,4M:5": 70% of
+// the files are about 4 KiB, and so on.
+func ParseSizes(spec string) ([]SizeClass, error) {
+	var classes []SizeClass
+	for _, part := range strings.Split(spec, ",") {
+		i := strings.Index(part, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid size class %q, expected size:weight", part)
+		}
+		size, err := ParseSize(part[:i])
+		if err != nil {
+			return nil, err
+		}
+		weight, err := strconv.Atoi(part[i+1:])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight in %q", part)
+		}
+		classes = append(classes, SizeClass{size, weight})
+	}
+	return classes, nil
+}
+
+// ParseSize parses a size in bytes, with an optional k, M or G suffix.
+func ParseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult, s = 1<<10, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "M"):
+		mult, s = 1<<20, strings.TrimSuffix(s, "M")
+	case strings.HasSuffix(s, "G"):
+		mult, s = 1<<30, strings.TrimSuffix(s, "G")
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// Spec describes a synthetic tree. The same spec generates the same tree,
+// but for the times, which are relative to now.
+type Spec struct {
+	Seed     int64
+	Files    int         // files (and symlinks) in the tree
+	Dirs     int         // the files are spread over this many directories
+	Depth    int         // the directories are nested up to this deep, 1 if zero
+	Sizes    []SizeClass // the file size distribution; files are 50-150% of the size
+	Content  string      // random (incompressible), text or mixed
+	Symlinks float64     // fraction of the files which are symlinks instead
+	Change   float64     // fraction of the files changed in the second version
+}
+
+// words make up text content, which compresses well.
+var words = strings.Fields(`the quick brown fox jumps over the lazy dog while
+qubes keeps domains apart and files are synced between them one metadata
+header at a time with a crc of the content`)
+
+// Generate writes two versions of the tree within root: base/tree, and
+// changed/tree, in which a fraction of the files have new content (or
+// symlinks a new target) and a later mtime. The other items are the same in
+// both, mtimes included. It returns the total size of the files of the base
+// tree.
+func Generate(root string, spec *Spec) (int64, error) {
+	if spec.Files < 1 || spec.Dirs < 1 || spec.Change < 0 || spec.Change > 1 ||
+		spec.Symlinks < 0 || spec.Symlinks > 1 {
+		return 0, fmt.Errorf("files and dirs must be positive, and the ratios within 0-1")
+	}
+	switch spec.Content {
+	case "random", "text", "mixed":
+	default:
+		return 0, fmt.Errorf("unknown content %q", spec.Content)
+	}
+	total := 0
+	for _, c := range spec.Sizes {
+		total += c.Weight
+	}
+	if total == 0 {
+		return 0, fmt.Errorf("the size distribution has no weight")
+	}
+	var (
+		rnd           = rand.New(rand.NewSource(spec.Seed))
+		base, changed = filepath.Join(root, "base", "tree"), filepath.Join(root, "changed", "tree")
+		dirs          = dirPaths(spec, rnd)
+		mtime         = time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+		size          int64
+	)
+	for i := 0; i < spec.Files; i++ {
+		name := filepath.Join(dirs[i%spec.Dirs], fmt.Sprintf("file%06d", i))
+		if spec.Symlinks > 0 && rnd.Float64() < spec.Symlinks {
+			target := fmt.Sprintf("file%06d", rnd.Intn(spec.Files))
+			if err := writeSymlink(filepath.Join(base, name), target, mtime); err != nil {
+				return 0, err
+			}
+			if rnd.Float64() < spec.Change {
+				target, mtime := target+".new", mtime.Add(time.Hour)
+				if err := writeSymlink(filepath.Join(changed, name), target, mtime); err != nil {
+					return 0, err
+				}
+			} else if err := writeSymlink(filepath.Join(changed, name), target, mtime); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		// Pick the size class, and a size within it
+		class, w := spec.Sizes[0], rnd.Intn(total)
+		for _, c := range spec.Sizes {
+			if w < c.Weight {
+				class = c
+				break
+			}
+			w -= c.Weight
+		}
+		n := class.Size/2 + rnd.Int63n(class.Size+1)
+		data := content(spec.Content, n, rnd)
+		if err := writeFile(filepath.Join(base, name), data, mtime); err != nil {
+			return 0, err
+		}
+		if rnd.Float64() < spec.Change {
+			data = content(spec.Content, n, rnd)
+			if err := writeFile(filepath.Join(changed, name), data, mtime.Add(time.Hour)); err != nil {
+				return 0, err
+			}
+		} else if err := writeFile(filepath.Join(changed, name), data, mtime); err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, fixDirTimes(root, mtime)
+}
+
+// dirPaths returns the paths of the directories the files are spread over.
+// Without nesting, they're all at the top. Otherwise each is placed within an
+// earlier one, unless that is as deep as it gets, or at the top.
+func dirPaths(spec *Spec, rnd *rand.Rand) []string {
+	var (
+		paths  = make([]string, spec.Dirs)
+		depths = make([]int, spec.Dirs)
+	)
+	for i := range paths {
+		name := fmt.Sprintf("dir%03d", i)
+		paths[i], depths[i] = name, 1
+		if spec.Depth <= 1 || i == 0 {
+			continue
+		}
+		if parent := rnd.Intn(i + 1); parent < i && depths[parent] < spec.Depth {
+			paths[i], depths[i] = filepath.Join(paths[parent], name), depths[parent]+1
+		}
+	}
+	return paths
+}
+
+// content returns n bytes of content of the given kind.
+func content(kind string, n int64, rnd *rand.Rand) []byte {
+	if kind == "mixed" {
+		kind = "random"
+		if rnd.Intn(2) == 0 {
+			kind = "text"
+		}
+	}
+	data := make([]byte, 0, n)
+	if kind == "text" {
+		for int64(len(data)) < n {
+			data = append(data, words[rnd.Intn(len(words))]...)
+			data = append(data, ' ')
+		}
+		return data[:n]
+	}
+	data = data[:n]
+	rnd.Read(data)
+	return data
+}
+
+func writeFile(path string, data []byte, mtime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	return os.Chtimes(path, mtime, mtime)
+}
+
+func writeSymlink(path, target string, mtime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, path); err != nil {
+		return err
+	}
+	return lchtimes(path, mtime)
+}
+
+// lchtimes sets the times of the symlink at path, which os.Chtimes would
+// follow.
+func lchtimes(path string, mtime time.Time) error {
+	const atSymlinkNoFollow = 0x100
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	ts := []syscall.Timespec{syscall.NsecToTimespec(mtime.UnixNano()), syscall.NsecToTimespec(mtime.UnixNano())}
+	dirfd := -100 // AT_FDCWD
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&ts[0])), atSymlinkNoFollow, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "utimensat", Path: path, Err: errno}
+	}
+	return nil
+}
+
+// fixDirTimes sets the mtimes of the directories, deepest first, so that
+// they're the same in both versions.
+func fixDirTimes(root string, mtime time.Time) error {
+	var dirs []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		if err := os.Chtimes(dir, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
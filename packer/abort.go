@@ -0,0 +1,94 @@
+package packer
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// With FlagAbort, the sender may abort the sync with an abort frame: a header
+// with no path and the mode os.ModeIrregular, in place of the next header of
+// the metadata, or of the data phase (after a count of zero, with FlagPacked).
+// With several streams, it's an empty frame of the stream abortStream instead.
+// Nothing follows it. The receiver removes its tempfiles, restores the
+// permissions of the directories handled so far, and answers with the result
+// CodeAborted, unless it has already. The sender discards what the receiver
+// sends, until it closes the connection.
+// OBS: This is not part of the qvm-copy protocol.
+
+// abortStream is the stream of the empty frame which aborts the sync.
+const abortStream = ^uint32(0)
+
+// isAbortFrame returns whether hdr is an abort frame. As an end marker, it
+// would be all zeros.
+func isAbortFrame(hdr *fileHeader) bool {
+	return hdr.Data.NameLen == 0 && hdr.Data.Mode == uint32(os.ModeIrregular)
+}
+
+// Abort makes the sender stop the sync before the next item it sends. With
+// Options.Abortable, the receiver is told so, and waited for to wind down.
+// Sync returns ErrAborted. It is safe to call from another goroutine (e.g. a
+// signal handler). If Sync is blocked reading from the receiver, it only
+// returns once the receiver sends something.
+func (s *Sender) Abort() {
+	atomic.StoreInt32(&s.aborted, 1)
+}
+
+func (s *Sender) isAborted() bool {
+	return atomic.LoadInt32(&s.aborted) == 1
+}
+
+// abort stops the sync, after sending the receiver an abort frame with send,
+// with Options.Abortable.
+func (s *Sender) abort(send func() error) error {
+	if s.opts.Verbosity > 0 {
+		log.Print("Aborting sync")
+	}
+	if !s.opts.Abortable {
+		return ErrAborted
+	}
+	if err := send(); err != nil {
+		return err
+	}
+	s.abortSent = true
+	return ErrAborted
+}
+
+// writeAbort writes an abort frame in place of the next header, and flushes.
+func (s *Sender) writeAbort() error {
+	hdr := new(fileHeader)
+	hdr.Data.Mode = uint32(os.ModeIrregular)
+	if err := hdr.marshallBinary(s.out); err != nil {
+		return err
+	}
+	return s.out.Flush()
+}
+
+// endAbort discards what the receiver sends after an abort frame, until it's
+// done, and returns ErrAborted.
+func (s *Sender) endAbort() error {
+	if s.abortSent {
+		io.Copy(ioutil.Discard, s.in)
+	}
+	return ErrAborted
+}
+
+// senderAborted winds down a sync which the sender aborted, see FlagAbort.
+func (r *Receiver) senderAborted() error {
+	if r.opts.Verbosity > 0 {
+		log.Print("Sync aborted by the sender")
+	}
+	r.Cleanup()
+	for _, hdr := range r.deferredPermissions {
+		r.fixTimesAndPerms(hdr)
+	}
+	// Unless the failure of the phase was reported as such already
+	if r.lastCode != CodeAborted {
+		if r.sendStatusAndCrc(CodeAborted, "") == nil {
+			r.out.Flush()
+		}
+	}
+	return ErrSenderAborted
+}
@@ -0,0 +1,496 @@
+package packer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Archive formats, see ReceiverOptions.Archive.
+const (
+	ArchiveTar = "tar"
+	ArchiveZip = "zip"
+)
+
+// ArchiveFormat returns the archive format matching the name of a file:
+// ArchiveZip for ".zip", and ArchiveTar otherwise.
+func ArchiveFormat(name string) string {
+	if strings.EqualFold(filepath.Ext(name), ".zip") {
+		return ArchiveZip
+	}
+	return ArchiveTar
+}
+
+// archiveWriter writes the received items into an archive. Directories are
+// added before any content, once their final times are known.
+type archiveWriter interface {
+	addDir(hdr *fileHeader) error
+	addFile(hdr *fileHeader, content io.Reader) error
+	addSymlink(hdr *fileHeader, target string) error
+	Close() error
+}
+
+func newArchiveWriter(out io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case ArchiveTar, "":
+		return &tarArchive{tar.NewWriter(out)}, nil
+	case ArchiveZip:
+		return &zipArchive{zip.NewWriter(out)}, nil
+	}
+	return nil, fmt.Errorf("unsupported archive format %q", format)
+}
+
+func headerMtime(hdr *fileHeader) time.Time {
+	return time.Unix(int64(hdr.Data.Mtime), int64(hdr.Data.MtimeNsec))
+}
+
+type tarArchive struct {
+	w *tar.Writer
+}
+
+func (a *tarArchive) header(hdr *fileHeader, typ byte, size int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: typ,
+		Name:     hdr.path,
+		Mode:     int64(hdr.Data.Mode & 07777),
+		Size:     size,
+		ModTime:  headerMtime(hdr),
+		Format:   tar.FormatPAX, // for the nanoseconds
+	}
+}
+
+func (a *tarArchive) addDir(hdr *fileHeader) error {
+	h := a.header(hdr, tar.TypeDir, 0)
+	h.Name += "/"
+	return a.w.WriteHeader(h)
+}
+
+func (a *tarArchive) addFile(hdr *fileHeader, content io.Reader) error {
+	if err := a.w.WriteHeader(a.header(hdr, tar.TypeReg, int64(hdr.Data.FileLen))); err != nil {
+		return err
+	}
+	_, err := io.CopyN(a.w, content, int64(hdr.Data.FileLen))
+	return err
+}
+
+func (a *tarArchive) addSymlink(hdr *fileHeader, target string) error {
+	h := a.header(hdr, tar.TypeSymlink, 0)
+	h.Linkname = target
+	return a.w.WriteHeader(h)
+}
+
+func (a *tarArchive) Close() error {
+	return a.w.Close()
+}
+
+type zipArchive struct {
+	w *zip.Writer
+}
+
+func (a *zipArchive) create(hdr *fileHeader, name string) (io.Writer, error) {
+	h := &zip.FileHeader{
+		Name:     name,
+		Modified: headerMtime(hdr),
+		Method:   zip.Deflate,
+	}
+	h.SetMode(os.FileMode(hdr.Data.Mode))
+	if hdr.isDir() {
+		h.Method = zip.Store
+	}
+	return a.w.CreateHeader(h)
+}
+
+func (a *zipArchive) addDir(hdr *fileHeader) error {
+	_, err := a.create(hdr, hdr.path+"/")
+	return err
+}
+
+func (a *zipArchive) addFile(hdr *fileHeader, content io.Reader) error {
+	w, err := a.create(hdr, hdr.path)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, content, int64(hdr.Data.FileLen))
+	return err
+}
+
+func (a *zipArchive) addSymlink(hdr *fileHeader, target string) error {
+	// Like Info-ZIP, the target is the content
+	w, err := a.create(hdr, hdr.path)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, target)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.w.Close()
+}
+
+// archiveMetadata handles the metadata of an item, when receiving into an
+// archive. Everything is requested.
+func (r *Receiver) archiveMetadata(hdr *fileHeader) error {
+	local := *hdr
+	local.path = r.localPath(hdr.path)
+	if hdr.isDir() {
+		if r.visitDir(hdr.path) {
+			r.archiveDirs = append(r.archiveDirs, &local)
+			r.archiveDirIndex[hdr.path] = len(r.archiveDirs) - 1
+		} else {
+			// Second visit, with the final times
+			r.archiveDirs[r.archiveDirIndex[hdr.path]] = &local
+		}
+		return nil
+	}
+	defer func() { r.index++ }()
+	r.items = append(r.items, hdr)
+	if err := r.countBytes(hdr.Data.FileLen, false); err != nil {
+		return err
+	}
+	r.request(r.index)
+	return nil
+}
+
+// writeArchiveDirs adds the directories to the archive, before the content.
+func (r *Receiver) writeArchiveDirs() error {
+	for _, dir := range r.archiveDirs {
+		if err := r.archive.addDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveFullData writes the content of a file or symlink into the archive.
+//
+// OBS: Content can't be taken back out of the archive, so a file which fails
+// the signature check is already in it. The sync fails, and the archive must
+// then be discarded.
+func (r *Receiver) archiveFullData(hdr *fileHeader) error {
+	if err := r.countBytes(hdr.Data.FileLen, true); err != nil {
+		return err
+	}
+	local := *hdr
+	local.path = r.localPath(hdr.path)
+	digest := sha256.New()
+	if hdr.isSymlink() {
+		if hdr.Data.FileLen > MaxPathLength-1 {
+			return fmt.Errorf("symlink link-name too long (%d characters)", hdr.Data.FileLen)
+		}
+		buf := make([]byte, hdr.Data.FileLen)
+		if _, err := io.ReadFull(r.in, buf); err != nil {
+			return fmt.Errorf("symlink content read err: %v", err)
+		}
+		if err := r.checkDigest(hdr, sha256Sum(buf)); err != nil {
+			return err
+		}
+		return r.archive.addSymlink(&local, string(buf))
+	}
+	if err := r.archive.addFile(&local, io.TeeReader(r.in, digest)); err != nil {
+		return err
+	}
+	return r.checkDigest(hdr, digest.Sum(nil))
+}
+
+// Archive is a tar or zip archive, opened as the source of a sync, see
+// NewArchiveSender. It is read in place, so it must not change while open.
+type Archive struct {
+	src *archiveSource
+	f   *os.File
+}
+
+// OpenArchive opens the archive at path (zip if named .zip, tar otherwise).
+// If name is given, the content of the archive is placed in a directory of
+// that name.
+func OpenArchive(path, name string) (*Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	src := &archiveSource{
+		items: make(map[string]*archiveItem),
+		dirs:  make(map[string][]os.FileInfo),
+		mtime: stat.ModTime(),
+		name:  name,
+	}
+	if name != "" {
+		if err := checkStoreSource(name); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("invalid directory name %q", name)
+		}
+		src.add(name, &archiveItem{mode: os.ModeDir | 0755, mtime: src.mtime})
+	}
+	if ArchiveFormat(path) == ArchiveZip {
+		err = src.loadZip(f, stat.Size())
+	} else {
+		err = src.loadTar(f, stat.Size())
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading %v failed: %v", path, err)
+	}
+	src.index()
+	return &Archive{src: src, f: f}, nil
+}
+
+// Close closes the archive.
+func (a *Archive) Close() error {
+	return a.f.Close()
+}
+
+// NewArchiveSender creates a sender which sends the content of the archive,
+// as if it were a directory: Sync is given a top-level directory of the
+// archive, or "" if there's only one.
+func NewArchiveSender(out io.Writer, in io.Reader, a *Archive, opts *Options) (*Sender, error) {
+	if opts != nil && opts.Owners {
+		return nil, fmt.Errorf("an archive doesn't record the owners of its items")
+	}
+	s, err := NewSender(out, in, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.src = a.src
+	return s, nil
+}
+
+// archiveItem is an item of an archive. It is the os.FileInfo of the item, as
+// far as the sender is concerned.
+type archiveItem struct {
+	name   string
+	mode   os.FileMode
+	size   int64
+	mtime  time.Time
+	target string                        // of symlinks
+	open   func() (io.ReadCloser, error) // the content of files
+}
+
+func (i *archiveItem) Name() string       { return i.name }
+func (i *archiveItem) Size() int64        { return i.size }
+func (i *archiveItem) Mode() os.FileMode  { return i.mode }
+func (i *archiveItem) ModTime() time.Time { return i.mtime }
+func (i *archiveItem) IsDir() bool        { return i.mode.IsDir() }
+
+// Sys returns what newFileHeaderFromStat needs.
+func (i *archiveItem) Sys() interface{} {
+	ts := syscall.NsecToTimespec(i.mtime.UnixNano())
+	return &syscall.Stat_t{Size: i.size, Mtim: ts, Atim: ts}
+}
+
+// archiveSource reads the tree from an archive.
+type archiveSource struct {
+	items map[string]*archiveItem  // by path
+	dirs  map[string][]os.FileInfo // the items in each directory, by name
+	mtime time.Time                // of directories which aren't in the archive
+	name  string                   // directory the content is placed in, if any
+}
+
+// add adds an item, and the directories leading to it, unless they are in
+// the archive too. A later item replaces an earlier one, as with tar.
+func (a *archiveSource) add(path string, item *archiveItem) error {
+	path = strings.TrimSuffix(strings.TrimPrefix(path, "./"), "/")
+	if path == "" || path == "." {
+		return nil
+	}
+	if a.name != "" && path != a.name {
+		path = a.name + "/" + path
+	}
+	if err := checkPullPath(path); err != nil {
+		return err
+	}
+	if prev, ok := a.items[path]; ok && prev.IsDir() && !item.IsDir() {
+		return fmt.Errorf("%v is both a directory and a file", path)
+	}
+	item.name = filepath.Base(path)
+	a.items[path] = item
+	for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+		if prev, ok := a.items[dir]; ok {
+			if !prev.IsDir() {
+				return fmt.Errorf("%v is both a directory and a file", dir)
+			}
+			continue
+		}
+		a.items[dir] = &archiveItem{name: filepath.Base(dir), mode: os.ModeDir | 0755, mtime: a.mtime}
+	}
+	return nil
+}
+
+// index lists the items in each directory.
+func (a *archiveSource) index() {
+	for path, item := range a.items {
+		dir := filepath.Dir(path)
+		a.dirs[dir] = append(a.dirs[dir], item)
+	}
+	for _, items := range a.dirs {
+		sort.Slice(items, func(i, j int) bool { return items[i].Name() < items[j].Name() })
+	}
+}
+
+func (a *archiveSource) loadTar(f *os.File, size int64) error {
+	sr := io.NewSectionReader(f, 0, size)
+	tr := tar.NewReader(sr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		item := &archiveItem{mode: h.FileInfo().Mode(), size: h.Size, mtime: h.ModTime}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			item.size = 0
+		case tar.TypeSymlink:
+			item.target, item.size = h.Linkname, int64(len(h.Linkname))
+		case tar.TypeReg:
+			for key := range h.PAXRecords {
+				if strings.HasPrefix(key, "GNU.sparse.") {
+					return fmt.Errorf("sparse file %v is not supported", h.Name)
+				}
+			}
+			// The reader is now at the content, which is read in place
+			offset, err := sr.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			n := h.Size
+			item.open = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(io.NewSectionReader(f, offset, n)), nil
+			}
+		case tar.TypeLink:
+			target := strings.TrimSuffix(strings.TrimPrefix(h.Linkname, "./"), "/")
+			if a.name != "" {
+				target = a.name + "/" + target
+			}
+			orig, ok := a.items[target]
+			if !ok || !orig.mode.IsRegular() {
+				return fmt.Errorf("hard link %v to unknown file %v", h.Name, h.Linkname)
+			}
+			copy := *orig
+			item = &copy
+		case tar.TypeGNUSparse:
+			return fmt.Errorf("sparse file %v is not supported", h.Name)
+		default:
+			// Devices, fifos and the like can't be synced
+			continue
+		}
+		if err := a.add(h.Name, item); err != nil {
+			return err
+		}
+	}
+}
+
+func (a *archiveSource) loadZip(f *os.File, size int64) error {
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		zf := zf
+		item := &archiveItem{mode: zf.Mode(), size: int64(zf.UncompressedSize64), mtime: zf.Modified}
+		switch {
+		case item.mode.IsDir():
+			item.size = 0
+		case item.mode&os.ModeSymlink != 0:
+			// Like Info-ZIP, the target is the content
+			if zf.UncompressedSize64 > MaxPathLength-1 {
+				return fmt.Errorf("symlink %v too long", zf.Name)
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			target, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			item.target = string(target)
+		case item.mode.IsRegular():
+			item.open = func() (io.ReadCloser, error) { return zf.Open() }
+		default:
+			continue
+		}
+		if err := a.add(zf.Name, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *archiveSource) resolve(dir string) (string, string, error) {
+	if dir == "" {
+		top := a.dirs["."]
+		if len(top) != 1 || !top[0].IsDir() {
+			return "", "", fmt.Errorf("archive has %d top-level items, the directory to sync must be given", len(top))
+		}
+		return "", top[0].Name(), nil
+	}
+	if item, ok := a.items[dir]; !ok || !item.IsDir() || strings.Contains(dir, "/") {
+		return "", "", fmt.Errorf("%v is not a top-level directory of the archive", dir)
+	}
+	return "", dir, nil
+}
+
+func (a *archiveSource) item(path string) (*archiveItem, error) {
+	item, ok := a.items[path]
+	if !ok {
+		return nil, &os.PathError{Op: "lstat", Path: path, Err: os.ErrNotExist}
+	}
+	return item, nil
+}
+
+func (a *archiveSource) Lstat(path string) (os.FileInfo, error) {
+	return a.item(path)
+}
+
+func (a *archiveSource) ReadDir(path string) ([]os.FileInfo, error) {
+	return a.dirs[path], nil
+}
+
+func (a *archiveSource) Readlink(path string) (string, error) {
+	item, err := a.item(path)
+	if err != nil {
+		return "", err
+	}
+	return item.target, nil
+}
+
+func (a *archiveSource) Open(path string) (io.ReadCloser, error) {
+	item, err := a.item(path)
+	if err != nil {
+		return nil, err
+	}
+	if item.open == nil {
+		return nil, fmt.Errorf("%v is not a file", path)
+	}
+	return item.open()
+}
+
+// ApplyArchive syncs the directory dir of the archive (see
+// NewArchiveSender) to the current directory, with a receiver in this
+// process.
+func ApplyArchive(a *Archive, dir string, ropts *ReceiverOptions, opts *Options) error {
+	return applyLocal(ropts, func(out io.Writer, in io.Reader) error {
+		s, err := NewArchiveSender(out, in, a, opts)
+		if err != nil {
+			return err
+		}
+		return s.Sync(dir)
+	})
+}
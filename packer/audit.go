@@ -0,0 +1,116 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	auditFile = "audit.log"
+
+	// DefaultAuditLogSize is the size at which the audit log is rotated
+	DefaultAuditLogSize = 10 * 1024 * 1024
+	// auditLogKeep is the number of rotated logs kept around
+	auditLogKeep = 5
+)
+
+// Audit actions
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+	auditSkip   = "skip"
+	auditMkdir  = "mkdir"
+	auditLink   = "link"
+)
+
+// auditLog is an append-only log of every action the receiver takes on the
+// destination. Each line has the format
+//
+//	<timestamp> <action> <path> size=<size> crc32=<crc>
+//
+// A nil *auditLog is valid, and discards everything.
+type auditLog struct {
+	path    string
+	maxSize int64
+	size    int64
+	f       *os.File
+	mu      sync.Mutex // content is received while metadata is, see FlagOverlap
+}
+
+// openAuditLog opens (or creates) the audit log within the given root.
+func openAuditLog(root string, maxSize int64) (*auditLog, error) {
+	dir := filepath.Join(root, StateDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultAuditLogSize
+	}
+	a := &auditLog{
+		path:    filepath.Join(dir, auditFile),
+		maxSize: maxSize,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, info.Size()
+	return nil
+}
+
+// rotate shifts audit.log -> audit.log.1 -> audit.log.2 and so on, dropping
+// the oldest, and starts a fresh log.
+func (a *auditLog) rotate() error {
+	if err := a.f.Close(); err != nil {
+		return err
+	}
+	for i := auditLogKeep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%v.%d", a.path, i), fmt.Sprintf("%v.%d", a.path, i+1))
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// record writes one action to the log.
+func (a *auditLog) record(action, path string, size uint64, crc uint32) error {
+	if a == nil {
+		return nil
+	}
+	line := fmt.Sprintf("%v %v %q size=%d crc32=%08x\n",
+		time.Now().UTC().Format(time.RFC3339Nano), action, path, size, crc)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return fmt.Errorf("audit log rotation failed: %v", err)
+		}
+	}
+	n, err := a.f.WriteString(line)
+	a.size += int64(n)
+	return err
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.f.Close()
+}
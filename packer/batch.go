@@ -0,0 +1,314 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/snappy"
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+// A batch is the stream a sender produces, written to a file instead of
+// being sent to a receiver. Since there's no receiver to decide which files
+// are needed, the sender assumes that the destination is empty, or that it
+// matches a description made in advance (see DescribeDestination), and
+// includes everything else.
+//
+// The batch is later applied by ReplayBatch, which acts as the sender towards
+// a real receiver: it forwards the metadata, and then those items the
+// receiver requests. If the receiver requests something which isn't in the
+// batch, the destination has changed since it was described, and the replay
+// fails.
+// OBS: This is not part of the qvm-copy protocol.
+
+// batchReplies stands in for the receiver, towards a sender writing a batch.
+type batchReplies struct {
+	described manifest // nil if the destination is assumed to be empty
+	useCrc    bool
+	requests  []uint32
+	replies   *bytes.Buffer // generated once the metadata has been sent
+}
+
+// consider decides whether the item with the given index goes into the
+// batch, the same way a receiver with the described destination would.
+func (b *batchReplies) consider(index uint32, hdr *fileHeader) {
+	// The crc of symlinks is always zero in the metadata, so like the
+	// receiver, don't compare their targets.
+	if e, ok := b.described[hdr.path]; ok && sameMode(e.Mode, hdr.Data.Mode) && e.Size == hdr.Data.FileLen &&
+		e.Mtime == int64(hdr.Data.Mtime)*1e9+int64(hdr.Data.MtimeNsec) &&
+		(hdr.isSymlink() || !b.useCrc || e.Crc == hdr.Data.AtimeNsec) {
+		return
+	}
+	b.requests = append(b.requests, index)
+}
+
+// Read returns what the receiver would have replied: a result after the
+// metadata, the list of requested items, and a result after the data.
+func (b *batchReplies) Read(p []byte) (int, error) {
+	if b.replies == nil {
+		b.replies = new(bytes.Buffer)
+		(&resultHeader{}).marshallBinary(b.replies)
+		(&resultHeaderExt{}).marshallBinary(b.replies)
+		binary.Write(b.replies, binary.LittleEndian, uint32(len(b.requests)))
+		binary.Write(b.replies, binary.LittleEndian, b.requests)
+		(&resultHeader{}).marshallBinary(b.replies)
+		(&resultHeaderExt{}).marshallBinary(b.replies)
+	}
+	return b.replies.Read(p)
+}
+
+// NewBatchSender creates a sender which writes a batch to out. If
+// description is non-nil, it is read as a description of the destination
+// (see DescribeDestination), and only what differs from it is included.
+func NewBatchSender(out io.Writer, opts *Options, description io.Reader) (*Sender, error) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	if opts.Summary {
+		return nil, fmt.Errorf("a batch has no receiver to send a summary")
+	}
+	if opts.Streams > 1 {
+		return nil, fmt.Errorf("a batch is a single stream")
+	}
+	if opts.Overlap {
+		return nil, fmt.Errorf("a batch has no receiver to request files as it goes")
+	}
+	if opts.Pack {
+		return nil, fmt.Errorf("a batch can't be packed")
+	}
+	if opts.LazyHash {
+		return nil, fmt.Errorf("a batch has no receiver to ask for crcs")
+	}
+	if opts.Dedup {
+		return nil, fmt.Errorf("a batch can't send files as clones")
+	}
+	if opts.Digests {
+		return nil, fmt.Errorf("a batch can't carry digests of the content")
+	}
+	if opts.Inline > 0 {
+		return nil, fmt.Errorf("a batch can't inline files")
+	}
+	if opts.Owners {
+		return nil, fmt.Errorf("a batch can't carry the owners of the items")
+	}
+	if opts.VerifyTree {
+		return nil, fmt.Errorf("a batch can't be verified, it has no receiver")
+	}
+	if opts.Lenient {
+		return nil, fmt.Errorf("a batch can't be lenient, it has no receiver to report failures")
+	}
+	if opts.DiskFullDetails {
+		return nil, fmt.Errorf("a batch has no receiver to report running out of space")
+	}
+	if needed, err := checkSubtrees(opts.Subtrees); err != nil || needed {
+		// Excludes are fine, they are applied while writing it
+		return nil, fmt.Errorf("a batch can't carry subtree options for the receiver")
+	}
+	b := &batchReplies{useCrc: opts.CrcUsage != FileCrcOff}
+	if description != nil {
+		var entries []*ManifestEntry
+		if err := json.NewDecoder(description).Decode(&entries); err != nil {
+			return nil, fmt.Errorf("invalid destination description: %v", err)
+		}
+		b.described = make(manifest)
+		for _, e := range entries {
+			b.described[e.Path] = e
+		}
+	}
+	s, err := NewSender(out, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	// The replies are not compressed, since they're never transferred
+	s.in, s.batch = b, b
+	return s, nil
+}
+
+// DescribeDestination writes a description of the directory root, which
+// NewBatchSender can use to only include what differs.
+func DescribeDestination(out io.Writer, root string) error {
+	m, err := scanManifest(root)
+	if err != nil {
+		return err
+	}
+	entries := make([]*ManifestEntry, 0, len(m))
+	for _, p := range m.sortedPaths() {
+		entries = append(entries, m[p])
+	}
+	return json.NewEncoder(out).Encode(entries)
+}
+
+// ReplayBatch reads a batch, and acts as the sender towards the receiver
+// connected via out and in.
+func ReplayBatch(batch io.Reader, out io.Writer, in io.Reader, verbosity int) error {
+	var v versionHeader
+	if err := binary.Read(batch, binary.LittleEndian, &v); err != nil {
+		return fmt.Errorf("invalid batch: %v", err)
+	}
+	if v.Ones != 0xFFFFFFFF || v.Version != Version {
+		return fmt.Errorf("invalid batch: unsupported version %d", v.Version)
+	}
+	switch v.Compression {
+	case CompressionOff:
+	case CompressionSnappy:
+		batch = snappy.NewReader(batch)
+	default:
+		return fmt.Errorf("invalid batch: unsupported compression format %d", v.Compression)
+	}
+	bout := bufio.NewWriter(out)
+	// The receiver is local, so there's no point in compressing
+	rv := newVersionHeader(CompressionOff, int(v.FileCrcUsage), verbosity)
+	rv.Flags = v.Flags & FlagSigned
+	if err := rv.marshallBinary(bout); err != nil {
+		return err
+	}
+	// Phase 0: forward the metadata, and number the items like the sender did
+	index := make(map[string]uint32)
+	for {
+		hdr, err := unMarshallBinary(batch)
+		if err != nil {
+			return fmt.Errorf("invalid batch: %v", err)
+		}
+		if hdr.Data.NameLen == 0 {
+			break
+		}
+		if err := hdr.marshallBinary(bout); err != nil {
+			return err
+		}
+		if hdr.isRegular() || hdr.isSymlink() {
+			index[hdr.path] = uint32(len(index))
+		}
+	}
+	if _, err := bout.Write(make([]byte, 32)); err != nil {
+		return err
+	}
+	if rv.Flags&FlagSigned != 0 {
+		// Forward the signature block, for the receiver to verify
+		if _, err := io.CopyN(bout, batch, int64(len(index)*sha256.Size+ed25519.SignatureSize)); err != nil {
+			return fmt.Errorf("invalid batch: %v", err)
+		}
+	}
+	if err := bout.Flush(); err != nil {
+		return err
+	}
+	if err := replayResult(in, verbosity); err != nil {
+		return err
+	}
+	requests, err := readRequests(in, uint32(len(index)))
+	if err != nil {
+		return err
+	}
+	if verbosity >= 3 {
+		log.Printf("Receiver requested %d items", len(requests))
+	}
+	// The items in the batch are in index order, and so are the requests
+	var next *fileHeader
+	for _, want := range requests {
+		for {
+			if next == nil {
+				hdr, err := unMarshallBinary(batch)
+				if err == io.EOF {
+					return fmt.Errorf("item %d not in batch, destination does not match", want)
+				}
+				if err != nil {
+					return fmt.Errorf("invalid batch: %v", err)
+				}
+				if _, ok := index[hdr.path]; !ok {
+					return fmt.Errorf("invalid batch: unexpected item %v", hdr.path)
+				}
+				next = hdr
+			}
+			if index[next.path] >= want {
+				break
+			}
+			// Not requested, skip it
+			if _, err := io.CopyN(ioutil.Discard, batch, int64(next.Data.FileLen)); err != nil {
+				return fmt.Errorf("invalid batch: %v", err)
+			}
+			next = nil
+		}
+		if index[next.path] != want {
+			return fmt.Errorf("item %d not in batch, destination does not match", want)
+		}
+		if verbosity >= 4 {
+			log.Printf("Sending file %v", next.path)
+		}
+		if err := next.marshallBinary(bout); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(bout, batch, int64(next.Data.FileLen)); err != nil {
+			return fmt.Errorf("invalid batch: %v", err)
+		}
+		next = nil
+	}
+	if err := bout.Flush(); err != nil {
+		return err
+	}
+	return replayResult(in, verbosity)
+}
+
+func replayResult(in io.Reader, verbosity int) error {
+	var (
+		hdr    resultHeader
+		hdrExt resultHeaderExt
+	)
+	if err := hdr.unMarshallBinary(in); err != nil {
+		return err
+	}
+	if err := hdrExt.unMarshallBinary(in); err != nil {
+		return err
+	}
+	if hdr.ErrorCode != 0 {
+		return &RemoteError{Code: ErrorCode(hdr.ErrorCode), LastName: hdrExt.LastName}
+	}
+	if verbosity >= 3 {
+		log.Printf("Got result ACK, last file %v", hdrExt.LastName)
+	}
+	return nil
+}
+
+// ApplyBatch applies a batch to the current directory, with a receiver in
+// this process.
+// OBS: The receiver is normally jailed, and relies on that for its safety. A
+// batch from an untrusted source should rather be replayed towards a jailed
+// receiver.
+func ApplyBatch(batch io.Reader, ropts *ReceiverOptions, verbosity int) error {
+	return applyLocal(ropts, func(out io.Writer, in io.Reader) error {
+		return ReplayBatch(batch, out, in, verbosity)
+	})
+}
+
+// applyLocal runs send against a receiver in this process.
+func applyLocal(ropts *ReceiverOptions, send func(out io.Writer, in io.Reader) error) error {
+	toReceiver, replayOut := io.Pipe()
+	replayIn, fromReceiver := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		r, err := NewReceiver(toReceiver, fromReceiver, ropts)
+		if err == nil {
+			err = r.Sync()
+		}
+		if err != nil {
+			fromReceiver.CloseWithError(err)
+			// Unblock the replay, if it's still writing
+			toReceiver.CloseWithError(err)
+		}
+		errc <- err
+	}()
+	err := send(replayOut, replayIn)
+	if err != nil {
+		replayOut.CloseWithError(err)
+		// Unblock the receiver, if it's reporting a failure
+		replayIn.CloseWithError(err)
+	}
+	if rErr := <-errc; rErr != nil {
+		return rErr
+	}
+	return err
+}
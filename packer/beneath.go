@@ -0,0 +1,550 @@
+package packer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// During a sync, the receiver holds its root open, and reaches the items below
+// it through that descriptor rather than by path (see rootDir). The directory
+// an item is in is opened without following a symlink on the way, and the item
+// is then handled relative to it with the *at(2) calls, which don't follow a
+// symlink in its place either. Neither a sequence of items crafted by the
+// sender, nor a local process swapping a directory for a symlink between a
+// check and its use, can make the receiver write outside of its root. With
+// openat2(2) (Linux 5.6), the kernel resolves the directory in one go, with
+// RESOLVE_BENEATH and RESOLVE_NO_SYMLINKS. Otherwise, it's opened a component
+// at a time, with O_NOFOLLOW.
+
+const (
+	oPath             = unix.O_PATH
+	atFdCwd           = unix.AT_FDCWD
+	atRemoveDir       = unix.AT_REMOVEDIR
+	resolveNoSymlinks = unix.RESOLVE_NO_SYMLINKS
+	resolveBeneath    = unix.RESOLVE_BENEATH
+)
+
+// noOpenat2 and noFchmodat2 are set (atomically) to 1 when the kernel doesn't
+// support the call.
+var noOpenat2, noFchmodat2 int32
+
+// fchmodat2 is unix.Fchmodat, which uses fchmodat2(2) with flags. It's a
+// variable for the tests.
+var fchmodat2 = unix.Fchmodat
+
+// rootDir is the root of a receiver, held open. Its methods are those of the
+// os package, for paths below the root, as returned by Receiver.local (or
+// absolute). A nil rootDir uses the os package.
+type rootDir struct {
+	fd   int
+	path string // the root, as given
+	abs  string // the root, absolute
+}
+
+// openRootDir opens the directory at path, the current one if it's empty. It
+// may itself be a symlink.
+func openRootDir(path string) (*rootDir, error) {
+	if path == "" {
+		path = "."
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Open(path, oPath|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return &rootDir{fd: fd, path: filepath.Clean(path), abs: abs}, nil
+}
+
+func (d *rootDir) Close() error {
+	if d == nil {
+		return nil
+	}
+	return syscall.Close(d.fd)
+}
+
+// rel returns path relative to the root, if it's below it.
+func (d *rootDir) rel(path string) (string, error) {
+	root := d.path
+	if filepath.IsAbs(path) != filepath.IsAbs(root) {
+		root = d.abs
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%v is not below %v", path, d.path)
+	}
+	return rel, nil
+}
+
+// at opens the directory which the item at path is in, and returns it, with
+// the name of the item in it. The directory is to be released when done.
+func (d *rootDir) at(path string) (int, string, error) {
+	rel, err := d.rel(path)
+	if err != nil {
+		return -1, "", err
+	}
+	dir, name := filepath.Split(rel)
+	if dir == "" {
+		return d.fd, name, nil
+	}
+	dir = filepath.Clean(dir)
+	if atomic.LoadInt32(&noOpenat2) == 0 {
+		fd, err := openat2(d.fd, dir, &unix.OpenHow{
+			Flags:   oPath | syscall.O_DIRECTORY | syscall.O_CLOEXEC,
+			Resolve: resolveBeneath | resolveNoSymlinks,
+		})
+		if err == nil {
+			return fd, name, nil
+		}
+		// Seccomp filters may refuse calls they don't know with EPERM
+		if err != syscall.ENOSYS && err != syscall.EPERM {
+			return -1, "", &os.PathError{Op: "openat2", Path: path, Err: err}
+		}
+		atomic.StoreInt32(&noOpenat2, 1)
+	}
+	fd := d.fd
+	for _, part := range strings.Split(dir, "/") {
+		if part == ".." {
+			d.release(fd)
+			return -1, "", fmt.Errorf("%v is not below %v", path, d.path)
+		}
+		next, err := syscall.Openat(fd, part, oPath|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		d.release(fd)
+		if err != nil {
+			return -1, "", &os.PathError{Op: "openat", Path: path, Err: err}
+		}
+		fd = next
+	}
+	return fd, name, nil
+}
+
+// release closes a directory returned by at, unless it's the root.
+func (d *rootDir) release(fd int) {
+	if fd != d.fd {
+		syscall.Close(fd)
+	}
+}
+
+func openat2(dirfd int, path string, how *unix.OpenHow) (int, error) {
+	for {
+		fd, err := unix.Openat2(dirfd, path, how)
+		// EAGAIN: a rename raced with RESOLVE_BENEATH
+		if err == unix.EINTR || err == unix.EAGAIN {
+			continue
+		}
+		return fd, err
+	}
+}
+
+func (d *rootDir) Lstat(path string) (os.FileInfo, error) {
+	if d == nil {
+		return os.Lstat(path)
+	}
+	dirfd, name, err := d.at(path)
+	if err != nil {
+		return nil, err
+	}
+	defer d.release(dirfd)
+	info := &direntInfo{name: filepath.Base(path)}
+	if err := fstatat(dirfd, name, &info.st); err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+	return info, nil
+}
+
+// fstatat fills in st for the entry name of the directory dirfd, without
+// following symlinks.
+func fstatat(dirfd int, name string, st *syscall.Stat_t) error {
+	var ust unix.Stat_t
+	if err := unix.Fstatat(dirfd, name, &ust, atSymlinkNoFollow); err != nil {
+		return err
+	}
+	*st = syscall.Stat_t{
+		Dev:     ust.Dev,
+		Ino:     ust.Ino,
+		Nlink:   ust.Nlink,
+		Mode:    ust.Mode,
+		Uid:     ust.Uid,
+		Gid:     ust.Gid,
+		Rdev:    ust.Rdev,
+		Size:    ust.Size,
+		Blksize: ust.Blksize,
+		Blocks:  ust.Blocks,
+		Atim:    syscall.Timespec(ust.Atim),
+		Mtim:    syscall.Timespec(ust.Mtim),
+		Ctim:    syscall.Timespec(ust.Ctim),
+	}
+	return nil
+}
+
+func (d *rootDir) Open(path string) (*os.File, error) {
+	return d.OpenFile(path, os.O_RDONLY, 0)
+}
+
+// OpenFile is os.OpenFile, but a symlink at path isn't followed.
+func (d *rootDir) OpenFile(path string, flag int, perm os.FileMode) (*os.File, error) {
+	if d == nil {
+		return os.OpenFile(path, flag, perm)
+	}
+	dirfd, name, err := d.at(path)
+	if err != nil {
+		return nil, err
+	}
+	defer d.release(dirfd)
+	fd, err := syscall.Openat(dirfd, name, flag|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, syscallMode(perm))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// TempFile is ioutil.TempFile.
+func (d *rootDir) TempFile(dir, pattern string) (*os.File, error) {
+	if d == nil {
+		return ioutil.TempFile(dir, pattern)
+	}
+	for i := 0; ; i++ {
+		name := strings.Replace(pattern, "*", strconv.FormatUint(uint64(rand.Uint32()), 10), 1)
+		f, err := d.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) && i < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+func (d *rootDir) Mkdir(path string, perm os.FileMode) error {
+	if d == nil {
+		return os.Mkdir(path, perm)
+	}
+	dirfd, name, err := d.at(path)
+	if err != nil {
+		return err
+	}
+	defer d.release(dirfd)
+	if err := syscall.Mkdirat(dirfd, name, syscallMode(perm)); err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	return nil
+}
+
+// MkdirAll is os.MkdirAll, below the root: a symlink on the way isn't
+// followed, that fails.
+func (d *rootDir) MkdirAll(path string, perm os.FileMode) error {
+	if d == nil {
+		return os.MkdirAll(path, perm)
+	}
+	rel, err := d.rel(path)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	dir := d.path
+	for _, part := range strings.Split(rel, "/") {
+		dir = filepath.Join(dir, part)
+		err := d.Mkdir(dir, perm)
+		if err == nil {
+			continue
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		info, err := d.Lstat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+	}
+	return nil
+}
+
+// Chmod is os.Chmod, but a symlink at path isn't followed: that fails.
+// Without fchmodat2(2) (Linux 6.6), or if a seccomp filter refuses it, that's
+// only checked beforehand.
+func (d *rootDir) Chmod(path string, mode os.FileMode) error {
+	if d == nil {
+		return os.Chmod(path, mode)
+	}
+	dirfd, name, err := d.at(path)
+	if err != nil {
+		return err
+	}
+	defer d.release(dirfd)
+	tried := false
+	if atomic.LoadInt32(&noFchmodat2) == 0 {
+		err := fchmodat2(dirfd, name, syscallMode(mode), atSymlinkNoFollow)
+		if err == nil {
+			return nil
+		}
+		// EOPNOTSUPP both for a symlink, and without fchmodat2, which is told
+		// apart below. Seccomp filters may refuse calls they don't know with
+		// EPERM, as for openat2 in at, which fchmodat then tells apart from
+		// lacking permission.
+		if err != unix.EOPNOTSUPP && err != unix.EPERM && err != unix.ENOSYS {
+			return &os.PathError{Op: "chmod", Path: path, Err: err}
+		}
+		tried = true
+	}
+	var st syscall.Stat_t
+	if err := fstatat(dirfd, name, &st); err != nil {
+		return &os.PathError{Op: "chmod", Path: path, Err: err}
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		return &os.PathError{Op: "chmod", Path: path, Err: syscall.ELOOP}
+	}
+	if err := syscall.Fchmodat(dirfd, name, syscallMode(mode), 0); err != nil {
+		return &os.PathError{Op: "chmod", Path: path, Err: err}
+	}
+	if tried {
+		// fchmodat2 refused what fchmodat didn't
+		atomic.StoreInt32(&noFchmodat2, 1)
+	}
+	return nil
+}
+
+// Lchown is os.Lchown: a symlink at path gets the owner itself.
+func (d *rootDir) Lchown(path string, uid, gid int) error {
+	if d == nil {
+		return os.Lchown(path, uid, gid)
+	}
+	dirfd, name, err := d.at(path)
+	if err != nil {
+		return err
+	}
+	defer d.release(dirfd)
+	if err := syscall.Fchownat(dirfd, name, uid, gid, atSymlinkNoFollow); err != nil {
+		return &os.PathError{Op: "lchown", Path: path, Err: err}
+	}
+	return nil
+}
+
+// Chtimes is os.Chtimes, but a symlink at path isn't followed.
+func (d *rootDir) Chtimes(path string, atime, mtime time.Time) error {
+	if d == nil {
+		return utimensat(atFdCwd, path, path, atime, mtime)
+	}
+	dirfd, name, err := d.at(path)
+	if err != nil {
+		return err
+	}
+	defer d.release(dirfd)
+	return utimensat(dirfd, name, path, atime, mtime)
+}
+
+// utimensat sets the times of name in dirfd, without following a symlink,
+// which os.Chtimes can't do (see https://github.com/golang/go/issues/3951).
+func utimensat(dirfd int, name, path string, atime, mtime time.Time) error {
+	times := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(mtime.UnixNano()),
+	}
+	if err := unix.UtimesNanoAt(dirfd, name, times, atSymlinkNoFollow); err != nil {
+		return &os.PathError{Op: "chtimes", Path: path, Err: err}
+	}
+	return nil
+}
+
+// Link is os.Link. The existing file may be outside of the root (see
+// ReceiverOptions.LinkDest), in which case its path is resolved as usual.
+func (d *rootDir) Link(oldpath, newpath string) error {
+	if d == nil {
+		return os.Link(oldpath, newpath)
+	}
+	olddirfd, oldname := atFdCwd, oldpath
+	if _, err := d.rel(oldpath); err == nil {
+		fd, name, err := d.at(oldpath)
+		if err != nil {
+			return err
+		}
+		defer d.release(fd)
+		olddirfd, oldname = fd, name
+	}
+	newdirfd, newname, err := d.at(newpath)
+	if err != nil {
+		return err
+	}
+	defer d.release(newdirfd)
+	if err := unix.Linkat(olddirfd, oldname, newdirfd, newname, 0); err != nil {
+		return &os.LinkError{Op: "link", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
+
+// Rename is os.Rename. With exchange, newpath has to exist, and the two are
+// swapped atomically, with renameat2(2) (Linux 3.15), which fails with EINVAL
+// on filesystems which can't.
+func (d *rootDir) Rename(oldpath, newpath string, exchange bool) error {
+	olddirfd, oldname, newdirfd, newname := atFdCwd, oldpath, atFdCwd, newpath
+	if d != nil {
+		fd, name, err := d.at(oldpath)
+		if err != nil {
+			return err
+		}
+		defer d.release(fd)
+		olddirfd, oldname = fd, name
+		if fd, name, err = d.at(newpath); err != nil {
+			return err
+		}
+		defer d.release(fd)
+		newdirfd, newname = fd, name
+	}
+	var err error
+	if exchange {
+		err = unix.Renameat2(olddirfd, oldname, newdirfd, newname, unix.RENAME_EXCHANGE)
+	} else {
+		err = syscall.Renameat(olddirfd, oldname, newdirfd, newname)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
+
+// Symlink is os.Symlink.
+func (d *rootDir) Symlink(target, path string) error {
+	if d == nil {
+		return os.Symlink(target, path)
+	}
+	dirfd, name, err := d.at(path)
+	if err != nil {
+		return err
+	}
+	defer d.release(dirfd)
+	if err := unix.Symlinkat(target, dirfd, name); err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: path, Err: err}
+	}
+	return nil
+}
+
+// Readlink is os.Readlink.
+func (d *rootDir) Readlink(path string) (string, error) {
+	if d == nil {
+		return os.Readlink(path)
+	}
+	dirfd, name, err := d.at(path)
+	if err != nil {
+		return "", err
+	}
+	defer d.release(dirfd)
+	for size := 128; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(dirfd, name, buf)
+		if err != nil {
+			return "", &os.PathError{Op: "readlink", Path: path, Err: err}
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// Remove is os.Remove.
+func (d *rootDir) Remove(path string) error {
+	if d == nil {
+		return os.Remove(path)
+	}
+	dirfd, name, err := d.at(path)
+	if err != nil {
+		return err
+	}
+	defer d.release(dirfd)
+	err = unix.Unlinkat(dirfd, name, 0)
+	if err == nil {
+		return nil
+	}
+	if dErr := unix.Unlinkat(dirfd, name, atRemoveDir); dErr == nil {
+		return nil
+	} else if dErr != syscall.ENOTDIR {
+		err = dErr
+	}
+	return &os.PathError{Op: "remove", Path: path, Err: err}
+}
+
+// RemoveAll is os.RemoveAll: what's in a directory is removed through it, so
+// a symlink which takes the place of a directory on the way is removed, but
+// not followed.
+func (d *rootDir) RemoveAll(path string) error {
+	if d == nil {
+		return os.RemoveAll(path)
+	}
+	rmErr := d.Remove(path)
+	if rmErr == nil || os.IsNotExist(rmErr) {
+		return nil
+	}
+	dir, err := d.OpenFile(path, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		// Not a directory, or one which can't be listed
+		return rmErr
+	}
+	names, err := readNames(int(dir.Fd()))
+	dir.Close()
+	if err != nil {
+		return &os.PathError{Op: "readdirent", Path: path, Err: err}
+	}
+	for _, name := range names {
+		if err := d.RemoveAll(filepath.Join(path, name)); err != nil {
+			return err
+		}
+	}
+	if err := d.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// RemoveIfExist is RemoveIfExist, below the root.
+func (d *rootDir) RemoveIfExist(path string) error {
+	if d == nil {
+		return RemoveIfExist(path)
+	}
+	info, err := d.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if os.IsPermission(err) {
+			if err := d.Chmod(path, 0700); err != nil {
+				return fmt.Errorf("failed changing perms: %v", err)
+			}
+			info, err = d.Lstat(path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if info.IsDir() {
+		return d.RemoveAll(path)
+	}
+	return d.Remove(path)
+}
+
+// syscallMode is the mode bits of mode, as the os package passes them.
+func syscallMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+	return m
+}
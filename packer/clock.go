@@ -0,0 +1,90 @@
+package packer
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"time"
+)
+
+// With FlagClock (see Options.ClockSkew), the sender sends its current time,
+// in nanoseconds since the epoch, right after the version header. The receiver
+// takes the difference to its own clock as the offset between the two, and,
+// with FlagSummary, sends it back ahead of the summary, so that the sender
+// judges the summary the way the receiver judges the metadata.
+//
+// The times of the files received are those of the sender, so the offset
+// doesn't matter for them. It does for local copies which got their times from
+// the receiver's clock instead, e.g. restored from a backup, or written by
+// another tool at the same time as on the sender: with a clock which drifted,
+// every one of them differs in its modification time. With the offset, a
+// modification time which is the sender's shifted by it, give or take
+// clockTolerance, is the same.
+// OBS: This is not part of the qvm-copy protocol.
+
+// clockTolerance is how far apart times may be, beyond the offset, to be the
+// same. It covers the time the sender's clock takes to get to the receiver.
+// An offset within it isn't taken to be systematic, and is ignored.
+const clockTolerance = 2 * time.Second
+
+// systematicOffset returns the offset, or zero if it's within clockTolerance.
+func systematicOffset(offset time.Duration) time.Duration {
+	if offset > -clockTolerance && offset < clockTolerance {
+		return 0
+	}
+	return offset
+}
+
+// sendClock sends the current time of the sender, see FlagClock.
+func sendClock(out io.Writer) error {
+	return binary.Write(out, binary.LittleEndian, time.Now().UnixNano())
+}
+
+// readClock reads the time of the sender, and returns the offset of its clock
+// to the local one.
+func readClock(in io.Reader) (time.Duration, error) {
+	var now int64
+	if err := binary.Read(in, binary.LittleEndian, &now); err != nil {
+		return 0, err
+	}
+	return time.Duration(now - time.Now().UnixNano()), nil
+}
+
+// sendClockOffset sends the offset of the sender's clock, ahead of the summary.
+func (r *Receiver) sendClockOffset() error {
+	if !r.clockSent {
+		return nil
+	}
+	return binary.Write(r.out, binary.LittleEndian, int64(r.clockOffset))
+}
+
+// readClockOffset reads the offset of the sender's clock, as the receiver
+// measured it, ahead of the summary.
+func (s *Sender) readClockOffset() error {
+	if !s.opts.ClockSkew {
+		return nil
+	}
+	var offset int64
+	if err := binary.Read(s.in, binary.LittleEndian, &offset); err != nil {
+		return err
+	}
+	s.clockOffset = systematicOffset(time.Duration(offset))
+	if s.clockOffset != 0 && s.opts.Verbosity >= 3 {
+		log.Printf("The receiver's clock is %v off", -s.clockOffset)
+	}
+	return nil
+}
+
+// sameMtime returns whether the modification time of hdr, a local item of the
+// receiver, is that of other, from the sender, given the offset of the
+// sender's clock.
+func (hdr *fileHeader) sameMtime(other *fileHeader, offset time.Duration) bool {
+	if hdr.Data.Mtime == other.Data.Mtime && hdr.Data.MtimeNsec == other.Data.MtimeNsec {
+		return true
+	}
+	if offset == 0 {
+		return false
+	}
+	d := headerMtime(other).Sub(headerMtime(hdr)) - offset
+	return d > -clockTolerance && d < clockTolerance
+}
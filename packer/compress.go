@@ -0,0 +1,161 @@
+package packer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// The snappy framing format is a stream identifier followed by chunks, each
+// of up to 64K of input, compressed on its own. A parallelSnappy compresses
+// the chunks on several goroutines, and writes them in order, which is the
+// same stream a snappy.Writer writes, and read by a snappy.Reader as usual.
+
+const (
+	snappyStreamID     = "\xff\x06\x00\x00sNaPpY"
+	snappyBlockSize    = 65536 // the most input of a chunk
+	snappyChunkHeader  = 8     // type, length and checksum
+	snappyCompressed   = 0x00
+	snappyUncompressed = 0x01
+)
+
+var snappyCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// parallelSnappy is a snappy writer which compresses on several goroutines,
+// see Options.Compressors.
+type parallelSnappy struct {
+	out      io.Writer
+	workers  int
+	block    *snappyBlock   // the block being filled
+	inflight []*snappyBlock // blocks being compressed, in order
+	free     []*snappyBlock // blocks written, to be reused
+	started  bool           // whether the stream identifier is written
+	err      error
+}
+
+// snappyBlock is a block of input, and the chunk it's compressed into.
+type snappyBlock struct {
+	data  []byte
+	chunk []byte
+	done  chan struct{}
+}
+
+func newParallelSnappy(out io.Writer, workers int) *parallelSnappy {
+	return &parallelSnappy{out: out, workers: workers}
+}
+
+func (w *parallelSnappy) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if w.err != nil {
+			return n, w.err
+		}
+		if w.block == nil {
+			w.block = w.newBlock()
+		}
+		m := copy(w.block.data[len(w.block.data):snappyBlockSize], p)
+		w.block.data = w.block.data[:len(w.block.data)+m]
+		n, p = n+m, p[m:]
+		if len(w.block.data) == snappyBlockSize {
+			w.dispatch()
+		}
+	}
+	return n, nil
+}
+
+// Flush writes what has been written so far, and flushes the underlying
+// writer, if it has a Flush method.
+func (w *parallelSnappy) Flush() error {
+	if w.block != nil && len(w.block.data) > 0 {
+		w.dispatch()
+	}
+	for len(w.inflight) > 0 && w.err == nil {
+		w.writeOldest()
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if f, ok := w.out.(BufferedWriter); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (w *parallelSnappy) newBlock() *snappyBlock {
+	if n := len(w.free); n > 0 {
+		b := w.free[n-1]
+		w.free = w.free[:n-1]
+		b.data, b.done = b.data[:0], make(chan struct{})
+		return b
+	}
+	return &snappyBlock{
+		data:  make([]byte, 0, snappyBlockSize),
+		chunk: make([]byte, snappyChunkHeader+snappy.MaxEncodedLen(snappyBlockSize)),
+		done:  make(chan struct{}),
+	}
+}
+
+// dispatch starts compressing the block being filled. With as many blocks in
+// flight as workers can keep busy, the oldest is written first.
+func (w *parallelSnappy) dispatch() {
+	if len(w.inflight) >= 2*w.workers {
+		w.writeOldest()
+	}
+	b := w.block
+	w.block = nil
+	w.inflight = append(w.inflight, b)
+	go b.compress()
+}
+
+// writeOldest waits for the oldest block in flight, and writes its chunk.
+func (w *parallelSnappy) writeOldest() {
+	b := w.inflight[0]
+	<-b.done
+	copy(w.inflight, w.inflight[1:])
+	w.inflight = w.inflight[:len(w.inflight)-1]
+	w.free = append(w.free, b)
+	if w.err != nil {
+		return
+	}
+	if !w.started {
+		if _, w.err = io.WriteString(w.out, snappyStreamID); w.err != nil {
+			return
+		}
+		w.started = true
+	}
+	_, w.err = w.out.Write(b.chunk)
+}
+
+// compress frames the data as a chunk, compressed unless that doesn't save
+// an eighth of it, like a snappy.Writer does.
+func (b *snappyBlock) compress() {
+	defer close(b.done)
+	chunk := b.chunk[:cap(b.chunk)]
+	body := snappy.Encode(chunk[snappyChunkHeader:], b.data)
+	chunkType := byte(snappyCompressed)
+	if len(body) >= len(b.data)-len(b.data)/8 {
+		chunkType = snappyUncompressed
+		body = append(chunk[snappyChunkHeader:snappyChunkHeader], b.data...)
+	}
+	length := len(body) + 4 // the checksum
+	chunk[0] = chunkType
+	chunk[1], chunk[2], chunk[3] = byte(length), byte(length>>8), byte(length>>16)
+	c := crc32.Update(0, snappyCrcTable, b.data)
+	binary.LittleEndian.PutUint32(chunk[4:], (c>>15|c<<17)+0xa282ead8)
+	b.chunk = chunk[:snappyChunkHeader+len(body)]
+}
+
+// newCompressingWriter is NewConfigurableWriter, with snappy, compressing on
+// the given number of goroutines.
+func newCompressingWriter(out io.Writer, compressors int) BufferedWriter {
+	snappyMeter := NewMeteredWriter(bufio.NewWriter(out))
+	rawMeter := NewMeteredWriter(newParallelSnappy(snappyMeter, compressors))
+	return &ConfigurableWriter{
+		out:             rawMeter,
+		compressedMeter: snappyMeter,
+		rawMeter:        rawMeter,
+	}
+}
@@ -0,0 +1,300 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// SystemConfigFile is the configuration of receivers (outside of the
+// preloader jail, which can't read it).
+const SystemConfigFile = "/etc/qvm-sync/config.toml"
+
+// UserConfigFile returns the configuration file of the user, used by the
+// sending side: ~/.config/qvm-sync/config.toml.
+func UserConfigFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "qvm-sync", "config.toml"), nil
+}
+
+// Config is the content of a configuration file: a set of named profiles.
+// A profile holds the settings of one kind of sync, e.g.
+//
+//	[profile.docs]
+//	path = "/home/user/docs"
+//	destination = "vault"
+//	excludes = ["*.tmp", "cache"]
+//	compression = "snappy"   # or "off"
+//	crc = "metadata"         # "off", "data" or "metadata"
+//
+//	[profile.docs.subtree."Photos"]
+//	crc = "off"
+//
+//	[profile.docs.subtree."Shared"]
+//	delete = false
+//	excludes = ["*.bak"]
+//
+//	[profile.default]
+//	max-depth = 64
+//	quota = 10000000000
+//
+// Senders use the path, destination, excludes, compression, crc and
+// subtrees (see Subtree), receivers the limits.
+type Config struct {
+	Profiles map[string]*Profile
+}
+
+// Profile is one profile of the configuration. Settings which are not
+// configured are left at their zero values, see Options and
+// ReceiverOptions for how they're applied.
+type Profile struct {
+	Name        string
+	Path        string   // directory to sync
+	Destination []string // where to sync to, as with qsync-send -to
+	Excludes    []string // see Options.Excludes
+	Compression *int
+	CrcUsage    *int
+	Subtrees    []*Subtree
+
+	MaxDepth      int
+	MaxDirEntries int
+	MaxRootSize   uint64
+	AuditLog      *bool
+}
+
+// LoadConfig reads the configuration file at path. The file is toml, with
+// the tables and keys of Config. Unknown keys are an error, rather than
+// settings which are silently ignored.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, err := parseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Profile returns the named profile, or an error if there's no such profile.
+func (c *Config) Profile(name string) (*Profile, error) {
+	p, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+	return p, nil
+}
+
+// Options returns a copy of base, with the settings of the profile applied.
+func (p *Profile) Options(base *Options) *Options {
+	opts := *base
+	if p.Compression != nil {
+		opts.Compression = *p.Compression
+	}
+	if p.CrcUsage != nil {
+		opts.CrcUsage = *p.CrcUsage
+	}
+	if len(p.Excludes) > 0 {
+		opts.Excludes = append(append([]string{}, base.Excludes...), p.Excludes...)
+	}
+	if len(p.Subtrees) > 0 {
+		opts.Subtrees = append(append([]*Subtree{}, base.Subtrees...), p.Subtrees...)
+	}
+	return &opts
+}
+
+// ReceiverOptions returns a copy of base, with the limits of the profile
+// applied.
+func (p *Profile) ReceiverOptions(base *ReceiverOptions) *ReceiverOptions {
+	ropts := *base
+	if p.MaxDepth != 0 {
+		ropts.MaxDepth = p.MaxDepth
+	}
+	if p.MaxDirEntries != 0 {
+		ropts.MaxDirEntries = p.MaxDirEntries
+	}
+	if p.MaxRootSize != 0 {
+		ropts.MaxRootSize = p.MaxRootSize
+	}
+	if p.AuditLog != nil {
+		ropts.AuditLog = *p.AuditLog
+	}
+	return &ropts
+}
+
+// configFile is the layout of the configuration file, which parseConfig
+// decodes it into, before it's checked.
+type configFile struct {
+	Profile map[string]*profileTable `toml:"profile"`
+}
+
+// profileTable is a [profile.<name>] table of the configuration file.
+type profileTable struct {
+	Path          string                   `toml:"path"`
+	Destination   interface{}              `toml:"destination"` // a string, or an array of them
+	Excludes      []string                 `toml:"excludes"`
+	Compression   *string                  `toml:"compression"`
+	Crc           *string                  `toml:"crc"`
+	MaxDepth      int                      `toml:"max-depth"`
+	MaxDirEntries int                      `toml:"max-dir-entries"`
+	Quota         int64                    `toml:"quota"`
+	Audit         *bool                    `toml:"audit"`
+	Subtree       map[string]*subtreeTable `toml:"subtree"`
+}
+
+// subtreeTable is a [profile.<name>.subtree.<path>] table of the
+// configuration file.
+type subtreeTable struct {
+	Excludes []string `toml:"excludes"`
+	Crc      *string  `toml:"crc"`
+	Delete   *bool    `toml:"delete"`
+}
+
+// parseConfig parses the configuration, see LoadConfig.
+func parseConfig(r io.Reader) (*Config, error) {
+	var file configFile
+	md, err := toml.NewDecoder(r).Decode(&file)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown key %v", undecoded[0])
+	}
+	// The tables in the order they appear, for that of the subtrees
+	var (
+		defined = make(map[string]bool)
+		cfg     = &Config{Profiles: make(map[string]*Profile)}
+	)
+	for _, key := range md.Keys() {
+		if len(key) == 2 && key[0] == "profile" {
+			defined[key[1]] = true
+		}
+	}
+	for name, t := range file.Profile {
+		if !defined[name] {
+			// Only given subtrees, or dotted keys
+			return nil, fmt.Errorf("profile %q isn't defined, expected [profile.%v]", name, name)
+		}
+		p, err := t.profile(name)
+		if err != nil {
+			return nil, fmt.Errorf("profile %v: %v", name, err)
+		}
+		cfg.Profiles[name] = p
+	}
+	for _, key := range md.Keys() {
+		if len(key) != 4 || key[0] != "profile" || key[2] != "subtree" {
+			continue
+		}
+		name := key[1]
+		st, err := file.Profile[name].Subtree[key[3]].subtree(key[3])
+		if err == nil {
+			err = cfg.Profiles[name].addSubtree(st)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("profile %v: %v", name, err)
+		}
+	}
+	return cfg, nil
+}
+
+// profile returns the profile configured by the table.
+func (t *profileTable) profile(name string) (*Profile, error) {
+	p := &Profile{
+		Name:          name,
+		Path:          t.Path,
+		Excludes:      t.Excludes,
+		MaxDepth:      t.MaxDepth,
+		MaxDirEntries: t.MaxDirEntries,
+		MaxRootSize:   uint64(t.Quota),
+		AuditLog:      t.Audit,
+	}
+	if t.Quota < 0 {
+		return nil, fmt.Errorf("quota: can't be negative")
+	}
+	switch d := t.Destination.(type) {
+	case nil:
+	case string:
+		p.Destination = []string{d}
+	case []interface{}:
+		for _, v := range d {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("destination: expected a string, or an array of strings")
+			}
+			p.Destination = append(p.Destination, s)
+		}
+	default:
+		return nil, fmt.Errorf("destination: expected a string, or an array of strings")
+	}
+	if err := checkPatterns(p.Excludes); err != nil {
+		return nil, fmt.Errorf("excludes: %v", err)
+	}
+	if t.Compression != nil {
+		c, ok := map[string]int{"off": CompressionOff, "snappy": CompressionSnappy}[*t.Compression]
+		if !ok {
+			return nil, fmt.Errorf("compression: unknown compression %q", *t.Compression)
+		}
+		p.Compression = &c
+	}
+	if t.Crc != nil {
+		c, ok := map[string]int{"off": FileCrcOff, "data": FileCrcAtimeNsec, "metadata": FileCrcAtimeNsecMetadata}[*t.Crc]
+		if !ok {
+			return nil, fmt.Errorf("crc: unknown crc mode %q", *t.Crc)
+		}
+		p.CrcUsage = &c
+	}
+	return p, nil
+}
+
+// subtree returns the subtree at path configured by the table.
+func (t *subtreeTable) subtree(path string) (*Subtree, error) {
+	path = strings.TrimSuffix(path, "/")
+	if err := checkSubtreePath(path); err != nil {
+		return nil, err
+	}
+	st := &Subtree{Path: path, Excludes: t.Excludes}
+	if err := checkPatterns(st.Excludes); err != nil {
+		return nil, fmt.Errorf("subtree %q: excludes: %v", path, err)
+	}
+	if t.Crc != nil {
+		if *t.Crc != "off" {
+			return nil, fmt.Errorf("subtree %q: crc: only \"off\" can be set for a subtree", path)
+		}
+		st.NoCrc = true
+	}
+	if t.Delete != nil {
+		st.NoDelete = !*t.Delete
+	}
+	return st, nil
+}
+
+// addSubtree adds the subtree to the profile, unless it has one at the same
+// path already.
+func (p *Profile) addSubtree(st *Subtree) error {
+	for _, other := range p.Subtrees {
+		if other.Path == st.Path {
+			return fmt.Errorf("duplicate subtree %q", st.Path)
+		}
+	}
+	p.Subtrees = append(p.Subtrees, st)
+	return nil
+}
+
+// checkPatterns checks that the patterns are valid, see filepath.Match.
+func checkPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", p, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// readDeadliner is implemented by connections which support read deadlines,
+// such as a net.Conn, or an *os.File of a pipe.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// deadlineReader fails a read from the other side which takes longer than the
+// read timeout, or doesn't finish before the current phase times out, with
+// ErrTimeout. On a connection with read deadlines, they are used. Otherwise,
+// the reads are made by a goroutine, which is left blocked on a timeout: the
+// sync fails anyway, and the caller is to close the connection.
+type deadlineReader struct {
+	in    io.Reader
+	conn  readDeadliner // in, if it supports read deadlines
+	read  time.Duration // the read timeout, 0 for none
+	phase time.Duration // the phase timeout, 0 for none
+
+	mu    sync.Mutex
+	name  string    // the current phase
+	start time.Time // when the current phase started
+
+	chunks chan readChunk // read by the goroutine, without read deadlines
+	next   chan struct{}  // the chunk was consumed, and the buffer can be reused
+	buf    []byte         // what's left of the last chunk
+	err    error          // what ends the reads: a timeout, or an error of in
+}
+
+// readChunk is the result of a read by the goroutine of a deadlineReader.
+type readChunk struct {
+	data []byte
+	err  error
+}
+
+// newDeadlineReader wraps in, unless there are no timeouts (or nothing to read
+// from), in which case it returns nil.
+func newDeadlineReader(in io.Reader, read, phase time.Duration) *deadlineReader {
+	if in == nil || (read <= 0 && phase <= 0) {
+		return nil
+	}
+	r := &deadlineReader{in: in, read: read, phase: phase, start: time.Now()}
+	r.conn, _ = in.(readDeadliner)
+	return r
+}
+
+// reader returns what to read from: in itself, if there are no timeouts.
+func (r *deadlineReader) reader(in io.Reader) io.Reader {
+	if r == nil {
+		return in
+	}
+	return r
+}
+
+// startPhase starts the phase timeout anew, for the phase with the given name
+// (e.g. "phase 1", as in the errors of Sync).
+func (r *deadlineReader) startPhase(name string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.name, r.start = name, time.Now()
+}
+
+// deadline returns when the next read times out, and the error it then fails
+// with.
+func (r *deadlineReader) deadline() (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var (
+		deadline time.Time
+		err      error
+	)
+	if r.read > 0 {
+		deadline = time.Now().Add(r.read)
+		err = fmt.Errorf("%w: nothing received for %v", ErrTimeout, r.read)
+	}
+	if end := r.start.Add(r.phase); r.phase > 0 && (deadline.IsZero() || end.Before(deadline)) {
+		deadline = end
+		err = fmt.Errorf("%w: %v not done after %v", ErrTimeout, r.phaseName(), r.phase)
+	}
+	return deadline, err
+}
+
+func (r *deadlineReader) phaseName() string {
+	if r.name == "" {
+		return "phase 0"
+	}
+	return r.name
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	deadline, timeout := r.deadline()
+	if r.conn != nil {
+		if err := r.conn.SetReadDeadline(deadline); err == nil {
+			n, err := r.in.Read(p)
+			if isTimeout(err) {
+				r.err = timeout
+				return n, r.err
+			}
+			return n, err
+		}
+		// E.g. a file which can't be polled
+		r.conn = nil
+	}
+	if len(r.buf) == 0 {
+		if r.chunks == nil {
+			r.chunks, r.next = make(chan readChunk), make(chan struct{}, 1)
+			go r.readChunks()
+		}
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case chunk := <-r.chunks:
+			if chunk.err != nil {
+				r.err = chunk.err
+				return 0, r.err
+			}
+			r.buf = chunk.data
+		case <-expired:
+			r.err = timeout
+			return 0, r.err
+		}
+	}
+	n := copy(p, r.buf)
+	if r.buf = r.buf[n:]; len(r.buf) == 0 {
+		r.next <- struct{}{}
+	}
+	return n, nil
+}
+
+// readChunks reads from in until it fails, a chunk at a time, waiting for each
+// to be consumed. An error is only passed on once the data read with it is.
+func (r *deadlineReader) readChunks() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.in.Read(buf)
+		if n > 0 {
+			r.chunks <- readChunk{data: buf[:n]}
+			<-r.next
+		}
+		if err != nil {
+			r.chunks <- readChunk{err: err}
+			return
+		}
+	}
+}
+
+// isTimeout returns whether err is that of a read deadline.
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
@@ -0,0 +1,196 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"syscall"
+)
+
+// With FlagDedup, the header of each regular file in the data phase is
+// followed by a uint32: zero if its content follows, as usual, or one more
+// than the index of an item sent before in the same sync, whose content it
+// has. The receiver then clones that item's file, instead of reading the
+// content. The sender only hashes the files of dedupMin bytes and more whose
+// size is that of another file requested, so a tree without duplicates
+// costs little more than the four bytes.
+// OBS: This is not part of the qvm-copy protocol.
+
+const (
+	// dedupMin is the smallest file which is hashed to be sent once.
+	dedupMin = 4096
+	// ficlone is the FICLONE ioctl, which shares the extents of one file
+	// with another (a reflink), on filesystems which support it.
+	ficlone = 0x40049409
+)
+
+// dedupKey is what the content of a file is identified by.
+type dedupKey struct {
+	size   int64
+	digest [32]byte
+}
+
+// dedup keeps track of the content sent, see Options.Dedup.
+type dedup struct {
+	sizes  map[int64]int       // files of each size requested, not sent yet
+	hashed map[int64]bool      // sizes of which a file has been hashed
+	sent   map[dedupKey]uint32 // the index of the first file sent, by content
+}
+
+func newDedup() *dedup {
+	return &dedup{
+		sizes:  make(map[int64]int),
+		hashed: make(map[int64]bool),
+		sent:   make(map[dedupKey]uint32),
+	}
+}
+
+// expect counts the sizes of the files about to be sent. With overlap, that
+// is a chunk at a time, so duplicates in later chunks only match files which
+// were hashed already.
+func (d *dedup) expect(s *Sender, list []uint32) {
+	if d == nil {
+		return
+	}
+	for _, index := range list {
+		if index < uint32(len(s.sendInfos)) {
+			if info := s.sendInfos[index]; info.Mode().IsRegular() && info.Size() >= dedupMin {
+				d.sizes[info.Size()]++
+			}
+		}
+	}
+}
+
+// cloneSource returns the index of the file sent before with the same content
+// as the file at path, if any, plus one. Otherwise, the file is the one to
+// clone for those with the same content, sent later.
+func (s *Sender) cloneSource(index uint32, path string, info os.FileInfo) (uint32, error) {
+	d, size := s.dedup, info.Size()
+	if !info.Mode().IsRegular() || size < dedupMin {
+		return 0, nil
+	}
+	candidate := d.sizes[size] > 1 || d.hashed[size]
+	if d.sizes[size] > 0 {
+		d.sizes[size]--
+	}
+	if !candidate {
+		return 0, nil
+	}
+	digest, ok := s.cache.digest(info)
+	if !ok {
+		var err error
+		if digest, err = digestItem(s.src, path, info); err != nil {
+			return 0, fmt.Errorf("digest failed: %v", err)
+		}
+		s.cache.setDigest(info, digest)
+	}
+	key := dedupKey{size: size}
+	copy(key.digest[:], digest)
+	d.hashed[size] = true
+	if first, ok := d.sent[key]; ok {
+		if s.opts.Verbosity >= 4 {
+			log.Printf("Sending %v as a clone of %v", s.sendNames[index], s.sendNames[first])
+		}
+		return first + 1, nil
+	}
+	d.sent[key] = index
+	return 0, nil
+}
+
+// readCloneSource reads what follows the header of a regular file, with
+// FlagDedup, and returns the header of the item to clone, if any.
+func (r *Receiver) readCloneSource(index uint32, hdr *fileHeader) (*fileHeader, uint32, error) {
+	var n uint32
+	if err := binary.Read(r.in, binary.LittleEndian, &n); err != nil {
+		return nil, 0, err
+	}
+	if n == 0 {
+		return nil, 0, nil
+	}
+	src := n - 1
+	if _, ok := r.cloneable[src]; !ok || src >= index {
+		return nil, 0, protocolErrorf("item %v can't be cloned from item %d, which wasn't received", hdr.path, src)
+	}
+	if source := r.items[src]; source.Data.FileLen == hdr.Data.FileLen {
+		return source, src, nil
+	}
+	return nil, 0, protocolErrorf("item %v can't be cloned from %v, of a different size", hdr.path, r.items[src].path)
+}
+
+// receiveClone puts a file with the content of the file received as source
+// in place of the item, see FlagDedup.
+func (r *Receiver) receiveClone(hdr, source *fileHeader, src uint32) error {
+	if err := r.countBytes(hdr.Data.FileLen, true); err != nil {
+		return err
+	}
+	if err := r.reserveQuota(hdr.path, hdr.Data.FileLen); err != nil {
+		return err
+	}
+	if r.digest != nil && !bytes.Equal(r.digest, r.digests[src]) {
+		return protocolErrorf("%w: content of %v does not match the signed digest", ErrChecksumMismatch, hdr.path)
+	}
+	if r.archive != nil {
+		return fmt.Errorf("item %v can't be cloned into an archive", hdr.path)
+	}
+	if r.store != nil {
+		entry, from := r.storeEntries[r.localPath(hdr.path)], r.storeEntries[r.localPath(source.path)]
+		entry.Blob, entry.Crc = from.Blob, from.Crc
+		return r.audit.record(auditCreate, entry.Path, entry.Size, entry.Crc)
+	}
+	// The source may still be being put in place
+	if err := r.waitFinished(); err != nil {
+		return err
+	}
+	if r.lenient && r.hasFailed(source.path) {
+		return cloneFailed(hdr.path, source.path)
+	}
+	in, err := r.fs.Open(r.local(source.path))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || uint64(info.Size()) != hdr.Data.FileLen ||
+		len(newFileHeaderFromStat(source.path, info).Diff(source)) > 0 {
+		return fmt.Errorf("item %v can't be cloned from %v, which was changed or left out", hdr.path, source.path)
+	}
+	out, err := r.fs.TempFile(r.local("."), "qvm-*")
+	if err != nil {
+		return err
+	}
+	temp := out.Name()
+	r.addStaging(temp)
+	err = cloneFile(out, in)
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	var crc uint32
+	if err == nil && r.audit != nil {
+		crc, err = crcItem(r.source(), temp, info)
+	}
+	if err != nil {
+		r.dropStaging(temp)
+		return err
+	}
+	return r.finishLater(func() error {
+		defer r.dropStaging(temp)
+		return r.placeFile(hdr, temp, r.local(hdr.path), crc)
+	})
+}
+
+// cloneFile gives out the content of in: as a reflink where the filesystem
+// supports it, and copied otherwise.
+func cloneFile(out, in *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	if errno == 0 {
+		return nil
+	}
+	_, err := io.Copy(out, in)
+	return err
+}
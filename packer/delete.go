@@ -0,0 +1,155 @@
+package packer
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// deleteWorkers is the number of items deleted at once.
+const deleteWorkers = 8
+
+// deleter deletes the local items which the sender doesn't have, in the
+// background, see Receiver.startDeletions.
+type deleter struct {
+	r     *Receiver
+	root  string // the synced directory, absolute
+	items chan deletion
+	wg    sync.WaitGroup
+
+	mu  sync.Mutex // protects err, and the deletion counters of r
+	err error      // of the audit log, which stops the deletions
+}
+
+// deletion is an item to delete.
+type deletion struct {
+	abs  string // the path to delete
+	path string // the path relative to the synced directory
+	info os.FileInfo
+}
+
+// startDeletions starts deleting the items in toDelete, on deleteWorkers
+// goroutines, which waitDeletions waits for. They're started once everything
+// else is received, and the sender needn't wait for them: a large removal
+// overlaps with the final status. None of the items is within another (a
+// directory which is deleted is snapshotted, or summarized, but not what's in
+// it), so the workers don't get in each other's way.
+func (r *Receiver) startDeletions() error {
+	if r.archive != nil || r.store != nil || len(r.toDelete) == 0 {
+		return nil
+	}
+	// The paths to delete are absolute, the audit log (and Conflict) wants
+	// them relative, like the paths from the sender
+	root, err := filepath.Abs(r.local("."))
+	if err != nil {
+		return err
+	}
+	d := &deleter{
+		r:     r,
+		root:  root,
+		items: make(chan deletion, deleteWorkers),
+	}
+	d.wg.Add(deleteWorkers)
+	for i := 0; i < deleteWorkers; i++ {
+		go d.work()
+	}
+	go d.dispatch()
+	r.deleter = d
+	return nil
+}
+
+// waitDeletions waits for the deletions started by startDeletions, if any,
+// and returns the error of the audit log, if it failed.
+func (r *Receiver) waitDeletions() error {
+	d := r.deleter
+	if d == nil {
+		return nil
+	}
+	d.wg.Wait()
+	r.deleter = nil
+	if r.opts.Verbosity >= 3 {
+		log.Printf("Deleted %d items, %d failed", r.deleted, r.deleteFailed)
+	}
+	return d.err
+}
+
+// dispatch decides which items to delete, one at a time, since Conflict is
+// called for each, and passes them on to the workers.
+func (d *deleter) dispatch() {
+	defer close(d.items)
+	r := d.r
+	for f := range r.toDelete {
+		if d.failed() {
+			return
+		}
+		info, err := r.fs.Lstat(f)
+		if err != nil {
+			log.Printf("Error during deletion: %v", err)
+			d.countFailed()
+			continue
+		}
+		path, err := filepath.Rel(d.root, f)
+		if err != nil {
+			path = f
+		}
+		if !r.mayReplace(path) {
+			continue
+		}
+		if subtreeFlags(r.subtrees, path)&subtreeNoDelete != 0 {
+			if r.opts.Verbosity >= 4 {
+				log.Printf("Keeping %v", f)
+			}
+			continue
+		}
+		d.items <- deletion{abs: f, path: path, info: info}
+	}
+}
+
+func (d *deleter) work() {
+	defer d.wg.Done()
+	for item := range d.items {
+		if !d.failed() {
+			d.remove(item)
+		}
+	}
+}
+
+// remove deletes the item (or moves it aside, see removeItem), and records it.
+func (d *deleter) remove(item deletion) {
+	r := d.r
+	if err := r.removeItem(item.abs, item.info); err != nil {
+		if r.opts.Verbosity > 0 {
+			log.Printf("Failed to delete %v: %v", item.abs, err)
+		}
+		d.countFailed()
+		return
+	}
+	if r.opts.Verbosity >= 4 {
+		log.Printf("Removed %v", item.abs)
+	}
+	size := uint64(item.info.Size())
+	if item.info.IsDir() {
+		size = 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r.deleted++
+	if err := r.audit.record(auditDelete, item.path, size, 0); err != nil && d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *deleter) countFailed() {
+	d.mu.Lock()
+	d.r.deleteFailed++
+	d.mu.Unlock()
+}
+
+// failed returns whether the audit log failed, after which nothing more is
+// deleted.
+func (d *deleter) failed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err != nil
+}
@@ -0,0 +1,32 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// With FlagDigests, the content of each regular file in the data phase is
+// followed by its sha256, which the sender computes as the content goes out,
+// and the receiver compares with the sha256 of what it wrote, computed the
+// same way. Neither side reads a file a second time for it. Files sent as
+// clones (FlagDedup) or inlined in the metadata (FlagInline) have none.
+// OBS: This is not part of the qvm-copy protocol.
+
+// checkSentDigest reads the digest which follows the content of the item
+// being received, if any, and compares it with the digest of what was
+// received.
+func (r *Receiver) checkSentDigest(hdr *fileHeader, digest []byte) error {
+	if !r.trailer {
+		return nil
+	}
+	sent := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r.in, sent); err != nil {
+		return fmt.Errorf("failed reading digest of %v: %v", hdr.path, err)
+	}
+	if !bytes.Equal(digest, sent) {
+		return protocolErrorf("%w: content of %v does not match the digest sent", ErrChecksumMismatch, hdr.path)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package packer
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// direntBufSize is the size of the buffer getdents(2) fills, several
+	// times what os.File uses, for fewer calls on large directories.
+	direntBufSize = 64 * 1024
+	// dirBatch is the most entries of a directory which are statted at
+	// once, see Sender.walkDir.
+	dirBatch = 256
+)
+
+const (
+	atSymlinkNoFollow = unix.AT_SYMLINK_NOFOLLOW
+	// statxMask is what a header (and the hash cache) needs: the type and
+	// mode, owner, inode, size, atime and mtime. The device is always filled
+	// in.
+	statxMask = unix.STATX_TYPE | unix.STATX_MODE | unix.STATX_UID | unix.STATX_GID |
+		unix.STATX_ATIME | unix.STATX_MTIME | unix.STATX_INO | unix.STATX_SIZE
+)
+
+// noStatx is set (atomically) to 1 when the kernel doesn't support statx.
+var noStatx int32
+
+// dirList lists a directory in batches, see openDir.
+type dirList interface {
+	// next returns the info of up to n more entries, or io.EOF after the
+	// last.
+	next(n int) ([]os.FileInfo, error)
+	Close() error
+}
+
+// openDir lists the directory at path in src: with getdents(2) and statx(2)
+// for the filesystem, and ReadDir otherwise.
+func openDir(src source, path string) (dirList, error) {
+	if _, ok := src.(osSource); ok {
+		return openDirReader(path)
+	}
+	files, err := src.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	return &readDirList{files}, nil
+}
+
+// readDirList is a dirList of the entries returned by ReadDir.
+type readDirList struct {
+	files []os.FileInfo
+}
+
+func (l *readDirList) next(n int) ([]os.FileInfo, error) {
+	if len(l.files) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(l.files) {
+		n = len(l.files)
+	}
+	files := l.files[:n]
+	l.files = l.files[n:]
+	return files, nil
+}
+
+func (l *readDirList) Close() error { return nil }
+
+// dirReader lists a directory of the filesystem. Like ioutil.ReadDir, it
+// returns the entries sorted by name, but it reads only the names up front,
+// and stats the entries batch by batch, as they're asked for. Each is statted
+// relative to the directory, for the kernel not to resolve the whole path
+// every time, and only for what the header needs.
+type dirReader struct {
+	path  string
+	f     *os.File
+	names []string // the names not returned yet
+}
+
+func openDirReader(path string) (*dirReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &dirReader{path: path, f: f}
+	if d.names, err = readNames(int(f.Fd())); err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "readdirent", Path: path, Err: err}
+	}
+	sort.Strings(d.names)
+	return d, nil
+}
+
+// readNames returns the names in the directory fd, but "." and "..".
+func readNames(fd int) ([]string, error) {
+	var (
+		buf   = make([]byte, direntBufSize)
+		names []string
+	)
+	for {
+		n, err := syscall.ReadDirent(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			return names, nil
+		}
+		_, _, names = syscall.ParseDirent(buf[:n], -1, names)
+	}
+}
+
+func (d *dirReader) next(n int) ([]os.FileInfo, error) {
+	if len(d.names) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.names) {
+		n = len(d.names)
+	}
+	batch := d.names[:n]
+	d.names = d.names[n:]
+	infos := make([]os.FileInfo, 0, len(batch))
+	for _, name := range batch {
+		info, err := d.lstat(name)
+		if os.IsNotExist(err) {
+			// Removed meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (d *dirReader) Close() error { return d.f.Close() }
+
+// lstat returns the info of the entry name, with statx relative to the
+// directory, or os.Lstat if statx isn't supported.
+func (d *dirReader) lstat(name string) (os.FileInfo, error) {
+	if atomic.LoadInt32(&noStatx) == 0 {
+		info := &direntInfo{name: name}
+		err := statxAt(int(d.f.Fd()), name, &info.st)
+		if err == nil {
+			return info, nil
+		}
+		if err != syscall.ENOSYS {
+			return nil, &os.PathError{Op: "statx", Path: filepath.Join(d.path, name), Err: err}
+		}
+		atomic.StoreInt32(&noStatx, 1)
+	}
+	return os.Lstat(filepath.Join(d.path, name))
+}
+
+// statxAt fills in st for the entry name of the directory dirfd, without
+// following symlinks, with the fields in statxMask. The fields of st differ
+// between architectures, so only those are filled in.
+func statxAt(dirfd int, name string, st *syscall.Stat_t) error {
+	var sx unix.Statx_t
+	for {
+		err := unix.Statx(dirfd, name, atSymlinkNoFollow, statxMask, &sx)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+	*st = syscall.Stat_t{
+		Dev:  mkdev(sx.Dev_major, sx.Dev_minor),
+		Ino:  sx.Ino,
+		Mode: uint32(sx.Mode),
+		Uid:  sx.Uid,
+		Gid:  sx.Gid,
+		Size: int64(sx.Size),
+		Atim: statxTimespec(sx.Atime),
+		Mtim: statxTimespec(sx.Mtime),
+		Ctim: statxTimespec(sx.Ctime),
+	}
+	return nil
+}
+
+// statxTimespec converts a time of statx to the Timespec of the architecture.
+func statxTimespec(ts unix.StatxTimestamp) syscall.Timespec {
+	return syscall.NsecToTimespec(ts.Sec*1e9 + int64(ts.Nsec))
+}
+
+// mkdev combines a major and minor device number, like the kernel does for
+// stat(2).
+func mkdev(major, minor uint32) uint64 {
+	return uint64(major&0xfffff000)<<32 | uint64(major&0xfff)<<8 |
+		uint64(minor&0xffffff00)<<12 | uint64(minor&0xff)
+}
+
+// direntInfo is the os.FileInfo of an entry listed by a dirReader, the same
+// as os.Lstat returns.
+type direntInfo struct {
+	name string
+	st   syscall.Stat_t
+}
+
+func (i *direntInfo) Name() string       { return i.name }
+func (i *direntInfo) Size() int64        { return i.st.Size }
+func (i *direntInfo) ModTime() time.Time { return time.Unix(i.st.Mtim.Unix()) }
+func (i *direntInfo) IsDir() bool        { return i.Mode().IsDir() }
+func (i *direntInfo) Sys() interface{}   { return &i.st }
+
+func (i *direntInfo) Mode() os.FileMode {
+	mode := os.FileMode(i.st.Mode & 0777)
+	switch i.st.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+	if i.st.Mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if i.st.Mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if i.st.Mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
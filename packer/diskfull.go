@@ -0,0 +1,125 @@
+package packer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"syscall"
+)
+
+// When the receiver runs out of space (ENOSPC, or EDQUOT from the filesystem),
+// the sync fails, even a lenient one, as the items after it would fail as
+// well. The receiver reports it as CodeDiskFull, removes its tempfiles, and a
+// file it was writing in place, and restores the permissions of the
+// directories handled so far.
+//
+// With FlagDiskFull, the result is followed by a diskFullHeader and the path
+// (as sent) of the item which didn't fit, if it's known. Needed is the size
+// of the content requested which was not written yet, that of the item
+// included: an estimate of the space the sync needed, as it leaves out the
+// local copies which would have been replaced.
+// OBS: This is not part of the qvm-copy protocol.
+
+// diskFullHeader follows a result with CodeDiskFull, see FlagDiskFull.
+type diskFullHeader struct {
+	Needed  uint64
+	NameLen uint32
+}
+
+// isOutOfSpace returns whether err is the filesystem running out of space,
+// or the user's quota on it. The failure of a hook isn't, whatever it says.
+func isOutOfSpace(err error) bool {
+	if errors.Is(err, ErrRejected) {
+		return false
+	}
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// diskFull returns err as a *DiskFullError if the receiver ran out of space,
+// unless it is one already, and err otherwise.
+func (r *Receiver) diskFull(err error) error {
+	var full *DiskFullError
+	if errors.As(err, &full) || !isOutOfSpace(err) {
+		return err
+	}
+	full = &DiskFullError{Needed: r.pendingBytes(), Err: err}
+	var lerr *LocalIOError
+	if errors.As(err, &lerr) {
+		full.Path = lerr.Path
+	}
+	return full
+}
+
+// pendingBytes returns the size of the content requested so far, which was
+// not received yet.
+func (r *Receiver) pendingBytes() uint64 {
+	r.bytesMu.Lock()
+	defer r.bytesMu.Unlock()
+	return r.askedBytes - r.doneBytes
+}
+
+// askBytes counts the content of an item requested.
+func (r *Receiver) askBytes(n uint64) {
+	r.bytesMu.Lock()
+	r.askedBytes += n
+	r.bytesMu.Unlock()
+}
+
+// countDone counts the content of an item received.
+func (r *Receiver) countDone(n uint64) {
+	r.bytesMu.Lock()
+	r.doneBytes += n
+	r.bytesMu.Unlock()
+}
+
+// sendDiskFull sends the details of a failure for lack of space, after its
+// result, see FlagDiskFull.
+func (r *Receiver) sendDiskFull(err error) error {
+	var (
+		hdr  diskFullHeader
+		path string
+		full *DiskFullError
+	)
+	if errors.As(err, &full) {
+		hdr.Needed, path = full.Needed, full.Path
+	}
+	hdr.NameLen = uint32(len(path))
+	if err := binary.Write(r.out, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	_, err = r.out.Write([]byte(path))
+	return err
+}
+
+// outOfSpace winds down a sync which failed for lack of space, and returns
+// the failure, as a *DiskFullError.
+func (r *Receiver) outOfSpace(err error) error {
+	err = r.diskFull(err)
+	if r.opts.Verbosity > 0 {
+		log.Printf("Out of space, cleaning up: %v", err)
+	}
+	r.Cleanup()
+	for _, hdr := range r.deferredPermissions {
+		r.fixTimesAndPerms(hdr)
+	}
+	return err
+}
+
+// readDiskFull reads the details which follow the result remote, with
+// CodeDiskFull, and returns them as a *DiskFullError.
+func readDiskFull(in io.Reader, remote *RemoteError) error {
+	var hdr diskFullHeader
+	if err := binary.Read(in, binary.LittleEndian, &hdr); err != nil {
+		return fmt.Errorf("failed reading disk full details: %v", err)
+	}
+	if hdr.NameLen > MaxPathLength {
+		return protocolErrorf("bad path length of a disk full result: %d", hdr.NameLen)
+	}
+	name := make([]byte, hdr.NameLen)
+	if _, err := io.ReadFull(in, name); err != nil {
+		return fmt.Errorf("failed reading disk full details: %v", err)
+	}
+	return &DiskFullError{Path: string(name), Needed: hdr.Needed, Err: remote}
+}
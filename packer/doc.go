@@ -0,0 +1,51 @@
+// Package packer implements the qvm-sync protocol: a Sender transmits a
+// directory, and a Receiver makes its destination identical to it, only
+// transferring what differs.
+//
+// The engine can be embedded; all it needs is a pair of streams between the
+// two sides (e.g. qrexec, a pipe, or a connection from package transport).
+// Neither side depends on the working directory of the process or on global
+// state, so several syncs may run in the same process:
+//
+//	opts := packer.NewOptions(packer.WithExcludes("*.tmp"))
+//	sender, err := packer.NewSender(conn, conn, opts)
+//	if err != nil {
+//		return err
+//	}
+//	err = sender.Sync("/home/user/Documents")
+//
+// and on the other side:
+//
+//	ropts := packer.NewReceiverOptions(
+//		packer.WithRoot("/srv/backup"),
+//		packer.WithReceiveProgress(func(path string, size uint64) {
+//			log.Printf("received %v (%d bytes)", path, size)
+//		}),
+//	)
+//	receiver, err := packer.NewReceiver(conn, conn, ropts)
+//	if err != nil {
+//		return err
+//	}
+//	err = receiver.Sync()
+//
+// Both sides accept a Filter, which leaves out or renames items, and Hooks,
+// which are called before and after the sync, and for each file. On the
+// receiving side, the PostFile hook sees each file before it is put in place
+// (e.g. to scan it), and can leave it out.
+//
+// Errors from Sync can be inspected with errors.Is and errors.As: ErrAborted
+// (and ErrSenderAborted, on the receiver), ErrQuotaExceeded, ErrLimitExceeded,
+// ErrChecksumMismatch, ErrRejected and ErrConflict; *ProtocolError, if the
+// other side sent something invalid, and *LocalIOError, if the local
+// filesystem failed. The receiver reports its
+// failure to the sender as an ErrorCode, where it is a *RemoteError, which
+// matches the same errors, and unwraps to the errno (e.g. syscall.ENOSPC).
+// A lenient sync (see Options.Lenient) in which some items failed returns a
+// *PartialError on both sides, which matches ErrPartial. A receiver which ran
+// out of space returns a *DiskFullError, as does the sender, with
+// Options.DiskFullDetails.
+//
+// OBS: the receiver validates the paths it is sent, but is meant to run
+// root-jailed (see qsync-preloader). Embedded, it is only as confined as the
+// process it runs in.
+package packer
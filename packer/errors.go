@@ -0,0 +1,282 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+var (
+	// ErrAborted is returned by Receiver.Sync if the sync was cancelled via
+	// Abort. Errors returned by Sender.Sync match it (see errors.Is) if the
+	// receiver aborted.
+	ErrAborted = errors.New("sync aborted")
+	// ErrSenderAborted is returned by Receiver.Sync if the sender aborted
+	// the sync, see Sender.Abort. It matches ErrAborted.
+	ErrSenderAborted = fmt.Errorf("%w by sender", ErrAborted)
+	// ErrQuotaExceeded is matched by errors from Receiver.Sync if the sync
+	// would make the sync root exceed ReceiverOptions.MaxRootSize. Errors
+	// returned by Sender.Sync match it if the receiver failed because of it.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrConflict is matched by errors from Receiver.Sync if a local item
+	// which ReceiverOptions.Conflict wanted to keep is in the way.
+	ErrConflict = errors.New("conflict")
+	// ErrLimitExceeded is matched by errors from Receiver.Sync if the sync
+	// exceeds one of the receiver's limits: the number of files or bytes,
+	// the depth of the tree, or the entries of a directory. Errors returned
+	// by Sender.Sync match it if the receiver failed because of a limit or
+	// the quota, which it doesn't tell apart.
+	ErrLimitExceeded = errors.New("limit exceeded")
+	// ErrChecksumMismatch is matched by errors from Receiver.Sync if content
+	// received doesn't match its digest (see FlagDigests and SigningKey), and
+	// by those from Sender.Sync if the receiver failed because of it.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrRejected is matched by errors from Receiver.Sync if the receiver's
+	// policy refused the transfer: a PostFile hook failed, a local item was
+	// in conflict, or the signature is not that of the trusted key. Errors
+	// from Sender.Sync match it if the receiver failed because of it.
+	ErrRejected = errors.New("rejected")
+	// ErrTimeout is matched by errors from Sync if the other side sent
+	// nothing for the read timeout, or didn't get through a phase of the
+	// sync within the phase timeout (see Options.ReadTimeout).
+	ErrTimeout = errors.New("timeout")
+	// ErrPartial is matched by errors from Sync if a lenient sync (see
+	// Options.Lenient) completed, but some items failed. See PartialError.
+	ErrPartial = errors.New("partial sync")
+)
+
+// ErrorCode is the code with which the receiver reports the result of a sync.
+// As in qvm-copy, it is zero on success, and an errno otherwise: either one
+// of those below, or that of the local operation which failed.
+type ErrorCode uint32
+
+const (
+	CodeOK               ErrorCode = 0
+	CodeAborted                    = ErrorCode(syscall.EINTR)     // see ErrAborted
+	CodeLimitExceeded              = ErrorCode(syscall.EDQUOT)    // see ErrLimitExceeded
+	CodeChecksumMismatch           = ErrorCode(syscall.EBADMSG)   // see ErrChecksumMismatch
+	CodeDiskFull                   = ErrorCode(syscall.ENOSPC)    // see DiskFullError
+	CodeRejected                   = ErrorCode(syscall.ECANCELED) // see ErrRejected
+	CodeProtocol                   = ErrorCode(syscall.EPROTO)    // see ProtocolError
+	CodeTimeout                    = ErrorCode(syscall.ETIMEDOUT) // see ErrTimeout
+	CodeInternal                   = ErrorCode(syscall.EIO)
+)
+
+const (
+	// ExitAborted is the exit code of the commands when the other side
+	// aborted the sync. The side which aborts, on a signal, exits with
+	// 128+signal.
+	ExitAborted = 3
+	// ExitPartial is the exit code of the commands when a lenient sync
+	// completed, but some items failed, see ErrPartial.
+	ExitPartial = 4
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeOK:
+		return "ok"
+	case CodeAborted:
+		return "aborted"
+	case CodeLimitExceeded:
+		return "limit exceeded"
+	case CodeChecksumMismatch:
+		return "checksum mismatch"
+	case CodeDiskFull:
+		return "disk full"
+	case CodeRejected:
+		return "rejected"
+	case CodeProtocol:
+		return "protocol error"
+	case CodeTimeout:
+		return "timeout"
+	case CodeInternal:
+		return "internal error"
+	}
+	return syscall.Errno(c).Error()
+}
+
+// err returns the sentinel error which the code stands for, if any.
+func (c ErrorCode) err() error {
+	switch c {
+	case CodeAborted:
+		return ErrAborted
+	case CodeLimitExceeded:
+		return ErrLimitExceeded
+	case CodeChecksumMismatch:
+		return ErrChecksumMismatch
+	case CodeRejected:
+		return ErrRejected
+	case CodeTimeout:
+		return ErrTimeout
+	}
+	return nil
+}
+
+// ProtocolError is matched (see errors.As) by errors caused by what the other
+// side sent: something malformed, unexpected at that point, or not allowed,
+// such as a path outside of the sync root. The receiver reports it to the
+// sender as EPROTO.
+type ProtocolError struct {
+	Err error
+}
+
+func (e *ProtocolError) Error() string { return e.Err.Error() }
+
+func (e *ProtocolError) Unwrap() error { return e.Err }
+
+// protocolErrorf returns a *ProtocolError, with the message formatted as by
+// fmt.Errorf.
+func protocolErrorf(format string, args ...interface{}) error {
+	return &ProtocolError{fmt.Errorf(format, args...)}
+}
+
+// LocalIOError is matched by errors caused by the local filesystem, while
+// handling the item at Path (as sent). The receiver reports its errno to the
+// sender (EIO if there's none).
+type LocalIOError struct {
+	Path string
+	Err  error
+}
+
+func (e *LocalIOError) Error() string { return e.Err.Error() }
+
+func (e *LocalIOError) Unwrap() error { return e.Err }
+
+// rejection is the failure of a hook, which the receiver reports as
+// CodeRejected. It matches ErrRejected, and unwraps to what the hook returned.
+type rejection struct {
+	err error
+}
+
+func (e *rejection) Error() string { return e.err.Error() }
+
+func (e *rejection) Unwrap() error { return e.err }
+
+func (e *rejection) Is(target error) bool { return target == ErrRejected }
+
+// localIOError makes err a *LocalIOError for the item at path, if it is a
+// failure of the filesystem, and it isn't typed already.
+func localIOError(path string, err error) error {
+	var (
+		perr  *ProtocolError
+		lerr  *LocalIOError
+		errno syscall.Errno
+	)
+	if err == nil || errors.As(err, &perr) || errors.As(err, &lerr) || !errors.As(err, &errno) {
+		return err
+	}
+	return &LocalIOError{Path: path, Err: err}
+}
+
+// PartialError is returned by Sync, on both sides, when a lenient sync (see
+// Options.Lenient) completed, but some items failed. Both get the same
+// failures, from the receiver. It matches ErrPartial.
+type PartialError struct {
+	Failures []ItemFailure
+}
+
+// ItemFailure is an item which a lenient sync failed to sync.
+type ItemFailure struct {
+	Path   string    // as sent
+	Code   ErrorCode // the errno of the failure, as with RemoteError
+	Sender bool      // whether it failed on the sender, which couldn't read it
+}
+
+func (f ItemFailure) String() string {
+	if f.Sender {
+		return fmt.Sprintf("%v: %v (on the sender)", f.Path, f.Code)
+	}
+	return fmt.Sprintf("%v: %v", f.Path, f.Code)
+}
+
+func (e *PartialError) Error() string {
+	if len(e.Failures) == 1 {
+		return fmt.Sprintf("partial sync, 1 item failed: %v", e.Failures[0])
+	}
+	return fmt.Sprintf("partial sync, %d items failed, the first: %v", len(e.Failures), e.Failures[0])
+}
+
+func (e *PartialError) Is(target error) bool { return target == ErrPartial }
+
+// DiskFullError is matched by errors from Receiver.Sync if the receiver ran
+// out of space (ENOSPC, or EDQUOT from the filesystem), which it reports as
+// CodeDiskFull. With Options.DiskFullDetails, errors from Sender.Sync match
+// it too, and it wraps the *RemoteError. See FlagDiskFull.
+type DiskFullError struct {
+	Path   string // the item which didn't fit, as sent, if known
+	Needed uint64 // an estimate of the bytes which were still to be written
+	Err    error
+}
+
+func (e *DiskFullError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("out of space, about %d more bytes needed: %v", e.Needed, e.Err)
+	}
+	return fmt.Sprintf("out of space for %v, about %d more bytes needed: %v", e.Path, e.Needed, e.Err)
+}
+
+func (e *DiskFullError) Unwrap() error { return e.Err }
+
+// RemoteError is returned by Sender.Sync when the receiver reports a failure.
+// It matches the error which the code stands for (e.g. ErrLimitExceeded), and
+// unwraps to the code as a syscall.Errno, so that errors.Is(err,
+// syscall.ENOSPC) tells whether the receiver ran out of space.
+type RemoteError struct {
+	Code     ErrorCode // the code sent by the receiver
+	LastName string    // the last item the receiver handled successfully
+}
+
+func (e *RemoteError) Error() string {
+	if e.Code == CodeAborted {
+		return fmt.Sprintf("sync aborted by receiver, last file: %v", e.LastName)
+	}
+	return fmt.Sprintf("sync error, code: %d (%v), last file: %v", e.Code, e.Code, e.LastName)
+}
+
+// Is matches the error which the code stands for. A failure on the quota is
+// reported as a limit, so it matches ErrQuotaExceeded as well.
+func (e *RemoteError) Is(target error) bool {
+	if err := e.Code.err(); err != nil && target == err {
+		return true
+	}
+	return target == ErrQuotaExceeded && e.Code == CodeLimitExceeded
+}
+
+func (e *RemoteError) Unwrap() error { return syscall.Errno(e.Code) }
+
+// errorCode returns the code with which a failure is reported to the other
+// side, in a resultHeader.
+func errorCode(err error) ErrorCode {
+	var (
+		perr *ProtocolError
+		full *DiskFullError
+	)
+	switch {
+	case errors.Is(err, ErrAborted):
+		return CodeAborted
+	case errors.Is(err, ErrQuotaExceeded), errors.Is(err, ErrLimitExceeded):
+		return CodeLimitExceeded
+	case errors.Is(err, ErrChecksumMismatch):
+		return CodeChecksumMismatch
+	case errors.Is(err, ErrConflict), errors.Is(err, ErrRejected):
+		return CodeRejected
+	case errors.As(err, &perr):
+		return CodeProtocol
+	case errors.Is(err, ErrTimeout):
+		return CodeTimeout
+	case errors.As(err, &full):
+		return CodeDiskFull
+	}
+	if errno, ok := underlyingErrno(err); ok && errno != 0 {
+		return ErrorCode(errno)
+	}
+	return CodeInternal
+}
+
+// underlyingErrno returns the errno which caused err, if any.
+func underlyingErrno(err error) (syscall.Errno, bool) {
+	var errno syscall.Errno
+	ok := errors.As(err, &errno)
+	return errno, ok
+}
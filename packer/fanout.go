@@ -0,0 +1,271 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// A fan-out sends one directory to several receivers at once. The metadata is
+// computed once (crc, signature), and sent to all of them. Each receiver then
+// requests what it needs, and every requested item is read once, and sent to
+// those receivers which requested it. To each receiver, it's a regular sync.
+//
+// The receivers are fed in lockstep, so the slowest one sets the pace. A
+// receiver which fails is dropped, and the others carry on.
+// OBS: This is not part of the qvm-copy protocol.
+
+// Destination is one receiver of a fan-out.
+type Destination struct {
+	Name string
+	Out  io.Writer
+	In   io.Reader
+}
+
+// fanoutPeer is the connection to one receiver of a fan-out.
+type fanoutPeer struct {
+	name string
+	*Sender
+	list []uint32 // requested items
+	next int      // the next item of list to send
+	err  error
+}
+
+// fail drops the peer, unless it has already been dropped.
+func (p *fanoutPeer) fail(err error) {
+	if p.err == nil {
+		log.Printf("Sync to %v failed: %v", p.name, err)
+		p.err = err
+	}
+}
+
+var errNoDestination = fmt.Errorf("no destination left")
+
+// fanWriter writes to the peers which haven't failed. A peer which fails to
+// write is dropped, so that it doesn't stop the others.
+type fanWriter struct {
+	peers []*fanoutPeer
+}
+
+func (w *fanWriter) Write(p []byte) (int, error) {
+	live := 0
+	for _, peer := range w.peers {
+		if peer.err != nil {
+			continue
+		}
+		if _, err := peer.out.Write(p); err != nil {
+			peer.fail(err)
+			continue
+		}
+		live++
+	}
+	if live == 0 && len(w.peers) > 0 {
+		return 0, errNoDestination
+	}
+	return len(p), nil
+}
+
+func (w *fanWriter) Flush() error {
+	for _, peer := range w.peers {
+		if peer.err == nil {
+			if err := peer.out.Flush(); err != nil {
+				peer.fail(err)
+			}
+		}
+	}
+	return nil
+}
+
+// FanoutSender sends a directory to several receivers.
+type FanoutSender struct {
+	lead  *Sender // walks the directory, and sends to the peers via out
+	out   *fanWriter
+	peers []*fanoutPeer
+}
+
+// NewFanoutSender sends the version header to each destination, and returns
+// a sender for all of them.
+func NewFanoutSender(dests []Destination, opts *Options) (*FanoutSender, error) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	if len(dests) == 0 {
+		return nil, fmt.Errorf("no destinations")
+	}
+	if opts.Summary {
+		// The metadata is the same for all of them
+		return nil, fmt.Errorf("a summary can't be used with several destinations")
+	}
+	if opts.Streams > 1 {
+		// The content is sent once, as a single stream
+		return nil, fmt.Errorf("streams can't be used with several destinations")
+	}
+	if opts.Overlap {
+		// Each would request different files at different times
+		return nil, fmt.Errorf("overlap can't be used with several destinations")
+	}
+	if opts.Pack {
+		// The content is sent item by item, see sendItems
+		return nil, fmt.Errorf("packing can't be used with several destinations")
+	}
+	if opts.Dedup {
+		// Each would request different files
+		return nil, fmt.Errorf("dedup can't be used with several destinations")
+	}
+	if opts.LazyHash {
+		// Each would ask for the crcs of different files
+		return nil, fmt.Errorf("lazy hashing can't be used with several destinations")
+	}
+	if opts.Lenient {
+		// Each would report different failures
+		return nil, fmt.Errorf("a lenient sync can't be used with several destinations")
+	}
+	f := &FanoutSender{out: new(fanWriter)}
+	for _, d := range dests {
+		s, err := NewSender(d.Out, d.In, opts)
+		if err != nil {
+			return nil, fmt.Errorf("destination %v: %v", d.Name, err)
+		}
+		// The metadata is only signed once, by the lead
+		s.signer = nil
+		f.peers = append(f.peers, &fanoutPeer{name: d.Name, Sender: s})
+	}
+	f.lead = &Sender{src: osSource{mmap: opts.Mmap, dropCache: opts.DropCache}, opts: opts, out: f.out}
+	if opts.IOUring {
+		f.lead.rings = new(uringPool)
+	}
+	if opts.SigningKey != nil {
+		f.lead.signer = newSigner(opts.SigningKey)
+	}
+	return f, nil
+}
+
+// live returns the peers which haven't failed.
+func (f *FanoutSender) live() []*fanoutPeer {
+	var peers []*fanoutPeer
+	for _, p := range f.peers {
+		if p.err == nil {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// Sync sends the directory at path to all destinations. It fails if the
+// sync to any of them failed, but does not stop the others because of it.
+func (f *FanoutSender) Sync(path string) (err error) {
+	if hooks := f.lead.opts.Hooks; hooks != nil {
+		if err := hooks.PreSync(path); err != nil {
+			return err
+		}
+		defer func() { hooks.PostSync(err) }()
+	}
+	// Only the lead reads the files
+	f.lead.cache = loadHashCache(f.lead.opts)
+	defer func() {
+		saveHashCache(f.lead.cache, f.lead.opts)
+		f.lead.cache = nil
+	}()
+	f.lead.walks = loadWalkCache(f.lead.opts, f.lead.src)
+	defer func() {
+		if err == nil {
+			saveWalkCache(f.lead.walks, f.lead.opts)
+		}
+		f.lead.walks = nil
+	}()
+	defer f.lead.rings.close()
+	f.out.peers = f.peers
+	if err := f.lead.transmitDirectory(path); err != nil {
+		return fmt.Errorf("phase 0 send error: %w", err)
+	}
+	for _, p := range f.live() {
+		p.sendList, p.requested = f.lead.sendList, nil
+		p.deadline.startPhase("phase 1")
+		if err := p.waitForResult(); err != nil {
+			p.fail(fmt.Errorf("phase 1 wait error: %w", err))
+			continue
+		}
+		p.deadline.startPhase("phase 2")
+		list, err := p.readFileList()
+		if err != nil {
+			p.fail(fmt.Errorf("phase 2 list error: %w", err))
+			continue
+		}
+		p.list = list
+	}
+	if err := f.sendItems(); err != nil {
+		return fmt.Errorf("phase 2 send error: %w", err)
+	}
+	for _, p := range f.live() {
+		p.deadline.startPhase("phase 3")
+		if err := p.waitForResult(); err != nil {
+			p.fail(fmt.Errorf("phase 3 wait error: %w", err))
+			continue
+		}
+		if f.lead.opts.Verbosity >= 3 {
+			if cm, ok := p.out.(*ConfigurableWriter); ok {
+				r, c := cm.Stats()
+				log.Printf("Data sent to %v, raw: %d, compressed: %d", p.name, r, c)
+			}
+		}
+	}
+	if f.lead.opts.VerifyTree && len(f.live()) > 0 {
+		sum, err := f.lead.treeHash()
+		if err != nil {
+			return fmt.Errorf("verification error: %w", err)
+		}
+		for _, p := range f.live() {
+			p.deadline.startPhase("verification")
+			if err := p.sendTreeHash(sum); err != nil {
+				p.fail(fmt.Errorf("verification error: %w", err))
+			}
+		}
+	}
+	var failed []string
+	for _, p := range f.peers {
+		if p.err != nil {
+			failed = append(failed, p.name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("sync failed for %v of %d destinations: %v", len(failed), len(f.peers), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// sendItems sends the requested items, each to the peers which requested
+// it. Each peer gets its items in the order it requested them; as receivers
+// request in the order of the metadata, each item is read only once.
+func (f *FanoutSender) sendItems() error {
+	for {
+		var (
+			index   uint32
+			targets []*fanoutPeer
+		)
+		for _, p := range f.live() {
+			if p.next >= len(p.list) {
+				continue
+			}
+			switch i := p.list[p.next]; {
+			case len(targets) == 0 || i < index:
+				index, targets = i, []*fanoutPeer{p}
+			case i == index:
+				targets = append(targets, p)
+			}
+		}
+		if len(targets) == 0 {
+			break
+		}
+		for _, p := range targets {
+			p.next++
+		}
+		f.out.peers = targets
+		// If only the targets failed, the others may carry on
+		if err := f.lead.sendItem(index); err != nil && (err != errNoDestination || len(f.live()) == 0) {
+			return err
+		}
+	}
+	f.out.peers = f.peers
+	return f.out.Flush()
+}
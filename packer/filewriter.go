@@ -0,0 +1,138 @@
+package packer
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// contentBufSize is the size of the writes of received content, larger
+	// than the reads of the connection, for fewer and larger writes.
+	contentBufSize = 1 << 20
+	// preallocMin is the smallest file which is allocated up front.
+	preallocMin = 64 * 1024
+	// writeBehind is how much of a file is written back at once, see
+	// fileWriter.
+	writeBehind = 8 << 20
+)
+
+const (
+	fallocKeepSize = unix.FALLOC_FL_KEEP_SIZE
+
+	syncFileRangeWaitBefore = unix.SYNC_FILE_RANGE_WAIT_BEFORE
+	syncFileRangeWrite      = unix.SYNC_FILE_RANGE_WRITE
+	syncFileRangeWaitAfter  = unix.SYNC_FILE_RANGE_WAIT_AFTER
+
+	fadvDontNeed = unix.FADV_DONTNEED
+)
+
+// contentPool holds the buffers used for writing received content.
+var contentPool = sync.Pool{
+	New: func() interface{} { return make([]byte, contentBufSize) },
+}
+
+// fileWriter writes the content of a received file. The file is allocated up
+// front, for it not to be fragmented, and the content is written back as it
+// comes, a window of writeBehind at a time: once written back, it's dropped
+// from the page cache, so that receiving many gigabytes doesn't push out
+// everything else. The kernel (or filesystem) may not support any of it,
+// which isn't an error.
+type fileWriter struct {
+	f       *os.File
+	fd      int
+	uf      *uringFile // set if written through a ring, see ReceiverOptions.IOUring
+	written int64      // bytes written
+	synced  int64      // bytes being written back, a multiple of writeBehind
+}
+
+// newFileWriter returns a fileWriter for f, which is to be size bytes,
+// written through a ring of the pool if it's large enough. It fails if
+// there's no room for the file, before any of it is received.
+func newFileWriter(f *os.File, size uint64, rings *uringPool) (*fileWriter, error) {
+	w := &fileWriter{f: f, fd: int(f.Fd())}
+	if size >= preallocMin {
+		// The size is kept, so that a file which isn't received in full
+		// is no larger than what was
+		err := syscall.Fallocate(w.fd, fallocKeepSize, 0, int64(size))
+		if err == syscall.ENOSPC || err == syscall.EDQUOT {
+			return nil, &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+		}
+	}
+	w.uf = newUringFile(rings, f, int64(size))
+	return w, nil
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	var (
+		n   int
+		err error
+	)
+	if w.uf != nil {
+		n, err = w.uf.Write(p)
+	} else {
+		n, err = w.f.Write(p)
+	}
+	w.written += int64(n)
+	for err == nil && w.written-w.synced >= writeBehind {
+		if w.uf != nil {
+			// What's in flight can't be written back yet
+			if err = w.uf.Flush(); err != nil {
+				break
+			}
+		}
+		// Start writing back the window just written, and wait for the
+		// one before, which can then be dropped
+		unix.SyncFileRange(w.fd, w.synced, writeBehind, syncFileRangeWrite)
+		if w.synced >= writeBehind {
+			prev := w.synced - writeBehind
+			unix.SyncFileRange(w.fd, prev, writeBehind, syncFileRangeWaitBefore|syncFileRangeWrite|syncFileRangeWaitAfter)
+			unix.Fadvise(w.fd, prev, writeBehind, fadvDontNeed)
+		}
+		w.synced += writeBehind
+	}
+	return n, err
+}
+
+// Close drops the rest of the file from the page cache, if it's large enough
+// to have been written back while written, and closes it. It fails if
+// writing through the ring did.
+func (w *fileWriter) Close() error {
+	var err error
+	if w.uf != nil {
+		err = w.uf.Release()
+	}
+	if w.synced > 0 {
+		unix.SyncFileRange(w.fd, 0, 0, syncFileRangeWaitBefore|syncFileRangeWrite|syncFileRangeWaitAfter)
+		unix.Fadvise(w.fd, 0, 0, fadvDontNeed)
+	}
+	if cErr := w.f.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// copyContent copies size bytes from input to output, in writes of up to
+// contentBufSize. Like CopyFile, it fails with io.ErrUnexpectedEOF if input
+// ends before that.
+func copyContent(input io.Reader, output io.Writer, size uint64) error {
+	buf := contentPool.Get().([]byte)
+	defer contentPool.Put(buf)
+	for size > 0 {
+		chunk := buf
+		if size < uint64(len(chunk)) {
+			chunk = chunk[:size]
+		}
+		if n, err := io.ReadFull(input, chunk); err != nil {
+			return shortContent(int(size)-n, err)
+		}
+		if _, err := output.Write(chunk); err != nil {
+			return err
+		}
+		size -= uint64(len(chunk))
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package packer
+
+import "sync"
+
+// finishWorkers is the number of received files put in place at once.
+const finishWorkers = 4
+
+// finisher puts received files in place in the background, see
+// Receiver.finishLater.
+type finisher struct {
+	items chan func() error
+	wg    sync.WaitGroup
+
+	mu  sync.Mutex // protects err
+	err error      // the first failure, which fails the sync
+}
+
+// finishLater runs fn, which puts a received file in place, on one of
+// finishWorkers goroutines, while the content of the next files is received.
+// The content arrives one file at a time, but closing a large file waits for
+// it to be written back, and linking it in place and setting its times take
+// syscalls of their own. With a single file requested, or with hooks (which
+// needn't be safe for concurrent use), fn is run right away.
+//
+// A failure is returned by a later call, or by waitFinished.
+func (r *Receiver) finishLater(fn func() error) error {
+	if r.ropts.Hooks != nil || (r.queue == nil && len(r.requestList) < 2) {
+		return fn()
+	}
+	f := r.finisher
+	if f == nil {
+		f = &finisher{items: make(chan func() error, finishWorkers)}
+		f.wg.Add(finishWorkers)
+		for i := 0; i < finishWorkers; i++ {
+			go f.work()
+		}
+		r.finisher = f
+	}
+	if err := f.failed(); err != nil {
+		// The file is complete, and put in place all the same
+		fn()
+		return err
+	}
+	f.items <- fn
+	return nil
+}
+
+// waitFinished waits for the files passed to finishLater, and returns the first
+// failure, if any. The times and permissions of the directories are fixed
+// after it, and the deletions started, so that neither gets in the way.
+func (r *Receiver) waitFinished() error {
+	f := r.finisher
+	if f == nil {
+		return nil
+	}
+	close(f.items)
+	f.wg.Wait()
+	r.finisher = nil
+	return f.err
+}
+
+func (f *finisher) work() {
+	defer f.wg.Done()
+	for fn := range f.items {
+		if err := fn(); err != nil {
+			f.mu.Lock()
+			if f.err == nil {
+				f.err = err
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+func (f *finisher) failed() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
@@ -0,0 +1,246 @@
+package packer
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SenderFlags are the command line flags which set the Options of a sender,
+// shared by the commands which send.
+type SenderFlags struct {
+	noCompression  *bool
+	ignoreSymlinks *bool
+	verbosity      *uint
+	excludes       stringList
+	signKey        *string
+	summary        *bool
+	quick          *bool
+	streams        *int
+	compressors    *int
+	workers        *int
+	mmap           *bool
+	ioUring        *bool
+	dropCache      *bool
+	hashCache      *string
+	walkCache      *string
+	fullWalk       *time.Duration
+	lazyHash       *bool
+	dedup          *bool
+	digests        *bool
+	skipGone       *bool
+	abortable      *bool
+	verifyTree     *bool
+	lenient        *bool
+	diskFull       *bool
+	clockSkew      *bool
+	owners         *bool
+	inline         *int
+	overlap        *bool
+	pack           *bool
+	readTimeout    *time.Duration
+	phaseTimeout   *time.Duration
+}
+
+// AddSenderFlags adds the flags which set the Options of a sender to fs. They
+// are to be parsed before Options is called.
+func AddSenderFlags(fs *flag.FlagSet) *SenderFlags {
+	f := &SenderFlags{
+		noCompression:  fs.Bool("n", false, "`nocompress` disables compression"),
+		verbosity:      fs.Uint("v", 3, "`verbosity`: 0=None, 1=Error, 2=Warn, 3=Info, 4=Debug, 5=Trace"),
+		ignoreSymlinks: fs.Bool("i", false, "`ignore-symlinks` - if set, symlinks are ignored"),
+		signKey:        fs.String("sign-key", "", "sign the transfer with the private key in `file`"),
+		summary:        fs.Bool("summary", false, "ask the receiver for a summary of its copy first, and only send the metadata of what differs (needs a receiver which supports it)"),
+		quick:          fs.Bool("quick", false, "with -summary, take files with the same size and modification time to be unchanged, without hashing them on either side"),
+		streams:        fs.Int("streams", 1, "send the file content over this many `streams`, compressed in parallel (needs a receiver which supports it)"),
+		compressors:    fs.Int("compressors", 1, "compress the data sent on this many `cores`, in blocks of 64K (the receiver is not affected)"),
+		workers:        fs.Int("workers", 1, "read and hash this many `files` at once, when crcs are used"),
+		mmap:           fs.Bool("mmap", false, "map large files into memory to hash them, instead of reading them"),
+		ioUring:        fs.Bool("io-uring", false, "read large files through io_uring, several chunks ahead of what is sent"),
+		dropCache:      fs.Bool("drop-cache", false, "drop the files read from the page cache, and don't update their access times, so that a large sync doesn't push out what applications use"),
+		hashCache:      fs.String("hash-cache", "", "keep the crcs and digests of files in `file` between syncs, and only hash files whose inode, size or modification time changed"),
+		walkCache:      fs.String("walk-cache", "", "keep the listings of directories in `file` between syncs, and only list and stat the entries of directories which changed"),
+		fullWalk:       fs.Duration("full-walk-every", 24*time.Hour, "with -walk-cache, list every directory again after this `duration`, to notice files modified in place"),
+		lazyHash:       fs.Bool("lazy-hash", false, "leave the crcs out of the metadata, and hash only the files the receiver asks for, whose size and modification time are unchanged (needs a receiver which supports it)"),
+		dedup:          fs.Bool("dedup", false, "send the content of identical files once, for the receiver to clone (needs a receiver which supports it)"),
+		digests:        fs.Bool("digests", false, "send the sha256 of each file after its content, for the receiver to check what it wrote (needs a receiver which supports it)"),
+		skipGone:       fs.Bool("skip-gone", false, "skip files which are gone by the time they are sent, instead of failing (needs a receiver which supports it)"),
+		abortable:      fs.Bool("abortable", false, "tell the receiver when the sync is aborted (e.g. on SIGINT), for it to clean up, instead of breaking the connection (needs a receiver which supports it)"),
+		verifyTree:     fs.Bool("verify-tree", false, "after the sync, compare hashes of the whole tree on both sides, reading every file again, and fail if they differ (needs a receiver which supports it)"),
+		lenient:        fs.Bool("lenient", false, "complete the sync even if some files fail, list them, and exit with 4 (needs a receiver which supports it)"),
+		diskFull:       fs.Bool("disk-full-details", false, "when the receiver runs out of space, have it tell which file didn't fit, and about how much space the sync needed (needs a receiver which supports it)"),
+		clockSkew:      fs.Bool("clock-skew", false, "send the current time, for the receiver to allow for the offset of its clock when comparing modification times (needs a receiver which supports it)"),
+		owners:         fs.Bool("owners", false, "send the owners of the items, for a privileged receiver with -owners to apply, symlinks included (needs a receiver which supports it)"),
+		inline:         fs.Int("inline", 0, "send the content of files up to this size (e.g. 4096, at most 65535) with the metadata, instead of waiting for them to be requested (needs a receiver which supports it)"),
+		overlap:        fs.Bool("overlap", false, "let the receiver request files while it still compares the metadata, and send them right away (needs a receiver which supports it)"),
+		pack:           fs.Bool("pack", false, "pack small files into frames of up to a megabyte, sent and received in one go (needs a receiver which supports it)"),
+		readTimeout:    fs.Duration("read-timeout", 0, "fail if the receiver sends nothing for this `duration`, when it's expected to (0 = no timeout)"),
+		phaseTimeout:   fs.Duration("phase-timeout", 0, "fail if the receiver takes longer than this `duration` with a phase of the sync: the metadata, the file list, or the content (0 = no timeout)"),
+	}
+	fs.Var(&f.excludes, "exclude", "don't send items matching `pattern` (repeatable), by name or by path within the directory")
+	return f
+}
+
+// Options returns a copy of base (e.g. the options of a profile), with the
+// flags applied. It fails if a value is out of range, or if the options don't
+// go together (see Options.Validate).
+func (f *SenderFlags) Options(base *Options) (*Options, error) {
+	if *f.verbosity > 5 {
+		return nil, fmt.Errorf("-v must be at most 5, not %d", *f.verbosity)
+	}
+	for _, c := range []struct {
+		name string
+		n    int
+	}{{"streams", *f.streams}, {"compressors", *f.compressors}, {"workers", *f.workers}} {
+		if c.n < 1 {
+			return nil, fmt.Errorf("-%v must be at least 1, not %d", c.name, c.n)
+		}
+	}
+	if *f.inline < 0 || *f.inline > MaxInline {
+		return nil, fmt.Errorf("-inline must be between 0 and %d, not %d", MaxInline, *f.inline)
+	}
+	if *f.fullWalk <= 0 {
+		return nil, fmt.Errorf("-full-walk-every must be positive, not %v", *f.fullWalk)
+	}
+	if *f.readTimeout < 0 || *f.phaseTimeout < 0 {
+		return nil, fmt.Errorf("timeouts can't be negative")
+	}
+	opts := *base
+	opts.Excludes = append(append([]string{}, base.Excludes...), f.excludes...)
+	if *f.noCompression {
+		opts.Compression = CompressionOff
+	}
+	if *f.ignoreSymlinks {
+		opts.IgnoreSymlinks = true
+	}
+	opts.Verbosity = int(*f.verbosity)
+	opts.Summary = *f.summary
+	opts.QuickCheck = *f.quick
+	opts.Streams = *f.streams
+	opts.Compressors = *f.compressors
+	opts.Workers = *f.workers
+	opts.Mmap = *f.mmap
+	opts.IOUring = *f.ioUring
+	opts.DropCache = *f.dropCache
+	opts.HashCache = *f.hashCache
+	opts.WalkCache = *f.walkCache
+	opts.FullWalkEvery = *f.fullWalk
+	opts.LazyHash = *f.lazyHash
+	opts.Dedup = *f.dedup
+	opts.Digests = *f.digests
+	opts.SkipGone = *f.skipGone
+	opts.Abortable = *f.abortable
+	opts.VerifyTree = *f.verifyTree
+	opts.Lenient = *f.lenient
+	opts.DiskFullDetails = *f.diskFull
+	opts.ClockSkew = *f.clockSkew
+	opts.Owners = *f.owners
+	opts.Inline = *f.inline
+	opts.Overlap = *f.overlap
+	opts.Pack = *f.pack
+	opts.ReadTimeout, opts.PhaseTimeout = *f.readTimeout, *f.phaseTimeout
+	if *f.signKey != "" {
+		key, err := LoadSigningKey(*f.signKey)
+		if err != nil {
+			return nil, err
+		}
+		opts.SigningKey = key
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return &opts, nil
+}
+
+// ReceiverFlags are the command line flags which set the ReceiverOptions of a
+// receiver, shared by the commands which receive.
+type ReceiverFlags struct {
+	snapshotCmd   *string
+	audit         *bool
+	auditSize     *int64
+	maxDepth      *int
+	maxDirEntries *int
+	normalize     *string
+	duplicates    *string
+	transactional *bool
+	writeAhead    *string
+	owners        *bool
+	setID         *bool
+	mmap          *bool
+	ioUring       *bool
+	readTimeout   *time.Duration
+	phaseTimeout  *time.Duration
+}
+
+// AddReceiverFlags adds the flags which set the ReceiverOptions of a receiver
+// to fs. They are to be parsed before ReceiverOptions is called.
+func AddReceiverFlags(fs *flag.FlagSet) *ReceiverFlags {
+	return &ReceiverFlags{
+		snapshotCmd:   fs.String("snapshot-cmd", "", "`command` to invoke (space-separated) to snapshot the destination before modifying it"),
+		audit:         fs.Bool("audit", false, "keep an audit log of all changes in .qsync/audit.log"),
+		auditSize:     fs.Int64("audit-max-size", DefaultAuditLogSize, "`bytes` after which the audit log is rotated"),
+		maxDepth:      fs.Int("max-depth", DefaultMaxDepth, "maximum `depth` of received paths"),
+		maxDirEntries: fs.Int("max-dir-entries", DefaultMaxDirEntries, "maximum number of `entries` in a received directory"),
+		normalize:     fs.String("normalize", "", "put the names of received items in the Unicode normalization `form` nfc or nfd"),
+		duplicates:    fs.String("duplicates", "", "`policy` for names which differ only in their normalization: report (the default with -normalize), or merge directories"),
+		transactional: fs.Bool("transactional", false, "receive into a staged copy of the destination, which only takes its place once the sync has completed"),
+		writeAhead:    fs.String("write-ahead", "", "journal each change before it's made, and settle a failed or interrupted sync with the `policy` rollback or complete"),
+		owners:        fs.Bool("owners", false, "give the items the owners the sender sends, if privileged in the initial user namespace"),
+		setID:         fs.Bool("setid", false, "keep the set-user-ID and set-group-ID bits of the items, which are cleared otherwise"),
+		mmap:          fs.Bool("mmap", false, "map large local files into memory to hash them, instead of reading them"),
+		ioUring:       fs.Bool("io-uring", false, "write large files through io_uring, several chunks behind what is received"),
+		readTimeout:   fs.Duration("read-timeout", 0, "fail if the sender sends nothing for this `duration`, when it's expected to (0 = no timeout)"),
+		phaseTimeout:  fs.Duration("phase-timeout", 0, "fail if the sender takes longer than this `duration` with a phase of the sync: the metadata, or the content (0 = no timeout)"),
+	}
+}
+
+// ReceiverOptions returns a copy of base, with the flags applied. It fails if
+// a value is out of range, or unknown.
+func (f *ReceiverFlags) ReceiverOptions(base *ReceiverOptions) (*ReceiverOptions, error) {
+	if *f.auditSize <= 0 {
+		return nil, fmt.Errorf("-audit-max-size must be positive, not %d", *f.auditSize)
+	}
+	if *f.maxDepth < 1 {
+		return nil, fmt.Errorf("-max-depth must be at least 1, not %d", *f.maxDepth)
+	}
+	if *f.maxDirEntries < 1 {
+		return nil, fmt.Errorf("-max-dir-entries must be at least 1, not %d", *f.maxDirEntries)
+	}
+	if *f.readTimeout < 0 || *f.phaseTimeout < 0 {
+		return nil, fmt.Errorf("timeouts can't be negative")
+	}
+	ropts := *base
+	ropts.SnapshotCommand = strings.Fields(*f.snapshotCmd)
+	ropts.AuditLog = *f.audit
+	ropts.AuditLogMaxSize = *f.auditSize
+	ropts.MaxDepth = *f.maxDepth
+	ropts.MaxDirEntries = *f.maxDirEntries
+	ropts.Normalize, ropts.Duplicates = *f.normalize, *f.duplicates
+	ropts.Transactional = *f.transactional
+	ropts.WriteAhead = *f.writeAhead
+	ropts.Owners = *f.owners
+	ropts.SetID = *f.setID
+	ropts.Mmap = *f.mmap
+	ropts.IOUring = *f.ioUring
+	ropts.ReadTimeout, ropts.PhaseTimeout = *f.readTimeout, *f.phaseTimeout
+	if err := checkNormalization(&ropts); err != nil {
+		return nil, err
+	}
+	if err := checkWriteAhead(&ropts); err != nil {
+		return nil, err
+	}
+	return &ropts, nil
+}
+
+// stringList is a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
@@ -0,0 +1,87 @@
+package packer
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+// With FlagGone, a file or symlink requested in the data phase may be sent as
+// a header with its path, and the mode os.ModeIrregular, if it's gone by the
+// time it's sent, or is no longer a file or symlink. Nothing follows it: no
+// clone source (FlagDedup), content, or digest (FlagDigests). The receiver
+// leaves its copy of the item as it is. With FlagLazyHash, the crc of such an
+// item is sent as 0, so that it's most likely requested, and sent as gone.
+// OBS: This is not part of the qvm-copy protocol.
+
+// errGone is returned by itemInfo for an item which is gone, with SkipGone.
+var errGone = errors.New("gone")
+
+// goneItem returns whether the item at the given index is to be skipped as
+// gone, given the result of statting (or reading) it.
+func (s *Sender) goneItem(index uint32, info os.FileInfo, err error) bool {
+	if !s.opts.SkipGone {
+		return false
+	}
+	if err != nil {
+		return errors.Is(err, os.ErrNotExist)
+	}
+	return info.Mode()&regularOrSymlink != s.sendInfos[index].Mode()&regularOrSymlink
+}
+
+// writeGone writes the item at the given index to out as gone. There is no
+// sentItem, as nothing was sent.
+func (s *Sender) writeGone(out io.Writer, index uint32) (*sentItem, error) {
+	if s.opts.Verbosity >= 2 {
+		log.Printf("Skipping %v, which is gone", s.sendNames[index])
+	}
+	s.gone = append(s.gone, s.sendNames[index])
+	return nil, goneHeader(s.sendNames[index]).marshallBinary(out)
+}
+
+// goneHeader returns the header of the item sent as name, as gone.
+func goneHeader(name string) *fileHeader {
+	hdr := &fileHeader{path: name}
+	hdr.Data.NameLen = uint32(len(hdr.path) + 1)
+	hdr.Data.Mode = uint32(os.ModeIrregular)
+	return hdr
+}
+
+// Gone returns the paths of the items skipped by the last sync, since they
+// were gone, see Options.SkipGone.
+func (s *Sender) Gone() []string {
+	return s.gone
+}
+
+// isGone returns whether the header received in place of the announced one
+// is that of an item sent as gone, or as failed (see FlagLenient).
+func (r *Receiver) isGone(hdr, announced *fileHeader) bool {
+	return (r.goneSent || r.lenient) && hdr.path == announced.path && hdr.Data.Mode == uint32(os.ModeIrregular)
+}
+
+// receiveGone leaves the local copy of an item sent as gone, or as failed, as
+// it is. A store leaves it out of the manifest.
+func (r *Receiver) receiveGone(hdr *fileHeader) error {
+	if hdr.Data.FileLen != 0 {
+		if err := r.senderFailed(hdr); err != nil {
+			return err
+		}
+	} else if !r.goneSent {
+		return protocolErrorf("%v sent as gone", hdr.path)
+	} else {
+		if r.opts.Verbosity >= 3 {
+			log.Printf("%v is gone on the sender, leaving it as it is", hdr.path)
+		}
+		r.gone++
+	}
+	if r.stage != "" {
+		if err := r.keepLive(hdr); err != nil {
+			return err
+		}
+	}
+	if r.store != nil {
+		r.dropStoreEntry(r.storeEntries[r.localPath(hdr.path)])
+	}
+	return r.audit.record(auditSkip, r.localPath(hdr.path), 0, 0)
+}
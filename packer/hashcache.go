@@ -0,0 +1,284 @@
+package packer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// hashCache keeps the crcs and digests of files between syncs, by their
+// identity: the device, inode, size and modification time. As long as that is
+// unchanged, the content is taken to be unchanged. See Options.HashCache.
+//
+// On disk, it's a hashCacheHeader followed by a hashCacheRecord for each
+// file. A nil *hashCache is valid, and caches nothing.
+type hashCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[hashCacheKey]*hashCacheRecord
+	today   uint32 // days since the epoch, see hashCacheRecord.Used
+	dirty   bool
+}
+
+type hashCacheKey struct {
+	Dev   uint64
+	Ino   uint64
+	Size  int64
+	Mtime int64 // nanoseconds since the epoch
+}
+
+type hashCacheHeader struct {
+	Magic   [8]byte
+	Version uint32
+	Count   uint32
+}
+
+type hashCacheRecord struct {
+	hashCacheKey
+	Used   uint32 // the day it was last used, in days since the epoch
+	Flags  uint32 // which of Crc and Digest are set, see hashCacheCrc
+	Crc    uint32
+	Digest [32]byte // sha256, see digestItem
+}
+
+const (
+	hashCacheCrc = 1 << iota
+	hashCacheDigest
+)
+
+const (
+	hashCacheMagic   = "qsynchc\x00"
+	hashCacheVersion = 1
+	// hashCacheKeep is the number of days an entry is kept without being
+	// used, e.g. for a file which is gone.
+	hashCacheKeep = 30
+	// racyWindow is how recently a file may have been modified for its
+	// hashes not to be cached, or its mtime trusted: it could be modified
+	// again within the same tick of the clock, leaving its mtime the same.
+	racyWindow = 2 * time.Second
+)
+
+// openHashCache reads the cache at path. If it doesn't exist yet, it is
+// empty. If it can't be read, it's empty as well, and the error is returned
+// along with it, since it's no reason for a sync to fail.
+func openHashCache(path string) (*hashCache, error) {
+	c := &hashCache{
+		path:    path,
+		entries: make(map[hashCacheKey]*hashCacheRecord),
+		today:   uint32(time.Now().Unix() / 86400),
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+	in := bufio.NewReader(f)
+	var hdr hashCacheHeader
+	if err := binary.Read(in, binary.LittleEndian, &hdr); err != nil {
+		return c, fmt.Errorf("hash cache %v: %v", path, err)
+	}
+	if string(hdr.Magic[:]) != hashCacheMagic || hdr.Version != hashCacheVersion {
+		return c, fmt.Errorf("hash cache %v: unsupported format", path)
+	}
+	for i := uint32(0); i < hdr.Count; i++ {
+		rec := new(hashCacheRecord)
+		if err := binary.Read(in, binary.LittleEndian, rec); err != nil {
+			c.entries = make(map[hashCacheKey]*hashCacheRecord)
+			return c, fmt.Errorf("hash cache %v: %v", path, err)
+		}
+		c.entries[rec.hashCacheKey] = rec
+	}
+	return c, nil
+}
+
+// racy returns whether the file was modified within racyWindow.
+func racy(info os.FileInfo) bool {
+	return time.Since(info.ModTime()) < racyWindow
+}
+
+// cacheKey returns the identity of a file, if it has one.
+func cacheKey(info os.FileInfo) (hashCacheKey, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.Mode().IsRegular() {
+		return hashCacheKey{}, false
+	}
+	return hashCacheKey{
+		Dev:   uint64(st.Dev),
+		Ino:   uint64(st.Ino),
+		Size:  info.Size(),
+		Mtime: info.ModTime().UnixNano(),
+	}, true
+}
+
+// lookup returns the record of the file, if it has one with the given flag.
+func (c *hashCache) lookup(info os.FileInfo, flag uint32) *hashCacheRecord {
+	if c == nil {
+		return nil
+	}
+	key, ok := cacheKey(info)
+	if !ok {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rec := c.entries[key]
+	if rec == nil || rec.Flags&flag == 0 {
+		return nil
+	}
+	if rec.Used != c.today {
+		rec.Used, c.dirty = c.today, true
+	}
+	return rec
+}
+
+// update sets the hashes of the file with fn, unless it was modified too
+// recently.
+func (c *hashCache) update(info os.FileInfo, fn func(rec *hashCacheRecord)) {
+	if c == nil || racy(info) {
+		return
+	}
+	key, ok := cacheKey(info)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rec := c.entries[key]
+	if rec == nil {
+		rec = &hashCacheRecord{hashCacheKey: key}
+		c.entries[key] = rec
+	}
+	rec.Used = c.today
+	fn(rec)
+	c.dirty = true
+}
+
+// crc returns the cached crc of the file.
+func (c *hashCache) crc(info os.FileInfo) (uint32, bool) {
+	if rec := c.lookup(info, hashCacheCrc); rec != nil {
+		return rec.Crc, true
+	}
+	return 0, false
+}
+
+func (c *hashCache) setCrc(info os.FileInfo, crc uint32) {
+	c.update(info, func(rec *hashCacheRecord) {
+		rec.Crc = crc
+		rec.Flags |= hashCacheCrc
+	})
+}
+
+// digest returns the cached digest of the file.
+func (c *hashCache) digest(info os.FileInfo) ([]byte, bool) {
+	if rec := c.lookup(info, hashCacheDigest); rec != nil {
+		return append([]byte(nil), rec.Digest[:]...), true
+	}
+	return nil, false
+}
+
+func (c *hashCache) setDigest(info os.FileInfo, digest []byte) {
+	c.update(info, func(rec *hashCacheRecord) {
+		copy(rec.Digest[:], digest)
+		rec.Flags |= hashCacheDigest
+	})
+}
+
+// save writes the cache, if anything changed, leaving out the entries which
+// haven't been used for hashCacheKeep days. It replaces the file atomically,
+// so that concurrent syncs at worst lose each other's updates.
+func (c *hashCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	var records []*hashCacheRecord
+	for _, rec := range c.entries {
+		if c.today-rec.Used <= hashCacheKeep {
+			records = append(records, rec)
+		}
+	}
+	dir := filepath.Dir(c.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".hashcache-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := writeHashCache(f, records); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+func writeHashCache(w io.Writer, records []*hashCacheRecord) error {
+	out := bufio.NewWriter(w)
+	hdr := hashCacheHeader{Version: hashCacheVersion, Count: uint32(len(records))}
+	copy(hdr.Magic[:], hashCacheMagic)
+	if err := binary.Write(out, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := binary.Write(out, binary.LittleEndian, rec); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// loadHashCache opens the cache of a sync, if opts.HashCache is set. If it
+// can't be read, that's logged, and the sync starts with an empty one.
+func loadHashCache(opts *Options) *hashCache {
+	if opts.HashCache == "" {
+		return nil
+	}
+	c, err := openHashCache(opts.HashCache)
+	if err != nil && opts.Verbosity >= 2 {
+		log.Printf("Ignoring hash cache: %v", err)
+	}
+	return c
+}
+
+// saveHashCache saves the cache of a sync. Failing to is only logged.
+func saveHashCache(c *hashCache, opts *Options) {
+	if err := c.save(); err != nil && opts.Verbosity >= 2 {
+		log.Printf("Saving hash cache failed: %v", err)
+	}
+}
+
+// crc returns the crc of the file at path, from the cache, from the pool, or
+// computed, and caches it.
+func (s *Sender) crc(path string, info os.FileInfo) (uint32, error) {
+	if crc, ok := s.cache.crc(info); ok {
+		return crc, nil
+	}
+	crc, err := s.crcs.crc(s.src, path, info)
+	if err == nil {
+		s.cache.setCrc(info, crc)
+	}
+	return crc, err
+}
@@ -0,0 +1,71 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrSkipItem can be returned by Hooks.PostFile on the receiving side, to
+// leave the received file out, without failing the sync.
+var ErrSkipItem = errors.New("skip item")
+
+// Filter decides which items are synced, and under which name. It is called
+// with the path of each item below the synced directory (as sent, e.g.
+// "dir/sub/file"), and its mode. It returns the path to use instead, or false
+// if the item is to be left out. Leaving out a directory leaves out all of its
+// content.
+//
+// A new path must be within the same directory as the original, as the
+// protocol sends a tree. Filters must not map two items to the same path.
+type Filter interface {
+	Filter(path string, mode os.FileMode) (string, bool)
+}
+
+// FilterFunc adapts a function to a Filter.
+type FilterFunc func(path string, mode os.FileMode) (string, bool)
+
+func (f FilterFunc) Filter(path string, mode os.FileMode) (string, bool) {
+	return f(path, mode)
+}
+
+// Hooks are called at points in the lifecycle of a sync. Embed NoHooks to
+// implement only some of them.
+type Hooks interface {
+	// PreSync is called before anything is transferred, with the synced
+	// directory on the sending side, and the root on the receiving side. An
+	// error cancels the sync.
+	PreSync(path string) error
+	// PostFile is called for each file or symlink transferred, with its path
+	// and the local file holding its content ("" for symlinks). On the
+	// receiving side it is called before the file is put in place, so that
+	// it can be inspected; ErrSkipItem leaves it out. Any other error fails
+	// the sync.
+	PostFile(path, local string) error
+	// PostSync is called when the sync is done, with its result.
+	PostSync(err error)
+}
+
+// NoHooks implements Hooks, doing nothing.
+type NoHooks struct{}
+
+func (NoHooks) PreSync(path string) error         { return nil }
+func (NoHooks) PostFile(path, local string) error { return nil }
+func (NoHooks) PostSync(err error)                {}
+
+// applyFilter runs the filter on the item at path, and checks the result.
+func applyFilter(f Filter, path string, mode os.FileMode) (string, bool, error) {
+	if f == nil {
+		return path, true, nil
+	}
+	name, ok := f.Filter(path, mode)
+	if !ok || name == path {
+		return path, ok, nil
+	}
+	dir, base := filepath.Split(name)
+	if filepath.Clean(dir) != filepath.Dir(path) || base == "" || base == "." || base == ".." {
+		return "", false, fmt.Errorf("filter moved %v to %v, outside of its directory", path, name)
+	}
+	return filepath.Join(filepath.Dir(path), base), true, nil
+}
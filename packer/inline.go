@@ -0,0 +1,107 @@
+package packer
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+)
+
+// With FlagInline, the header of each regular file in the metadata whose size
+// is at most the Inline field of the version header is followed by its
+// content. The receiver then never requests it: if the file is to be updated,
+// it's received from what came with the metadata, and otherwise the content is
+// dropped. This saves the round trip for the long tail of tiny files, at the
+// cost of sending those which are unchanged as well.
+// OBS: This is not part of the qvm-copy protocol.
+
+// MaxInline is the largest size up to which files can be inlined.
+const MaxInline = 1<<16 - 1
+
+// isInlined returns whether the content of the item follows its header in the
+// metadata, when files up to max bytes are inlined.
+func isInlined(hdr *fileHeader, max uint64) bool {
+	return max > 0 && hdr.isRegular() && hdr.Data.FileLen <= max
+}
+
+// readHeader reads a header of the metadata, and the owner (see FlagOwners)
+// and the content which follow it, if they're sent.
+func readHeader(in io.Reader, max uint64, owners bool) (*fileHeader, error) {
+	hdr, err := unMarshallBinary(in)
+	if err != nil {
+		return nil, err
+	}
+	if owners && hdr.Data.NameLen != 0 {
+		if err := readOwner(in, hdr); err != nil {
+			return nil, err
+		}
+	}
+	if !isInlined(hdr, max) {
+		return hdr, nil
+	}
+	hdr.inline = make([]byte, hdr.Data.FileLen)
+	if _, err := io.ReadFull(in, hdr.inline); err != nil {
+		return nil, fmt.Errorf("failed reading content of %v: %v", hdr.path, err)
+	}
+	return hdr, nil
+}
+
+// readInline returns the content of the file at path, to be sent with its
+// header. If it shrank since it was statted, the header is made to match.
+func (s *Sender) readInline(path string, header *fileHeader) ([]byte, error) {
+	f, err := s.src.Open(filepath.Join(s.root, path))
+	if err != nil {
+		return nil, fmt.Errorf("file %v no longer available: %v", path, err)
+	}
+	defer f.Close()
+	defer dropCache(s.src, f)
+	data := make([]byte, header.Data.FileLen)
+	n, err := io.ReadFull(f, data)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		header.Data.FileLen = uint64(n)
+		return data[:n], nil
+	}
+	return data, err
+}
+
+// receiveInlined receives the items requested so far whose content came with
+// the metadata. When overlapping, they are passed on to be received in turn.
+// An archive or a store takes them after the metadata, see receiveFullData.
+func (r *Receiver) receiveInlined() error {
+	if len(r.inlined) == 0 || r.archive != nil || r.store != nil {
+		return nil
+	}
+	for _, index := range r.inlined {
+		if r.queue != nil {
+			r.requested <- requestedItem{index, r.items[index]}
+			continue
+		}
+		if err := r.receiveInline(index, r.items[index]); err != nil {
+			return err
+		}
+	}
+	r.inlined = r.inlined[:0]
+	return nil
+}
+
+// receiveInline is receiveItem, for an item whose content came with the
+// metadata.
+func (r *Receiver) receiveInline(index uint32, hdr *fileHeader) error {
+	in := r.in
+	r.in = bytes.NewReader(hdr.inline)
+	defer func() { r.in = in }()
+	// Before the header is passed on to be put in place
+	hdr.inline = nil
+	r.trailer = false
+	return r.receiveContent(index, hdr, nil, 0)
+}
+
+// inlineCrc returns the crc of an item whose content came with the metadata,
+// so that it needn't be asked for, see FlagLazyHash.
+func inlineCrc(hdr *fileHeader) (uint32, bool) {
+	if hdr.inline == nil {
+		return 0, false
+	}
+	return crc32.ChecksumIEEE(hdr.inline), true
+}
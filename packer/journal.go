@@ -0,0 +1,156 @@
+package packer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// StateDir is the directory (relative to the receiver root) where the
+	// receiver keeps its own bookkeeping. It is never synced into.
+	StateDir = ".qsync"
+
+	journalFile = "journal"
+)
+
+// JournalEntry is one line in the sync journal, describing a single sync
+// session on the receiver side.
+type JournalEntry struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Snapshot string    `json:"snapshot,omitempty"` // id of pre-sync snapshot, if any
+	Error    string    `json:"error,omitempty"`
+
+	Profile      string `json:"profile,omitempty"` // see ReceiverOptions.Profile
+	Peer         string `json:"peer,omitempty"`    // see ReceiverOptions.Peer
+	Dir          string `json:"dir,omitempty"`     // the synced directory
+	Files        int    `json:"files"`             // files and symlinks received
+	Bytes        uint64 `json:"bytes"`             // size of the files received
+	Deleted      int    `json:"deleted"`
+	DeleteFailed int    `json:"delete_failed,omitempty"` // items which couldn't be deleted
+	Conflicts    int    `json:"conflicts"`               // local changes kept, see ReceiverOptions.Conflict
+	Gone         int    `json:"gone,omitempty"`          // files gone on the sender, see Options.SkipGone
+	Failed       int    `json:"failed,omitempty"`        // items which failed, see Options.Lenient
+	Duplicates   int    `json:"duplicates,omitempty"`    // names differing only in normalization, see ReceiverOptions.Duplicates
+	Undone       int    `json:"undone,omitempty"`        // changes undone from the write-ahead journal, see ReceiverOptions.WriteAhead
+	// Manifest is the sha256 of the metadata received, which identifies the
+	// tree the sender had, unless it sent a summary.
+	Manifest string `json:"manifest,omitempty"`
+}
+
+// appendJournal appends the entry as a json-line to the journal within the
+// given root directory.
+func appendJournal(root string, entry *JournalEntry) error {
+	dir := filepath.Join(root, StateDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, journalFile),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("journal write failed: %v", err)
+	}
+	return f.Close()
+}
+
+// ReadJournal returns the entries of the journal within the given root
+// directory, oldest first.
+func ReadJournal(root string) ([]*JournalEntry, error) {
+	f, err := os.Open(filepath.Join(root, StateDir, journalFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []*JournalEntry
+	for dec := json.NewDecoder(f); ; {
+		entry := new(JournalEntry)
+		if err := dec.Decode(entry); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid journal entry %d: %v", len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// FileEvent is something the receiver did to a file, as recorded in the audit
+// log, see FileHistory.
+type FileEvent struct {
+	Time   time.Time
+	Action string // create, update, delete, link or mkdir
+	Path   string
+	Size   uint64
+	Sync   *JournalEntry // the sync it was part of, if it's in the journal
+}
+
+// FileHistory returns what the syncs into the given root directory did to the
+// item at path (relative to the root, e.g. "docs/a.txt"), oldest first. The
+// events are read from the audit log (see ReceiverOptions.AuditLog), including
+// the rotated ones, so only syncs with the audit log enabled are covered.
+// Items which were unchanged are left out.
+func FileHistory(root, path string) ([]*FileEvent, error) {
+	entries, err := ReadJournal(root)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		events []*FileEvent
+		audit  = filepath.Join(root, StateDir, auditFile)
+	)
+	path = filepath.Clean(path)
+	for i := auditLogKeep; i >= 0; i-- {
+		name := audit
+		if i > 0 {
+			name = fmt.Sprintf("%v.%d", audit, i)
+		}
+		data, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			var (
+				ts, action, p string
+				size          uint64
+				crc           uint32
+			)
+			if n, _ := fmt.Sscanf(line, "%s %s %q size=%d crc32=%x", &ts, &action, &p, &size, &crc); n < 4 {
+				continue
+			}
+			if p != path || action == auditSkip {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339Nano, ts)
+			if err != nil {
+				continue
+			}
+			ev := &FileEvent{Time: t, Action: action, Path: p, Size: size}
+			for _, e := range entries {
+				if !t.Before(e.Start) && !t.After(e.End) {
+					ev.Sync = e
+				}
+			}
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,165 @@
+package packer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// With FlagLazyHash, the sender leaves the crcs out of the metadata (the
+// atimensec is the actual one), and computes them only for the items the
+// receiver asks for: those whose metadata is the same as that of the local
+// copy (or the copy it would link or reuse), so that it takes their content
+// to decide. Items which are new, or whose size or mtime differ, are requested
+// without, and read once, to be sent.
+//
+// After the metadata (and the signature, if any), the receiver sends chunks of
+// indexes, each a uint32 count followed by the indexes, like the request
+// list. The sender replies to each with the crcs of the items, a uint32 each,
+// in the same order, and flushes. A chunk with a count of zero ends them; the
+// result of phase 1 and the request list follow, as usual. The receiver waits
+// for the crcs of a chunk before it sends the next, so that neither is blocked
+// writing while the other is.
+// OBS: This is not part of the qvm-copy protocol.
+
+// hashBatch is the most crcs asked for in one chunk.
+const hashBatch = 256
+
+// lazyHash returns whether the receiver asks for the crc of an item whose
+// metadata is unchanged, rather than taking it from the metadata.
+func (r *Receiver) lazyHash(hdr *fileHeader) bool {
+	return r.lazyHashing && r.useCrc(hdr.path)
+}
+
+// receiveHashes asks for the crcs of the items whose metadata left it open
+// whether they changed, a chunk at a time, and decides on each as its crc
+// arrives.
+func (r *Receiver) receiveHashes() error {
+	var pending []uint32
+	if !r.isAborted() && r.failure == nil {
+		// The sender is told after the crcs, see abort
+		for _, index := range r.hashPending {
+			hdr := r.items[index]
+			crc, ok := inlineCrc(hdr)
+			if !ok {
+				pending = append(pending, index)
+				continue
+			}
+			inlined := len(r.inlined)
+			if err := r.hashReceived(index, hdr, crc); err != nil {
+				return fmt.Errorf("error processing metadata for %v: %v", hdr.path, err)
+			}
+			if len(r.inlined) == inlined {
+				hdr.inline = nil
+			}
+		}
+	}
+	r.hashPending = nil
+	if r.opts.Verbosity >= 3 && len(pending) > 0 {
+		log.Printf("Asking for %d crcs", len(pending))
+	}
+	buf := make([]byte, 4*hashBatch)
+	for len(pending) > 0 {
+		chunk := pending
+		if len(chunk) > hashBatch {
+			chunk = chunk[:hashBatch]
+		}
+		pending = pending[len(chunk):]
+		if err := writeRequests(r.out, chunk); err != nil {
+			return err
+		}
+		if err := r.out.Flush(); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r.in, buf[:4*len(chunk)]); err != nil {
+			return fmt.Errorf("failed reading crcs: %v", err)
+		}
+		for i, index := range chunk {
+			hdr := r.items[index]
+			if err := r.hashReceived(index, hdr, binary.LittleEndian.Uint32(buf[4*i:])); err != nil {
+				return fmt.Errorf("error processing metadata for %v: %v", hdr.path, err)
+			}
+		}
+	}
+	if err := writeRequests(r.out, nil); err != nil {
+		return err
+	}
+	return r.out.Flush()
+}
+
+// hashReceived decides on the item with the given index, whose crc the sender
+// sent, the same way as if it had been in the metadata.
+func (r *Receiver) hashReceived(index uint32, hdr *fileHeader, crc uint32) error {
+	if r.store != nil {
+		return r.storeHashed(index, hdr, crc)
+	}
+	info, err := r.fs.Lstat(r.local(hdr.path))
+	if os.IsNotExist(err) {
+		// Asked for by linkPrevious
+		if prev, prevInfo, err := r.previous(hdr.path); err == nil {
+			if linked, err := r.linkFrom(hdr, prev, prevInfo, crc); linked || err != nil {
+				return err
+			}
+		}
+		r.request(index)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return r.compareCrc(index, hdr, info, crc)
+}
+
+// sendHashes replies to the chunks of indexes the receiver sends after the
+// metadata, with the crcs of the items.
+func (s *Sender) sendHashes() error {
+	if s.opts.Workers > 1 {
+		s.crcs = newCrcPool(s.src, s.cache, s.opts.Workers)
+		defer func() {
+			s.crcs.close()
+			s.crcs = nil
+		}()
+	}
+	for {
+		list, err := readRequests(s.in, uint32(len(s.sendList)))
+		if err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			return nil
+		}
+		if s.opts.Verbosity >= 4 {
+			log.Printf("Got %d crc requests", len(list))
+		}
+		for _, index := range list {
+			if index >= uint32(len(s.sendList)) {
+				return fmt.Errorf("index %d not in list (length %d)", index, len(s.sendList))
+			}
+			if s.crcs != nil {
+				s.crcs.add(filepath.Join(s.root, s.sendList[index]), s.sendInfos[index])
+			}
+		}
+		buf := make([]byte, 4*len(list))
+		for i, index := range list {
+			crc, err := s.crc(filepath.Join(s.root, s.sendList[index]), s.sendInfos[index])
+			if err != nil && (s.goneItem(index, nil, err) || s.opts.Lenient) {
+				// To be requested, and sent as gone, or as failed, see
+				// FlagGone and FlagLenient
+				crc, err = 0, nil
+			}
+			if err != nil {
+				return fmt.Errorf("crc failed: %v", err)
+			}
+			binary.LittleEndian.PutUint32(buf[4*i:], crc)
+		}
+		if _, err := s.out.Write(buf); err != nil {
+			return err
+		}
+		if err := s.out.Flush(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"syscall"
+)
+
+// With FlagLenient, a file or symlink which fails, on either side, is skipped
+// instead of failing the sync, as long as the failure is confined to it:
+//   - one which the sender can't read in the data phase is sent as gone (see
+//     FlagGone), with the errno of the failure in place of the size. In the
+//     metadata, its crc is sent as 0, so that it's most likely requested.
+//   - one which the receiver can't create, or put in place (e.g. for lack of
+//     permissions, or since a PostFile hook rejected it), is dropped, once
+//     its content has been read. The local copy is left as it is.
+//
+// After the final result, the receiver sends the failures of both sides: their
+// number (uint32), and for each, a failureHeader and the path. Anything else,
+// such as a directory, a limit, a checksum, the content which can't be written
+// as it's read, running out of space, or the connection, fails the sync as
+// without it.
+// OBS: This is not part of the qvm-copy protocol.
+
+// failureHeader precedes the path of an item which failed, see FlagLenient.
+type failureHeader struct {
+	Code    uint32
+	Sender  uint32 // 1 if it failed on the sender
+	NameLen uint32
+}
+
+// itemError is returned by itemInfo for an item which can't be read, in a
+// lenient sync. It's sent as failed, see writeFailed.
+type itemError struct {
+	err error
+}
+
+func (e *itemError) Error() string { return e.err.Error() }
+
+func (e *itemError) Unwrap() error { return e.err }
+
+// unreadable returns err, the failure to read an item, as an *itemError in a
+// lenient sync.
+func (s *Sender) unreadable(err error) error {
+	if s.opts.Lenient {
+		return &itemError{err}
+	}
+	return err
+}
+
+// writeFailed writes the item at the given index to out as failed, with the
+// errno of err.
+func (s *Sender) writeFailed(out io.Writer, index uint32, err error) (*sentItem, error) {
+	if s.opts.Verbosity >= 2 {
+		log.Printf("Skipping %v, which can't be read: %v", s.sendNames[index], err)
+	}
+	hdr := goneHeader(s.sendNames[index])
+	hdr.Data.FileLen = uint64(errorCode(err))
+	return nil, hdr.marshallBinary(out)
+}
+
+// readFailures reads the failures which the receiver sends after the final
+// result of a lenient sync.
+func readFailures(in io.Reader) ([]ItemFailure, error) {
+	var n uint32
+	if err := binary.Read(in, binary.LittleEndian, &n); err != nil {
+		return nil, fmt.Errorf("failed reading failures: %v", err)
+	}
+	var failures []ItemFailure
+	for i := uint32(0); i < n; i++ {
+		var hdr failureHeader
+		if err := binary.Read(in, binary.LittleEndian, &hdr); err != nil {
+			return nil, fmt.Errorf("failed reading failures: %v", err)
+		}
+		if hdr.NameLen == 0 || hdr.NameLen > MaxPathLength {
+			return nil, protocolErrorf("bad path length of a failure: %d", hdr.NameLen)
+		}
+		name := make([]byte, hdr.NameLen)
+		if _, err := io.ReadFull(in, name); err != nil {
+			return nil, fmt.Errorf("failed reading failures: %v", err)
+		}
+		failures = append(failures, ItemFailure{Path: string(name), Code: ErrorCode(hdr.Code), Sender: hdr.Sender != 0})
+	}
+	return failures, nil
+}
+
+// itemFailed records the failure of the item at path, in a lenient sync, if
+// it's confined to it: a failure of the filesystem, but for running out of
+// space, or a rejection by a hook. It then returns nil, and err otherwise.
+func (r *Receiver) itemFailed(path string, err error) error {
+	err = localIOError(path, err)
+	var lerr *LocalIOError
+	if !r.lenient || err == nil || !(errors.As(err, &lerr) || errors.Is(err, ErrRejected)) || isOutOfSpace(err) {
+		return err
+	}
+	r.addFailure(ItemFailure{Path: path, Code: errorCode(err)})
+	return nil
+}
+
+// skipContent is itemFailed, for a file which failed before its content was
+// read. The content, and its digest, are read and discarded.
+func (r *Receiver) skipContent(hdr *fileHeader, err error) error {
+	if err := r.itemFailed(hdr.path, err); err != nil {
+		return err
+	}
+	n := int64(hdr.Data.FileLen)
+	if r.trailer {
+		n += sha256.Size
+	}
+	_, err = io.CopyN(ioutil.Discard, r.in, n)
+	return err
+}
+
+// senderFailed records the failure of an item which the sender couldn't read,
+// sent as gone, with its errno in place of the size.
+func (r *Receiver) senderFailed(hdr *fileHeader) error {
+	if !r.lenient || hdr.Data.FileLen > uint64(^uint32(0)) {
+		return protocolErrorf("%v sent as failed, with code %d", hdr.path, hdr.Data.FileLen)
+	}
+	r.addFailure(ItemFailure{Path: hdr.path, Code: ErrorCode(hdr.Data.FileLen), Sender: true})
+	return nil
+}
+
+// addFailure records a failure. Files may be put in place concurrently, see
+// finishLater.
+func (r *Receiver) addFailure(f ItemFailure) {
+	if r.opts.Verbosity >= 2 {
+		log.Printf("Skipping %v", f)
+	}
+	r.failMu.Lock()
+	defer r.failMu.Unlock()
+	r.failures = append(r.failures, f)
+}
+
+// hasFailed returns whether the item at path failed.
+func (r *Receiver) hasFailed(path string) bool {
+	r.failMu.Lock()
+	defer r.failMu.Unlock()
+	for _, f := range r.failures {
+		if f.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// cloneFailed returns the error of a clone from an item which failed.
+func cloneFailed(path, source string) error {
+	return &LocalIOError{Path: path, Err: fmt.Errorf("item %v can't be cloned from %v, which failed: %w", path, source, syscall.ENOENT)}
+}
+
+// sendFailures sends the failures of a lenient sync, after the final result.
+func (r *Receiver) sendFailures() error {
+	if err := binary.Write(r.out, binary.LittleEndian, uint32(len(r.failures))); err != nil {
+		return err
+	}
+	for _, f := range r.failures {
+		hdr := failureHeader{Code: uint32(f.Code), NameLen: uint32(len(f.Path))}
+		if f.Sender {
+			hdr.Sender = 1
+		}
+		if err := binary.Write(r.out, binary.LittleEndian, &hdr); err != nil {
+			return err
+		}
+		if _, err := r.out.Write([]byte(f.Path)); err != nil {
+			return err
+		}
+	}
+	return r.out.Flush()
+}
+
+// partial returns the result of a sync which was received, as a
+// *PartialError if some items failed.
+func (r *Receiver) partial() error {
+	if len(r.failures) > 0 {
+		return &PartialError{Failures: r.failures}
+	}
+	return nil
+}
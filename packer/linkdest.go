@@ -0,0 +1,108 @@
+package packer
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// linkSnapshotLatest is the symlink to the last complete snapshot, within
+	// a snapshot directory.
+	linkSnapshotLatest = "latest"
+	// linkSnapshotFormat is the time format snapshots are named by.
+	linkSnapshotFormat = "20060102T150405Z"
+)
+
+// linkPrevious hardlinks the file from the previous copy of the destination
+// (see ReceiverOptions.LinkDest, and Transactional), if it is unchanged there, instead of having
+// it sent. It returns whether it did, or will once the crc is in, see
+// FlagLazyHash.
+//
+// OBS: The link shares the inode with the previous copy. This is fine, since
+// the receiver never modifies a file in place: a changed file is written to a
+// new one, which replaces it.
+func (r *Receiver) linkPrevious(hdr *fileHeader) (bool, error) {
+	if r.linkDest == "" || !hdr.isRegular() {
+		return false, nil
+	}
+	prev, info, err := r.previous(hdr.path)
+	if err != nil || !info.Mode().IsRegular() {
+		return false, nil
+	}
+	if diff := newFileHeaderFromStat(hdr.path, info).Diff(hdr); len(diff) > 0 {
+		return false, nil
+	}
+	if r.lazyHash(hdr) {
+		// Linked once the crc is in, see receiveHashes
+		r.hashPending = append(r.hashPending, r.index)
+		return true, nil
+	}
+	return r.linkFrom(hdr, prev, info, hdr.Data.AtimeNsec)
+}
+
+// previous returns the path of the previous copy of the item at path, and its
+// info. In a transactional sync, that's the live copy, below the root.
+func (r *Receiver) previous(path string) (string, os.FileInfo, error) {
+	prev := filepath.Join(r.linkDest, r.localPath(path))
+	if r.stage != "" {
+		info, err := r.fs.Lstat(prev)
+		return prev, info, err
+	}
+	info, err := os.Lstat(prev)
+	return prev, info, err
+}
+
+// linkFrom hardlinks the file from prev, whose metadata is that of the item,
+// if its crc (when used) is the remote one. It returns whether it did.
+func (r *Receiver) linkFrom(hdr *fileHeader, prev string, info os.FileInfo, remote uint32) (bool, error) {
+	var (
+		crc uint32
+		err error
+	)
+	if r.opts.CrcUsage == FileCrcAtimeNsecMetadata ||
+		r.opts.CrcUsage == FileCrcAtimeNsec {
+		if crc, err = crcItem(r.source(), prev, info); err != nil || crc != remote {
+			return false, nil
+		}
+	}
+	path := r.local(hdr.path)
+	if err := r.createItem(path, func() error { return r.fs.Link(prev, path) }); err != nil {
+		return false, err
+	}
+	if r.opts.Verbosity >= 4 {
+		log.Printf("Linked %v from %v", hdr.path, prev)
+	}
+	return true, r.audit.record(auditLink, r.localPath(hdr.path), hdr.Data.FileLen, crc)
+}
+
+// NewLinkSnapshot creates a new, empty, snapshot within dir, named after the
+// given time. It returns its path, and the path of the last complete snapshot
+// ("" if there is none), to be used as ReceiverOptions.Root and LinkDest.
+// Once the sync is done, it should be marked with CompleteLinkSnapshot.
+func NewLinkSnapshot(dir string, now time.Time) (root, prev string, err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", err
+	}
+	root = filepath.Join(dir, now.UTC().Format(linkSnapshotFormat))
+	if err := os.Mkdir(root, 0755); err != nil {
+		return "", "", err
+	}
+	if target, err := os.Readlink(filepath.Join(dir, linkSnapshotLatest)); err == nil {
+		prev = filepath.Join(dir, target)
+	}
+	return root, prev, nil
+}
+
+// CompleteLinkSnapshot marks the snapshot at root as the last complete one,
+// which the next snapshot is linked from.
+func CompleteLinkSnapshot(root string) error {
+	dir, name := filepath.Split(filepath.Clean(root))
+	tmp := filepath.Join(dir, "."+linkSnapshotLatest)
+	os.Remove(tmp)
+	if err := os.Symlink(name, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, linkSnapshotLatest))
+}
@@ -0,0 +1,45 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"syscall"
+)
+
+// mmapMin is the smallest file which is mapped, see mapItem. For smaller
+// ones, setting up the mapping costs more than the copy saves.
+const mmapMin = 1 << 20
+
+// mapItem maps the content of the file f in src, size bytes of it, if src
+// maps files (see Options.Mmap) and it's large enough. It returns nil if it
+// doesn't, and the file is to be read as usual.
+func mapItem(src source, f io.Reader, size int64) []byte {
+	file, ok := f.(*os.File)
+	if s, isOS := src.(osSource); !isOS || !s.mmap || !ok || size < mmapMin || size != int64(int(size)) {
+		return nil
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		// E.g. a filesystem which doesn't support it
+		return nil
+	}
+	syscall.Madvise(data, syscall.MADV_SEQUENTIAL)
+	return data
+}
+
+// hashMapped feeds data, as returned by mapItem, to hash, and unmaps it. If the
+// file was truncated meanwhile, reading past its end faults, which is
+// returned as an error, like reading it would.
+func hashMapped(path string, data []byte, hash func([]byte)) (err error) {
+	defer syscall.Munmap(data)
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if recover() != nil {
+			err = fmt.Errorf("%v: unexpected end of file", path)
+		}
+	}()
+	hash(data)
+	return nil
+}
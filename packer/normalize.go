@@ -0,0 +1,111 @@
+package packer
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The Unicode normalization forms of ReceiverOptions.Normalize.
+const (
+	NormalizeNFC = "nfc" // composed, as most systems create names
+	NormalizeNFD = "nfd" // decomposed, as macOS used to store them
+)
+
+// The policies of ReceiverOptions.Duplicates.
+const (
+	DuplicatesReport = "report"
+	DuplicatesMerge  = "merge"
+)
+
+// normEntry is the first item received with a normalized name, see normalize.
+type normEntry struct {
+	path string // local
+	dir  bool
+}
+
+// normForm returns the normalization form named by name, if any.
+func normForm(name string) (norm.Form, bool) {
+	switch name {
+	case NormalizeNFC:
+		return norm.NFC, true
+	case NormalizeNFD:
+		return norm.NFD, true
+	}
+	return 0, false
+}
+
+// checkNormalization checks the normalization options of ropts.
+func checkNormalization(ropts *ReceiverOptions) error {
+	if _, ok := normForm(ropts.Normalize); !ok && ropts.Normalize != "" {
+		return fmt.Errorf("unknown normalization %q", ropts.Normalize)
+	}
+	if ropts.Duplicates != "" && ropts.Duplicates != DuplicatesReport && ropts.Duplicates != DuplicatesMerge {
+		return fmt.Errorf("unknown policy for duplicates %q", ropts.Duplicates)
+	}
+	return nil
+}
+
+// duplicatePolicy returns the policy for items whose names differ only in
+// their normalization, "" if they're not looked for.
+func (r *Receiver) duplicatePolicy() string {
+	if r.ropts.Duplicates == "" && r.ropts.Normalize != "" {
+		return DuplicatesReport
+	}
+	return r.ropts.Duplicates
+}
+
+// renames returns whether items may be received under another name than
+// they're sent as, by the filter or the normalization of their names.
+func (r *Receiver) renames() bool {
+	return r.ropts.Filter != nil || r.ropts.Normalize != "" || r.ropts.Duplicates == DuplicatesMerge
+}
+
+// normalize returns the local path of the item, which would otherwise be
+// local, with its name normalized, and whether it's left out, as a duplicate
+// of one received before. A directory merged into one before is received in
+// its place, see ReceiverOptions.Duplicates.
+func (r *Receiver) normalize(hdr *fileHeader, local string) (string, bool) {
+	dir, name := filepath.Split(local)
+	if form, ok := normForm(r.ropts.Normalize); ok && utf8.ValidString(name) {
+		name = form.String(name)
+		local = filepath.Join(dir, name)
+	}
+	policy := r.duplicatePolicy()
+	if policy == "" {
+		return local, false
+	}
+	if r.normNames == nil {
+		r.normNames = make(map[string]normEntry)
+	}
+	key := filepath.Join(dir, norm.NFC.String(name))
+	first, seen := r.normNames[key]
+	if !seen {
+		r.normNames[key] = normEntry{local, hdr.isDir()}
+		return local, false
+	}
+	r.duplicates++
+	switch {
+	case policy == DuplicatesMerge && first.dir && hdr.isDir():
+		if r.opts.Verbosity >= 2 {
+			log.Printf("Merging %v into %v, whose name differs only in normalization", hdr.path, first.path)
+		}
+		// Its content is received already, and isn't to be deleted
+		if abs, err := filepath.Abs(filepath.Join(r.root, r.stage, first.path)); err == nil {
+			r.snapshots[abs] = make(map[string]struct{})
+		}
+		return first.path, false
+	case policy == DuplicatesReport && local != first.path:
+		if r.opts.Verbosity >= 2 {
+			log.Printf("Name of %v differs only in normalization from %v", hdr.path, first.path)
+		}
+		return local, false
+	}
+	if r.opts.Verbosity >= 2 {
+		log.Printf("Leaving out %v, whose name differs only in normalization from %v", hdr.path, first.path)
+	}
+	return "", true
+}
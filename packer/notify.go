@@ -0,0 +1,80 @@
+package packer
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// When to show desktop notifications, see Notify.
+const (
+	NotifyOff    = iota
+	NotifyErrors // only when a sync fails
+	NotifyAlways
+)
+
+// ParseNotify parses when to notify: "off", "errors" or "always".
+func ParseNotify(when string) (int, error) {
+	switch when {
+	case "off", "":
+		return NotifyOff, nil
+	case "errors":
+		return NotifyErrors, nil
+	case "always":
+		return NotifyAlways, nil
+	}
+	return 0, fmt.Errorf("invalid notify setting %q, expected off, errors or always", when)
+}
+
+// SyncSummary describes a completed sync, for Notify.
+type SyncSummary struct {
+	Dir    string
+	Target string // if known
+	Files  int    // files and symlinks sent
+	Bytes  uint64 // size of the files sent
+	Err    error  // if the sync failed
+}
+
+// Notify shows a desktop notification about the sync, via notify-send,
+// depending on when (NotifyErrors or NotifyAlways).
+func Notify(when int, s *SyncSummary) error {
+	if when == NotifyOff || (when == NotifyErrors && s.Err == nil) {
+		return nil
+	}
+	name := filepath.Base(s.Dir)
+	if s.Target != "" {
+		name = fmt.Sprintf("%v to %v", name, s.Target)
+	}
+	args := []string{"--app-name=qvm-sync"}
+	if s.Err != nil {
+		args = append(args, "--urgency=critical", "--icon=dialog-error",
+			fmt.Sprintf("Sync of %v failed", name), s.Err.Error())
+	} else {
+		files := fmt.Sprintf("%d files", s.Files)
+		if s.Files == 1 {
+			files = "1 file"
+		}
+		args = append(args, "--icon=emblem-synchronizing", fmt.Sprintf("Synced %v", name),
+			fmt.Sprintf("%v, %v", files, formatSize(s.Bytes)))
+	}
+	if out, err := exec.Command("notify-send", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("notify-send failed: %v %v", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// formatSize formats a size in bytes for humans, e.g. 3.4 MB.
+func formatSize(size uint64) string {
+	if size < 1000 {
+		return fmt.Sprintf("%d bytes", size)
+	}
+	value, unit := float64(size)/1000, "kB"
+	for _, u := range []string{"MB", "GB", "TB"} {
+		if value < 1000 {
+			break
+		}
+		value, unit = value/1000, u
+	}
+	return fmt.Sprintf("%.1f %v", value, unit)
+}
@@ -0,0 +1,391 @@
+package packer
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Option configures the Options of a sender, see NewOptions.
+type Option func(*Options)
+
+// NewOptions returns a copy of DefaultOptions, with the given options applied.
+func NewOptions(opts ...Option) *Options {
+	o := *DefaultOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &o
+}
+
+// WithVerbosity sets the log level, for both sides of the sync.
+func WithVerbosity(level int) Option {
+	return func(o *Options) { o.Verbosity = level }
+}
+
+// WithCompression sets the compression, CompressionOff or CompressionSnappy.
+func WithCompression(compression int) Option {
+	return func(o *Options) { o.Compression = compression }
+}
+
+// WithCrcUsage sets how file content is compared, e.g. FileCrcOff.
+func WithCrcUsage(usage int) Option {
+	return func(o *Options) { o.CrcUsage = usage }
+}
+
+// WithIgnoreSymlinks makes the sender skip symlinks.
+func WithIgnoreSymlinks() Option {
+	return func(o *Options) { o.IgnoreSymlinks = true }
+}
+
+// WithExcludes adds patterns of items which are not sent, see Options.Excludes.
+func WithExcludes(patterns ...string) Option {
+	return func(o *Options) { o.Excludes = append(o.Excludes, patterns...) }
+}
+
+// WithSigningKey makes the sender sign the transfer with the given key.
+func WithSigningKey(key ed25519.PrivateKey) Option {
+	return func(o *Options) { o.SigningKey = key }
+}
+
+// WithProgress sets a callback for each item sent, see Options.Progress.
+func WithProgress(fn func(path string, size uint64)) Option {
+	return func(o *Options) { o.Progress = fn }
+}
+
+// WithFilter sets the filter deciding which items are sent, and as what.
+func WithFilter(f Filter) Option {
+	return func(o *Options) { o.Filter = f }
+}
+
+// WithHooks sets the hooks called during the sync.
+func WithHooks(h Hooks) Option {
+	return func(o *Options) { o.Hooks = h }
+}
+
+// WithSummary makes the sender ask the receiver for a summary of its copy,
+// see Options.Summary.
+func WithSummary() Option {
+	return func(o *Options) { o.Summary = true }
+}
+
+// WithSubtrees adds options for subtrees of the synced directory, see
+// Subtree.
+func WithSubtrees(subtrees ...*Subtree) Option {
+	return func(o *Options) { o.Subtrees = append(o.Subtrees, subtrees...) }
+}
+
+// WithOverlap makes the receiver request files while it still processes the
+// metadata, see Options.Overlap.
+func WithOverlap() Option {
+	return func(o *Options) { o.Overlap = true }
+}
+
+// WithPack makes the sender pack small files into frames, see Options.Pack.
+func WithPack() Option {
+	return func(o *Options) { o.Pack = true }
+}
+
+// WithMmap makes the sender map large files to hash them, see Options.Mmap.
+func WithMmap() Option {
+	return func(o *Options) { o.Mmap = true }
+}
+
+// WithIOUring makes the sender read large files through an io_uring, see
+// Options.IOUring.
+func WithIOUring() Option {
+	return func(o *Options) { o.IOUring = true }
+}
+
+// WithDropCache makes the sender drop the files it reads from the page cache,
+// see Options.DropCache.
+func WithDropCache() Option {
+	return func(o *Options) { o.DropCache = true }
+}
+
+// WithHashCache makes the sender keep the hashes of files in the file at
+// path, see Options.HashCache.
+func WithHashCache(path string) Option {
+	return func(o *Options) { o.HashCache = path }
+}
+
+// WithWalkCache makes the sender keep the listings of directories in the file
+// at path, see Options.WalkCache.
+func WithWalkCache(path string) Option {
+	return func(o *Options) { o.WalkCache = path }
+}
+
+// WithLazyHash makes the sender hash files only when the receiver asks, see
+// Options.LazyHash.
+func WithLazyHash() Option {
+	return func(o *Options) { o.LazyHash = true }
+}
+
+// WithDedup makes the sender send the content of identical files once, see
+// Options.Dedup.
+func WithDedup() Option {
+	return func(o *Options) { o.Dedup = true }
+}
+
+// WithInline makes the sender send the content of files up to size bytes with
+// their metadata, see Options.Inline.
+func WithInline(size int) Option {
+	return func(o *Options) { o.Inline = size }
+}
+
+// WithDigests makes the sender send the sha256 of each file after its content,
+// see Options.Digests.
+func WithDigests() Option {
+	return func(o *Options) { o.Digests = true }
+}
+
+// WithSkipGone makes the sender skip files which are gone by the time they're
+// sent, see Options.SkipGone.
+func WithSkipGone() Option {
+	return func(o *Options) { o.SkipGone = true }
+}
+
+// WithAbortable makes the sender tell the receiver when it aborts the sync, see
+// Options.Abortable.
+func WithAbortable() Option {
+	return func(o *Options) { o.Abortable = true }
+}
+
+// WithVerifyTree makes both sides compare their trees after the sync, see
+// Options.VerifyTree.
+func WithVerifyTree() Option {
+	return func(o *Options) { o.VerifyTree = true }
+}
+
+// WithLenient makes the sync complete even if some files fail, see
+// Options.Lenient.
+func WithLenient() Option {
+	return func(o *Options) { o.Lenient = true }
+}
+
+// WithDiskFullDetails makes the receiver tell what didn't fit when it runs out
+// of space, see Options.DiskFullDetails.
+func WithDiskFullDetails() Option {
+	return func(o *Options) { o.DiskFullDetails = true }
+}
+
+// WithClockSkew makes the sender send its time, for the comparisons to allow
+// for the offset of the clocks, see Options.ClockSkew.
+func WithClockSkew() Option {
+	return func(o *Options) { o.ClockSkew = true }
+}
+
+// WithOwners makes the sender send the owners of the items, see
+// Options.Owners.
+func WithOwners() Option {
+	return func(o *Options) { o.Owners = true }
+}
+
+// WithQuickCheck makes the sender compare files by size and modification
+// time only, see Options.QuickCheck.
+func WithQuickCheck() Option {
+	return func(o *Options) { o.QuickCheck = true }
+}
+
+// WithCompressors makes the sender compress on n goroutines, see
+// Options.Compressors.
+func WithCompressors(n int) Option {
+	return func(o *Options) { o.Compressors = n }
+}
+
+// WithTimeouts sets how long the sender waits for the receiver, see
+// Options.ReadTimeout.
+func WithTimeouts(read, phase time.Duration) Option {
+	return func(o *Options) { o.ReadTimeout, o.PhaseTimeout = read, phase }
+}
+
+// ReceiverOption configures the ReceiverOptions of a receiver, see
+// NewReceiverOptions.
+type ReceiverOption func(*ReceiverOptions)
+
+// NewReceiverOptions returns a copy of DefaultReceiverOptions, with the given
+// options applied.
+func NewReceiverOptions(opts ...ReceiverOption) *ReceiverOptions {
+	o := *DefaultReceiverOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &o
+}
+
+// WithRoot makes the receiver place the synced directory in dir, instead of
+// the current directory.
+func WithRoot(dir string) ReceiverOption {
+	return func(o *ReceiverOptions) { o.Root = dir }
+}
+
+// WithAuditLog enables the audit log, rotated at maxSize bytes (0 for the
+// default).
+func WithAuditLog(maxSize int64) ReceiverOption {
+	return func(o *ReceiverOptions) { o.AuditLog, o.AuditLogMaxSize = true, maxSize }
+}
+
+// WithSnapshotCommand sets the command which takes a snapshot before the
+// destination is modified, see TakeSnapshot.
+func WithSnapshotCommand(command ...string) ReceiverOption {
+	return func(o *ReceiverOptions) { o.SnapshotCommand = command }
+}
+
+// WithLimits sets the maximum path depth and number of entries per directory.
+func WithLimits(maxDepth, maxDirEntries int) ReceiverOption {
+	return func(o *ReceiverOptions) { o.MaxDepth, o.MaxDirEntries = maxDepth, maxDirEntries }
+}
+
+// WithQuota sets the maximum total size of the sync root, in bytes.
+func WithQuota(size uint64) ReceiverOption {
+	return func(o *ReceiverOptions) { o.MaxRootSize = size }
+}
+
+// WithTrustedKey makes the receiver refuse transfers not signed with key.
+func WithTrustedKey(key ed25519.PublicKey) ReceiverOption {
+	return func(o *ReceiverOptions) { o.TrustedKey = key }
+}
+
+// WithReceiveProgress sets a callback for each item received, see
+// ReceiverOptions.Progress.
+func WithReceiveProgress(fn func(path string, size uint64)) ReceiverOption {
+	return func(o *ReceiverOptions) { o.Progress = fn }
+}
+
+// WithLinkDest makes the receiver hardlink unchanged files from a previous
+// copy of the destination, see ReceiverOptions.LinkDest.
+func WithLinkDest(dir string) ReceiverOption {
+	return func(o *ReceiverOptions) { o.LinkDest = dir }
+}
+
+// WithStore makes the receiver receive into the store, recording the sync as a
+// manifest of the given source.
+func WithStore(store *Store, source string) ReceiverOption {
+	return func(o *ReceiverOptions) { o.Store, o.StoreSource = store, source }
+}
+
+// WithArchive makes the receiver write an archive of the given format to w,
+// instead of receiving into a directory.
+func WithArchive(w io.Writer, format string) ReceiverOption {
+	return func(o *ReceiverOptions) { o.Archive, o.ArchiveFormat = w, format }
+}
+
+// WithReceiveFilter sets the filter deciding which items are received, and
+// where to.
+func WithReceiveFilter(f Filter) ReceiverOption {
+	return func(o *ReceiverOptions) { o.Filter = f }
+}
+
+// WithNormalize makes the receiver put names in the given normalization form
+// (NormalizeNFC or NormalizeNFD), and apply the policy (DuplicatesReport or
+// DuplicatesMerge) to names which differ only in it, see
+// ReceiverOptions.Normalize.
+func WithNormalize(form, duplicates string) ReceiverOption {
+	return func(o *ReceiverOptions) { o.Normalize, o.Duplicates = form, duplicates }
+}
+
+// WithTransactional makes the receiver stage the sync, and commit it only once
+// it's complete, see ReceiverOptions.Transactional.
+func WithTransactional() ReceiverOption {
+	return func(o *ReceiverOptions) { o.Transactional = true }
+}
+
+// WithWriteAhead makes the receiver record its changes in a write-ahead
+// journal, settled with the given policy (WriteAheadRollback or
+// WriteAheadComplete) if the sync fails, see ReceiverOptions.WriteAhead.
+func WithWriteAhead(policy string) ReceiverOption {
+	return func(o *ReceiverOptions) { o.WriteAhead = policy }
+}
+
+// WithReceiveHooks sets the hooks called during the sync.
+func WithReceiveHooks(h Hooks) ReceiverOption {
+	return func(o *ReceiverOptions) { o.Hooks = h }
+}
+
+// WithConflict sets the callback deciding whether local changes may be
+// overwritten, see ReceiverOptions.Conflict.
+func WithConflict(fn func(path string) bool) ReceiverOption {
+	return func(o *ReceiverOptions) { o.Conflict = fn }
+}
+
+// WithApplyOwners makes the receiver give the items the owners the sender
+// sends, see ReceiverOptions.Owners.
+func WithApplyOwners() ReceiverOption {
+	return func(o *ReceiverOptions) { o.Owners = true }
+}
+
+// WithSetID makes the receiver keep the set-user-ID and set-group-ID bits of
+// the items, see ReceiverOptions.SetID.
+func WithSetID() ReceiverOption {
+	return func(o *ReceiverOptions) { o.SetID = true }
+}
+
+// WithReceiveTimeouts sets how long the receiver waits for the sender, see
+// Options.ReadTimeout.
+func WithReceiveTimeouts(read, phase time.Duration) ReceiverOption {
+	return func(o *ReceiverOptions) { o.ReadTimeout, o.PhaseTimeout = read, phase }
+}
+
+// Validate checks that the options are supported, and go together. NewSender
+// fails with the same error, but a command can check them before it connects.
+func (o *Options) Validate() error {
+	if o.CrcUsage > FileCrcAtimeNsecMetadata {
+		return fmt.Errorf("Unsupported crc usage: %d", o.CrcUsage)
+	}
+	if o.Compression > CompressionSnappy {
+		return fmt.Errorf("Unsupported compression format %d", o.Compression)
+	}
+	if o.Summary && o.SigningKey != nil {
+		return fmt.Errorf("a summary can't be used when signing")
+	}
+	if o.QuickCheck && !o.Summary {
+		return fmt.Errorf("quick check needs a summary")
+	}
+	if o.LazyHash && o.CrcUsage == FileCrcOff {
+		return fmt.Errorf("lazy hashing needs crcs")
+	}
+	if o.LazyHash && (o.Summary || o.Overlap) {
+		return fmt.Errorf("lazy hashing can't be used with a summary or overlap")
+	}
+	if o.Streams < 0 || o.Streams > MaxStreams {
+		return fmt.Errorf("Unsupported number of streams %d", o.Streams)
+	}
+	if o.Compressors < 0 {
+		return fmt.Errorf("Unsupported number of compressors %d", o.Compressors)
+	}
+	if o.Compressors > 1 && o.Streams > 1 {
+		return fmt.Errorf("compressors can't be used with streams")
+	}
+	if o.Overlap && o.Streams > 1 {
+		return fmt.Errorf("overlap can't be used with streams")
+	}
+	if o.Pack && o.Streams > 1 {
+		return fmt.Errorf("packing can't be used with streams")
+	}
+	if o.Dedup && (o.Pack || o.Streams > 1) {
+		return fmt.Errorf("dedup can't be used with packing or streams")
+	}
+	if o.Inline < 0 || o.Inline > MaxInline {
+		return fmt.Errorf("Unsupported inline size %d", o.Inline)
+	}
+	if o.Inline > 0 && o.SigningKey != nil {
+		return fmt.Errorf("inlining can't be used when signing")
+	}
+	subtrees, err := checkSubtrees(o.Subtrees)
+	if err != nil {
+		return err
+	}
+	if subtrees && o.SigningKey != nil {
+		return fmt.Errorf("subtree options can't be used when signing")
+	}
+	if subtrees && o.VerifyTree {
+		// Items kept by NoDelete would make the trees differ
+		return fmt.Errorf("subtree options can't be used with tree verification")
+	}
+	if o.Lenient && o.VerifyTree {
+		// The items which failed would make the trees differ
+		return fmt.Errorf("tree verification can't be used with a lenient sync")
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With FlagOverlap, the receiver doesn't wait for the end of the metadata
+// before it requests files. After the metadata (and the deletions, with a
+// summary), the sender reads chunks of requests, each a uint32 count followed
+// by the indexes, like the request list. It sends the content of the items
+// of each chunk, and flushes, until it reads a chunk with a count of zero.
+// The result of phase 1 follows, and the result of phase 3 after the content,
+// as usual. The sender reads the requests and the result of phase 1 while it
+// sends the content, and the receiver reads ahead the metadata while it
+// processes it, so that neither is blocked writing while the other is.
+//
+// The receiver sends a chunk whenever overlapBatch requests have piled up,
+// the first of them has waited for overlapDelay, or it has nothing else to do
+// until more metadata arrives. Where it can't receive content while it
+// processes the metadata (see overlapping), it sends all requests as one
+// chunk, at the end.
+// OBS: This is not part of the qvm-copy protocol.
+
+const (
+	// overlapBatch is the most requests sent in one chunk.
+	overlapBatch = 256
+	// overlapDelay is how long a request may wait for others to join it.
+	overlapDelay = 100 * time.Millisecond
+)
+
+// errDataFailed is returned by receiveMetadata, when receiving the content
+// meanwhile failed.
+var errDataFailed = errors.New("receiving content failed")
+
+// requestedItem is an item whose content is to be received.
+type requestedItem struct {
+	index uint32
+	hdr   *fileHeader
+}
+
+// headerQueue holds the metadata read ahead of the receiver, so that the
+// sender isn't held up by it, and can send content as soon as it's requested.
+type headerQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond    // signalled when a header is added, or reading fails
+	hdrs []*fileHeader // headers not taken yet, up to the end marker
+	err  error         // the error reading failed with
+	idle func() error  // called before waiting for the next header
+}
+
+func newHeaderQueue(idle func() error) *headerQueue {
+	q := &headerQueue{idle: idle}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// fill reads headers from in, up to and including the end marker, with the
+// content of files up to inline bytes (see FlagInline) and their owners, if
+// sent (see FlagOwners).
+func (q *headerQueue) fill(in io.Reader, inline uint64, owners bool) error {
+	for {
+		hdr, err := readHeader(in, inline, owners)
+		q.mu.Lock()
+		if err != nil {
+			q.err = err
+		} else {
+			q.hdrs = append(q.hdrs, hdr)
+		}
+		q.mu.Unlock()
+		q.cond.Signal()
+		if err != nil {
+			return err
+		}
+		if isAbortFrame(hdr) {
+			// receiveMetadata takes it, and stops
+			return ErrSenderAborted
+		}
+		if hdr.Data.NameLen == 0 {
+			return nil
+		}
+	}
+}
+
+// next returns the next header, waiting for it if it hasn't been read yet.
+func (q *headerQueue) next() (*fileHeader, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.hdrs) == 0 && q.err == nil && q.idle != nil {
+		q.mu.Unlock()
+		err := q.idle()
+		q.mu.Lock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for len(q.hdrs) == 0 && q.err == nil {
+		q.cond.Wait()
+	}
+	if len(q.hdrs) == 0 {
+		return nil, q.err
+	}
+	hdr := q.hdrs[0]
+	q.hdrs[0] = nil
+	q.hdrs = q.hdrs[1:]
+	return hdr, nil
+}
+
+// overlapping returns whether the content is received while the metadata is
+// still being processed. Otherwise, with FlagOverlap, the requests are sent in
+// one chunk, after the metadata.
+func (r *Receiver) overlapping() bool {
+	// An archive or a store takes the content after all the metadata, the
+	// renames of a filter (or normalization) are looked up while receiving
+	// content, a
+	// signature only holds once all the metadata is in, and the summary is
+	// sent in the middle of the metadata.
+	return r.overlapOffered && r.archive == nil && r.store == nil &&
+		!r.renames() && !r.signed && !r.summaryOffered
+}
+
+// receiveOverlapped receives the metadata, and meanwhile the content of the
+// files requested so far. The metadata is read ahead by the goroutine which
+// then receives the content, so that the sender is never held up by the
+// receiver going through it.
+func (r *Receiver) receiveOverlapped() error {
+	type result struct {
+		lastName string
+		err      error
+	}
+	r.queue = newHeaderQueue(r.sendPending)
+	r.requested = make(chan requestedItem, overlapBatch)
+	done := make(chan result, 1)
+	go func() {
+		if err := r.queue.fill(r.in, r.inlineMax, r.ownersSent); err != nil {
+			// The metadata is cut short, which receiveMetadata reports
+			for range r.requested {
+			}
+			done <- result{}
+			return
+		}
+		lastName, err := r.receiveRequested()
+		done <- result{lastName, err}
+	}()
+	err := r.receiveMetadata()
+	if err != nil && !r.requestsEnded {
+		// The sender waits for it, before the result
+		if r.writeRequests(nil) == nil {
+			r.out.Flush()
+		}
+	}
+	close(r.requested)
+	res := <-done
+	if res.err != nil {
+		if err == nil || err == errDataFailed {
+			// The sender waits for a result, either that of the
+			// metadata or the final one
+			r.fail(res.err, res.lastName)
+		}
+		return fmt.Errorf("Error during file reception: %w", res.err)
+	}
+	if err == ErrAborted {
+		// The content requested before is in place now
+		for _, hdr := range r.deferredPermissions {
+			r.fixTimesAndPerms(hdr)
+		}
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Error during phase 0 receive : %w", err)
+	}
+	if err := r.startDeletions(); err != nil {
+		return r.fail(err, res.lastName)
+	}
+	if err := r.sendStatusAndCrc(CodeOK, res.lastName); err != nil {
+		return fmt.Errorf("Error during file reception: %w", err)
+	}
+	return r.out.Flush()
+}
+
+// receiveRequested receives the content of the requested items as they're
+// passed on, and returns the path of the last one.
+func (r *Receiver) receiveRequested() (string, error) {
+	var lastName string
+	defer r.waitFinished()
+	for item := range r.requested {
+		receive := r.receivePacked
+		if item.hdr.inline != nil {
+			receive = r.receiveInline
+		}
+		if err := receive(item.index, item.hdr); err != nil {
+			atomic.StoreInt32(&r.dataErr, 1)
+			// Where the content of the item ends is unknown, so the rest
+			// is discarded, for the sender not to block until the receiver
+			// gives up
+			go io.Copy(ioutil.Discard, r.in)
+			for range r.requested {
+			}
+			return lastName, err
+		}
+		lastName = item.hdr.path
+	}
+	if err := r.endPacked(); err != nil {
+		return lastName, err
+	}
+	return lastName, r.waitFinished()
+}
+
+func (r *Receiver) dataFailed() bool {
+	return atomic.LoadInt32(&r.dataErr) == 1
+}
+
+// nextQueued returns the next header of the metadata read ahead. The requests
+// made so far are sent first, if enough of them have piled up, or they have
+// waited long enough.
+func (r *Receiver) nextQueued() (*fileHeader, error) {
+	if len(r.pending) >= overlapBatch ||
+		(len(r.pending) > 0 && time.Since(r.pendingSince) >= overlapDelay) {
+		if err := r.sendPending(); err != nil {
+			return nil, err
+		}
+	}
+	return r.queue.next()
+}
+
+// sendPending sends the requests made so far as a chunk, and passes them on to
+// be received.
+func (r *Receiver) sendPending() error {
+	if len(r.pending) == 0 || r.isAborted() || r.dataFailed() || r.failure != nil {
+		r.pending = r.pending[:0]
+		return nil
+	}
+	if err := r.writeRequests(r.pending); err != nil {
+		return err
+	}
+	if err := r.out.Flush(); err != nil {
+		return err
+	}
+	for _, index := range r.pending {
+		r.requested <- requestedItem{index, r.items[index]}
+	}
+	r.pending = r.pending[:0]
+	return nil
+}
+
+// writeRequests writes a chunk of requests.
+func (r *Receiver) writeRequests(list []uint32) error {
+	if r.opts.Verbosity >= 4 {
+		log.Printf("Requesting %d files", len(list))
+	}
+	return writeRequests(r.out, list)
+}
+
+// endRequests sends the requests not sent yet, and the end of them.
+func (r *Receiver) endRequests() error {
+	if r.queue != nil {
+		if err := r.sendPending(); err != nil {
+			return err
+		}
+	} else if len(r.requestList) > 0 && !r.isAborted() && r.failure == nil {
+		if err := r.writeRequests(r.requestList); err != nil {
+			return err
+		}
+	}
+	if err := r.writeRequests(nil); err != nil {
+		return err
+	}
+	r.requestsEnded = true
+	return r.out.Flush()
+}
+
+// sendRequested sends the content of the items the receiver requests, chunk by
+// chunk, and returns the result of phase 1, which follows the requests. They
+// are read meanwhile, since the receiver may send all of them (and the result)
+// before it reads any content.
+func (s *Sender) sendRequested() error {
+	var (
+		lists = make(chan []uint32, 1)
+		done  = make(chan error, 1)
+		stop  = make(chan struct{})
+	)
+	defer close(stop)
+	go func() {
+		defer close(lists)
+		for {
+			list, err := s.readFileList()
+			if err != nil {
+				done <- fmt.Errorf("phase 2 list error: %w", err)
+				return
+			}
+			if len(list) == 0 {
+				break
+			}
+			select {
+			case lists <- list:
+			case <-stop:
+				return
+			}
+		}
+		if err := s.waitForResult(); err != nil {
+			done <- fmt.Errorf("phase 1 wait error: %w", err)
+			return
+		}
+		done <- nil
+	}()
+	for list := range lists {
+		if err := s.sendItems(list); err != nil {
+			if s.abortSent {
+				// The rest is discarded, see endAbort
+				for range lists {
+				}
+				<-done
+			}
+			return fmt.Errorf("phase 2 list error: %w", err)
+		}
+	}
+	return <-done
+}
@@ -1,25 +1,54 @@
 package packer
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/golang/snappy"
+	"hash"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type Sender struct {
-	out      BufferedWriter
-	in       io.Reader
-	sendList []string
-	root     string
+	out       BufferedWriter
+	in        io.Reader
+	sendList  []string      // paths of the files and symlinks, below root
+	sendNames []string      // paths the items in sendList are sent as
+	sendInfos []os.FileInfo // the info of the items in sendList, as walked
+	root      string
+	src       source // where the tree is read from
 
 	// Options
 	opts *Options
 
+	batch  *batchReplies // set when writing a batch, see NewBatchSender
+	signer *signer       // set when signing, see Options.SigningKey
+	walk   *summaryWalk  // set when the receiver has sent a summary
+	crcs   *crcPool      // set while files are hashed ahead, see Options.Workers
+	cache  *hashCache    // set during a sync, see Options.HashCache
+	walks  *walkCache    // set during a sync, see Options.WalkCache
+
+	raw         io.Writer       // the connection, which the streams are sent over
+	streamStats [2]int          // bytes sent over the streams, see Stats
+	noZeroCopy  bool            // set when the kernel can't send files, see sendFile
+	rings       *uringPool      // set when reading through io_uring, see Options.IOUring
+	dedup       *dedup          // set when identical files are sent once, see Options.Dedup
+	gone        []string        // items skipped, see Options.SkipGone
+	changed     []string        // files which changed while sent, see Changed
+	requested   []bool          // the items requested so far, by index, see readFileList
+	deadline    *deadlineReader // set when reading with timeouts, see Options.ReadTimeout
+	aborted     int32           // set (atomically) to 1 when the sync should be aborted, see Abort
+	abortSent   bool            // whether the receiver was sent an abort frame, see abort
+	dir         string          // the directory synced, below root
+	clockOffset time.Duration   // of the local clock to the receiver's, when systematic, see FlagClock
+
 	// stats
 	rawCounter  *MeteredWriter
 	snapCounter *MeteredWriter
@@ -32,22 +61,108 @@ func NewSender(out io.Writer, in io.Reader, opts *Options) (*Sender, error) {
 	if opts == nil {
 		opts = DefaultOptions
 	}
-	if opts.CrcUsage > FileCrcAtimeNsecMetadata {
-		return nil, fmt.Errorf("Unsupported crc usage: %d", opts.CrcUsage)
-	}
-	if opts.Compression > CompressionSnappy {
-		return nil, fmt.Errorf("Unsupported compression format %d", opts.Compression)
+	if err := opts.Validate(); err != nil {
+		return nil, err
 	}
+	subtrees, _ := checkSubtrees(opts.Subtrees)
 	var sender = &Sender{
+		src:  osSource{mmap: opts.Mmap, dropCache: opts.DropCache},
 		opts: opts,
 		out:  NewConfigurableWriter(opts.Compression == CompressionSnappy, out),
 	}
+	if opts.Compression == CompressionSnappy && opts.Compressors > 1 {
+		sender.out = newCompressingWriter(out, opts.Compressors)
+	}
+	if opts.IOUring {
+		sender.rings = new(uringPool)
+	}
+	sender.raw = out
 	// We still have the un-modified 'out', and can send the first packet
 	// without compression
 	v := newVersionHeader(opts.Compression, opts.CrcUsage, opts.Verbosity)
+	if opts.SigningKey != nil {
+		sender.signer = newSigner(opts.SigningKey)
+		v.Flags |= FlagSigned
+	}
+	if opts.Summary {
+		v.Version = VersionExtended
+		v.Flags |= FlagSummary
+	}
+	if opts.QuickCheck {
+		v.Flags |= FlagQuickCheck
+	}
+	if opts.Streams > 1 {
+		v.Version = VersionExtended
+		v.Streams = uint16(opts.Streams)
+	}
+	if subtrees {
+		v.Version = VersionExtended
+		v.Flags |= FlagSubtrees
+	}
+	if opts.Overlap {
+		v.Version = VersionExtended
+		v.Flags |= FlagOverlap
+	}
+	if opts.Pack {
+		v.Version = VersionExtended
+		v.Flags |= FlagPacked
+	}
+	if opts.LazyHash {
+		v.Version = VersionExtended
+		v.Flags |= FlagLazyHash
+	}
+	if opts.Dedup {
+		v.Version = VersionExtended
+		v.Flags |= FlagDedup
+		sender.dedup = newDedup()
+	}
+	if opts.Inline > 0 {
+		v.Version = VersionExtended
+		v.Flags |= FlagInline
+		v.Inline = uint16(opts.Inline)
+	}
+	if opts.Digests {
+		v.Version = VersionExtended
+		v.Flags |= FlagDigests
+	}
+	if opts.SkipGone {
+		v.Version = VersionExtended
+		v.Flags |= FlagGone
+	}
+	if opts.Abortable {
+		v.Version = VersionExtended
+		v.Flags |= FlagAbort
+	}
+	if opts.VerifyTree {
+		v.Version = VersionExtended
+		v.Flags |= FlagVerifyTree
+	}
+	if opts.Lenient {
+		v.Version = VersionExtended
+		v.Flags |= FlagLenient
+	}
+	if opts.DiskFullDetails {
+		v.Version = VersionExtended
+		v.Flags |= FlagDiskFull
+	}
+	if opts.ClockSkew {
+		v.Version = VersionExtended
+		v.Flags |= FlagClock
+	}
+	if opts.Owners {
+		v.Version = VersionExtended
+		v.Flags |= FlagOwners
+	}
 	if err := v.marshallBinary(out); err != nil {
 		return nil, err
 	}
+	if opts.ClockSkew {
+		if err := sendClock(out); err != nil {
+			return nil, err
+		}
+	}
+	sender.deadline = newDeadlineReader(in, opts.ReadTimeout, opts.PhaseTimeout)
+	in = sender.deadline.reader(in)
 	if opts.Compression == CompressionSnappy {
 		in = snappy.NewReader(in)
 	}
@@ -55,49 +170,174 @@ func NewSender(out io.Writer, in io.Reader, opts *Options) (*Sender, error) {
 	return sender, nil
 }
 
-func (s *Sender) Sync(path string) error {
+func (s *Sender) Sync(path string) (err error) {
+	if hooks := s.opts.Hooks; hooks != nil {
+		if err := hooks.PreSync(path); err != nil {
+			return err
+		}
+		defer func() { hooks.PostSync(err) }()
+	}
+	defer func() {
+		if err != nil && s.isAborted() {
+			err = s.endAbort()
+		}
+	}()
+	s.cache = loadHashCache(s.opts)
+	defer func() {
+		saveHashCache(s.cache, s.opts)
+		s.cache = nil
+	}()
+	s.walks = loadWalkCache(s.opts, s.src)
+	defer func() {
+		if err == nil {
+			saveWalkCache(s.walks, s.opts)
+		}
+		s.walks = nil
+	}()
+	defer s.rings.close()
+	s.gone, s.changed, s.requested = nil, nil, nil
+	s.deadline.startPhase("phase 0")
 	if err := s.transmitDirectory(path); err != nil {
-		return fmt.Errorf("phase 0 send error: %v", err)
+		return fmt.Errorf("phase 0 send error: %w", err)
 	}
-	if err := s.waitForResult(); err != nil {
-		return fmt.Errorf("phase 1 wait error: %v", err)
+	s.deadline.startPhase("phase 1")
+	if s.opts.LazyHash {
+		if err := s.sendHashes(); err != nil {
+			return fmt.Errorf("phase 1 crc error: %w", err)
+		}
 	}
-	if err := s.handleFileList(); err != nil {
-		return fmt.Errorf("phase 2 list error: %v", err)
+	if s.opts.Overlap {
+		// The requests come before the result of phase 1, see FlagOverlap
+		if err := s.sendRequested(); err != nil {
+			return err
+		}
+	} else {
+		if err := s.waitForResult(); err != nil {
+			return fmt.Errorf("phase 1 wait error: %w", err)
+		}
+		s.deadline.startPhase("phase 2")
+		if err := s.handleFileList(); err != nil {
+			return fmt.Errorf("phase 2 list error: %w", s.remoteFailure(err))
+		}
 	}
+	s.deadline.startPhase("phase 3")
 	if err := s.waitForResult(); err != nil {
-		return fmt.Errorf("phase 3 wait error: %v", err)
+		return fmt.Errorf("phase 3 wait error: %w", err)
+	}
+	var failures []ItemFailure
+	if s.opts.Lenient {
+		if failures, err = readFailures(s.in); err != nil {
+			return fmt.Errorf("phase 3 failures error: %w", err)
+		}
+	}
+	if s.opts.VerifyTree {
+		s.deadline.startPhase("verification")
+		sum, err := s.treeHash()
+		if err == nil {
+			err = s.sendTreeHash(sum)
+		}
+		if err != nil {
+			return fmt.Errorf("verification error: %w", err)
+		}
 	}
 	if s.opts.Verbosity >= 3 {
-		if cm, ok := s.out.(*ConfigurableWriter); ok {
-			r, c := cm.Stats()
+		if _, ok := s.out.(*ConfigurableWriter); ok {
+			r, c := s.Stats()
 			log.Printf("Data sent, raw: %d, compresed: %d", r, c)
 		}
 	}
+	if len(failures) > 0 {
+		return &PartialError{Failures: failures}
+	}
 	return nil
 }
 
+// Stats returns how many bytes have been sent, before and after compression.
+// Without compression, both are the same.
+func (s *Sender) Stats() (raw, compressed int) {
+	if cm, ok := s.out.(*ConfigurableWriter); ok {
+		raw, compressed = cm.Stats()
+		if cm.compressedMeter == nil {
+			compressed = raw
+		}
+	}
+	return raw + s.streamStats[0], compressed + s.streamStats[1]
+}
+
 // sendItemMetadata sends the list of files and directories
-// it remembers the paths of each file sent
-func (s *Sender) sendItemMetadata(path string, info os.FileInfo) error {
-	header := newFileHeaderFromStat(path, info)
+// it remembers the paths of each file sent. The item at path is sent as name.
+func (s *Sender) sendItemMetadata(path, name string, info os.FileInfo) error {
+	header, err := s.itemHeader(path, name, info)
+	if err != nil {
+		return err
+	}
+	return s.sendHeader(path, name, info, header)
+}
 
-	// Possibly replace atimensec with crc32
-	if !header.isDir() {
+// itemHeader returns the metadata of the item at path, to be sent as name.
+func (s *Sender) itemHeader(path, name string, info os.FileInfo) (*fileHeader, error) {
+	header := newFileHeaderFromStat(name, info)
+
+	// Possibly replace atimensec with crc32, unless the receiver asks for
+	// it, see FlagLazyHash
+	if !header.isDir() && !s.opts.LazyHash {
 		fullPath := filepath.Join(s.root, path)
-		if s.opts.CrcUsage == FileCrcAtimeNsec ||
-			s.opts.CrcUsage == FileCrcAtimeNsecMetadata {
-			crc, err := CrcFile(fullPath, info)
+		if (s.opts.CrcUsage == FileCrcAtimeNsec ||
+			s.opts.CrcUsage == FileCrcAtimeNsecMetadata) && s.useCrc(path) {
+			crc, err := s.crc(fullPath, info)
+			if err != nil && s.opts.Lenient {
+				// To be requested, and sent as failed, see FlagLenient
+				crc, err = 0, nil
+			}
 			if err != nil {
-				return fmt.Errorf("crc failed: %v", err)
+				return nil, fmt.Errorf("crc failed: %v", err)
 			}
 			header.Data.AtimeNsec = crc
 		}
 	}
-	header.marshallBinary(s.out)
+	return header, nil
+}
+
+// sendHeader sends the metadata of the item at path, as returned by
+// itemHeader.
+func (s *Sender) sendHeader(path, name string, info os.FileInfo, header *fileHeader) error {
+	if s.isAborted() {
+		return s.abort(s.writeAbort)
+	}
+	var content []byte
+	if isInlined(header, uint64(s.opts.Inline)) {
+		var err error
+		if content, err = s.readInline(path, header); err != nil {
+			return err
+		}
+	}
+	if err := header.marshallBinary(s.out); err != nil {
+		return err
+	}
+	if s.opts.Owners {
+		if err := sendOwner(s.out, header); err != nil {
+			return err
+		}
+	}
+	if _, err := s.out.Write(content); err != nil {
+		return err
+	}
+	if s.signer != nil {
+		header.marshallBinary(s.signer.meta)
+		if info.Mode()&regularOrSymlink == 0 {
+			if err := s.signer.addItem(s.src, s.cache, filepath.Join(s.root, path), info); err != nil {
+				return fmt.Errorf("digest failed: %v", err)
+			}
+		}
+	}
 	if info.Mode()&regularOrSymlink == 0 {
+		if s.batch != nil {
+			s.batch.consider(uint32(len(s.sendList)), header)
+		}
 		// Files and symlinks can be requested later
 		s.sendList = append(s.sendList, path)
+		s.sendNames = append(s.sendNames, name)
+		s.sendInfos = append(s.sendInfos, info)
 	}
 	return nil
 }
@@ -106,61 +346,251 @@ func (s *Sender) sendItemMetadata(path string, info os.FileInfo) error {
 // given index. It transmits the file with the full header,
 // not just the content.
 func (s *Sender) sendItem(index uint32) error {
+	item, err := s.writeItem(s.out, index)
+	if err != nil {
+		return err
+	}
+	return s.itemSent(item)
+}
+
+// sentItem is an item whose content has been written, see writeItem.
+type sentItem struct {
+	name  string // the path it was sent as
+	local string // the file it was read from, if it's a file
+	size  uint64
+}
+
+// writeItem writes the header and content of the item at the given index to
+// out.
+func (s *Sender) writeItem(out io.Writer, index uint32) (*sentItem, error) {
+	info, file, err := s.itemInfo(index)
+	if err == errGone {
+		return s.writeGone(out, index)
+	}
+	if ierr, ok := err.(*itemError); ok {
+		return s.writeFailed(out, index, ierr.err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.writeItemInfo(out, index, info, file)
+}
+
+// itemInfo returns the current info of the item at the given index, and the
+// file, opened, if it's a file on the filesystem: it's then statted through
+// the descriptor, rather than looked up by path again. With SkipGone, it
+// returns errGone for an item which is gone, and with Lenient, an *itemError
+// for one which can't be read.
+func (s *Sender) itemInfo(index uint32) (os.FileInfo, io.ReadCloser, error) {
 	if index >= uint32(len(s.sendList)) {
-		return fmt.Errorf("index %d not in list (length %d)", index, len(s.sendList))
+		return nil, nil, fmt.Errorf("index %d not in list (length %d)", index, len(s.sendList))
+	}
+	path := filepath.Join(s.root, s.sendList[index])
+	if src, isOS := s.src.(osSource); isOS && s.sendInfos[index].Mode().IsRegular() {
+		if file, info, err := openRegular(path, src.dropCache); err == nil {
+			return info, file, nil
+		}
+		// Not a file anymore, or gone, which Lstat tells
+	}
+	info, err := s.src.Lstat(path)
+	if s.goneItem(index, info, err) {
+		return nil, nil, errGone
 	}
-	var (
-		filename  = s.sendList[index]
-		path      = filepath.Join(s.root, filename)
-		info, err = os.Lstat(path)
-	)
 	if err != nil {
-		return fmt.Errorf("file %v no longer available: %v", filename, err)
+		return nil, nil, s.unreadable(fmt.Errorf("file %v no longer available: %w", s.sendList[index], err))
+	}
+	if s.opts.Lenient && info.Mode().IsRegular() {
+		// Opened before anything is sent, so that it can be sent as failed
+		file, err := s.src.Open(path)
+		if err != nil {
+			return nil, nil, &itemError{err}
+		}
+		return info, file, nil
 	}
+	return info, nil, nil
+}
+
+// writeItemInfo is writeItem, with the info of the item, and the file, as
+// returned by itemInfo. It closes the file.
+func (s *Sender) writeItemInfo(out io.Writer, index uint32, info os.FileInfo, file io.ReadCloser) (*sentItem, error) {
+	if file != nil {
+		defer file.Close()
+	}
+	var (
+		err      error
+		filename = s.sendList[index]
+		name     = s.sendNames[index]
+		path     = filepath.Join(s.root, filename)
+	)
 	if s.opts.Verbosity >= 4 {
-		log.Printf("Sending file %v", filename)
+		log.Printf("Sending file %v", name)
 	}
-	header := newFileHeaderFromStat(filename, info)
+	header := newFileHeaderFromStat(name, info)
 	// Possibly replace atimensec with crc32
-	if header.isRegular() && s.opts.CrcUsage == FileCrcAtimeNsec {
-		crc, err := CrcFile(path, info)
+	if header.isRegular() && s.opts.CrcUsage == FileCrcAtimeNsec && !s.opts.LazyHash && s.useCrc(filename) {
+		crc, err := s.crc(path, info)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		header.Data.AtimeNsec = crc
 	}
-	if err := header.marshallBinary(s.out); err != nil {
-		return err
+	if err := header.marshallBinary(out); err != nil {
+		return nil, err
 	}
+	if s.dedup != nil && header.isRegular() {
+		source, err := s.cloneSource(index, path, info)
+		if err != nil {
+			return nil, err
+		}
+		if err := binary.Write(out, binary.LittleEndian, source); err != nil {
+			return nil, err
+		}
+		if source != 0 {
+			return &sentItem{name: name, local: path, size: uint64(info.Size())}, nil
+		}
+	}
+	local := ""
 	if info.Mode()&os.ModeSymlink != 0 {
 		var data string
-		data, err = os.Readlink(filepath.Join(s.root, filename))
+		data, err = s.src.Readlink(path)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		_, err = s.out.Write([]byte(data))
+		_, err = out.Write([]byte(data))
 	} else if info.Mode().IsRegular() {
 		// file Data
-		var file *os.File
-		file, err = os.Open(filepath.Join(s.root, filename))
-		if err != nil {
-			return err
+		if file == nil {
+			if file, err = s.src.Open(path); err != nil {
+				return nil, err
+			}
+			defer file.Close()
 		}
-		defer file.Close()
-		_, err = io.Copy(s.out, file)
+		var (
+			sent   = false
+			dst    = out
+			digest hash.Hash
+		)
+		if s.opts.Digests {
+			// Hashed as it's sent, see FlagDigests
+			digest = sha256.New()
+			dst = io.MultiWriter(out, digest)
+		}
+		if dst == io.Writer(s.out) {
+			sent, err = s.sendFile(file, info.Size())
+		}
+		if !sent && err == nil {
+			err = s.copyFile(dst, file, info.Size())
+		}
+		if err == nil {
+			s.noteChanged(name, file, info)
+		}
+		if err == nil && digest != nil {
+			_, err = out.Write(digest.Sum(nil))
+		}
+		dropCache(s.src, file)
+		local = path
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sentItem{name: name, local: local, size: uint64(info.Size())}, nil
+}
+
+// copyFile copies the content of file to out, through a ring if it's large
+// enough, see Options.IOUring. Exactly size bytes are copied, as the header
+// says, even if the file changed meanwhile: it's cut, or padded with zeros.
+func (s *Sender) copyFile(out io.Writer, file io.Reader, size int64) error {
+	var (
+		n   int64
+		err error
+	)
+	if f, ok := file.(*os.File); ok {
+		if uf := newUringFile(s.rings, f, size); uf != nil {
+			n, err = io.Copy(out, io.LimitReader(uf, size))
+			if rErr := uf.Release(); err == nil {
+				err = rErr
+			}
+			return padContent(out, size-n, err)
+		}
+	}
+	n, err = io.Copy(out, io.LimitReader(file, size))
+	return padContent(out, size-n, err)
+}
+
+// padContent writes n zeros to out, in place of the content of a file which
+// shrank while it was sent, unless the copy failed.
+func padContent(out io.Writer, n int64, err error) error {
+	if err != nil || n <= 0 {
+		return err
 	}
+	_, err = io.CopyN(out, zeros{}, n)
 	return err
 }
 
+// zeros reads as an endless run of zeros.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// noteChanged takes note of the file, if it changed while it was sent. It was
+// sent cut or padded to the size in its header, whose times the receiver gives
+// its copy: as the file's are different by now, the next sync sends it again.
+func (s *Sender) noteChanged(name string, file io.Reader, info os.FileInfo) {
+	f, ok := file.(interface{ Stat() (os.FileInfo, error) })
+	if !ok {
+		return
+	}
+	now, err := f.Stat()
+	if err != nil || (now.Size() == info.Size() && now.ModTime().Equal(info.ModTime())) {
+		return
+	}
+	if s.opts.Verbosity >= 2 {
+		log.Printf("File %v changed while it was sent, it will be sent again by the next sync", name)
+	}
+	s.changed = append(s.changed, name)
+}
+
+// Changed returns the paths of the files which changed while the last sync
+// sent them. Their content on the receiver is not what the sender has, until
+// the next sync sends them again.
+func (s *Sender) Changed() []string {
+	return s.changed
+}
+
+// itemSent runs the PostFile hook, and reports the progress, after the
+// content of an item has been sent.
+func (s *Sender) itemSent(item *sentItem) error {
+	if item == nil {
+		// Sent as gone, see writeGone
+		return nil
+	}
+	if s.opts.Hooks != nil {
+		if err := s.opts.Hooks.PostFile(item.name, item.local); err != nil {
+			return err
+		}
+	}
+	if s.opts.Progress != nil {
+		s.opts.Progress(item.name, item.size)
+	}
+	return nil
+}
+
 // transmitDirectory resolves the given dirname to a directory, and syncs that directory
 func (s *Sender) transmitDirectory(dirname string) error {
 
-	absPath, _ := filepath.Abs(filepath.Clean(dirname))
-	root, path := filepath.Split(absPath)
+	root, path, err := s.src.resolve(dirname)
+	if err != nil {
+		return err
+	}
 	if s.opts.Verbosity >= 3 {
 		log.Printf("Root: %v, sync dir: %v", root, path)
 	}
-	stat, err := os.Lstat(absPath)
+	stat, err := s.src.Lstat(filepath.Join(root, path))
 	if err != nil {
 		return err
 	}
@@ -168,8 +598,28 @@ func (s *Sender) transmitDirectory(dirname string) error {
 	if !stat.IsDir() {
 		return fmt.Errorf("%v is not a directory", dirname)
 	}
-	s.root = root
-	if err := s.osWalk(path, stat); err != nil {
+	s.root, s.dir = root, path
+	if s.walks != nil {
+		s.walks.root = filepath.Join(root, path)
+	}
+	if s.opts.Workers > 1 && (s.opts.CrcUsage == FileCrcAtimeNsec || s.opts.CrcUsage == FileCrcAtimeNsecMetadata) && !s.opts.LazyHash {
+		s.crcs = newCrcPool(s.src, s.cache, s.opts.Workers)
+		defer func() {
+			s.crcs.close()
+			s.crcs = nil
+		}()
+	}
+	if needed, _ := checkSubtrees(s.opts.Subtrees); needed {
+		if err := s.sendSubtrees(path); err != nil {
+			return err
+		}
+	}
+	if s.opts.Summary {
+		err = s.summarySync(path, stat)
+	} else {
+		err = s.osWalk(path, path, stat)
+	}
+	if err != nil {
 		return err
 	}
 	// send ending
@@ -179,6 +629,16 @@ func (s *Sender) transmitDirectory(dirname string) error {
 	if _, err = s.out.Write(make([]byte, 32)); err != nil {
 		return err
 	}
+	if s.walk != nil {
+		if err := s.sendDeletions(); err != nil {
+			return err
+		}
+	}
+	if s.signer != nil {
+		if err := s.signer.writeBlock(s.out); err != nil {
+			return err
+		}
+	}
 	if err := s.out.Flush(); err != nil {
 		return err
 	}
@@ -189,37 +649,95 @@ func (s *Sender) transmitDirectory(dirname string) error {
 	return nil
 }
 
-func (s *Sender) osWalk(path string, stat os.FileInfo) error {
+// osWalk sends the item at path (below the root) as name, and everything in
+// it.
+func (s *Sender) osWalk(path, name string, stat os.FileInfo) error {
 
 	if s.opts.IgnoreSymlinks && (stat.Mode()&os.ModeSymlink != 0) {
 		return nil
 	}
 	if s.opts.Verbosity >= 5 {
-		log.Printf("Sending metadata for %v", path)
+		log.Printf("Sending metadata for %v", name)
 	}
-	if err := s.sendItemMetadata(path, stat); err != nil {
+	if err := s.sendItemMetadata(path, name, stat); err != nil {
 		return err
 	}
 	if !stat.IsDir() {
 		return nil
 	}
-	files, err := ioutil.ReadDir(filepath.Join(s.root, path))
+	if err := s.walkDir(path, name, s.osWalk); err != nil {
+		return err
+	}
+	// resend directory info, as walked
+	if s.opts.Verbosity >= 5 {
+		log.Printf("Sending metadata (2) for %v", name)
+	}
+	if err := s.sendItemMetadata(path, name, stat); err != nil {
+		return err
+	}
+	return nil
+}
+
+// walkDir calls walk for each item in the directory at path (sent as name),
+// which isn't excluded or left out by the filter. The items are listed in
+// batches of dirBatch, in the order of the directory, so that a huge one
+// isn't held in memory. With a walk cache, an unchanged directory is listed
+// from it instead.
+func (s *Sender) walkDir(path, name string, walk func(path, name string, stat os.FileInfo) error) error {
+	var (
+		dir dirList
+		err error
+	)
+	if s.walks != nil {
+		dir, err = s.walks.open(filepath.Join(s.root, path))
+	} else {
+		dir, err = openDir(s.src, filepath.Join(s.root, path))
+	}
 	if err != nil {
 		return err
 	}
+	defer dir.Close()
+	for {
+		files, err := dir.next(dirBatch)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.walkBatch(path, name, files, walk); err != nil {
+			return err
+		}
+	}
+}
+
+// walkBatch is walkDir, for a batch of the items in the directory.
+func (s *Sender) walkBatch(path, name string, files []os.FileInfo, walk func(path, name string, stat os.FileInfo) error) error {
+	var (
+		paths, names []string
+		infos        []os.FileInfo
+	)
 	for _, finfo := range files {
 		fName := filepath.Join(path, finfo.Name())
-		if err := s.osWalk(fName, finfo); err != nil {
+		if s.excluded(fName) {
+			continue
+		}
+		child, ok, err := applyFilter(s.opts.Filter, filepath.Join(name, finfo.Name()), finfo.Mode())
+		if err != nil {
 			return err
 		}
+		if !ok {
+			continue
+		}
+		if s.crcs != nil && s.useCrc(fName) {
+			s.crcs.add(filepath.Join(s.root, fName), finfo)
+		}
+		paths, names, infos = append(paths, fName), append(names, child), append(infos, finfo)
 	}
-	// resend directory info
-	if s.opts.Verbosity >= 5 {
-		log.Printf("Sending metadata (2) for %v", path)
-	}
-	stat, _ = os.Lstat(filepath.Join(s.root, path))
-	if err = s.sendItemMetadata(path, stat); err != nil {
-		return err
+	for i, fName := range paths {
+		if err := walk(fName, names[i], infos[i]); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -233,32 +751,67 @@ func (s *Sender) waitForResult() error {
 	if err := hdrExt.unMarshallBinary(s.in); err != nil {
 		return err
 	}
-	if hdr.ErrorCode != 0{
-		return fmt.Errorf("sync error, code: %v , last file: %v", hdr.ErrorCode, hdrExt.LastName)
+	if hdr.ErrorCode != 0 {
+		remote := &RemoteError{Code: ErrorCode(hdr.ErrorCode), LastName: hdrExt.LastName}
+		if remote.Code == CodeDiskFull && s.opts.DiskFullDetails {
+			return readDiskFull(s.in, remote)
+		}
+		return remote
 	}
 	if s.opts.Verbosity >= 3 {
-		log.Printf("Got result ACK, last file %v",  hdrExt.LastName)
+		log.Printf("Got result ACK, last file %v", hdrExt.LastName)
 	}
 	return nil
 }
 
-func (s *Sender) handleFileList() error {
-
-	var listLen uint32
-	if err := binary.Read(s.in, binary.LittleEndian, &listLen); err != nil {
+// remoteFailure returns the failure which the receiver reported, if err is that
+// of the connection being closed, as the receiver does once it has failed.
+// Otherwise, or if there is no such report, it returns err.
+func (s *Sender) remoteFailure(err error) error {
+	if !errors.Is(err, syscall.EPIPE) && !errors.Is(err, io.ErrClosedPipe) {
 		return err
 	}
-	if max := uint32(len(s.sendList)); listLen > max {
-		return fmt.Errorf("remote requested %d items, only %d possible", listLen, max)
+	var remote *RemoteError
+	if rErr := s.waitForResult(); errors.As(rErr, &remote) {
+		return rErr
 	}
-	var list = make([]uint32, listLen)
-	if err := binary.Read(s.in, binary.LittleEndian, &list); err != nil {
+	return err
+}
+
+func (s *Sender) handleFileList() error {
+	list, err := s.readFileList()
+	if err != nil {
 		return err
 	}
-	if s.opts.Verbosity >= 3 {
-		log.Printf("Got list, %d items requested", len(list))
+	if s.opts.Workers > 1 && s.opts.CrcUsage == FileCrcAtimeNsec && !s.opts.LazyHash {
+		s.crcs = newCrcPool(s.src, s.cache, s.opts.Workers)
+		defer func() {
+			s.crcs.close()
+			s.crcs = nil
+		}()
+		for _, index := range list {
+			if index < uint32(len(s.sendList)) && s.useCrc(s.sendList[index]) {
+				s.crcs.add(filepath.Join(s.root, s.sendList[index]), s.sendInfos[index])
+			}
+		}
+	}
+	if s.opts.Streams > 1 {
+		return s.sendStreams(list)
+	}
+	return s.sendItems(list)
+}
+
+// sendItems sends the content of the items at the given indexes, and
+// flushes.
+func (s *Sender) sendItems(list []uint32) error {
+	if s.opts.Pack {
+		return s.sendPacked(list)
 	}
+	s.dedup.expect(s, list)
 	for _, index := range list {
+		if s.isAborted() {
+			return s.abort(s.writeAbort)
+		}
 		// index starts at 1
 		if err := s.sendItem(index); err != nil {
 			return err
@@ -266,3 +819,63 @@ func (s *Sender) handleFileList() error {
 	}
 	return s.out.Flush()
 }
+
+// readFileList reads the indexes of the items the receiver requests. An item
+// requested twice would be sent twice, and only received once, so that's
+// refused, as is an item which isn't in the list.
+func (s *Sender) readFileList() ([]uint32, error) {
+	list, err := readRequests(s.in, uint32(len(s.sendList)))
+	if err != nil {
+		return nil, err
+	}
+	if len(s.requested) != len(s.sendList) {
+		s.requested = make([]bool, len(s.sendList))
+	}
+	for _, index := range list {
+		if index >= uint32(len(s.sendList)) {
+			return nil, protocolErrorf("index %d not in list (length %d)", index, len(s.sendList))
+		}
+		if s.requested[index] {
+			return nil, protocolErrorf("item %d requested twice", index)
+		}
+		s.requested[index] = true
+	}
+	if s.opts.Verbosity >= 3 {
+		log.Printf("Got list, %d items requested", len(list))
+	}
+	return list, nil
+}
+
+// excluded returns whether the item at path (below the root) matches any of
+// the Excludes, or those of a subtree it is in. The synced directory itself is
+// never excluded.
+func (s *Sender) excluded(path string) bool {
+	i := strings.IndexByte(path, '/')
+	if i < 0 {
+		return false
+	}
+	rel := path[i+1:]
+	if matchesAny(s.opts.Excludes, rel) {
+		return true
+	}
+	for _, st := range s.opts.Subtrees {
+		if strings.HasPrefix(rel, st.Path+"/") && matchesAny(st.Excludes, rel[len(st.Path)+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny returns whether any of the patterns matches the name of the item
+// at path, or path itself.
+func matchesAny(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
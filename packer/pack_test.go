@@ -1,19 +1,36 @@
 package packer
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
 	rand2 "math/rand"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/iotest"
 	"time"
+
+	"github.com/golang/snappy"
+	"github.com/holiman/qvm-sync/internal/treegen"
 )
 
 func TestMarshalUnMarshal(t *testing.T) {
@@ -34,6 +51,8 @@ func TestMarshalUnMarshal(t *testing.T) {
 		rand.Read(in)
 		// set name length explicitly to zero
 		copy(in[0:], []byte{0, 0, 0, 0})
+		// and a single file type, that of a regular file, see checkHeader
+		binary.LittleEndian.PutUint32(in[4:], binary.LittleEndian.Uint32(in[4:])&^uint32(os.ModeType))
 		hdr, err := fromBin(in)
 		if err != nil {
 			t.Fatal(err)
@@ -66,6 +85,36 @@ func TestMarshalUnMarshal(t *testing.T) {
 		if !reflect.DeepEqual(&hdr, hdr2) {
 			t.Fatalf("err: %v != %v", hdr, hdr2)
 		}
+		// The same as the fields, in order
+		var want bytes.Buffer
+		binary.Write(&want, binary.LittleEndian, hdr.Data)
+		want.WriteString("abcde\x00")
+		if !bytes.Equal(out, want.Bytes()) {
+			t.Fatalf("marshalled %x, want %x", out, want.Bytes())
+		}
+	}
+	// Only the header and its path are allocated, unless the pool drops
+	// buffers, as it does at random with the race detector
+	pooled := true
+	for i := 0; i < 100 && pooled; i++ {
+		b := getHeaderBuf(1)
+		headerPool.Put(b)
+		got := headerPool.Get()
+		pooled = got == b
+		headerPool.Put(got)
+	}
+	if !pooled {
+		return
+	}
+	hdr.path = strings.Repeat("a", 1000)
+	hdr.Data.NameLen = uint32(len(hdr.path) + 1)
+	out, _ := toBin(&hdr)
+	r := bytes.NewReader(out)
+	if n := testing.AllocsPerRun(100, func() { hdr.marshallBinary(ioutil.Discard) }); n != 0 {
+		t.Errorf("marshalling allocates %v times", n)
+	}
+	if n := testing.AllocsPerRun(100, func() { r.Reset(out); unMarshallBinary(r) }); n > 2 {
+		t.Errorf("unmarshalling allocates %v times", n)
 	}
 }
 
@@ -150,7 +199,7 @@ func testEntireDirectory(t *testing.T, path string) {
 	var recv = func() {
 		defer pipeTwoOut.Close()
 
-		r, err := NewReceiver(pipeOneIn, pipeTwoOut)
+		r, err := NewReceiver(pipeOneIn, pipeTwoOut, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -184,18 +233,6 @@ func testOsWalk(dirname string) error {
 	return err
 }
 
-// With crc:
-//BenchmarkCrcFilesBuf/test-32-6         	       1	1033402134 ns/op
-//BenchmarkCrcFilesBuf/test-64-6         	       2	 884616798 ns/op // 884 ms-- sane choice
-//BenchmarkCrcFilesBuf/test-128-6        	       2	 869347812 ns/op
-//BenchmarkCrcFilesBuf/test-1M-6         	       2	 873511816 ns/op
-
-// Without crc:
-//BenchmarkCrcFilesBuf/test-32-6         	      10	 161151702 ns/op // 161 ms
-//BenchmarkCrcFilesBuf/test-64-6         	      10	 161965409 ns/op
-//BenchmarkCrcFilesBuf/test-128-6        	      10	 170212225 ns/op
-//BenchmarkCrcFilesBuf/test-1M-6         	      10	 166505231 ns/op
-
 func testOsWalkInternal(root, path string, stat os.FileInfo) error {
 	var (
 		cur = filepath.Join(root, path)
@@ -219,50 +256,77 @@ func testOsWalkInternal(root, path string, stat os.FileInfo) error {
 	return nil
 }
 
-func TestCrcFiles(t *testing.T) {
-
-	err := testOsWalk("/home/user/go/src/github.com/ethereum/go-ethereum")
-	if err != nil {
+// genTree generates the trees of the spec in a temporary directory, which
+// it returns.
+func genTree(t *testing.T, spec *treegen.Spec) string {
+	dir, _ := ioutil.TempDir("", "gentree")
+	if _, err := treegen.Generate(dir, spec); err != nil {
+		os.RemoveAll(dir)
 		t.Fatal(err)
 	}
+	return dir
 }
 
-func BenchmarkCrcFiles(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		testOsWalk("/home/user/go/src/github.com/ethereum/go-ethereum")
+func TestCrcFiles(t *testing.T) {
+	dir := genTree(t, &treegen.Spec{
+		Seed:     1,
+		Files:    500,
+		Dirs:     20,
+		Depth:    4,
+		Sizes:    []treegen.SizeClass{{Size: 4 << 10, Weight: 90}, {Size: 256 << 10, Weight: 10}},
+		Content:  "mixed",
+		Symlinks: 0.05,
+	})
+	defer os.RemoveAll(dir)
+	err := testOsWalk(filepath.Join(dir, "base", "tree"))
+	if err != nil {
+		t.Fatal(err)
 	}
 }
 
-func BenchmarkCrcFilesBuf(b *testing.B) {
-	b.Run("test-32", func(b *testing.B) {
-
-		b.ResetTimer()
-		for i := 0; i < b.N; i++ {
-			testOsWalk("/home/user/go/src/github.com/ethereum/go-ethereum")
-		}
-	})
-
-	b.Run("test-64", func(b *testing.B) {
-
-		b.ResetTimer()
-		for i := 0; i < b.N; i++ {
-			testOsWalk("/home/user/go/src/github.com/ethereum/go-ethereum")
-		}
-	})
-	b.Run("test-128", func(b *testing.B) {
-
-		b.ResetTimer()
-		for i := 0; i < b.N; i++ {
-			testOsWalk("/home/user/go/src/github.com/ethereum/go-ethereum")
-		}
+// TestGeneratedTree syncs a generated tree, and then its second version, and
+// checks that the destination ends up the same as the latter.
+func TestGeneratedTree(t *testing.T) {
+	src := genTree(t, &treegen.Spec{
+		Seed:     2,
+		Files:    300,
+		Dirs:     12,
+		Depth:    3,
+		Sizes:    []treegen.SizeClass{{Size: 1 << 10, Weight: 80}, {Size: 64 << 10, Weight: 20}},
+		Content:  "mixed",
+		Symlinks: 0.1,
+		Change:   0.3,
 	})
-	b.Run("test-1M", func(b *testing.B) {
-
-		b.ResetTimer()
-		for i := 0; i < b.N; i++ {
-			testOsWalk("/home/user/go/src/github.com/ethereum/go-ethereum")
-		}
+	dest, _ := ioutil.TempDir("", "gentree-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	for _, version := range []string{"base", "changed"} {
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest)))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			s, err := NewSender(out, in, NewOptions(WithVerbosity(0)))
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, version, "tree"))
+		})
+	}
+	var diffs []*Difference
+	runPiped(t, func(in io.Reader, out io.Writer) error {
+		return ServeVerify(in, out, func(dir string) (string, error) {
+			return dest, nil
+		})
+	}, func(in io.Reader, out io.Writer) (err error) {
+		diffs, err = Verify(in, out, filepath.Join(src, "changed"), "tree")
+		return err
 	})
+	for _, d := range diffs {
+		t.Errorf("%v %v", d.Path, d.Change())
+	}
 }
 
 // TestSymlinkOutsideOfJailRemoval tests that if the root-jailing is not active,
@@ -310,7 +374,11 @@ func TestSymlinkOutsideOfJailRemoval(t *testing.T) {
 
 	*/
 	// So now we sync over 'emptydir', which will trigger the removal of these
-	// But we must first swap the names
+	// But we must first swap the names. Git doesn't keep empty directories, so
+	// 'emptydir' may need to be created first.
+	if err := os.MkdirAll("./testdata/emptydir", 0755); err != nil {
+		t.Fatal(err)
+	}
 	if err := swapDirs("./testdata/linktest", "./testdata/emptydir"); err != nil {
 		t.Fatal(err)
 	}
@@ -357,3 +425,3865 @@ func TestOverwriteROnlyFiles(t *testing.T) {
 	RemoveIfExist(dir)
 
 }
+
+func TestReceiverLimits(t *testing.T) {
+	r := &Receiver{
+		dirEntries:    make(map[string]int),
+		maxDepth:      3,
+		maxDirEntries: 2,
+	}
+	dir := func(path string) *fileHeader {
+		return &fileHeader{path: path, Data: fileHeaderData{Mode: uint32(os.ModeDir | 0755)}}
+	}
+	file := func(path string) *fileHeader {
+		return &fileHeader{path: path, Data: fileHeaderData{Mode: 0644}}
+	}
+	// a, a/b, a/b/c are fine, a/b/c/d is too deep
+	for _, hdr := range []*fileHeader{dir("a"), dir("a/b"), file("a/b/c")} {
+		if err := r.checkLimits(hdr); err != nil {
+			t.Fatalf("%v: unexpected error: %v", hdr.path, err)
+		}
+		if hdr.isDir() {
+			r.visitDir(hdr.path)
+		}
+	}
+	if err := r.checkLimits(file("a/b/c/d")); err == nil {
+		t.Fatal("expected depth error")
+	}
+	// a/b has one entry, one more is ok, then it's full
+	if err := r.checkLimits(file("a/b/d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.checkLimits(file("a/b/e")); err == nil {
+		t.Fatal("expected entry count error")
+	}
+	// Leaving a/b does not count as an entry
+	if err := r.checkLimits(dir("a/b")); err != nil {
+		t.Fatal(err)
+	}
+	r.visitDir("a/b")
+	// Entering a/b again does not reset its count
+	if err := r.checkLimits(dir("a/b")); err != nil {
+		t.Fatal(err)
+	}
+	r.visitDir("a/b")
+	if err := r.checkLimits(file("a/b/f")); err == nil {
+		t.Fatal("expected entry count error after re-entering")
+	}
+}
+
+func TestReceiverPaths(t *testing.T) {
+	newReceiver := func() *Receiver {
+		return &Receiver{paths: make(map[string]struct{})}
+	}
+	dir := func(path string) *fileHeader {
+		return &fileHeader{path: path, Data: fileHeaderData{Mode: uint32(os.ModeDir | 0755)}}
+	}
+	file := func(path string) *fileHeader {
+		return &fileHeader{path: path, Data: fileHeaderData{Mode: 0644}}
+	}
+	link := func(path string) *fileHeader {
+		return &fileHeader{path: path, Data: fileHeaderData{Mode: uint32(os.ModeSymlink | 0777)}}
+	}
+	// receive feeds the headers to the receiver, and returns the first error
+	receive := func(r *Receiver, hdrs ...*fileHeader) error {
+		for _, hdr := range hdrs {
+			if err := r.checkPath(hdr); err != nil {
+				return err
+			}
+			if hdr.isDir() {
+				r.visitDir(hdr.path)
+			}
+		}
+		return nil
+	}
+	if err := receive(newReceiver(), dir("a"), file("a/f"), dir("a/b"), link("a/b/l"), dir("a/b"), dir("a")); err != nil {
+		t.Fatalf("valid tree refused: %v", err)
+	}
+	for i, hdrs := range [][]*fileHeader{
+		{dir("/a")},
+		{dir("..")},
+		{dir("a"), file("a/../b")},
+		{dir("a"), file("a//b")},
+		{dir("a/b")},
+		{dir("a"), file("b")},
+		{dir("a"), dir("a/b"), dir("a/b"), file("a/b/c")},
+		{dir("a"), dir("a"), dir("b")},
+		// A symlink, and a directory of the same name to write through it
+		{dir("a"), link("a/l"), dir("a/l"), file("a/l/f")},
+		{dir("a"), file("a/f"), file("a/f")},
+	} {
+		if err := receive(newReceiver(), hdrs...); err == nil {
+			t.Errorf("test %d: invalid tree accepted", i)
+		}
+	}
+}
+
+// FuzzReceiver feeds mutated streams to a receiver, which must fail on them
+// rather than crash or hang. The seed is the sync of testdata to an empty
+// destination. See also cmd/qsync-fuzz, which runs the receiver with limits.
+func FuzzReceiver(f *testing.F) {
+	buf := new(bytes.Buffer)
+	s, err := NewBatchSender(buf, &Options{Compression: CompressionOff, CrcUsage: FileCrcAtimeNsecMetadata}, nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	if err := s.Sync("testdata"); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dest, _ := ioutil.TempDir("", "fuzz-receiver")
+		defer os.RemoveAll(dest)
+		r, err := NewReceiver(bytes.NewReader(data), ioutil.Discard, NewReceiverOptions(WithRoot(dest), WithQuota(16<<20)))
+		if err == nil {
+			r.Sync()
+		}
+	})
+}
+
+func TestPullRequest(t *testing.T) {
+	for _, path := range []string{"foo", "foo/bar", "."} {
+		buf := new(bytes.Buffer)
+		if err := RequestPull(buf, path); err != nil {
+			t.Fatalf("path %q: %v", path, err)
+		}
+		got, err := ReadPullRequest(buf)
+		if err != nil {
+			t.Fatalf("path %q: %v", path, err)
+		}
+		if got != path {
+			t.Errorf("got %q, want %q", got, path)
+		}
+	}
+	for _, path := range []string{"", "/etc", "..", "../foo", "foo/../../bar", "foo//bar"} {
+		// Write it raw, since RequestPull refuses it too
+		buf := new(bytes.Buffer)
+		req := &resultHeaderExt{LastNameLen: uint32(len(path) + 1), LastName: path}
+		req.marshallBinary(buf)
+		if _, err := ReadPullRequest(buf); err == nil {
+			t.Errorf("path %q: expected error", path)
+		}
+	}
+}
+
+func TestWirePaths(t *testing.T) {
+	for _, path := range []string{"foo", "foo/bar", "foo..bar/..baz"} {
+		buf := new(bytes.Buffer)
+		hdr := &fileHeader{path: path}
+		hdr.Data.NameLen = uint32(len(path) + 1)
+		hdr.marshallBinary(buf)
+		if _, err := unMarshallBinary(buf); err != nil {
+			t.Errorf("path %q: %v", path, err)
+		}
+	}
+	for _, path := range []string{"/etc/passwd", "..", "../foo", "foo/../../bar", "foo/..", "foo\x00/bar"} {
+		buf := new(bytes.Buffer)
+		hdr := &fileHeader{path: path}
+		hdr.Data.NameLen = uint32(len(path) + 1)
+		hdr.marshallBinary(buf)
+		var perr *ProtocolError
+		if _, err := unMarshallBinary(buf); !errors.As(err, &perr) {
+			t.Errorf("path %q: got %v, want a ProtocolError", path, err)
+		}
+	}
+}
+
+func TestHeaderChecks(t *testing.T) {
+	header := func(path string, mode os.FileMode, size uint64) *fileHeader {
+		hdr := &fileHeader{path: path, Data: fileHeaderData{Mode: uint32(mode), FileLen: size}}
+		if path != "" {
+			hdr.Data.NameLen = uint32(len(path) + 1)
+		}
+		return hdr
+	}
+	for i, hdr := range []*fileHeader{
+		header("", 0, 0),
+		header("", os.ModeIrregular, 0),
+		header("f", 0644, 1<<40),
+		header("d", os.ModeDir|0755, 0),
+		header("l", os.ModeSymlink|0777, MaxPathLength-1),
+		header("c", os.ModeDevice|os.ModeCharDevice|0600, 0),
+		header("g", os.ModeIrregular, uint64(syscall.EACCES)),
+	} {
+		buf := new(bytes.Buffer)
+		hdr.marshallBinary(buf)
+		if _, err := unMarshallBinary(buf); err != nil {
+			t.Errorf("test %d: %v", i, err)
+		}
+	}
+	for i, hdr := range []*fileHeader{
+		header("d", os.ModeDir|os.ModeSymlink|0755, 0),
+		header("p", os.ModeNamedPipe|os.ModeSocket, 0),
+		header("d", os.ModeDir|0755, 4096),
+		header("l", os.ModeSymlink|0777, MaxPathLength),
+		// The length of the path doesn't match it
+		{path: "abc", Data: fileHeaderData{NameLen: 3}},
+		{path: "abc", Data: fileHeaderData{NameLen: 1}},
+	} {
+		buf := new(bytes.Buffer)
+		hdr.marshallBinary(buf)
+		var perr *ProtocolError
+		if _, err := unMarshallBinary(buf); !errors.As(err, &perr) {
+			t.Errorf("test %d: got %v, want a ProtocolError", i, err)
+		}
+	}
+	// A directory which is entered, but never left
+	dest, _ := ioutil.TempDir("", "headers-dest")
+	defer os.RemoveAll(dest)
+	buf := new(bytes.Buffer)
+	newVersionHeader(CompressionOff, FileCrcAtimeNsecMetadata, 0).marshallBinary(buf)
+	header("a", os.ModeDir|0755, 0).marshallBinary(buf)
+	header("a/b", os.ModeDir|0755, 0).marshallBinary(buf)
+	header("a/b", os.ModeDir|0755, 0).marshallBinary(buf)
+	buf.Write(make([]byte, fileHeaderSize))
+	r, err := NewReceiver(buf, ioutil.Discard, NewReceiverOptions(WithRoot(dest)))
+	if err == nil {
+		err = r.Sync()
+	}
+	var perr *ProtocolError
+	if !errors.As(err, &perr) || !strings.Contains(err.Error(), "not left") {
+		t.Errorf("unterminated directory: got %v", err)
+	}
+}
+
+// writeTestFile writes the file below dir, creating the parent directories.
+func writeTestFile(t *testing.T, dir, path, content string) {
+	t.Helper()
+	os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0755)
+	if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runPiped connects the serving and the local side of an exchange, and runs
+// them to completion.
+func runPiped(t *testing.T, serve, local func(in io.Reader, out io.Writer) error) {
+	t.Helper()
+	inR, outL := io.Pipe()
+	inL, outR := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- serve(inR, outR)
+		outR.Close()
+	}()
+	if err := local(inL, outL); err != nil {
+		t.Fatalf("local: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("remote: %v", err)
+	}
+}
+
+func TestTwoWaySync(t *testing.T) {
+	local, _ := ioutil.TempDir("", "twoway-local")
+	remote, _ := ioutil.TempDir("", "twoway-remote")
+	defer os.RemoveAll(local)
+	defer os.RemoveAll(remote)
+
+	write := func(dir, path, content string) {
+		writeTestFile(t, dir, path, content)
+	}
+	read := func(dir, path string) string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			return "<missing>"
+		}
+		return string(data)
+	}
+	sync := func(policy ConflictPolicy) {
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			return ServeTwoWay(in, out, func(dir string) (string, error) {
+				return remote, nil
+			})
+		}, func(in io.Reader, out io.Writer) error {
+			opts := &TwoWayOptions{Peer: "remote", Policy: policy}
+			return TwoWaySync(in, out, local, ".", opts)
+		})
+	}
+	write(local, "a/local.txt", "local")
+	write(remote, "b/remote.txt", "remote")
+	write(local, "both.txt", "local version")
+	write(remote, "both.txt", "remote version")
+	sync(ConflictRename)
+	for dir, name := range map[string]string{local: "local", remote: "remote"} {
+		if got := read(dir, "a/local.txt"); got != "local" {
+			t.Errorf("%v: a/local.txt: %q", name, got)
+		}
+		if got := read(dir, "b/remote.txt"); got != "remote" {
+			t.Errorf("%v: b/remote.txt: %q", name, got)
+		}
+		if got := read(dir, "both.txt"); got != "local version" {
+			t.Errorf("%v: both.txt: %q", name, got)
+		}
+		if got := read(dir, "both.txt.conflict-remote"); got != "remote version" {
+			t.Errorf("%v: both.txt.conflict-remote: %q", name, got)
+		}
+	}
+	// Changes on one side only propagate, including deletions
+	os.Remove(filepath.Join(remote, "a/local.txt"))
+	write(local, "b/remote.txt", "changed locally")
+	sync(ConflictNewest)
+	if got := read(local, "a/local.txt"); got != "<missing>" {
+		t.Errorf("deletion not propagated: %q", got)
+	}
+	if got := read(remote, "b/remote.txt"); got != "changed locally" {
+		t.Errorf("change not propagated: %q", got)
+	}
+	// Conflicting changes, the newest wins
+	write(remote, "both.txt", "older")
+	os.Chtimes(filepath.Join(remote, "both.txt"), time.Now(), time.Now().Add(-time.Hour))
+	write(local, "both.txt", "newer")
+	sync(ConflictNewest)
+	if got := read(remote, "both.txt"); got != "newer" {
+		t.Errorf("newest did not win: %q", got)
+	}
+	// Directory times are set after their content has been written
+	mtime := time.Unix(1600000000, 0)
+	write(remote, "c/file.txt", "content")
+	os.Chtimes(filepath.Join(remote, "c"), mtime, mtime)
+	sync(ConflictNewest)
+	if info, err := os.Stat(filepath.Join(local, "c")); err != nil {
+		t.Error(err)
+	} else if !info.ModTime().Equal(mtime) {
+		t.Errorf("directory mtime: %v, want %v", info.ModTime(), mtime)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	local, _ := ioutil.TempDir("", "verify-local")
+	remote, _ := ioutil.TempDir("", "verify-remote")
+	defer os.RemoveAll(local)
+	defer os.RemoveAll(remote)
+
+	mtime := time.Unix(1600000000, 0)
+	write := func(dir, path, content string) {
+		writeTestFile(t, dir, path, content)
+		os.Chtimes(filepath.Join(dir, path), mtime, mtime)
+	}
+	verify := func() []string {
+		var diffs []*Difference
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			return ServeVerify(in, out, func(dir string) (string, error) {
+				return remote, nil
+			})
+		}, func(in io.Reader, out io.Writer) (err error) {
+			diffs, err = Verify(in, out, local, ".")
+			return err
+		})
+		var paths []string
+		for _, d := range diffs {
+			paths = append(paths, d.Path)
+		}
+		return paths
+	}
+	for _, dir := range []string{local, remote} {
+		write(dir, "a/same.txt", "same")
+		write(dir, "content.txt", "aaaa")
+	}
+	if diffs := verify(); len(diffs) != 0 {
+		t.Fatalf("expected no differences, got %v", diffs)
+	}
+	write(remote, "content.txt", "bbbb")
+	write(local, "a/local.txt", "local")
+	write(remote, "remote.txt", "remote")
+	want := []string{"a/local.txt", "content.txt", "remote.txt"}
+	if diffs := verify(); !reflect.DeepEqual(diffs, want) {
+		t.Fatalf("got %v, want %v", diffs, want)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	src, _ := ioutil.TempDir("", "batch-src")
+	dest, _ := ioutil.TempDir("", "batch-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	cwd, _ := os.Getwd()
+	if err := os.Chdir(dest); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	dir := filepath.Join(src, "dir")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "b"), []byte("b"), 0644)
+	// Uncompressed, so the items can be looked for in the batch
+	opts := &Options{Compression: CompressionOff, CrcUsage: FileCrcAtimeNsecMetadata}
+
+	batch := func(description io.Reader) *bytes.Buffer {
+		buf := new(bytes.Buffer)
+		s, err := NewBatchSender(buf, opts, description)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Sync(dir); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	if err := ApplyBatch(batch(nil), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile("dir/sub/b"); string(data) != "b" {
+		t.Fatalf("wrong content: %q", data)
+	}
+	// An incremental batch only contains the changed file
+	description := new(bytes.Buffer)
+	if err := DescribeDestination(description, "."); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("changed"), 0644)
+	incremental := batch(description)
+	if !bytes.Contains(incremental.Bytes(), []byte("dir/a\x00")) || bytes.Contains(incremental.Bytes(), []byte("dir/sub/b\x00b")) {
+		t.Fatal("wrong items in incremental batch")
+	}
+	empty, _ := ioutil.TempDir("", "batch-empty")
+	defer os.RemoveAll(empty)
+	if err := os.Chdir(empty); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyBatch(bytes.NewReader(incremental.Bytes()), nil, 0); err == nil {
+		t.Fatal("expected error applying incremental batch to wrong destination")
+	}
+	if err := os.Chdir(dest); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyBatch(incremental, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile("dir/a"); string(data) != "changed" {
+		t.Fatalf("wrong content: %q", data)
+	}
+}
+
+func TestSignedSync(t *testing.T) {
+	src, _ := ioutil.TempDir("", "signed-src")
+	defer os.RemoveAll(src)
+	dir := filepath.Join(src, "dir")
+	os.MkdirAll(dir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("signed content"), 0644)
+	os.Symlink("a", filepath.Join(dir, "link"))
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	sync := func(signWith ed25519.PrivateKey, trust ed25519.PublicKey) (string, error) {
+		dest, _ := ioutil.TempDir("", "signed-dest")
+		cwd, _ := os.Getwd()
+		os.Chdir(dest)
+		defer os.Chdir(cwd)
+
+		inR, outS := io.Pipe()
+		inS, outR := io.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			opts := &Options{Compression: CompressionSnappy, CrcUsage: FileCrcAtimeNsecMetadata, SigningKey: signWith}
+			s, err := NewSender(outS, inS, opts)
+			if err == nil {
+				err = s.Sync(dir)
+			}
+			outS.CloseWithError(err)
+			errc <- err
+		}()
+		r, err := NewReceiver(inR, outR, &ReceiverOptions{TrustedKey: trust})
+		if err == nil {
+			err = r.Sync()
+		}
+		outR.CloseWithError(err)
+		inR.CloseWithError(err)
+		<-errc
+		return dest, err
+	}
+	dest, err := sync(priv, pub)
+	defer os.RemoveAll(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dest, "dir", "a")); string(data) != "signed content" {
+		t.Fatalf("wrong content: %q", data)
+	}
+	// Signed, but not trusted, is fine without a trusted key
+	dest, err = sync(priv, nil)
+	defer os.RemoveAll(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		key   ed25519.PrivateKey
+		trust ed25519.PublicKey
+	}{
+		{priv, otherPub}, // wrong key
+		{nil, pub},       // not signed
+	} {
+		dest, err := sync(tc.key, tc.trust)
+		defer os.RemoveAll(dest)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		// Nothing should have been created
+		if _, err := os.Lstat(filepath.Join(dest, "dir")); err == nil {
+			t.Fatal("transfer was applied")
+		}
+	}
+}
+
+// failingWriter fails once more than n bytes have been written.
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n -= len(p); w.n < 0 {
+		return 0, io.ErrClosedPipe
+	}
+	return len(p), nil
+}
+
+func TestFanout(t *testing.T) {
+	src, _ := ioutil.TempDir("", "fanout-src")
+	dest, _ := ioutil.TempDir("", "fanout-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, src, "dir/a", "content")
+	writeTestFile(t, src, "dir/sub/b", "more content")
+	cwd, _ := os.Getwd()
+	os.Chdir(dest)
+	defer os.Chdir(cwd)
+
+	// One destination works, the other breaks during the metadata
+	inR, outS := io.Pipe()
+	inS, outR := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		r, err := NewReceiver(inR, outR, nil)
+		if err == nil {
+			err = r.Sync()
+		}
+		outR.CloseWithError(err)
+		inR.CloseWithError(err)
+		errc <- err
+	}()
+	f, err := NewFanoutSender([]Destination{
+		{Name: "good", Out: outS, In: inS},
+		{Name: "broken", Out: &failingWriter{n: 64}, In: strings.NewReader("")},
+	}, &Options{Compression: CompressionSnappy, CrcUsage: FileCrcAtimeNsecMetadata})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync(filepath.Join(src, "dir"))
+	outS.Close()
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("expected failure of the broken destination, got %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("receiver: %v", err)
+	}
+	for path, want := range map[string]string{"dir/a": "content", "dir/sub/b": "more content"} {
+		if data, _ := ioutil.ReadFile(filepath.Join(dest, path)); string(data) != want {
+			t.Errorf("%v: got %q, want %q", path, data, want)
+		}
+	}
+}
+
+// TestEmbedded tests syncing into a root other than the working directory,
+// with callbacks.
+func TestEmbedded(t *testing.T) {
+	src, _ := ioutil.TempDir("", "embedded-src")
+	dest, _ := ioutil.TempDir("", "embedded-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, src, "dir/a", "content")
+	writeTestFile(t, src, "dir/sub/b", "more content")
+
+	sync := func(ropts ...ReceiverOption) {
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(append(ropts, WithRoot(dest))...))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			s, err := NewSender(out, in, NewOptions(WithVerbosity(0)))
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+	}
+	var received []string
+	sync(WithReceiveProgress(func(path string, size uint64) {
+		received = append(received, path)
+	}))
+	if want := []string{"dir/a", "dir/sub/b"}; !reflect.DeepEqual(received, want) {
+		t.Fatalf("progress: got %v, want %v", received, want)
+	}
+	// Local changes are kept, if the conflict callback says so
+	writeTestFile(t, dest, "dir/a", "local change")
+	writeTestFile(t, dest, "dir/c", "local only")
+	var conflicts []string
+	sync(WithConflict(func(path string) bool {
+		conflicts = append(conflicts, path)
+		return false
+	}))
+	sort.Strings(conflicts)
+	if want := []string{"dir/a", "dir/c"}; !reflect.DeepEqual(conflicts, want) {
+		t.Fatalf("conflicts: got %v, want %v", conflicts, want)
+	}
+	for path, want := range map[string]string{"dir/a": "local change", "dir/c": "local only", "dir/sub/b": "more content"} {
+		if data, _ := ioutil.ReadFile(filepath.Join(dest, path)); string(data) != want {
+			t.Errorf("%v: got %q, want %q", path, data, want)
+		}
+	}
+}
+
+// scanHooks leaves out received files with "virus" in them, and records the
+// result of the sync.
+type scanHooks struct {
+	NoHooks
+	result error
+	done   bool
+}
+
+func (h *scanHooks) PostFile(path, local string) error {
+	if data, _ := ioutil.ReadFile(local); strings.Contains(string(data), "virus") {
+		return ErrSkipItem
+	}
+	return nil
+}
+
+func (h *scanHooks) PostSync(err error) { h.result, h.done = err, true }
+
+func TestSummary(t *testing.T) {
+	src, _ := ioutil.TempDir("", "summary-src")
+	dest, _ := ioutil.TempDir("", "summary-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, src, "dir/a", "content")
+	writeTestFile(t, src, "dir/sub/b", "more content")
+	writeTestFile(t, src, "dir/old/c", "to be removed")
+
+	// sync returns the paths received, and the bytes sent by the sender
+	sync := func(summary bool, ropts ...ReceiverOption) ([]string, int) {
+		var received []string
+		var sent int
+		ropts = append(ropts, WithRoot(dest), WithReceiveProgress(func(path string, size uint64) {
+			received = append(received, path)
+		}))
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(ropts...))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			opts := NewOptions(WithVerbosity(0), WithCompression(CompressionOff))
+			opts.Summary = summary
+			s, err := NewSender(out, in, opts)
+			if err != nil {
+				return err
+			}
+			err = s.Sync(filepath.Join(src, "dir"))
+			sent, _ = s.Stats()
+			return err
+		})
+		sort.Strings(received)
+		return received, sent
+	}
+	// Into an empty destination, everything is sent
+	if got, _ := sync(true); !reflect.DeepEqual(got, []string{"dir/a", "dir/old/c", "dir/sub/b"}) {
+		t.Fatalf("initial sync received %v", got)
+	}
+	os.RemoveAll(filepath.Join(src, "dir/old"))
+	writeTestFile(t, src, "dir/a", "changed content")
+	writeTestFile(t, src, "dir/new/d", "new")
+	if got, _ := sync(true); !reflect.DeepEqual(got, []string{"dir/a", "dir/new/d"}) {
+		t.Fatalf("second sync received %v", got)
+	}
+	for path, want := range map[string]string{"dir/a": "changed content", "dir/sub/b": "more content", "dir/new/d": "new"} {
+		if data, _ := ioutil.ReadFile(filepath.Join(dest, path)); string(data) != want {
+			t.Errorf("%v: got %q, want %q", path, data, want)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "dir/old")); !os.IsNotExist(err) {
+		t.Errorf("dir/old not deleted: %v", err)
+	}
+	// Without changes, the summary leaves out all but the synced directory
+	_, full := sync(false)
+	_, summarized := sync(true)
+	if summarized >= full {
+		t.Errorf("sent %d bytes with a summary, %d without", summarized, full)
+	}
+	// A receiver which renames items declines
+	rename := FilterFunc(func(path string, mode os.FileMode) (string, bool) { return path, true })
+	writeTestFile(t, src, "dir/e", "declined")
+	if got, _ := sync(true, WithReceiveFilter(rename)); !reflect.DeepEqual(got, []string{"dir/e"}) {
+		t.Fatalf("declined sync received %v", got)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	src, _ := ioutil.TempDir("", "streams-src")
+	defer os.RemoveAll(src)
+	files := map[string]string{"dir/big": strings.Repeat("large and compressible ", 20000)}
+	for i := 0; i < 10; i++ {
+		files[fmt.Sprintf("dir/sub%d/f%d", i%3, i)] = fmt.Sprintf("content %d", i)
+	}
+	for path, content := range files {
+		writeTestFile(t, src, path, content)
+	}
+	os.Symlink("big", filepath.Join(src, "dir/link"))
+	for _, compression := range []int{CompressionOff, CompressionSnappy} {
+		dest, _ := ioutil.TempDir("", "streams-dest")
+		defer os.RemoveAll(dest)
+		var received int
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest),
+				WithReceiveProgress(func(path string, size uint64) { received++ })))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			opts := NewOptions(WithVerbosity(0), WithCompression(compression), WithSummary())
+			opts.Streams = 4
+			s, err := NewSender(out, in, opts)
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		if received != len(files)+1 {
+			t.Errorf("compression %d: received %d items, want %d", compression, received, len(files)+1)
+		}
+		for path, want := range files {
+			if data, _ := ioutil.ReadFile(filepath.Join(dest, path)); string(data) != want {
+				t.Errorf("compression %d, %v: got %d bytes, want %d", compression, path, len(data), len(want))
+			}
+		}
+		if target, _ := os.Readlink(filepath.Join(dest, "dir/link")); target != "big" {
+			t.Errorf("compression %d: link points to %q", compression, target)
+		}
+	}
+}
+
+func TestSubtrees(t *testing.T) {
+	src, _ := ioutil.TempDir("", "subtrees-src")
+	defer os.RemoveAll(src)
+	for path, content := range map[string]string{
+		"dir/Photos/p":    "photo",
+		"dir/Shared/s":    "shared",
+		"dir/Code/main.c": "code",
+		"dir/Code/main.o": "object",
+		"dir/other":       "other",
+	} {
+		writeTestFile(t, src, path, content)
+	}
+	subtrees := []*Subtree{
+		{Path: "Photos", NoCrc: true},
+		{Path: "Shared", NoDelete: true},
+		{Path: "Code", Excludes: []string{"*.o"}},
+	}
+	for _, summary := range []bool{false, true} {
+		dest, _ := ioutil.TempDir("", "subtrees-dest")
+		defer os.RemoveAll(dest)
+		sync := func() []string {
+			var received []string
+			runPiped(t, func(in io.Reader, out io.Writer) error {
+				r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest),
+					WithReceiveProgress(func(path string, size uint64) { received = append(received, path) })))
+				if err != nil {
+					return err
+				}
+				return r.Sync()
+			}, func(in io.Reader, out io.Writer) error {
+				opts := NewOptions(WithVerbosity(0), WithCrcUsage(FileCrcAtimeNsecMetadata), WithSubtrees(subtrees...))
+				opts.Summary = summary
+				s, err := NewSender(out, in, opts)
+				if err != nil {
+					return err
+				}
+				return s.Sync(filepath.Join(src, "dir"))
+			})
+			sort.Strings(received)
+			return received
+		}
+		if got := sync(); !reflect.DeepEqual(got, []string{"dir/Code/main.c", "dir/Photos/p", "dir/Shared/s", "dir/other"}) {
+			t.Fatalf("summary %v: initial sync received %v", summary, got)
+		}
+		// Content changes without metadata changes are only noticed outside
+		// of Photos
+		for _, path := range []string{"dir/Photos/p", "dir/other"} {
+			info, _ := os.Stat(filepath.Join(dest, path))
+			ioutil.WriteFile(filepath.Join(dest, path), []byte("xxxxx"), 0644)
+			os.Chtimes(filepath.Join(dest, path), info.ModTime(), info.ModTime())
+		}
+		if got := sync(); !reflect.DeepEqual(got, []string{"dir/other"}) {
+			t.Fatalf("summary %v: second sync received %v", summary, got)
+		}
+		// Deletions are only made outside of Shared
+		writeTestFile(t, dest, "dir/extra", "extra")
+		writeTestFile(t, dest, "dir/Shared/extra", "extra")
+		sync()
+		if _, err := os.Lstat(filepath.Join(dest, "dir/extra")); !os.IsNotExist(err) {
+			t.Errorf("summary %v: dir/extra not deleted: %v", summary, err)
+		}
+		if _, err := os.Lstat(filepath.Join(dest, "dir/Shared/extra")); err != nil {
+			t.Errorf("summary %v: dir/Shared/extra deleted: %v", summary, err)
+		}
+	}
+}
+
+func TestJournal(t *testing.T) {
+	src, _ := ioutil.TempDir("", "journal-src")
+	dest, _ := ioutil.TempDir("", "journal-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, src, "dir/a", "content")
+	writeTestFile(t, src, "dir/b", "other")
+	sync := func(peer string) {
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			ropts := NewReceiverOptions(WithRoot(dest), WithAuditLog(0))
+			ropts.Profile, ropts.Peer = "docs", peer
+			r, err := NewReceiver(in, out, ropts)
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			s, err := NewSender(out, in, NewOptions(WithVerbosity(0)))
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+	}
+	sync("work")
+	writeTestFile(t, src, "dir/a", "changed content")
+	os.Remove(filepath.Join(src, "dir/b"))
+	sync("personal")
+
+	entries, err := ReadJournal(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d journal entries, want 2", len(entries))
+	}
+	first, second := entries[0], entries[1]
+	if first.Peer != "work" || first.Profile != "docs" || first.Dir != "dir" || first.Files != 2 || first.Bytes != 12 {
+		t.Errorf("wrong first entry: %+v", first)
+	}
+	if second.Peer != "personal" || second.Files != 1 || second.Deleted != 1 || second.Manifest == first.Manifest {
+		t.Errorf("wrong second entry: %+v", second)
+	}
+	events, err := FileHistory(dest, "dir/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Action != "create" || events[1].Action != "update" ||
+		events[1].Sync == nil || events[1].Sync.Peer != "personal" {
+		t.Fatalf("wrong history: %v", events)
+	}
+}
+
+// TestDeletions checks that the items the sender doesn't have are deleted by
+// the workers, and counted, and that the times of their directory are set
+// after they're gone.
+func TestDeletions(t *testing.T) {
+	for _, overlap := range []bool{false, true} {
+		src, _ := ioutil.TempDir("", "delete-src")
+		dest, _ := ioutil.TempDir("", "delete-dest")
+		defer os.RemoveAll(src)
+		defer os.RemoveAll(dest)
+		writeTestFile(t, src, "dir/keep", "kept")
+		for i := 0; i < 3*deleteWorkers; i++ {
+			writeTestFile(t, dest, fmt.Sprintf("dir/f%d", i), "stale")
+		}
+		writeTestFile(t, dest, "dir/sub/a/b", "stale")
+		past := time.Now().Add(-time.Hour).Truncate(time.Second)
+		if err := os.Chtimes(filepath.Join(src, "dir"), past, past); err != nil {
+			t.Fatal(err)
+		}
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest)))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			opts := NewOptions(WithVerbosity(0))
+			if overlap {
+				opts = NewOptions(WithVerbosity(0), WithOverlap())
+			}
+			s, err := NewSender(out, in, opts)
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		files, err := ioutil.ReadDir(filepath.Join(dest, "dir"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || files[0].Name() != "keep" {
+			t.Errorf("overlap %v: left %d items", overlap, len(files))
+		}
+		if info, err := os.Stat(filepath.Join(dest, "dir")); err != nil || !info.ModTime().Equal(past) {
+			t.Errorf("overlap %v: wrong directory mtime: %v", overlap, err)
+		}
+		entries, err := ReadJournal(dest)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("overlap %v: wrong journal: %v", overlap, err)
+		}
+		if e := entries[0]; e.Deleted != 3*deleteWorkers+1 || e.DeleteFailed != 0 {
+			t.Errorf("overlap %v: wrong entry: %+v", overlap, e)
+		}
+	}
+}
+
+// TestSnapshotFiles checks that the names of a directory larger than a batch
+// are snapshotted, and that what isn't received is deleted once the
+// directory is done.
+func TestSnapshotFiles(t *testing.T) {
+	dest, _ := ioutil.TempDir("", "snapshot")
+	defer os.RemoveAll(dest)
+	for i := 0; i < dirBatch+10; i++ {
+		writeTestFile(t, dest, fmt.Sprintf("dir/f%d", i), "")
+	}
+	r := &Receiver{
+		root:      dest,
+		toDelete:  make(map[string]struct{}),
+		snapshots: make(map[string]map[string]struct{}),
+	}
+	if err := r.snapshotFiles(r.local("dir"), true); err != nil {
+		t.Fatal(err)
+	}
+	r.removeSnapshot("dir/f0")
+	r.removeSnapshot("dir/new")
+	if len(r.toDelete) != 0 {
+		t.Fatalf("%d items to delete before the directory is done", len(r.toDelete))
+	}
+	r.endSnapshot("dir")
+	if _, ok := r.toDelete[filepath.Join(dest, "dir/f0")]; ok || len(r.toDelete) != dirBatch+9 {
+		t.Errorf("%d items to delete, want %d", len(r.toDelete), dirBatch+9)
+	}
+	if len(r.snapshots) != 0 {
+		t.Errorf("%d snapshots left", len(r.snapshots))
+	}
+	writeTestFile(t, dest, "root/etc/passwd", "")
+	if err := r.snapshotFiles(r.local("root"), true); err == nil {
+		t.Error("snapshotted what looks like a root")
+	}
+}
+
+// TestConcurrentSyncs checks that syncs in the same process don't interfere,
+// e.g. by sharing buffers.
+func TestConcurrentSyncs(t *testing.T) {
+	src, _ := ioutil.TempDir("", "concurrent-src")
+	defer os.RemoveAll(src)
+	files := make(map[string]string)
+	for i := 0; i < 4; i++ {
+		// Larger than the read buffers
+		files[fmt.Sprintf("dir/f%d", i)] = strings.Repeat(fmt.Sprintf("content of file %d ", i), 10000)
+	}
+	for path, content := range files {
+		writeTestFile(t, src, path, content)
+	}
+	var (
+		wg   sync.WaitGroup
+		errc = make(chan error, 8)
+	)
+	for i := 0; i < 4; i++ {
+		dest, _ := ioutil.TempDir("", "concurrent-dest")
+		defer os.RemoveAll(dest)
+		wg.Add(2)
+		inR, outL := io.Pipe()
+		inL, outR := io.Pipe()
+		go func() {
+			defer wg.Done()
+			defer outR.Close()
+			r, err := NewReceiver(inR, outR, NewReceiverOptions(WithRoot(dest)))
+			if err == nil {
+				err = r.Sync()
+			}
+			errc <- err
+		}()
+		go func() {
+			defer wg.Done()
+			defer outL.Close()
+			s, err := NewSender(outL, inL, NewOptions(WithVerbosity(0), WithCrcUsage(FileCrcAtimeNsec)))
+			if err == nil {
+				err = s.Sync(filepath.Join(src, "dir"))
+			}
+			errc <- err
+		}()
+		defer func() {
+			for path, want := range files {
+				if data, _ := ioutil.ReadFile(filepath.Join(dest, path)); string(data) != want {
+					t.Errorf("%v: wrong content in %v", path, dest)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	src, _ := ioutil.TempDir("", "workers-src")
+	dest, _ := ioutil.TempDir("", "workers-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	for i := 0; i < 20; i++ {
+		writeTestFile(t, src, fmt.Sprintf("dir/sub%d/f%d", i%3, i), fmt.Sprintf("content %02d", i))
+	}
+	sync := func() (received []string) {
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest),
+				WithReceiveProgress(func(path string, size uint64) { received = append(received, path) })))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			opts := NewOptions(WithVerbosity(0), WithCrcUsage(FileCrcAtimeNsec))
+			opts.Workers = 4
+			s, err := NewSender(out, in, opts)
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		return received
+	}
+	if got := sync(); len(got) != 20 {
+		t.Fatalf("initial sync received %d items", len(got))
+	}
+	// A change of content only is found by the crcs
+	path := filepath.Join(dest, "dir/sub1/f7")
+	info, _ := os.Stat(path)
+	ioutil.WriteFile(path, []byte("content xx"), 0644)
+	os.Chtimes(path, info.ModTime(), info.ModTime())
+	if got := sync(); !reflect.DeepEqual(got, []string{"dir/sub1/f7"}) {
+		t.Fatalf("second sync received %v", got)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "content 07" {
+		t.Errorf("got %q", data)
+	}
+}
+
+func TestQuickCheck(t *testing.T) {
+	src, _ := ioutil.TempDir("", "quick-src")
+	dest, _ := ioutil.TempDir("", "quick-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, src, "dir/a", "content a")
+	writeTestFile(t, src, "dir/b", "content b")
+	writeTestFile(t, src, "dir/c", "content c")
+	mtime := time.Now().Add(-time.Hour)
+	for _, name := range []string{"a", "b", "c"} {
+		os.Chtimes(filepath.Join(src, "dir", name), mtime, mtime)
+	}
+
+	sync := func() (received []string) {
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest),
+				WithReceiveProgress(func(path string, size uint64) { received = append(received, path) })))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			opts := NewOptions(WithVerbosity(0), WithQuickCheck())
+			opts.Summary = true
+			s, err := NewSender(out, in, opts)
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		sort.Strings(received)
+		return received
+	}
+	if got := sync(); len(got) != 3 {
+		t.Fatalf("initial sync received %v", got)
+	}
+	// A change which keeps the size and mtime goes unnoticed, unlike one
+	// which changes either
+	writeTestFile(t, src, "dir/a", "changed a")
+	os.Chtimes(filepath.Join(src, "dir/a"), mtime, mtime)
+	writeTestFile(t, src, "dir/b", "changed b")
+	os.Chtimes(filepath.Join(src, "dir/b"), mtime, mtime.Add(time.Second))
+	writeTestFile(t, src, "dir/c", "changed c")
+	if got := sync(); !reflect.DeepEqual(got, []string{"dir/b", "dir/c"}) {
+		t.Errorf("second sync received %v", got)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dest, "dir/a")); string(data) != "content a" {
+		t.Errorf("got %q", data)
+	}
+	// Without a summary, there's nothing to check against
+	if _, err := NewSender(ioutil.Discard, nil, NewOptions(WithQuickCheck())); err == nil {
+		t.Errorf("quick check accepted without a summary")
+	}
+}
+
+// skewingWriter shifts the time the sender sends after the version header,
+// as if its clock were off by skew.
+type skewingWriter struct {
+	w    io.Writer
+	skew time.Duration
+	head []byte // what's written up to and including the time
+}
+
+func (s *skewingWriter) Write(p []byte) (int, error) {
+	size := binary.Size(versionHeader{}) + 8
+	if len(s.head) >= size {
+		return s.w.Write(p)
+	}
+	n := size - len(s.head)
+	if n > len(p) {
+		n = len(p)
+	}
+	s.head = append(s.head, p[:n]...)
+	if len(s.head) == size {
+		now := binary.LittleEndian.Uint64(s.head[size-8:])
+		binary.LittleEndian.PutUint64(s.head[size-8:], now+uint64(s.skew))
+		if _, err := s.w.Write(s.head); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := s.w.Write(p[n:]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func TestClockSkew(t *testing.T) {
+	src, _ := ioutil.TempDir("", "skew-src")
+	dest, _ := ioutil.TempDir("", "skew-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	mtime := time.Now().Add(-24 * time.Hour)
+	// The local copies were written an hour behind on the receiver's
+	// clock, except for b, which was written earlier
+	for name, local := range map[string]time.Time{
+		"a": mtime.Add(-time.Hour),
+		"b": mtime.Add(-3 * time.Hour),
+		"c": mtime.Add(-time.Hour + time.Second),
+	} {
+		writeTestFile(t, src, "dir/"+name, "content "+name)
+		writeTestFile(t, dest, "dir/"+name, "content "+name)
+		os.Chtimes(filepath.Join(src, "dir", name), mtime, mtime)
+		os.Chtimes(filepath.Join(dest, "dir", name), local, local)
+	}
+	os.Chtimes(filepath.Join(dest, "dir"), mtime, mtime)
+	sync := func(opts ...Option) (received []string) {
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest),
+				WithReceiveProgress(func(path string, size uint64) { received = append(received, path) })))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			o := NewOptions(append(opts, WithVerbosity(0))...)
+			if o.ClockSkew {
+				out = &skewingWriter{w: out, skew: time.Hour}
+			}
+			s, err := NewSender(out, in, o)
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		sort.Strings(received)
+		return received
+	}
+	reset := func() {
+		for name, local := range map[string]time.Time{"a": mtime.Add(-time.Hour), "b": mtime.Add(-3 * time.Hour)} {
+			os.Chtimes(filepath.Join(dest, "dir", name), local, local)
+		}
+	}
+	// a and c are only compared by their crcs, and b is sent again
+	if got := sync(WithClockSkew()); !reflect.DeepEqual(got, []string{"dir/b"}) {
+		t.Errorf("metadata sync received %v", got)
+	}
+	reset()
+	// With a quick check, the sender takes a to be unchanged
+	opts := []Option{WithClockSkew(), WithQuickCheck()}
+	if got := sync(append(opts, WithSummary())...); !reflect.DeepEqual(got, []string{"dir/b"}) {
+		t.Errorf("summary sync received %v", got)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "dir/a")); err != nil || !info.ModTime().Equal(mtime.Add(-time.Hour)) {
+		t.Errorf("local copy of a was changed: %v", err)
+	}
+	// Without the offset, they all differ
+	reset()
+	if got := sync(); !reflect.DeepEqual(got, []string{"dir/a", "dir/b", "dir/c"}) {
+		t.Errorf("sync without the clock received %v", got)
+	}
+	if systematicOffset(time.Second) != 0 || systematicOffset(-time.Minute) != -time.Minute {
+		t.Error("wrong systematic offsets")
+	}
+}
+
+func TestSymlinkTimes(t *testing.T) {
+	src, _ := ioutil.TempDir("", "symlink-src")
+	dest, _ := ioutil.TempDir("", "symlink-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, src, "dir/a", "content a")
+	os.Symlink("a", filepath.Join(src, "dir/link"))
+	amtime := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(src, "dir/a"), amtime, amtime)
+	mtime := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	if err := utimensat(atFdCwd, filepath.Join(src, "dir/link"), "link", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	sync := func() (received []string) {
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest),
+				WithReceiveProgress(func(path string, size uint64) { received = append(received, path) })))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			s, err := NewSender(out, in, NewOptions(WithVerbosity(0)))
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		sort.Strings(received)
+		return received
+	}
+	if got := sync(); !reflect.DeepEqual(got, []string{"dir/a", "dir/link"}) {
+		t.Fatalf("initial sync received %v", got)
+	}
+	// The link has the time of the sender's, and its target kept its own
+	if info, err := os.Lstat(filepath.Join(dest, "dir/link")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("link mtime: %v %v, want %v", info.ModTime(), err, mtime)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "dir/a")); err != nil || !info.ModTime().Equal(amtime) {
+		t.Errorf("target mtime: %v %v, want %v", info.ModTime(), err, amtime)
+	}
+	if got := sync(); len(got) != 0 {
+		t.Errorf("second sync received %v", got)
+	}
+}
+
+func TestOwners(t *testing.T) {
+	if !privileged() {
+		t.Skip("needs root to give files away")
+	}
+	src, _ := ioutil.TempDir("", "owners-src")
+	dest, _ := ioutil.TempDir("", "owners-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, src, "dir/sub/a", "content a")
+	os.Symlink("sub/a", filepath.Join(src, "dir/link"))
+	for _, name := range []string{"dir/sub", "dir/sub/a", "dir/link"} {
+		if err := os.Lchown(filepath.Join(src, name), 1234, 5678); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	syncOpts := func(opts ...ReceiverOption) (received []string) {
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			opts = append(opts, WithRoot(dest),
+				WithReceiveProgress(func(path string, size uint64) { received = append(received, path) }))
+			r, err := NewReceiver(in, out, NewReceiverOptions(opts...))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			s, err := NewSender(out, in, NewOptions(WithVerbosity(0), WithOwners()))
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		sort.Strings(received)
+		return received
+	}
+	sync := func() []string { return syncOpts(WithApplyOwners()) }
+	owner := func(name string) string {
+		info, err := os.Lstat(filepath.Join(dest, name))
+		if err != nil {
+			return err.Error()
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		return fmt.Sprintf("%d:%d", st.Uid, st.Gid)
+	}
+	// Without the receiver opting in, the owners are dropped
+	if got := syncOpts(); !reflect.DeepEqual(got, []string{"dir/link", "dir/sub/a"}) {
+		t.Fatalf("sync without owners received %v", got)
+	}
+	self := fmt.Sprintf("%d:%d", os.Geteuid(), os.Getegid())
+	if got := owner("dir/sub/a"); got != self {
+		t.Errorf("owner without -owners %v, want %v", got, self)
+	}
+	os.RemoveAll(filepath.Join(dest, "dir"))
+
+	if got := sync(); !reflect.DeepEqual(got, []string{"dir/link", "dir/sub/a"}) {
+		t.Fatalf("initial sync received %v", got)
+	}
+	// The symlink itself gets the owner, not its target
+	for _, name := range []string{"dir/sub", "dir/sub/a", "dir/link"} {
+		if got := owner(name); got != "1234:5678" {
+			t.Errorf("%v: owner %v", name, got)
+		}
+	}
+	if got := sync(); len(got) != 0 {
+		t.Errorf("second sync received %v", got)
+	}
+	// A change of the owner alone is received
+	os.Lchown(filepath.Join(src, "dir/link"), 4321, 5678)
+	if got := sync(); !reflect.DeepEqual(got, []string{"dir/link"}) {
+		t.Errorf("third sync received %v", got)
+	}
+	if got, want := owner("dir/link"), "4321:5678"; got != want {
+		t.Errorf("link owner %v, want %v", got, want)
+	}
+	if got := owner("dir/sub/a"); got != "1234:5678" {
+		t.Errorf("target owner %v", got)
+	}
+}
+
+func TestOwnersUnmapped(t *testing.T) {
+	if !privileged() {
+		t.Skip("needs root to give files away")
+	}
+	// A user namespace like the preloader's jail, where only root is mapped
+	dir, _ := ioutil.TempDir("", "owners-map")
+	defer os.RemoveAll(dir)
+	jailMap := filepath.Join(dir, "uid_map")
+	if err := ioutil.WriteFile(jailMap, []byte("         0       1000          1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(uids, gids string) { uidMapFile, gidMapFile = uids, gids }(uidMapFile, gidMapFile)
+	uidMapFile, gidMapFile = jailMap, jailMap
+	if privileged() {
+		t.Fatal("privileged with only root mapped")
+	}
+	uidMapFile = filepath.Join(dir, "missing")
+	if privileged() {
+		t.Fatal("privileged without /proc")
+	}
+	uidMapFile = jailMap
+
+	src, _ := ioutil.TempDir("", "owners-src")
+	dest, _ := ioutil.TempDir("", "owners-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, src, "dir/a", "content a")
+	if err := os.Chown(filepath.Join(src, "dir/a"), 1234, 5678); err != nil {
+		t.Fatal(err)
+	}
+	// The owners are dropped, rather than the sync failing on them
+	runPiped(t, func(in io.Reader, out io.Writer) error {
+		r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest), WithApplyOwners()))
+		if err != nil {
+			return err
+		}
+		return r.Sync()
+	}, func(in io.Reader, out io.Writer) error {
+		s, err := NewSender(out, in, NewOptions(WithVerbosity(0), WithOwners()))
+		if err != nil {
+			return err
+		}
+		return s.Sync(filepath.Join(src, "dir"))
+	})
+	info, err := os.Lstat(filepath.Join(dest, "dir/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := info.Sys().(*syscall.Stat_t); int(st.Uid) != os.Geteuid() {
+		t.Errorf("owner %d applied, unprivileged", st.Uid)
+	}
+}
+
+func TestIdentityMap(t *testing.T) {
+	for _, tt := range []struct {
+		data string
+		want bool
+	}{
+		{"         0          0 4294967295\n", true},
+		{"0 0 4294967295", true},
+		{"         0       1000          1\n", false},
+		{"         0          0          1\n", false},
+		{"         0     100000      65536\n", false},
+		{"         0          0      65536\n     65536     165536 4294901759\n", false},
+		{"", false},
+	} {
+		if got := identityMap(tt.data); got != tt.want {
+			t.Errorf("identityMap(%q) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestSetID(t *testing.T) {
+	src, _ := ioutil.TempDir("", "setid-src")
+	dest, _ := ioutil.TempDir("", "setid-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, src, "dir/tool", "#!/bin/sh")
+	writeTestFile(t, src, "dir/shared/a", "content a")
+	if privileged() {
+		// A setuid binary of an owner of the sender's choosing
+		if err := os.Chown(filepath.Join(src, "dir/tool"), 1234, 5678); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Chmod(filepath.Join(src, "dir/tool"), 0755|os.ModeSetuid|os.ModeSetgid)
+	os.Chmod(filepath.Join(src, "dir/shared"), 0777|os.ModeSticky)
+
+	sync := func(opts ...ReceiverOption) (received []string) {
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			opts = append(opts, WithRoot(dest), WithApplyOwners(),
+				WithReceiveProgress(func(path string, size uint64) { received = append(received, path) }))
+			r, err := NewReceiver(in, out, NewReceiverOptions(opts...))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			s, err := NewSender(out, in, NewOptions(WithVerbosity(0), WithOwners()))
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		return received
+	}
+	mode := func(name string) os.FileMode {
+		info, err := os.Lstat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Mode()
+	}
+	if got := sync(); len(got) != 2 {
+		t.Fatalf("initial sync received %v", got)
+	}
+	if got, want := mode("dir/tool"), os.FileMode(0755); got != want {
+		t.Errorf("mode %v, want %v", got, want)
+	}
+	// The sticky bit isn't dropped
+	if got, want := mode("dir/shared"), os.ModeDir|os.ModeSticky|0777; got != want {
+		t.Errorf("dir mode %v, want %v", got, want)
+	}
+	// Nor is the binary received again, for the bits it doesn't get
+	if got := sync(); len(got) != 0 {
+		t.Errorf("second sync received %v", got)
+	}
+	// Unless they're kept
+	if got := sync(WithSetID()); !reflect.DeepEqual(got, []string{"dir/tool"}) {
+		t.Errorf("sync keeping them received %v", got)
+	}
+	if got, want := mode("dir/tool"), os.ModeSetuid|os.ModeSetgid|0755; got != want {
+		t.Errorf("mode kept %v, want %v", got, want)
+	}
+	if got := sync(WithSetID()); len(got) != 0 {
+		t.Errorf("sync keeping them received %v again", got)
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	src, _ := ioutil.TempDir("", "overlap-src")
+	dest, _ := ioutil.TempDir("", "overlap-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	// More files than fit in a chunk of requests
+	for i := 0; i < 600; i++ {
+		writeTestFile(t, src, fmt.Sprintf("dir/sub%d/f%d", i%7, i), fmt.Sprintf("content %03d", i))
+	}
+	os.Symlink("sub1/f1", filepath.Join(src, "dir/link"))
+	os.Chmod(filepath.Join(src, "dir/sub3"), 0555)
+	defer os.Chmod(filepath.Join(src, "dir/sub3"), 0755)
+	defer os.Chmod(filepath.Join(dest, "dir/sub3"), 0755)
+
+	sync := func(signingKey ed25519.PrivateKey) (received []string) {
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest),
+				WithReceiveProgress(func(path string, size uint64) { received = append(received, path) })))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			opts := NewOptions(WithVerbosity(0), WithOverlap(), WithSigningKey(signingKey))
+			s, err := NewSender(out, in, opts)
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		return received
+	}
+	if got := sync(nil); len(got) != 601 {
+		t.Fatalf("initial sync received %d items", len(got))
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dest, "dir/sub3/f598")); string(data) != "content 598" {
+		t.Errorf("got %q", data)
+	}
+	if info, _ := os.Stat(filepath.Join(dest, "dir/sub3")); info.Mode().Perm() != 0555 {
+		t.Errorf("got mode %v", info.Mode())
+	}
+	if got := sync(nil); len(got) != 0 {
+		t.Fatalf("unchanged sync received %v", got)
+	}
+	// Signed, the requests are sent in one go
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	writeTestFile(t, src, "dir/sub0/f0", "changed")
+	os.Remove(filepath.Join(src, "dir/sub2/f2"))
+	if got := sync(priv); !reflect.DeepEqual(got, []string{"dir/sub0/f0"}) {
+		t.Fatalf("signed sync received %v", got)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "dir/sub2/f2")); !os.IsNotExist(err) {
+		t.Errorf("deleted file is still there: %v", err)
+	}
+	if _, err := NewSender(ioutil.Discard, nil, NewOptions(WithOverlap(), func(o *Options) { o.Streams = 2 })); err == nil {
+		t.Errorf("overlap with streams accepted")
+	}
+}
+
+func TestPacked(t *testing.T) {
+	src, _ := ioutil.TempDir("", "packed-src")
+	dest, _ := ioutil.TempDir("", "packed-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	for i := 0; i < 300; i++ {
+		writeTestFile(t, src, fmt.Sprintf("dir/sub%d/f%d", i%3, i), strings.Repeat("x", i*20))
+	}
+	writeTestFile(t, src, "dir/big", strings.Repeat("big", 100000))
+	os.Symlink("big", filepath.Join(src, "dir/link"))
+
+	for _, overlap := range []bool{false, true} {
+		var received int
+		os.RemoveAll(filepath.Join(dest, "dir"))
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest),
+				WithReceiveProgress(func(path string, size uint64) { received++ })))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			opts := NewOptions(WithVerbosity(0), WithPack())
+			opts.Overlap = overlap
+			s, err := NewSender(out, in, opts)
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		if received != 302 {
+			t.Fatalf("overlap %v: received %d items", overlap, received)
+		}
+		for _, path := range []string{"dir/sub2/f299", "dir/big", "dir/sub0/f0"} {
+			want, _ := ioutil.ReadFile(filepath.Join(src, path))
+			if got, err := ioutil.ReadFile(filepath.Join(dest, path)); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("overlap %v: %v has %d bytes, want %d (%v)", overlap, path, len(got), len(want), err)
+			}
+		}
+	}
+	// A corrupted item is caught before it's handled
+	var frame bytes.Buffer
+	item := []byte("not really an item")
+	binary.Write(&frame, binary.LittleEndian, []uint32{1, uint32(len(item)), crc32.ChecksumIEEE(item) + 1})
+	frame.Write(item)
+	if _, err := new(Receiver).readFrame(&frame); err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Errorf("corrupted frame: %v", err)
+	}
+}
+
+func TestZeroCopy(t *testing.T) {
+	src, _ := ioutil.TempDir("", "zerocopy-src")
+	dest, _ := ioutil.TempDir("", "zerocopy-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	content := strings.Repeat("0123456789abcdef", 20000)
+	writeTestFile(t, src, "dir/big", content)
+	writeTestFile(t, src, "dir/small", "small")
+
+	// The sender writes to a pipe, as to qrexec
+	inR, outS, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inR.Close()
+	inS, outR := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		r, err := NewReceiver(inR, outR, NewReceiverOptions(WithRoot(dest)))
+		if err == nil {
+			err = r.Sync()
+		}
+		outR.CloseWithError(err)
+		errc <- err
+	}()
+	s, err := NewSender(outS, inS, NewOptions(WithVerbosity(0), WithCompression(CompressionOff)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sync(filepath.Join(src, "dir")); err != nil {
+		t.Fatalf("sender: %v", err)
+	}
+	outS.Close()
+	if err := <-errc; err != nil {
+		t.Fatalf("receiver: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dest, "dir/big")); string(data) != content {
+		t.Errorf("got %d bytes, want %d", len(data), len(content))
+	}
+	if raw, _ := s.Stats(); s.noZeroCopy || raw < len(content) {
+		t.Errorf("sent %d bytes, zero-copy disabled: %v", raw, s.noZeroCopy)
+	}
+	// Between files, where copy_file_range is used
+	in, _ := os.Open(filepath.Join(src, "dir/big"))
+	defer in.Close()
+	out, _ := os.Create(filepath.Join(dest, "copy"))
+	defer out.Close()
+	if n, err := zeroCopy(rawConn(out), rawConn(in), int64(len(content))); n != int64(len(content)) || err != nil {
+		t.Fatalf("copied %d bytes: %v", n, err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dest, "copy")); string(data) != content {
+		t.Errorf("copy has %d bytes, want %d", len(data), len(content))
+	}
+}
+
+func TestMmap(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mmap")
+	defer os.RemoveAll(dir)
+	content := strings.Repeat("mapped content", 100000)
+	writeTestFile(t, dir, "big", content)
+	path := filepath.Join(dir, "big")
+	info, _ := os.Stat(path)
+
+	crc, err := crcItem(osSource{mmap: true}, path, info)
+	if want := crc32.ChecksumIEEE([]byte(content)); crc != want || err != nil {
+		t.Fatalf("crc %08x, want %08x: %v", crc, want, err)
+	}
+	digest, err := digestItem(osSource{mmap: true}, path, info)
+	if want := sha256Sum([]byte(content)); !bytes.Equal(digest, want) || err != nil {
+		t.Fatalf("digest %x, want %x: %v", digest, want, err)
+	}
+	// A file truncated since it was listed fails, as when it's read
+	os.Truncate(path, 1000)
+	if _, err := crcItem(osSource{mmap: true}, path, info); err == nil {
+		t.Errorf("truncated file hashed")
+	}
+}
+
+func TestHashCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hashcache")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, dir, "old", "old content")
+	writeTestFile(t, dir, "new", "new content")
+	old, recent := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	mtime := time.Now().Add(-time.Hour)
+	os.Chtimes(old, mtime, mtime)
+	oldInfo, _ := os.Lstat(old)
+	newInfo, _ := os.Lstat(recent)
+
+	path := filepath.Join(dir, "cache", "hashes")
+	c, err := openHashCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.setCrc(oldInfo, 1234)
+	c.setDigest(oldInfo, sha256Sum([]byte("old content")))
+	c.setCrc(newInfo, 5678)
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = openHashCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if crc, ok := c.crc(oldInfo); crc != 1234 || !ok {
+		t.Errorf("crc %d (%v), want 1234", crc, ok)
+	}
+	if d, ok := c.digest(oldInfo); !bytes.Equal(d, sha256Sum([]byte("old content"))) || !ok {
+		t.Errorf("digest %x (%v)", d, ok)
+	}
+	// A file modified just now could change again with the same mtime
+	if _, ok := c.crc(newInfo); ok {
+		t.Errorf("crc of recently modified file cached")
+	}
+	// Same size, but modified
+	os.Chtimes(old, mtime, mtime.Add(time.Second))
+	oldInfo, _ = os.Lstat(old)
+	if _, ok := c.crc(oldInfo); ok {
+		t.Errorf("crc of modified file cached")
+	}
+	// Garbage is ignored
+	ioutil.WriteFile(path, []byte("garbage"), 0600)
+	if c, err = openHashCache(path); err == nil || c == nil {
+		t.Errorf("garbage cache read: %v", err)
+	}
+}
+
+func TestParallelSnappy(t *testing.T) {
+	var (
+		out  bytes.Buffer
+		want []byte
+		rnd  = rand2.New(rand2.NewSource(1))
+	)
+	w := newCompressingWriter(&out, 4)
+	// Compressible and random data, in writes spanning blocks, and flushed
+	// now and then
+	for i := 0; i < 200; i++ {
+		data := make([]byte, rnd.Intn(3*snappyBlockSize))
+		if i%2 == 0 {
+			rnd.Read(data)
+		} else {
+			copy(data, strings.Repeat(fmt.Sprintf("line %d\n", i), len(data)/6+1))
+		}
+		want = append(want, data...)
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if i%7 == 0 {
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if raw, compressed := w.(*ConfigurableWriter).Stats(); raw != len(want) || compressed != out.Len() {
+		t.Errorf("stats %d, %d, want %d, %d", raw, compressed, len(want), out.Len())
+	}
+	got, err := ioutil.ReadAll(snappy.NewReader(&out))
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("read %d bytes, want %d: %v", len(got), len(want), err)
+	}
+}
+
+func TestDirReader(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dirreader")
+	defer os.RemoveAll(dir)
+	for i := 0; i < 10; i++ {
+		writeTestFile(t, dir, fmt.Sprintf("f%d", i), strings.Repeat("x", i))
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0750|os.ModeSetgid)
+	os.Chmod(filepath.Join(dir, "sub"), 0750|os.ModeSetgid)
+	os.Symlink("f1", filepath.Join(dir, "link"))
+	syscall.Mkfifo(filepath.Join(dir, "fifo"), 0600)
+
+	want, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := openDir(osSource{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var got []os.FileInfo
+	for {
+		infos, err := d.next(3)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, infos...)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("listed %d entries, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Name() != w.Name() || g.Mode() != w.Mode() || g.Size() != w.Size() || !g.ModTime().Equal(w.ModTime()) {
+			t.Errorf("got %v %v %d %v, want %v %v %d %v", g.Name(), g.Mode(), g.Size(), g.ModTime(),
+				w.Name(), w.Mode(), w.Size(), w.ModTime())
+		}
+		// What the headers and the hash cache use
+		gs, ws := g.Sys().(*syscall.Stat_t), w.Sys().(*syscall.Stat_t)
+		if gs.Dev != ws.Dev || gs.Ino != ws.Ino || gs.Atim != ws.Atim || gs.Mtim != ws.Mtim {
+			t.Errorf("%v: got %+v, want %+v", g.Name(), gs, ws)
+		}
+	}
+}
+
+func TestOpenRegular(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "openregular")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, dir, "file", "content")
+	os.Symlink("file", filepath.Join(dir, "link"))
+	syscall.Mkfifo(filepath.Join(dir, "fifo"), 0600)
+
+	f, info, err := openRegular(filepath.Join(dir, "file"), false)
+	if err != nil || info.Size() != 7 {
+		t.Fatalf("opening file: %v", err)
+	}
+	f.Close()
+	// Items which replaced a file since it was listed are neither followed,
+	// nor block
+	for _, name := range []string{"link", "fifo", "missing"} {
+		if f, _, err := openRegular(filepath.Join(dir, name), true); err == nil {
+			f.Close()
+			t.Errorf("%v opened", name)
+		}
+	}
+}
+
+// TestDropCache checks that with Options.DropCache, the files sent and hashed
+// keep their access times.
+func TestDropCache(t *testing.T) {
+	src, _ := ioutil.TempDir("", "dropcache-src")
+	dest, _ := ioutil.TempDir("", "dropcache-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, src, "dir/file", strings.Repeat("cached ", 10000))
+	path := filepath.Join(src, "dir/file")
+	// Older than the modification time, which even relatime would update
+	atime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(path, atime, time.Now())
+	runPiped(t, func(in io.Reader, out io.Writer) error {
+		r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest)))
+		if err != nil {
+			return err
+		}
+		return r.Sync()
+	}, func(in io.Reader, out io.Writer) error {
+		s, err := NewSender(out, in, NewOptions(WithVerbosity(0), WithCrcUsage(FileCrcAtimeNsec), WithDropCache()))
+		if err != nil {
+			return err
+		}
+		return s.Sync(filepath.Join(src, "dir"))
+	})
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Unix(st.Atim.Unix()); !got.Equal(atime) {
+		t.Errorf("access time %v, want %v", got, atime)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dest, "dir/file")); len(data) != 70000 {
+		t.Errorf("got %d bytes", len(data))
+	}
+}
+
+// TestWalkCache checks that only the directories which changed are listed
+// again with a walk cache, so that a file modified in place goes unnoticed
+// until its directory's listing expires.
+func TestWalkCache(t *testing.T) {
+	src, _ := ioutil.TempDir("", "walkcache-src")
+	dest, _ := ioutil.TempDir("", "walkcache-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, src, "dir/file", "old content")
+	writeTestFile(t, src, "dir/sub/a", "a")
+	mtime := time.Now().Add(-time.Hour)
+	for _, name := range []string{"dir/file", "dir/sub/a", "dir/sub", "dir"} {
+		os.Chtimes(filepath.Join(src, name), mtime, mtime)
+	}
+	cache := filepath.Join(src, "walks")
+	sync := func(every time.Duration) {
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest)))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			opts := NewOptions(WithVerbosity(0), WithCrcUsage(FileCrcOff), WithWalkCache(cache))
+			opts.FullWalkEvery = every
+			s, err := NewSender(out, in, opts)
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+	}
+	sync(0)
+	writeTestFile(t, src, "dir/sub/b", "b")
+	writeTestFile(t, src, "dir/file", "new content, modified in place")
+	sync(0)
+	if data, err := ioutil.ReadFile(filepath.Join(dest, "dir/sub/b")); string(data) != "b" {
+		t.Errorf("new file in changed directory: %q, %v", data, err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dest, "dir/file")); string(data) != "old content" {
+		t.Errorf("file in unchanged directory listed again: %q", data)
+	}
+	sync(time.Nanosecond)
+	if data, _ := ioutil.ReadFile(filepath.Join(dest, "dir/file")); string(data) != "new content, modified in place" {
+		t.Errorf("file not noticed by full walk: %q", data)
+	}
+}
+
+// TestLazyHash checks that with crcs asked for on demand, files whose size
+// and mtime are unchanged are still compared by content.
+func TestLazyHash(t *testing.T) {
+	src, _ := ioutil.TempDir("", "lazyhash-src")
+	dest, _ := ioutil.TempDir("", "lazyhash-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	mtime := time.Now().Add(-time.Hour)
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("dir/file%03d", i)
+		writeTestFile(t, src, name, fmt.Sprintf("content %03d", i))
+		os.Chtimes(filepath.Join(src, name), mtime, mtime)
+	}
+	sync := func() {
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest)))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			s, err := NewSender(out, in, NewOptions(WithVerbosity(0), WithLazyHash()))
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+	}
+	sync()
+	// The same size and mtime, but different content, in both chunks
+	for _, i := range []int{7, 290} {
+		path := filepath.Join(dest, fmt.Sprintf("dir/file%03d", i))
+		ioutil.WriteFile(path, []byte("changed!!!!"), 0644)
+		os.Chtimes(path, mtime, mtime)
+	}
+	writeTestFile(t, src, "dir/file100", "a new size")
+	writeTestFile(t, src, "dir/new", "new")
+	sync()
+	for i := 0; i < 300; i++ {
+		want := fmt.Sprintf("content %03d", i)
+		if i == 100 {
+			want = "a new size"
+		}
+		if data, _ := ioutil.ReadFile(filepath.Join(dest, fmt.Sprintf("dir/file%03d", i))); string(data) != want {
+			t.Errorf("file %d: got %q, want %q", i, data, want)
+		}
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dest, "dir/new")); string(data) != "new" {
+		t.Errorf("new file: got %q", data)
+	}
+}
+
+// TestDedup checks that the content of identical files is sent once, and
+// cloned by the receiver for the others.
+func TestDedup(t *testing.T) {
+	src, _ := ioutil.TempDir("", "dedup-src")
+	dest, _ := ioutil.TempDir("", "dedup-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	same, other := make([]byte, 20000), make([]byte, 20000)
+	rand2.Read(same)
+	rand2.Read(other)
+	files := map[string][]byte{"a": same, "sub/b": same, "sub/c": same, "d": other, "e": other[:100], "f": other[:100]}
+	for name, data := range files {
+		writeTestFile(t, src, filepath.Join("dir", name), string(data))
+	}
+	var raw int
+	runPiped(t, func(in io.Reader, out io.Writer) error {
+		r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest)))
+		if err != nil {
+			return err
+		}
+		return r.Sync()
+	}, func(in io.Reader, out io.Writer) error {
+		s, err := NewSender(out, in, NewOptions(WithVerbosity(0), WithCompression(CompressionOff), WithDedup()))
+		if err != nil {
+			return err
+		}
+		err = s.Sync(filepath.Join(src, "dir"))
+		raw, _ = s.Stats()
+		return err
+	})
+	for name, data := range files {
+		if got, _ := ioutil.ReadFile(filepath.Join(dest, "dir", name)); !bytes.Equal(got, data) {
+			t.Errorf("%v: got %d bytes, want %d", name, len(got), len(data))
+		}
+	}
+	if raw > 2*20000+1000 {
+		t.Errorf("sent %d bytes, the identical files were sent more than once", raw)
+	}
+}
+
+// TestFileWriter checks that content is written in full through a fileWriter,
+// across windows of write-behind, that a file received in part is no larger
+// than what was, and that a file which doesn't fit fails up front.
+func TestFileWriter(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "filewriter")
+	defer os.RemoveAll(dir)
+	data := make([]byte, 2*writeBehind+12345)
+	rand2.Read(data)
+	write := func(name string, size uint64, content []byte) error {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := newFileWriter(f, size, nil)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		err = copyContent(bytes.NewReader(content), w, size)
+		if cErr := w.Close(); cErr != nil {
+			t.Fatal(cErr)
+		}
+		return err
+	}
+	if err := write("full", uint64(len(data)), data); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "full")); !bytes.Equal(got, data) {
+		t.Errorf("wrote %d bytes, want %d", len(got), len(data))
+	}
+	if err := write("part", uint64(len(data)), data[:contentBufSize+10]); err == nil {
+		t.Fatal("short content copied")
+	}
+	if info, err := os.Stat(filepath.Join(dir, "part")); err != nil || info.Size() != contentBufSize {
+		t.Errorf("wrong size of partial file: %v", err)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	free := st.Bavail * uint64(st.Bsize)
+	if err := write("large", free+1<<30, nil); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("preallocating beyond the free space: %v", err)
+	}
+}
+
+// TestCopyShortReads checks that content is copied in full over readers which
+// return less than asked for, and that content which ends early fails with
+// io.ErrUnexpectedEOF.
+func TestCopyShortReads(t *testing.T) {
+	data := make([]byte, 3*contentBufSize+123)
+	rand2.Read(data)
+	var compressed bytes.Buffer
+	sw := snappy.NewBufferedWriter(&compressed)
+	sw.Write(data)
+	sw.Close()
+	copies := map[string]func(io.Reader, io.Writer, int) error{
+		"CopyFile": CopyFile,
+		"copyContent": func(in io.Reader, out io.Writer, size int) error {
+			return copyContent(in, out, uint64(size))
+		},
+	}
+	for name, copyFn := range copies {
+		readers := map[string]io.Reader{
+			"onebyte": iotest.OneByteReader(bytes.NewReader(data)),
+			"half":    iotest.HalfReader(bytes.NewReader(data)),
+			"dataerr": iotest.DataErrReader(bytes.NewReader(data)),
+			"snappy":  snappy.NewReader(bytes.NewReader(compressed.Bytes())),
+		}
+		for rname, r := range readers {
+			var out bytes.Buffer
+			if err := copyFn(r, &out, len(data)); err != nil {
+				t.Fatalf("%v, %v reader: %v", name, rname, err)
+			}
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Errorf("%v, %v reader: copied %d bytes, want %d", name, rname, out.Len(), len(data))
+			}
+		}
+		for _, n := range []int{0, 1, contentBufSize, len(data) - 1} {
+			var out bytes.Buffer
+			err := copyFn(iotest.HalfReader(bytes.NewReader(data[:n])), &out, len(data))
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%v, %d of %d bytes: have %v, want unexpected EOF", name, n, len(data), err)
+			}
+			if out.Len() > n {
+				t.Errorf("%v, %d of %d bytes: copied %d", name, n, len(data), out.Len())
+			}
+		}
+		err := copyFn(iotest.TimeoutReader(bytes.NewReader(data)), ioutil.Discard, len(data))
+		if err != iotest.ErrTimeout {
+			t.Errorf("%v: have %v, want %v", name, err, iotest.ErrTimeout)
+		}
+	}
+}
+
+// TestIOUring checks that files are read and written through rings in full,
+// whether they end on a chunk or not, and that a file which grows while read
+// is read up to where it ended.
+func TestIOUring(t *testing.T) {
+	u, err := newUring()
+	if err != nil {
+		t.Skipf("no io_uring: %v", err)
+	}
+	u.close()
+	src, _ := ioutil.TempDir("", "uring-src")
+	dest, _ := ioutil.TempDir("", "uring-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	files := map[string][]byte{
+		"dir/min":     make([]byte, uringMin),
+		"dir/chunks":  make([]byte, 3*uringDepth*uringChunk),
+		"dir/odd":     make([]byte, 2*uringDepth*uringChunk+12345),
+		"dir/small":   []byte("small"),
+		"dir/sub/big": make([]byte, writeBehind+uringChunk/2),
+	}
+	for path, content := range files {
+		rand2.Read(content)
+		writeTestFile(t, src, path, string(content))
+	}
+	for _, compression := range []int{CompressionOff, CompressionSnappy} {
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			ropts := NewReceiverOptions(WithRoot(dest))
+			ropts.IOUring = true
+			r, err := NewReceiver(in, out, ropts)
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			s, err := NewSender(out, in, NewOptions(WithVerbosity(0), WithCompression(compression), WithIOUring()))
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		for path, want := range files {
+			if data, _ := ioutil.ReadFile(filepath.Join(dest, path)); !bytes.Equal(data, want) {
+				t.Errorf("compression %d, %v: got %d bytes, want %d", compression, path, len(data), len(want))
+			}
+		}
+		os.RemoveAll(filepath.Join(dest, "dir"))
+	}
+	// A file which grows after a short chunk is read
+	pool := new(uringPool)
+	defer pool.close()
+	path := filepath.Join(src, "dir/odd")
+	f, _ := os.Open(path)
+	defer f.Close()
+	uf := newUringFile(pool, f, uringMin)
+	buf := make([]byte, len(files["dir/odd"]))
+	if _, err := io.ReadFull(uf, buf); err != nil {
+		t.Fatal(err)
+	}
+	app, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	app.Write(make([]byte, 3*uringChunk))
+	app.Close()
+	if n, err := io.Copy(ioutil.Discard, uf); n != 0 || err != nil {
+		t.Errorf("read %d bytes more: %v", n, err)
+	}
+	if err := uf.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFinishLater checks that files are put in place in the background, all
+// of them before waitFinished returns, and that a failure is reported.
+func TestFinishLater(t *testing.T) {
+	r := &Receiver{ropts: DefaultReceiverOptions, requestList: make([]uint32, 100)}
+	var done int32
+	for i := 0; i < 100; i++ {
+		if err := r.finishLater(func() error { atomic.AddInt32(&done, 1); return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.waitFinished(); err != nil || done != 100 {
+		t.Fatalf("%d finished: %v", done, err)
+	}
+	failure := errors.New("failed")
+	r.finishLater(func() error { return failure })
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		err = r.finishLater(func() error { time.Sleep(time.Millisecond); return nil })
+	}
+	if err != failure {
+		t.Errorf("got %v, want %v", err, failure)
+	}
+	if err := r.waitFinished(); err != failure {
+		t.Errorf("got %v, want %v", err, failure)
+	}
+	// Without several files, nothing is put off
+	r = &Receiver{ropts: DefaultReceiverOptions, requestList: make([]uint32, 1)}
+	if err := r.finishLater(func() error { return failure }); err != failure || r.finisher != nil {
+		t.Errorf("got %v, want %v right away", err, failure)
+	}
+}
+
+// TestRequestList checks that a request list longer than a batch is read
+// back as written, and that the count is checked before the indexes are read.
+func TestRequestList(t *testing.T) {
+	list := make([]uint32, 2*requestBatch+5)
+	for i := range list {
+		list[i] = uint32(3 * i)
+	}
+	var buf bytes.Buffer
+	if err := writeRequests(&buf, list); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	got, err := readRequests(bytes.NewReader(data), uint32(3*len(list)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, list) {
+		t.Errorf("read %d indexes, want %d", len(got), len(list))
+	}
+	if _, err := readRequests(bytes.NewReader(data), uint32(len(list)-1)); err == nil {
+		t.Error("accepted more requests than items")
+	}
+	if _, err := readRequests(bytes.NewReader(data[:len(data)-1]), uint32(3*len(list))); err == nil {
+		t.Error("accepted a truncated list")
+	}
+}
+
+// TestDuplicateRequests checks that the receiver requests an item once, even
+// if it's requested several times, and that the sender refuses one requested
+// twice.
+func TestDuplicateRequests(t *testing.T) {
+	r := &Receiver{items: []*fileHeader{{}, {}}}
+	r.request(1)
+	r.request(0)
+	r.request(1)
+	if !reflect.DeepEqual(r.requestList, []uint32{1, 0}) {
+		t.Errorf("requested %v, want [1 0]", r.requestList)
+	}
+	var buf bytes.Buffer
+	writeRequests(&buf, []uint32{1})
+	writeRequests(&buf, []uint32{0, 1})
+	s := &Sender{in: &buf, sendList: make([]string, 2), opts: DefaultOptions}
+	if _, err := s.readFileList(); err != nil {
+		t.Fatal(err)
+	}
+	var perr *ProtocolError
+	if _, err := s.readFileList(); !errors.As(err, &perr) {
+		t.Errorf("got %v, want a ProtocolError", err)
+	}
+}
+
+func TestTrickleWriter(t *testing.T) {
+	var out bytes.Buffer
+	tw := NewTrickleWriter(&out, 100000)
+	tw.Idle = time.Minute
+	tw.IdleTime = func() (time.Duration, error) { return time.Hour, nil }
+	start := time.Now()
+	data := bytes.Repeat([]byte{1}, 30000)
+	if n, err := tw.Write(data); n != len(data) || err != nil {
+		t.Fatalf("wrote %d bytes: %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > time.Second {
+		t.Errorf("writing 30000 bytes at 100000 per second took %v", elapsed)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("wrote %d bytes, want %d", out.Len(), len(data))
+	}
+}
+
+func TestFilterAndHooks(t *testing.T) {
+	src, _ := ioutil.TempDir("", "filter-src")
+	dest, _ := ioutil.TempDir("", "filter-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, src, "dir/a", "content")
+	writeTestFile(t, src, "dir/b", "a virus")
+	writeTestFile(t, src, "dir/secret/c", "not sent")
+	writeTestFile(t, src, "dir/sub/d", "not received")
+	writeTestFile(t, dest, "dir/sub/e", "kept")
+
+	hooks := new(scanHooks)
+	runPiped(t, func(in io.Reader, out io.Writer) error {
+		r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest), WithReceiveHooks(hooks),
+			WithReceiveFilter(FilterFunc(func(path string, mode os.FileMode) (string, bool) {
+				if path == "dir/sub" {
+					return "", false
+				}
+				return path + ".txt", true
+			}))))
+		if err != nil {
+			return err
+		}
+		return r.Sync()
+	}, func(in io.Reader, out io.Writer) error {
+		s, err := NewSender(out, in, NewOptions(WithVerbosity(0),
+			WithFilter(FilterFunc(func(path string, mode os.FileMode) (string, bool) {
+				return path, path != "dir/secret"
+			}))))
+		if err != nil {
+			return err
+		}
+		return s.Sync(filepath.Join(src, "dir"))
+	})
+	if !hooks.done || hooks.result != nil {
+		t.Fatalf("post-sync hook: called %v, result %v", hooks.done, hooks.result)
+	}
+	for path, want := range map[string]string{"dir/a.txt": "content", "dir/b.txt": "", "dir/secret.txt/c.txt": "",
+		"dir/sub/d": "", "dir/sub/e": "kept"} {
+		if data, _ := ioutil.ReadFile(filepath.Join(dest, path)); string(data) != want {
+			t.Errorf("%v: got %q, want %q", path, data, want)
+		}
+	}
+}
+
+// TestNormalize checks that names are normalized on receive, and that names
+// which differ only in their normalization are reported or merged.
+func TestNormalize(t *testing.T) {
+	src, _ := ioutil.TempDir("", "normalize-src")
+	defer os.RemoveAll(src)
+	// The decomposed names are sent first
+	writeTestFile(t, src, "dir/cafe\u0301", "nfd")
+	writeTestFile(t, src, "dir/caf\u00e9", "nfc")
+	writeTestFile(t, src, "dir/Ma\u0308rz/x", "x")
+	writeTestFile(t, src, "dir/M\u00e4rz/y", "y")
+	sync := func(dest string, ropts ...ReceiverOption) int {
+		var duplicates int
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(append(ropts, WithRoot(dest))...))
+			if err != nil {
+				return err
+			}
+			err = r.Sync()
+			duplicates = r.duplicates
+			return err
+		}, func(in io.Reader, out io.Writer) error {
+			s, err := NewSender(out, in, NewOptions(WithVerbosity(0)))
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		return duplicates
+	}
+	for i, tt := range []struct {
+		form, policy string
+		want         map[string]string
+	}{
+		{NormalizeNFC, "", map[string]string{"caf\u00e9": "nfd", "M\u00e4rz/x": "x"}},
+		{NormalizeNFC, DuplicatesMerge, map[string]string{"caf\u00e9": "nfd", "M\u00e4rz/x": "x", "M\u00e4rz/y": "y"}},
+		{NormalizeNFD, DuplicatesMerge, map[string]string{"cafe\u0301": "nfd", "Ma\u0308rz/x": "x", "Ma\u0308rz/y": "y"}},
+		{"", DuplicatesReport, map[string]string{"cafe\u0301": "nfd", "caf\u00e9": "nfc", "Ma\u0308rz/x": "x", "M\u00e4rz/y": "y"}},
+	} {
+		dest, _ := ioutil.TempDir("", "normalize-dest")
+		defer os.RemoveAll(dest)
+		// Once more over the copy, whose merged directories have content
+		for j := 0; j < 2; j++ {
+			if n := sync(dest, WithNormalize(tt.form, tt.policy)); n != 2 {
+				t.Errorf("test %d, sync %d: %d duplicates, want 2", i, j, n)
+			}
+			got := make(map[string]string)
+			filepath.Walk(filepath.Join(dest, "dir"), func(path string, info os.FileInfo, err error) error {
+				if err == nil && info.Mode().IsRegular() {
+					data, _ := ioutil.ReadFile(path)
+					rel, _ := filepath.Rel(filepath.Join(dest, "dir"), path)
+					got[rel] = string(data)
+				}
+				return nil
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("test %d, sync %d: got %q, want %q", i, j, got, tt.want)
+			}
+		}
+	}
+	hdr := new(bytes.Buffer)
+	newVersionHeader(CompressionOff, FileCrcOff, 0).marshallBinary(hdr)
+	if _, err := NewReceiver(hdr, ioutil.Discard, NewReceiverOptions(WithNormalize("nfkc", ""))); err == nil || !strings.Contains(err.Error(), "normalization") {
+		t.Errorf("unknown normalization: %v", err)
+	}
+}
+
+func TestLinkSnapshot(t *testing.T) {
+	src, _ := ioutil.TempDir("", "link-src")
+	dest, _ := ioutil.TempDir("", "link-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, src, "dir/a", "unchanged")
+	writeTestFile(t, src, "dir/b", "changed")
+
+	snapshot := func(now time.Time) string {
+		root, prev, err := NewLinkSnapshot(dest, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(root), WithLinkDest(prev)))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			s, err := NewSender(out, in, NewOptions(WithVerbosity(0)))
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		if err := CompleteLinkSnapshot(root); err != nil {
+			t.Fatal(err)
+		}
+		return root
+	}
+	now := time.Now()
+	first := snapshot(now)
+	writeTestFile(t, src, "dir/b", "changed!")
+	second := snapshot(now.Add(time.Second))
+
+	stat := func(root, path string) os.FileInfo {
+		info, err := os.Stat(filepath.Join(root, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	if !os.SameFile(stat(first, "dir/a"), stat(second, "dir/a")) {
+		t.Error("unchanged file was not linked")
+	}
+	if os.SameFile(stat(first, "dir/b"), stat(second, "dir/b")) {
+		t.Error("changed file was linked")
+	}
+	for root, want := range map[string]string{first: "changed", second: "changed!"} {
+		if data, _ := ioutil.ReadFile(filepath.Join(root, "dir/b")); string(data) != want {
+			t.Errorf("%v: got %q, want %q", root, data, want)
+		}
+	}
+	if latest, _ := os.Readlink(filepath.Join(dest, "latest")); latest != filepath.Base(second) {
+		t.Errorf("latest is %v, want %v", latest, filepath.Base(second))
+	}
+}
+
+func TestTransactional(t *testing.T) {
+	src, _ := ioutil.TempDir("", "transact-src")
+	dest, _ := ioutil.TempDir("", "transact-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, src, "dir/a", "old")
+	writeTestFile(t, src, "dir/c", "unchanged")
+	writeTestFile(t, src, "dir/sub/e", "removed")
+	sync := func(hooks Hooks, opts ...Option) (sErr, rErr error) {
+		inR, outL := io.Pipe()
+		inL, outR := io.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			r, err := NewReceiver(inR, outR, NewReceiverOptions(WithRoot(dest), WithTransactional(), WithReceiveHooks(hooks)))
+			if err == nil {
+				err = r.Sync()
+			}
+			inR.CloseWithError(io.ErrClosedPipe)
+			outR.Close()
+			errc <- err
+		}()
+		s, err := NewSender(outL, inL, NewOptions(append(opts, WithVerbosity(0))...))
+		if err == nil {
+			err = s.Sync(filepath.Join(src, "dir"))
+		}
+		outL.Close()
+		inL.Close()
+		rErr = <-errc
+		if _, err := os.Lstat(filepath.Join(dest, StateDir, stageDir)); !os.IsNotExist(err) {
+			t.Errorf("staged tree left behind: %v", err)
+		}
+		return err, rErr
+	}
+	check := func(what string, want map[string]string) {
+		t.Helper()
+		got := make(map[string]string)
+		filepath.Walk(filepath.Join(dest, "dir"), func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				data, _ := ioutil.ReadFile(path)
+				rel, _ := filepath.Rel(filepath.Join(dest, "dir"), path)
+				got[rel] = string(data)
+			}
+			return nil
+		})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %q, want %q", what, got, want)
+		}
+	}
+	if sErr, rErr := sync(NoHooks{}); sErr != nil || rErr != nil {
+		t.Fatalf("first sync: %v, %v", sErr, rErr)
+	}
+	first := map[string]string{"a": "old", "c": "unchanged", "sub/e": "removed"}
+	check("first sync", first)
+	before, err := os.Stat(filepath.Join(dest, "dir/c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, src, "dir/a", "new")
+	writeTestFile(t, src, "dir/b", "added")
+	os.Remove(filepath.Join(src, "dir/sub/e"))
+	// A sync which fails, after a has been received, leaves the live tree as
+	// it was
+	if _, rErr := sync(rejectB{}); !errors.Is(rErr, ErrRejected) {
+		t.Fatalf("rejected sync: got %v, want %v", rErr, ErrRejected)
+	}
+	check("failed sync", first)
+	if sErr, rErr := sync(NoHooks{}, WithVerifyTree()); sErr != nil || rErr != nil {
+		t.Fatalf("second sync: %v, %v", sErr, rErr)
+	}
+	check("second sync", map[string]string{"a": "new", "b": "added", "c": "unchanged"})
+	if after, err := os.Stat(filepath.Join(dest, "dir/c")); err != nil || !os.SameFile(before, after) {
+		t.Errorf("unchanged file was not linked from the live tree: %v", err)
+	}
+	hdr := new(bytes.Buffer)
+	newVersionHeader(CompressionOff, FileCrcOff, 0).marshallBinary(hdr)
+	if _, err := NewReceiver(hdr, ioutil.Discard, NewReceiverOptions(WithTransactional(), WithLinkDest(src))); err == nil {
+		t.Error("transactional sync with a link destination accepted")
+	}
+}
+
+func TestWriteAhead(t *testing.T) {
+	src, _ := ioutil.TempDir("", "wal-src")
+	dest, _ := ioutil.TempDir("", "wal-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	writeTestFile(t, src, "dir/a", "old")
+	writeTestFile(t, src, "dir/c", "unchanged")
+	writeTestFile(t, src, "dir/sub/e", "removed")
+	sync := func(policy string, hooks Hooks) error {
+		inR, outL := io.Pipe()
+		inL, outR := io.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			r, err := NewReceiver(inR, outR, NewReceiverOptions(WithRoot(dest), WithWriteAhead(policy), WithReceiveHooks(hooks)))
+			if err == nil {
+				err = r.Sync()
+			}
+			inR.CloseWithError(io.ErrClosedPipe)
+			outR.Close()
+			errc <- err
+		}()
+		s, err := NewSender(outL, inL, NewOptions(WithVerbosity(0)))
+		if err == nil {
+			s.Sync(filepath.Join(src, "dir"))
+		}
+		outL.Close()
+		inL.Close()
+		err = <-errc
+		for _, name := range []string{walFile, walBackups} {
+			if _, err := os.Lstat(filepath.Join(dest, StateDir, name)); !os.IsNotExist(err) {
+				t.Errorf("%v left behind: %v", name, err)
+			}
+		}
+		return err
+	}
+	check := func(what string, want map[string]string) {
+		t.Helper()
+		got := make(map[string]string)
+		filepath.Walk(filepath.Join(dest, "dir"), func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				data, _ := ioutil.ReadFile(path)
+				rel, _ := filepath.Rel(filepath.Join(dest, "dir"), path)
+				got[rel] = string(data)
+			}
+			return nil
+		})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %q, want %q", what, got, want)
+		}
+	}
+	if err := sync(WriteAheadRollback, NoHooks{}); err != nil {
+		t.Fatalf("first sync: %v", err)
+	}
+	first := map[string]string{"a": "old", "c": "unchanged", "sub/e": "removed"}
+	check("first sync", first)
+	writeTestFile(t, src, "dir/a", "new")
+	writeTestFile(t, src, "dir/b", "added")
+	os.RemoveAll(filepath.Join(src, "dir/sub"))
+	// A sync which fails after a has been replaced is rolled back, or keeps
+	// the new a
+	if err := sync(WriteAheadRollback, rejectB{}); !errors.Is(err, ErrRejected) {
+		t.Fatalf("rejected sync: got %v, want %v", err, ErrRejected)
+	}
+	check("rolled back sync", first)
+	if err := sync(WriteAheadComplete, rejectB{}); !errors.Is(err, ErrRejected) {
+		t.Fatalf("rejected sync: got %v, want %v", err, ErrRejected)
+	}
+	check("completed sync", map[string]string{"a": "new", "c": "unchanged", "sub/e": "removed"})
+	if err := sync(WriteAheadRollback, NoHooks{}); err != nil {
+		t.Fatalf("second sync: %v", err)
+	}
+	second := map[string]string{"a": "new", "b": "added", "c": "unchanged"}
+	check("second sync", second)
+
+	// An interrupted sync, which replaced c, created x, and was about to
+	// delete b, is settled by the next receiver
+	interrupt := func() {
+		os.MkdirAll(filepath.Join(dest, StateDir, walBackups), 0700)
+		os.Rename(filepath.Join(dest, "dir/c"), walBackup(dest, 1))
+		writeTestFile(t, dest, "dir/c", "changed")
+		writeTestFile(t, dest, "dir/x", "created")
+		journal := `{"seq":1,"op":"replace","path":"dir/c"}
+{"seq":1,"done":true}
+{"seq":2,"op":"create","path":"dir/x"}
+{"seq":3,"op":"delete","path":"dir/b"}
+{"seq":3,"do`
+		if err := ioutil.WriteFile(filepath.Join(dest, StateDir, walFile), []byte(journal), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	settle := func(policy string) int {
+		fs, err := openRootDir(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fs.Close()
+		r := &Receiver{root: dest, fs: fs, opts: &Options{}, ropts: NewReceiverOptions(WithWriteAhead(policy))}
+		n, err := r.recoverWriteAhead()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	interrupt()
+	if n := settle(WriteAheadRollback); n != 3 {
+		t.Errorf("rollback undid %d changes, want 3", n)
+	}
+	check("rolled back interruption", second)
+	interrupt()
+	if n := settle(WriteAheadComplete); n != 2 {
+		t.Errorf("completion undid %d changes, want 2", n)
+	}
+	check("completed interruption", map[string]string{"a": "new", "b": "added", "c": "changed"})
+	if _, err := os.Lstat(filepath.Join(dest, StateDir, walFile)); !os.IsNotExist(err) {
+		t.Errorf("journal left behind: %v", err)
+	}
+	hdr := new(bytes.Buffer)
+	newVersionHeader(CompressionOff, FileCrcOff, 0).marshallBinary(hdr)
+	if _, err := NewReceiver(hdr, ioutil.Discard, NewReceiverOptions(WithWriteAhead(WriteAheadRollback), WithTransactional())); err == nil {
+		t.Error("write-ahead journal with a transactional sync accepted")
+	}
+}
+
+func TestStore(t *testing.T) {
+	src, _ := ioutil.TempDir("", "store-src")
+	dir, _ := ioutil.TempDir("", "store")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dir)
+	writeTestFile(t, src, "dir/a", "same")
+	writeTestFile(t, src, "dir/sub/b", "same")
+	writeTestFile(t, src, "dir/c", "changed")
+	os.Symlink("a", filepath.Join(src, "dir", "link"))
+
+	store, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync := func() (received []string) {
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dir), WithStore(store, "work"),
+				WithReceiveProgress(func(path string, size uint64) {
+					received = append(received, path)
+				})))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			s, err := NewSender(out, in, NewOptions(WithVerbosity(0)))
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		return received
+	}
+	sync()
+	writeTestFile(t, src, "dir/c", "changed!")
+	// Only what changed is sent again (and the symlink)
+	if got, want := sync(), []string{"dir/c", "dir/link"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("received %v, want %v", got, want)
+	}
+	names, err := store.Manifests("")
+	if err != nil || len(names) != 2 {
+		t.Fatalf("manifests: %v, %v", names, err)
+	}
+	// "same" is stored once
+	var blobs int
+	filepath.Walk(filepath.Join(dir, "objects"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			blobs++
+		}
+		return nil
+	})
+	if blobs != 3 {
+		t.Errorf("got %d blobs, want 3", blobs)
+	}
+	for i, want := range []string{"changed", "changed!"} {
+		dest := filepath.Join(dir, fmt.Sprintf("checkout-%d", i))
+		if err := store.Materialize(names[i], dest); err != nil {
+			t.Fatal(err)
+		}
+		for path, want := range map[string]string{"dir/a": "same", "dir/sub/b": "same", "dir/c": want, "dir/link": "same"} {
+			if data, _ := ioutil.ReadFile(filepath.Join(dest, path)); string(data) != want {
+				t.Errorf("%v: got %q, want %q", path, data, want)
+			}
+		}
+		srcInfo, _ := os.Stat(filepath.Join(src, "dir", "a"))
+		if info, _ := os.Stat(filepath.Join(dest, "dir", "a")); !info.ModTime().Equal(srcInfo.ModTime()) {
+			t.Errorf("mtime %v, want %v", info.ModTime(), srcInfo.ModTime())
+		}
+	}
+}
+
+func TestArchive(t *testing.T) {
+	src, _ := ioutil.TempDir("", "archive-src")
+	defer os.RemoveAll(src)
+	writeTestFile(t, src, "dir/a", "content")
+	writeTestFile(t, src, "dir/sub/b", "more content")
+	os.Chmod(filepath.Join(src, "dir", "a"), 0600)
+	os.Symlink("a", filepath.Join(src, "dir", "link"))
+	info, _ := os.Stat(filepath.Join(src, "dir", "a"))
+
+	for _, format := range []string{ArchiveTar, ArchiveZip} {
+		var buf bytes.Buffer
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithArchive(&buf, format)))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			s, err := NewSender(out, in, NewOptions(WithVerbosity(0)))
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		got := make(map[string]string)
+		var mode os.FileMode
+		var mtime time.Time
+		add := func(name string, fi os.FileInfo, content io.Reader) {
+			data, _ := ioutil.ReadAll(content)
+			got[name] = string(data)
+			if name == "dir/a" {
+				mode, mtime = fi.Mode(), fi.ModTime()
+			}
+		}
+		if format == ArchiveTar {
+			tr := tar.NewReader(&buf)
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				var content io.Reader = tr
+				if h.Typeflag == tar.TypeSymlink {
+					content = strings.NewReader(h.Linkname)
+				}
+				add(h.Name, h.FileInfo(), content)
+			}
+		} else {
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range zr.File {
+				rc, _ := f.Open()
+				add(f.Name, f.FileInfo(), rc)
+				rc.Close()
+			}
+		}
+		want := map[string]string{"dir/": "", "dir/sub/": "", "dir/a": "content", "dir/sub/b": "more content", "dir/link": "a"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", format, got, want)
+		}
+		if mode.Perm() != 0600 || mtime.Unix() != info.ModTime().Unix() {
+			t.Errorf("%v: mode %v, mtime %v, want %v", format, mode, mtime, info.ModTime())
+		}
+	}
+}
+
+func TestImportArchive(t *testing.T) {
+	src, _ := ioutil.TempDir("", "import-src")
+	defer os.RemoveAll(src)
+	writeTestFile(t, src, "dir/a", "content")
+	writeTestFile(t, src, "dir/sub/b", "more content")
+	os.Symlink("a", filepath.Join(src, "dir", "link"))
+
+	for _, format := range []string{ArchiveTar, ArchiveZip} {
+		name := filepath.Join(src, "export."+format)
+		f, _ := os.Create(name)
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithArchive(f, format)))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			s, err := NewSender(out, in, NewOptions(WithVerbosity(0)))
+			if err != nil {
+				return err
+			}
+			return s.Sync(filepath.Join(src, "dir"))
+		})
+		f.Close()
+
+		dest, _ := ioutil.TempDir("", "import-dest")
+		defer os.RemoveAll(dest)
+		writeTestFile(t, dest, "dir/a", "old")
+		writeTestFile(t, dest, "dir/extra", "to be deleted")
+		for _, wrap := range []string{"", "copy"} {
+			a, err := OpenArchive(name, wrap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runPiped(t, func(in io.Reader, out io.Writer) error {
+				r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest)))
+				if err != nil {
+					return err
+				}
+				return r.Sync()
+			}, func(in io.Reader, out io.Writer) error {
+				s, err := NewArchiveSender(out, in, a, NewOptions(WithVerbosity(0)))
+				if err != nil {
+					return err
+				}
+				return s.Sync(wrap)
+			})
+			a.Close()
+		}
+		for _, dir := range []string{"dir", "copy/dir"} {
+			for file, want := range map[string]string{"a": "content", "sub/b": "more content"} {
+				if data, _ := ioutil.ReadFile(filepath.Join(dest, dir, file)); string(data) != want {
+					t.Errorf("%v: %v/%v is %q, want %q", format, dir, file, data, want)
+				}
+			}
+			if target, _ := os.Readlink(filepath.Join(dest, dir, "link")); target != "a" {
+				t.Errorf("%v: %v/link points to %q", format, dir, target)
+			}
+		}
+		if _, err := os.Lstat(filepath.Join(dest, "dir", "extra")); !os.IsNotExist(err) {
+			t.Errorf("%v: extra file not deleted: %v", format, err)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig(strings.NewReader(`
+# Sending
+[profile.docs]
+path = "/home/user/docs"   # the docs
+destination = ["vault", "unix:/run/qsync.sock"]
+excludes = ["*.tmp", "a \"quoted\" #name"]
+compression = "off"
+crc = "data"
+
+[profile.docs.subtree."Photos/"]
+crc = "off"
+delete = false
+
+[profile.docs.subtree.Code]
+excludes = [
+	"*.o",
+	"node_modules",
+]
+
+[profile.default]
+destination = "vault"
+max-depth = 64
+quota = 10_000
+audit = true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := cfg.Profile("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docs.Path != "/home/user/docs" || !reflect.DeepEqual(docs.Destination, []string{"vault", "unix:/run/qsync.sock"}) ||
+		!reflect.DeepEqual(docs.Excludes, []string{"*.tmp", `a "quoted" #name`}) {
+		t.Errorf("wrong profile: %+v", docs)
+	}
+	opts := docs.Options(DefaultOptions)
+	if opts.Compression != CompressionOff || opts.CrcUsage != FileCrcAtimeNsec || len(opts.Excludes) != 2 {
+		t.Errorf("wrong options: %+v", opts)
+	}
+	// In the order they're given
+	if len(opts.Subtrees) != 2 || !reflect.DeepEqual(opts.Subtrees[0], &Subtree{Path: "Photos", NoCrc: true, NoDelete: true}) ||
+		!reflect.DeepEqual(opts.Subtrees[1], &Subtree{Path: "Code", Excludes: []string{"*.o", "node_modules"}}) {
+		t.Errorf("wrong subtrees: %+v", opts.Subtrees)
+	}
+	if d := cfg.Profiles["default"].Destination; !reflect.DeepEqual(d, []string{"vault"}) {
+		t.Errorf("wrong destination: %v", d)
+	}
+	ropts := cfg.Profiles["default"].ReceiverOptions(&ReceiverOptions{MaxDirEntries: 5})
+	if ropts.MaxDepth != 64 || ropts.MaxDirEntries != 5 || ropts.MaxRootSize != 10000 || !ropts.AuditLog {
+		t.Errorf("wrong receiver options: %+v", ropts)
+	}
+	for _, bad := range []string{
+		"path = \"x\"",                     // outside of a profile
+		"[profile.a]\nfoo = 1",             // unknown key
+		"[profile.a]\ncrc = \"sometimes\"", // unknown value
+		"[profile.a]\nexcludes = [\"[\"]",  // bad pattern
+		"[profile.a]\n[profile.a]",         // duplicate
+
+		"[profile.a]\ndestination = 1",          // wrong type
+		"[profile.a]\ndestination = [\"a\", 1]", // wrong type
+		"[profile.a]\nquota = -1",               // negative
+		"[profile.a]\npath = \"unterminated",    // not toml
+		"[profile.a]\ncompression = \"\"",       // unknown value
+		"[profile]\na.path = \"x\"",             // not a table of its own
+
+		"[profile.a.subtree.\"x\"]",                                      // unknown profile
+		"[profile.a]\n[profile.a.subtree.\"../x\"]",                      // outside of the profile
+		"[profile.a]\n[profile.a.subtree.x]\nfoo = 1",                    // unknown key
+		"[profile.a]\n[profile.a.subtree.x]\ncrc = \"data\"",             // unknown value
+		"[profile.a]\n[profile.a.subtree.x]\n[profile.a.subtree.\"x/\"]", // duplicate
+	} {
+		if _, err := parseConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+	s := &Sender{opts: &Options{Excludes: []string{"*.tmp", "sub/cache"}}}
+	for path, want := range map[string]bool{
+		"dir":           false,
+		"dir/a.tmp":     true,
+		"dir/x/b.tmp":   true,
+		"dir/sub/cache": true,
+		"dir/cache":     false,
+		"dir/a.txt":     false,
+	} {
+		if got := s.excluded(path); got != want {
+			t.Errorf("%v: excluded %v, want %v", path, got, want)
+		}
+	}
+}
+
+// TestInline checks that tiny files come with the metadata, and are not
+// requested, with and without overlap, and that changes to them are received.
+func TestInline(t *testing.T) {
+	for _, overlap := range []bool{false, true} {
+		src, _ := ioutil.TempDir("", "inline-src")
+		dest, _ := ioutil.TempDir("", "inline-dest")
+		defer os.RemoveAll(src)
+		defer os.RemoveAll(dest)
+		big := make([]byte, 10000)
+		rand2.Read(big)
+		files := map[string]string{"a": "tiny", "sub/b": "lock", "sub/empty": "", "big": string(big)}
+		sync := func() []uint32 {
+			for name, data := range files {
+				writeTestFile(t, src, filepath.Join("dir", name), data)
+			}
+			var requested []uint32
+			runPiped(t, func(in io.Reader, out io.Writer) error {
+				r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest)))
+				if err != nil {
+					return err
+				}
+				err = r.Sync()
+				requested = r.requestList
+				return err
+			}, func(in io.Reader, out io.Writer) error {
+				opts := []Option{WithVerbosity(0), WithInline(4096)}
+				if overlap {
+					opts = append(opts, WithOverlap())
+				}
+				s, err := NewSender(out, in, NewOptions(opts...))
+				if err != nil {
+					return err
+				}
+				return s.Sync(filepath.Join(src, "dir"))
+			})
+			for name, data := range files {
+				if got, _ := ioutil.ReadFile(filepath.Join(dest, "dir", name)); string(got) != data {
+					t.Errorf("overlap %v, %v: got %d bytes, want %d", overlap, name, len(got), len(data))
+				}
+			}
+			return requested
+		}
+		if requested := sync(); !overlap && len(requested) != 1 {
+			t.Errorf("requested %d files, want only the big one", len(requested))
+		}
+		files["a"] = "changed"
+		sync()
+	}
+}
+
+// tamperingWriter replaces what it's given on the way, like a faulty link.
+type tamperingWriter struct {
+	w        io.Writer
+	old, new []byte
+}
+
+func (t *tamperingWriter) Write(p []byte) (int, error) {
+	if _, err := t.w.Write(bytes.Replace(p, t.old, t.new, -1)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// TestDigests checks that files are received with digests, including those
+// which would be sent straight from the kernel, and that content changed on
+// the way is caught.
+func TestDigests(t *testing.T) {
+	src, _ := ioutil.TempDir("", "digests-src")
+	dest, _ := ioutil.TempDir("", "digests-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	big := make([]byte, 2*zeroCopyMin)
+	rand2.Read(big)
+	files := map[string]string{"a": "original content", "sub/big": string(big)}
+	for name, data := range files {
+		writeTestFile(t, src, filepath.Join("dir", name), data)
+	}
+	sync := func(dest string, tamper bool) error {
+		inR, outL := io.Pipe()
+		inL, outR := io.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			r, err := NewReceiver(inR, outR, NewReceiverOptions(WithRoot(dest)))
+			if err == nil {
+				err = r.Sync()
+			}
+			inR.CloseWithError(io.ErrClosedPipe)
+			outR.Close()
+			errc <- err
+		}()
+		var out io.Writer = outL
+		if tamper {
+			out = &tamperingWriter{outL, []byte("original"), []byte("tampered")}
+		}
+		s, err := NewSender(out, inL, NewOptions(WithVerbosity(0), WithCompression(CompressionOff), WithDigests()))
+		if err == nil {
+			err = s.Sync(filepath.Join(src, "dir"))
+		}
+		if rErr := <-errc; rErr != nil || tamper {
+			return rErr
+		}
+		return err
+	}
+	if err := sync(dest, false); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if got, _ := ioutil.ReadFile(filepath.Join(dest, "dir", name)); string(got) != data {
+			t.Errorf("%v: got %d bytes, want %d", name, len(got), len(data))
+		}
+	}
+	other, _ := ioutil.TempDir("", "digests-other")
+	defer os.RemoveAll(other)
+	if err := sync(other, true); err == nil || !strings.Contains(err.Error(), "does not match the digest sent") {
+		t.Errorf("tampered content: got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(other, "dir", "a")); err == nil {
+		t.Errorf("tampered file was put in place")
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	src, _ := ioutil.TempDir("", "errors-src")
+	defer os.RemoveAll(src)
+	writeTestFile(t, src, "dir/a", "original content")
+	writeTestFile(t, src, "dir/b", string(make([]byte, 64<<10)))
+	sync := func(ropts *ReceiverOptions, tamper bool) (sErr, rErr error) {
+		dest, _ := ioutil.TempDir("", "errors-dest")
+		defer os.RemoveAll(dest)
+		ropts.Root = dest
+		inR, outL := io.Pipe()
+		inL, outR := io.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			r, err := NewReceiver(inR, outR, ropts)
+			if err == nil {
+				err = r.Sync()
+			}
+			inR.CloseWithError(io.ErrClosedPipe)
+			outR.Close()
+			errc <- err
+		}()
+		var out io.Writer = outL
+		if tamper {
+			out = &tamperingWriter{outL, []byte("original"), []byte("tampered")}
+		}
+		s, err := NewSender(out, inL, NewOptions(WithVerbosity(0), WithCompression(CompressionOff), WithDigests()))
+		if err == nil {
+			err = s.Sync(filepath.Join(src, "dir"))
+		}
+		return err, <-errc
+	}
+	// Tampered content is the sender's fault
+	sErr, rErr := sync(NewReceiverOptions(), true)
+	var perr *ProtocolError
+	if !errors.As(rErr, &perr) {
+		t.Errorf("receiver: got %v, want a ProtocolError", rErr)
+	}
+	var remote *RemoteError
+	if !errors.As(sErr, &remote) || remote.Code != CodeChecksumMismatch || !errors.Is(sErr, ErrChecksumMismatch) {
+		t.Errorf("sender: got %v, want %v", sErr, ErrChecksumMismatch)
+	}
+	// The quota is reported as a limit
+	sErr, rErr = sync(NewReceiverOptions(WithQuota(1<<10)), false)
+	if !errors.Is(rErr, ErrQuotaExceeded) {
+		t.Errorf("receiver: got %v, want %v", rErr, ErrQuotaExceeded)
+	}
+	if !errors.Is(sErr, ErrQuotaExceeded) || !errors.Is(sErr, ErrLimitExceeded) || !errors.Is(sErr, syscall.EDQUOT) {
+		t.Errorf("sender: got %v, want %v", sErr, ErrQuotaExceeded)
+	}
+	sErr, rErr = sync(NewReceiverOptions(WithLimits(1, 10)), false)
+	if !errors.Is(rErr, ErrLimitExceeded) || !errors.Is(sErr, ErrLimitExceeded) {
+		t.Errorf("depth limit: got %v, %v, want %v", rErr, sErr, ErrLimitExceeded)
+	}
+	// A failing hook rejects the transfer
+	sErr, rErr = sync(NewReceiverOptions(WithReceiveHooks(rejectHooks{})), false)
+	if !errors.Is(rErr, ErrRejected) || !errors.Is(rErr, errInfected) || !errors.Is(sErr, ErrRejected) {
+		t.Errorf("hook: got %v, %v, want %v", rErr, sErr, ErrRejected)
+	}
+}
+
+var errInfected = errors.New("infected")
+
+// rejectHooks fails the sync on the first file received.
+type rejectHooks struct {
+	NoHooks
+}
+
+func (rejectHooks) PostFile(path, local string) error { return errInfected }
+
+func TestTimeouts(t *testing.T) {
+	src, _ := ioutil.TempDir("", "timeouts-src")
+	defer os.RemoveAll(src)
+	writeTestFile(t, src, "dir/a", "content")
+	// A receiver which reads everything, and never answers
+	inR, outL := io.Pipe()
+	inL, outR := io.Pipe()
+	defer outR.Close()
+	go io.Copy(ioutil.Discard, inR)
+	s, err := NewSender(outL, inL, NewOptions(WithVerbosity(0), WithTimeouts(100*time.Millisecond, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := s.Sync(filepath.Join(src, "dir")); !errors.Is(err, ErrTimeout) {
+		t.Errorf("sender: got %v, want %v", err, ErrTimeout)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("sender gave up after %v", d)
+	}
+	outL.Close()
+	// A sender which connects, and never sends anything, over a connection
+	// with read deadlines
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	_, err = NewReceiver(c1, c1, NewReceiverOptions(WithReceiveTimeouts(0, 100*time.Millisecond)))
+	if !errors.Is(err, ErrTimeout) || !strings.Contains(err.Error(), "phase 0") {
+		t.Errorf("receiver: got %v, want %v in phase 0", err, ErrTimeout)
+	}
+}
+
+// TestSymlinkSwap checks that a directory which is replaced by a symlink while
+// it's being received isn't followed: the file which goes in it is refused,
+// rather than written where the symlink points.
+func TestSymlinkSwap(t *testing.T) {
+	src, _ := ioutil.TempDir("", "swap-src")
+	dest, _ := ioutil.TempDir("", "swap-dest")
+	outside, _ := ioutil.TempDir("", "swap-outside")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+	defer os.RemoveAll(outside)
+	writeTestFile(t, src, "dir/sub/file", "content")
+	var sErr, rErr error
+	runPiped(t, func(in io.Reader, out io.Writer) error {
+		// After the metadata, before the files are requested
+		out = &onFirstWrite{Writer: out, fn: func() {
+			sub := filepath.Join(dest, "dir", "sub")
+			if err := os.Remove(sub); err != nil {
+				t.Error(err)
+			}
+			if err := os.Symlink(outside, sub); err != nil {
+				t.Error(err)
+			}
+		}}
+		r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest)))
+		if err == nil {
+			rErr = r.Sync()
+		}
+		return err
+	}, func(in io.Reader, out io.Writer) error {
+		s, err := NewSender(out, in, NewOptions(WithVerbosity(0), WithCompression(CompressionOff)))
+		if err == nil {
+			sErr = s.Sync(filepath.Join(src, "dir"))
+		}
+		return err
+	})
+	if rErr == nil || sErr == nil {
+		t.Errorf("sync succeeded: %v, %v", rErr, sErr)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "file")); err == nil {
+		t.Error("file written through the symlink")
+	}
+}
+
+// afterWrites calls fn once more than n bytes were written to the writer.
+type afterWrites struct {
+	io.Writer
+	n    int
+	fn   func()
+	once sync.Once
+}
+
+func (w *afterWrites) Write(p []byte) (int, error) {
+	if w.n -= len(p); w.n < 0 {
+		w.once.Do(w.fn)
+	}
+	return w.Writer.Write(p)
+}
+
+func TestChangedWhileSent(t *testing.T) {
+	for i, change := range []func(f *os.File) error{
+		func(f *os.File) error { return f.Truncate(64 * 1024) },
+		func(f *os.File) error { _, err := f.Write(make([]byte, 64*1024)); return err },
+	} {
+		src, _ := ioutil.TempDir("", "changed-src")
+		dest, _ := ioutil.TempDir("", "changed-dest")
+		defer os.RemoveAll(src)
+		defer os.RemoveAll(dest)
+		writeTestFile(t, src, "dir/a", "content of a")
+		writeTestFile(t, src, "dir/b", strings.Repeat("content of b", 32*1024))
+		writeTestFile(t, src, "dir/c", "content of c")
+		var sender *Sender
+		sync := func(first bool) {
+			runPiped(t, func(in io.Reader, out io.Writer) error {
+				r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest)))
+				if err != nil {
+					return err
+				}
+				return r.Sync()
+			}, func(in io.Reader, out io.Writer) error {
+				if first {
+					// Halfway through the content of b
+					out = &afterWrites{Writer: out, n: 128 * 1024, fn: func() {
+						f, err := os.OpenFile(filepath.Join(src, "dir", "b"), os.O_WRONLY|os.O_APPEND, 0)
+						if err == nil {
+							err = change(f)
+							f.Close()
+						}
+						if err != nil {
+							t.Error(err)
+						}
+					}}
+				}
+				var err error
+				if sender, err = NewSender(out, in, NewOptions(WithVerbosity(0), WithCompression(CompressionOff))); err != nil {
+					return err
+				}
+				return sender.Sync(filepath.Join(src, "dir"))
+			})
+		}
+		sync(true)
+		if changed := sender.Changed(); len(changed) != 1 || changed[0] != "dir/b" {
+			t.Errorf("%d: changed: %v", i, changed)
+		}
+		for _, name := range []string{"a", "c"} {
+			if data, _ := ioutil.ReadFile(filepath.Join(dest, "dir", name)); string(data) != "content of "+name {
+				t.Errorf("%d: %v: got %q", i, name, data)
+			}
+		}
+		// The next sync sends it again
+		sync(false)
+		want, _ := ioutil.ReadFile(filepath.Join(src, "dir", "b"))
+		if got, _ := ioutil.ReadFile(filepath.Join(dest, "dir", "b")); !bytes.Equal(got, want) {
+			t.Errorf("%d: b: got %d bytes, want %d", i, len(got), len(want))
+		}
+		if changed := sender.Changed(); len(changed) != 0 {
+			t.Errorf("%d: changed again: %v", i, changed)
+		}
+	}
+}
+
+// onFirstWrite calls fn before the first write to the writer.
+type onFirstWrite struct {
+	io.Writer
+	fn   func()
+	once sync.Once
+}
+
+func (w *onFirstWrite) Write(p []byte) (int, error) {
+	w.once.Do(w.fn)
+	return w.Writer.Write(p)
+}
+
+func TestSkipGone(t *testing.T) {
+	for i, extra := range [][]Option{nil, {WithPack()}, {WithDedup(), WithDigests()}} {
+		src, _ := ioutil.TempDir("", "gone-src")
+		dest, _ := ioutil.TempDir("", "gone-dest")
+		defer os.RemoveAll(src)
+		defer os.RemoveAll(dest)
+		for _, name := range []string{"a", "b", "c"} {
+			writeTestFile(t, src, filepath.Join("dir", name), "content of "+name)
+		}
+		var sender *Sender
+		runPiped(t, func(in io.Reader, out io.Writer) error {
+			// After the metadata, before the files are requested
+			out = &onFirstWrite{Writer: out, fn: func() {
+				os.Remove(filepath.Join(src, "dir", "b"))
+			}}
+			r, err := NewReceiver(in, out, NewReceiverOptions(WithRoot(dest)))
+			if err != nil {
+				return err
+			}
+			return r.Sync()
+		}, func(in io.Reader, out io.Writer) error {
+			opts := NewOptions(append(extra, WithVerbosity(0), WithCompression(CompressionOff), WithSkipGone())...)
+			var err error
+			if sender, err = NewSender(out, in, opts); err != nil {
+				return err
+			}
+			return sender.Sync(filepath.Join(src, "dir"))
+		})
+		if gone := sender.Gone(); len(gone) != 1 || gone[0] != "dir/b" {
+			t.Errorf("%d: gone: %v", i, gone)
+		}
+		for _, name := range []string{"a", "c"} {
+			if data, _ := ioutil.ReadFile(filepath.Join(dest, "dir", name)); string(data) != "content of "+name {
+				t.Errorf("%d: %v: got %q", i, name, data)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dest, "dir", "b")); err == nil {
+			t.Errorf("%d: gone file was received", i)
+		}
+		if entries, err := ReadJournal(dest); err != nil || len(entries) != 1 || entries[0].Gone != 1 {
+			t.Errorf("%d: journal: %v %v", i, entries, err)
+		}
+	}
+}
+
+func TestSenderFlags(t *testing.T) {
+	parse := func(base *Options, args ...string) (*Options, error) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		f := AddSenderFlags(fs)
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		return f.Options(base)
+	}
+	base := NewOptions(WithExcludes("*.tmp"))
+	orig := *base
+	opts, err := parse(base, "-n", "-i", "-v", "1", "-workers", "4", "-summary", "-quick", "-exclude", "*.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Compression != CompressionOff || !opts.IgnoreSymlinks || opts.Verbosity != 1 || opts.Workers != 4 || !opts.Summary || !opts.QuickCheck {
+		t.Errorf("flags not applied: %+v", opts)
+	}
+	if !reflect.DeepEqual(opts.Excludes, []string{"*.tmp", "*.bak"}) {
+		t.Errorf("excludes: %v", opts.Excludes)
+	}
+	if !reflect.DeepEqual(*base, orig) {
+		t.Errorf("base was modified: %+v", base)
+	}
+	for _, args := range [][]string{
+		{"-v", "9"},
+		{"-workers", "0"},
+		{"-streams", "-1"},
+		{"-inline", "70000"},
+		{"-full-walk-every", "0"},
+		{"-read-timeout", "-1s"},
+		{"-quick"},
+		{"-lazy-hash", "-summary"},
+		{"-pack", "-streams", "2"},
+	} {
+		if _, err := parse(base, args...); err == nil {
+			t.Errorf("%v: no error", args)
+		}
+	}
+}
+
+func TestReceiverFlags(t *testing.T) {
+	parse := func(base *ReceiverOptions, args ...string) (*ReceiverOptions, error) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		f := AddReceiverFlags(fs)
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		return f.ReceiverOptions(base)
+	}
+	base := NewReceiverOptions(WithRoot("/dest"), WithQuota(1000))
+	orig := *base
+	ropts, err := parse(base, "-audit", "-max-depth", "8", "-owners", "-mmap", "-io-uring", "-read-timeout", "2m", "-phase-timeout", "1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ropts.AuditLog || ropts.MaxDepth != 8 || !ropts.Owners || ropts.SetID || !ropts.Mmap || !ropts.IOUring ||
+		ropts.ReadTimeout != 2*time.Minute || ropts.PhaseTimeout != time.Hour {
+		t.Errorf("flags not applied: %+v", ropts)
+	}
+	if ropts.Root != "/dest" || ropts.MaxRootSize != 1000 {
+		t.Errorf("base not kept: %+v", ropts)
+	}
+	if !reflect.DeepEqual(*base, orig) {
+		t.Errorf("base was modified: %+v", base)
+	}
+	for _, args := range [][]string{
+		{"-audit-max-size", "0"},
+		{"-max-depth", "0"},
+		{"-max-dir-entries", "0"},
+		{"-read-timeout", "-1s"},
+		{"-phase-timeout", "-1h"},
+		{"-normalize", "nfkc"},
+		{"-write-ahead", "undo"},
+		{"-transactional", "-write-ahead", "rollback"},
+	} {
+		if _, err := parse(base, args...); err == nil {
+			t.Errorf("%v: no error", args)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	root, _ := ioutil.TempDir("", "audit")
+	defer os.RemoveAll(root)
+	const maxSize = 200
+	a, err := openAuditLog(root, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough for the log to be rotated more often than the rotated logs kept
+	var paths []string
+	for i := 0; i < 40; i++ {
+		path := fmt.Sprintf("dir/file %d", i)
+		paths = append(paths, path)
+		if err := a.record(auditCreate, path, uint64(i*1000), uint32(i)<<16|0xbeef); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(root, StateDir, auditFile)
+	if _, err := os.Stat(fmt.Sprintf("%v.%d", logPath, auditLogKeep+1)); !os.IsNotExist(err) {
+		t.Errorf("more than %d rotated logs kept: %v", auditLogKeep, err)
+	}
+	lineRe := regexp.MustCompile(`^(\S+) create "(dir/file \d+)" size=(\d+) crc32=([0-9a-f]{8})$`)
+	// The oldest first
+	var got []string
+	for i := auditLogKeep; i >= 0; i-- {
+		name := logPath
+		if i > 0 {
+			name = fmt.Sprintf("%v.%d", logPath, i)
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > maxSize {
+			t.Errorf("%v: %d bytes, more than %d", name, len(data), maxSize)
+		}
+		if i > 0 && len(data) == 0 {
+			t.Errorf("%v: empty", name)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			m := lineRe.FindStringSubmatch(line)
+			if m == nil {
+				t.Fatalf("%v: malformed line %q", name, line)
+			}
+			if _, err := time.Parse(time.RFC3339Nano, m[1]); err != nil {
+				t.Errorf("%v: timestamp: %v", name, err)
+			}
+			var n int
+			fmt.Sscanf(m[2], "dir/file %d", &n)
+			if want := fmt.Sprintf("size=%d crc32=%08x", n*1000, uint32(n)<<16|0xbeef); !strings.HasSuffix(line, want) {
+				t.Errorf("%v: line %q, want %v", name, line, want)
+			}
+			got = append(got, m[2])
+		}
+	}
+	// The latest lines, in order, with none lost within the logs kept
+	if want := paths[len(paths)-len(got):]; len(got) == 0 || !reflect.DeepEqual(got, want) {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+
+	// Reopened, the log is appended to, and rotated by its size on disk
+	a, err = openAuditLog(root, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	before, _ := ioutil.ReadFile(logPath)
+	if err := a.record(auditDelete, "dir/gone", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := ioutil.ReadFile(logPath)
+	if !bytes.HasSuffix(after, []byte(` delete "dir/gone" size=0 crc32=00000000`+"\n")) {
+		t.Fatalf("reopened log: %q", after)
+	}
+	if line := after[bytes.LastIndexByte(after[:len(after)-1], '\n')+1:]; len(before)+len(line) <= maxSize {
+		if !bytes.Equal(after, append(before, line...)) {
+			t.Errorf("reopened log not appended to: %q", after)
+		}
+	} else if rotated, _ := ioutil.ReadFile(logPath + ".1"); !bytes.Equal(rotated, before) || !bytes.Equal(after, line) {
+		t.Errorf("reopened log not rotated: %q, %q", rotated, after)
+	}
+}
+
+func TestSenderAbort(t *testing.T) {
+	withStreams := func(o *Options) { o.Streams = 2 }
+	for i, extra := range [][]Option{nil, {WithPack()}, {WithOverlap()}, {withStreams}, {WithDedup()}} {
+		for _, early := range []bool{true, false} {
+			src, _ := ioutil.TempDir("", "abort-src")
+			dest, _ := ioutil.TempDir("", "abort-dest")
+			defer os.RemoveAll(src)
+			defer os.RemoveAll(dest)
+			for j := 0; j < 8; j++ {
+				writeTestFile(t, src, fmt.Sprintf("dir/f%d", j), strings.Repeat("x", j*3000))
+			}
+			var (
+				sender       *Sender
+				sendErr      error
+				receiveErr   error
+				receiverDone = make(chan struct{})
+			)
+			inR, outL := io.Pipe()
+			inL, outR := io.Pipe()
+			go func() {
+				defer close(receiverDone)
+				defer outR.Close()
+				r, err := NewReceiver(inR, outR, NewReceiverOptions(WithRoot(dest)))
+				if err != nil {
+					receiveErr = err
+					return
+				}
+				receiveErr = r.Sync()
+			}()
+			opts := NewOptions(append(extra, WithVerbosity(0), WithAbortable(), WithProgress(func(string, uint64) {
+				sender.Abort()
+			}))...)
+			sender, sendErr = NewSender(outL, inL, opts)
+			if sendErr == nil {
+				if early {
+					sender.Abort()
+				}
+				sendErr = sender.Sync(filepath.Join(src, "dir"))
+			}
+			outL.Close()
+			<-receiverDone
+			if sendErr != ErrAborted {
+				t.Errorf("%d/%v: sender: %v", i, early, sendErr)
+			}
+			if receiveErr != ErrSenderAborted {
+				t.Errorf("%d/%v: receiver: %v", i, early, receiveErr)
+			}
+			filepath.Walk(filepath.Join(dest, "dir"), func(path string, info os.FileInfo, err error) error {
+				if err == nil && info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), "f") {
+					t.Errorf("%d/%v: left behind: %v", i, early, path)
+				}
+				return nil
+			})
+		}
+	}
+}
+
+func TestVerifyTree(t *testing.T) {
+	src, _ := ioutil.TempDir("", "verify-src")
+	defer os.RemoveAll(src)
+	writeTestFile(t, src, "dir/a", "content")
+	writeTestFile(t, src, "dir/b", string(make([]byte, 64<<10)))
+	writeTestFile(t, src, "dir/secret/c", "not sent")
+	writeTestFile(t, src, "dir/sub/d", "renamed")
+	os.Symlink("a", filepath.Join(src, "dir/link"))
+	sync := func(ropts *ReceiverOptions, opts ...Option) (sErr, rErr error) {
+		dest, _ := ioutil.TempDir("", "verify-dest")
+		defer os.RemoveAll(dest)
+		ropts.Root = dest
+		inR, outL := io.Pipe()
+		inL, outR := io.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			r, err := NewReceiver(inR, outR, ropts)
+			if err == nil {
+				err = r.Sync()
+			}
+			inR.CloseWithError(io.ErrClosedPipe)
+			outR.Close()
+			errc <- err
+		}()
+		opts = append(opts, WithVerbosity(0), WithVerifyTree(), WithExcludes("secret"),
+			WithFilter(FilterFunc(func(path string, mode os.FileMode) (string, bool) {
+				return strings.Replace(path, "/sub/", "/sub/renamed-", 1), true
+			})))
+		s, err := NewSender(outL, inL, NewOptions(opts...))
+		if err == nil {
+			err = s.Sync(filepath.Join(src, "dir"))
+		}
+		outL.Close()
+		return err, <-errc
+	}
+	withStreams := func(o *Options) { o.Streams = 2 }
+	for i, opts := range [][]Option{nil, {withStreams}, {WithPack()}} {
+		if sErr, rErr := sync(NewReceiverOptions(), opts...); sErr != nil || rErr != nil {
+			t.Errorf("test %d: sender %v, receiver %v", i, sErr, rErr)
+		}
+	}
+	// A receiver which leaves out an item has a different tree
+	sErr, rErr := sync(NewReceiverOptions(WithReceiveFilter(FilterFunc(func(path string, mode os.FileMode) (string, bool) {
+		return path, path != "dir/b"
+	}))))
+	if !errors.Is(sErr, ErrChecksumMismatch) || !errors.Is(rErr, ErrChecksumMismatch) {
+		t.Errorf("differing trees: sender %v, receiver %v", sErr, rErr)
+	}
+}
+
+// failingSource fails to open the files named c.
+type failingSource struct {
+	osSource
+}
+
+func (s failingSource) Open(path string) (io.ReadCloser, error) {
+	if filepath.Base(path) == "c" {
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EACCES}
+	}
+	return s.osSource.Open(path)
+}
+
+// rejectB fails the sync on the file received as dir/b.
+type rejectB struct {
+	NoHooks
+}
+
+func (rejectB) PostFile(path, local string) error {
+	if path == "dir/b" {
+		return errInfected
+	}
+	return nil
+}
+
+func TestLenient(t *testing.T) {
+	src, _ := ioutil.TempDir("", "lenient-src")
+	defer os.RemoveAll(src)
+	writeTestFile(t, src, "dir/a", "content")
+	writeTestFile(t, src, "dir/b", "rejected")
+	writeTestFile(t, src, "dir/c", "unreadable")
+	sync := func(dest string, opts ...Option) (sErr, rErr error) {
+		inR, outL := io.Pipe()
+		inL, outR := io.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			r, err := NewReceiver(inR, outR, NewReceiverOptions(WithRoot(dest), WithReceiveHooks(rejectB{})))
+			if err == nil {
+				err = r.Sync()
+			}
+			inR.CloseWithError(io.ErrClosedPipe)
+			outR.Close()
+			errc <- err
+		}()
+		s, err := NewSender(outL, inL, NewOptions(append(opts, WithVerbosity(0))...))
+		if err == nil {
+			s.src = failingSource{}
+			err = s.Sync(filepath.Join(src, "dir"))
+		}
+		outL.Close()
+		inL.Close()
+		return err, <-errc
+	}
+	want := map[string]ItemFailure{
+		"dir/b": {Path: "dir/b", Code: CodeRejected},
+		"dir/c": {Path: "dir/c", Code: ErrorCode(syscall.EACCES), Sender: true},
+	}
+	for i, opts := range [][]Option{nil, {WithPack()}} {
+		dest, _ := ioutil.TempDir("", "lenient-dest")
+		defer os.RemoveAll(dest)
+		sErr, rErr := sync(dest, append(opts, WithLenient())...)
+		for side, err := range map[string]error{"sender": sErr, "receiver": rErr} {
+			var partial *PartialError
+			if !errors.As(err, &partial) || !errors.Is(err, ErrPartial) {
+				t.Fatalf("test %d: %v: got %v, want a partial sync", i, side, err)
+			}
+			got := make(map[string]ItemFailure)
+			for _, f := range partial.Failures {
+				got[f.Path] = f
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("test %d: %v: got failures %v, want %v", i, side, partial.Failures, want)
+			}
+		}
+		if data, _ := ioutil.ReadFile(filepath.Join(dest, "dir/a")); string(data) != "content" {
+			t.Errorf("test %d: dir/a: got %q", i, data)
+		}
+		for _, name := range []string{"dir/b", "dir/c"} {
+			if _, err := os.Lstat(filepath.Join(dest, name)); err == nil {
+				t.Errorf("test %d: %v was put in place", i, name)
+			}
+		}
+	}
+	// Without it, the sync is strict
+	dest, _ := ioutil.TempDir("", "lenient-dest")
+	defer os.RemoveAll(dest)
+	if sErr, rErr := sync(dest); sErr == nil || rErr == nil || errors.Is(sErr, ErrPartial) || errors.Is(rErr, ErrPartial) {
+		t.Errorf("strict sync: sender %v, receiver %v", sErr, rErr)
+	}
+}
+
+// TestDiskFull checks that a receiver which runs out of space fails the sync,
+// even a lenient one, without leaving tempfiles behind, and tells the sender
+// which file didn't fit.
+func TestDiskFull(t *testing.T) {
+	src, _ := ioutil.TempDir("", "diskfull-src")
+	defer os.RemoveAll(src)
+	writeTestFile(t, src, "dir/a", "content")
+	writeTestFile(t, src, "dir/big", strings.Repeat("x", 4<<20))
+	dest, _ := ioutil.TempDir("", "diskfull-dest")
+	defer os.RemoveAll(dest)
+	if err := syscall.Mount("tmpfs", dest, "tmpfs", 0, "size=1m"); err != nil {
+		t.Skipf("can't mount a tmpfs: %v", err)
+	}
+	defer syscall.Unmount(dest, 0)
+	sync := func(opts ...Option) (sErr, rErr error) {
+		inR, outL := io.Pipe()
+		inL, outR := io.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			r, err := NewReceiver(inR, outR, NewReceiverOptions(WithRoot(dest)))
+			if err == nil {
+				err = r.Sync()
+			}
+			inR.CloseWithError(io.ErrClosedPipe)
+			outR.Close()
+			errc <- err
+		}()
+		s, err := NewSender(outL, inL, NewOptions(append(opts, WithVerbosity(0), WithDiskFullDetails())...))
+		if err == nil {
+			err = s.Sync(filepath.Join(src, "dir"))
+		}
+		outL.Close()
+		inL.Close()
+		return err, <-errc
+	}
+	for i, opts := range [][]Option{nil, {WithLenient()}, {WithPack()}} {
+		os.RemoveAll(filepath.Join(dest, "dir"))
+		sErr, rErr := sync(opts...)
+		for side, err := range map[string]error{"sender": sErr, "receiver": rErr} {
+			var full *DiskFullError
+			if !errors.As(err, &full) || !errors.Is(err, syscall.ENOSPC) {
+				t.Fatalf("test %d: %v: got %v, want out of space", i, side, err)
+			}
+			if full.Path != "dir/big" || full.Needed != 4<<20 {
+				t.Errorf("test %d: %v: %v didn't fit, %d bytes needed, want dir/big, %d", i, side, full.Path, full.Needed, 4<<20)
+			}
+		}
+		var remote *RemoteError
+		if !errors.As(sErr, &remote) || remote.Code != CodeDiskFull {
+			t.Errorf("test %d: sender got %v, want a remote error", i, sErr)
+		}
+		if temps, _ := filepath.Glob(filepath.Join(dest, "qvm-*")); len(temps) > 0 {
+			t.Errorf("test %d: tempfiles left: %v", i, temps)
+		}
+	}
+}
+
+// TestRootDirChmodFiltered checks that chmod works where fchmodat2 is refused,
+// e.g. by a seccomp filter, and that a symlink is still not followed.
+func TestRootDirChmodFiltered(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chmod")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, dir, "a", "a")
+	os.Symlink("a", filepath.Join(dir, "link"))
+	fs, err := openRootDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	defer func(f func(int, string, uint32, int) error) {
+		fchmodat2 = f
+		atomic.StoreInt32(&noFchmodat2, 0)
+	}(fchmodat2)
+	for _, errno := range []syscall.Errno{syscall.EPERM, syscall.ENOSYS, syscall.EOPNOTSUPP} {
+		atomic.StoreInt32(&noFchmodat2, 0)
+		fchmodat2 = func(int, string, uint32, int) error { return errno }
+		err := fs.Chmod(filepath.Join(dir, "link"), 0600)
+		if !errors.Is(err, syscall.ELOOP) {
+			t.Errorf("%v: chmod of a symlink: %v, want ELOOP", errno, err)
+		}
+		if atomic.LoadInt32(&noFchmodat2) != 0 {
+			t.Errorf("%v: fchmodat2 given up on for a symlink", errno)
+		}
+		if err := fs.Chmod(filepath.Join(dir, "a"), 0640); err != nil {
+			t.Fatalf("%v: chmod: %v", errno, err)
+		}
+		if info, _ := os.Lstat(filepath.Join(dir, "a")); info.Mode().Perm() != 0640 {
+			t.Errorf("%v: mode %v, want 0640", errno, info.Mode())
+		}
+		if atomic.LoadInt32(&noFchmodat2) != 1 {
+			t.Errorf("%v: fchmodat2 not given up on", errno)
+		}
+		// Once given up on, it's not tried again
+		fchmodat2 = func(int, string, uint32, int) error {
+			t.Fatalf("%v: fchmodat2 tried again", errno)
+			return nil
+		}
+		if err := fs.Chmod(filepath.Join(dir, "a"), 0600); err != nil {
+			t.Fatalf("%v: chmod: %v", errno, err)
+		}
+	}
+	// Other errors are returned as such
+	atomic.StoreInt32(&noFchmodat2, 0)
+	fchmodat2 = func(int, string, uint32, int) error { return syscall.EROFS }
+	if err := fs.Chmod(filepath.Join(dir, "a"), 0600); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("chmod: %v, want EROFS", err)
+	}
+}
+
+// TestTwoWayBeneath checks that the two-way sync doesn't follow a symlink in
+// place of a directory, out of the synced directory.
+func TestTwoWayBeneath(t *testing.T) {
+	root, _ := ioutil.TempDir("", "twoway-root")
+	outside, _ := ioutil.TempDir("", "twoway-outside")
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(outside)
+	writeTestFile(t, outside, "secret", "secret")
+	writeTestFile(t, root, "x.txt", "pushed")
+	os.Symlink(outside, filepath.Join(root, "sub"))
+	fs, err := openRootDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	// An item pushed into the symlinked directory
+	info, err := os.Lstat(filepath.Join(root, "x.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := newFileHeaderFromStat("sub/x.txt", info)
+	stream := new(bytes.Buffer)
+	hdr.marshallBinary(stream)
+	stream.WriteString("pushed")
+	if _, err := receiveTwoWayItem(stream, fs, root, "sub/x.txt"); err == nil {
+		t.Error("item received through a symlink")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "x.txt")); !os.IsNotExist(err) {
+		t.Errorf("item written outside: %v", err)
+	}
+	if temps, _ := filepath.Glob(filepath.Join(outside, "qvm-*")); len(temps) > 0 {
+		t.Errorf("tempfiles written outside: %v", temps)
+	}
+	// A directory pushed below it
+	hdr = newFileHeaderFromStat("sub/dir/x.txt", info)
+	stream.Reset()
+	hdr.marshallBinary(stream)
+	stream.WriteString("pushed")
+	if _, err := receiveTwoWayItem(stream, fs, root, "sub/dir/x.txt"); err == nil {
+		t.Error("directory created through a symlink")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "dir")); !os.IsNotExist(err) {
+		t.Errorf("directory created outside: %v", err)
+	}
+	// Deleting, and sending, what's in it
+	if err := removeTwoWayItem(fs, root, "sub/secret"); err == nil {
+		t.Error("item deleted through a symlink")
+	}
+	if err := sendTwoWayItem(ioutil.Discard, fs, root, "sub/secret"); err == nil {
+		t.Error("item sent through a symlink")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "secret")); err != nil {
+		t.Errorf("item outside: %v", err)
+	}
+	// The path itself must stay below the root
+	if _, err := twoWayJoin(root, "../secret"); err == nil {
+		t.Error("path outside of the root accepted")
+	}
+}
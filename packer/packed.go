@@ -0,0 +1,212 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// With FlagPacked, the content of each requested item is preceded by a uint32
+// count. A count of zero means that a single item follows, as usual. Otherwise
+// it is the number of small items packed into a frame: a packedEntry for each,
+// followed by the items (header and content) back to back. The receiver reads
+// a frame in one go, and checks each item against its entry before it's
+// handled, so that a frame can't spill into what follows it.
+// OBS: This is not part of the qvm-copy protocol.
+
+// packedEntry describes an item in a frame.
+type packedEntry struct {
+	Len uint32 // of the header and content
+	Crc uint32 // crc32 of the header and content
+}
+
+const (
+	// packedMaxFile is the largest file which is packed.
+	packedMaxFile = 16 * 1024
+	// packedFrameSize is the size at which a frame is sent.
+	packedFrameSize = 1 << 20
+	// packedMaxItems is the most items in a frame.
+	packedMaxItems = 4096
+	// maxPackedFrame is the largest frame a receiver accepts, which leaves
+	// room for the last item added, and files which grew meanwhile.
+	maxPackedFrame = 4 * packedFrameSize
+)
+
+// packable returns whether an item with the given info is packed.
+func packable(info os.FileInfo) bool {
+	return info.Mode()&os.ModeSymlink != 0 ||
+		(info.Mode().IsRegular() && info.Size() <= packedMaxFile)
+}
+
+// sendPacked sends the content of the items at the given indexes, with runs
+// of small ones packed into frames, and flushes.
+func (s *Sender) sendPacked(list []uint32) error {
+	var (
+		frame   bytes.Buffer
+		entries []packedEntry
+		items   []*sentItem
+	)
+	sendFrame := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		if err := binary.Write(s.out, binary.LittleEndian, uint32(len(entries))); err != nil {
+			return err
+		}
+		if err := binary.Write(s.out, binary.LittleEndian, entries); err != nil {
+			return err
+		}
+		if _, err := s.out.Write(frame.Bytes()); err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := s.itemSent(item); err != nil {
+				return err
+			}
+		}
+		frame.Reset()
+		entries, items = entries[:0], items[:0]
+		return nil
+	}
+	for _, index := range list {
+		if s.isAborted() {
+			// The items of the frame are dropped, the receiver hasn't
+			// seen any of them
+			return s.abort(func() error {
+				if err := binary.Write(s.out, binary.LittleEndian, uint32(0)); err != nil {
+					return err
+				}
+				return s.writeAbort()
+			})
+		}
+		info, file, err := s.itemInfo(index)
+		ierr, failed := err.(*itemError)
+		if err != nil && err != errGone && !failed {
+			return err
+		}
+		if err == nil && !packable(info) {
+			err := sendFrame()
+			if err == nil {
+				err = binary.Write(s.out, binary.LittleEndian, uint32(0))
+			}
+			if err != nil {
+				if file != nil {
+					file.Close()
+				}
+				return err
+			}
+			item, err := s.writeItemInfo(s.out, index, info, file)
+			if err != nil {
+				return err
+			}
+			if err := s.itemSent(item); err != nil {
+				return err
+			}
+			continue
+		}
+		start := frame.Len()
+		var item *sentItem
+		if err == errGone {
+			item, err = s.writeGone(&frame, index)
+		} else if failed {
+			item, err = s.writeFailed(&frame, index, ierr.err)
+		} else {
+			item, err = s.writeItemInfo(&frame, index, info, file)
+		}
+		if err != nil {
+			return err
+		}
+		data := frame.Bytes()[start:]
+		entries = append(entries, packedEntry{Len: uint32(len(data)), Crc: crc32.ChecksumIEEE(data)})
+		items = append(items, item)
+		if frame.Len() >= packedFrameSize || len(entries) == packedMaxItems {
+			if err := sendFrame(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := sendFrame(); err != nil {
+		return err
+	}
+	return s.out.Flush()
+}
+
+// readFrame reads what precedes the next item from in, and returns the item,
+// if it's packed into a frame.
+func (r *Receiver) readFrame(in io.Reader) (*bytes.Reader, error) {
+	if len(r.frame) == 0 {
+		var count uint32
+		if err := binary.Read(in, binary.LittleEndian, &count); err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			return nil, nil
+		}
+		if count > packedMaxItems {
+			return nil, fmt.Errorf("too many items in frame (%d)", count)
+		}
+		entries := make([]packedEntry, count)
+		if err := binary.Read(in, binary.LittleEndian, entries); err != nil {
+			return nil, err
+		}
+		var size uint64
+		for _, e := range entries {
+			size += uint64(e.Len)
+		}
+		if size > maxPackedFrame {
+			return nil, fmt.Errorf("frame too large (%d bytes)", size)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(in, data); err != nil {
+			return nil, err
+		}
+		for i, e := range entries {
+			item := data[:e.Len]
+			data = data[e.Len:]
+			if crc := crc32.ChecksumIEEE(item); crc != e.Crc {
+				return nil, fmt.Errorf("item %d of frame corrupted (crc %08x, expected %08x)", i, crc, e.Crc)
+			}
+			r.frame = append(r.frame, item)
+		}
+	}
+	item := r.frame[0]
+	r.frame = r.frame[1:]
+	return bytes.NewReader(item), nil
+}
+
+// receivePacked is receiveItem, for the item read from the frame it is packed
+// into, with FlagPacked.
+func (r *Receiver) receivePacked(index uint32, announced *fileHeader) error {
+	if !r.packed {
+		return r.receiveItem(index, announced)
+	}
+	item, err := r.readFrame(r.in)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return r.receiveItem(index, announced)
+	}
+	in := r.in
+	r.in = item
+	defer func() { r.in = in }()
+	if err := r.receiveItem(index, announced); err != nil {
+		return err
+	}
+	if item.Len() > 0 {
+		return fmt.Errorf("%d bytes left after %v in frame", item.Len(), announced.path)
+	}
+	return nil
+}
+
+// endPacked checks that no packed items are left over, after the requested
+// ones.
+func (r *Receiver) endPacked() error {
+	if len(r.frame) > 0 {
+		return fmt.Errorf("%d items left in frame", len(r.frame))
+	}
+	return nil
+}
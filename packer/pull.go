@@ -0,0 +1,73 @@
+package packer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// pullRequest is sent by the receiving side, when it initiates the sync (a
+// pull). It names the directory to be synced, relative to the root which the
+// sending side serves. After that, the sync proceeds as usual.
+// OBS: This is not part of the qvm-copy protocol.
+type pullRequest struct {
+	NameLen uint32
+	Path    string
+}
+
+// RequestPull asks the other side to send the given directory.
+func RequestPull(out io.Writer, path string) error {
+	if err := checkPullPath(path); err != nil {
+		return err
+	}
+	req := pullRequest{NameLen: uint32(len(path) + 1), Path: path}
+	if err := binary.Write(out, binary.LittleEndian, req.NameLen); err != nil {
+		return err
+	}
+	return WritePath(out, req.Path)
+}
+
+// ReadPullRequest reads the directory requested by the other side. The path
+// is guaranteed to be relative, and not to lead outside of the served root.
+func ReadPullRequest(in io.Reader) (string, error) {
+	var req pullRequest
+	if err := binary.Read(in, binary.LittleEndian, &req.NameLen); err != nil {
+		return "", err
+	}
+	path, err := ReadPath(in, req.NameLen)
+	if err != nil {
+		return "", err
+	}
+	if err := checkPullPath(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func checkPullPath(path string) error {
+	if path == "" || filepath.IsAbs(path) || filepath.Clean(path) != path ||
+		path == ".." || strings.HasPrefix(path, "../") {
+		return fmt.Errorf("invalid pull path %q", path)
+	}
+	return nil
+}
+
+// ResolveServed resolves a directory requested by the other side, within the
+// served root. Symlinks within the root are followed, but may not lead the
+// other side outside of it.
+func ResolveServed(root, dir string) (string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := filepath.EvalSymlinks(filepath.Join(realRoot, dir))
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(realRoot, realPath); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("path %v is outside of the served root", dir)
+	}
+	return realPath, nil
+}
@@ -0,0 +1,51 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DiskUsage returns the total (apparent) size of all files in the
+// directories below root. Files directly in root (such as the receiver binary
+// itself, when jailed) are not counted, since everything synced lives in a
+// directory.
+func DiskUsage(root string) (uint64, error) {
+	var total uint64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() && filepath.Dir(path) != filepath.Clean(root) {
+			total += uint64(info.Size())
+		}
+		return nil
+	})
+	return total, err
+}
+
+// reserveQuota checks that replacing the file at path with one of the given
+// size does not make the sync root exceed the quota, and accounts for it.
+// Deletions are not accounted for until the next sync.
+func (r *Receiver) reserveQuota(path string, size uint64) error {
+	if r.ropts.MaxRootSize == 0 {
+		return nil
+	}
+	var existing uint64
+	if info, err := r.fs.Lstat(r.local(path)); err == nil && !info.IsDir() {
+		existing = uint64(info.Size())
+	}
+	usage := r.usage - existing + size
+	if r.usage < existing {
+		usage = size
+	}
+	if usage > r.ropts.MaxRootSize {
+		return fmt.Errorf("%w: %v would need %d bytes, quota is %d", ErrQuotaExceeded,
+			path, usage, r.ropts.MaxRootSize)
+	}
+	r.usage = usage
+	return nil
+}
@@ -0,0 +1,223 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// A signed transfer (FlagSigned) works like this: after the metadata (phase
+// 0), the sender sends a signature block, containing the sha256 digest of
+// each file and symlink target in the metadata, in order, followed by an
+// ed25519 signature over
+//
+//	signatureContext || sha256(metadata) || digests
+//
+// where the metadata is every file header, as sent. A receiver with a
+// trusted key reads the metadata and the block before changing anything, and
+// refuses the transfer unless the signature checks out. During the data
+// phase, each received item must match its header in the metadata, and its
+// content the digest, before it is put in place.
+// OBS: This is not part of the qvm-copy protocol.
+
+const signatureContext = "qvm-sync signed metadata v1\x00"
+
+// maxSignedMetadata limits how much metadata a receiver buffers, while
+// waiting for the signature.
+const maxSignedMetadata = 256 * 1024 * 1024
+
+// signer collects what is signed, on the sending side.
+type signer struct {
+	key     ed25519.PrivateKey
+	meta    hash.Hash
+	digests bytes.Buffer
+}
+
+func newSigner(key ed25519.PrivateKey) *signer {
+	return &signer{key: key, meta: sha256.New()}
+}
+
+// addItem adds the digest of the given file, or the target of the given
+// symlink. The digest of a file is taken from the cache, if it's there.
+func (s *signer) addItem(src source, cache *hashCache, path string, info os.FileInfo) error {
+	d, ok := cache.digest(info)
+	if !ok {
+		var err error
+		if d, err = digestItem(src, path, info); err != nil {
+			return err
+		}
+		cache.setDigest(info, d)
+	}
+	s.digests.Write(d)
+	return nil
+}
+
+// writeBlock sends the digests and the signature.
+func (s *signer) writeBlock(out io.Writer) error {
+	sig := ed25519.Sign(s.key, signedMessage(s.meta.Sum(nil), s.digests.Bytes()))
+	if _, err := out.Write(s.digests.Bytes()); err != nil {
+		return err
+	}
+	_, err := out.Write(sig)
+	return err
+}
+
+func signedMessage(metaSum, digests []byte) []byte {
+	msg := make([]byte, 0, len(signatureContext)+len(metaSum)+len(digests))
+	msg = append(msg, signatureContext...)
+	msg = append(msg, metaSum...)
+	return append(msg, digests...)
+}
+
+// digestItem returns the sha256 of the content of a file, or of the target of
+// a symlink.
+func digestItem(src source, path string, info os.FileInfo) ([]byte, error) {
+	h := sha256.New()
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := src.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(h, target)
+		return h.Sum(nil), nil
+	}
+	f, err := src.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	defer dropCache(src, f)
+	if data := mapItem(src, f, info.Size()); data != nil {
+		if err := hashMapped(path, data, func(data []byte) { h.Write(data) }); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// receiveSigned reads the metadata and the signature block, and verifies the
+// signature, if a key is given. It returns the metadata, to be processed as usual, and the
+// digests of the items.
+func receiveSigned(in io.Reader, key ed25519.PublicKey) (io.Reader, [][]byte, error) {
+	var (
+		meta  = new(bytes.Buffer)
+		sum   = sha256.New()
+		items int
+	)
+	for {
+		hdr, err := unMarshallBinary(in)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isAbortFrame(hdr) {
+			return nil, nil, ErrSenderAborted
+		}
+		if hdr.Data.NameLen == 0 {
+			break
+		}
+		if meta.Len() > maxSignedMetadata {
+			return nil, nil, protocolErrorf("signed metadata exceeds %d bytes", maxSignedMetadata)
+		}
+		hdr.marshallBinary(io.MultiWriter(meta, sum))
+		if hdr.isRegular() || hdr.isSymlink() {
+			items++
+		}
+	}
+	meta.Write(make([]byte, 32))
+	digests := make([]byte, items*sha256.Size)
+	if _, err := io.ReadFull(in, digests); err != nil {
+		return nil, nil, fmt.Errorf("failed reading digests: %v", err)
+	}
+	sig := make([]byte, ed25519.SignatureSize)
+	if _, err := io.ReadFull(in, sig); err != nil {
+		return nil, nil, fmt.Errorf("failed reading signature: %v", err)
+	}
+	// Without a trusted key, the digests are still checked
+	if key != nil && !ed25519.Verify(key, signedMessage(sum.Sum(nil), digests), sig) {
+		return nil, nil, fmt.Errorf("%w: invalid signature", ErrRejected)
+	}
+	list := make([][]byte, items)
+	for i := range list {
+		list[i] = digests[i*sha256.Size : (i+1)*sha256.Size]
+	}
+	return meta, list, nil
+}
+
+// GenerateKey creates a new signing key, and writes the private key to
+// privPath, and the public key to pubPath (base64-encoded).
+func GenerateKey(privPath, pubPath string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(privPath, []byte(base64.StdEncoding.EncodeToString(priv)+"\n"), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pubPath, []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644)
+}
+
+// LoadSigningKey reads a private key written by GenerateKey.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid signing key in %v", path)
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// ParsePublicKey parses a base64-encoded public key, as written by
+// GenerateKey.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key %q", s)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// checkSignedItem verifies that the header of an item in the data phase
+// matches the signed header in the metadata.
+func checkSignedItem(signed, hdr *fileHeader) error {
+	if hdr.path != signed.path || hdr.Data.Mode != signed.Data.Mode ||
+		hdr.Data.FileLen != signed.Data.FileLen || hdr.Data.Mtime != signed.Data.Mtime ||
+		hdr.Data.MtimeNsec != signed.Data.MtimeNsec {
+		return protocolErrorf("item %v does not match the signed metadata (%v)", hdr.path, signed.path)
+	}
+	return nil
+}
+
+// checkDigest verifies the digest of a received item, if the transfer is
+// signed, or the sender sent it along, see checkSentDigest.
+func (r *Receiver) checkDigest(hdr *fileHeader, digest []byte) error {
+	if err := r.checkSentDigest(hdr, digest); err != nil {
+		return err
+	}
+	if r.digest == nil {
+		return nil
+	}
+	if !bytes.Equal(digest, r.digest) {
+		return protocolErrorf("%w: content of %v does not match the signed digest", ErrChecksumMismatch, hdr.path)
+	}
+	return nil
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
@@ -0,0 +1,43 @@
+package packer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// TakeSnapshot invokes the given snapshot command (e.g. a wrapper around
+// 'btrfs subvolume snapshot' or 'lvcreate --snapshot'), with the environment
+// variable QSYNC_ROOT set to the absolute path of root. The last non-empty
+// line printed on stdout is used as the snapshot id.
+func TakeSnapshot(command []string, root string) (string, error) {
+	if len(command) == 0 {
+		return "", fmt.Errorf("no snapshot command given")
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	var stdout bytes.Buffer
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = absRoot
+	cmd.Env = append(os.Environ(), fmt.Sprintf("QSYNC_ROOT=%v", absRoot))
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("snapshot command failed: %v", err)
+	}
+	var id string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			id = line
+		}
+	}
+	if id == "" {
+		return "", fmt.Errorf("snapshot command did not report an id")
+	}
+	return id, nil
+}
@@ -0,0 +1,131 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// source is where a sender reads the tree from: the filesystem (osSource), or
+// an archive (see OpenArchive). Paths are those below the root of the source.
+type source interface {
+	// resolve resolves the directory to sync, into the root and the path of
+	// the directory below it.
+	resolve(dir string) (root, path string, err error)
+	Lstat(path string) (os.FileInfo, error)
+	ReadDir(path string) ([]os.FileInfo, error)
+	Readlink(path string) (string, error)
+	Open(path string) (io.ReadCloser, error)
+}
+
+// osSource reads the tree from the filesystem.
+type osSource struct {
+	mmap      bool // whether large files are mapped when hashed, see mapItem
+	dropCache bool // whether files are dropped from the page cache, see dropCache
+}
+
+func (osSource) resolve(dir string) (string, string, error) {
+	absPath, err := filepath.Abs(filepath.Clean(dir))
+	if err != nil {
+		return "", "", err
+	}
+	root, path := filepath.Split(absPath)
+	return root, path, nil
+}
+
+func (osSource) Lstat(path string) (os.FileInfo, error)     { return os.Lstat(path) }
+func (osSource) ReadDir(path string) ([]os.FileInfo, error) { return ioutil.ReadDir(path) }
+func (osSource) Readlink(path string) (string, error)       { return os.Readlink(path) }
+
+func (s osSource) Open(path string) (io.ReadCloser, error) {
+	f, err := openFile(path, os.O_RDONLY, s.dropCache)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// openFile opens the file at path for reading. With noatime, it's opened with
+// O_NOATIME if it's ours, so that reading it doesn't update its access time,
+// which is a write of its own.
+func openFile(path string, flag int, noatime bool) (*os.File, error) {
+	if noatime {
+		f, err := os.OpenFile(path, flag|syscall.O_NOATIME, 0)
+		if !errors.Is(err, syscall.EPERM) {
+			return f, err
+		}
+	}
+	return os.OpenFile(path, flag, 0)
+}
+
+// openRegular opens the file at path, if it's still a regular file, and
+// returns its info, from the descriptor. A symlink isn't followed, and a fifo
+// doesn't block, which it may have been replaced with since it was listed.
+// With noatime, it's opened like openFile does.
+func openRegular(path string, noatime bool) (*os.File, os.FileInfo, error) {
+	f, err := openFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, noatime)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = fmt.Errorf("%v is not a regular file", path)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// dropCache drops the content of the file f in src from the page cache, once
+// it's been read, if src drops files (see Options.DropCache).
+func dropCache(src source, f io.Reader) {
+	file, ok := f.(*os.File)
+	if s, isOS := src.(osSource); isOS && s.dropCache && ok {
+		unix.Fadvise(int(file.Fd()), 0, 0, fadvDontNeed)
+	}
+}
+
+// crcItem returns the crc32 (IEEETable) of the content of a file in src. If
+// the item is a directory, symlink or empty, it returns crc 0.
+func crcItem(src source, path string, stat os.FileInfo) (uint32, error) {
+	if !stat.Mode().IsRegular() || stat.Size() == 0 {
+		return 0, nil
+	}
+	f, err := src.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	defer dropCache(src, f)
+	var (
+		size = stat.Size()
+		crc  uint32
+	)
+	if data := mapItem(src, f, size); data != nil {
+		err := hashMapped(path, data, func(data []byte) { crc = crc32.ChecksumIEEE(data) })
+		return crc, err
+	}
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+	for size > 0 {
+		n, err := f.Read(buf)
+		if n == 0 && err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("%v: unexpected end of file", path)
+			}
+			return 0, err
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, buf[:n])
+		size -= int64(n)
+	}
+	return crc, nil
+}
@@ -0,0 +1,449 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// storeTimeFormat is the time format manifests are named by.
+const storeTimeFormat = "20060102T150405.000000000Z"
+
+// Store is a content-addressed store of synced trees, an alternative to
+// receiving into a directory. The content of each file is kept once, as a
+// blob named by its sha256, no matter how many syncs (or sources) it is part
+// of. Each sync is recorded in a manifest, which lists the items of the tree:
+//
+//	<dir>/objects/<first two hex digits>/<sha256>
+//	<dir>/manifests/<source>/<time>.json
+//
+// A manifest can be checked out into a directory with Materialize.
+type Store struct {
+	dir string
+}
+
+// StoreEntry is an item in a StoreManifest.
+type StoreEntry struct {
+	Path   string `json:"path"`
+	Mode   uint32 `json:"mode"` // as os.FileMode
+	Size   uint64 `json:"size,omitempty"`
+	Mtime  int64  `json:"mtime"` // in nanoseconds since the epoch
+	Crc    uint32 `json:"crc,omitempty"`
+	Blob   string `json:"blob,omitempty"`   // sha256 of the content, for files
+	Target string `json:"target,omitempty"` // for symlinks
+}
+
+func (e *StoreEntry) mode() os.FileMode {
+	return os.FileMode(e.Mode)
+}
+
+// StoreManifest describes a tree received into a Store.
+type StoreManifest struct {
+	Name    string        `json:"name"` // <source>/<time>
+	Source  string        `json:"source"`
+	Time    time.Time     `json:"time"`
+	Entries []*StoreEntry `json:"entries"` // parents before their content
+}
+
+// OpenStore opens the store in dir, creating it if needed.
+func OpenStore(dir string) (*Store, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range []string{"objects", "manifests", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) blobPath(sum string) string {
+	return filepath.Join(s.dir, "objects", sum[:2], sum)
+}
+
+// hasBlob returns whether the blob with the given sha256 is in the store.
+func (s *Store) hasBlob(sum string) bool {
+	if len(sum) != sha256.Size*2 {
+		return false
+	}
+	_, err := os.Lstat(s.blobPath(sum))
+	return err == nil
+}
+
+// tempFile creates a file to receive content into, before it's added.
+func (s *Store) tempFile() (*os.File, error) {
+	return ioutil.TempFile(filepath.Join(s.dir, "tmp"), "qvm-*")
+}
+
+// addBlob moves the file at path into the store, as the blob with the given
+// sha256. If the store already has it, the file is removed instead.
+func (s *Store) addBlob(path, sum string) error {
+	if s.hasBlob(sum) {
+		return os.Remove(path)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.blobPath(sum)), 0700); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0400); err != nil {
+		return err
+	}
+	return os.Rename(path, s.blobPath(sum))
+}
+
+// checkStoreSource verifies that a source can be used as a directory name.
+func checkStoreSource(source string) error {
+	if source == "" || source == "." || source == ".." || strings.ContainsAny(source, "/\x00") {
+		return fmt.Errorf("invalid source %q", source)
+	}
+	return nil
+}
+
+// Manifests returns the names of the manifests of the given source, or of all
+// sources if it's empty, oldest first.
+func (s *Store) Manifests(source string) ([]string, error) {
+	sources := []string{source}
+	if source == "" {
+		dirs, err := ioutil.ReadDir(filepath.Join(s.dir, "manifests"))
+		if err != nil {
+			return nil, err
+		}
+		sources = sources[:0]
+		for _, d := range dirs {
+			sources = append(sources, d.Name())
+		}
+	} else if err := checkStoreSource(source); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, src := range sources {
+		files, err := ioutil.ReadDir(filepath.Join(s.dir, "manifests", src))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		var own []string
+		for _, f := range files {
+			if name := f.Name(); strings.HasSuffix(name, ".json") {
+				own = append(own, src+"/"+strings.TrimSuffix(name, ".json"))
+			}
+		}
+		sort.Strings(own)
+		names = append(names, own...)
+	}
+	return names, nil
+}
+
+// Manifest reads the manifest with the given name.
+func (s *Store) Manifest(name string) (*StoreManifest, error) {
+	source, stamp := filepath.Split(name)
+	if err := checkStoreSource(filepath.Clean(source)); err != nil {
+		return nil, fmt.Errorf("invalid manifest name %q", name)
+	}
+	if err := checkStoreSource(stamp); err != nil {
+		return nil, fmt.Errorf("invalid manifest name %q", name)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, "manifests", name+".json"))
+	if err != nil {
+		return nil, err
+	}
+	m := new(StoreManifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %v: %v", name, err)
+	}
+	return m, nil
+}
+
+// writeManifest writes the manifest, named after its source and time.
+func (s *Store) writeManifest(m *StoreManifest) error {
+	m.Name = m.Source + "/" + m.Time.UTC().Format(storeTimeFormat)
+	dir := filepath.Join(s.dir, "manifests", m.Source)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", " ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".qvm-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(s.dir, "manifests", m.Name+".json"))
+}
+
+// latest returns the entries of the last manifest of the source, by path.
+func (s *Store) latest(source string) (map[string]*StoreEntry, error) {
+	entries := make(map[string]*StoreEntry)
+	names, err := s.Manifests(source)
+	if err != nil || len(names) == 0 {
+		return entries, err
+	}
+	m, err := s.Manifest(names[len(names)-1])
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range m.Entries {
+		entries[e.Path] = e
+	}
+	return entries, nil
+}
+
+// Materialize checks out the tree of the manifest into dest, which must not
+// exist, or be empty. The content of each file is verified against its sha256.
+func (s *Store) Materialize(name, dest string) error {
+	m, err := s.Manifest(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	if files, err := ioutil.ReadDir(dest); err != nil || len(files) > 0 {
+		if err == nil {
+			err = fmt.Errorf("%v is not empty", dest)
+		}
+		return err
+	}
+	var dirs []*StoreEntry
+	for _, e := range m.Entries {
+		if err := checkPullPath(e.Path); err != nil {
+			return err
+		}
+		path := filepath.Join(dest, e.Path)
+		switch {
+		case e.mode().IsDir():
+			if err := os.Mkdir(path, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, e)
+			continue
+		case e.mode()&os.ModeSymlink != 0:
+			// Symlinks can't have their perms set, see fixTimesAndPerms
+			if err := os.Symlink(e.Target, path); err != nil {
+				return err
+			}
+			mtime := time.Unix(0, e.Mtime)
+			if err := utimensat(atFdCwd, path, path, mtime, mtime); err != nil {
+				return err
+			}
+			continue
+		case e.mode().IsRegular():
+			if err := s.checkout(e, path); err != nil {
+				return fmt.Errorf("checking out %v failed: %v", e.Path, err)
+			}
+		default:
+			return fmt.Errorf("unknown file mode %x of %v", e.Mode, e.Path)
+		}
+		if err := fixStoreEntry(e, path); err != nil {
+			return err
+		}
+	}
+	// Children go before their parents
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := fixStoreEntry(dirs[i], filepath.Join(dest, dirs[i].Path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkout copies the blob of the entry to path, verifying it.
+func (s *Store) checkout(e *StoreEntry, path string) error {
+	if len(e.Blob) != sha256.Size*2 {
+		return fmt.Errorf("invalid blob %q", e.Blob)
+	}
+	in, err := os.Open(s.blobPath(e.Blob))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	digest := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, digest), in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(digest.Sum(nil)); sum != e.Blob {
+		return fmt.Errorf("blob %v is corrupt (sha256 %v)", e.Blob, sum)
+	}
+	return nil
+}
+
+// fixStoreEntry sets the perms and times of the checked out item.
+func fixStoreEntry(e *StoreEntry, path string) error {
+	if err := os.Chmod(path, e.mode()&os.ModePerm); err != nil {
+		return err
+	}
+	mtime := time.Unix(0, e.Mtime)
+	return os.Chtimes(path, mtime, mtime)
+}
+
+// newStoreEntry returns the entry for a received item.
+func (r *Receiver) newStoreEntry(hdr *fileHeader) *StoreEntry {
+	return &StoreEntry{
+		Path:  r.localPath(hdr.path),
+		Mode:  hdr.Data.Mode,
+		Size:  hdr.Data.FileLen,
+		Mtime: time.Unix(int64(hdr.Data.Mtime), int64(hdr.Data.MtimeNsec)).UnixNano(),
+	}
+}
+
+// storeMetadata handles the metadata of an item, when receiving into a store.
+// Files which are unchanged since the last sync from the same source are not
+// requested again.
+func (r *Receiver) storeMetadata(hdr *fileHeader) error {
+	entry := r.newStoreEntry(hdr)
+	if hdr.isDir() {
+		if !r.visitDir(hdr.path) {
+			// Second visit, with the final times
+			r.storeEntries[entry.Path].Mtime = entry.Mtime
+			return nil
+		}
+		r.storeEntries[entry.Path] = entry
+		r.manifest.Entries = append(r.manifest.Entries, entry)
+		return nil
+	}
+	defer func() { r.index++ }()
+	r.items = append(r.items, hdr)
+	if err := r.countBytes(hdr.Data.FileLen, false); err != nil {
+		return err
+	}
+	r.storeEntries[entry.Path] = entry
+	r.manifest.Entries = append(r.manifest.Entries, entry)
+	if hdr.isRegular() {
+		crcUsed := r.opts.CrcUsage == FileCrcAtimeNsecMetadata || r.opts.CrcUsage == FileCrcAtimeNsec
+		if crcUsed && !r.lazyHashing {
+			entry.Crc = hdr.Data.AtimeNsec
+		}
+		prev := r.storePrevious[entry.Path]
+		if prev != nil && prev.Mode == entry.Mode && prev.Size == entry.Size &&
+			prev.Mtime == entry.Mtime && r.store.hasBlob(prev.Blob) {
+			if crcUsed && r.lazyHashing {
+				// Compared once the crc is in, see receiveHashes
+				r.hashPending = append(r.hashPending, r.index)
+				return nil
+			}
+			if !crcUsed || prev.Crc == entry.Crc {
+				entry.Blob, entry.Crc = prev.Blob, prev.Crc
+				return r.audit.record(auditSkip, entry.Path, entry.Size, entry.Crc)
+			}
+		}
+	}
+	// Symlinks are always requested, as they are cheap, and can't be
+	// compared by their metadata
+	r.request(r.index)
+	return nil
+}
+
+// storeHashed reuses the content of the last manifest for the item with the
+// given index, whose crc the sender sent, if it's the same as there, and
+// requests it otherwise.
+func (r *Receiver) storeHashed(index uint32, hdr *fileHeader, crc uint32) error {
+	entry := r.storeEntries[r.localPath(hdr.path)]
+	if prev := r.storePrevious[entry.Path]; prev.Crc == crc {
+		entry.Blob, entry.Crc = prev.Blob, prev.Crc
+		return r.audit.record(auditSkip, entry.Path, entry.Size, entry.Crc)
+	}
+	r.request(index)
+	return nil
+}
+
+// storeFullData receives the content of a file or symlink into the store.
+func (r *Receiver) storeFullData(hdr *fileHeader) error {
+	if err := r.countBytes(hdr.Data.FileLen, true); err != nil {
+		return err
+	}
+	entry := r.storeEntries[r.localPath(hdr.path)]
+	if hdr.isSymlink() {
+		if hdr.Data.FileLen > MaxPathLength-1 {
+			return fmt.Errorf("symlink link-name too long (%d characters)", hdr.Data.FileLen)
+		}
+		buf := make([]byte, hdr.Data.FileLen)
+		if _, err := io.ReadFull(r.in, buf); err != nil {
+			return fmt.Errorf("symlink content read err: %v", err)
+		}
+		if err := r.checkDigest(hdr, sha256Sum(buf)); err != nil {
+			return err
+		}
+		if keep, err := r.postFile(hdr, ""); !keep {
+			r.dropStoreEntry(entry)
+			return err
+		}
+		entry.Target = string(buf)
+		return r.audit.record(auditCreate, entry.Path, hdr.Data.FileLen, crc32.ChecksumIEEE(buf))
+	}
+	f, err := r.store.tempFile()
+	if err != nil {
+		return err
+	}
+	r.addStaging(f.Name())
+	defer r.dropStaging(f.Name()) // the removal is a no-op, once added
+	var (
+		crc    = crc32.NewIEEE()
+		digest = sha256.New()
+	)
+	fw, err := newFileWriter(f, hdr.Data.FileLen, r.rings)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = copyContent(r.in, io.MultiWriter(fw, crc, digest), hdr.Data.FileLen)
+	if cErr := fw.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+	sum := digest.Sum(nil)
+	if err := r.checkDigest(hdr, sum); err != nil {
+		return err
+	}
+	if keep, err := r.postFile(hdr, f.Name()); !keep {
+		r.dropStoreEntry(entry)
+		return err
+	}
+	entry.Blob, entry.Crc = hex.EncodeToString(sum), crc.Sum32()
+	if err := r.store.addBlob(f.Name(), entry.Blob); err != nil {
+		return err
+	}
+	if r.opts.Verbosity >= 4 {
+		log.Printf("Stored %v as %v", entry.Path, entry.Blob)
+	}
+	return r.audit.record(auditCreate, entry.Path, entry.Size, entry.Crc)
+}
+
+// dropStoreEntry removes an item left out by the PostFile hook.
+func (r *Receiver) dropStoreEntry(entry *StoreEntry) {
+	delete(r.storeEntries, entry.Path)
+	for i, e := range r.manifest.Entries {
+		if e == entry {
+			r.manifest.Entries = append(r.manifest.Entries[:i], r.manifest.Entries[i+1:]...)
+			break
+		}
+	}
+}
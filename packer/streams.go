@@ -0,0 +1,248 @@
+package packer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"io"
+)
+
+// With several streams (see Options.Streams), the data phase works like this:
+//
+//  1. The requested items are assigned to the streams round-robin: the
+//     first item to the first stream, and so on. Each stream reads its
+//     items, and compresses them on its own, as a separate snappy stream.
+//  2. What the streams produce is sent in frames, each of which is a
+//     frameHeader, and that many bytes of the stream. The frames of an item
+//     are sent before those of the next one, so the receiver handles the
+//     items in the order requested, as usual, while the other streams work
+//     ahead.
+//  3. After the last item, the sender sends an empty frame, which ends all
+//     streams, and the receiver sends the result as usual. An empty frame
+//     of the stream abortStream aborts the sync instead, see FlagAbort.
+//
+// Nothing else changes: the metadata, and what the receiver sends, are sent
+// as a single stream.
+// OBS: This is not part of the qvm-copy protocol.
+
+// frameHeader precedes each frame of the streams.
+type frameHeader struct {
+	Stream uint32
+	Len    uint32 // 0 ends the streams
+}
+
+const (
+	// maxFrame is the largest frame accepted. The frames are what the
+	// buffered writer of a stream flushes, which is much smaller.
+	maxFrame = 1 << 20
+	// streamFrames is how many frames a stream may have ready, ahead of
+	// the item being sent.
+	streamFrames = 64
+)
+
+var errStreamClosed = errors.New("stream closed")
+
+// streamItem is an item, as written to a stream.
+type streamItem struct {
+	frames chan []byte // closed once the item is written
+	sent   *sentItem
+	err    error // set before frames is closed, if writing failed
+}
+
+// frameWriter passes what a stream writes on, as frames of the current item.
+type frameWriter struct {
+	frames chan []byte
+	quit   chan struct{}
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	select {
+	case w.frames <- append([]byte(nil), p...):
+		return len(p), nil
+	case <-w.quit:
+		return 0, errStreamClosed
+	}
+}
+
+// sendStreams sends the content of the requested items over the streams.
+func (s *Sender) sendStreams(list []uint32) error {
+	var (
+		n       = s.opts.Streams
+		quit    = make(chan struct{})
+		streams = make([]chan *streamItem, n)
+		stats   = make([]BufferedWriter, n)
+		done    = make(chan struct{}, n)
+	)
+	for i := range streams {
+		streams[i] = make(chan *streamItem, 1)
+		fw := &frameWriter{quit: quit}
+		stats[i] = NewConfigurableWriter(s.opts.Compression == CompressionSnappy, fw)
+		go s.writeStream(list, i, n, stats[i], fw, streams[i], done)
+	}
+	// The streams must be done before the stats can be summed up
+	defer func() {
+		close(quit)
+		for range streams {
+			<-done
+		}
+		for _, w := range stats {
+			raw, compressed := w.(*ConfigurableWriter).Stats()
+			if s.opts.Compression != CompressionSnappy {
+				compressed = raw
+			}
+			s.streamStats[0] += raw
+			s.streamStats[1] += compressed
+		}
+	}()
+	out := bufio.NewWriter(s.raw)
+	for i := range list {
+		id := uint32(i % n)
+		if s.isAborted() {
+			return s.abort(func() error {
+				if err := binary.Write(out, binary.LittleEndian, &frameHeader{Stream: abortStream}); err != nil {
+					return err
+				}
+				return out.Flush()
+			})
+		}
+		item := <-streams[id]
+		for frame := range item.frames {
+			if err := binary.Write(out, binary.LittleEndian, &frameHeader{Stream: id, Len: uint32(len(frame))}); err != nil {
+				return err
+			}
+			if _, err := out.Write(frame); err != nil {
+				return err
+			}
+		}
+		if item.err != nil {
+			return item.err
+		}
+		if err := s.itemSent(item.sent); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(out, binary.LittleEndian, &frameHeader{}); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// writeStream writes the items of stream id, every n:th of the list, each
+// into the frames of its own streamItem. It stops when quit is closed.
+func (s *Sender) writeStream(list []uint32, id, n int, w BufferedWriter, fw *frameWriter, items chan *streamItem, done chan struct{}) {
+	defer func() { done <- struct{}{} }()
+	for i := id; i < len(list); i += n {
+		item := &streamItem{frames: make(chan []byte, streamFrames)}
+		select {
+		case items <- item:
+		case <-fw.quit:
+			return
+		}
+		fw.frames = item.frames
+		item.sent, item.err = s.writeItem(w, list[i])
+		if item.err == nil {
+			// The item must be in frames, before the next one is
+			item.err = w.Flush()
+		}
+		close(item.frames)
+		if item.err != nil {
+			return
+		}
+	}
+}
+
+// inStreams are the streams of the data phase, on the receiving side.
+type inStreams struct {
+	streams []io.Reader      // what the streams carry, decompressed
+	pipes   []*io.PipeWriter // where the frames of each stream go
+	readers []*io.PipeReader // all pipes, to stop them
+	done    chan error       // the result of demux
+}
+
+// newInStreams starts reading n streams from in.
+func newInStreams(in io.Reader, n int, useSnappy bool) *inStreams {
+	st := &inStreams{done: make(chan error, 1)}
+	for i := 0; i < n; i++ {
+		pr, pw := io.Pipe()
+		st.pipes, st.readers = append(st.pipes, pw), append(st.readers, pr)
+		if useSnappy {
+			// Decompress ahead of the receiver, which reads from another
+			// stream meanwhile
+			dr, dw := io.Pipe()
+			st.readers = append(st.readers, dr)
+			go func() {
+				_, err := io.Copy(dw, snappy.NewReader(pr))
+				if err == nil {
+					err = io.ErrUnexpectedEOF
+				}
+				dw.CloseWithError(err)
+			}()
+			st.streams = append(st.streams, dr)
+		} else {
+			st.streams = append(st.streams, pr)
+		}
+	}
+	go func() { st.done <- st.demux(in) }()
+	return st
+}
+
+// demux passes the frames on to their streams, until the end of the streams.
+func (st *inStreams) demux(in io.Reader) error {
+	buf := make([]byte, maxFrame)
+	for {
+		var hdr frameHeader
+		if err := binary.Read(in, binary.LittleEndian, &hdr); err != nil {
+			st.closeWithError(err)
+			return err
+		}
+		if hdr.Len == 0 && hdr.Stream == abortStream {
+			st.closeWithError(ErrSenderAborted)
+			return ErrSenderAborted
+		}
+		if hdr.Len == 0 {
+			st.closeWithError(io.ErrUnexpectedEOF)
+			return nil
+		}
+		if hdr.Stream >= uint32(len(st.pipes)) || hdr.Len > maxFrame {
+			err := fmt.Errorf("invalid frame, stream %d, length %d", hdr.Stream, hdr.Len)
+			st.closeWithError(err)
+			return err
+		}
+		if _, err := io.ReadFull(in, buf[:hdr.Len]); err != nil {
+			st.closeWithError(err)
+			return err
+		}
+		if _, err := st.pipes[hdr.Stream].Write(buf[:hdr.Len]); err != nil {
+			return err
+		}
+	}
+}
+
+// closeWithError makes reading any of the streams fail with err, once what
+// has been passed on is read.
+func (st *inStreams) closeWithError(err error) {
+	for _, pw := range st.pipes {
+		pw.CloseWithError(err)
+	}
+}
+
+// stop makes passing anything more on to the streams fail, so that demux
+// doesn't block forever if the receiver stops reading them.
+func (st *inStreams) stop() {
+	for _, pr := range st.readers {
+		pr.CloseWithError(errStreamClosed)
+	}
+}
+
+// close stops the streams, once the receiver has read what it requested, and
+// returns an error unless the sender has ended them.
+func (st *inStreams) close() error {
+	// A sender which sends more than was requested fails here
+	st.stop()
+	if err := <-st.done; err != nil {
+		return fmt.Errorf("streams failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package packer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Subtree holds options for a directory within the synced directory, which
+// apply to everything in it, in addition to the options of the sync. Where
+// subtrees are nested, the options of all of them apply.
+type Subtree struct {
+	// Path of the directory, relative to the synced directory, e.g.
+	// "Photos".
+	Path string
+	// Excludes are left out, like Options.Excludes, but matched against the
+	// names of the items in the subtree, and their paths within it.
+	Excludes []string
+	// NoCrc makes the receiver compare the files in the subtree by their
+	// metadata only, even if the sync uses crcs (see Options.CrcUsage).
+	NoCrc bool
+	// NoDelete makes the receiver keep the items in the subtree (and the
+	// directory itself) which the sender doesn't have.
+	NoDelete bool
+}
+
+// With subtree options which the receiver needs to know about (NoCrc or
+// NoDelete), the sender sets FlagSubtrees, and sends the number of such
+// subtrees before the metadata, and a subtreeHeader for each. The paths are
+// those the subtrees are sent as, e.g. "home/Photos".
+// OBS: This is not part of the qvm-copy protocol.
+
+// subtreeHeader precedes the path of a subtree.
+type subtreeHeader struct {
+	Flags   uint32 // see subtreeNoCrc
+	NameLen uint32 // including the terminating zero, like fileHeaderData
+}
+
+const (
+	subtreeNoCrc = 1 << iota
+	subtreeNoDelete
+)
+
+// maxSubtrees is the most subtrees a receiver accepts.
+const maxSubtrees = 1024
+
+// flags returns the options of the subtree which the receiver applies.
+func (st *Subtree) flags() uint32 {
+	var flags uint32
+	if st.NoCrc {
+		flags |= subtreeNoCrc
+	}
+	if st.NoDelete {
+		flags |= subtreeNoDelete
+	}
+	return flags
+}
+
+// contains returns whether the item at path, relative to the same directory
+// as the subtree, is within the subtree.
+func (st *Subtree) contains(path string) bool {
+	return path == st.Path || strings.HasPrefix(path, st.Path+"/")
+}
+
+// subtreeFlags returns the flags of the subtrees which contain path.
+func subtreeFlags(subtrees []*Subtree, path string) uint32 {
+	var flags uint32
+	for _, st := range subtrees {
+		if st.contains(path) {
+			flags |= st.flags()
+		}
+	}
+	return flags
+}
+
+// checkSubtrees checks that the paths of the subtrees are valid, and returns
+// whether the receiver needs to know about any of them.
+func checkSubtrees(subtrees []*Subtree) (bool, error) {
+	needed := false
+	for _, st := range subtrees {
+		if err := checkSubtreePath(st.Path); err != nil {
+			return false, err
+		}
+		if err := checkPatterns(st.Excludes); err != nil {
+			return false, fmt.Errorf("subtree %v: %v", st.Path, err)
+		}
+		if st.flags() != 0 {
+			needed = true
+		}
+	}
+	return needed, nil
+}
+
+func checkSubtreePath(path string) error {
+	if path == "" || path == "." || filepath.IsAbs(path) || filepath.Clean(path) != path ||
+		path == ".." || strings.HasPrefix(path, "../") {
+		return fmt.Errorf("invalid subtree path %q", path)
+	}
+	return nil
+}
+
+// subtreeFlags returns the flags of the subtrees which the item at path
+// (below the root) is in.
+func (s *Sender) subtreeFlags(path string) uint32 {
+	i := strings.IndexByte(path, '/')
+	if len(s.opts.Subtrees) == 0 || i < 0 {
+		return 0
+	}
+	return subtreeFlags(s.opts.Subtrees, path[i+1:])
+}
+
+// useCrc returns whether the item at path (below the root) is compared by
+// crc.
+func (s *Sender) useCrc(path string) bool {
+	return s.opts.CrcUsage != FileCrcOff && s.subtreeFlags(path)&subtreeNoCrc == 0
+}
+
+// sendSubtrees sends the subtrees which the receiver needs to know about,
+// for the synced directory sent as name.
+func (s *Sender) sendSubtrees(name string) error {
+	var subtrees []*Subtree
+	for _, st := range s.opts.Subtrees {
+		if st.flags() != 0 {
+			subtrees = append(subtrees, st)
+		}
+	}
+	if err := binary.Write(s.out, binary.LittleEndian, uint32(len(subtrees))); err != nil {
+		return err
+	}
+	for _, st := range subtrees {
+		path := filepath.Join(name, st.Path)
+		hdr := &subtreeHeader{Flags: st.flags(), NameLen: uint32(len(path) + 1)}
+		if err := binary.Write(s.out, binary.LittleEndian, hdr); err != nil {
+			return err
+		}
+		if err := WritePath(s.out, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receiveSubtrees reads the subtrees the sender sends.
+func (r *Receiver) receiveSubtrees() error {
+	var count uint32
+	if err := binary.Read(r.in, binary.LittleEndian, &count); err != nil {
+		return err
+	}
+	if count > maxSubtrees {
+		return fmt.Errorf("too many subtrees (%d)", count)
+	}
+	for i := uint32(0); i < count; i++ {
+		var hdr subtreeHeader
+		if err := binary.Read(r.in, binary.LittleEndian, &hdr); err != nil {
+			return err
+		}
+		path, err := ReadPath(r.in, hdr.NameLen)
+		if err != nil {
+			return err
+		}
+		if err := checkSubtreePath(path); err != nil {
+			return err
+		}
+		if hdr.Flags&^(subtreeNoCrc|subtreeNoDelete) != 0 {
+			return fmt.Errorf("unsupported subtree flags: %#x", hdr.Flags)
+		}
+		r.subtrees = append(r.subtrees, &Subtree{
+			Path:     path,
+			NoCrc:    hdr.Flags&subtreeNoCrc != 0,
+			NoDelete: hdr.Flags&subtreeNoDelete != 0,
+		})
+		if r.opts.Verbosity >= 3 {
+			log.Printf("Subtree %v, flags %#x", path, hdr.Flags)
+		}
+	}
+	return nil
+}
+
+// useCrc returns whether the item at path from the sender is compared by crc.
+func (r *Receiver) useCrc(path string) bool {
+	return r.opts.CrcUsage != FileCrcOff && subtreeFlags(r.subtrees, path)&subtreeNoCrc == 0
+}
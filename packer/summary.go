@@ -0,0 +1,304 @@
+package packer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// With a summary (see Options.Summary), the receiver describes its copy of
+// the synced directory before the sender sends the metadata:
+//
+//  1. The sender sends the version header (FlagSummary), and the header of
+//     the synced directory, the first item of the metadata.
+//  2. The receiver replies with the number of entries, and the header of
+//     each item within its copy of the directory, with the crc in place of
+//     atimensec like the sender does. If it can't use a summary, it sends
+//     summaryDeclined instead, and the sync continues as usual.
+//  3. The sender sends the rest of the metadata, leaving out the items which
+//     are the same in the summary, and directories without any changes in
+//     them. After the end of the metadata, it sends the number of items to
+//     delete, and their indexes in the summary.
+//
+// With FlagQuickCheck, the summary has no crcs of files (atimensec is zero),
+// and the sender takes files with the same size and modification time to be
+// unchanged, without hashing them. Files which differ are sent with their
+// crc as usual, and the receiver compares it in phase 1, as always.
+//
+// The rest of the sync is as usual. Since the deletions refer to the
+// summary, the sender can't make the receiver delete anything but what the
+// receiver listed.
+// OBS: This is not part of the qvm-copy protocol.
+
+// summaryDeclined is sent in place of the number of entries, when the
+// receiver declines to send a summary.
+const summaryDeclined = 0xFFFFFFFF
+
+// summaryWalk is the state of the sender, walking the directory against the
+// summary.
+type summaryWalk struct {
+	entries []*fileHeader          // the summary, in the order received
+	index   map[string]*fileHeader // the summary, by path
+	seen    map[string]struct{}    // items walked, whether sent or not
+	dirs    []*pendingDir          // the directories being walked
+}
+
+// pendingDir is a directory being walked, which is only sent once something
+// in it is.
+type pendingDir struct {
+	path, name string
+	info       os.FileInfo // as walked
+	sent       bool
+}
+
+// readSummary reads the summary, or returns nil if the receiver declined.
+func readSummary(in io.Reader) (*summaryWalk, error) {
+	var count uint32
+	if err := binary.Read(in, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	if count == summaryDeclined {
+		return nil, nil
+	}
+	w := &summaryWalk{
+		index: make(map[string]*fileHeader),
+		seen:  make(map[string]struct{}),
+	}
+	// The entries are not allocated in advance, a bogus count runs out of
+	// data instead of memory
+	for i := uint32(0); i < count; i++ {
+		hdr, err := unMarshallBinary(in)
+		if err != nil {
+			return nil, err
+		}
+		w.entries = append(w.entries, hdr)
+		w.index[hdr.path] = hdr
+	}
+	return w, nil
+}
+
+// unchanged returns whether the item is the same in the summary, judged the
+// way the receiver would, given the offset of the clocks.
+func (w *summaryWalk) unchanged(hdr *fileHeader, useCrc bool, offset time.Duration) bool {
+	e, ok := w.index[hdr.path]
+	if !ok || len(e.diff(hdr, offset)) > 0 {
+		return false
+	}
+	return hdr.isDir() || !useCrc || e.Data.AtimeNsec == hdr.Data.AtimeNsec
+}
+
+// summarySync sends the synced directory at path, asks for the summary, and
+// sends the rest of the metadata against it.
+func (s *Sender) summarySync(path string, stat os.FileInfo) error {
+	if err := s.sendItemMetadata(path, path, stat); err != nil {
+		return err
+	}
+	if err := s.out.Flush(); err != nil {
+		return err
+	}
+	if err := s.readClockOffset(); err != nil {
+		return fmt.Errorf("failed reading the clock offset: %v", err)
+	}
+	w, err := readSummary(s.in)
+	if err != nil {
+		return fmt.Errorf("failed reading summary (does the receiver support it?): %v", err)
+	}
+	if w == nil {
+		if s.opts.Verbosity >= 3 {
+			log.Print("Receiver declined to send a summary")
+		}
+		if err := s.walkDir(path, path, s.osWalk); err != nil {
+			return err
+		}
+	} else {
+		if s.opts.Verbosity >= 3 {
+			log.Printf("Got summary of %d items", len(w.entries))
+		}
+		s.walk = w
+		w.seen[path] = struct{}{}
+		w.dirs = []*pendingDir{{path: path, name: path, sent: true}}
+		if err := s.walkDir(path, path, s.summaryWalk); err != nil {
+			return err
+		}
+	}
+	return s.sendItemMetadata(path, path, stat)
+}
+
+// summaryWalk is osWalk, against the summary: only the items which differ
+// from it are sent, along with the directories leading to them.
+func (s *Sender) summaryWalk(path, name string, stat os.FileInfo) error {
+	if s.opts.IgnoreSymlinks && (stat.Mode()&os.ModeSymlink != 0) {
+		return nil
+	}
+	w := s.walk
+	w.seen[name] = struct{}{}
+	quick := s.opts.QuickCheck && stat.Mode().IsRegular()
+	if quick && !racy(stat) && w.unchanged(newFileHeaderFromStat(name, stat), false, s.clockOffset) {
+		// The same size and mtime, see FlagQuickCheck
+		return nil
+	}
+	header, err := s.itemHeader(path, name, stat)
+	if err != nil {
+		return err
+	}
+	// Without a crc in the summary, a file which may have changed is sent
+	changed := quick || !w.unchanged(header, s.useCrc(path), s.clockOffset)
+	if !stat.IsDir() {
+		if !changed {
+			return nil
+		}
+		if err := s.sendPending(); err != nil {
+			return err
+		}
+		return s.sendHeader(path, name, stat, header)
+	}
+	dir := &pendingDir{path: path, name: name, info: stat}
+	w.dirs = append(w.dirs, dir)
+	if changed {
+		if err := s.sendPending(); err != nil {
+			return err
+		}
+	}
+	if err := s.walkDir(path, name, s.summaryWalk); err != nil {
+		return err
+	}
+	w.dirs = w.dirs[:len(w.dirs)-1]
+	if !dir.sent {
+		return nil
+	}
+	// resend directory info, as walked
+	return s.sendItemMetadata(path, name, stat)
+}
+
+// sendPending sends the directories being walked which haven't been sent
+// yet, since something in them is about to be.
+func (s *Sender) sendPending() error {
+	for _, d := range s.walk.dirs {
+		if d.sent {
+			continue
+		}
+		if err := s.sendItemMetadata(d.path, d.name, d.info); err != nil {
+			return err
+		}
+		d.sent = true
+	}
+	return nil
+}
+
+// sendDeletions sends the indexes of the items in the summary which the
+// sender doesn't have. Items within a directory which is deleted are left
+// out.
+func (s *Sender) sendDeletions() error {
+	var deletions []uint32
+	for i, e := range s.walk.entries {
+		if _, ok := s.walk.seen[e.path]; ok {
+			continue
+		}
+		if _, ok := s.walk.seen[filepath.Dir(e.path)]; !ok {
+			continue
+		}
+		deletions = append(deletions, uint32(i))
+	}
+	if s.opts.Verbosity >= 3 {
+		log.Printf("Deleting %d items", len(deletions))
+	}
+	if err := binary.Write(s.out, binary.LittleEndian, uint32(len(deletions))); err != nil {
+		return err
+	}
+	return binary.Write(s.out, binary.LittleEndian, deletions)
+}
+
+// sendSummary sends the summary of the local copy of the synced directory,
+// whose header is hdr, or declines to.
+func (r *Receiver) sendSummary(hdr *fileHeader) error {
+	if err := r.sendClockOffset(); err != nil {
+		return err
+	}
+	// Without a directory of its own to compare (a staged tree starts out
+	// empty), or with paths which are renamed or left out locally, a summary
+	// is of no use. Invalid items fail the sync later on.
+	if r.archive != nil || r.store != nil || r.stage != "" || r.renames() || r.isAborted() ||
+		!hdr.isDir() || hdr.path != filepath.Base(hdr.path) || hdr.path == "." || hdr.path == ".." || hdr.path == StateDir {
+		if err := binary.Write(r.out, binary.LittleEndian, uint32(summaryDeclined)); err != nil {
+			return err
+		}
+		return r.out.Flush()
+	}
+	root := r.local(hdr.path)
+	var entries []*fileHeader
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Items which can't be read are left out, and will be sent
+			if info != nil && info.IsDir() && path != root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entry := newFileHeaderFromStat(filepath.Join(hdr.path, rel), info)
+		if !info.IsDir() && r.useCrc(entry.path) && !(r.quickCheck && info.Mode().IsRegular()) {
+			crc, err := CrcFile(path, info)
+			if err != nil {
+				return nil
+			}
+			entry.Data.AtimeNsec = crc
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("summary failed: %v", err)
+	}
+	if r.opts.Verbosity >= 3 {
+		log.Printf("Sending summary of %d items", len(entries))
+	}
+	if err := binary.Write(r.out, binary.LittleEndian, uint32(len(entries))); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := e.marshallBinary(r.out); err != nil {
+			return err
+		}
+	}
+	r.summary, r.summarized = entries, true
+	return r.out.Flush()
+}
+
+// receiveDeletions reads the items of the summary to delete, which replace
+// what the receiver would otherwise delete: the sender didn't send the
+// items which are unchanged.
+func (r *Receiver) receiveDeletions(in io.Reader) error {
+	var count uint32
+	if err := binary.Read(in, binary.LittleEndian, &count); err != nil {
+		return err
+	}
+	if count > uint32(len(r.summary)) {
+		return fmt.Errorf("%d deletions, only %d items in the summary", count, len(r.summary))
+	}
+	deletions := make([]uint32, count)
+	if err := binary.Read(in, binary.LittleEndian, deletions); err != nil {
+		return err
+	}
+	r.toDelete = make(map[string]struct{})
+	for _, i := range deletions {
+		if i >= uint32(len(r.summary)) {
+			return fmt.Errorf("deletion %d not in the summary", i)
+		}
+		path, err := filepath.Abs(r.local(r.summary[i].path))
+		if err != nil {
+			return err
+		}
+		r.toDelete[path] = struct{}{}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package packer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// A transactional sync (see ReceiverOptions.Transactional) is received into a
+// staged tree within the state directory, instead of into the synced directory.
+// Files which are unchanged are hardlinked from the live tree, like from
+// ReceiverOptions.LinkDest, and everything else is received as usual. Once the
+// content is in, and the tree is verified when the sender asks for it, the
+// staged tree is swapped with the live one, and the live one is removed.
+//
+// Until then, the live tree isn't touched at all: a sync which fails, or is
+// interrupted, only leaves the staged tree behind, which is removed right
+// away, or at the start of the next transactional sync.
+
+// stageDir is the directory (relative to StateDir) of the staged tree, under
+// "tree", and of the live one while it's replaced, under "old".
+const stageDir = "stage"
+
+// stageTree starts a transactional sync: the receiver writes into the staged
+// tree from here on, see local.
+func (r *Receiver) stageTree() error {
+	if err := os.MkdirAll(filepath.Join(r.root, StateDir), 0700); err != nil {
+		return err
+	}
+	dir := filepath.Join(r.root, StateDir, stageDir)
+	// Left behind by a sync which was interrupted
+	if err := r.removeTree(dir); err != nil {
+		return err
+	}
+	if err := r.fs.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	if err := r.fs.Mkdir(filepath.Join(dir, "tree"), 0700); err != nil {
+		return err
+	}
+	r.stage = filepath.Join(StateDir, stageDir, "tree")
+	return nil
+}
+
+// dropStagedTree removes the staged tree, which is either committed by now, in
+// which case it holds the tree it replaced, or discarded.
+func (r *Receiver) dropStagedTree() {
+	if err := r.removeTree(filepath.Join(r.root, StateDir, stageDir)); err != nil && r.opts.Verbosity > 0 {
+		log.Printf("Failed removing the staged tree: %v", err)
+	}
+	r.stage = ""
+}
+
+// commitTree puts the staged tree in place of the live one.
+func (r *Receiver) commitTree() error {
+	if r.dir == "" {
+		return nil
+	}
+	staged, live := r.local(r.dir), filepath.Join(r.root, r.localPath(r.dir))
+	if _, err := r.fs.Lstat(live); os.IsNotExist(err) {
+		return r.fs.Rename(staged, live, false)
+	} else if err != nil {
+		return err
+	}
+	err := r.fs.Rename(staged, live, true)
+	if lerr, ok := err.(*os.LinkError); ok && (lerr.Err == syscall.EINVAL || lerr.Err == syscall.ENOSYS) {
+		// The live tree is moved away first, and back if the staged one
+		// can't take its place
+		old := filepath.Join(r.root, StateDir, stageDir, "old")
+		if err := r.fs.Rename(live, old, false); err != nil {
+			return err
+		}
+		if err = r.fs.Rename(staged, live, false); err != nil {
+			r.fs.Rename(old, live, false)
+		}
+	}
+	if err == nil && r.opts.Verbosity >= 3 {
+		log.Printf("Committed %v", r.dir)
+	}
+	return err
+}
+
+// checkLive checks that the live copy of the synced directory at path doesn't
+// look like the root of a system, see snapshotFiles, as the staged tree takes
+// its place.
+func (r *Receiver) checkLive(path string) error {
+	live := filepath.Join(r.root, r.localPath(path))
+	for _, name := range rootNames {
+		if _, err := r.fs.Lstat(filepath.Join(live, name)); err == nil {
+			return fmt.Errorf("file %v in receiver root, bailing out", name)
+		}
+	}
+	return nil
+}
+
+// keepLive links the live copy of an item into the staged tree, for it to be
+// left as it is, e.g. when it's gone on the sender.
+func (r *Receiver) keepLive(hdr *fileHeader) error {
+	err := r.fs.Link(filepath.Join(r.root, r.localPath(hdr.path)), r.local(hdr.path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// removeTree removes the tree at path. Its directories are made writable
+// first, since they have the permissions they were received with.
+func (r *Receiver) removeTree(path string) error {
+	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			r.fs.Chmod(path, 0700)
+		}
+		return nil
+	})
+	return r.fs.RemoveAll(path)
+}
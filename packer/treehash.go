@@ -0,0 +1,198 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// With FlagVerifyTree, once the receiver has sent the final result, the sender
+// sends the tree hash of the directory synced, as it would send it now, and
+// the receiver that of its copy, after which it sends another result: CodeOK
+// if they're the same, or CodeChecksumMismatch.
+//
+// The tree hash is a sha256 over the items, each hashed on its own:
+//   - a file: its permissions, size, modification time, and the sha256 of
+//     its content,
+//   - a symlink: its target,
+//   - a directory: its permissions, and the name and hash of each item in it,
+//     sorted by name.
+//
+// Other items, and the times of directories and symlinks, are left out, as
+// they aren't synced. Anything the receiver has which the sender didn't send,
+// such as items kept by a receiver's Filter, or gone ones (see FlagGone), make
+// the hashes differ.
+// OBS: This is not part of the qvm-copy protocol.
+
+// treeEntry is an item hashed by hashTree.
+type treeEntry struct {
+	path string // where it's read from
+	name string // as synced, the last element of which it's sorted by
+	info os.FileInfo
+}
+
+// hashTree returns the tree hash of the item e, with the items in directories
+// listed by list.
+func hashTree(src source, e treeEntry, list func(dir treeEntry) ([]treeEntry, error)) ([]byte, error) {
+	h := sha256.New()
+	mode := e.info.Mode()
+	switch {
+	case mode.IsDir():
+		entries, err := list(e)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return filepath.Base(entries[i].name) < filepath.Base(entries[j].name)
+		})
+		h.Write([]byte{'d'})
+		binary.Write(h, binary.LittleEndian, uint32(mode.Perm()))
+		for _, child := range entries {
+			if !syncedType(child.info.Mode()) {
+				continue
+			}
+			sum, err := hashTree(src, child, list)
+			if err != nil {
+				return nil, err
+			}
+			name := filepath.Base(child.name)
+			binary.Write(h, binary.LittleEndian, uint32(len(name)))
+			h.Write([]byte(name))
+			h.Write(sum)
+		}
+	case mode&os.ModeSymlink != 0:
+		target, err := src.Readlink(e.path)
+		if err != nil {
+			return nil, err
+		}
+		h.Write([]byte{'l'})
+		h.Write([]byte(target))
+	default:
+		stat := e.info.Sys().(*syscall.Stat_t)
+		h.Write([]byte{'f'})
+		binary.Write(h, binary.LittleEndian, uint32(mode.Perm()))
+		binary.Write(h, binary.LittleEndian, uint64(stat.Size))
+		binary.Write(h, binary.LittleEndian, [2]uint32{uint32(stat.Mtim.Sec), uint32(stat.Mtim.Nsec)})
+		if err := hashContent(h, src, e.path); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// syncedType returns whether items with the given mode are synced: files,
+// symlinks, and directories.
+func syncedType(mode os.FileMode) bool {
+	return mode.IsRegular() || mode.IsDir() || mode&os.ModeSymlink != 0
+}
+
+// hashContent writes the sha256 of the content of the file at path to h.
+func hashContent(h hash.Hash, src source, path string) error {
+	f, err := src.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	content := sha256.New()
+	if _, err := io.Copy(content, f); err != nil {
+		return err
+	}
+	h.Write(content.Sum(nil))
+	return nil
+}
+
+// treeHash returns the tree hash of the directory synced, as it would be sent
+// now: without what's excluded, or left out by the filter, and with the names
+// it gives.
+func (s *Sender) treeHash() ([]byte, error) {
+	info, err := s.src.Lstat(filepath.Join(s.root, s.dir))
+	if err != nil {
+		return nil, err
+	}
+	list := func(dir treeEntry) ([]treeEntry, error) {
+		path, err := filepath.Rel(s.root, dir.path)
+		if err != nil {
+			return nil, err
+		}
+		infos, err := s.src.ReadDir(dir.path)
+		if err != nil {
+			return nil, err
+		}
+		var entries []treeEntry
+		for _, info := range infos {
+			fName := filepath.Join(path, info.Name())
+			if s.excluded(fName) || (s.opts.IgnoreSymlinks && info.Mode()&os.ModeSymlink != 0) {
+				continue
+			}
+			child, ok, err := applyFilter(s.opts.Filter, filepath.Join(dir.name, info.Name()), info.Mode())
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				entries = append(entries, treeEntry{filepath.Join(s.root, fName), child, info})
+			}
+		}
+		return entries, nil
+	}
+	return hashTree(s.src, treeEntry{filepath.Join(s.root, s.dir), s.dir, info}, list)
+}
+
+// sendTreeHash sends the tree hash, and waits for the receiver to compare it
+// with that of its copy.
+func (s *Sender) sendTreeHash(sum []byte) error {
+	if _, err := s.out.Write(sum); err != nil {
+		return err
+	}
+	if err := s.out.Flush(); err != nil {
+		return err
+	}
+	return s.waitForResult()
+}
+
+// verifyTree compares the tree hash of the directory synced with that of the
+// sender, and sends the result.
+func (r *Receiver) verifyTree() error {
+	r.deadline.startPhase("verification")
+	src := r.source()
+	list := func(dir treeEntry) ([]treeEntry, error) {
+		infos, err := src.ReadDir(dir.path)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]treeEntry, len(infos))
+		for i, info := range infos {
+			entries[i] = treeEntry{filepath.Join(dir.path, info.Name()), info.Name(), info}
+		}
+		return entries, nil
+	}
+	var sum []byte
+	info, err := os.Lstat(r.local(r.dir))
+	if err == nil {
+		sum, err = hashTree(src, treeEntry{r.local(r.dir), r.dir, info}, list)
+	}
+	if err != nil {
+		return r.fail(fmt.Errorf("hashing the tree failed: %w", localIOError(r.dir, err)), r.dir)
+	}
+	theirs := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r.in, theirs); err != nil {
+		return fmt.Errorf("failed reading tree hash: %v", err)
+	}
+	if !bytes.Equal(sum, theirs) {
+		return r.fail(fmt.Errorf("%w: tree hash %x, the sender's %x", ErrChecksumMismatch, sum, theirs), r.dir)
+	}
+	if r.opts.Verbosity >= 3 {
+		log.Printf("Tree verified, hash %x", sum)
+	}
+	if err := r.sendStatusAndCrc(CodeOK, r.dir); err != nil {
+		return err
+	}
+	return r.out.Flush()
+}
@@ -0,0 +1,126 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// idlePoll is how often TrickleWriter asks how long the user has been idle.
+const idlePoll = 2 * time.Second
+
+// TrickleWriter writes to out at a limited rate, and holds the writes back
+// while the user is active, so that a large sync can run in the background
+// without getting in the way. Since the sender blocks meanwhile, so does the
+// receiver: a receiver which drops silent connections (see qsync-listen
+// -idle-timeout) must allow for the pauses.
+type TrickleWriter struct {
+	out  io.Writer
+	rate uint64 // bytes per second, 0 for no limit
+
+	// Idle, if non-zero, is how long the user must have been idle before
+	// anything is written, as told by IdleTime (see IdleCommand). If
+	// IdleTime fails, the user is taken to be idle, rather than pausing
+	// forever.
+	Idle     time.Duration
+	IdleTime func() (time.Duration, error)
+	// Paused, if set, is called when the writes are paused, and resumed.
+	Paused func(paused bool)
+
+	start   time.Time // when the current rate window started
+	written uint64    // bytes written in the window
+	checked time.Time // when IdleTime was last called
+}
+
+// NewTrickleWriter returns a writer to out, which writes at most rate bytes
+// per second (0 for no limit).
+func NewTrickleWriter(out io.Writer, rate uint64) *TrickleWriter {
+	return &TrickleWriter{out: out, rate: rate}
+}
+
+func (t *TrickleWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		t.waitForIdle()
+		chunk := len(p)
+		if t.rate > 0 {
+			// A tenth of a second at a time, so that the rate is even
+			if max := int(t.rate/10) + 1; chunk > max {
+				chunk = max
+			}
+			t.wait(uint64(chunk))
+		}
+		w, err := t.out.Write(p[:chunk])
+		n += w
+		if err != nil {
+			return n, err
+		}
+		p = p[chunk:]
+	}
+	return n, nil
+}
+
+// wait sleeps until size more bytes can be written within the rate.
+func (t *TrickleWriter) wait(size uint64) {
+	now := time.Now()
+	// After a while without writes (e.g. while the sender computes crcs),
+	// the time is not made up for with a burst
+	if behind := now.Sub(t.start) - t.duration(t.written); t.start.IsZero() || behind > time.Second {
+		t.start, t.written = now, 0
+	}
+	t.written += size
+	if d := t.duration(t.written) - now.Sub(t.start); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// duration returns how long it takes to write size bytes at the rate.
+func (t *TrickleWriter) duration(size uint64) time.Duration {
+	return time.Duration(float64(size) / float64(t.rate) * float64(time.Second))
+}
+
+// waitForIdle blocks while the user has been idle less than t.Idle.
+func (t *TrickleWriter) waitForIdle() {
+	if t.Idle == 0 || t.IdleTime == nil || time.Since(t.checked) < idlePoll {
+		return
+	}
+	paused := false
+	for {
+		t.checked = time.Now()
+		idle, err := t.IdleTime()
+		if err != nil || idle >= t.Idle {
+			break
+		}
+		if !paused && t.Paused != nil {
+			t.Paused(true)
+		}
+		paused = true
+		time.Sleep(idlePoll)
+	}
+	if paused {
+		// The pause isn't made up for either
+		t.start = time.Time{}
+		if t.Paused != nil {
+			t.Paused(false)
+		}
+	}
+}
+
+// IdleCommand returns a function which runs the command, which is to print
+// how long the user has been idle in milliseconds, like xprintidle does.
+func IdleCommand(command ...string) func() (time.Duration, error) {
+	return func() (time.Duration, error) {
+		out, err := exec.Command(command[0], command[1:]...).Output()
+		if err != nil {
+			return 0, fmt.Errorf("%v failed: %v", command[0], err)
+		}
+		ms, err := strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid idle time from %v: %q", command[0], out)
+		}
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+}
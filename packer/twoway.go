@@ -0,0 +1,786 @@
+package packer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A two-way sync is initiated by one side, which requests a directory on the
+// other side (see RequestPull). After that:
+//
+//  1. The responder sends its manifest: the metadata of everything in the
+//     directory, with crc.
+//  2. The initiator compares both manifests against the manifest stored after
+//     the last two-way sync with the same peer (the common ancestor), decides
+//     what goes in which direction, and resolves conflicts. It then sends the
+//     list of operations for the responder, followed by the items it pushes.
+//  3. The responder applies the operations, sends a result, followed by the
+//     items pulled by the initiator.
+//  4. The initiator stores the new ancestor.
+//
+// OBS: This is not part of the qvm-copy protocol.
+
+// ConflictPolicy decides what happens with an item which was changed on both
+// sides since the last two-way sync.
+type ConflictPolicy int
+
+const (
+	ConflictNewest      ConflictPolicy = iota // the most recently modified version wins
+	ConflictRename                            // both are kept, the remote one renamed
+	ConflictInteractive                       // TwoWayOptions.Resolve decides
+)
+
+// Resolution is the outcome of a conflict.
+type Resolution int
+
+const (
+	KeepLocal Resolution = iota
+	KeepRemote
+	KeepBoth
+)
+
+// Conflict describes an item changed on both sides. A nil entry means that
+// the item was deleted on that side.
+type Conflict struct {
+	Path   string
+	Local  *ManifestEntry
+	Remote *ManifestEntry
+}
+
+// TwoWayOptions are the options of the initiator of a two-way sync.
+type TwoWayOptions struct {
+	// Peer identifies the other side, the common ancestor is stored per peer
+	// and directory.
+	Peer string
+	// Policy decides conflicts.
+	Policy ConflictPolicy
+	// Resolve is called for each conflict with ConflictInteractive.
+	Resolve func(c *Conflict) (Resolution, error)
+	// Verbosity: 0 = None, 1 = Error, 2 = Warn, 3 = Info, 4 = Debug, 5 = Trace
+	Verbosity int
+}
+
+// ManifestEntry is the state of an item within a synced directory.
+type ManifestEntry struct {
+	Path  string `json:"path"`
+	Mode  uint32 `json:"mode"`
+	Size  uint64 `json:"size"`
+	Mtime int64  `json:"mtime"` // unix nanoseconds
+	Crc   uint32 `json:"crc"`   // of the content, or the target of a symlink
+}
+
+func (e *ManifestEntry) isDir() bool {
+	return os.FileMode(e.Mode).IsDir()
+}
+
+// sameEntry returns whether the items are equal, as far as syncing goes. Nil
+// (not existing) is only the same as nil.
+func sameEntry(a, b *ManifestEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if !sameMode(a.Mode, b.Mode) {
+		return false
+	}
+	return a.isDir() || (a.Size == b.Size && a.Crc == b.Crc)
+}
+
+type manifest map[string]*ManifestEntry
+
+// scanManifest walks the directory, and returns the state of everything in
+// it, except the state directory.
+func scanManifest(root string) (manifest, error) {
+	m := make(manifest)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if rel == StateDir {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() && info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		e := &ManifestEntry{
+			Path:  rel,
+			Mode:  uint32(info.Mode()),
+			Mtime: stat.Mtim.Nano(),
+		}
+		switch {
+		case info.IsDir():
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			e.Size, e.Crc = uint64(len(target)), crc32.ChecksumIEEE([]byte(target))
+		default:
+			if e.Crc, err = CrcFile(path, info); err != nil {
+				return err
+			}
+			e.Size = uint64(info.Size())
+		}
+		m[rel] = e
+		return nil
+	})
+	return m, err
+}
+
+// sortedPaths returns the paths of the manifest, parents before children.
+func (m manifest) sortedPaths() []string {
+	paths := make([]string, 0, len(m))
+	for p := range m {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// writeManifest sends the manifest as a list of file headers, with the crc
+// in place of atime_nsec, terminated by an empty header.
+func writeManifest(out io.Writer, m manifest) error {
+	for _, p := range m.sortedPaths() {
+		e := m[p]
+		hdr := &fileHeader{
+			path: p,
+			Data: fileHeaderData{
+				NameLen:   uint32(len(p) + 1),
+				Mode:      e.Mode,
+				FileLen:   e.Size,
+				Mtime:     uint32(e.Mtime / 1e9),
+				MtimeNsec: uint32(e.Mtime % 1e9),
+				AtimeNsec: e.Crc,
+			},
+		}
+		if err := hdr.marshallBinary(out); err != nil {
+			return err
+		}
+	}
+	_, err := out.Write(make([]byte, 32))
+	return err
+}
+
+func readManifest(in io.Reader) (manifest, error) {
+	m := make(manifest)
+	for {
+		hdr, err := unMarshallBinary(in)
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Data.NameLen == 0 {
+			return m, nil
+		}
+		if err := checkTwoWayPath(hdr.path); err != nil {
+			return nil, err
+		}
+		m[hdr.path] = &ManifestEntry{
+			Path:  hdr.path,
+			Mode:  hdr.Data.Mode,
+			Size:  hdr.Data.FileLen,
+			Mtime: int64(hdr.Data.Mtime)*1e9 + int64(hdr.Data.MtimeNsec),
+			Crc:   hdr.Data.AtimeNsec,
+		}
+	}
+}
+
+// ancestorPath returns where the common ancestor for the peer and directory
+// is stored, within the local root.
+func ancestorPath(root, peer, dir string) string {
+	key := sha256.Sum256([]byte(peer + "\x00" + dir))
+	return filepath.Join(root, StateDir, fmt.Sprintf("ancestor-%x", key[:8]))
+}
+
+func loadAncestor(path string) (manifest, error) {
+	m := make(manifest)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []*ManifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("corrupt ancestor %v: %v", path, err)
+	}
+	for _, e := range entries {
+		m[e.Path] = e
+	}
+	return m, nil
+}
+
+func storeAncestor(path string, m manifest) error {
+	entries := make([]*ManifestEntry, 0, len(m))
+	for _, p := range m.sortedPaths() {
+		entries = append(entries, m[p])
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// The operations the initiator sends to the responder
+const (
+	opEnd    = 0
+	opPush   = 1 // the initiator sends the item
+	opPull   = 2 // the responder sends the item
+	opDelete = 3 // the responder deletes the item
+	opRename = 4 // the responder renames the item, to the second path
+)
+
+type twoWayOp struct {
+	Op   uint32
+	Path string
+	To   string // only for opRename
+}
+
+func (op *twoWayOp) marshallBinary(out io.Writer) error {
+	if err := binary.Write(out, binary.LittleEndian, op.Op); err != nil {
+		return err
+	}
+	if op.Op == opEnd {
+		return nil
+	}
+	paths := []string{op.Path}
+	if op.Op == opRename {
+		paths = append(paths, op.To)
+	}
+	for _, p := range paths {
+		if err := binary.Write(out, binary.LittleEndian, uint32(len(p)+1)); err != nil {
+			return err
+		}
+		if err := WritePath(out, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (op *twoWayOp) unMarshallBinary(in io.Reader) error {
+	if err := binary.Read(in, binary.LittleEndian, &op.Op); err != nil {
+		return err
+	}
+	if op.Op == opEnd {
+		return nil
+	}
+	if op.Op > opRename {
+		return fmt.Errorf("invalid operation %d", op.Op)
+	}
+	read := func() (string, error) {
+		var l uint32
+		if err := binary.Read(in, binary.LittleEndian, &l); err != nil {
+			return "", err
+		}
+		p, err := ReadPath(in, l)
+		if err != nil {
+			return "", err
+		}
+		return p, checkTwoWayPath(p)
+	}
+	var err error
+	if op.Path, err = read(); err != nil || op.Op != opRename {
+		return err
+	}
+	op.To, err = read()
+	return err
+}
+
+// twoWayPlan is what the initiator decided.
+type twoWayPlan struct {
+	remote      []*twoWayOp // for the responder, in order
+	localDelete []string    // deepest first
+}
+
+// conflictName returns the name for the remote version of a conflicting item.
+func conflictName(path, peer string) string {
+	return fmt.Sprintf("%v.conflict-%v", path, peer)
+}
+
+func makePlan(local, remote, ancestor manifest, opts *TwoWayOptions) (*twoWayPlan, error) {
+	all := make(manifest)
+	for _, m := range []manifest{local, remote, ancestor} {
+		for p, e := range m {
+			all[p] = e
+		}
+	}
+	var (
+		plan                     = new(twoWayPlan)
+		pushes, pulls, deletes   []*twoWayOp
+		renames                  []*twoWayOp
+		push, pull, deleteRemote func(p string)
+		deleteLocal, keepBoth    func(p string)
+		keepNewest               func(c *Conflict)
+		resolve                  func(c *Conflict) error
+	)
+	push = func(p string) { pushes = append(pushes, &twoWayOp{Op: opPush, Path: p}) }
+	pull = func(p string) { pulls = append(pulls, &twoWayOp{Op: opPull, Path: p}) }
+	deleteRemote = func(p string) { deletes = append(deletes, &twoWayOp{Op: opDelete, Path: p}) }
+	deleteLocal = func(p string) { plan.localDelete = append(plan.localDelete, p) }
+	keepBoth = func(p string) {
+		to := conflictName(p, opts.Peer)
+		renames = append(renames, &twoWayOp{Op: opRename, Path: p, To: to})
+		push(p)
+		pulls = append(pulls, &twoWayOp{Op: opPull, Path: to})
+	}
+	keepNewest = func(c *Conflict) {
+		// A deletion has no time, so a modification always wins over it
+		if c.Remote == nil || (c.Local != nil && c.Local.Mtime >= c.Remote.Mtime) {
+			push(c.Path)
+		} else {
+			pull(c.Path)
+		}
+	}
+	resolve = func(c *Conflict) error {
+		if opts.Verbosity >= 3 {
+			log.Printf("Conflict: %v", c.Path)
+		}
+		res := KeepBoth
+		switch opts.Policy {
+		case ConflictNewest:
+			keepNewest(c)
+			return nil
+		case ConflictInteractive:
+			if opts.Resolve == nil {
+				return fmt.Errorf("no conflict resolver")
+			}
+			var err error
+			if res, err = opts.Resolve(c); err != nil {
+				return err
+			}
+		}
+		switch {
+		case res == KeepLocal && c.Local == nil:
+			deleteRemote(c.Path)
+		case res == KeepLocal:
+			push(c.Path)
+		case res == KeepRemote && c.Remote == nil:
+			deleteLocal(c.Path)
+		case res == KeepRemote:
+			pull(c.Path)
+		case c.Local == nil || c.Remote == nil || c.Local.isDir() || c.Remote.isDir():
+			// Nothing to keep both of
+			keepNewest(c)
+		default:
+			keepBoth(c.Path)
+		}
+		return nil
+	}
+	for _, p := range all.sortedPaths() {
+		l, r, a := local[p], remote[p], ancestor[p]
+		lChanged, rChanged := !sameEntry(l, a), !sameEntry(r, a)
+		switch {
+		case !lChanged && !rChanged:
+		case lChanged && !rChanged && l == nil:
+			deleteRemote(p)
+		case lChanged && !rChanged:
+			push(p)
+		case rChanged && !lChanged && r == nil:
+			deleteLocal(p)
+		case rChanged && !lChanged:
+			pull(p)
+		case sameEntry(l, r):
+			// Both made the same change
+		default:
+			if err := resolve(&Conflict{Path: p, Local: l, Remote: r}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// Deletions go deepest first, before anything is written
+	sort.Sort(sort.Reverse(sort.StringSlice(plan.localDelete)))
+	sort.Slice(deletes, func(i, j int) bool { return deletes[i].Path > deletes[j].Path })
+	plan.remote = append(plan.remote, deletes...)
+	plan.remote = append(plan.remote, renames...)
+	plan.remote = append(plan.remote, pushes...)
+	plan.remote = append(plan.remote, pulls...)
+	return plan, nil
+}
+
+// checkTwoWayPath verifies a path of an item within the synced directory. It
+// must not lead outside of it, nor into the state directory.
+func checkTwoWayPath(path string) error {
+	if err := checkPullPath(path); err != nil {
+		return err
+	}
+	if path == "." || path == StateDir || strings.HasPrefix(path, StateDir+"/") {
+		return fmt.Errorf("path %v is reserved", path)
+	}
+	return nil
+}
+
+// twoWayJoin joins the root and the relative path, making sure that the
+// path doesn't lead outside of the root. Symlinks on the way are not followed
+// by the rootDir the path is then used with.
+func twoWayJoin(root, path string) (string, error) {
+	if err := checkTwoWayPath(path); err != nil {
+		return "", err
+	}
+	return filepath.Join(root, path), nil
+}
+
+// sendTwoWayItem sends the header and content of the item.
+func sendTwoWayItem(out io.Writer, fs *rootDir, root, path string) error {
+	full, err := twoWayJoin(root, path)
+	if err != nil {
+		return err
+	}
+	info, err := fs.Lstat(full)
+	if err != nil {
+		return fmt.Errorf("file %v no longer available: %v", path, err)
+	}
+	hdr := newFileHeaderFromStat(path, info)
+	if err := hdr.marshallBinary(out); err != nil {
+		return err
+	}
+	switch {
+	case hdr.isSymlink():
+		target, err := fs.Readlink(full)
+		if err != nil {
+			return err
+		}
+		if uint64(len(target)) != hdr.Data.FileLen {
+			return fmt.Errorf("symlink %v changed", path)
+		}
+		_, err = out.Write([]byte(target))
+		return err
+	case hdr.isRegular():
+		f, err := fs.Open(full)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.CopyN(out, f, int64(hdr.Data.FileLen)); err != nil {
+			return fmt.Errorf("file %v changed: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// receiveTwoWayItem receives the header and content of the item, which must
+// be the expected one, and writes it. The perms and times of a directory are
+// not set right away, since it may still receive content (and be read-only),
+// so its header is returned, see fixTwoWayDirs.
+func receiveTwoWayItem(in io.Reader, fs *rootDir, root, expected string) (*fileHeader, error) {
+	hdr, err := unMarshallBinary(in)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.path != expected {
+		return nil, fmt.Errorf("received %q, expected %q", hdr.path, expected)
+	}
+	if !hdr.isDir() && !hdr.isRegular() && !hdr.isSymlink() {
+		return nil, fmt.Errorf("unsupported file type for %v: %v", hdr.path, os.FileMode(hdr.Data.Mode))
+	}
+	full, err := twoWayJoin(root, hdr.path)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return nil, err
+	}
+	// Replace whatever is there, if it's of another kind
+	if info, err := fs.Lstat(full); err == nil && (info.IsDir() != hdr.isDir() || hdr.isSymlink()) {
+		if err := fs.Remove(full); err != nil {
+			return nil, err
+		}
+	}
+	local := &fileHeader{path: full, Data: hdr.Data}
+	switch {
+	case hdr.isDir():
+		if err := fs.MkdirAll(full, 0700); err != nil {
+			return nil, err
+		}
+		return local, nil
+	case hdr.isSymlink():
+		if hdr.Data.FileLen > MaxPathLength {
+			return nil, fmt.Errorf("symlink target too large (%d characters)", hdr.Data.FileLen)
+		}
+		target := make([]byte, hdr.Data.FileLen)
+		if _, err := io.ReadFull(in, target); err != nil {
+			return nil, err
+		}
+		// Symlinks can't have their perms set, see fixTimesAndPerms
+		if err := fs.Symlink(string(target), full); err != nil {
+			return nil, err
+		}
+		return nil, fixTwoWayItem(fs, local)
+	default:
+		f, err := fs.TempFile(filepath.Dir(full), "qvm-*")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(f, in, int64(hdr.Data.FileLen)); err != nil {
+			f.Close()
+			fs.Remove(f.Name())
+			return nil, err
+		}
+		f.Close()
+		if err := fs.Rename(f.Name(), full, false); err != nil {
+			fs.Remove(f.Name())
+			return nil, err
+		}
+	}
+	return nil, fixTwoWayItem(fs, local)
+}
+
+// fixTwoWayItem sets the perms and times of the received item, through fs.
+// Symlinks can't have their perms set, see fixTimesAndPerms.
+func fixTwoWayItem(fs *rootDir, hdr *fileHeader) error {
+	if !hdr.isSymlink() {
+		if err := fs.Chmod(hdr.path, os.FileMode(hdr.Data.Mode&07777)); err != nil {
+			return err
+		}
+	}
+	atime := time.Unix(int64(hdr.Data.Atime), int64(hdr.Data.AtimeNsec))
+	mtime := time.Unix(int64(hdr.Data.Mtime), int64(hdr.Data.MtimeNsec))
+	return fs.Chtimes(hdr.path, atime, mtime)
+}
+
+// fixTwoWayDirs sets the perms and times of the received directories, once
+// everything has been written. Children go before their parents.
+func fixTwoWayDirs(fs *rootDir, dirs []*fileHeader) error {
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].path > dirs[j].path })
+	for _, hdr := range dirs {
+		if err := fixTwoWayItem(fs, hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeTwoWayItem deletes the item. Directories are only removed if empty,
+// since they may have received new content from the other side.
+func removeTwoWayItem(fs *rootDir, root, path string) error {
+	full, err := twoWayJoin(root, path)
+	if err != nil {
+		return err
+	}
+	err = fs.Remove(full)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if pErr, ok := err.(*os.PathError); ok && pErr.Err == syscall.ENOTEMPTY {
+		return nil
+	}
+	return err
+}
+
+// TwoWaySync syncs the local directory root with the directory dir on the
+// other side, in both directions.
+func TwoWaySync(in io.Reader, out io.Writer, root, dir string, opts *TwoWayOptions) error {
+	bout := bufio.NewWriter(out)
+	if err := RequestPull(bout, dir); err != nil {
+		return err
+	}
+	if err := bout.Flush(); err != nil {
+		return err
+	}
+	local, err := scanManifest(root)
+	if err != nil {
+		return fmt.Errorf("scanning %v failed: %v", root, err)
+	}
+	remote, err := readManifest(in)
+	if err != nil {
+		return fmt.Errorf("receiving manifest failed: %v", err)
+	}
+	ancestorFile := ancestorPath(root, opts.Peer, dir)
+	ancestor, err := loadAncestor(ancestorFile)
+	if err != nil {
+		return err
+	}
+	plan, err := makePlan(local, remote, ancestor, opts)
+	if err != nil {
+		return err
+	}
+	fs, err := openRootDir(root)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	for _, p := range plan.localDelete {
+		if opts.Verbosity >= 4 {
+			log.Printf("Deleting %v", p)
+		}
+		if err := removeTwoWayItem(fs, root, p); err != nil {
+			return err
+		}
+	}
+	var pulls []string
+	for _, op := range plan.remote {
+		if err := op.marshallBinary(bout); err != nil {
+			return err
+		}
+		if op.Op == opPull {
+			pulls = append(pulls, op.Path)
+		}
+	}
+	if err := (&twoWayOp{Op: opEnd}).marshallBinary(bout); err != nil {
+		return err
+	}
+	var pushed int
+	for _, op := range plan.remote {
+		if op.Op != opPush {
+			continue
+		}
+		if opts.Verbosity >= 4 {
+			log.Printf("Sending %v", op.Path)
+		}
+		if err := sendTwoWayItem(bout, fs, root, op.Path); err != nil {
+			return err
+		}
+		pushed++
+	}
+	if err := bout.Flush(); err != nil {
+		return err
+	}
+	var res resultHeader
+	if err := res.unMarshallBinary(in); err != nil {
+		return err
+	}
+	if res.ErrorCode != 0 {
+		return &RemoteError{Code: ErrorCode(res.ErrorCode)}
+	}
+	var dirs []*fileHeader
+	for _, p := range pulls {
+		if opts.Verbosity >= 4 {
+			log.Printf("Receiving %v", p)
+		}
+		dir, err := receiveTwoWayItem(in, fs, root, p)
+		if err != nil {
+			return err
+		}
+		if dir != nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	if err := fixTwoWayDirs(fs, dirs); err != nil {
+		return err
+	}
+	if opts.Verbosity >= 3 {
+		log.Printf("Two-way sync done, sent %d, received %d, deleted %d locally",
+			pushed, len(pulls), len(plan.localDelete))
+	}
+	// Both sides should now be the same, as the local side is
+	final, err := scanManifest(root)
+	if err != nil {
+		return err
+	}
+	return storeAncestor(ancestorFile, final)
+}
+
+// ServeTwoWay serves a two-way sync of the directory requested by the other
+// side. The requested directory is resolved by the given function, which is
+// responsible for keeping it within whatever is served.
+func ServeTwoWay(in io.Reader, out io.Writer, resolve func(dir string) (string, error)) error {
+	dir, err := ReadPullRequest(in)
+	if err != nil {
+		return err
+	}
+	root, err := resolve(dir)
+	if err != nil {
+		return err
+	}
+	fs, err := openRootDir(root)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	m, err := scanManifest(root)
+	if err != nil {
+		return err
+	}
+	bout := bufio.NewWriter(out)
+	if err := writeManifest(bout, m); err != nil {
+		return err
+	}
+	if err := bout.Flush(); err != nil {
+		return err
+	}
+	var ops []*twoWayOp
+	for {
+		op := new(twoWayOp)
+		if err := op.unMarshallBinary(in); err != nil {
+			return err
+		}
+		if op.Op == opEnd {
+			break
+		}
+		ops = append(ops, op)
+	}
+	var (
+		applyErr error
+		dirs     []*fileHeader
+	)
+	for _, op := range ops {
+		switch op.Op {
+		case opDelete:
+			applyErr = removeTwoWayItem(fs, root, op.Path)
+		case opRename:
+			var from, to string
+			if from, applyErr = twoWayJoin(root, op.Path); applyErr == nil {
+				if to, applyErr = twoWayJoin(root, op.To); applyErr == nil {
+					applyErr = fs.Rename(from, to, false)
+				}
+			}
+		case opPush:
+			var dir *fileHeader
+			if dir, applyErr = receiveTwoWayItem(in, fs, root, op.Path); dir != nil {
+				dirs = append(dirs, dir)
+			}
+		}
+		if applyErr != nil {
+			break
+		}
+	}
+	if err := fixTwoWayDirs(fs, dirs); err != nil && applyErr == nil {
+		applyErr = err
+	}
+	res := resultHeader{}
+	if applyErr != nil {
+		log.Printf("Two-way sync failed: %v", applyErr)
+		res.ErrorCode = uint32(errorCode(applyErr))
+	}
+	if err := res.marshallBinary(bout); err != nil {
+		return err
+	}
+	if applyErr != nil {
+		bout.Flush()
+		return applyErr
+	}
+	for _, op := range ops {
+		if op.Op != opPull {
+			continue
+		}
+		if err := sendTwoWayItem(bout, fs, root, op.Path); err != nil {
+			return err
+		}
+	}
+	return bout.Flush()
+}
@@ -1,10 +1,13 @@
 package packer
 
 import (
+	"crypto/ed25519"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -13,8 +16,26 @@ const (
 	MaxPathLength = 16384
 )
 
+// VersionPrefix starts the line with which a receiver announces its protocol
+// version (qsync-receive -version), for remote senders.
+const VersionPrefix = "qsync-protocol "
+
 const (
 	Version = 0
+	// VersionExtended is Version, with extensions announced in the version
+	// header which change the course of the sync: a summary (FlagSummary),
+	// several streams (Streams), subtree options (FlagSubtrees), requests
+	// as the receiver goes (FlagOverlap), packed frames (FlagPacked), a
+	// summary without crcs (FlagQuickCheck), crcs on demand (FlagLazyHash),
+	// clones of files sent before (FlagDedup), tiny files inlined in the
+	// metadata (FlagInline), the digests of files after their content
+	// (FlagDigests), files skipped since they're gone (FlagGone), an abort
+	// by the sender (FlagAbort), a verification of the tree after the sync
+	// (FlagVerifyTree), the failures of a lenient sync (FlagLenient), or
+	// the details of the receiver running out of space (FlagDiskFull).
+	// Receivers which don't support it reject the transfer, instead of
+	// misreading it.
+	VersionExtended = 1
 
 	CompressionOff    = 0
 	CompressionSnappy = 1
@@ -29,8 +50,183 @@ type Options struct {
 	CrcUsage       int
 	IgnoreSymlinks bool
 	Compression    int
+	// SigningKey, if set, is used to sign the transfer, see signer.
+	SigningKey ed25519.PrivateKey
+	// Excludes are patterns (see filepath.Match) of items which are not
+	// sent, matched against the name of the item, and its path within the
+	// synced directory. To the receiver, they don't exist.
+	Excludes []string
+	// Progress, if set, is called after the content of each file or symlink
+	// has been sent, with its path and size.
+	Progress func(path string, size uint64)
+	// Filter, if set, decides which items are sent, and as what.
+	Filter Filter
+	// Hooks, if set, are called at points of the sync.
+	Hooks Hooks
+	// Summary makes the sender ask the receiver for a summary of its copy
+	// of the directory first, and only send the metadata of the items
+	// which differ from it. The receiver may decline, e.g. when receiving
+	// into an archive. It can't be used when signing.
+	Summary bool
+	// Streams is the number of streams the content of the files is sent
+	// over, multiplexed over the connection, so that reading and compressing
+	// files can use several cores. 0 or 1 means a single stream, the most
+	// is MaxStreams.
+	Streams int
+	// Subtrees are options for parts of the synced directory, see Subtree.
+	Subtrees []*Subtree
+	// Workers is the number of files the sender reads and hashes at once,
+	// ahead of sending them, when crcs are used. 0 or 1 means one at a
+	// time.
+	Workers int
+	// Overlap makes the receiver request files while it still processes
+	// the metadata, so that the content of the first ones is sent while it
+	// compares the rest. It can't be used with Streams.
+	Overlap bool
+	// Pack makes the sender pack small files and symlinks into frames of
+	// up to a megabyte, which the receiver reads in one go, with a crc for
+	// each item. It can't be used with Streams.
+	Pack bool
+	// Mmap makes the sender map files of a megabyte and more into memory
+	// to hash them, instead of reading them, letting the kernel read
+	// ahead.
+	Mmap bool
+	// IOUring makes the sender read the content of files of a megabyte and
+	// more through an io_uring, several chunks ahead of what is sent. The
+	// kernel may not support it, in which case the files are read as
+	// usual.
+	IOUring bool
+	// DropCache makes the sender drop the files it reads (to hash or send
+	// them) from the page cache, once read, and not update their access
+	// times, where it may, so that a large sync doesn't push out what the
+	// applications of the source use.
+	DropCache bool
+
+	// HashCache, if set, is the path of a file where the sender keeps the
+	// crcs and digests of files between syncs. A file is hashed again only
+	// when its device, inode, size or modification time changes.
+	HashCache string
+
+	// WalkCache, if set, is the path of a file where the sender keeps the
+	// listings of directories between syncs. A directory is listed again,
+	// and its entries statted, only when its device, inode, modification or
+	// change time changes, or its listing is older than FullWalkEvery. Only
+	// the directories in it are statted otherwise. A file modified in place
+	// doesn't change its directory, so that goes unnoticed until then.
+	WalkCache string
+
+	// FullWalkEvery is how long a listing is kept in the WalkCache. 0 means
+	// a day.
+	FullWalkEvery time.Duration
+
+	// QuickCheck makes the sender take files with the same size and
+	// modification time as in the summary to be unchanged, like rsync does
+	// by default, so that neither side hashes them. Files which differ, or
+	// were modified within the last couple of seconds, are hashed as
+	// usual. It requires Summary.
+	QuickCheck bool
+
+	// LazyHash makes the sender leave the crcs out of the metadata, and
+	// compute them only for the files the receiver asks for after it: those
+	// whose size and modification time are the same on both sides, so that
+	// only the content tells whether they changed. New and modified files
+	// are read once, to be sent, rather than hashed up front as well. It
+	// needs crcs, and can't be used with Summary or Overlap.
+	LazyHash bool
+
+	// Dedup makes the sender send the content of files which are the same
+	// (by size and sha256) once per sync, and the receiver clone the file it
+	// received for the others: with a reflink where the filesystem supports
+	// it, and a copy otherwise. Only files of 4K and more, whose size is that
+	// of another file requested, are hashed for it. It can't be used with
+	// Streams or Pack.
+	Dedup bool
+
+	// Inline is the size up to which the content of files is sent along with
+	// their metadata, instead of being requested after it, which saves the
+	// round trip for tiny files. Those which turn out to be unchanged are sent
+	// for nothing, so it's best kept small, e.g. 4096. It's at most
+	// MaxInline, and can't be used with SigningKey. Zero (the default)
+	// inlines nothing.
+	Inline int
+
+	// Digests makes the sender send the sha256 of each file after its
+	// content, computed as the content is read, for the receiver to check
+	// against that of what it wrote, computed as it's written. It catches
+	// corruption which the crc of the metadata can't, at the cost of the
+	// hashing on both sides: files are never sent straight from the kernel
+	// (see Sender.sendFile), since the content must pass through it.
+	Digests bool
+
+	// SkipGone makes the sender skip the files which are gone, or are no
+	// longer a file or symlink, by the time they're hashed or sent, instead
+	// of failing the sync. The receiver leaves its copy as it is. See
+	// Sender.Gone.
+	SkipGone bool
+
+	// Abortable makes Sender.Abort tell the receiver that the sync was
+	// cancelled (see FlagAbort), for it to wind down and answer, rather
+	// than find the connection broken. Needs a receiver which supports it.
+	Abortable bool
+
+	// VerifyTree makes the sender and the receiver compare the tree hashes
+	// of the directory synced and of the copy, after the sync (see
+	// FlagVerifyTree), which fails with ErrChecksumMismatch if they differ.
+	// Every file is read again on both sides. Needs a receiver which
+	// supports it.
+	VerifyTree bool
+
+	// Lenient makes the sync complete even if some files or symlinks fail,
+	// on either side: those which the sender can't read, or the receiver
+	// can't put in place (see FlagLenient). Sync then returns a
+	// *PartialError, on both sides. Without it, the sync is strict: any
+	// failure fails it. Needs a receiver which supports it.
+	Lenient bool
+
+	// DiskFullDetails makes the receiver tell which item didn't fit, and
+	// about how much space it needed, when it runs out of space (see
+	// FlagDiskFull). Sync then returns a *DiskFullError. Needs a receiver
+	// which supports it.
+	DiskFullDetails bool
+
+	// ClockSkew makes the sender send its current time, for the receiver to
+	// measure the offset between their clocks (see FlagClock). Local files
+	// on the receiver whose modification times differ from the sender's by
+	// that offset are then taken to be unchanged, rather than all of them
+	// differing when one of the clocks drifted. Needs a receiver which
+	// supports it.
+	ClockSkew bool
+
+	// Owners makes the sender send the owner (uid and gid) of each item with
+	// its metadata (see FlagOwners), which a privileged receiver which opts
+	// in to them (see ReceiverOptions.Owners) gives the items it receives,
+	// symlinks included. Can't be used when signing,
+	// nor with a batch or an archive. Needs a receiver which supports it.
+	Owners bool
+
+	// Compressors is the number of goroutines which compress the data sent
+	// with snappy, each a block of 64K at a time, so that compression can
+	// use several cores. The stream is the same either way. 0 or 1 means
+	// one. It can't be used with Streams, which compress in parallel
+	// already.
+	Compressors int
+
+	// ReadTimeout is how long the sender waits for the receiver to send
+	// anything, when it expects to read, and PhaseTimeout how long it waits
+	// for the receiver to get through each phase of the sync: the metadata
+	// (phase 1), the file list (phase 2), and the content (phase 3). Sync
+	// then fails with ErrTimeout, rather than hang on a receiver which died
+	// without closing the connection. Zero (the default) means no timeout.
+	// Connections which support read deadlines (e.g. a net.Conn) use them;
+	// otherwise, a goroutine is left blocked on the connection, until the
+	// caller closes it.
+	ReadTimeout  time.Duration
+	PhaseTimeout time.Duration
 }
 
+// MaxStreams is the most streams a sync can use, see Options.Streams.
+const MaxStreams = 64
+
 var DefaultOptions = &Options{
 	Verbosity:      3, // info
 	CrcUsage:       FileCrcAtimeNsecMetadata,
@@ -38,6 +234,132 @@ var DefaultOptions = &Options{
 	IgnoreSymlinks: false,
 }
 
+// ReceiverOptions are the options local to the receiving side. As opposed to
+// Options, these are not dictated by the sender.
+type ReceiverOptions struct {
+	// Root is the directory the synced directory is placed in. Empty means
+	// the current directory, which is what the jailed receiver uses.
+	Root string
+	// SnapshotCommand, if set, is invoked before any modification is made
+	// to the destination. See TakeSnapshot.
+	SnapshotCommand []string
+	// SnapshotID is the id of a snapshot already taken by someone else (e.g.
+	// the preloader, outside of the jail). It is recorded in the journal.
+	SnapshotID string
+	// Profile and Peer name the profile of the sync, and where it comes
+	// from (e.g. the qube), for the journal. See ReadJournal.
+	Profile string
+	Peer    string
+	// AuditLog enables the audit log, which records every action taken on
+	// the destination.
+	AuditLog bool
+	// AuditLogMaxSize is the size at which the audit log is rotated.
+	AuditLogMaxSize int64
+	// MaxDepth is the maximum number of path components allowed in a
+	// received path. 0 means DefaultMaxDepth.
+	MaxDepth int
+	// MaxDirEntries is the maximum number of entries allowed in a single
+	// received directory. 0 means DefaultMaxDirEntries.
+	MaxDirEntries int
+	// MaxRootSize is the maximum total size, in bytes, of all files within
+	// the sync root. 0 means no quota.
+	MaxRootSize uint64
+	// TrustedKey, if set, is the public key which transfers must be signed
+	// with. Unsigned transfers, or transfers signed with another key, are
+	// refused before anything is changed.
+	TrustedKey ed25519.PublicKey
+	// Progress, if set, is called after each file or symlink has been
+	// received, with its path and size.
+	Progress func(path string, size uint64)
+	// Conflict, if set, is called before an existing local file or symlink
+	// is replaced by a different version, or before a local item is deleted
+	// because the sender doesn't have it. If it returns false, the local
+	// item is kept. A file
+	// which is in the way of a directory can't be kept: the sync fails with
+	// ErrConflict instead.
+	Conflict func(path string) bool
+	// LinkDest, if set, is a previous copy of the destination (laid out like
+	// Root). Files which don't exist in Root, but are unchanged in LinkDest,
+	// are hardlinked from there instead of being sent. See NewLinkSnapshot.
+	LinkDest string
+	// Store, if set, receives into the content-addressed store instead of
+	// into Root. Each sync is recorded as a manifest of StoreSource
+	// ("local" if empty).
+	Store       *Store
+	StoreSource string
+	// Archive, if set, receives into an archive written to it, in the
+	// ArchiveFormat (ArchiveTar if empty), instead of into Root. Nothing
+	// else is written locally. If the sync fails, the archive is incomplete.
+	Archive       io.Writer
+	ArchiveFormat string
+	// Filter, if set, decides which of the items sent are received, and
+	// where to. Items left out are neither changed nor deleted locally.
+	Filter Filter
+	// Normalize, if set (NormalizeNFC or NormalizeNFD), is the Unicode
+	// normalization form the names of the items received are put in, e.g.
+	// for a tree shared with macOS later on. Names which aren't valid UTF-8
+	// are left as they are.
+	Normalize string
+	// Duplicates is what's done with an item whose name differs only in
+	// its normalization from one received before in the same directory.
+	// With DuplicatesReport, it's logged, and with Normalize, left out, as
+	// it would take the place of the first. With DuplicatesMerge, a
+	// directory is merged into the first, if that's a directory, and
+	// anything else is left out. Either way, they're counted in the
+	// journal. Empty means DuplicatesReport with Normalize, and that they
+	// aren't looked for otherwise.
+	Duplicates string
+	// Transactional makes the receiver stage the sync in a tree of its own,
+	// which only takes the place of the synced directory once the content
+	// is in, and verified if the sender asks for it. Unchanged files are
+	// hardlinked into it. A sync which fails, or is interrupted, leaves the
+	// synced directory as it was. It can't be used with a filter, a conflict
+	// callback, LinkDest, subtrees or a lenient sync, nor into an archive or
+	// a store. See stageTree.
+	Transactional bool
+	// WriteAhead, if set (WriteAheadRollback or WriteAheadComplete), makes
+	// the receiver record each change it makes in a write-ahead journal,
+	// synced to disk before the change is made, and move what it replaces
+	// or deletes aside until the sync is complete. A sync which fails is
+	// settled with the policy right away, and one which is interrupted by
+	// the next receive into the root: rolled back, or with the changes
+	// which were made kept. It can't be used with Transactional, nor into
+	// an archive or a store. See openWriteAhead.
+	WriteAhead string
+	// Hooks, if set, are called at points of the sync.
+	Hooks Hooks
+	// Owners makes the receiver give the items it receives the owners the
+	// sender sends with Options.Owners. They're only applied if the receiver
+	// has CAP_CHOWN in the initial user namespace, and are dropped
+	// otherwise. See FlagOwners.
+	Owners bool
+	// SetID makes the receiver keep the set-user-ID and set-group-ID bits of
+	// the items it receives, which are cleared otherwise, so that a sender
+	// can't place set-user-ID binaries of whichever owner it chooses.
+	SetID bool
+	// Mmap makes the receiver map local files of a megabyte and more into
+	// memory to hash them, see Options.Mmap.
+	Mmap bool
+	// IOUring makes the receiver write the content of files of a megabyte
+	// and more through an io_uring, see Options.IOUring.
+	IOUring bool
+	// ReadTimeout and PhaseTimeout are those of the receiver, see
+	// Options.ReadTimeout. Its phases are the metadata (phase 0) and the
+	// content (phase 2).
+	ReadTimeout  time.Duration
+	PhaseTimeout time.Duration
+}
+
+const (
+	DefaultMaxDepth      = 256
+	DefaultMaxDirEntries = 1000000
+)
+
+var DefaultReceiverOptions = &ReceiverOptions{
+	MaxDepth:      DefaultMaxDepth,
+	MaxDirEntries: DefaultMaxDirEntries,
+}
+
 // versionHeader is sent as the first thing when a sync is initiated.
 // OBS: This deviates from the qvm-copy protocol, which does not have any
 // such thing.
@@ -56,9 +378,74 @@ type versionHeader struct {
 	FileCrcUsage uint16
 	// Desired verbosity. 0 = None, 1 = Error, 2 = Warn, 3 = Info, 4 = Debug, 5 = Trace
 	Verbosity uint8
-	Reserved  uint64
+	// Flags, see FlagSigned. Older versions left this zero, as part of the
+	// reserved field.
+	Flags uint32
+	// Number of streams in the data phase, see Options.Streams. Older
+	// versions left this zero, as part of the reserved field.
+	Streams uint16
+	// Size up to which files are inlined, with FlagInline, see
+	// Options.Inline. Older versions left this zero, as part of the
+	// reserved field.
+	Inline uint16
 }
 
+const (
+	// FlagSigned means that the metadata is followed by a signature block,
+	// see signer.
+	FlagSigned = 1 << iota
+	// FlagSummary means that the sender waits for a summary from the
+	// receiver, after the first header of the metadata. See Options.Summary.
+	FlagSummary
+	// FlagSubtrees means that the metadata is preceded by the options of
+	// subtrees, which the receiver needs to know about. See Subtree.
+	FlagSubtrees
+	// FlagOverlap means that the receiver sends its requests in chunks, while
+	// it processes the metadata, and the sender sends the content of each
+	// chunk right away. See Options.Overlap.
+	FlagOverlap
+	// FlagPacked means that small files are packed into frames in the data
+	// phase. See Options.Pack.
+	FlagPacked
+	// FlagQuickCheck means that the summary leaves out the crcs of files,
+	// with FlagSummary. See Options.QuickCheck.
+	FlagQuickCheck
+	// FlagLazyHash means that the metadata has no crcs, and the receiver asks
+	// for those it needs after it. See Options.LazyHash.
+	FlagLazyHash
+	// FlagDedup means that a file in the data phase may be sent as a clone
+	// of one sent before. See Options.Dedup.
+	FlagDedup
+	// FlagInline means that the content of files up to the Inline size of
+	// the version header follows their metadata. See Options.Inline.
+	FlagInline
+	// FlagDigests means that the content of each file in the data phase is
+	// followed by its sha256. See Options.Digests.
+	FlagDigests
+	// FlagGone means that a file in the data phase may be sent as gone,
+	// instead of its content. See Options.SkipGone.
+	FlagGone
+	// FlagAbort means that the sender may abort the sync with an abort
+	// frame, in place of a header. See Options.Abortable.
+	FlagAbort
+	// FlagVerifyTree means that the tree hashes of both sides are compared
+	// after the sync. See Options.VerifyTree.
+	FlagVerifyTree
+	// FlagLenient means that files which fail are skipped, and reported
+	// after the sync. See Options.Lenient.
+	FlagLenient
+	// FlagDiskFull means that a result with CodeDiskFull is followed by the
+	// item which didn't fit. See Options.DiskFullDetails.
+	FlagDiskFull
+	// FlagClock means that the version header is followed by the current
+	// time of the sender, and the summary by the offset of the clocks. See
+	// Options.ClockSkew.
+	FlagClock
+	// FlagOwners means that the header of each item in the metadata is
+	// followed by its owner. See Options.Owners.
+	FlagOwners
+)
+
 func newVersionHeader(compression, crcUsage, verbosity int) *versionHeader {
 	return &versionHeader{
 		Ones:         0xFFFFFFFF,
@@ -77,8 +464,10 @@ func (v *versionHeader) marshallBinary(out io.Writer) error {
 }
 
 type fileHeader struct {
-	Data fileHeaderData
-	path string
+	Data   fileHeaderData
+	path   string
+	inline []byte     // the content which came with the metadata, see FlagInline
+	owner  *fileOwner // nil if unknown, or not to be applied, see FlagOwners
 }
 
 // fileHeaderData is 256 bits always
@@ -108,51 +497,143 @@ func newFileHeaderFromStat(path string, info os.FileInfo) *fileHeader {
 		data.FileLen = 0
 	}
 	return &fileHeader{
-		path: path,
-		Data: data,
+		path:  path,
+		Data:  data,
+		owner: &fileOwner{Uid: stat.Uid, Gid: stat.Gid},
 	}
 }
 
+// fileHeaderSize is the size of fileHeaderData, as sent.
+const fileHeaderSize = 32
+
+// put encodes d into b, like binary.Write would, but without reflection.
+func (d *fileHeaderData) put(b []byte) {
+	_ = b[fileHeaderSize-1]
+	binary.LittleEndian.PutUint32(b[0:], d.NameLen)
+	binary.LittleEndian.PutUint32(b[4:], d.Mode)
+	binary.LittleEndian.PutUint64(b[8:], d.FileLen)
+	binary.LittleEndian.PutUint32(b[16:], d.Atime)
+	binary.LittleEndian.PutUint32(b[20:], d.AtimeNsec)
+	binary.LittleEndian.PutUint32(b[24:], d.Mtime)
+	binary.LittleEndian.PutUint32(b[28:], d.MtimeNsec)
+}
+
+// get decodes d from b, the inverse of put.
+func (d *fileHeaderData) get(b []byte) {
+	_ = b[fileHeaderSize-1]
+	d.NameLen = binary.LittleEndian.Uint32(b[0:])
+	d.Mode = binary.LittleEndian.Uint32(b[4:])
+	d.FileLen = binary.LittleEndian.Uint64(b[8:])
+	d.Atime = binary.LittleEndian.Uint32(b[16:])
+	d.AtimeNsec = binary.LittleEndian.Uint32(b[20:])
+	d.Mtime = binary.LittleEndian.Uint32(b[24:])
+	d.MtimeNsec = binary.LittleEndian.Uint32(b[28:])
+}
+
+// marshallBinary sends the header and the path in one write, from a pooled
+// buffer.
 func (hdr *fileHeader) marshallBinary(out io.Writer) error {
-	if err := binary.Write(out, binary.LittleEndian, hdr.Data); err != nil {
-		return err
+	n := fileHeaderSize
+	if len(hdr.path) != 0 {
+		n += len(hdr.path) + 1
 	}
-	if err := WritePath(out, hdr.path); err != nil {
-		return err
+	buf := getHeaderBuf(n)
+	defer headerPool.Put(buf)
+	b := *buf
+	hdr.Data.put(b)
+	if len(hdr.path) != 0 {
+		copy(b[fileHeaderSize:], hdr.path)
+		b[n-1] = 0
 	}
-	return nil
+	_, err := out.Write(b)
+	return err
 }
 
 func unMarshallBinary(reader io.Reader) (*fileHeader, error) {
-	var data fileHeaderData
-	if err := binary.Read(reader, binary.LittleEndian, &data); err != nil {
+	buf := getHeaderBuf(fileHeaderSize)
+	defer headerPool.Put(buf)
+	if _, err := io.ReadFull(reader, *buf); err != nil {
 		return nil, err
 	}
-	path, err := ReadPath(reader, data.NameLen)
+	hdr := new(fileHeader)
+	hdr.Data.get(*buf)
+	path, err := ReadPath(reader, hdr.Data.NameLen)
 	if err != nil {
 		return nil, err
 	}
-	return &fileHeader{
-		path: path,
-		Data: data,
-	}, nil
+	if err := checkWirePath(path); err != nil {
+		return nil, err
+	}
+	hdr.path = path
+	if err := checkHeader(hdr); err != nil {
+		return nil, err
+	}
+	return hdr, nil
+}
+
+// checkHeader verifies that the fields of a header received agree with each
+// other: a path is sent with its length, the mode has a single file type, a
+// directory has no size, and a symlink no longer a target than a path can be.
+// Like checkWirePath, this holds for every header, so that nothing further
+// along has to make sense of one which doesn't.
+func checkHeader(hdr *fileHeader) error {
+	if hdr.Data.NameLen == 1 {
+		return protocolErrorf("empty path")
+	}
+	mode := os.FileMode(hdr.Data.Mode)
+	switch mode & os.ModeType {
+	case 0, os.ModeDir, os.ModeSymlink, os.ModeNamedPipe, os.ModeSocket, os.ModeDevice,
+		os.ModeDevice | os.ModeCharDevice, os.ModeIrregular:
+	default:
+		return protocolErrorf("mode %x of %q has several file types", hdr.Data.Mode, hdr.path)
+	}
+	if mode.IsDir() && hdr.Data.FileLen != 0 {
+		return protocolErrorf("directory %q has a size (%d)", hdr.path, hdr.Data.FileLen)
+	}
+	if mode&os.ModeSymlink != 0 && hdr.Data.FileLen > MaxPathLength-1 {
+		return protocolErrorf("symlink %q has a target of %d bytes", hdr.path, hdr.Data.FileLen)
+	}
+	return nil
+}
+
+// checkWirePath verifies that a path received in a header is relative, and
+// has neither ".." components nor NULs. This holds for every header, whether
+// or not the receiver is jailed, and before anything else looks at the path.
+func checkWirePath(path string) error {
+	if filepath.IsAbs(path) {
+		return protocolErrorf("absolute path %q", path)
+	}
+	if strings.IndexByte(path, 0) >= 0 {
+		return protocolErrorf("path %q contains NUL", path)
+	}
+	if path == ".." || strings.HasPrefix(path, "../") || strings.HasSuffix(path, "/..") ||
+		strings.Contains(path, "/../") {
+		return protocolErrorf("path %q leads out of the directory", path)
+	}
+	return nil
 }
 
 func (hdr *fileHeader) Diff(other *fileHeader) []string {
+	return hdr.diff(other, 0)
+}
+
+// diff is Diff, with the modification times compared given the offset of the
+// sender's clock (see FlagClock), hdr being the receiver's.
+func (hdr *fileHeader) diff(other *fileHeader, offset time.Duration) []string {
 	var errs []string
 	if a, b := hdr.Data.NameLen, other.Data.NameLen; a != b {
 		errs = append(errs, fmt.Sprintf("NameLen %d != %d", a, b))
 	}
-	if a, b := hdr.Data.Mode, other.Data.Mode; a != b {
+	if a, b := hdr.Data.Mode, other.Data.Mode; !sameMode(a, b) {
 		errs = append(errs, fmt.Sprintf("Mode %x != %x", a, b))
 	}
+	if a, b := hdr.owner, other.owner; a != nil && b != nil && *a != *b {
+		errs = append(errs, fmt.Sprintf("Owner %d:%d != %d:%d", a.Uid, a.Gid, b.Uid, b.Gid))
+	}
 	if a, b := hdr.Data.FileLen, other.Data.FileLen; a != b {
 		errs = append(errs, fmt.Sprintf("FileLen %d != %d", a, b))
 	}
-	if !(hdr.isSymlink() && other.isSymlink()) {
-		// Ignore comparing atime/mtime for symlinks, since we
-		// cannot set the times/perms on those when syncing, so they will
-		// basically always yield errors
+	if !hdr.sameMtime(other, offset) {
 		if a, b := hdr.Data.Mtime, other.Data.Mtime; a != b {
 			errs = append(errs, fmt.Sprintf("Mtime %d != %d", a, b))
 		}
@@ -178,20 +659,30 @@ func (hdr *fileHeader) Diff(other *fileHeader) []string {
 //
 // > If the file is a symbolic link, it changes the mode of the link's target.
 //
-// And similarly, it's not possible to do ChTimes on a symlink, as golang will always
-// resolve the symlinks, see https://github.com/golang/go/issues/3951
-//
-// - Invoking os.Chtimes on a symlink that resolves to some existing file will
-//   in actuality change the other file.
-// - Invoking os.Chtimes on a symlink that doesn't resolve to an existing file at
-//   all, will return an error (no such file or directory).
+// Symlinks only get their times set, see fixTimes.
 func (hdr *fileHeader) fixTimesAndPerms() error {
 	if err := os.Chmod(hdr.path, os.FileMode(hdr.Data.Mode&07777)); err != nil {
 		return err
 	}
+	return hdr.fixTimes()
+}
+
+// fixTimes sets the times of the given item according to the fileHeader. A
+// symlink isn't followed, so it gets the times itself.
+func (hdr *fileHeader) fixTimes() error {
 	atime := time.Unix(int64(hdr.Data.Atime), int64(hdr.Data.AtimeNsec))
 	mtime := time.Unix(int64(hdr.Data.Mtime), int64(hdr.Data.MtimeNsec))
-	return os.Chtimes(hdr.path, atime, mtime)
+	return utimensat(atFdCwd, hdr.path, hdr.path, atime, mtime)
+}
+
+// sameMode returns whether the modes are the same, as far as syncing goes. The
+// perms of symlinks can't be set, and depend on the filesystem (always 0777 on
+// most), so only their type is compared.
+func sameMode(a, b uint32) bool {
+	if os.FileMode(a)&os.ModeSymlink != 0 && os.FileMode(b)&os.ModeSymlink != 0 {
+		return true
+	}
+	return a == b
 }
 
 func (hdr *fileHeader) isRegular() bool {
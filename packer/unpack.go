@@ -1,14 +1,22 @@
 package packer
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/golang/snappy"
+	"hash"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -25,32 +33,189 @@ type Receiver struct {
 
 	totalBytes uint64 // counter for total bytes received
 	totalFiles uint64 // counter for total files received
+	askedBytes uint64 // size of the content requested, see pendingBytes
+	doneBytes  uint64 // size of the content received of it
 
 	filesLimit int    // a limit on the number of files to receive
 	byteLimit  uint64 // limit on the number of bytes to receive
+	usage      uint64 // size of the sync root, when a quota is used
 
 	index       uint32              // index count,for requesting
 	requestList []uint32            // list of files (indexes) to request
 	toDelete    map[string]struct{} // list of local files to delete
+	// names in the local directories being received (by absolute path)
+	// which the sender hasn't sent, see snapshotFiles
+	snapshots map[string]map[string]struct{}
 
-	dirStack            []string // stack of directories we visit/create
+	dirStack            []string       // stack of directories we visit/create
+	dirEntries          map[string]int // number of entries seen per directory
+	maxDepth            int
+	maxDirEntries       int
 	deferredPermissions []*fileHeader
-	// place to store stuff in. Defaults to empty string, as we're normally
-	// root-jailed, but is used for testing
+	// place to store stuff in, see ReceiverOptions.Root. Defaults to empty
+	// string, as we're normally root-jailed
 	root string
+	fs   *rootDir // the root, held open during a sync, see rootDir
 
-	opts *Options
+	opts  *Options
+	ropts *ReceiverOptions
+	audit *auditLog // nil unless audit logging is enabled
+
+	aborted  int32     // set (atomically) to 1 when the sync should be aborted
+	failure  error     // the first failure handling the metadata, see fail
+	results  int       // results sent, see sendStatusAndCrc
+	lastCode ErrorCode // the code of the last result sent
+
+	paths map[string]struct{} // paths received so far, in the metadata phase
+	items []*fileHeader       // headers of the files and symlinks, by index
+
+	renamed map[string]string   // local paths of the items renamed by the filter
+	skipped map[string]struct{} // directories left out by the filter
+
+	normNames  map[string]normEntry // the first item of each normalized name, see normalize
+	duplicates int                  // items whose names differ only in normalization
+
+	store         *Store                 // set when receiving into a store
+	manifest      *StoreManifest         // the tree received into the store
+	storeEntries  map[string]*StoreEntry // entries of the manifest, by path
+	storePrevious map[string]*StoreEntry // entries of the last manifest, by path
+
+	archive         archiveWriter  // set when receiving into an archive
+	archiveDirs     []*fileHeader  // directories, added before the content
+	archiveDirIndex map[string]int // index in archiveDirs, by path
+
+	signed  bool     // whether the sender signs the transfer
+	digests [][]byte // signed digests of the files and symlinks, by index
+	digest  []byte   // digest of the item being received, when signed
+
+	summaryOffered bool          // whether the sender asks for a summary
+	summarized     bool          // whether the summary has been sent
+	summary        []*fileHeader // the summary, see sendSummary
+	quickCheck     bool          // whether the summary leaves out the crcs of files
+
+	lazyHashing bool     // whether the crcs are asked for, see FlagLazyHash
+	hashPending []uint32 // the items whose crcs are to be asked for
+
+	dedup     bool                // whether files may be clones, see FlagDedup
+	cloneable map[uint32]struct{} // the files received, which may be cloned
+
+	inlineMax uint64   // size up to which files are inlined, see FlagInline
+	inlined   []uint32 // items requested whose content came with the metadata
+
+	ownersSent bool // whether items come with their owners, see FlagOwners
+	chown      bool // whether those are applied, see ReceiverOptions.Owners
+
+	asked map[uint32]struct{} // the items requested so far, see request
+
+	digestsSent bool // whether the content of files is followed by its sha256
+	trailer     bool // whether that of the item being received is, see checkSentDigest
+
+	goneSent  bool // whether files may be sent as gone, see FlagGone
+	gone      int  // files sent as gone
+	verifying bool // whether the trees are compared after the sync, see FlagVerifyTree
+
+	lenient  bool          // whether items may fail, see FlagLenient
+	failures []ItemFailure // the items which failed, see addFailure
+	failMu   sync.Mutex
+
+	diskFullDetails bool // whether running out of space is detailed, see FlagDiskFull
+
+	clockSent   bool          // whether the sender sent its time, see FlagClock
+	clockOffset time.Duration // of the sender's clock to the local one, when systematic
+
+	stage    string // the staged tree, below the root, see ReceiverOptions.Transactional
+	linkDest string // where unchanged files are linked from, see linkPrevious
+
+	raw      io.Reader       // the connection, which the streams are read from
+	deadline *deadlineReader // set when reading with timeouts, see ReceiverOptions.ReadTimeout
+	streams  int             // number of streams in the data phase
+
+	subtreesOffered bool       // whether the sender sends subtree options
+	subtrees        []*Subtree // the subtrees, see receiveSubtrees
+
+	overlapOffered bool               // whether the requests are sent in chunks
+	queue          *headerQueue       // the metadata read ahead, when overlapping
+	pending        []uint32           // requests not sent yet, when overlapping
+	pendingSince   time.Time          // when the first of them was made
+	requested      chan requestedItem // items whose content is to be received
+	requestsEnded  bool               // whether the end of the requests is sent
+	dataErr        int32              // set (atomically) to 1 when receiving content failed
+	bytesMu        sync.Mutex         // protects the byte counters, when overlapping
+
+	packed bool     // whether small files are packed into frames
+	frame  [][]byte // items left in the current frame, see readFrame
+
+	// For the journal
+	received     int       // files and symlinks received
+	deleted      int       // items deleted
+	deleteFailed int       // items which couldn't be deleted
+	conflicts    int       // local changes kept, see mayReplace
+	metaHash     hash.Hash // of the metadata received
+	dir          string    // the synced directory
+
+	stagingMu sync.Mutex
+	staging   map[string]struct{} // tempfiles being written, or put in place
+
+	finisher *finisher // set while files are put in place, see finishLater
+
+	rings *uringPool // set when writing through io_uring, see ReceiverOptions.IOUring
+
+	deleter *deleter // set while deleting, see startDeletions
+
+	wal *writeAhead // set when writing ahead, see ReceiverOptions.WriteAhead
 }
 
 // NewReceiver creates a new receiver
-func NewReceiver(in io.Reader, out io.Writer) (*Receiver, error) {
+func NewReceiver(in io.Reader, out io.Writer, ropts *ReceiverOptions) (*Receiver, error) {
+	if ropts == nil {
+		ropts = DefaultReceiverOptions
+	}
+	deadline := newDeadlineReader(in, ropts.ReadTimeout, ropts.PhaseTimeout)
+	in = deadline.reader(in)
 	v := versionHeader{}
 	if err := binary.Read(in, binary.LittleEndian, &v); err != nil {
 		return nil, err
 	}
-	if v.Version != 0 {
+	if v.Version != Version && v.Version != VersionExtended {
 		return nil, fmt.Errorf("unsupported version: %d", v.Version)
 	}
+	if v.Flags&^(FlagSigned|FlagSummary|FlagSubtrees|FlagOverlap|FlagPacked|FlagQuickCheck|FlagLazyHash|FlagDedup|FlagInline|FlagDigests|FlagGone|FlagAbort|FlagVerifyTree|FlagLenient|FlagDiskFull|FlagClock|FlagOwners) != 0 {
+		return nil, fmt.Errorf("unsupported flags: %#x", v.Flags)
+	}
+	if v.Streams > MaxStreams {
+		return nil, fmt.Errorf("unsupported number of streams: %d", v.Streams)
+	}
+	if v.Flags&FlagOverlap != 0 && v.Streams > 1 {
+		return nil, fmt.Errorf("overlap can't be used with streams")
+	}
+	if v.Flags&FlagPacked != 0 && v.Streams > 1 {
+		return nil, fmt.Errorf("packing can't be used with streams")
+	}
+	if v.Flags&FlagQuickCheck != 0 && v.Flags&FlagSummary == 0 {
+		return nil, fmt.Errorf("quick check needs a summary")
+	}
+	if v.Flags&FlagLazyHash != 0 && (v.Flags&(FlagSummary|FlagOverlap) != 0 || v.FileCrcUsage == FileCrcOff) {
+		return nil, fmt.Errorf("lazy hashing needs crcs, and can't be used with a summary or overlap")
+	}
+	if v.Flags&FlagDedup != 0 && (v.Flags&FlagPacked != 0 || v.Streams > 1) {
+		return nil, fmt.Errorf("dedup can't be used with packing or streams")
+	}
+	if v.Flags&FlagInline != 0 && (v.Flags&FlagSigned != 0 || v.Inline == 0) {
+		return nil, fmt.Errorf("inlining needs a size, and can't be used when signing")
+	}
+	if v.Flags&FlagOwners != 0 && v.Flags&FlagSigned != 0 {
+		return nil, fmt.Errorf("owners can't be sent when signing")
+	}
+	if v.Flags&FlagVerifyTree != 0 && (v.Flags&(FlagSubtrees|FlagLenient) != 0 || ropts.Archive != nil || ropts.Store != nil) {
+		return nil, fmt.Errorf("tree verification can't be used with subtrees, a lenient sync, or into an archive or a store")
+	}
+	var clockOffset time.Duration
+	if v.Flags&FlagClock != 0 {
+		var err error
+		if clockOffset, err = readClock(in); err != nil {
+			return nil, err
+		}
+	}
 	opts := &Options{
 		Verbosity:   int(v.Verbosity),
 		CrcUsage:    int(v.FileCrcUsage),
@@ -59,6 +224,11 @@ func NewReceiver(in io.Reader, out io.Writer) (*Receiver, error) {
 	if opts.Compression > CompressionSnappy {
 		return nil, fmt.Errorf("Unsupported compression format %d", opts.Compression)
 	}
+	signed := v.Flags&FlagSigned != 0
+	if ropts.TrustedKey != nil && !signed {
+		return nil, fmt.Errorf("transfer is not signed, but a trusted key is required")
+	}
+	raw := in
 	if opts.Compression == CompressionSnappy {
 		in = snappy.NewReader(in)
 	}
@@ -66,28 +236,319 @@ func NewReceiver(in io.Reader, out io.Writer) (*Receiver, error) {
 		log.Printf("protocol version: %d, verbosity %d, snappy: %v, crc: %d",
 			v.Version, opts.Verbosity, opts.Compression != 0, opts.CrcUsage)
 	}
-	return &Receiver{
+	r := &Receiver{
 		in:          in,
 		out:         NewConfigurableWriter(opts.Compression == CompressionSnappy, out),
 		filesLimit:  -1,
 		useTempFile: true,
 		opts:        opts,
+		ropts:       ropts,
 		toDelete:    make(map[string]struct{}),
-	}, nil
+		snapshots:   make(map[string]map[string]struct{}),
+		dirEntries:  make(map[string]int),
+		paths:       make(map[string]struct{}),
+		renamed:     make(map[string]string),
+		skipped:     make(map[string]struct{}),
+		signed:      signed,
+		root:        ropts.Root,
+		store:       ropts.Store,
+	}
+	r.metaHash = sha256.New()
+	r.summaryOffered = v.Flags&FlagSummary != 0
+	r.quickCheck = v.Flags&FlagQuickCheck != 0
+	r.lazyHashing = v.Flags&FlagLazyHash != 0
+	if v.Flags&FlagDedup != 0 {
+		r.dedup, r.cloneable = true, make(map[uint32]struct{})
+	}
+	if v.Flags&FlagInline != 0 {
+		r.inlineMax = uint64(v.Inline)
+	}
+	r.digestsSent = v.Flags&FlagDigests != 0
+	r.goneSent = v.Flags&FlagGone != 0
+	r.verifying = v.Flags&FlagVerifyTree != 0
+	r.lenient = v.Flags&FlagLenient != 0
+	r.diskFullDetails = v.Flags&FlagDiskFull != 0
+	r.clockSent = v.Flags&FlagClock != 0
+	r.ownersSent = v.Flags&FlagOwners != 0
+	r.chown = r.ownersSent && r.ropts.Owners && privileged()
+	if r.ownersSent && !r.chown && opts.Verbosity >= 2 {
+		if r.ropts.Owners {
+			log.Print("Owners are sent, but not privileged to apply them")
+		} else {
+			log.Print("Owners are sent, but not applied without -owners")
+		}
+	}
+	r.clockOffset = systematicOffset(clockOffset)
+	if r.clockOffset != 0 && opts.Verbosity >= 3 {
+		log.Printf("The sender's clock is %v off", clockOffset)
+	}
+	r.subtreesOffered = v.Flags&FlagSubtrees != 0
+	r.overlapOffered = v.Flags&FlagOverlap != 0
+	r.packed = v.Flags&FlagPacked != 0
+	r.raw, r.streams = raw, int(v.Streams)
+	r.deadline = deadline
+	if ropts.IOUring {
+		r.rings = new(uringPool)
+	}
+	if ropts.Archive != nil {
+		var err error
+		if r.archive, err = newArchiveWriter(ropts.Archive, ropts.ArchiveFormat); err != nil {
+			return nil, err
+		}
+		r.archiveDirIndex = make(map[string]int)
+	}
+	if r.store != nil {
+		source := ropts.StoreSource
+		if source == "" {
+			source = "local"
+		}
+		if err := checkStoreSource(source); err != nil {
+			return nil, err
+		}
+		r.manifest = &StoreManifest{Source: source, Time: time.Now()}
+		r.storeEntries = make(map[string]*StoreEntry)
+	}
+	if err := checkNormalization(ropts); err != nil {
+		return nil, err
+	}
+	if err := checkWriteAhead(ropts); err != nil {
+		return nil, err
+	}
+	r.linkDest = ropts.LinkDest
+	if ropts.Transactional {
+		if v.Flags&(FlagSubtrees|FlagLenient) != 0 || ropts.Archive != nil || ropts.Store != nil ||
+			ropts.LinkDest != "" || ropts.Filter != nil || ropts.Conflict != nil {
+			return nil, fmt.Errorf("a transactional sync can't be used with subtrees, a lenient sync, a link destination, a filter or a conflict callback, or into an archive or a store")
+		}
+		// Unchanged files are linked from the live tree
+		r.linkDest = filepath.Clean(r.root)
+	}
+	r.maxDepth, r.maxDirEntries = ropts.MaxDepth, ropts.MaxDirEntries
+	if r.maxDepth <= 0 {
+		r.maxDepth = DefaultMaxDepth
+	}
+	if r.maxDirEntries <= 0 {
+		r.maxDirEntries = DefaultMaxDirEntries
+	}
+	return r, nil
 }
 
-func (r *Receiver) Sync() error {
-	// Receive directories + metadata
-	if err := r.receiveMetadata(); err != nil {
-		return fmt.Errorf("Error during phase 0 receive : %v", err)
+func (r *Receiver) Sync() (err error) {
+	if hooks := r.ropts.Hooks; hooks != nil {
+		if err := hooks.PreSync(r.local(".")); err != nil {
+			return err
+		}
+		defer func() { hooks.PostSync(err) }()
 	}
-	// Request files
-	if err := r.requestFiles(); err != nil {
-		return fmt.Errorf("Error during phase 2 file request: %v", err)
+	defer r.rings.close()
+	if r.archive != nil {
+		// Nothing but the archive is written, not even the journal
+		return r.sync()
 	}
-	// Receive data content
-	if err := r.receiveFullData(); err != nil {
-		return fmt.Errorf("Error during file reception: %v", err)
+	if r.store == nil {
+		if r.fs, err = openRootDir(r.root); err != nil {
+			return err
+		}
+		defer func() {
+			// Cleanup may be removing tempfiles through it meanwhile
+			r.stagingMu.Lock()
+			r.fs.Close()
+			r.fs = nil
+			r.stagingMu.Unlock()
+		}()
+	}
+	entry := &JournalEntry{
+		Start:    time.Now(),
+		Snapshot: r.ropts.SnapshotID,
+	}
+	entry.Profile, entry.Peer = r.ropts.Profile, r.ropts.Peer
+	defer func() {
+		entry.End = time.Now()
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		entry.Dir, entry.Files, entry.Bytes = r.dir, r.received, r.totalBytes
+		entry.Deleted, entry.DeleteFailed, entry.Conflicts = r.deleted, r.deleteFailed, r.conflicts
+		entry.Gone, entry.Failed = r.gone, len(r.failures)
+		entry.Duplicates = r.duplicates
+		if r.dir != "" {
+			entry.Manifest = fmt.Sprintf("%x", r.metaHash.Sum(nil))
+		}
+		if jErr := appendJournal(r.root, entry); jErr != nil && r.opts.Verbosity > 0 {
+			log.Printf("Failed to update journal: %v", jErr)
+		}
+	}()
+	if r.fs != nil {
+		// Before anything else is looked at, see recoverWriteAhead
+		if entry.Undone, err = r.recoverWriteAhead(); err != nil {
+			return fmt.Errorf("failed settling the write-ahead journal: %v", err)
+		}
+	}
+	if r.ropts.AuditLog {
+		if r.audit, err = openAuditLog(r.root, r.ropts.AuditLogMaxSize); err != nil {
+			return fmt.Errorf("failed opening audit log: %v", err)
+		}
+		defer r.audit.Close()
+	}
+	if r.ropts.MaxRootSize > 0 {
+		if r.usage, err = DiskUsage(r.local(".")); err != nil {
+			return fmt.Errorf("failed calculating disk usage: %v", err)
+		}
+		if r.usage >= r.ropts.MaxRootSize {
+			return fmt.Errorf("%w: %d bytes used, quota is %d", ErrQuotaExceeded, r.usage, r.ropts.MaxRootSize)
+		}
+	}
+	if len(r.ropts.SnapshotCommand) > 0 {
+		id, err := TakeSnapshot(r.ropts.SnapshotCommand, r.local("."))
+		if err != nil {
+			return err
+		}
+		if r.opts.Verbosity >= 3 {
+			log.Printf("Snapshot taken: %v", id)
+		}
+		entry.Snapshot = id
+	}
+	if r.store != nil {
+		if r.storePrevious, err = r.store.latest(r.manifest.Source); err != nil {
+			return fmt.Errorf("failed reading the last manifest: %v", err)
+		}
+	}
+	if r.ropts.Transactional {
+		if err := r.stageTree(); err != nil {
+			return fmt.Errorf("failed staging the tree: %v", err)
+		}
+		defer r.dropStagedTree()
+	}
+	if r.ropts.WriteAhead != "" {
+		if r.wal, err = openWriteAhead(r.fs, r.root); err != nil {
+			return fmt.Errorf("failed opening the write-ahead journal: %v", err)
+		}
+		defer func() {
+			n, wErr := r.closeWriteAhead(err)
+			entry.Undone += n
+			if wErr != nil && err == nil {
+				err = fmt.Errorf("failed closing the write-ahead journal: %v", wErr)
+			} else if wErr != nil && r.opts.Verbosity > 0 {
+				log.Printf("Failed settling the write-ahead journal: %v", wErr)
+			}
+		}()
+	}
+	return r.sync()
+}
+
+// Abort makes the receiver stop the sync at the next opportunity: no further
+// files are requested, the sender is notified with a non-zero result, and
+// Sync returns ErrAborted. It is safe to call from another goroutine
+// (e.g. a signal handler).
+func (r *Receiver) Abort() {
+	atomic.StoreInt32(&r.aborted, 1)
+}
+
+func (r *Receiver) isAborted() bool {
+	return atomic.LoadInt32(&r.aborted) == 1
+}
+
+// Cleanup removes any partially received file. It is meant to be used if
+// Sync cannot be waited for, e.g. when the process is about to exit while
+// Sync is blocked reading from the sender.
+func (r *Receiver) Cleanup() {
+	r.stagingMu.Lock()
+	defer r.stagingMu.Unlock()
+	for name := range r.staging {
+		r.fs.Remove(name)
+	}
+	r.staging = nil
+}
+
+// addStaging records a tempfile being written, which Cleanup removes.
+func (r *Receiver) addStaging(name string) {
+	r.stagingMu.Lock()
+	if r.staging == nil {
+		r.staging = make(map[string]struct{})
+	}
+	r.staging[name] = struct{}{}
+	r.stagingMu.Unlock()
+}
+
+// dropStaging removes a tempfile, once it's in place or failed.
+func (r *Receiver) dropStaging(name string) {
+	r.fs.Remove(name)
+	r.stagingMu.Lock()
+	delete(r.staging, name)
+	r.stagingMu.Unlock()
+}
+
+// abort sends the 'interrupted' result to the sender, and restores the
+// permissions on the directories handled so far.
+func (r *Receiver) abort(lastName string) error {
+	if r.opts.Verbosity > 0 {
+		log.Printf("Aborting sync, last file %v", lastName)
+	}
+	if r.queue == nil {
+		// Otherwise content may still be coming, see receiveOverlapped
+		for _, hdr := range r.deferredPermissions {
+			r.fixTimesAndPerms(hdr)
+		}
+	}
+	if err := r.sendStatusAndCrc(CodeAborted, lastName); err != nil {
+		return err
+	}
+	if err := r.out.Flush(); err != nil {
+		return err
+	}
+	return ErrAborted
+}
+
+// fail sends the code of a failure to the sender (see errorCode), in place of
+// the result it waits for, and returns the failure. Running out of space is
+// returned as a *DiskFullError.
+func (r *Receiver) fail(err error, lastName string) error {
+	err = r.diskFull(err)
+	if r.opts.Verbosity > 0 {
+		log.Printf("Sync failed, last file %v: %v", lastName, err)
+	}
+	code := errorCode(err)
+	if r.sendStatusAndCrc(code, lastName) == nil {
+		if code == CodeDiskFull && r.diskFullDetails {
+			r.sendDiskFull(err)
+		}
+		r.out.Flush()
+	}
+	return err
+}
+
+// failData is fail, for a failure after the result of the metadata phase,
+// unless the final result was sent already. The rest of the content is
+// discarded, for the sender to get to the result.
+func (r *Receiver) failData(err error) error {
+	if r.results > 1 {
+		return err
+	}
+	if r.streams <= 1 {
+		// First, since the sender may be blocked sending it
+		go io.Copy(ioutil.Discard, r.in)
+	}
+	return r.fail(err, "")
+}
+
+func (r *Receiver) sync() error {
+	r.deadline.startPhase("phase 0")
+	receive := r.receivePhases
+	if r.overlapping() {
+		receive = r.receiveOverlapped
+	}
+	err := receive()
+	if dErr := r.waitDeletions(); err == nil {
+		err = dErr
+	}
+	if errors.Is(err, ErrSenderAborted) {
+		return r.senderAborted()
+	}
+	if isOutOfSpace(err) {
+		return r.outOfSpace(err)
+	}
+	if err != nil {
+		return err
 	}
 	if r.opts.Verbosity >= 3 {
 		if cm, ok := r.out.(*ConfigurableWriter); ok {
@@ -95,47 +556,226 @@ func (r *Receiver) Sync() error {
 			log.Printf("Data sent, raw: %d, compresed: %d", r, c)
 		}
 	}
-	// Fix perms
+	if r.lenient {
+		if err := r.sendFailures(); err != nil {
+			return err
+		}
+	}
+	if r.archive != nil {
+		if err := r.archive.Close(); err != nil {
+			return fmt.Errorf("Error writing archive: %w", err)
+		}
+		return r.partial()
+	}
+	if r.store != nil {
+		if err := r.store.writeManifest(r.manifest); err != nil {
+			return fmt.Errorf("failed writing manifest: %v", err)
+		}
+		if r.opts.Verbosity >= 3 {
+			log.Printf("Wrote manifest %v", r.manifest.Name)
+		}
+		return r.partial()
+	}
+	// Fix perms, once the deletions within the directories are done
 	for _, hdr := range r.deferredPermissions {
-		hdr.fixTimesAndPerms()
+		r.fixTimesAndPerms(hdr)
 	}
-	for f, _ := range r.toDelete {
-		info, err := os.Lstat(f)
-		if err != nil {
-			log.Printf("Error during deletion: %v", err)
-			continue
+	if r.verifying {
+		if err := r.verifyTree(); err != nil {
+			return err
 		}
-		if info.IsDir() {
-			os.RemoveAll(f)
-			if r.opts.Verbosity >= 4 {
-				log.Printf("Removed directory %v", f)
-			}
-		} else {
-			if err := os.Remove(f); err != nil {
-				if r.opts.Verbosity > 0 {
-					log.Printf("Failed to delete %v: %v", f, err)
-				}
-			}
-			if r.opts.Verbosity >= 4 {
-				log.Printf("Removed %v", f)
-			}
+	}
+	if r.stage != "" {
+		if err := r.commitTree(); err != nil {
+			return fmt.Errorf("failed committing the staged tree: %v", err)
+		}
+	}
+	return r.partial()
+}
+
+// receivePhases receives the metadata, requests the files, and receives
+// their content, one after the other.
+func (r *Receiver) receivePhases() error {
+	// Receive directories + metadata
+	if err := r.receiveMetadata(); err != nil {
+		// Inlined files may be being put in place
+		r.waitFinished()
+		if err == ErrAborted {
+			return err
+		}
+		return fmt.Errorf("Error during phase 0 receive : %w", err)
+	}
+	// Request files, unless they already were, see FlagOverlap
+	if !r.overlapOffered {
+		if err := r.requestFiles(); err != nil {
+			return fmt.Errorf("Error during phase 2 file request: %w", err)
+		}
+	}
+	if r.archive != nil {
+		if err := r.writeArchiveDirs(); err != nil {
+			return r.failData(fmt.Errorf("Error writing archive: %w", err))
+		}
+	}
+	// Receive data content
+	r.deadline.startPhase("phase 2")
+	if err := r.receiveFullData(); err != nil {
+		if err == ErrAborted {
+			return err
 		}
+		return r.failData(fmt.Errorf("Error during file reception: %w", err))
 	}
 	return nil
 }
 
-// request schedules a certain index for later retrieval
+// localPath returns the path, below the root, where the item at the given
+// path from the sender is placed.
+func (r *Receiver) localPath(path string) string {
+	if local, ok := r.renamed[path]; ok {
+		return local
+	}
+	return path
+}
+
+// local returns the local path of the given path from the sender, in the
+// staged tree during a transactional sync.
+func (r *Receiver) local(path string) string {
+	return filepath.Join(r.root, r.stage, r.localPath(path))
+}
+
+// filter applies the filter to the item, and returns whether it is left out.
+// The synced directory itself is never left out.
+func (r *Receiver) filter(hdr *fileHeader) (bool, error) {
+	parent := filepath.Dir(hdr.path)
+	if parent == "." {
+		return false, nil
+	}
+	if _, skip := r.skipped[parent]; skip {
+		if hdr.isDir() {
+			r.skipped[hdr.path] = struct{}{}
+		}
+		return true, nil
+	}
+	if hdr.isDir() && len(r.dirStack) > 0 && r.dirStack[len(r.dirStack)-1] == hdr.path {
+		// Leaving the directory, which has already been filtered
+		_, skip := r.skipped[hdr.path]
+		return skip, nil
+	}
+	name, ok, err := applyFilter(r.ropts.Filter, hdr.path, os.FileMode(hdr.Data.Mode))
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		if hdr.isDir() {
+			r.skipped[hdr.path] = struct{}{}
+		}
+		return true, nil
+	}
+	local := filepath.Join(r.localPath(parent), filepath.Base(name))
+	if local, skip := r.normalize(hdr, local); skip {
+		if hdr.isDir() {
+			r.skipped[hdr.path] = struct{}{}
+		}
+		return true, nil
+	} else if local != hdr.path {
+		r.renamed[hdr.path] = local
+	}
+	return false, nil
+}
+
+// postFile runs the PostFile hook on a received item, with the local file
+// holding its content, and returns whether it is to be put in place.
+func (r *Receiver) postFile(hdr *fileHeader, local string) (bool, error) {
+	if r.ropts.Hooks == nil {
+		return true, nil
+	}
+	err := r.ropts.Hooks.PostFile(r.localPath(hdr.path), local)
+	if err == ErrSkipItem {
+		if r.opts.Verbosity >= 3 {
+			log.Printf("Leaving out %v", hdr.path)
+		}
+		return false, r.audit.record(auditSkip, r.localPath(hdr.path), hdr.Data.FileLen, 0)
+	}
+	if err != nil {
+		return false, &rejection{err}
+	}
+	return true, nil
+}
+
+// fixTimesAndPerms sets the perms and times of the local item, like
+// fileHeader.fixTimesAndPerms.
+func (r *Receiver) fixTimesAndPerms(hdr *fileHeader) error {
+	if err := r.fixOwner(hdr); err != nil {
+		return err
+	}
+	perms := os.FileMode(hdr.Data.Mode) & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := r.fs.Chmod(r.local(hdr.path), perms); err != nil {
+		return err
+	}
+	return r.fixTimes(hdr)
+}
+
+// fixTimes sets the times of the local item, like fileHeader.fixTimes.
+func (r *Receiver) fixTimes(hdr *fileHeader) error {
+	atime := time.Unix(int64(hdr.Data.Atime), int64(hdr.Data.AtimeNsec))
+	mtime := time.Unix(int64(hdr.Data.Mtime), int64(hdr.Data.MtimeNsec))
+	return r.fs.Chtimes(r.local(hdr.path), atime, mtime)
+}
+
+// mayReplace returns whether the local item at path may be replaced or
+// deleted, see ReceiverOptions.Conflict.
+func (r *Receiver) mayReplace(path string) bool {
+	if r.ropts.Conflict == nil || r.ropts.Conflict(path) {
+		return true
+	}
+	if r.opts.Verbosity >= 3 {
+		log.Printf("Keeping local version of %v", path)
+	}
+	r.conflicts++
+	return false
+}
+
+// source returns where local files are hashed from.
+func (r *Receiver) source() source {
+	return osSource{mmap: r.ropts.Mmap}
+}
+
+// request schedules a certain index for later retrieval. When overlapping,
+// the requests are sent, and received, a chunk at a time, and not kept.
 func (r *Receiver) request(index uint32) {
-	r.requestList = append(r.requestList, r.index)
+	// An item may fail several checks, but the sender sends it once per
+	// request, see readFileList
+	if _, ok := r.asked[index]; ok {
+		return
+	}
+	if r.asked == nil {
+		r.asked = make(map[uint32]struct{})
+	}
+	r.asked[index] = struct{}{}
+	r.askBytes(r.items[index].Data.FileLen)
+	if r.items[index].inline != nil {
+		// It's not asked for, see receiveInlined
+		r.inlined = append(r.inlined, index)
+		return
+	}
+	if r.queue == nil {
+		r.requestList = append(r.requestList, index)
+		return
+	}
+	if len(r.pending) == 0 {
+		r.pendingSince = time.Now()
+	}
+	r.pending = append(r.pending, index)
 }
 
 // countBytes verifies that the length is within limits, and updates bytecounter
 func (r *Receiver) countBytes(length uint64, update bool) error {
 	if length > MaxTransfer {
-		return fmt.Errorf("file too large, %d", length)
+		return fmt.Errorf("%w: file too large, %d", ErrLimitExceeded, length)
 	}
+	r.bytesMu.Lock()
+	defer r.bytesMu.Unlock()
 	if r.byteLimit != 0 && r.totalBytes > uint64(r.byteLimit)-length {
-		return fmt.Errorf("file too large, %d", length)
+		return fmt.Errorf("%w: file too large, %d", ErrLimitExceeded, length)
 	}
 	if update {
 		r.totalBytes += length
@@ -146,38 +786,65 @@ func (r *Receiver) countBytes(length uint64, update bool) error {
 // receiveFileMetadata handles stage-1 metadata for files and symlinks
 func (r *Receiver) receiveFileMetadata(hdr *fileHeader) error {
 	defer func() { r.index++ }()
+	r.items = append(r.items, hdr)
 	// Check sizes
 	if err := r.countBytes(hdr.Data.FileLen, false); err != nil {
 		return err
 	}
-	localFileInfo, err := os.Lstat(hdr.path)
+	localFileInfo, err := r.fs.Lstat(r.local(hdr.path))
 	if err != nil && os.IsNotExist(err) {
+		if linked, err := r.linkPrevious(hdr); linked || err != nil {
+			return err
+		}
 		r.request(r.index)
 		return nil
 	}
+	if err != nil {
+		// E.g. a path through a regular file
+		return err
+	}
 	localFile := newFileHeaderFromStat(hdr.path, localFileInfo)
-	if diff := localFile.Diff(hdr); len(diff) > 0 {
+	if diff := localFile.diff(hdr, r.clockOffset); len(diff) > 0 {
 		if r.opts.Verbosity >= 4 {
 			log.Printf("file diffs for %v: %v", hdr.path, diff)
 		}
+		if !r.mayReplace(r.localPath(hdr.path)) {
+			return r.audit.record(auditSkip, r.localPath(hdr.path), hdr.Data.FileLen, 0)
+		}
 		r.request(r.index)
 		return nil
 	}
-	if r.opts.CrcUsage == FileCrcAtimeNsecMetadata ||
-		r.opts.CrcUsage == FileCrcAtimeNsec {
-		crc, err := CrcFile(hdr.path, localFileInfo)
-		if err != nil {
-			return err
+	if (r.opts.CrcUsage == FileCrcAtimeNsecMetadata ||
+		r.opts.CrcUsage == FileCrcAtimeNsec) && r.useCrc(hdr.path) {
+		if r.lazyHash(hdr) {
+			// Compared once the crc is in, see receiveHashes
+			r.hashPending = append(r.hashPending, r.index)
+			return nil
 		}
-		if crc != hdr.Data.AtimeNsec {
-			if r.opts.Verbosity >= 3 {
-				log.Printf("crc diff on %v (local %d, remote %d)",
-					hdr.path, crc, hdr.Data.AtimeNsec)
-			}
-			r.request(r.index)
+		return r.compareCrc(r.index, hdr, localFileInfo, hdr.Data.AtimeNsec)
+	}
+	return r.audit.record(auditSkip, r.localPath(hdr.path), hdr.Data.FileLen, 0)
+}
+
+// compareCrc requests the item with the given index, if the crc of the local
+// copy isn't the remote one.
+func (r *Receiver) compareCrc(index uint32, hdr *fileHeader, info os.FileInfo, remote uint32) error {
+	crc, err := crcItem(r.source(), r.local(hdr.path), info)
+	if err != nil {
+		return err
+	}
+	if crc != remote {
+		if r.opts.Verbosity >= 3 {
+			log.Printf("crc diff on %v (local %d, remote %d)",
+				hdr.path, crc, remote)
 		}
+		if !r.mayReplace(r.localPath(hdr.path)) {
+			return r.audit.record(auditSkip, r.localPath(hdr.path), hdr.Data.FileLen, crc)
+		}
+		r.request(index)
+		return nil
 	}
-	return nil
+	return r.audit.record(auditSkip, r.localPath(hdr.path), hdr.Data.FileLen, crc)
 }
 
 // receiveDirMetadata handles directories (stage 1). Since qvm-sync, as opposed to qvm-copy,
@@ -192,28 +859,46 @@ func (r *Receiver) receiveDirMetadata(header *fileHeader) error {
 	// 1. we're now backing out of a dir, or,
 	// 2. We're visiting/creating one for the first time
 	if r.visitDir(header.path) { // first visit
-		stat, err := os.Lstat(header.path)
+		path := r.local(header.path)
+		stat, err := r.fs.Lstat(path)
 		if err == nil {
-			// If it's not a dir, delete it
+			// If it's not a dir, delete it, and create the dir below
 			if !stat.IsDir() {
-				return RemoveIfExist(header.path)
-			}
-			// We also need ensure that we have permissions in the directory
-			// this is later set correctly on the second visit
-			if err := os.Chmod(header.path, 0700); err != nil {
-				return err
+				if !r.mayReplace(r.localPath(header.path)) {
+					return fmt.Errorf("%w: %v is in the way of a directory", ErrConflict, header.path)
+				}
+				if err := r.replaceItem(path, func() error { return r.fs.Mkdir(path, 0700) }); err != nil {
+					return err
+				}
+				if err := r.audit.record(auditDelete, r.localPath(header.path), uint64(stat.Size()), 0); err != nil {
+					return err
+				}
+				return r.audit.record(auditMkdir, r.localPath(header.path), 0, 0)
+			} else {
+				// We also need ensure that we have permissions in the directory
+				// this is later set correctly on the second visit
+				if err := r.fs.Chmod(path, 0700); err != nil {
+					return err
+				}
+				// remember the files that were there
+				return r.snapshotFiles(path, false)
 			}
-			// remember the files that were there
-			return r.snapshotFiles(header.path, false)
 		}
 		if os.IsNotExist(err) {
-			// Dir did not exist (or was removed), just create it
-			return os.Mkdir(header.path, 0700)
+			// Dir did not exist, just create it
+			if err := r.createItem(path, func() error { return r.fs.Mkdir(path, 0700) }); err != nil {
+				return err
+			}
+			return r.audit.record(auditMkdir, r.localPath(header.path), 0, 0)
 		}
 		// Some other error
 		return err
 	}
 	// second visit
+	// What the sender didn't send in it is to be deleted
+	if err := r.endSnapshot(header.path); err != nil {
+		return err
+	}
 	// We can't set the perms here: if we were to set e.g rdonly perms,
 	// we will be unable to create the full files when they are transmitted.
 	// So just save the perms for later
@@ -226,66 +911,180 @@ func (r *Receiver) receiveRegularFileFullData(hdr *fileHeader) error {
 	if err := r.countBytes(hdr.Data.FileLen, true); err != nil {
 		return err
 	}
+	if err := r.reserveQuota(hdr.path, hdr.Data.FileLen); err != nil {
+		return err
+	}
 	var (
-		fdOut *os.File
-		err   error
+		fdOut  *os.File
+		fw     *fileWriter
+		err    error
+		out    io.Writer
+		crc    = crc32.NewIEEE()
+		digest = sha256.New()
+		path   = r.local(hdr.path)
 	)
 	if !r.useTempFile {
-		if fdOut, err = os.OpenFile(hdr.path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0); err != nil {
-			return err
+		rec, err := r.wal.begin(walCreate, path, 0)
+		if err != nil {
+			return r.skipContent(hdr, err)
 		}
-		// we can't do deferred fdOut.Close, because we need to fix perms
-		// _after_ file has been closed
-		if err := CopyFile(r.in, fdOut, int(hdr.Data.FileLen)); err != nil {
+		if fdOut, err = r.fs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0); err != nil {
+			r.wal.failed(rec)
+			return r.skipContent(hdr, err)
+		}
+		if fw, err = newFileWriter(fdOut, hdr.Data.FileLen, r.rings); err != nil {
 			fdOut.Close()
+			r.fs.Remove(path)
+			return r.skipContent(hdr, err)
+		}
+		out = r.itemWriter(fw, crc, digest)
+		// we can't do deferred fw.Close, because we need to fix perms
+		// _after_ file has been closed
+		err = copyContent(r.in, out, hdr.Data.FileLen)
+		if cErr := fw.Close(); err == nil {
+			err = cErr
+		}
+		if err != nil {
+			if isOutOfSpace(err) {
+				// Not to leave a file which is cut short
+				r.fs.Remove(path)
+			}
 			return err
 		}
-		fdOut.Close()
-		return hdr.fixTimesAndPerms()
+		if err := r.checkDigest(hdr, digest.Sum(nil)); err != nil {
+			r.fs.Remove(path)
+			return err
+		}
+		if keep, err := r.postFile(hdr, path); !keep {
+			r.fs.Remove(path)
+			return r.itemFailed(hdr.path, err)
+		}
+		if err := r.fixTimesAndPerms(hdr); err != nil {
+			return r.itemFailed(hdr.path, err)
+		}
+		if err := r.wal.done(rec); err != nil {
+			return err
+		}
+		return r.audit.record(auditCreate, r.localPath(hdr.path), hdr.Data.FileLen, crc.Sum32())
 	}
 	// Create tempfile
-	if fdOut, err = ioutil.TempFile(".", "qvm-*"); err != nil {
+	if fdOut, err = r.fs.TempFile(r.local("."), "qvm-*"); err != nil {
+		return r.skipContent(hdr, err)
+	}
+	temp := fdOut.Name()
+	r.addStaging(temp)
+	if fw, err = newFileWriter(fdOut, hdr.Data.FileLen, r.rings); err != nil {
+		fdOut.Close()
+		r.dropStaging(temp)
+		return r.skipContent(hdr, err)
+	}
+	out = r.itemWriter(fw, crc, digest)
+	err = copyContent(r.in, out, hdr.Data.FileLen)
+	if err == nil {
+		err = r.checkDigest(hdr, digest.Sum(nil))
+	}
+	if err != nil {
+		fw.Close()
+		r.dropStaging(temp)
 		return err
 	}
-	defer fdOut.Close()
-	defer os.Remove(fdOut.Name()) // defer cleanup
-	if err := CopyFile(r.in, fdOut, int(hdr.Data.FileLen)); err != nil {
+	sum := crc.Sum32()
+	return r.finishLater(func() error {
+		defer r.dropStaging(temp)
+		err := fw.Close()
+		if err == nil {
+			err = r.placeFile(hdr, temp, path, sum)
+		}
+		return r.itemFailed(hdr.path, err)
+	})
+}
+
+// placeFile puts the tempfile with the content of a received file in place,
+// at path.
+func (r *Receiver) placeFile(hdr *fileHeader, temp, path string, crc uint32) error {
+	if keep, err := r.postFile(hdr, temp); !keep {
 		return err
 	}
 	// This file may already exist.
-	if err := RemoveIfExist(hdr.path); err != nil {
+	action := auditCreate
+	if _, err := r.fs.Lstat(path); err == nil {
+		action = auditUpdate
+	}
+	err := r.replaceItem(path, func() error {
+		if err := r.fs.Link(temp, path); err != nil {
+			return fmt.Errorf("unable to link file : %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := r.fixTimesAndPerms(hdr); err != nil {
 		return err
 	}
-	if err := os.Link(fdOut.Name(), hdr.path); err != nil {
-		return fmt.Errorf("unable to link file : %v", err)
+	return r.audit.record(action, r.localPath(hdr.path), hdr.Data.FileLen, crc)
+}
+
+// itemWriter returns a writer for the content of a received file, which also
+// feeds the crc if there's an audit log, and the digest if it's signed or the
+// sender sends one.
+func (r *Receiver) itemWriter(out io.Writer, crc, digest io.Writer) io.Writer {
+	writers := []io.Writer{out}
+	if r.audit != nil {
+		writers = append(writers, crc)
+	}
+	if r.digest != nil || r.trailer {
+		writers = append(writers, digest)
+	}
+	if len(writers) == 1 {
+		return out
 	}
-	return hdr.fixTimesAndPerms()
+	return io.MultiWriter(writers...)
 }
 
 func (r *Receiver) receiveSymlinkFullData(hdr *fileHeader) error {
 	fileSize := hdr.Data.FileLen
 	if fileSize > MaxPathLength-1 {
-		return fmt.Errorf("symlink link-name too long (%d characters)", fileSize)
+		return protocolErrorf("symlink link-name too long (%d characters)", fileSize)
 	}
 	if err := r.countBytes(fileSize, true); err != nil {
 		return err
 	}
+	if err := r.reserveQuota(hdr.path, fileSize); err != nil {
+		return err
+	}
 	// a symlink should be small enough to not use CopyFile (buffered)
 	buf := make([]byte, fileSize)
 	if _, err := io.ReadFull(r.in, buf); err != nil {
 		return fmt.Errorf("symlink content read err: %v", err)
 	}
-	content := string(buf)
-	// This file may already exist.
-	if err := RemoveIfExist(hdr.path); err != nil {
+	if err := r.checkDigest(hdr, sha256Sum(buf)); err != nil {
 		return err
 	}
-	if err := os.Symlink(content, hdr.path); err != nil {
-		return err
+	if keep, err := r.postFile(hdr, ""); !keep {
+		return r.itemFailed(hdr.path, err)
 	}
-	// OBS! We can't set perms _nor_ times on symlinks. See documentation
-	// on the methods fixTimesAndPerms and fixTimes
-	return nil
+	var (
+		content = string(buf)
+		path    = r.local(hdr.path)
+	)
+	// This file may already exist.
+	action := auditCreate
+	if _, err := r.fs.Lstat(path); err == nil {
+		action = auditUpdate
+	}
+	if err := r.replaceItem(path, func() error { return r.fs.Symlink(content, path) }); err != nil {
+		return r.itemFailed(hdr.path, err)
+	}
+	// OBS! We can't set perms on symlinks, only the owner and times. See
+	// documentation on the methods fixTimesAndPerms and fixTimes
+	if err := r.fixOwner(hdr); err != nil {
+		return r.itemFailed(hdr.path, err)
+	}
+	if err := r.fixTimes(hdr); err != nil {
+		return r.itemFailed(hdr.path, err)
+	}
+	return r.audit.record(action, r.localPath(hdr.path), fileSize, crc32.ChecksumIEEE(buf))
 }
 
 // visitDir either push the path to the stack, or, if the topmost item
@@ -304,6 +1103,56 @@ func (r *Receiver) visitDir(path string) bool {
 	return false
 }
 
+// checkPath verifies that the given item is where it belongs. Since the
+// receiver is not necessarily jailed, a path must not lead outside of the
+// sync directory: it must be relative and clean, without "..", and within
+// the directory currently being received. Each path may only be received
+// once, so a file or symlink can't replace a directory which has already
+// been populated (and a symlink can't be followed when writing the
+// contents).
+func (r *Receiver) checkPath(hdr *fileHeader) error {
+	path := hdr.path
+	if path == "" || path == "." || path == ".." || filepath.IsAbs(path) ||
+		filepath.Clean(path) != path || strings.HasPrefix(path, "../") {
+		return fmt.Errorf("invalid path %q", path)
+	}
+	top := "."
+	if len(r.dirStack) > 0 {
+		top = r.dirStack[len(r.dirStack)-1]
+		if hdr.isDir() && top == path {
+			// Leaving the directory
+			return nil
+		}
+	}
+	if filepath.Dir(path) != top || (top == "." && len(r.paths) > 0) {
+		return fmt.Errorf("path %v is not within the current directory", path)
+	}
+	if _, seen := r.paths[path]; seen {
+		return fmt.Errorf("path %v received twice", path)
+	}
+	r.paths[path] = struct{}{}
+	return nil
+}
+
+// checkLimits verifies that the given item does not make the tree exceed the
+// depth- or directory size limits.
+func (r *Receiver) checkLimits(hdr *fileHeader) error {
+	if depth := strings.Count(hdr.path, "/") + 1; depth > r.maxDepth {
+		return fmt.Errorf("%w: path depth %d exceeds %d: %v", ErrLimitExceeded, depth, r.maxDepth, hdr.path)
+	}
+	if hdr.isDir() && len(r.dirStack) > 0 && r.dirStack[len(r.dirStack)-1] == hdr.path {
+		// Leaving the directory. The count is kept, since a sender may
+		// enter the same directory again
+		return nil
+	}
+	parent := filepath.Dir(hdr.path)
+	r.dirEntries[parent]++
+	if n := r.dirEntries[parent]; n > r.maxDirEntries {
+		return fmt.Errorf("%w: number of entries in %v exceeds %d", ErrLimitExceeded, parent, r.maxDirEntries)
+	}
+	return nil
+}
+
 // deferFixTimesAndPerms saves the times and perms for the given path, so that
 // we can set that later, when we're done with all file operations on it
 func (r *Receiver) deferFixTimesAndPerms(hdr *fileHeader) {
@@ -312,127 +1161,397 @@ func (r *Receiver) deferFixTimesAndPerms(hdr *fileHeader) {
 
 func (r *Receiver) processItemMetadata(hdr *fileHeader) error {
 	var err error
-	if hdr.isDir() {
+	if r.archive != nil && (hdr.isDir() || hdr.isSymlink() || hdr.isRegular()) {
+		err = r.archiveMetadata(hdr)
+	} else if r.store != nil && (hdr.isDir() || hdr.isSymlink() || hdr.isRegular()) {
+		err = r.storeMetadata(hdr)
+	} else if hdr.isDir() {
 		err = r.receiveDirMetadata(hdr)
 	} else if hdr.isSymlink() || hdr.isRegular() {
 		err = r.receiveFileMetadata(hdr)
 	} else {
-		return fmt.Errorf("unknown file Mode %x", hdr.Data.Mode)
+		return protocolErrorf("unknown file Mode %x", hdr.Data.Mode)
 	}
 	return err
 }
 
+// rootNames are the names which, in the synced directory, make it look like the
+// root of a system, see snapshotFiles.
+var rootNames = []string{
+	"bin", "boot", "dev", "etc", "home", "lost+found",
+	"media", "mnt", "opt", "proc", "root",
+	"sbin", "srv", "sys", "usr", "var",
+}
+
+// snapshotFiles remembers the names in the local directory dir, being
+// received, until the sender is done with it, see endSnapshot. The names are
+// read a batch at a time, and only the names: a huge directory isn't listed
+// with the info of every entry in memory at once.
 func (r *Receiver) snapshotFiles(dir string, checkRoot bool) error {
-	// Build up the list of existing files (on the current directory level)
-	files, err := ioutil.ReadDir(dir)
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if _, ok := r.snapshots[dir]; ok {
+		// The synced directory is snapshotted before it's received
+		return nil
+	}
+	f, err := r.fs.Open(dir)
 	if err != nil && os.IsNotExist(err) {
 		return nil
 	}
 	if err != nil {
 		return err
 	}
-	for _, f := range files {
-		fullPath, err := filepath.Abs(filepath.Join(dir, f.Name()))
+	defer f.Close()
+	names := make(map[string]struct{})
+	for {
+		batch, err := f.Readdirnames(dirBatch)
+		for _, name := range batch {
+			names[name] = struct{}{}
+		}
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
 			return err
 		}
-		r.toDelete[fullPath] = struct{}{}
 	}
 	// We are supposed to be chrooted, and therefore unable to actually
 	// delete files arbitrarily. However, better safe than sorry, so this
 	// program will simply throw an error if it "looks like" we're not in a
 	// chroot but in an actual root
 	if checkRoot {
-		blackList := []string{
-			"bin", "boot", "dev", "etc", "home", "lost+found",
-			"media", "mnt", "opt", "proc", "root",
-			"sbin", "srv", "sys", "usr", "var",
-		}
-		for _, nope := range blackList {
-			if _, exist := r.toDelete[filepath.Join(dir, nope)]; exist {
+		for _, nope := range rootNames {
+			if _, exist := names[nope]; exist {
 				return fmt.Errorf("file %v in receiver root, bailing out", nope)
 			}
 		}
 	}
+	r.snapshots[dir] = names
 	return nil
 }
 
+// removeSnapshot takes the item at path, received, off the snapshot of its
+// directory.
 func (r *Receiver) removeSnapshot(path string) error {
-	fullpath, err := filepath.Abs(path)
+	fullpath, err := filepath.Abs(r.local(path))
 	if err != nil {
 		return err
 	}
+	delete(r.snapshots[filepath.Dir(fullpath)], filepath.Base(fullpath))
+	// A renamed item may be placed in a directory which is done already
 	delete(r.toDelete, fullpath)
 	return nil
 }
 
+// endSnapshot adds what's left in the snapshot of the directory at path, which
+// the sender is done with, to toDelete. Only the snapshots of the directories
+// being received are kept.
+func (r *Receiver) endSnapshot(path string) error {
+	dir, err := filepath.Abs(r.local(path))
+	if err != nil {
+		return err
+	}
+	for name := range r.snapshots[dir] {
+		r.toDelete[filepath.Join(dir, name)] = struct{}{}
+	}
+	delete(r.snapshots, dir)
+	return nil
+}
+
 func (r *Receiver) receiveMetadata() error {
 	var lastName string
 	firstItem := true
 
+	if r.subtreesOffered {
+		if err := r.receiveSubtrees(); err != nil {
+			return fmt.Errorf("failed reading subtrees: %v", err)
+		}
+	}
+	src := r.in
+	if r.signed {
+		// Nothing may be changed until the signature is verified
+		var err error
+		if src, r.digests, err = receiveSigned(r.in, r.ropts.TrustedKey); err != nil {
+			// The sender is done with the metadata, and waits for the result
+			return r.fail(err, "")
+		}
+		if r.ropts.TrustedKey == nil && r.opts.Verbosity >= 2 {
+			log.Print("Transfer is signed, but no trusted key is configured")
+		}
+	}
+	next := func() (*fileHeader, error) { return readHeader(src, r.inlineMax, r.ownersSent) }
+	if r.queue != nil {
+		next = r.nextQueued
+	}
 	for {
-		hdr, err := unMarshallBinary(r.in)
+		hdr, err := next()
 		if err != nil {
 			return err
 		}
+		if isAbortFrame(hdr) {
+			return ErrSenderAborted
+		}
+		if !r.chown {
+			// Not compared either, see FlagOwners
+			hdr.owner = nil
+		}
 		// Check for end of transfer marker
 		if hdr.Data.NameLen == 0 {
+			if len(r.dirStack) > 0 && r.failure == nil {
+				// Unless the items weren't looked at, see below
+				r.failure = protocolErrorf("directory %v not left by the end of the metadata", r.dirStack[len(r.dirStack)-1])
+			}
 			break
 		}
-		r.totalFiles++
-		if r.filesLimit > 0 && int(r.totalFiles) > r.filesLimit {
-			return fmt.Errorf("number of files (%d) exceeded limit (%d)", r.totalFiles, r.filesLimit)
+		if r.summaryOffered {
+			// The sender waits for it, before sending anything else
+			r.summaryOffered = false
+			if err := r.sendSummary(hdr); err != nil {
+				return err
+			}
 		}
-		if firstItem{
-			// First item should be the directory the remote side is synching
-			if !hdr.isDir(){
-				return fmt.Errorf("Expected director as first entry, got %v", hdr.path)
+		if r.isAborted() || r.dataFailed() || r.failure != nil {
+			// Keep reading until the end of the metadata, so we can
+			// deliver the result where the sender expects it
+			continue
+		}
+		if err := r.receiveItemMetadata(hdr, firstItem); err != nil {
+			// As when aborted, the failure is the result
+			r.failure = err
+			continue
+		}
+		firstItem = false
+		lastName = hdr.path
+	}
+	if r.summarized {
+		if err := r.receiveDeletions(src); err != nil {
+			return err
+		}
+	}
+	if r.overlapOffered {
+		if err := r.endRequests(); err != nil {
+			return err
+		}
+	}
+	if r.lazyHashing {
+		if err := r.receiveHashes(); err != nil {
+			return err
+		}
+		if err := r.receiveInlined(); err != nil {
+			return err
+		}
+	}
+	if r.isAborted() {
+		return r.abort(lastName)
+	}
+	if r.dataFailed() {
+		// The error is that of receiveRequested
+		return errDataFailed
+	}
+	if r.failure != nil {
+		return r.fail(r.failure, lastName)
+	}
+	if err := r.sendStatusAndCrc(CodeOK, lastName); err != nil {
+		return err
+	}
+	return r.out.Flush()
+}
+
+// receiveItemMetadata handles a header of the metadata, other than the end
+// marker. The first is that of the directory synced.
+func (r *Receiver) receiveItemMetadata(hdr *fileHeader, first bool) error {
+	r.totalFiles++
+	hdr.marshallBinary(r.metaHash)
+	// After the hash, which is of what the sender sent
+	r.dropSetID(hdr)
+	if r.filesLimit > 0 && int(r.totalFiles) > r.filesLimit {
+		return fmt.Errorf("%w: number of files (%d) exceeds %d", ErrLimitExceeded, r.totalFiles, r.filesLimit)
+	}
+	if first {
+		// First item should be the directory the remote side is synching
+		if !hdr.isDir() {
+			return protocolErrorf("Expected director as first entry, got %v", hdr.path)
+		}
+		if hdr.path == StateDir {
+			return protocolErrorf("directory name %v is reserved", StateDir)
+		}
+		r.dir = hdr.path
+		if r.store == nil && r.archive == nil {
+			if err := r.snapshotFiles(r.local(hdr.path), true); err != nil {
+				return fmt.Errorf("snapshot failed: %w", localIOError(hdr.path, err))
 			}
-			if err := r.snapshotFiles(fmt.Sprintf("./%v", hdr.path), true); err != nil {
-				return fmt.Errorf("snapshot failed: %v", err)
+		}
+		if r.stage != "" {
+			if err := r.checkLive(hdr.path); err != nil {
+				return err
 			}
-			firstItem = false
 		}
-		r.removeSnapshot(hdr.path)
-		if err := r.processItemMetadata(hdr); err != nil {
-			return fmt.Errorf("error processing metadata for %v: %v", hdr.path, err)
+	}
+	if err := r.checkPath(hdr); err != nil {
+		return &ProtocolError{err}
+	}
+	if err := r.checkLimits(hdr); err != nil {
+		return err
+	}
+	skip, err := r.filter(hdr)
+	if err != nil {
+		return err
+	}
+	r.removeSnapshot(hdr.path)
+	if skip {
+		// Keep the indexes and the directory stack in order
+		if hdr.isDir() {
+			r.visitDir(hdr.path)
 		} else {
-			lastName = hdr.path
+			hdr.inline = nil
+			r.items = append(r.items, hdr)
+			r.index++
 		}
+		return nil
 	}
-	if err := r.sendStatusAndCrc(0, lastName); err != nil {
-		return err
+	inlined, pending := len(r.inlined), len(r.hashPending)
+	if err := r.processItemMetadata(hdr); err != nil {
+		return fmt.Errorf("error processing metadata for %v: %w", hdr.path, localIOError(hdr.path, err))
 	}
-	return r.out.Flush()
+	if len(r.inlined) == inlined && len(r.hashPending) == pending {
+		// Not requested, so the content is not needed
+		hdr.inline = nil
+	}
+	return r.receiveInlined()
 }
 
 func (r *Receiver) receiveFullData() error {
-	var lastName string
-	for _, index := range r.requestList {
-		hdr, err := unMarshallBinary(r.in)
-		if err != nil {
+	var (
+		lastName string
+		streams  *inStreams
+		in       = r.in
+	)
+	if r.streams > 1 {
+		streams = newInStreams(r.raw, r.streams, r.opts.Compression == CompressionSnappy)
+		defer streams.stop()
+		// The items are read from r.in, which is their stream
+		defer func() { r.in = in }()
+	}
+	// The files handed over to be put in place are waited for, whatever
+	// happens
+	defer r.waitFinished()
+	for _, index := range r.inlined {
+		if r.isAborted() {
+			r.waitFinished()
+			return r.abort(lastName)
+		}
+		if err := r.receiveInline(index, r.items[index]); err != nil {
 			return err
 		}
-		if hdr.isRegular() {
-			err = r.receiveRegularFileFullData(hdr)
-		} else if hdr.isSymlink() {
-			err = r.receiveSymlinkFullData(hdr)
+		lastName = r.items[index].path
+	}
+	for i, index := range r.requestList {
+		if r.isAborted() {
+			r.waitFinished()
+			return r.abort(lastName)
 		}
-		if err != nil {
+		if streams != nil {
+			r.in = streams.streams[i%r.streams]
+		}
+		if err := r.receivePacked(index, r.items[index]); err != nil {
 			return err
 		}
-		lastName = hdr.path
-		if r.opts.Verbosity >= 4 {
-			log.Printf("Got file %d (%v)", index, lastName)
+		lastName = r.items[index].path
+	}
+	if err := r.endPacked(); err != nil {
+		return err
+	}
+	if err := r.waitFinished(); err != nil {
+		return err
+	}
+	if streams != nil {
+		if err := streams.close(); err != nil {
+			return err
 		}
 	}
-	if err := r.sendStatusAndCrc(0, lastName); err != nil {
+	if err := r.startDeletions(); err != nil {
+		return err
+	}
+	if err := r.sendStatusAndCrc(CodeOK, lastName); err != nil {
 		return err
 	}
 	return r.out.Flush()
 }
 
-func (r *Receiver) sendStatusAndCrc(code int, lastFilename string) error {
+// receiveItem receives the content of the item with the given index, whose
+// metadata was announced.
+func (r *Receiver) receiveItem(index uint32, announced *fileHeader) error {
+	hdr, err := unMarshallBinary(r.in)
+	if err != nil {
+		return err
+	}
+	if isAbortFrame(hdr) {
+		return ErrSenderAborted
+	}
+	if r.isGone(hdr, announced) {
+		return r.receiveGone(hdr)
+	}
+	// The sender could otherwise write wherever it pleases
+	if hdr.path != announced.path ||
+		hdr.isRegular() != announced.isRegular() || hdr.isSymlink() != announced.isSymlink() {
+		return protocolErrorf("got %v, expected item %d (%v)", hdr.path, index, announced.path)
+	}
+	hdr.owner = announced.owner
+	r.dropSetID(hdr)
+	if r.signed {
+		if err := checkSignedItem(announced, hdr); err != nil {
+			return err
+		}
+		r.digest = r.digests[index]
+	}
+	var (
+		source *fileHeader
+		src    uint32
+	)
+	if r.dedup && hdr.isRegular() {
+		if source, src, err = r.readCloneSource(index, hdr); err != nil {
+			return err
+		}
+	}
+	r.trailer = r.digestsSent && hdr.isRegular() && source == nil
+	return r.receiveContent(index, hdr, source, src)
+}
+
+// receiveContent receives the content of the item with the given index, whose
+// header was read, or clones it from source, see FlagDedup.
+func (r *Receiver) receiveContent(index uint32, hdr, source *fileHeader, src uint32) error {
+	var err error
+	if source != nil {
+		err = r.itemFailed(hdr.path, r.receiveClone(hdr, source, src))
+	} else if r.archive != nil {
+		err = r.archiveFullData(hdr)
+	} else if r.store != nil {
+		err = r.storeFullData(hdr)
+	} else if hdr.isRegular() {
+		err = r.receiveRegularFileFullData(hdr)
+	} else if hdr.isSymlink() {
+		err = r.receiveSymlinkFullData(hdr)
+	}
+	if err != nil {
+		return localIOError(hdr.path, err)
+	}
+	if r.dedup && hdr.isRegular() && source == nil {
+		r.cloneable[index] = struct{}{}
+	}
+	if r.opts.Verbosity >= 4 {
+		log.Printf("Got file %d (%v)", index, hdr.path)
+	}
+	r.received++
+	r.countDone(hdr.Data.FileLen)
+	if r.ropts.Progress != nil {
+		r.ropts.Progress(hdr.path, hdr.Data.FileLen)
+	}
+	return nil
+}
+
+func (r *Receiver) sendStatusAndCrc(code ErrorCode, lastFilename string) error {
 	result := &resultHeader{
 		ErrorCode: uint32(code),
 	}
@@ -449,6 +1568,8 @@ func (r *Receiver) sendStatusAndCrc(code int, lastFilename string) error {
 	if err := extension.marshallBinary(r.out); err != nil {
 		return fmt.Errorf("failed sending result extension: %v", err)
 	}
+	r.results++
+	r.lastCode = code
 	return nil
 }
 
@@ -456,10 +1577,7 @@ func (r *Receiver) requestFiles() error {
 	if r.opts.Verbosity >= 3 {
 		log.Printf("Requesting %d files", len(r.requestList))
 	}
-	if err := binary.Write(r.out, binary.LittleEndian, uint32(len(r.requestList))); err != nil {
-		return err
-	}
-	if err := binary.Write(r.out, binary.LittleEndian, r.requestList); err != nil {
+	if err := writeRequests(r.out, r.requestList); err != nil {
 		return err
 	}
 	return r.out.Flush()
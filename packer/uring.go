@@ -0,0 +1,399 @@
+package packer
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// With Options.IOUring (and ReceiverOptions.IOUring), the content of large
+// files is read by the sender, and written by the receiver, through an
+// io_uring(7): uringDepth chunks of a file are in flight at once, and one
+// syscall submits the next ones and reaps those completed. The disk works
+// ahead of (or behind) the connection, and a large file takes a fraction of
+// the syscalls, which are comparatively expensive within a VM. A kernel
+// without io_uring (before 5.6), or with it disabled, falls back to plain
+// reads and writes.
+
+const (
+	// uringMin is the smallest file which goes through a ring. For smaller
+	// ones, a plain read or write is as good.
+	uringMin = 1 << 20
+	// uringChunk is the size of each read or write.
+	uringChunk = 256 * 1024
+	// uringDepth is the number of chunks in flight.
+	uringDepth = 8
+)
+
+const (
+	sysIOUringSetup = unix.SYS_IO_URING_SETUP
+	sysIOUringEnter = unix.SYS_IO_URING_ENTER
+
+	uringOffSqRing = 0
+	uringOffSqes   = 0x10000000
+
+	uringEnterGetEvents = 1 << 0
+
+	uringFeatSingleMmap = 1 << 0
+	uringFeatRwCurPos   = 1 << 3 // since 5.6, as are the ops below
+
+	uringOpRead  = 22
+	uringOpWrite = 23
+)
+
+// errNoUring is returned by newUring if the kernel has no (usable) io_uring.
+var errNoUring = errors.New("io_uring not supported")
+
+// uringParams is struct io_uring_params.
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        struct{ head, tail, ringMask, ringEntries, flags, dropped, array, resv1, resv2, resv3 uint32 }
+	cqOff        struct{ head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1, resv2, resv3 uint32 }
+}
+
+// uringSQE is struct io_uring_sqe, as used for reads and writes.
+type uringSQE struct {
+	opcode   uint8
+	flags    uint8
+	ioprio   uint16
+	fd       int32
+	off      uint64
+	addr     uint64
+	len      uint32
+	rwFlags  uint32
+	userData uint64
+	pad      [3]uint64
+}
+
+// uringCQE is struct io_uring_cqe.
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring is an io_uring of uringDepth entries, with a buffer for each. It's
+// used by one goroutine at a time, see uringPool.
+type uring struct {
+	fd   int
+	ring []byte // the submission and completion rings, mapped as one
+	sqes []byte
+	bufs [uringDepth][]byte
+
+	sqHead, sqTail, sqMask *uint32
+	sqArray                unsafe.Pointer
+	cqHead, cqTail, cqMask *uint32
+	cqes                   unsafe.Pointer
+
+	toSubmit uint32 // entries queued since the last enter
+}
+
+// newUring sets up a ring, or returns errNoUring.
+func newUring() (*uring, error) {
+	var p uringParams
+	fd, _, errno := syscall.Syscall(sysIOUringSetup, uringDepth, uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, errNoUring
+	}
+	u := &uring{fd: int(fd)}
+	if p.features&uringFeatSingleMmap == 0 || p.features&uringFeatRwCurPos == 0 {
+		u.close()
+		return nil, errNoUring
+	}
+	size := p.sqOff.array + p.sqEntries*4
+	if cqSize := p.cqOff.cqes + p.cqEntries*uint32(unsafe.Sizeof(uringCQE{})); cqSize > size {
+		size = cqSize
+	}
+	var err error
+	if u.ring, err = syscall.Mmap(u.fd, uringOffSqRing, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		u.close()
+		return nil, err
+	}
+	if u.sqes, err = syscall.Mmap(u.fd, uringOffSqes, int(p.sqEntries)*int(unsafe.Sizeof(uringSQE{})), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		u.close()
+		return nil, err
+	}
+	at := func(off uint32) unsafe.Pointer { return unsafe.Pointer(&u.ring[off]) }
+	u.sqHead, u.sqTail, u.sqMask = (*uint32)(at(p.sqOff.head)), (*uint32)(at(p.sqOff.tail)), (*uint32)(at(p.sqOff.ringMask))
+	u.sqArray = at(p.sqOff.array)
+	u.cqHead, u.cqTail, u.cqMask = (*uint32)(at(p.cqOff.head)), (*uint32)(at(p.cqOff.tail)), (*uint32)(at(p.cqOff.ringMask))
+	u.cqes = at(p.cqOff.cqes)
+	for i := range u.bufs {
+		u.bufs[i] = make([]byte, uringChunk)
+	}
+	return u, nil
+}
+
+func (u *uring) close() {
+	if u.sqes != nil {
+		syscall.Munmap(u.sqes)
+	}
+	if u.ring != nil {
+		syscall.Munmap(u.ring)
+	}
+	syscall.Close(u.fd)
+}
+
+// queue queues a read or write of buf at off of the file, to be submitted by
+// the next wait. There's room, as long as no more than uringDepth are in
+// flight.
+func (u *uring) queue(op uint8, fd int, buf []byte, off int64, id uint64) {
+	tail := atomic.LoadUint32(u.sqTail)
+	idx := tail & *u.sqMask
+	sqe := (*uringSQE)(unsafe.Pointer(&u.sqes[uintptr(idx)*unsafe.Sizeof(uringSQE{})]))
+	*sqe = uringSQE{
+		opcode:   op,
+		fd:       int32(fd),
+		off:      uint64(off),
+		addr:     uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		len:      uint32(len(buf)),
+		userData: id,
+	}
+	*(*uint32)(unsafe.Pointer(uintptr(u.sqArray) + uintptr(idx)*4)) = idx
+	atomic.StoreUint32(u.sqTail, tail+1)
+	u.toSubmit++
+}
+
+// wait submits what's queued, and returns the next completion. It fails only
+// if the ring does, the result of the read or write is in the completion.
+func (u *uring) wait() (uringCQE, error) {
+	for {
+		head := atomic.LoadUint32(u.cqHead)
+		if head != atomic.LoadUint32(u.cqTail) && u.toSubmit == 0 {
+			cqe := *(*uringCQE)(unsafe.Pointer(uintptr(u.cqes) + uintptr(head&*u.cqMask)*unsafe.Sizeof(uringCQE{})))
+			atomic.StoreUint32(u.cqHead, head+1)
+			return cqe, nil
+		}
+		n, _, errno := syscall.Syscall6(sysIOUringEnter, uintptr(u.fd), uintptr(u.toSubmit), 1, uringEnterGetEvents, 0, 0)
+		switch {
+		case errno == 0:
+			u.toSubmit -= uint32(n)
+		case errno != syscall.EINTR:
+			return uringCQE{}, errno
+		}
+	}
+}
+
+// uringPool holds the rings of a sync, one for each goroutine reading or
+// writing a file at once.
+type uringPool struct {
+	mu    sync.Mutex
+	rings []*uring // the ones not in use
+	all   []*uring
+	off   bool // set when the kernel has no io_uring
+}
+
+// get returns a ring, or nil if there's none to be had.
+func (p *uringPool) get() *uring {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n := len(p.rings); n > 0 {
+		u := p.rings[n-1]
+		p.rings = p.rings[:n-1]
+		return u
+	}
+	if p.off {
+		return nil
+	}
+	u, err := newUring()
+	if err != nil {
+		p.off = true
+		return nil
+	}
+	p.all = append(p.all, u)
+	return u
+}
+
+func (p *uringPool) put(u *uring) {
+	p.mu.Lock()
+	p.rings = append(p.rings, u)
+	p.mu.Unlock()
+}
+
+// close closes the rings, which are all put back.
+func (p *uringPool) close() {
+	if p == nil {
+		return
+	}
+	for _, u := range p.all {
+		u.close()
+	}
+	p.rings, p.all = nil, nil
+}
+
+// uringFile reads or writes a file through a ring, uringChunk at a time.
+type uringFile struct {
+	pool   *uringPool
+	u      *uring
+	fd     int
+	path   string
+	bufs   [uringDepth][]byte // those of u
+	busy   [uringDepth]bool   // whether the chunk of each buffer is in flight
+	want   [uringDepth]int    // bytes to read into, or write from, each buffer
+	got    [uringDepth]int    // bytes read, or written
+	off    int64              // of the next chunk to read, or write
+	err    error
+	broken bool // set if the ring failed, and is not to be used again
+
+	// When reading, the chunks are consumed in order, from that in buffer
+	// head
+	started bool
+	head    int
+	pos     int  // within the head buffer
+	eof     bool // set once a chunk is short
+}
+
+// newUringFile returns a uringFile for f, if it's large enough and a ring is
+// available, otherwise nil. It's used for either reading or writing, from
+// the start of the file, and then released.
+func newUringFile(pool *uringPool, f *os.File, size int64) *uringFile {
+	if size < uringMin {
+		return nil
+	}
+	u := pool.get()
+	if u == nil {
+		return nil
+	}
+	return &uringFile{pool: pool, u: u, fd: int(f.Fd()), path: f.Name(), bufs: u.bufs}
+}
+
+// reap waits for the next completion.
+func (uf *uringFile) reap() {
+	cqe, err := uf.u.wait()
+	if err != nil {
+		uf.broken = true
+		uf.fail(err)
+		return
+	}
+	i := cqe.userData
+	uf.busy[i] = false
+	if cqe.res < 0 {
+		uf.got[i] = 0
+		uf.fail(syscall.Errno(-cqe.res))
+		return
+	}
+	uf.got[i] = int(cqe.res)
+}
+
+func (uf *uringFile) fail(err error) {
+	if uf.err == nil {
+		uf.err = &os.PathError{Op: "io_uring", Path: uf.path, Err: err}
+	}
+}
+
+// Write queues p to be written, waiting for earlier chunks to be written as
+// needed. What fails to be written is reported by a later Write, or Flush.
+func (uf *uringFile) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 && uf.err == nil {
+		i := uf.free()
+		if i < 0 {
+			uf.reap()
+			continue
+		}
+		if uf.got[i] < uf.want[i] {
+			// Only regular files are written, which are never
+			// written in part but for an error
+			uf.err = io.ErrShortWrite
+			break
+		}
+		n := copy(uf.bufs[i], p)
+		uf.busy[i], uf.want[i], uf.got[i] = true, n, 0
+		uf.u.queue(uringOpWrite, uf.fd, uf.bufs[i][:n], uf.off, uint64(i))
+		uf.off += int64(n)
+		p, written = p[n:], written+n
+	}
+	return written, uf.err
+}
+
+// Flush waits for the chunks written so far.
+func (uf *uringFile) Flush() error {
+	for uf.inFlight() && !uf.broken {
+		uf.reap()
+	}
+	for i := range uf.got {
+		if uf.got[i] < uf.want[i] && uf.err == nil {
+			uf.err = io.ErrShortWrite
+		}
+	}
+	return uf.err
+}
+
+// Read returns the content of the file, the chunks after it in flight.
+func (uf *uringFile) Read(p []byte) (int, error) {
+	if !uf.started {
+		uf.started = true
+		for i := range uf.bufs {
+			uf.readChunk(i)
+		}
+	}
+	for {
+		switch {
+		case uf.err != nil:
+			return 0, uf.err
+		case uf.busy[uf.head]:
+			uf.reap()
+		case uf.pos < uf.got[uf.head]:
+			n := copy(p, uf.bufs[uf.head][uf.pos:uf.got[uf.head]])
+			uf.pos += n
+			return n, nil
+		case uf.eof || uf.got[uf.head] < uf.want[uf.head]:
+			// The chunks after a short one are left alone, even if
+			// the file grew in between
+			uf.eof = true
+			return 0, io.EOF
+		default:
+			uf.readChunk(uf.head)
+			uf.head, uf.pos = (uf.head+1)%uringDepth, 0
+		}
+	}
+}
+
+// readChunk queues the read of the next chunk into buffer i.
+func (uf *uringFile) readChunk(i int) {
+	uf.busy[i], uf.want[i], uf.got[i] = true, uringChunk, 0
+	uf.u.queue(uringOpRead, uf.fd, uf.bufs[i], uf.off, uint64(i))
+	uf.off += uringChunk
+}
+
+// free returns a buffer not in flight, or -1.
+func (uf *uringFile) free() int {
+	for i, busy := range uf.busy {
+		if !busy {
+			return i
+		}
+	}
+	return -1
+}
+
+func (uf *uringFile) inFlight() bool {
+	return uf.busy != [uringDepth]bool{}
+}
+
+// Release waits for the chunks in flight, and puts the ring back, unless it
+// failed. The file is left to the caller to close.
+func (uf *uringFile) Release() error {
+	for uf.inFlight() && !uf.broken {
+		uf.reap()
+	}
+	if !uf.broken {
+		uf.pool.put(uf.u)
+	}
+	return uf.err
+}
@@ -2,13 +2,14 @@ package packer
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
 	"github.com/golang/snappy"
-	"hash/crc32"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 func SetupLogging() {
@@ -22,17 +23,20 @@ func SetupLogging() {
 // reads a NULL-terminated string from r
 func ReadPath(in io.Reader, length uint32) (string, error) {
 	if length > MaxPathLength-1 {
-		return "", fmt.Errorf("path too large (%d characters)", length)
+		return "", protocolErrorf("path too large (%d characters)", length)
 	}
 	if length == 0 {
 		return "", nil
 	}
-	nBuf := make([]byte, length)
+	buf := getHeaderBuf(int(length))
+	defer headerPool.Put(buf)
+	nBuf := *buf
 	if n, err := io.ReadFull(in, nBuf); err != nil {
 		return "", fmt.Errorf("read err, wanted %d, got only %d: %v", length, n, err)
 	}
 	if nBuf[length-1] != 0 {
-		return "", fmt.Errorf("expected NULL-terminated string")
+		// The length doesn't match the path
+		return "", protocolErrorf("expected NULL-terminated string")
 	}
 	return string(nBuf[:length-1]), nil
 }
@@ -41,9 +45,11 @@ func ReadPath(in io.Reader, length uint32) (string, error) {
 func WritePath(out io.Writer, path string) error {
 	// write path with zero-suffix
 	if len(path) != 0 {
-		buf := make([]byte, len(path)+1)
-		copy(buf, path)
-		_, err := out.Write(buf)
+		buf := getHeaderBuf(len(path) + 1)
+		defer headerPool.Put(buf)
+		copy(*buf, path)
+		(*buf)[len(path)] = 0
+		_, err := out.Write(*buf)
 		if err != nil {
 			return err
 		}
@@ -52,7 +58,7 @@ func WritePath(out io.Writer, path string) error {
 }
 func RemoveIfExist(path string) error {
 
-	info, err := os.Stat(path)
+	info, err := os.Lstat(path)
 
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -62,7 +68,7 @@ func RemoveIfExist(path string) error {
 			if err := os.Chmod(path, 0700); err != nil {
 				return fmt.Errorf("failed changing perms: %v", err)
 			}
-			info, err = os.Stat(path)
+			info, err = os.Lstat(path)
 		}
 		if err != nil {
 			return err
@@ -74,56 +80,129 @@ func RemoveIfExist(path string) error {
 	return os.Remove(path)
 }
 
-var readBuf = make([]byte, 64*1000)
+// bufPool holds the buffers used for reading files, so that several senders
+// and receivers can run in the same process.
+var bufPool = sync.Pool{
+	New: func() interface{} { return make([]byte, 64*1000) },
+}
+
+// headerPool holds the buffers used for encoding and decoding headers and
+// paths, so that the metadata phase doesn't allocate for each item. They are
+// pointers, for Put not to allocate either.
+var headerPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 256)
+		return &b
+	},
+}
+
+// getHeaderBuf returns a buffer of n bytes from headerPool, to be put back
+// when done.
+func getHeaderBuf(n int) *[]byte {
+	b := headerPool.Get().(*[]byte)
+	if cap(*b) < n {
+		*b = make([]byte, n)
+	}
+	*b = (*b)[:n]
+	return b
+}
 
 // CrcFile return the crc32 using IEEETable.
 // If file is directory, symlink or empty, it return crc 0
-// This method is not at all safe for concurrent usage, as it
-// reuses an internal buffer
 func CrcFile(path string, stat os.FileInfo) (uint32, error) {
-	if !stat.Mode().IsRegular() {
-		return 0, nil
+	return crcItem(osSource{}, path, stat)
+}
+
+// CopyFile copies size bytes from input to output, with a buffer from bufPool.
+// Each chunk is read in full, however short the reads of input are, and if
+// input ends before size bytes, it fails with io.ErrUnexpectedEOF.
+func CopyFile(input io.Reader, output io.Writer, size int) error {
+	readBuf := bufPool.Get().([]byte)
+	defer bufPool.Put(readBuf)
+	for size > 0 {
+		chunk := readBuf
+		if size < len(chunk) {
+			chunk = chunk[:size]
+		}
+		n, err := io.ReadFull(input, chunk)
+		if err != nil {
+			return shortContent(size-n, err)
+		}
+		if _, err := output.Write(chunk); err != nil {
+			return err
+		}
+		size -= n
 	}
-	var (
-		size = stat.Size()
-		crc  uint32
-	)
-	if size == 0 {
-		return 0, nil
+	return nil
+}
+
+// shortContent returns the error of a read which failed with missing bytes of
+// content still to come. An EOF is unexpected at that point.
+func shortContent(missing int, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("content ended %d bytes short: %w", missing, io.ErrUnexpectedEOF)
 	}
-	file, err := os.Open(path)
-	if err != nil {
-		return 0, err
+	return err
+}
+
+// requestBatch is the most indexes of a request list which are read, or
+// written, at once.
+const requestBatch = 4096
+
+// readRequests reads a request list from in: the number of indexes, which may
+// be no more than max, and the indexes. They're read a batch of requestBatch
+// at a time, so that the list only takes up the memory of what was actually
+// received, rather than what the count claims.
+func readRequests(in io.Reader, max uint32) ([]uint32, error) {
+	var count uint32
+	if err := binary.Read(in, binary.LittleEndian, &count); err != nil {
+		return nil, err
 	}
-	defer file.Close()
-	for size > 0 {
-		n, err := file.Read(readBuf)
-		if err != nil {
-			return 0, err
+	if count > max {
+		return nil, fmt.Errorf("remote requested %d items, only %d possible", count, max)
+	}
+	var (
+		list []uint32
+		buf  = make([]byte, 4*requestBatch)
+	)
+	for left := count; left > 0; {
+		n := left
+		if n > requestBatch {
+			n = requestBatch
+		}
+		if _, err := io.ReadFull(in, buf[:4*n]); err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < n; i++ {
+			list = append(list, binary.LittleEndian.Uint32(buf[4*i:]))
 		}
-		crc = crc32.Update(crc, crc32.IEEETable, readBuf[:n])
-		size -= int64(n)
+		left -= n
 	}
-	return crc, nil
+	return list, nil
 }
 
-func CopyFile(input io.Reader, output io.Writer, size int) error {
-	bufSize := len(readBuf)
-	for size > 0 {
-		// read a chunk
-		maxRead := bufSize
-		if size < maxRead {
-			maxRead = size
+// writeRequests writes a request list to out, a batch of indexes at a time.
+func writeRequests(out io.Writer, list []uint32) error {
+	if err := binary.Write(out, binary.LittleEndian, uint32(len(list))); err != nil {
+		return err
+	}
+	n := len(list)
+	if n > requestBatch {
+		n = requestBatch
+	}
+	buf := make([]byte, 4*n)
+	for len(list) > 0 {
+		batch := list
+		if len(batch) > requestBatch {
+			batch = batch[:requestBatch]
 		}
-		n, err := input.Read(readBuf[:maxRead])
-		if err != nil {
-			return err
+		for i, index := range batch {
+			binary.LittleEndian.PutUint32(buf[4*i:], index)
 		}
-		// write a chunk
-		if _, err := output.Write(readBuf[:n]); err != nil {
+		if _, err := out.Write(buf[:4*len(batch)]); err != nil {
 			return err
 		}
-		size -= n
+		list = list[len(batch):]
 	}
 	return nil
 }
@@ -175,7 +254,9 @@ func (s *SnapShim) Flush() error {
 	if err := s.snap.Close(); err != nil {
 		return err
 	}
-	s.out.Flush()
+	if err := s.out.Flush(); err != nil {
+		return err
+	}
 	s.snap.Reset(s.out)
 	return nil
 }
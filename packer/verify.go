@@ -0,0 +1,123 @@
+package packer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// A verification is initiated by one side, which requests a directory on the
+// other side (see RequestPull). The other side responds with its manifest (as
+// in a two-way sync), which the initiator compares with its own. Nothing is
+// transferred or changed on either side.
+// OBS: This is not part of the qvm-copy protocol.
+
+// Difference describes an item which differs between the local and remote
+// trees. A nil entry means that the item is missing on that side.
+type Difference struct {
+	Path   string
+	Local  *ManifestEntry
+	Remote *ManifestEntry
+}
+
+// Change describes the difference as seen from the local side, as the
+// source: "added" if the item only exists locally, "deleted" if it only
+// exists remotely, or else "modified".
+func (d *Difference) Change() string {
+	switch {
+	case d.Remote == nil:
+		return "added"
+	case d.Local == nil:
+		return "deleted"
+	}
+	return "modified"
+}
+
+// Reason describes what differs.
+func (d *Difference) Reason() string {
+	l, r := d.Local, d.Remote
+	switch {
+	case r == nil:
+		return "missing remotely"
+	case l == nil:
+		return "missing locally"
+	case os.FileMode(l.Mode).Type() != os.FileMode(r.Mode).Type():
+		return fmt.Sprintf("type %v != %v", os.FileMode(l.Mode).Type(), os.FileMode(r.Mode).Type())
+	case l.Size != r.Size:
+		return fmt.Sprintf("size %d != %d", l.Size, r.Size)
+	case l.Crc != r.Crc:
+		return fmt.Sprintf("crc %08x != %08x", l.Crc, r.Crc)
+	case !sameMode(l.Mode, r.Mode):
+		return fmt.Sprintf("mode %v != %v", os.FileMode(l.Mode), os.FileMode(r.Mode))
+	default:
+		return fmt.Sprintf("mtime %d != %d", l.Mtime, r.Mtime)
+	}
+}
+
+// compareManifests returns the differences between the manifests, sorted by
+// path. Modification times are compared for regular files and symlinks, not
+// for directories, whose times change as soon as anything within them does.
+func compareManifests(local, remote manifest) []*Difference {
+	var diffs []*Difference
+	for p, l := range local {
+		r := remote[p]
+		if sameEntry(l, r) && (os.FileMode(l.Mode).IsDir() || l.Mtime == r.Mtime) {
+			continue
+		}
+		diffs = append(diffs, &Difference{Path: p, Local: l, Remote: r})
+	}
+	for p, r := range remote {
+		if _, ok := local[p]; !ok {
+			diffs = append(diffs, &Difference{Path: p, Remote: r})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Path < diffs[j].Path })
+	return diffs
+}
+
+// Verify compares the local directory root with the directory dir on the
+// other side, and returns the differences. The trees are identical if there
+// are none.
+func Verify(in io.Reader, out io.Writer, root, dir string) ([]*Difference, error) {
+	bout := bufio.NewWriter(out)
+	if err := RequestPull(bout, dir); err != nil {
+		return nil, err
+	}
+	if err := bout.Flush(); err != nil {
+		return nil, err
+	}
+	local, err := scanManifest(root)
+	if err != nil {
+		return nil, fmt.Errorf("scanning %v failed: %v", root, err)
+	}
+	remote, err := readManifest(in)
+	if err != nil {
+		return nil, fmt.Errorf("receiving manifest failed: %v", err)
+	}
+	return compareManifests(local, remote), nil
+}
+
+// ServeVerify sends the manifest of the directory requested by the other
+// side. The requested directory is resolved by the given function, which is
+// responsible for keeping it within whatever is served.
+func ServeVerify(in io.Reader, out io.Writer, resolve func(dir string) (string, error)) error {
+	dir, err := ReadPullRequest(in)
+	if err != nil {
+		return err
+	}
+	root, err := resolve(dir)
+	if err != nil {
+		return err
+	}
+	m, err := scanManifest(root)
+	if err != nil {
+		return err
+	}
+	bout := bufio.NewWriter(out)
+	if err := writeManifest(bout, m); err != nil {
+		return err
+	}
+	return bout.Flush()
+}
@@ -0,0 +1,344 @@
+package packer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// walkCache keeps the listings of directories between syncs, with the info of
+// their entries, by the identity of each directory: its device, inode,
+// modification and change time. Creating, removing or renaming an entry
+// changes those, so as long as they're unchanged, the entries are taken to be
+// the same, and only the directories among them are statted again, to be
+// descended into. See Options.WalkCache.
+//
+// A file which is modified in place leaves its directory unchanged, so that
+// is only noticed once the listing has expired: a listing is kept for
+// Options.FullWalkEvery, after which the directory is listed and its entries
+// statted again, as in a full walk.
+//
+// On disk, it's a walkCacheHeader, followed by a walkCacheDir for each
+// directory, its path, and a walkCacheEntry and the name of each of its
+// entries. A nil *walkCache is valid, and caches nothing.
+type walkCache struct {
+	path    string
+	every   time.Duration // how long a listing is kept
+	root    string        // the directory synced, see Sender.transmitDirectory
+	old     map[string]*walkDirRecord
+	dirs    map[string]*walkDirRecord // the directories walked this sync
+	reused  int
+	changed bool
+}
+
+// walkDirKey is the identity of a directory.
+type walkDirKey struct {
+	Dev   uint64
+	Ino   uint64
+	Mtime int64 // nanoseconds since the epoch
+	Ctime int64
+}
+
+type walkDirRecord struct {
+	key     walkDirKey
+	listed  int64 // when it was listed, in seconds since the epoch
+	entries []*direntInfo
+}
+
+type walkCacheHeader struct {
+	Magic   [8]byte
+	Version uint32
+	Count   uint32 // the number of directories
+}
+
+type walkCacheDir struct {
+	walkDirKey
+	Listed  int64
+	PathLen uint32
+	Count   uint32 // the number of entries
+}
+
+type walkCacheEntry struct {
+	Dev     uint64
+	Ino     uint64
+	Size    int64
+	Atime   int64 // nanoseconds since the epoch
+	Mtime   int64
+	Mode    uint32 // as in syscall.Stat_t
+	NameLen uint32
+}
+
+const (
+	walkCacheMagic   = "qsyncwc\x00"
+	walkCacheVersion = 1
+	// defaultFullWalk is how long a listing is kept, unless
+	// Options.FullWalkEvery says otherwise.
+	defaultFullWalk = 24 * time.Hour
+)
+
+// openWalkCache reads the cache at path. If it doesn't exist yet, it is
+// empty. If it can't be read, it's empty as well, and the error is returned
+// along with it, since it's no reason for a sync to fail.
+func openWalkCache(path string, every time.Duration) (*walkCache, error) {
+	if every <= 0 {
+		every = defaultFullWalk
+	}
+	c := &walkCache{
+		path:  path,
+		every: every,
+		old:   make(map[string]*walkDirRecord),
+		dirs:  make(map[string]*walkDirRecord),
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+	in := bufio.NewReader(f)
+	var hdr walkCacheHeader
+	if err := binary.Read(in, binary.LittleEndian, &hdr); err != nil {
+		return c, fmt.Errorf("walk cache %v: %v", path, err)
+	}
+	if string(hdr.Magic[:]) != walkCacheMagic || hdr.Version != walkCacheVersion {
+		return c, fmt.Errorf("walk cache %v: unsupported format", path)
+	}
+	for i := uint32(0); i < hdr.Count; i++ {
+		dir, rec, err := readWalkDir(in)
+		if err != nil {
+			c.old = make(map[string]*walkDirRecord)
+			return c, fmt.Errorf("walk cache %v: %v", path, err)
+		}
+		c.old[dir] = rec
+	}
+	return c, nil
+}
+
+func readWalkDir(in io.Reader) (string, *walkDirRecord, error) {
+	var d walkCacheDir
+	if err := binary.Read(in, binary.LittleEndian, &d); err != nil {
+		return "", nil, err
+	}
+	path := make([]byte, d.PathLen)
+	if _, err := io.ReadFull(in, path); err != nil {
+		return "", nil, err
+	}
+	rec := &walkDirRecord{key: d.walkDirKey, listed: d.Listed, entries: make([]*direntInfo, 0, d.Count)}
+	for i := uint32(0); i < d.Count; i++ {
+		var e walkCacheEntry
+		if err := binary.Read(in, binary.LittleEndian, &e); err != nil {
+			return "", nil, err
+		}
+		name := make([]byte, e.NameLen)
+		if _, err := io.ReadFull(in, name); err != nil {
+			return "", nil, err
+		}
+		rec.entries = append(rec.entries, &direntInfo{name: string(name), st: syscall.Stat_t{
+			Dev:  e.Dev,
+			Ino:  e.Ino,
+			Mode: e.Mode,
+			Size: e.Size,
+			Atim: syscall.NsecToTimespec(e.Atime),
+			Mtim: syscall.NsecToTimespec(e.Mtime),
+		}})
+	}
+	return string(path), rec, nil
+}
+
+// dirKey returns the identity of a directory, if it has one.
+func dirKey(info os.FileInfo) (walkDirKey, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.IsDir() {
+		return walkDirKey{}, false
+	}
+	return walkDirKey{
+		Dev:   uint64(st.Dev),
+		Ino:   uint64(st.Ino),
+		Mtime: syscall.TimespecToNsec(st.Mtim),
+		Ctime: syscall.TimespecToNsec(st.Ctim),
+	}, true
+}
+
+// expired returns whether the listing is too old to be used.
+func (c *walkCache) expired(rec *walkDirRecord) bool {
+	return time.Since(time.Unix(rec.listed, 0)) >= c.every
+}
+
+// open lists the directory at path, from the cache if it's unchanged, and
+// otherwise from the filesystem, keeping the listing for the next sync.
+func (c *walkCache) open(path string) (dirList, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := dirKey(info)
+	if rec := c.old[path]; ok && rec != nil && rec.key == key && !c.expired(rec) {
+		if files, err := rec.list(path); err == nil {
+			c.dirs[path] = rec
+			c.reused++
+			return &readDirList{files}, nil
+		}
+	}
+	d, err := openDirReader(path)
+	if err != nil {
+		return nil, err
+	}
+	c.changed = true
+	if !ok || racy(info) {
+		// It could change again without its times changing
+		return d, nil
+	}
+	rec := &walkDirRecord{key: key, listed: time.Now().Unix()}
+	return &walkRecorder{dirReader: d, cache: c, path: path, rec: rec}, nil
+}
+
+// list returns the info of the entries, with that of the directories among
+// them up to date.
+func (rec *walkDirRecord) list(path string) ([]os.FileInfo, error) {
+	files := make([]os.FileInfo, 0, len(rec.entries))
+	for _, e := range rec.entries {
+		if !e.IsDir() {
+			files = append(files, e)
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(path, e.name))
+		if os.IsNotExist(err) {
+			// Removed meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, info)
+	}
+	return files, nil
+}
+
+// walkRecorder lists a directory from the filesystem, and adds the listing to
+// the cache once it's complete.
+type walkRecorder struct {
+	*dirReader
+	cache *walkCache
+	path  string
+	rec   *walkDirRecord
+}
+
+func (w *walkRecorder) next(n int) ([]os.FileInfo, error) {
+	files, err := w.dirReader.next(n)
+	if err == io.EOF {
+		w.cache.dirs[w.path] = w.rec
+	}
+	for _, info := range files {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			w.rec.entries = append(w.rec.entries, &direntInfo{name: info.Name(), st: *st})
+		}
+	}
+	return files, err
+}
+
+// save writes the cache, if anything changed, with the directories walked
+// this sync. Those of other synced directories are kept, until they expire.
+// It's only to be called after a successful sync, so that the directories of
+// a failed one are listed again.
+func (c *walkCache) save(opts *Options) error {
+	if c == nil {
+		return nil
+	}
+	if opts.Verbosity >= 3 {
+		log.Printf("Walk cache: %d of %d directories unchanged", c.reused, len(c.dirs))
+	}
+	for path, rec := range c.old {
+		if _, ok := c.dirs[path]; ok {
+			continue
+		}
+		if c.expired(rec) || path == c.root || strings.HasPrefix(path, strings.TrimSuffix(c.root, "/")+"/") {
+			// Gone, or not walked into any more
+			c.changed = true
+			continue
+		}
+		c.dirs[path] = rec
+	}
+	if !c.changed {
+		return nil
+	}
+	dir := filepath.Dir(c.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".walkcache-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := c.write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path)
+}
+
+func (c *walkCache) write(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	hdr := walkCacheHeader{Version: walkCacheVersion, Count: uint32(len(c.dirs))}
+	copy(hdr.Magic[:], walkCacheMagic)
+	if err := binary.Write(out, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	for path, rec := range c.dirs {
+		d := walkCacheDir{walkDirKey: rec.key, Listed: rec.listed, PathLen: uint32(len(path)), Count: uint32(len(rec.entries))}
+		if err := binary.Write(out, binary.LittleEndian, &d); err != nil {
+			return err
+		}
+		out.WriteString(path)
+		for _, e := range rec.entries {
+			entry := walkCacheEntry{
+				Dev:     uint64(e.st.Dev),
+				Ino:     uint64(e.st.Ino),
+				Size:    e.st.Size,
+				Atime:   syscall.TimespecToNsec(e.st.Atim),
+				Mtime:   syscall.TimespecToNsec(e.st.Mtim),
+				Mode:    e.st.Mode,
+				NameLen: uint32(len(e.name)),
+			}
+			if err := binary.Write(out, binary.LittleEndian, &entry); err != nil {
+				return err
+			}
+			out.WriteString(e.name)
+		}
+	}
+	return out.Flush()
+}
+
+// loadWalkCache opens the cache of a sync, if opts.WalkCache is set and the
+// tree is read from the filesystem. If it can't be read, that's logged, and
+// the sync makes a full walk.
+func loadWalkCache(opts *Options, src source) *walkCache {
+	if _, ok := src.(osSource); !ok || opts.WalkCache == "" {
+		return nil
+	}
+	c, err := openWalkCache(opts.WalkCache, opts.FullWalkEvery)
+	if err != nil && opts.Verbosity >= 2 {
+		log.Printf("Ignoring walk cache: %v", err)
+	}
+	return c
+}
+
+// saveWalkCache saves the cache of a sync. Failing to is only logged.
+func saveWalkCache(c *walkCache, opts *Options) {
+	if err := c.save(opts); err != nil && opts.Verbosity >= 2 {
+		log.Printf("Saving walk cache failed: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package packer
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+var errPoolClosed = errors.New("crc pool closed")
+
+// crcPool computes the crcs of files on several workers, ahead of the sender,
+// which takes them in its own order. See Options.Workers.
+type crcPool struct {
+	src    source
+	cache  *hashCache // where crcs are looked up, and stored
+	mu     sync.Mutex
+	cond   *sync.Cond         // signalled when jobs are queued, or the pool is closed
+	queue  []*crcJob          // jobs not yet started, in the order added
+	jobs   map[string]*crcJob // all jobs not yet taken, by path
+	closed bool
+}
+
+// crcJob is the crc of a file, to be computed by the pool.
+type crcJob struct {
+	path string
+	info os.FileInfo // nil if the worker is to Lstat the file
+	done chan struct{}
+	crc  uint32
+	err  error
+}
+
+// newCrcPool starts the workers of a pool reading from src. The crcs in cache
+// aren't computed again.
+func newCrcPool(src source, cache *hashCache, workers int) *crcPool {
+	p := &crcPool{src: src, cache: cache, jobs: make(map[string]*crcJob)}
+	p.cond = sync.NewCond(&p.mu)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *crcPool) work() {
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		job := p.queue[0]
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+
+		if job.info == nil {
+			job.info, job.err = p.src.Lstat(job.path)
+		}
+		if job.err == nil {
+			var ok bool
+			if job.crc, ok = p.cache.crc(job.info); !ok {
+				job.crc, job.err = crcItem(p.src, job.path, job.info)
+			}
+		}
+		close(job.done)
+	}
+}
+
+// add queues the crc of the file at path, whose info may be nil if it isn't
+// known yet. Items which aren't files, or whose crc is cached, are skipped,
+// unless the info is nil.
+func (p *crcPool) add(path string, info os.FileInfo) {
+	if p == nil || (info != nil && (!info.Mode().IsRegular() || info.Size() == 0)) {
+		return
+	}
+	if info != nil {
+		if _, ok := p.cache.crc(info); ok {
+			return
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.jobs[path]; ok || p.closed {
+		return
+	}
+	job := &crcJob{path: path, info: info, done: make(chan struct{})}
+	p.jobs[path] = job
+	p.queue = append(p.queue, job)
+	p.cond.Signal()
+}
+
+// crc returns the crc of the file at path, as computed by the pool if it was
+// added with the same size and modification time, or computes it otherwise.
+func (p *crcPool) crc(src source, path string, info os.FileInfo) (uint32, error) {
+	var job *crcJob
+	if p != nil {
+		p.mu.Lock()
+		if job = p.jobs[path]; job != nil {
+			delete(p.jobs, path)
+		}
+		p.mu.Unlock()
+	}
+	if job == nil {
+		return crcItem(src, path, info)
+	}
+	<-job.done
+	if job.err != nil || job.info.Size() != info.Size() || !job.info.ModTime().Equal(info.ModTime()) {
+		// It changed meanwhile, or failed, which the sender may handle
+		return crcItem(src, path, info)
+	}
+	return job.crc, nil
+}
+
+// close stops the workers. Jobs not yet started are dropped, and computed by
+// crc instead, if they're still asked for.
+func (p *crcPool) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	for _, job := range p.queue {
+		job.err = errPoolClosed
+		close(job.done)
+	}
+	p.closed = true
+	p.queue = nil
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
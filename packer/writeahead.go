@@ -0,0 +1,411 @@
+package packer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// With ReceiverOptions.WriteAhead, each change the receiver makes below its
+// root is recorded in a write-ahead journal in the state directory, which is
+// synced to disk before the change is made. An item which is replaced, or
+// deleted, is moved aside into the journal's backups rather than removed, so
+// that it can be put back. Once the sync is complete, the journal and the
+// backups are removed.
+//
+// A sync which fails settles the journal right away, and one which is
+// interrupted leaves it behind, for the next receive into the same root to
+// settle before it starts (whether or not it writes ahead itself). With
+// WriteAheadRollback, every change is undone, the last one first, and the tree
+// is as it was before the sync. With WriteAheadComplete, the changes which were
+// made are kept, and only those underway are undone, so that each item is
+// either its old or its new version. Either way, the outcome only depends on
+// the journal. Times and permissions which were set are left as they are.
+
+// The policies of ReceiverOptions.WriteAhead.
+const (
+	WriteAheadRollback = "rollback"
+	WriteAheadComplete = "complete"
+)
+
+const (
+	walFile    = "wal"   // the journal, within StateDir
+	walBackups = "wal.d" // the items moved aside, by sequence number
+)
+
+// The changes recorded in the write-ahead journal.
+const (
+	walCreate  = "create"
+	walReplace = "replace"
+	walDelete  = "delete"
+)
+
+// walRecord is a line in the write-ahead journal: a change about to be made,
+// or, with Done, the note that the change with Seq has been made, or, with
+// Undone, that it failed, and what it did has been undone.
+type walRecord struct {
+	Seq    int         `json:"seq"`
+	Op     string      `json:"op,omitempty"`
+	Path   string      `json:"path,omitempty"` // relative to the root
+	Mode   os.FileMode `json:"mode,omitempty"` // of a directory moved aside, which is made writable to be moved
+	Done   bool        `json:"done,omitempty"`
+	Undone bool        `json:"undone,omitempty"`
+}
+
+// writeAhead is the write-ahead journal of a sync. A nil *writeAhead is
+// valid, and records nothing.
+type writeAhead struct {
+	fs   *rootDir
+	root string
+	f    *os.File
+	mu   sync.Mutex // items are deleted, and files put in place, concurrently
+	seq  int
+}
+
+// checkWriteAhead checks the write-ahead option of ropts.
+func checkWriteAhead(ropts *ReceiverOptions) error {
+	switch ropts.WriteAhead {
+	case "":
+		return nil
+	case WriteAheadRollback, WriteAheadComplete:
+	default:
+		return fmt.Errorf("unknown write-ahead policy %q", ropts.WriteAhead)
+	}
+	if ropts.Transactional || ropts.Archive != nil || ropts.Store != nil {
+		return fmt.Errorf("a write-ahead journal can't be used with a transactional sync, or into an archive or a store")
+	}
+	return nil
+}
+
+// walBackup returns the path an item is moved aside to, by the change with the
+// given sequence number.
+func walBackup(root string, seq int) string {
+	return filepath.Join(root, StateDir, walBackups, strconv.Itoa(seq))
+}
+
+// openWriteAhead starts the write-ahead journal within the root.
+func openWriteAhead(fs *rootDir, root string) (*writeAhead, error) {
+	if err := os.MkdirAll(filepath.Join(root, StateDir, walBackups), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(root, StateDir, walFile), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAhead{fs: fs, root: root, f: f}, nil
+}
+
+// begin records the change op of the item at path, before it's made, and
+// syncs the journal to disk.
+func (w *writeAhead) begin(op, path string, mode os.FileMode) (*walRecord, error) {
+	if w == nil {
+		return nil, nil
+	}
+	rel, err := w.fs.rel(path)
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.seq++
+	rec := &walRecord{Seq: w.seq, Op: op, Path: rel, Mode: mode}
+	if err := w.write(rec); err != nil {
+		return nil, err
+	}
+	if err := w.f.Sync(); err != nil {
+		return nil, fmt.Errorf("write-ahead journal sync failed: %v", err)
+	}
+	return rec, nil
+}
+
+// done records that the change has been made. It isn't synced: a change which
+// isn't known to be done is undone, which leaves the item whole all the same.
+func (w *writeAhead) done(rec *walRecord) error {
+	if rec == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.write(&walRecord{Seq: rec.Seq, Done: true})
+}
+
+// failed records that the change failed, and has been undone, so that what's
+// at its path, e.g. an item in the way, isn't removed when the journal is
+// settled.
+func (w *writeAhead) failed(rec *walRecord) {
+	if rec == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.write(&walRecord{Seq: rec.Seq, Undone: true})
+}
+
+func (w *writeAhead) write(rec *walRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("write-ahead journal write failed: %v", err)
+	}
+	return nil
+}
+
+// readWriteAhead returns the records of the write-ahead journal within the
+// root. A line which is cut short was being written when the receiver was
+// interrupted, so its change wasn't started, and it's the last one read.
+func readWriteAhead(root string) ([]*walRecord, error) {
+	f, err := os.Open(filepath.Join(root, StateDir, walFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var (
+		recs []*walRecord
+		scan = bufio.NewScanner(f)
+	)
+	for scan.Scan() {
+		rec := new(walRecord)
+		if err := json.Unmarshal(scan.Bytes(), rec); err != nil {
+			break
+		}
+		recs = append(recs, rec)
+	}
+	return recs, scan.Err()
+}
+
+// replaceItem makes a change to the item at path, by calling place: what's
+// there already is removed first, or moved aside, when writing ahead.
+func (r *Receiver) replaceItem(path string, place func() error) error {
+	if r.wal == nil {
+		if err := r.fs.RemoveIfExist(path); err != nil {
+			return err
+		}
+		return place()
+	}
+	info, err := r.fs.Lstat(path)
+	if os.IsNotExist(err) {
+		return r.createItem(path, place)
+	}
+	if err != nil {
+		return err
+	}
+	rec, err := r.wal.begin(walReplace, path, dirMode(info))
+	if err != nil {
+		return err
+	}
+	if err := r.moveAside(rec, path, info); err != nil {
+		return err
+	}
+	if err := place(); err != nil {
+		if r.undo(rec) == nil {
+			r.wal.failed(rec)
+		}
+		return err
+	}
+	return r.wal.done(rec)
+}
+
+// createItem creates the item at path, which doesn't exist, by calling place.
+func (r *Receiver) createItem(path string, place func() error) error {
+	rec, err := r.wal.begin(walCreate, path, 0)
+	if err != nil {
+		return err
+	}
+	if err := place(); err != nil {
+		// Nothing was created
+		r.wal.failed(rec)
+		return err
+	}
+	return r.wal.done(rec)
+}
+
+// removeItem deletes the item at path, or moves it aside, when writing ahead.
+func (r *Receiver) removeItem(path string, info os.FileInfo) error {
+	if r.wal == nil {
+		if info.IsDir() {
+			return r.fs.RemoveAll(path)
+		}
+		return r.fs.Remove(path)
+	}
+	rec, err := r.wal.begin(walDelete, path, dirMode(info))
+	if err != nil {
+		return err
+	}
+	if err := r.moveAside(rec, path, info); err != nil {
+		return err
+	}
+	return r.wal.done(rec)
+}
+
+// dirMode returns the mode of the item, if it's a directory, to be restored
+// when it's put back.
+func dirMode(info os.FileInfo) os.FileMode {
+	if info.IsDir() {
+		return info.Mode()
+	}
+	return 0
+}
+
+// moveAside moves the item at path into the backups, for the change rec.
+func (r *Receiver) moveAside(rec *walRecord, path string, info os.FileInfo) error {
+	// A directory is only moved into another with write permission on it
+	if info.IsDir() && info.Mode().Perm()&0200 == 0 {
+		if err := r.fs.Chmod(path, 0700); err != nil {
+			return err
+		}
+	}
+	return r.fs.Rename(path, walBackup(r.root, rec.Seq), false)
+}
+
+// undo undoes the change rec, whether or not it was made in full: what was
+// created is removed, and what was moved aside put back.
+func (r *Receiver) undo(rec *walRecord) error {
+	if rec == nil {
+		return nil
+	}
+	path := filepath.Join(r.root, rec.Path)
+	return r.inParent(path, func() error {
+		if rec.Op == walCreate {
+			return r.removeTree(path)
+		}
+		backup := walBackup(r.root, rec.Seq)
+		if _, err := r.fs.Lstat(backup); os.IsNotExist(err) {
+			// Not moved aside yet
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := r.removeTree(path); err != nil {
+			return err
+		}
+		if err := r.fs.Rename(backup, path, false); err != nil {
+			return err
+		}
+		if rec.Mode != 0 {
+			return r.fs.Chmod(path, rec.Mode)
+		}
+		return nil
+	})
+}
+
+// inParent calls fn with the directory the item at path is in made writable,
+// and its permissions restored afterwards, as they may be set already. If the
+// directory is gone, its own change has been undone, and fn isn't called.
+func (r *Receiver) inParent(path string, fn func() error) error {
+	dir := filepath.Dir(path)
+	info, err := r.fs.Lstat(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0700 == 0700 {
+		return fn()
+	}
+	if err := r.fs.Chmod(dir, 0700); err != nil {
+		return err
+	}
+	err = fn()
+	if cErr := r.fs.Chmod(dir, info.Mode()); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// recoverWriteAhead settles the write-ahead journal left behind by a sync which
+// was interrupted, if any, with the policy of the receiver (WriteAheadRollback
+// if it doesn't write ahead). It returns the number of changes undone.
+func (r *Receiver) recoverWriteAhead() (int, error) {
+	recs, err := readWriteAhead(r.root)
+	if os.IsNotExist(err) {
+		// The backups may be left from a sync which was interrupted
+		// while they were removed
+		return 0, r.removeTree(filepath.Join(r.root, StateDir, walBackups))
+	}
+	if err != nil {
+		return 0, err
+	}
+	policy := r.ropts.WriteAhead
+	if policy == "" {
+		policy = WriteAheadRollback
+	}
+	if r.opts.Verbosity >= 3 {
+		log.Printf("Settling the write-ahead journal of an interrupted sync (%v)", policy)
+	}
+	return r.settle(recs, policy)
+}
+
+// closeWriteAhead ends the write-ahead journal, once the sync is over: it's
+// dropped if the sync succeeded, and settled with the policy of the receiver
+// otherwise. It returns the number of changes undone.
+func (r *Receiver) closeWriteAhead(syncErr error) (int, error) {
+	w := r.wal
+	if w == nil {
+		return 0, nil
+	}
+	// Files may still be being put in place
+	r.waitFinished()
+	r.wal = nil
+	w.f.Close()
+	if syncErr == nil {
+		return 0, r.dropWriteAhead()
+	}
+	recs, err := readWriteAhead(r.root)
+	if err != nil {
+		return 0, err
+	}
+	return r.settle(recs, r.ropts.WriteAhead)
+}
+
+// settle undoes the changes recorded in recs, the last one first: all of them
+// with WriteAheadRollback, and those which weren't done with
+// WriteAheadComplete, except those undone already. The journal is then dropped. If a change can't be
+// undone, the journal is kept, for the next sync to try again.
+func (r *Receiver) settle(recs []*walRecord, policy string) (int, error) {
+	var (
+		done    = make(map[int]bool)
+		failed  = make(map[int]bool)
+		changes []*walRecord
+		undone  int
+	)
+	for _, rec := range recs {
+		switch {
+		case rec.Done:
+			done[rec.Seq] = true
+		case rec.Undone:
+			failed[rec.Seq] = true
+		default:
+			changes = append(changes, rec)
+		}
+	}
+	for i := len(changes) - 1; i >= 0; i-- {
+		rec := changes[i]
+		if failed[rec.Seq] || (done[rec.Seq] && policy == WriteAheadComplete) {
+			continue
+		}
+		if err := r.undo(rec); err != nil {
+			return undone, fmt.Errorf("failed undoing the %v of %v: %v", rec.Op, rec.Path, err)
+		}
+		if r.opts.Verbosity >= 4 {
+			log.Printf("Undid the %v of %v", rec.Op, rec.Path)
+		}
+		undone++
+	}
+	return undone, r.dropWriteAhead()
+}
+
+// dropWriteAhead removes the journal, and then the backups.
+func (r *Receiver) dropWriteAhead() error {
+	if err := os.Remove(filepath.Join(r.root, StateDir, walFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return r.removeTree(filepath.Join(r.root, StateDir, walBackups))
+}
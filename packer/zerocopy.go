@@ -0,0 +1,133 @@
+package packer
+
+import (
+	"errors"
+	"io"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// zeroCopyMin is the smallest file which sendFile sends. For smaller ones, the
+// extra flush costs more than the copy saves.
+const zeroCopyMin = 64 * 1024
+
+// errNoZeroCopy is returned by zeroCopy if the kernel can't copy between the
+// pair, and nothing was copied.
+var errNoZeroCopy = errors.New("zero-copy not supported")
+
+// sendFile sends size bytes of file straight from the kernel to the
+// connection, if the content isn't compressed, and both are file descriptors.
+// It returns false if it didn't, and nothing was sent, in which case the
+// caller copies the file itself.
+func (s *Sender) sendFile(file io.Reader, size int64) (bool, error) {
+	if s.opts.Compression != CompressionOff || size < zeroCopyMin || s.noZeroCopy {
+		return false, nil
+	}
+	out, in := rawConn(s.raw), rawConn(file)
+	if out == nil || in == nil {
+		return false, nil
+	}
+	// The header goes first
+	if err := s.out.Flush(); err != nil {
+		return false, err
+	}
+	n, err := zeroCopy(out, in, size)
+	if err == errNoZeroCopy {
+		// It won't work for the next file either
+		s.noZeroCopy = true
+		return false, nil
+	}
+	if cw, ok := s.out.(*ConfigurableWriter); ok {
+		cw.rawMeter.c += int(n)
+	}
+	if err == io.ErrUnexpectedEOF {
+		// It shrank meanwhile, see copyFile
+		err = padContent(s.out, size-n, nil)
+	}
+	return true, err
+}
+
+// rawConn returns the raw connection of v, if it has a file descriptor.
+func rawConn(v interface{}) syscall.RawConn {
+	sc, ok := v.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	return rc
+}
+
+// zeroCopy copies size bytes from the current offset of in to out within the
+// kernel: with copy_file_range(2) if out is a regular file, and sendfile(2)
+// otherwise, or if the former isn't supported. It returns errNoZeroCopy if
+// neither is.
+func zeroCopy(out, in syscall.RawConn, size int64) (int64, error) {
+	var (
+		written int64
+		err     error
+	)
+	cErr := in.Control(func(infd uintptr) {
+		wErr := out.Write(func(outfd uintptr) bool {
+			var st syscall.Stat_t
+			useRange := syscall.Fstat(int(outfd), &st) == nil && st.Mode&syscall.S_IFMT == syscall.S_IFREG
+			for written < size {
+				chunk := size - written
+				if chunk > 1<<30 {
+					chunk = 1 << 30
+				}
+				var (
+					n     int
+					errno error
+				)
+				if useRange {
+					n, errno = unix.CopyFileRange(int(infd), nil, int(outfd), nil, int(chunk), 0)
+				} else {
+					n, errno = syscall.Sendfile(int(outfd), int(infd), nil, int(chunk))
+				}
+				if n > 0 {
+					written += int64(n)
+				}
+				switch {
+				case errno == syscall.EAGAIN:
+					// Wait for the connection to be writable
+					return false
+				case errno == syscall.EINTR:
+				case errno != nil && written == 0 && unsupported(errno):
+					if !useRange {
+						err = errNoZeroCopy
+						return true
+					}
+					useRange = false
+				case errno != nil:
+					err = errno
+					return true
+				case n == 0:
+					err = io.ErrUnexpectedEOF
+					return true
+				}
+			}
+			return true
+		})
+		if err == nil {
+			err = wErr
+		}
+	})
+	if err == nil {
+		err = cErr
+	}
+	return written, err
+}
+
+// unsupported returns whether errno means that the kernel can't copy between
+// the pair of file descriptors.
+func unsupported(errno error) bool {
+	switch errno {
+	case syscall.ENOSYS, syscall.EINVAL, syscall.EXDEV, syscall.EOPNOTSUPP, syscall.EBADF, syscall.EPERM:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package transport
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/holiman/qvm-sync/packer"
+)
+
+// CommandConn is a connection to the stdin and stdout of a command, e.g. a
+// remote shell running the receiver.
+type CommandConn struct {
+	io.Reader
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// StartCommand starts the command. Its stderr goes to ours.
+func StartCommand(argv []string) (*CommandConn, error) {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &CommandConn{Reader: bufio.NewReader(stdout), WriteCloser: stdin, cmd: cmd}, nil
+}
+
+// Close closes the stdin of the command, and waits for it to exit.
+func (c *CommandConn) Close() error {
+	c.WriteCloser.Close()
+	return c.cmd.Wait()
+}
+
+// Handshake reads the version line of the receiver, and checks that it speaks
+// the given protocol version.
+func (c *CommandConn) Handshake(version int) error {
+	line, err := c.Reader.(*bufio.Reader).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("no version from receiver: %v", err)
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, packer.VersionPrefix) {
+		return fmt.Errorf("unexpected version from receiver: %q", line)
+	}
+	v, err := strconv.Atoi(strings.TrimPrefix(line, packer.VersionPrefix))
+	if err != nil || v != version {
+		return fmt.Errorf("receiver speaks protocol %q, we speak %d", strings.TrimPrefix(line, packer.VersionPrefix), version)
+	}
+	return nil
+}
+
+// remoteCandidates are where the receiver is looked for on the remote side,
+// unless given.
+var remoteCandidates = []string{"qsync-receive", `"$HOME/go/bin/qsync-receive"`, "/usr/local/bin/qsync-receive"}
+
+// SSHCommand returns the command which runs the receiver via the remote shell
+// rsh (e.g. "ssh -p 2222"), on host, within dir (created if missing). The
+// receiver announces its version before it starts, see Handshake.
+func SSHCommand(rsh, host, dir, bin string, args []string) []string {
+	candidates := remoteCandidates
+	if bin != "" {
+		candidates = []string{shellQuote(bin)}
+	}
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	script := fmt.Sprintf(`set -e; mkdir -p %s; cd %s; `+
+		`for b in %s; do if command -v "$b" >/dev/null 2>&1; then "$b" -version; exec "$b" %s; fi; done; `+
+		`echo "qsync-receive not found" >&2; exit 127`,
+		shellQuote(dir), shellQuote(dir), strings.Join(candidates, " "), strings.Join(quoted, " "))
+	return append(strings.Fields(rsh), host, script)
+}
+
+// shellQuote quotes s for the (POSIX) remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
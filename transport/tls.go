@@ -0,0 +1,86 @@
+// Package transport provides connections between sender and receiver, for
+// when they are not connected via qrexec (stdin and stdout).
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+)
+
+// TLSConfig loads the certificate and key of this side, and the CA which the
+// certificate of the other side must be signed by. Both sides authenticate
+// each other: a server requires a client certificate, and a client verifies
+// the certificate of the server.
+func TLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading certificate: %v", err)
+	}
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %v", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// DialTLS connects to the server at addr (host:port), and completes the
+// handshake.
+func DialTLS(addr string, cfg *tls.Config) (net.Conn, error) {
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ListenTLS listens for connections on addr (host:port). The handshake is
+// completed by AcceptTLS.
+func ListenTLS(addr string, cfg *tls.Config) (net.Listener, error) {
+	return tls.Listen("tcp", addr, cfg)
+}
+
+// handshakeTimeout is how long a client gets to complete the handshake. It's
+// a variable for the tests.
+var handshakeTimeout = 30 * time.Second
+
+// AcceptTLS accepts the next connection, and completes the handshake. It
+// returns the connection and the name (common name) of the client.
+// Connections which fail the handshake are closed, and skipped.
+func AcceptTLS(l net.Listener) (net.Conn, string, error) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return nil, "", err
+		}
+		tconn, ok := conn.(*tls.Conn)
+		if !ok {
+			conn.Close()
+			return nil, "", fmt.Errorf("not a tls listener")
+		}
+		// Don't let a silent client block others
+		tconn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tconn.Handshake(); err != nil {
+			log.Printf("TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		tconn.SetDeadline(time.Time{})
+		state := tconn.ConnectionState()
+		return conn, state.PeerCertificates[0].Subject.CommonName, nil
+	}
+}
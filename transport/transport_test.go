@@ -0,0 +1,345 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/holiman/qvm-sync/packer"
+)
+
+// testCA is a certificate authority, issuing certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, der: der}
+}
+
+// writeFiles writes the certificate and key of name, issued by the ca, and
+// the certificate of the ca, to dir, and returns their paths.
+func (ca *testCA) writeFiles(t *testing.T, dir, name string) (certFile, keyFile, caFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(file, typ string, data []byte) string {
+		path := filepath.Join(dir, file)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: data}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	return write(name+".crt", "CERTIFICATE", der), write(name+".key", "EC PRIVATE KEY", keyDer),
+		write(name+"-ca.crt", "CERTIFICATE", ca.der)
+}
+
+func TestTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "transport-tls")
+	defer os.RemoveAll(dir)
+	defer func(d time.Duration) { handshakeTimeout = d }(handshakeTimeout)
+	handshakeTimeout = 200 * time.Millisecond
+
+	ca := newTestCA(t)
+	serverCert, serverKey, caFile := ca.writeFiles(t, dir, "server")
+	serverCfg, err := TLSConfig(serverCert, serverKey, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg, err := TLSConfig(ca.writeFiles(t, dir, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A client whose certificate is signed by another ca, which it trusts
+	// for the server, though
+	rogueCert, rogueKey, _ := newTestCA(t).writeFiles(t, dir, "mallory")
+	rogueCfg, err := TLSConfig(rogueCert, rogueKey, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TLSConfig(rogueCert, rogueKey, serverKey); err == nil {
+		t.Errorf("ca without certificates accepted")
+	}
+
+	l, err := ListenTLS("127.0.0.1:0", serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	type accepted struct {
+		name string
+		err  error
+	}
+	acceptc := make(chan accepted, 1)
+	go func() {
+		conn, name, err := AcceptTLS(l)
+		if err == nil {
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+		acceptc <- accepted{name, err}
+	}()
+	addr := l.Addr().String()
+	buf := make([]byte, 2)
+
+	// The rogue client is rejected. With TLS 1.3, the client's handshake
+	// completes before the server checks its certificate: the first read
+	// fails then.
+	conn, err := DialTLS(addr, rogueCfg)
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(buf)
+		conn.Close()
+	}
+	if err == nil {
+		t.Errorf("client without a certificate of the ca accepted")
+	}
+	// A silent client is dropped after the handshake timeout
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if n, err := raw.Read(buf); err == nil {
+		t.Errorf("silent client got %d bytes", n)
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Errorf("silent client not dropped")
+	}
+	if d := time.Since(start); d < handshakeTimeout/2 {
+		t.Errorf("silent client dropped after %v", d)
+	}
+	raw.Close()
+	// The client with a certificate of the ca gets through, by its name
+	conn, err = DialTLS(addr, clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(buf); err != nil || string(buf) != "ok" {
+		t.Errorf("read %q: %v", buf, err)
+	}
+	if got := <-acceptc; got.err != nil || got.name != "alice" {
+		t.Errorf("accepted %q: %v", got.name, got.err)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	c, err := StartCommand([]string{"cat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	c.WriteCloser.Close()
+	if data, err := ioutil.ReadAll(c); err != nil || string(data) != "hello" {
+		t.Errorf("read %q: %v", data, err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("close: %v", err)
+	}
+
+	// The exit status of a command which fails comes back from Close
+	c, err = StartCommand([]string{"sh", "-c", "exit 3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Close()
+	if ee, ok := err.(*exec.ExitError); !ok || ee.ExitCode() != 3 {
+		t.Errorf("close: %v, want exit status 3", err)
+	}
+	if _, err := StartCommand([]string{"/nonexistent/command"}); err == nil {
+		t.Errorf("missing command started")
+	}
+}
+
+func TestCommandHandshake(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		ok   bool
+	}{
+		{fmt.Sprintf("%s%d", packer.VersionPrefix, packer.Version), true},
+		{fmt.Sprintf("%s%d", packer.VersionPrefix, packer.Version+1), false},
+		{"qsync-receive not found", false},
+		{"", false},
+	} {
+		c, err := StartCommand([]string{"echo", tt.line})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Handshake(packer.Version); (err == nil) != tt.ok {
+			t.Errorf("%q: handshake %v", tt.line, err)
+		}
+		c.Close()
+	}
+}
+
+func TestParseVsockAddr(t *testing.T) {
+	for _, tt := range []struct {
+		addr      string
+		cid, port uint32
+	}{
+		{"3:1024", 3, 1024},
+		{"host:52", VsockCidHost, 52},
+		{"4294967295:1", VsockCidAny, 1},
+	} {
+		cid, port, err := ParseVsockAddr(tt.addr)
+		if err != nil || cid != tt.cid || port != tt.port {
+			t.Errorf("%q: got %d:%d, %v, want %d:%d", tt.addr, cid, port, err, tt.cid, tt.port)
+		}
+	}
+	for _, addr := range []string{"", "1024", "3:", ":1024", "guest:1024", "3:port", "-1:1024", "4294967296:1", "3:4294967296"} {
+		if cid, port, err := ParseVsockAddr(addr); err == nil {
+			t.Errorf("%q: invalid address parsed as %d:%d", addr, cid, port)
+		}
+	}
+}
+
+func TestVsock(t *testing.T) {
+	l, err := ListenVsock(0x7fff1234)
+	if err != nil {
+		t.Skipf("no vsock: %v", err)
+	}
+	defer l.Close()
+	errc := make(chan error, 1)
+	go func() {
+		conn, _, err := l.Accept()
+		if err == nil {
+			_, err = conn.Write([]byte("ok"))
+			conn.Close()
+		}
+		errc <- err
+	}()
+	// The local CID, with vsock_loopback
+	conn, err := DialVsock(1, l.Port())
+	if err != nil {
+		t.Skipf("no vsock loopback: %v", err)
+	}
+	defer conn.Close()
+	if data, err := ioutil.ReadAll(conn); err != nil || string(data) != "ok" {
+		t.Errorf("read %q: %v", data, err)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("accept: %v", err)
+	}
+}
+
+func TestUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qsync.sock")
+	l, err := ListenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Accessible by the owner only
+	if info, err := os.Lstat(path); err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v: %v", info.Mode(), err)
+	}
+	type accepted struct {
+		uid uint32
+		err error
+	}
+	acceptc := make(chan accepted, 1)
+	go func() {
+		conn, uid, err := AcceptUnix(l)
+		if err == nil {
+			_, err = conn.Write([]byte("ok"))
+			conn.Close()
+		}
+		acceptc <- accepted{uid, err}
+	}()
+	conn, err := DialUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(conn); err != nil || string(data) != "ok" {
+		t.Errorf("read %q: %v", data, err)
+	}
+	conn.Close()
+	if got := <-acceptc; got.err != nil || got.uid != uint32(os.Getuid()) {
+		t.Errorf("accepted uid %d: %v", got.uid, got.err)
+	}
+	// The socket goes away with the listener
+	l.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket left behind: %v", err)
+	}
+	// One left behind by a listener which died is replaced
+	l, err = ListenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	if l, err = ListenUnix(path); err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	l.Close()
+	// Anything else in its place is left alone
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenUnix(path); err == nil {
+		t.Errorf("listening in place of a file")
+	}
+	if _, err := os.Lstat(path); err != nil {
+		t.Errorf("file removed: %v", err)
+	}
+}
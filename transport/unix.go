@@ -0,0 +1,83 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// ListenUnix listens for connections on the unix socket at path. A socket
+// left behind by an earlier listener is replaced. The socket is created
+// accessible by the owner only; loosen it with chmod (or use socket
+// activation) to let others sync.
+func ListenUnix(path string) (*net.UnixListener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+}
+
+// ActivatedListener returns the unix socket passed by systemd socket
+// activation, or nil if there is none. Only a single socket is supported.
+func ActivatedListener() (*net.UnixListener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	if n := os.Getenv("LISTEN_FDS"); n != "1" {
+		return nil, fmt.Errorf("expected one activated socket, got %q", n)
+	}
+	// Not for our children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// The first passed fd is 3, see sd_listen_fds(3)
+	f := os.NewFile(3, "activated-socket")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	ul, ok := l.(*net.UnixListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("activated socket is not a unix socket (%v)", l.Addr())
+	}
+	return ul, nil
+}
+
+// AcceptUnix accepts the next connection, and returns it along with the uid
+// of the peer process, as told by the kernel (SO_PEERCRED).
+func AcceptUnix(l *net.UnixListener) (*net.UnixConn, uint32, error) {
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		return nil, 0, err
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	var cred *syscall.Ucred
+	if cErr := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); cErr != nil {
+		err = cErr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, 0, fmt.Errorf("peer credentials: %v", err)
+	}
+	return conn, cred.Uid, nil
+}
+
+// DialUnix connects to the listener at the unix socket path.
+func DialUnix(path string) (*net.UnixConn, error) {
+	return net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+}
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The syscall package knows nothing about vsock, so the sockets are handled
+// with golang.org/x/sys, which does.
+const (
+	// VsockCidAny binds a listener to any CID of this machine.
+	VsockCidAny = unix.VMADDR_CID_ANY
+	// VsockCidHost is the CID of the host, as seen from a guest.
+	VsockCidHost = unix.VMADDR_CID_HOST
+)
+
+// ParseVsockAddr parses a vsock address, cid:port. The cid may also be
+// "host", for the host of a guest.
+func ParseVsockAddr(addr string) (cid, port uint32, err error) {
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("invalid vsock address %q, expected cid:port", addr)
+	}
+	if addr[:i] == "host" {
+		cid = VsockCidHost
+	} else if cid, err = parseUint32(addr[:i]); err != nil {
+		return 0, 0, fmt.Errorf("invalid vsock cid %q: %v", addr[:i], err)
+	}
+	if port, err = parseUint32(addr[i+1:]); err != nil {
+		return 0, 0, fmt.Errorf("invalid vsock port %q: %v", addr[i+1:], err)
+	}
+	return cid, port, nil
+}
+
+func parseUint32(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 10, 32)
+	return uint32(v), err
+}
+
+// vsockSocket creates a vsock stream socket.
+func vsockSocket() (int, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("vsock socket failed: %v", err)
+	}
+	return fd, nil
+}
+
+// vsockFile wraps a connected socket. The socket is made non-blocking, so the
+// file uses the runtime poller like other connections.
+func vsockFile(fd int, cid, port uint32) (*os.File, error) {
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), fmt.Sprintf("vsock:%d:%d", cid, port)), nil
+}
+
+// DialVsock connects to the listener on port, on the machine with the given
+// CID.
+func DialVsock(cid, port uint32) (*os.File, error) {
+	fd, err := vsockSocket()
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("vsock connect to %d:%d failed: %v", cid, port, err)
+	}
+	return vsockFile(fd, cid, port)
+}
+
+// VsockListener listens for vsock connections.
+type VsockListener struct {
+	fd   int
+	port uint32
+}
+
+// ListenVsock listens for connections on port, from any CID.
+func ListenVsock(port uint32) (*VsockListener, error) {
+	fd, err := vsockSocket()
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: VsockCidAny, Port: port}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("vsock bind to port %d failed: %v", port, err)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("vsock listen failed: %v", err)
+	}
+	return &VsockListener{fd: fd, port: port}, nil
+}
+
+// Accept waits for the next connection. It returns the connection and the
+// CID of the peer. The CID is assigned by the hypervisor, so unlike an ip
+// address, a guest can't pick it.
+func (l *VsockListener) Accept() (*os.File, uint32, error) {
+	for {
+		nfd, sa, err := unix.Accept4(l.fd, unix.SOCK_CLOEXEC)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("vsock accept failed: %v", err)
+		}
+		vm, ok := sa.(*unix.SockaddrVM)
+		if !ok {
+			unix.Close(nfd)
+			return nil, 0, fmt.Errorf("vsock accept returned a %T", sa)
+		}
+		f, err := vsockFile(nfd, vm.CID, vm.Port)
+		if err != nil {
+			return nil, 0, err
+		}
+		return f, vm.CID, nil
+	}
+}
+
+// Port returns the port the listener is bound to.
+func (l *VsockListener) Port() uint32 {
+	return l.port
+}
+
+// Close stops listening.
+func (l *VsockListener) Close() error {
+	return syscall.Close(l.fd)
+}